@@ -0,0 +1,170 @@
+#!/bin/bash
+#
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this
+# file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+#
+# Runs the integration conformance suite against a Simple Push server for
+# each store and locator combination. etcd and the backends for the selected
+# stores (memcached, Redis, and PostgreSQL) run in Docker containers, which
+# are removed when the script exits. Run from the project root after
+# `make simplepush`, or via `make integration`.
+#
+# Environment:
+#   GO          Go command; defaults to "go".
+#   STORES      Stores to test; defaults to "memcache_memcachego redis
+#               postgres". Add "memcache_gomc" if the server was built with
+#               libmemcached.
+#   LOCATORS    Locators to test; defaults to "static etcd".
+
+set -e
+
+GO=${GO:-go}
+STORES=${STORES:-memcache_memcachego redis postgres}
+LOCATORS=${LOCATORS:-static etcd}
+PACKAGE=github.com/mozilla-services/pushgo/integration
+MEMCACHED_PORT=21211
+REDIS_PORT=16379
+POSTGRES_PORT=25432
+ETCD_PORT=24001
+
+wd=`pwd`
+tmp=`mktemp -d -t pushgo-integration.XXXXXX`
+containers=()
+server=''
+
+cleanup(){
+    if [ -n "$server" ]; then
+        kill $server 2>/dev/null || true
+        wait $server 2>/dev/null || true
+    fi
+    if [ ${#containers[@]} -gt 0 ]; then
+        docker rm -f ${containers[@]} >/dev/null
+    fi
+    rm -rf $tmp
+}
+trap cleanup EXIT
+
+# wait_for polls a URL until it responds, or gives up after 30 seconds.
+wait_for(){
+    for i in `seq 1 30`; do
+        if curl -sf "$1" >/dev/null; then
+            return 0
+        fi
+        sleep 1
+    done
+    echo "Timed out waiting for $1"
+    return 1
+}
+
+# wait_for_exec runs a command in a container until it succeeds, or gives up
+# after 30 seconds.
+wait_for_exec(){
+    container=$1
+    shift
+    for i in `seq 1 30`; do
+        if docker exec $container "$@" >/dev/null 2>&1; then
+            return 0
+        fi
+        sleep 1
+    done
+    echo "Timed out waiting for $*"
+    return 1
+}
+
+# uses_store indicates whether any of the stores under test match $1.
+uses_store(){
+    for store in $STORES; do
+        case "$store" in
+            $1) return 0 ;;
+        esac
+    done
+    return 1
+}
+
+echo Starting dependencies...
+containers+=(`docker run -d -p $ETCD_PORT:4001 quay.io/coreos/etcd:v0.4.6`)
+if uses_store 'memcache_*'; then
+    containers+=(`docker run -d -p $MEMCACHED_PORT:11211 memcached:1.4`)
+fi
+if uses_store redis; then
+    redis=`docker run -d -p $REDIS_PORT:6379 redis:3.0`
+    containers+=($redis)
+    wait_for_exec $redis redis-cli ping
+fi
+if uses_store postgres; then
+    postgres=`docker run -d -p $POSTGRES_PORT:5432 -e POSTGRES_DB=pushgo \
+        postgres:9.5`
+    containers+=($postgres)
+    # The image restarts the server after initializing the database, and
+    # only listens on TCP once it's ready.
+    wait_for_exec $postgres pg_isready -h localhost -U postgres
+fi
+wait_for http://localhost:$ETCD_PORT/version
+
+failed=0
+for store in $STORES; do
+    for locator in $LOCATORS; do
+        echo ">> store=$store locator=$locator"
+        config=$tmp/config.$store.$locator.toml
+        if [ "$locator" == "etcd" ]; then
+            discovery="dir = \"pushgo_integration\"
+servers = [\"http://localhost:$ETCD_PORT\"]"
+        else
+            discovery='contacts = []'
+        fi
+        case "$store" in
+            redis)
+                storage="[storage.redis]
+server = \"localhost:$REDIS_PORT\""
+                ;;
+            postgres)
+                storage="url = \"postgres://postgres@localhost:$POSTGRES_PORT/pushgo?sslmode=disable\""
+                ;;
+            *)
+                storage="[storage.memcache]
+server = [\"localhost:$MEMCACHED_PORT\"]"
+                ;;
+        esac
+        cat > $config <<CONFIG
+[default]
+current_host = "localhost"
+resolve_host = false
+
+[websocket.listener]
+addr = ":28080"
+
+[endpoint.listener]
+addr = ":28081"
+
+[router.listener]
+addr = ":23000"
+
+[storage]
+type = "$store"
+$storage
+
+[discovery]
+type = "$locator"
+$discovery
+
+[logging]
+type = "stdout"
+format = "text"
+filter = 3
+CONFIG
+        ./simplepush -config=$config > $tmp/server.$store.$locator.log 2>&1 &
+        server=$!
+        wait_for http://localhost:28081/status/
+        if ! PUSHGO_INTEGRATION_ORIGIN=ws://localhost:28080 \
+            GOPATH=$wd/.godeps:$wd $GO test -v -tags integration $PACKAGE; then
+            echo "!! store=$store locator=$locator failed; server log:"
+            cat $tmp/server.$store.$locator.log
+            failed=1
+        fi
+        kill $server
+        wait $server 2>/dev/null || true
+        server=''
+    done
+done
+exit $failed
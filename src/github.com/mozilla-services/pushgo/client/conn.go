@@ -601,10 +601,14 @@ func decodeHelo(c *Conn, fields Fields, statusCode int, errorText string) (Packe
 		return nil, &IncompleteError{"hello", c.Origin(), "uaid"}
 	}
 	redirect, _ := fields["redirect"].(string)
+	pingInterval, _ := fields["pingInterval"].(float64)
+	maxSilence, _ := fields["maxSilence"].(float64)
 	reply := ServerHelo{
-		StatusCode: statusCode,
-		DeviceId:   deviceId,
-		Redirect:   redirect,
+		StatusCode:   statusCode,
+		DeviceId:     deviceId,
+		Redirect:     redirect,
+		PingInterval: time.Duration(pingInterval) * time.Second,
+		MaxSilence:   time.Duration(maxSilence) * time.Second,
 	}
 	return reply, nil
 }
@@ -657,7 +661,8 @@ func decodeNotification(c *Conn, fields Fields, statusCode int, errorText string
 		if version, ok = update["version"].(float64); !ok {
 			return nil, &IncompleteError{"notification", c.Origin(), "version"}
 		}
-		packet = append(packet, Update{channelId, int64(version)})
+		data, _ := update["data"].(string)
+		packet = append(packet, Update{channelId, int64(version), data})
 	}
 	return packet, nil
 }
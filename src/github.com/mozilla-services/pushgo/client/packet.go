@@ -6,6 +6,7 @@ package client
 
 import (
 	"encoding/json"
+	"time"
 )
 
 type (
@@ -92,6 +93,7 @@ type clientPacket interface {
 type Update struct {
 	ChannelId string `json:"channelID"`
 	Version   int64  `json:"version"`
+	Data      string `json:"data,omitempty"`
 }
 
 func NewHelo(deviceId string, channelIds []string) Request {
@@ -129,9 +131,11 @@ func (ch ClientHelo) MarshalJSON() ([]byte, error) {
 }
 
 type ServerHelo struct {
-	StatusCode int
-	DeviceId   string
-	Redirect   string
+	StatusCode   int
+	DeviceId     string
+	Redirect     string
+	PingInterval time.Duration // Advertised keep-alive interval, if any.
+	MaxSilence   time.Duration // Maximum time between packets, if any.
 }
 
 func (ServerHelo) Type() PacketType   { return Helo }
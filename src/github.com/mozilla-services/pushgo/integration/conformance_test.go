@@ -0,0 +1,114 @@
+// +build integration
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+// Package integration contains a conformance suite that runs against a live
+// Simple Push server. The server's WebSocket origin is read from the
+// PUSHGO_INTEGRATION_ORIGIN environment variable. See integration.bash in
+// the project root, which runs the suite for each store and locator.
+package integration
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/pushgo/client"
+	"github.com/mozilla-services/pushgo/id"
+)
+
+// origin returns the WebSocket origin of the server under test.
+func origin(t *testing.T) string {
+	origin := os.Getenv("PUSHGO_INTEGRATION_ORIGIN")
+	if len(origin) == 0 {
+		t.Skip("PUSHGO_INTEGRATION_ORIGIN not set; skipping")
+	}
+	return origin
+}
+
+// readBatch reads a batch of updates, failing the test if none arrive
+// before the timeout.
+func readBatch(t *testing.T, conn *client.Conn) []client.Update {
+	batchChan := make(chan []client.Update, 1)
+	go func() {
+		updates, err := conn.ReadBatch()
+		if err != nil && err != io.EOF {
+			t.Errorf("Error reading updates: %s", err)
+		}
+		batchChan <- updates
+	}()
+	select {
+	case updates := <-batchChan:
+		return updates
+	case <-time.After(15 * time.Second):
+		t.Fatalf("Timed out waiting for updates")
+	}
+	return nil
+}
+
+func TestPushThrough(t *testing.T) {
+	// Send 50 updates on 3 channels.
+	if err := client.DoTest(origin(t), 3, 50); err != nil {
+		t.Fatalf("Conformance test failed: %s", err)
+	}
+}
+
+func TestResumeDevice(t *testing.T) {
+	conn, deviceID, err := client.Dial(origin(t))
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	channelID, endpoint, err := conn.Subscribe()
+	if err != nil {
+		conn.Close()
+		t.Fatalf("Error subscribing to channel: %s", err)
+	}
+	conn.Close()
+
+	// Updates sent while the device is offline should be stored, and
+	// delivered when it reconnects with the same device ID.
+	if err = client.Notify(endpoint, 42); err != nil {
+		t.Fatalf("Error sending update to offline device: %s", err)
+	}
+	actualID := deviceID
+	if conn, err = client.DialId(origin(t), &actualID, channelID); err != nil {
+		t.Fatalf("Error reconnecting device: %s", err)
+	}
+	defer conn.Close()
+	if actualID != deviceID {
+		t.Fatalf("Device ID changed on reconnect: got %q; want %q",
+			actualID, deviceID)
+	}
+	updates := readBatch(t, conn)
+	if len(updates) != 1 || updates[0].ChannelId != channelID ||
+		updates[0].Version != 42 {
+		t.Fatalf("Unexpected updates after reconnect: %#v", updates)
+	}
+	if err = conn.AcceptBatch(updates); err != nil {
+		t.Fatalf("Error acknowledging updates: %s", err)
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	conn, _, err := client.Dial(origin(t))
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	defer conn.Close()
+	channelID, err := id.Generate()
+	if err != nil {
+		t.Fatalf("Error generating channel ID: %s", err)
+	}
+	if _, err = conn.Register(channelID); err != nil {
+		t.Fatalf("Error registering channel: %s", err)
+	}
+	if err = conn.Unregister(channelID); err != nil {
+		t.Fatalf("Error unregistering channel: %s", err)
+	}
+	if conn.Registered(channelID) {
+		t.Fatalf("Channel %q still registered", channelID)
+	}
+}
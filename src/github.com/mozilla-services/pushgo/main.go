@@ -14,6 +14,7 @@ import (
 	"runtime/pprof"
 	"syscall"
 
+	_ "github.com/mozilla-services/pushgo/pkg/push" // "process" backends.
 	"github.com/mozilla-services/pushgo/simplepush"
 )
 
@@ -73,25 +74,45 @@ func main() {
 	log.Printf("CurrentHost: %s, Version: %s", app.Hostname(), simplepush.VERSION)
 
 	// wait for sigint
-	sigChan := make(chan os.Signal)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGHUP, SIGUSR1)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP,
+		SIGUSR1)
 
 	// And we're underway!
 	errChan := app.Run()
 
 	logger := app.Logger()
 	exitCode := 0
-	select {
-	case err = <-errChan:
-		exitCode = 1
-		if logger.ShouldLog(simplepush.ERROR) {
-			logger.Error("main", "Run encountered an error; shutting down.",
-				simplepush.LogFields{"error": err.Error()})
-		}
+	for running := true; running; {
+		select {
+		case err = <-errChan:
+			exitCode = 1
+			running = false
+			if logger.ShouldLog(simplepush.ERROR) {
+				logger.Error("main", "Run encountered an error; shutting down.",
+					simplepush.LogFields{"error": err.Error()})
+			}
 
-	case <-sigChan:
-		if logger.ShouldLog(simplepush.INFO) {
-			logger.Info("main", "Recieved signal, shutting down.", nil)
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				// Apply changed settings without restarting. Errors are logged
+				// by the reloader.
+				if logger.ShouldLog(simplepush.INFO) {
+					logger.Info("main", "Received SIGHUP; reloading configuration.",
+						simplepush.LogFields{"config": *configFile})
+				}
+				app.ConfigReloader().ReloadFile(*configFile)
+				continue
+			}
+			running = false
+			if logger.ShouldLog(simplepush.INFO) {
+				logger.Info("main", "Recieved signal, shutting down.",
+					simplepush.LogFields{"signal": sig.String()})
+			}
+			if sig == syscall.SIGTERM {
+				// Ask clients to reconnect elsewhere before closing connections.
+				app.Drain()
+			}
 		}
 	}
 	if err = app.Close(); err != nil {
@@ -0,0 +1,20 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package push
+
+// Balancer redirects connecting clients to other servers when this server is
+// overloaded.
+type Balancer interface {
+	// RedirectURL returns the WebSocket URL of a server that should accept
+	// the client instead. ok indicates whether the client should be
+	// redirected.
+	RedirectURL() (origin string, ok bool, err error)
+
+	// Status indicates whether the balancer is healthy.
+	Status() (ok bool, err error)
+
+	// Close releases the balancer's resources.
+	Close() error
+}
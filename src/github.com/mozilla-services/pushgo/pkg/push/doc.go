@@ -0,0 +1,55 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+Package push is the stable public API of the Simple Push server. It lets
+other programs embed the server, and provide custom storage and
+proprietary ping backends, without depending on the simplepush package,
+whose exported identifiers change between releases.
+
+Backends register a factory under a type name, usually from an init
+function, and are selected with the "type" keyword of their configuration
+section:
+
+	func init() {
+		push.RegisterStore("postgres", func() push.Store { return new(Store) })
+	}
+
+	[storage]
+	type = "postgres"
+
+A backend with settings implements Configurable. Its section, except for
+the type keyword, is decoded into the value returned by ConfigStruct, with
+the same environment overrides as the built-in backends.
+
+Backends can also run in a separate plugin process, so that they can be
+deployed without rebuilding the server. The plugin's main function calls
+ServeStore, ServePinger, or ServeBalancer, and the backend is selected
+with the "process" type:
+
+	[storage]
+	type = "process"
+	command = "/usr/libexec/pushgo/postgres-store"
+	[storage.settings]
+	url = "postgres://localhost/push"
+
+The settings table is decoded into the plugin's ConfigStruct. Plugins log
+and record metrics through their Context, as in-process backends do.
+
+The package follows semantic versioning, independently of the server
+version; APIVersion is the current version. Within a major version:
+
+  - Exported identifiers are not removed or renamed, and function and
+    method signatures do not change.
+  - Methods are not added to interfaces that backends implement. New
+    capabilities are added as optional interfaces, detected with a type
+    assertion, so existing backends keep compiling and keep their behavior.
+  - Fields may be added to structs; use keyed composite literals.
+  - Configuration keys accepted by a backend are decoded as documented by
+    the backend; the server does not reinterpret them.
+
+Anything not exported by this package, including the simplepush package,
+is internal and may change in any release.
+*/
+package push
@@ -0,0 +1,27 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package push
+
+// Pinger wakes devices that aren't connected through a proprietary ping
+// service, such as GCM or APNs.
+type Pinger interface {
+	// Register stores the device's ping registration, sent by the device in
+	// its handshake. The format is defined by the pinger.
+	Register(deviceID string, pingData []byte) error
+
+	// Send pings a device with an update for a channel. ok indicates
+	// whether the device was pinged.
+	Send(deviceID string, version int64, data string) (ok bool, err error)
+
+	// CanBypassWebsocket indicates whether pinged devices receive updates
+	// through the ping service, instead of connecting to the server.
+	CanBypassWebsocket() bool
+
+	// Status indicates whether the ping service is healthy.
+	Status() (ok bool, err error)
+
+	// Close releases the pinger's resources.
+	Close() error
+}
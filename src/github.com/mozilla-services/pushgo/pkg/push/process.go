@@ -0,0 +1,427 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package push
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os/exec"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoPluginCommand = errors.New("push: Missing plugin command")
+	ErrPluginTimeout   = errors.New("push: Plugin call timed out")
+)
+
+// The "process" type runs a backend in an external plugin process, so that
+// proprietary backends can be deployed without rebuilding the server. The
+// plugin's main function calls ServeStore, ServePinger, or ServeBalancer.
+//
+//	[storage]
+//	type = "process"
+//	command = "/usr/libexec/pushgo/ldap-store"
+//	args = ["-v"]
+//	timeout = "5s"
+//	[storage.settings]
+//	url = "ldap://localhost"
+//
+// The settings table is decoded into the plugin's ConfigStruct. The plugin
+// is started when the server loads its configuration, and stopped when the
+// server closes; if it exits early, calls fail until the server restarts.
+func init() {
+	RegisterStore("process", func() Store {
+		return &processStore{process{kind: "store"}}
+	})
+	RegisterPinger("process", func() Pinger {
+		return &processPinger{process{kind: "pinger"}}
+	})
+	RegisterBalancer("process", func() Balancer {
+		return &processBalancer{process{kind: "balancer"}}
+	})
+}
+
+type processConfig struct {
+	Command  string                 `toml:"command" env:"command"`
+	Args     []string               `toml:"args" env:"args"`
+	Timeout  string                 `toml:"timeout" env:"timeout"`
+	Settings map[string]interface{} `toml:"settings"`
+}
+
+// process is a connection to an external plugin.
+type process struct {
+	kind      string
+	command   string
+	ctx       *Context
+	cmd       *exec.Cmd
+	client    *rpc.Client
+	timeout   time.Duration
+	eraser    bool
+	exporter  bool
+	exited    chan bool
+	closeOnce sync.Once
+}
+
+func (p *process) ConfigStruct() interface{} {
+	return &processConfig{Timeout: "5s"}
+}
+
+func (p *process) Configure(ctx *Context, config interface{}) (err error) {
+	conf := config.(*processConfig)
+	if len(conf.Command) == 0 {
+		return ErrNoPluginCommand
+	}
+	if p.timeout, err = time.ParseDuration(conf.Timeout); err != nil {
+		return fmt.Errorf("push: Invalid plugin timeout %q: %s",
+			conf.Timeout, err)
+	}
+	p.ctx = ctx
+	p.command = conf.Command
+	if err = p.start(conf.Args); err != nil {
+		return fmt.Errorf("push: Error starting plugin %q: %s", p.command, err)
+	}
+	args := &handshakeArgs{
+		APIVersion: APIVersion,
+		Kind:       p.kind,
+		Hostname:   ctx.Hostname,
+		LogLevel:   logLevel(ctx.Logger),
+		Settings:   conf.Settings,
+	}
+	reply := new(handshakeReply)
+	if err = p.call("Plugin.Handshake", args, reply); err == nil {
+		err = checkVersion(reply.APIVersion)
+	}
+	if err != nil {
+		p.stop()
+		return fmt.Errorf("push: Error configuring plugin %q: %s", p.command, err)
+	}
+	p.eraser, p.exporter = reply.Eraser, reply.Exporter
+	return nil
+}
+
+func (p *process) start(args []string) error {
+	p.cmd = exec.Command(p.command, args...)
+	stdin, err := p.cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := p.cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err = p.cmd.Start(); err != nil {
+		return err
+	}
+	p.exited = make(chan bool)
+	go p.run(stderr)
+	p.client = jsonrpc.NewClient(pipe{stdout, stdin})
+	return nil
+}
+
+// run relays events from the plugin until it exits.
+func (p *process) run(stderr io.Reader) {
+	defer close(p.exited)
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		p.handleEvent(scanner.Bytes())
+	}
+	if err := scanner.Err(); err != nil && p.ctx.Logger.ShouldLog(Error) {
+		p.ctx.Logger.Log(Error, "plugin", "Error reading plugin events",
+			map[string]string{"cmd": p.command, "error": err.Error()})
+	}
+	// Wait closes the pipes, which stops the RPC client.
+	err := p.cmd.Wait()
+	if p.ctx.Logger.ShouldLog(Notice) {
+		fields := map[string]string{"cmd": p.command}
+		if err != nil {
+			fields["error"] = err.Error()
+		}
+		p.ctx.Logger.Log(Notice, "plugin", "Plugin exited", fields)
+	}
+}
+
+func (p *process) handleEvent(line []byte) {
+	e := new(event)
+	if err := json.Unmarshal(line, e); err != nil || len(e.Type) == 0 {
+		if p.ctx.Logger.ShouldLog(Info) {
+			p.ctx.Logger.Log(Info, "plugin", "Plugin output",
+				map[string]string{"cmd": p.command, "line": string(line)})
+		}
+		return
+	}
+	switch e.Type {
+	case eventLog:
+		if p.ctx.Logger.ShouldLog(e.Level) {
+			p.ctx.Logger.Log(e.Level, e.Component, e.Message, e.Fields)
+		}
+	case eventCounter:
+		p.ctx.Metrics.IncrementBy(e.Name, e.Value)
+	case eventGauge:
+		p.ctx.Metrics.Gauge(e.Name, e.Value)
+	case eventTimer:
+		p.ctx.Metrics.Timer(e.Name, time.Duration(e.Value))
+	}
+}
+
+// call calls a plugin method, waiting up to the configured timeout. reply
+// is a pointer, or nil if the method doesn't return a value. The response is
+// decoded into a copy of reply, so that a call that times out can't write
+// to reply after call returns.
+func (p *process) call(method string, args, reply interface{}) error {
+	var result reflect.Value
+	var resultReply interface{}
+	if reply != nil {
+		result = reflect.New(reflect.TypeOf(reply).Elem())
+		resultReply = result.Interface()
+	}
+	call := p.client.Go(method, args, resultReply, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return decodeError(call.Error)
+		}
+		if reply != nil {
+			reflect.ValueOf(reply).Elem().Set(result.Elem())
+		}
+		return nil
+	case <-timer.C:
+		return ErrPluginTimeout
+	}
+}
+
+// logError logs errors from methods that can't return them.
+func (p *process) logError(method string, err error) {
+	if p.ctx.Logger.ShouldLog(Error) {
+		p.ctx.Logger.Log(Error, "plugin", "Error calling plugin",
+			map[string]string{"cmd": p.command, "method": method,
+				"error": err.Error()})
+	}
+}
+
+// close closes the backend, then stops the plugin.
+func (p *process) close(method string) (err error) {
+	p.closeOnce.Do(func() {
+		if p.client == nil {
+			return // Not started.
+		}
+		err = p.call(method, nil, nil)
+		p.stop()
+	})
+	return err
+}
+
+// stop closes the plugin's standard input, and kills it if it doesn't exit
+// within the timeout.
+func (p *process) stop() {
+	p.client.Close()
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case <-p.exited:
+		return
+	case <-timer.C:
+	}
+	p.cmd.Process.Kill()
+	<-p.exited
+}
+
+// EraseDevice implements Eraser. Plugins that don't hold device data
+// erase nothing.
+func (p *process) EraseDevice(deviceID string) (erased int, err error) {
+	if !p.eraser {
+		return 0, nil
+	}
+	err = p.call("Plugin.EraseDevice", deviceID, &erased)
+	return erased, err
+}
+
+// ExportDevice implements Exporter.
+func (p *process) ExportDevice(deviceID string) (data interface{}, err error) {
+	if !p.exporter {
+		return nil, nil
+	}
+	reply := new(exportReply)
+	if err = p.call("Plugin.ExportDevice", deviceID, reply); err != nil {
+		return nil, err
+	}
+	return reply.Data, nil
+}
+
+// logLevel returns the most verbose level logged by logger.
+func logLevel(logger Logger) LogLevel {
+	level := Debug
+	for level > Emergency && !logger.ShouldLog(level) {
+		level--
+	}
+	return level
+}
+
+// processStore implements Store.
+type processStore struct {
+	process
+}
+
+func (s *processStore) CanStore(channels int) (ok bool) {
+	if err := s.call("Store.CanStore", channels, &ok); err != nil {
+		s.logError("Store.CanStore", err)
+		return false
+	}
+	return ok
+}
+
+func (s *processStore) Close() error {
+	return s.close("Store.Close")
+}
+
+func (s *processStore) KeyToIDs(key string) (deviceID, channelID string,
+	err error) {
+
+	ids := new(channelArgs)
+	if err = s.call("Store.KeyToIDs", key, ids); err != nil {
+		return "", "", err
+	}
+	return ids.DeviceID, ids.ChannelID, nil
+}
+
+func (s *processStore) IDsToKey(deviceID, channelID string) (key string,
+	err error) {
+
+	args := &channelArgs{DeviceID: deviceID, ChannelID: channelID}
+	err = s.call("Store.IDsToKey", args, &key)
+	return key, err
+}
+
+func (s *processStore) Status() (ok bool, err error) {
+	if err = s.call("Store.Status", nil, &ok); err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+func (s *processStore) Exists(deviceID string) (ok bool) {
+	if err := s.call("Store.Exists", deviceID, &ok); err != nil {
+		s.logError("Store.Exists", err)
+		return false
+	}
+	return ok
+}
+
+func (s *processStore) Register(deviceID, channelID string, version int64) error {
+	return s.call("Store.Register", &channelArgs{deviceID, channelID, version}, nil)
+}
+
+func (s *processStore) Update(deviceID, channelID string, version int64) error {
+	return s.call("Store.Update", &channelArgs{deviceID, channelID, version}, nil)
+}
+
+func (s *processStore) Unregister(deviceID, channelID string) error {
+	return s.call("Store.Unregister", &channelArgs{deviceID, channelID, 0}, nil)
+}
+
+func (s *processStore) Drop(deviceID, channelID string) error {
+	return s.call("Store.Drop", &channelArgs{deviceID, channelID, 0}, nil)
+}
+
+func (s *processStore) FetchAll(deviceID string, since time.Time) (
+	updates []Update, expired []string, err error) {
+
+	reply := new(fetchReply)
+	if err = s.call("Store.FetchAll", &fetchArgs{deviceID, since}, reply); err != nil {
+		return nil, nil, err
+	}
+	return reply.Updates, reply.Expired, nil
+}
+
+func (s *processStore) DropAll(deviceID string) error {
+	return s.call("Store.DropAll", deviceID, nil)
+}
+
+func (s *processStore) FetchPing(deviceID string) (pingData []byte, err error) {
+	reply := new(pingArgs)
+	if err = s.call("Store.FetchPing", deviceID, reply); err != nil {
+		return nil, err
+	}
+	return reply.PingData, nil
+}
+
+func (s *processStore) PutPing(deviceID string, pingData []byte) error {
+	return s.call("Store.PutPing", &pingArgs{deviceID, pingData}, nil)
+}
+
+func (s *processStore) DropPing(deviceID string) error {
+	return s.call("Store.DropPing", deviceID, nil)
+}
+
+// processPinger implements Pinger.
+type processPinger struct {
+	process
+}
+
+func (p *processPinger) Register(deviceID string, pingData []byte) error {
+	return p.call("Pinger.Register", &pingArgs{deviceID, pingData}, nil)
+}
+
+func (p *processPinger) Send(deviceID string, version int64, data string) (
+	ok bool, err error) {
+
+	err = p.call("Pinger.Send", &sendArgs{deviceID, version, data}, &ok)
+	return ok, err
+}
+
+func (p *processPinger) CanBypassWebsocket() (ok bool) {
+	if err := p.call("Pinger.CanBypassWebsocket", nil, &ok); err != nil {
+		p.logError("Pinger.CanBypassWebsocket", err)
+		return false
+	}
+	return ok
+}
+
+func (p *processPinger) Status() (ok bool, err error) {
+	if err = p.call("Pinger.Status", nil, &ok); err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+func (p *processPinger) Close() error {
+	return p.close("Pinger.Close")
+}
+
+// processBalancer implements Balancer.
+type processBalancer struct {
+	process
+}
+
+func (b *processBalancer) RedirectURL() (origin string, ok bool, err error) {
+	reply := new(redirectReply)
+	if err = b.call("Balancer.RedirectURL", nil, reply); err != nil {
+		return "", false, err
+	}
+	return reply.Origin, reply.OK, nil
+}
+
+func (b *processBalancer) Status() (ok bool, err error) {
+	if err = b.call("Balancer.Status", nil, &ok); err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+func (b *processBalancer) Close() error {
+	return b.close("Balancer.Close")
+}
@@ -0,0 +1,124 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package push
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// TestPluginProcess isn't a real test: it serves a memStore when the test
+// binary is started as a plugin by TestProcessStore.
+func TestPluginProcess(t *testing.T) {
+	if os.Getenv("PUSHGO_TEST_PLUGIN") != "1" {
+		return
+	}
+	if err := ServeStore(new(memStore)); err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// discardLogger discards plugin log messages.
+type discardLogger struct{}
+
+func (discardLogger) ShouldLog(level LogLevel) bool                   { return level <= Info }
+func (discardLogger) Log(LogLevel, string, string, map[string]string) {}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Increment(string)            {}
+func (nopMetrics) IncrementBy(string, int64)   {}
+func (nopMetrics) Gauge(string, int64)         {}
+func (nopMetrics) Timer(string, time.Duration) {}
+
+func TestProcessStore(t *testing.T) {
+	uaid := "5e1e5984569c4f00bf4bea47754a6403"
+	chid := "0d6a6d0ca1ba4be1bc8a2cea8e4ddb1a"
+
+	os.Setenv("PUSHGO_TEST_PLUGIN", "1")
+	defer os.Unsetenv("PUSHGO_TEST_PLUGIN")
+
+	ctx := &Context{Logger: discardLogger{}, Metrics: nopMetrics{}}
+	store := &processStore{process{kind: "store"}}
+	config := store.ConfigStruct().(*processConfig)
+	config.Command = os.Args[0]
+	config.Args = []string{"-test.run=TestPluginProcess"}
+	config.Settings = map[string]interface{}{"max_channels": 2}
+	if err := store.Configure(ctx, config); err != nil {
+		t.Fatalf("Error starting plugin: %s", err)
+	}
+	defer store.Close()
+
+	if !store.CanStore(2) || store.CanStore(3) {
+		t.Errorf("Plugin ignored max_channels setting")
+	}
+	key, err := store.IDsToKey(uaid, chid)
+	if err != nil {
+		t.Fatalf("Error encoding key: %s", err)
+	}
+	if keyID, keyChID, err := store.KeyToIDs(key); err != nil ||
+		keyID != uaid || keyChID != chid {
+		t.Errorf("Wrong IDs for key %q: got (%q, %q, %v)",
+			key, keyID, keyChID, err)
+	}
+	if err := store.Register(uaid, chid, 1); err != nil {
+		t.Fatalf("Error registering channel: %s", err)
+	}
+	// Exported errors are returned as is, instead of as server errors.
+	otherID := "4f6e9e3b0bd34a6e9a5fa1bca4d2b3a8"
+	if err := store.Update(uaid, otherID, 2); err != ErrNonexistentChannel {
+		t.Errorf("Wrong error for unregistered channel: got %v; want %s",
+			err, ErrNonexistentChannel)
+	}
+	updates, _, err := store.FetchAll(uaid, time.Time{})
+	if err != nil {
+		t.Fatalf("Error fetching updates: %s", err)
+	}
+	if len(updates) != 1 || updates[0].ChannelID != chid || updates[0].Version != 1 {
+		t.Errorf("Wrong updates: got %#v", updates)
+	}
+	if erased, err := store.EraseDevice(uaid); err != nil || erased != 1 {
+		t.Errorf("Wrong erase result: got (%d, %v)", erased, err)
+	}
+	if store.Exists(uaid) {
+		t.Errorf("Device not erased")
+	}
+	if err := store.Close(); err != nil {
+		t.Errorf("Error closing plugin: %s", err)
+	}
+	select {
+	case <-store.exited:
+	default:
+		t.Errorf("Plugin still running after Close")
+	}
+}
+
+func TestProcessStoreKind(t *testing.T) {
+	os.Setenv("PUSHGO_TEST_PLUGIN", "1")
+	defer os.Unsetenv("PUSHGO_TEST_PLUGIN")
+
+	ctx := &Context{Logger: discardLogger{}, Metrics: nopMetrics{}}
+	pinger := &processPinger{process{kind: "pinger"}}
+	config := pinger.ConfigStruct().(*processConfig)
+	config.Command = os.Args[0]
+	config.Args = []string{"-test.run=TestPluginProcess"}
+	if err := pinger.Configure(ctx, config); err == nil {
+		pinger.Close()
+		t.Errorf("Store plugin configured as a pinger")
+	}
+}
+
+func TestProcessNoCommand(t *testing.T) {
+	store := &processStore{process{kind: "store"}}
+	if err := store.Configure(new(Context), store.ConfigStruct()); err != ErrNoPluginCommand {
+		t.Errorf("Wrong error for missing command: got %v; want %s",
+			err, ErrNoPluginCommand)
+	}
+	if err := store.Close(); err != nil {
+		t.Errorf("Error closing unstarted plugin: %s", err)
+	}
+}
@@ -0,0 +1,149 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package push
+
+import (
+	"fmt"
+	"io"
+	"net/rpc"
+	"strings"
+	"time"
+)
+
+// External plugins are separate processes that speak JSON-RPC 1.0, as
+// implemented by net/rpc/jsonrpc, over their standard input and output. The
+// server calls Plugin.Handshake first, then the methods of the backend's
+// kind: Store.*, Pinger.*, or Balancer.*, named after the interface methods.
+// Each line written to standard error is a JSON-encoded event, or plain text
+// that the server logs as is.
+
+// handshakeArgs is sent to a plugin before any other call.
+type handshakeArgs struct {
+	APIVersion string
+	Kind       string
+	Hostname   string
+	LogLevel   LogLevel // The most verbose level logged by the server.
+	Settings   map[string]interface{}
+}
+
+// handshakeReply describes the plugin's backend.
+type handshakeReply struct {
+	APIVersion string
+	Eraser     bool
+	Exporter   bool
+}
+
+type channelArgs struct {
+	DeviceID  string
+	ChannelID string
+	Version   int64
+}
+
+type fetchArgs struct {
+	DeviceID string
+	Since    time.Time
+}
+
+type fetchReply struct {
+	Updates []Update
+	Expired []string
+}
+
+type pingArgs struct {
+	DeviceID string
+	PingData []byte
+}
+
+type exportReply struct {
+	Data interface{}
+}
+
+type sendArgs struct {
+	DeviceID string
+	Version  int64
+	Data     string
+}
+
+type redirectReply struct {
+	Origin string
+	OK     bool
+}
+
+// Event types written to a plugin's standard error.
+const (
+	eventLog     = "log"
+	eventCounter = "counter"
+	eventGauge   = "gauge"
+	eventTimer   = "timer" // Value is in nanoseconds.
+)
+
+type event struct {
+	Type      string            `json:"type"`
+	Level     LogLevel          `json:"level,omitempty"`
+	Component string            `json:"component,omitempty"`
+	Message   string            `json:"message,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	Name      string            `json:"name,omitempty"`
+	Value     int64             `json:"value,omitempty"`
+}
+
+// errorCodes identifies the exported errors in plugin responses. JSON-RPC
+// errors are strings, so these are sent as "[code] message", and mapped
+// back to the exported errors by the server.
+var errorCodes = map[string]error{
+	"invalid_id":          ErrInvalidID,
+	"invalid_channel":     ErrInvalidChannel,
+	"invalid_key":         ErrInvalidKey,
+	"nonexistent_channel": ErrNonexistentChannel,
+	"channel_gone":        ErrChannelGone,
+	"stale_version":       ErrStaleVersion,
+}
+
+// encodeError returns the response error string for err.
+func encodeError(err error) string {
+	for code, codeErr := range errorCodes {
+		if err == codeErr {
+			return "[" + code + "] " + err.Error()
+		}
+	}
+	return err.Error()
+}
+
+// decodeError returns the exported error for a coded response error, or err
+// if the error doesn't have a known code.
+func decodeError(err error) error {
+	serverErr, ok := err.(rpc.ServerError)
+	if !ok || !strings.HasPrefix(string(serverErr), "[") {
+		return err
+	}
+	end := strings.Index(string(serverErr), "]")
+	if end < 0 {
+		return err
+	}
+	if codeErr, ok := errorCodes[string(serverErr[1:end])]; ok {
+		return codeErr
+	}
+	return err
+}
+
+// checkVersion returns an error if a plugin built against version of this
+// package is incompatible with the server.
+func checkVersion(version string) error {
+	if majorVersion(version) != majorVersion(APIVersion) {
+		return fmt.Errorf("push: Plugin API version %q is incompatible with %q",
+			version, APIVersion)
+	}
+	return nil
+}
+
+func majorVersion(version string) string {
+	return strings.SplitN(version, ".", 2)[0]
+}
+
+// pipe joins the read and write halves of a plugin connection.
+type pipe struct {
+	io.Reader
+	io.WriteCloser
+}
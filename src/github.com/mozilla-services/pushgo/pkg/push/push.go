@@ -0,0 +1,81 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package push
+
+import (
+	"time"
+)
+
+// APIVersion is the semantic version of this package's API.
+const APIVersion = "1.0.0"
+
+// A LogLevel is a syslog severity level.
+type LogLevel int32
+
+const (
+	Emergency LogLevel = iota
+	Alert
+	Critical
+	Error
+	Warning
+	Notice
+	Info
+	Debug
+)
+
+// Logger writes structured log messages to the server's log.
+type Logger interface {
+	// ShouldLog indicates whether messages at level are logged.
+	ShouldLog(level LogLevel) bool
+
+	// Log logs a message for a component, such as the backend's type name.
+	Log(level LogLevel, component, message string, fields map[string]string)
+}
+
+// Metrics records metrics with the server's metrics client. Names are
+// prefixed as configured in the server's [metrics] section.
+type Metrics interface {
+	Increment(name string)
+	IncrementBy(name string, delta int64)
+	Gauge(name string, value int64)
+	Timer(name string, duration time.Duration)
+}
+
+// Context is passed to backends when they are configured.
+type Context struct {
+	// Hostname is the public host name of the server.
+	Hostname string
+
+	Logger  Logger
+	Metrics Metrics
+}
+
+// Configurable is an optional interface implemented by backends with
+// settings.
+type Configurable interface {
+	// ConfigStruct returns a pointer to a struct populated with default
+	// settings, into which the backend's configuration section is decoded.
+	ConfigStruct() interface{}
+
+	// Configure initializes the backend with the decoded settings. Returning
+	// an error stops the server from starting.
+	Configure(ctx *Context, config interface{}) error
+}
+
+// Eraser is an optional interface implemented by backends that hold device
+// data, so that the data is removed for right-to-erasure requests.
+type Eraser interface {
+	// EraseDevice removes all data held for the device, returning the number
+	// of records removed. Erasing a device without data is not an error.
+	EraseDevice(deviceID string) (erased int, err error)
+}
+
+// Exporter is an optional interface implemented by backends that hold device
+// data, so that the data is included in data portability requests.
+type Exporter interface {
+	// ExportDevice returns a JSON-encodable description of the data held for
+	// the device, or nil if the backend holds no data for the device.
+	ExportDevice(deviceID string) (data interface{}, err error)
+}
@@ -0,0 +1,203 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package push
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/pushgo/simplepush"
+)
+
+// nopLogger discards log messages.
+type nopLogger struct{}
+
+func (nopLogger) Log(simplepush.LogLevel, string, string, simplepush.LogFields) error {
+	return nil
+}
+func (nopLogger) SetFilter(simplepush.LogLevel)      {}
+func (nopLogger) ShouldLog(simplepush.LogLevel) bool { return false }
+func (nopLogger) Close() error                       { return nil }
+
+type memStoreConfig struct {
+	MaxChannels int `toml:"max_channels"`
+}
+
+// memStore is a third-party store that keeps channel versions in memory.
+type memStore struct {
+	ctx         *Context
+	maxChannels int
+	versions    map[string]int64
+}
+
+func (s *memStore) ConfigStruct() interface{} {
+	return &memStoreConfig{MaxChannels: 10}
+}
+
+func (s *memStore) Configure(ctx *Context, config interface{}) error {
+	s.ctx = ctx
+	s.maxChannels = config.(*memStoreConfig).MaxChannels
+	s.versions = make(map[string]int64)
+	return nil
+}
+
+func (s *memStore) CanStore(channels int) bool { return channels <= s.maxChannels }
+func (s *memStore) Close() error               { return nil }
+func (s *memStore) Status() (bool, error)      { return true, nil }
+
+func (s *memStore) KeyToIDs(key string) (string, string, error) {
+	return key[:32], key[32:], nil
+}
+
+func (s *memStore) IDsToKey(uaid, chid string) (string, error) {
+	return uaid + chid, nil
+}
+
+func (s *memStore) Exists(uaid string) bool {
+	for key := range s.versions {
+		if key[:32] == uaid {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memStore) Register(uaid, chid string, version int64) error {
+	s.versions[uaid+chid] = version
+	return nil
+}
+
+func (s *memStore) Update(uaid, chid string, version int64) error {
+	if _, ok := s.versions[uaid+chid]; !ok {
+		return ErrNonexistentChannel
+	}
+	s.versions[uaid+chid] = version
+	return nil
+}
+
+func (s *memStore) Unregister(uaid, chid string) error {
+	delete(s.versions, uaid+chid)
+	return nil
+}
+
+func (s *memStore) Drop(uaid, chid string) error {
+	delete(s.versions, uaid+chid)
+	return nil
+}
+
+func (s *memStore) FetchAll(uaid string, since time.Time) ([]Update, []string, error) {
+	var updates []Update
+	for key, version := range s.versions {
+		if key[:32] == uaid {
+			updates = append(updates, Update{ChannelID: key[32:], Version: uint64(version)})
+		}
+	}
+	return updates, nil, nil
+}
+
+func (s *memStore) DropAll(uaid string) error {
+	_, err := s.EraseDevice(uaid)
+	return err
+}
+
+func (s *memStore) FetchPing(uaid string) ([]byte, error)      { return nil, nil }
+func (s *memStore) PutPing(uaid string, pingData []byte) error { return nil }
+func (s *memStore) DropPing(uaid string) error                 { return nil }
+
+func (s *memStore) EraseDevice(uaid string) (erased int, err error) {
+	for key := range s.versions {
+		if key[:32] == uaid {
+			delete(s.versions, key)
+			erased++
+		}
+	}
+	return erased, nil
+}
+
+func TestRegisterStore(t *testing.T) {
+	uaid := "5e1e5984569c4f00bf4bea47754a6403"
+	chid := "0d6a6d0ca1ba4be1bc8a2cea8e4ddb1a"
+
+	RegisterStore("test_memory", func() Store { return new(memStore) })
+	ext, ok := simplepush.AvailableStores["test_memory"]
+	if !ok {
+		t.Fatalf("Store type not registered")
+	}
+	plugin := ext()
+	store, ok := plugin.(simplepush.Store)
+	if !ok {
+		t.Fatalf("Registered store does not implement simplepush.Store")
+	}
+
+	app := simplepush.NewApplication()
+	app.SetLogger(nopLogger{})
+	config := plugin.ConfigStruct().(*memStoreConfig)
+	config.MaxChannels = 2
+	if err := plugin.Init(app, config); err != nil {
+		t.Fatalf("Error initializing store: %s", err)
+	}
+	if err := app.SetStore(store); err != nil {
+		t.Fatalf("Error setting store: %s", err)
+	}
+	if store.CanStore(3) {
+		t.Errorf("Store ignored max_channels setting")
+	}
+	backend := plugin.(*storeAdapter).Store.(*memStore)
+	if backend.ctx == nil || backend.ctx.Logger == nil {
+		t.Errorf("Store configured without a context")
+	}
+
+	if err := store.Register(uaid, chid, 1); err != nil {
+		t.Fatalf("Error registering channel: %s", err)
+	}
+	updates, _, err := store.FetchAll(uaid, time.Time{})
+	if err != nil {
+		t.Fatalf("Error fetching updates: %s", err)
+	}
+	if len(updates) != 1 || updates[0].ChannelID != chid || updates[0].Version != 1 {
+		t.Errorf("Wrong updates: got %#v", updates)
+	}
+	// Store errors are reported as the server's errors.
+	otherID := "4f6e9e3b0bd34a6e9a5fa1bca4d2b3a8"
+	if err := store.Update(uaid, otherID, 2); err != simplepush.ErrNonexistentChannel {
+		t.Errorf("Wrong error for unregistered channel: got %v; want %s",
+			err, simplepush.ErrNonexistentChannel)
+	}
+
+	// Stores that hold device data are erased with the built-in components.
+	report := simplepush.EraseDevice(app, uaid)
+	var erased bool
+	for _, step := range report.Steps {
+		if step.Name == "test_memory" && step.Erased == 1 {
+			erased = true
+		}
+	}
+	if !erased || store.Exists(uaid) {
+		t.Errorf("Device not erased: got %#v", report.Steps)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Registering a duplicate store type should panic")
+		}
+	}()
+	RegisterStore("test_memory", func() Store { return new(memStore) })
+}
+
+func TestRegisterPinger(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Registering a nil pinger factory should panic")
+		}
+	}()
+	RegisterPinger("test_nil", nil)
+}
+
+func TestNewServer(t *testing.T) {
+	if _, err := NewServer(Options{}); err != ErrNoConfigFile {
+		t.Errorf("Wrong error for missing config file: got %v; want %s",
+			err, ErrNoConfigFile)
+	}
+}
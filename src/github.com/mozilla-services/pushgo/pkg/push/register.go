@@ -0,0 +1,217 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package push
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/pushgo/simplepush"
+)
+
+var registerMux sync.Mutex
+
+// RegisterStore makes a storage backend available as a [storage] type.
+// Panics if factory is nil, or if the type is already registered. Must be
+// called before the server is created.
+func RegisterStore(name string, factory func() Store) {
+	register(simplepush.AvailableStores, "store", name, factory == nil,
+		func() simplepush.HasConfigStruct {
+			store := factory()
+			return &storeAdapter{Store: store, plugin: plugin{name, store}}
+		})
+}
+
+// RegisterPinger makes a proprietary ping backend available as a [propping]
+// type. Panics if factory is nil, or if the type is already registered. Must
+// be called before the server is created.
+func RegisterPinger(name string, factory func() Pinger) {
+	register(simplepush.AvailablePings, "pinger", name, factory == nil,
+		func() simplepush.HasConfigStruct {
+			pinger := factory()
+			return &pingerAdapter{Pinger: pinger, plugin: plugin{name, pinger}}
+		})
+}
+
+// RegisterBalancer makes a load balancer available as a [balancer] type.
+// Panics if factory is nil, or if the type is already registered. Must be
+// called before the server is created.
+func RegisterBalancer(name string, factory func() Balancer) {
+	register(simplepush.AvailableBalancers, "balancer", name, factory == nil,
+		func() simplepush.HasConfigStruct {
+			balancer := factory()
+			return &balancerAdapter{Balancer: balancer, plugin: plugin{name, balancer}}
+		})
+}
+
+func register(extensions simplepush.AvailableExtensions, kind, name string,
+	isNil bool, ext func() simplepush.HasConfigStruct) {
+
+	registerMux.Lock()
+	defer registerMux.Unlock()
+	if isNil {
+		panic(fmt.Sprintf("push: Nil %s factory for type %q", kind, name))
+	}
+	if _, ok := extensions[name]; ok {
+		panic(fmt.Sprintf("push: Duplicate %s type %q", kind, name))
+	}
+	extensions[name] = ext
+}
+
+// plugin adapts a backend to the server's plugin interface.
+type plugin struct {
+	name    string
+	backend interface{}
+}
+
+func (p *plugin) ConfigStruct() interface{} {
+	if c, ok := p.backend.(Configurable); ok {
+		return c.ConfigStruct()
+	}
+	return nil
+}
+
+func (p *plugin) Init(app *simplepush.Application, config interface{}) error {
+	if c, ok := p.backend.(Configurable); ok {
+		if err := c.Configure(newContext(app), config); err != nil {
+			return err
+		}
+	}
+	if eraser, ok := p.backend.(Eraser); ok {
+		app.AddEraser(p.name, eraser)
+	}
+	if exporter, ok := p.backend.(Exporter); ok {
+		app.AddExporter(p.name, exporter)
+	}
+	return nil
+}
+
+// storeAdapter implements simplepush.Store.
+type storeAdapter struct {
+	Store
+	plugin
+}
+
+// storeErrors maps store errors to the server's errors, so that they're
+// reported to clients and app servers like the built-in stores' errors.
+var storeErrors = map[error]error{
+	ErrInvalidID:          simplepush.ErrInvalidID,
+	ErrInvalidChannel:     simplepush.ErrInvalidChannel,
+	ErrInvalidKey:         simplepush.ErrInvalidKey,
+	ErrNonexistentChannel: simplepush.ErrNonexistentChannel,
+	ErrChannelGone:        simplepush.ErrChannelGone,
+	ErrStaleVersion:       simplepush.ErrStaleVersion,
+}
+
+func storeError(err error) error {
+	if serverErr, ok := storeErrors[err]; ok {
+		return serverErr
+	}
+	return err
+}
+
+func (s *storeAdapter) KeyToIDs(key string) (suaid, schid string, err error) {
+	suaid, schid, err = s.Store.KeyToIDs(key)
+	return suaid, schid, storeError(err)
+}
+
+func (s *storeAdapter) IDsToKey(suaid, schid string) (key string, err error) {
+	key, err = s.Store.IDsToKey(suaid, schid)
+	return key, storeError(err)
+}
+
+func (s *storeAdapter) Register(suaid, schid string, version int64) error {
+	return storeError(s.Store.Register(suaid, schid, version))
+}
+
+func (s *storeAdapter) Update(suaid, schid string, version int64) error {
+	return storeError(s.Store.Update(suaid, schid, version))
+}
+
+func (s *storeAdapter) Unregister(suaid, schid string) error {
+	return storeError(s.Store.Unregister(suaid, schid))
+}
+
+func (s *storeAdapter) Drop(suaid, schid string) error {
+	return storeError(s.Store.Drop(suaid, schid))
+}
+
+func (s *storeAdapter) FetchAll(suaid string, since time.Time) (
+	updates []simplepush.Update, expired []string, err error) {
+
+	fetched, expired, err := s.Store.FetchAll(suaid, since)
+	if err != nil {
+		return nil, nil, storeError(err)
+	}
+	if len(fetched) > 0 {
+		updates = make([]simplepush.Update, len(fetched))
+		for i, update := range fetched {
+			updates[i] = simplepush.Update{
+				ChannelID: update.ChannelID,
+				Version:   update.Version,
+				Data:      update.Data,
+			}
+		}
+	}
+	return updates, expired, nil
+}
+
+func (s *storeAdapter) DropAll(suaid string) error {
+	return storeError(s.Store.DropAll(suaid))
+}
+
+func (s *storeAdapter) FetchPing(suaid string) (pingData []byte, err error) {
+	pingData, err = s.Store.FetchPing(suaid)
+	return pingData, storeError(err)
+}
+
+func (s *storeAdapter) PutPing(suaid string, pingData []byte) error {
+	return storeError(s.Store.PutPing(suaid, pingData))
+}
+
+func (s *storeAdapter) DropPing(suaid string) error {
+	return storeError(s.Store.DropPing(suaid))
+}
+
+// pingerAdapter implements simplepush.PropPinger.
+type pingerAdapter struct {
+	Pinger
+	plugin
+}
+
+// balancerAdapter implements simplepush.Balancer.
+type balancerAdapter struct {
+	Balancer
+	plugin
+}
+
+func newContext(app *simplepush.Application) *Context {
+	return &Context{
+		Hostname: app.Hostname(),
+		Logger:   logger{app.Logger()},
+		Metrics:  app.Metrics(),
+	}
+}
+
+// logger implements Logger.
+type logger struct {
+	log *simplepush.SimpleLogger
+}
+
+func (l logger) ShouldLog(level LogLevel) bool {
+	return l.log.ShouldLog(simplepush.LogLevel(level))
+}
+
+func (l logger) Log(level LogLevel, component, message string,
+	fields map[string]string) {
+
+	if level == Warning {
+		// Deduplicate warnings, like the server's components.
+		l.log.Warn(component, message, fields)
+		return
+	}
+	l.log.Logger.Log(simplepush.LogLevel(level), component, message, fields)
+}
@@ -0,0 +1,435 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package push
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errUnknownMethod = errors.New("push: Unknown plugin method")
+
+// ServeStore serves store to the server over standard input and output, and
+// returns when the server disconnects. It is called from the main function
+// of an external plugin; see the "process" storage type.
+func ServeStore(store Store) error {
+	return serve(os.Stdin, os.Stdout, os.Stderr, "store", store,
+		storeMethods(store))
+}
+
+// ServePinger serves pinger to the server over standard input and output,
+// and returns when the server disconnects.
+func ServePinger(pinger Pinger) error {
+	return serve(os.Stdin, os.Stdout, os.Stderr, "pinger", pinger,
+		pingerMethods(pinger))
+}
+
+// ServeBalancer serves balancer to the server over standard input and
+// output, and returns when the server disconnects.
+func ServeBalancer(balancer Balancer) error {
+	return serve(os.Stdin, os.Stdout, os.Stderr, "balancer", balancer,
+		balancerMethods(balancer))
+}
+
+// method is a plugin method. args returns a pointer to a new argument value,
+// or nil if the method doesn't take arguments.
+type method struct {
+	args func() interface{}
+	call func(args interface{}) (reply interface{}, err error)
+}
+
+func noArgs() interface{} { return nil }
+
+func serve(r io.Reader, w io.WriteCloser, events io.Writer, kind string,
+	backend interface{}, methods map[string]method) error {
+
+	s := &server{
+		kind:    kind,
+		backend: backend,
+		methods: methods,
+		events:  &eventWriter{enc: json.NewEncoder(events)},
+	}
+	s.methods["Plugin.Handshake"] = method{
+		func() interface{} { return new(handshakeArgs) },
+		func(args interface{}) (interface{}, error) {
+			return s.handshake(args.(*handshakeArgs))
+		},
+	}
+	if eraser, ok := backend.(Eraser); ok {
+		s.methods["Plugin.EraseDevice"] = method{
+			func() interface{} { return new(string) },
+			func(args interface{}) (interface{}, error) {
+				return eraser.EraseDevice(*args.(*string))
+			},
+		}
+	}
+	if exporter, ok := backend.(Exporter); ok {
+		s.methods["Plugin.ExportDevice"] = method{
+			func() interface{} { return new(string) },
+			func(args interface{}) (interface{}, error) {
+				data, err := exporter.ExportDevice(*args.(*string))
+				return &exportReply{data}, err
+			},
+		}
+	}
+	return s.serve(jsonrpc.NewServerCodec(pipe{r, w}))
+}
+
+// server dispatches calls from the server to a plugin's backend.
+type server struct {
+	kind       string
+	backend    interface{}
+	methods    map[string]method
+	events     *eventWriter
+	sendLock   sync.Mutex
+	handshaken bool
+}
+
+func (s *server) serve(codec rpc.ServerCodec) (err error) {
+	defer codec.Close()
+	var calls sync.WaitGroup
+	defer calls.Wait()
+	for {
+		var req rpc.Request
+		if err = codec.ReadRequestHeader(&req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		m, ok := s.methods[req.ServiceMethod]
+		if !ok {
+			if err = codec.ReadRequestBody(nil); err != nil {
+				return err
+			}
+			s.send(codec, &req, nil, errUnknownMethod)
+			continue
+		}
+		args := m.args()
+		if err = codec.ReadRequestBody(args); err != nil {
+			return err
+		}
+		if req.ServiceMethod == "Plugin.Handshake" {
+			// Configure the backend before serving other calls.
+			reply, err := m.call(args)
+			s.handshaken = err == nil
+			s.send(codec, &req, reply, err)
+			continue
+		}
+		if !s.handshaken {
+			s.send(codec, &req, nil, errors.New("push: Missing plugin handshake"))
+			continue
+		}
+		calls.Add(1)
+		go func(req rpc.Request) {
+			defer calls.Done()
+			reply, err := m.call(args)
+			s.send(codec, &req, reply, err)
+		}(req)
+	}
+}
+
+func (s *server) send(codec rpc.ServerCodec, req *rpc.Request,
+	reply interface{}, err error) {
+
+	resp := &rpc.Response{ServiceMethod: req.ServiceMethod, Seq: req.Seq}
+	if err != nil {
+		resp.Error = encodeError(err)
+		reply = nil
+	} else if reply == nil {
+		// The JSON-RPC client rejects null results without an error.
+		reply = struct{}{}
+	}
+	s.sendLock.Lock()
+	codec.WriteResponse(resp, reply)
+	s.sendLock.Unlock()
+}
+
+func (s *server) handshake(args *handshakeArgs) (*handshakeReply, error) {
+	if err := checkVersion(args.APIVersion); err != nil {
+		return nil, err
+	}
+	if args.Kind != s.kind {
+		return nil, fmt.Errorf("push: Plugin serves a %s, not a %s",
+			s.kind, args.Kind)
+	}
+	if c, ok := s.backend.(Configurable); ok {
+		config := c.ConfigStruct()
+		if err := decodeSettings(args.Settings, config); err != nil {
+			return nil, err
+		}
+		ctx := &Context{
+			Hostname: args.Hostname,
+			Logger:   &eventLogger{s.events, args.LogLevel},
+			Metrics:  s.events,
+		}
+		if err := c.Configure(ctx, config); err != nil {
+			return nil, err
+		}
+	}
+	_, isEraser := s.backend.(Eraser)
+	_, isExporter := s.backend.(Exporter)
+	return &handshakeReply{
+		APIVersion: APIVersion,
+		Eraser:     isEraser,
+		Exporter:   isExporter,
+	}, nil
+}
+
+// decodeSettings decodes the plugin's [<section>.settings] table into
+// config, a pointer to a struct. Fields are matched by their toml tags, as
+// for in-process backends, or by case-insensitive name.
+func decodeSettings(settings map[string]interface{}, config interface{}) error {
+	if config == nil || len(settings) == 0 {
+		return nil
+	}
+	rv := reflect.ValueOf(config)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return json.Unmarshal(mustMarshal(settings), config)
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+	for key, value := range settings {
+		i := settingField(rt, key)
+		if i < 0 {
+			return fmt.Errorf("push: Unknown plugin setting: %s", key)
+		}
+		if err := json.Unmarshal(mustMarshal(value), rv.Field(i).Addr().Interface()); err != nil {
+			return fmt.Errorf("push: Invalid plugin setting %s: %s", key, err)
+		}
+	}
+	return nil
+}
+
+func settingField(rt reflect.Type, key string) int {
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue // Unexported.
+		}
+		name := strings.Split(field.Tag.Get("toml"), ",")[0]
+		if len(name) == 0 {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+func mustMarshal(v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		// Settings are decoded from JSON, and always re-encodable.
+		panic(err)
+	}
+	return data
+}
+
+// eventWriter sends log messages and metrics to the server. It implements
+// Metrics.
+type eventWriter struct {
+	sync.Mutex
+	enc *json.Encoder
+}
+
+func (w *eventWriter) write(e *event) {
+	w.Lock()
+	w.enc.Encode(e)
+	w.Unlock()
+}
+
+func (w *eventWriter) Increment(name string) {
+	w.IncrementBy(name, 1)
+}
+
+func (w *eventWriter) IncrementBy(name string, delta int64) {
+	w.write(&event{Type: eventCounter, Name: name, Value: delta})
+}
+
+func (w *eventWriter) Gauge(name string, value int64) {
+	w.write(&event{Type: eventGauge, Name: name, Value: value})
+}
+
+func (w *eventWriter) Timer(name string, duration time.Duration) {
+	w.write(&event{Type: eventTimer, Name: name, Value: int64(duration)})
+}
+
+// eventLogger implements Logger for plugins.
+type eventLogger struct {
+	w     *eventWriter
+	level LogLevel
+}
+
+func (l *eventLogger) ShouldLog(level LogLevel) bool {
+	return level <= l.level
+}
+
+func (l *eventLogger) Log(level LogLevel, component, message string,
+	fields map[string]string) {
+
+	if !l.ShouldLog(level) {
+		return
+	}
+	l.w.write(&event{
+		Type:      eventLog,
+		Level:     level,
+		Component: component,
+		Message:   message,
+		Fields:    fields,
+	})
+}
+
+func storeMethods(store Store) map[string]method {
+	return map[string]method{
+		"Store.CanStore": {
+			func() interface{} { return new(int) },
+			func(args interface{}) (interface{}, error) {
+				return store.CanStore(*args.(*int)), nil
+			},
+		},
+		"Store.Close": {noArgs, func(interface{}) (interface{}, error) {
+			return nil, store.Close()
+		}},
+		"Store.KeyToIDs": {
+			func() interface{} { return new(string) },
+			func(args interface{}) (interface{}, error) {
+				deviceID, channelID, err := store.KeyToIDs(*args.(*string))
+				return &channelArgs{DeviceID: deviceID, ChannelID: channelID}, err
+			},
+		},
+		"Store.IDsToKey": {
+			func() interface{} { return new(channelArgs) },
+			func(args interface{}) (interface{}, error) {
+				ids := args.(*channelArgs)
+				return store.IDsToKey(ids.DeviceID, ids.ChannelID)
+			},
+		},
+		"Store.Status": {noArgs, func(interface{}) (interface{}, error) {
+			return store.Status()
+		}},
+		"Store.Exists": {
+			func() interface{} { return new(string) },
+			func(args interface{}) (interface{}, error) {
+				return store.Exists(*args.(*string)), nil
+			},
+		},
+		"Store.Register": {
+			func() interface{} { return new(channelArgs) },
+			func(args interface{}) (interface{}, error) {
+				c := args.(*channelArgs)
+				return nil, store.Register(c.DeviceID, c.ChannelID, c.Version)
+			},
+		},
+		"Store.Update": {
+			func() interface{} { return new(channelArgs) },
+			func(args interface{}) (interface{}, error) {
+				c := args.(*channelArgs)
+				return nil, store.Update(c.DeviceID, c.ChannelID, c.Version)
+			},
+		},
+		"Store.Unregister": {
+			func() interface{} { return new(channelArgs) },
+			func(args interface{}) (interface{}, error) {
+				c := args.(*channelArgs)
+				return nil, store.Unregister(c.DeviceID, c.ChannelID)
+			},
+		},
+		"Store.Drop": {
+			func() interface{} { return new(channelArgs) },
+			func(args interface{}) (interface{}, error) {
+				c := args.(*channelArgs)
+				return nil, store.Drop(c.DeviceID, c.ChannelID)
+			},
+		},
+		"Store.FetchAll": {
+			func() interface{} { return new(fetchArgs) },
+			func(args interface{}) (interface{}, error) {
+				f := args.(*fetchArgs)
+				updates, expired, err := store.FetchAll(f.DeviceID, f.Since)
+				return &fetchReply{updates, expired}, err
+			},
+		},
+		"Store.DropAll": {
+			func() interface{} { return new(string) },
+			func(args interface{}) (interface{}, error) {
+				return nil, store.DropAll(*args.(*string))
+			},
+		},
+		"Store.FetchPing": {
+			func() interface{} { return new(string) },
+			func(args interface{}) (interface{}, error) {
+				pingData, err := store.FetchPing(*args.(*string))
+				return &pingArgs{PingData: pingData}, err
+			},
+		},
+		"Store.PutPing": {
+			func() interface{} { return new(pingArgs) },
+			func(args interface{}) (interface{}, error) {
+				p := args.(*pingArgs)
+				return nil, store.PutPing(p.DeviceID, p.PingData)
+			},
+		},
+		"Store.DropPing": {
+			func() interface{} { return new(string) },
+			func(args interface{}) (interface{}, error) {
+				return nil, store.DropPing(*args.(*string))
+			},
+		},
+	}
+}
+
+func pingerMethods(pinger Pinger) map[string]method {
+	return map[string]method{
+		"Pinger.Register": {
+			func() interface{} { return new(pingArgs) },
+			func(args interface{}) (interface{}, error) {
+				p := args.(*pingArgs)
+				return nil, pinger.Register(p.DeviceID, p.PingData)
+			},
+		},
+		"Pinger.Send": {
+			func() interface{} { return new(sendArgs) },
+			func(args interface{}) (interface{}, error) {
+				s := args.(*sendArgs)
+				return pinger.Send(s.DeviceID, s.Version, s.Data)
+			},
+		},
+		"Pinger.CanBypassWebsocket": {noArgs, func(interface{}) (interface{}, error) {
+			return pinger.CanBypassWebsocket(), nil
+		}},
+		"Pinger.Status": {noArgs, func(interface{}) (interface{}, error) {
+			return pinger.Status()
+		}},
+		"Pinger.Close": {noArgs, func(interface{}) (interface{}, error) {
+			return nil, pinger.Close()
+		}},
+	}
+}
+
+func balancerMethods(balancer Balancer) map[string]method {
+	return map[string]method{
+		"Balancer.RedirectURL": {noArgs, func(interface{}) (interface{}, error) {
+			origin, ok, err := balancer.RedirectURL()
+			return &redirectReply{origin, ok}, err
+		}},
+		"Balancer.Status": {noArgs, func(interface{}) (interface{}, error) {
+			return balancer.Status()
+		}},
+		"Balancer.Close": {noArgs, func(interface{}) (interface{}, error) {
+			return nil, balancer.Close()
+		}},
+	}
+}
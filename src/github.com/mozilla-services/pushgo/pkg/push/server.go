@@ -0,0 +1,92 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package push
+
+import (
+	"errors"
+
+	"github.com/mozilla-services/pushgo/simplepush"
+)
+
+var ErrNoConfigFile = errors.New("push: Missing configuration file")
+
+// Hook is a named component that holds device data outside the store and
+// pinger. Hooks run after the built-in components, in order.
+type Hook struct {
+	Name     string
+	Eraser   Eraser   // Optional.
+	Exporter Exporter // Optional.
+}
+
+// Options configures a server.
+type Options struct {
+	// ConfigFile is the path to the TOML configuration file. Required.
+	ConfigFile string
+
+	// LogLevel overrides the minimum log level set in the [logging]
+	// section. The zero value keeps the configured level.
+	LogLevel LogLevel
+
+	// Hooks are called for erasure and data portability requests.
+	Hooks []Hook
+}
+
+// Server is a Simple Push server.
+type Server struct {
+	app        *simplepush.Application
+	configFile string
+}
+
+// NewServer loads a server from opts. The server's listeners are open when
+// NewServer returns, but connections aren't served until Run is called.
+func NewServer(opts Options) (*Server, error) {
+	if len(opts.ConfigFile) == 0 {
+		return nil, ErrNoConfigFile
+	}
+	app, err := simplepush.LoadApplicationFromFileName(opts.ConfigFile,
+		int(opts.LogLevel))
+	if err != nil {
+		return nil, err
+	}
+	for _, hook := range opts.Hooks {
+		if hook.Eraser != nil {
+			app.AddEraser(hook.Name, hook.Eraser)
+		}
+		if hook.Exporter != nil {
+			app.AddExporter(hook.Name, hook.Exporter)
+		}
+	}
+	return &Server{app: app, configFile: opts.ConfigFile}, nil
+}
+
+// Hostname returns the server's public host name.
+func (s *Server) Hostname() string {
+	return s.app.Hostname()
+}
+
+// Run starts serving connections. Errors that stop the server are sent on
+// the returned channel; the caller should then call Close.
+func (s *Server) Run() <-chan error {
+	return s.app.Run()
+}
+
+// Reload re-reads the configuration file, and applies the settings that can
+// change without a restart. Changes to other settings are logged and ignored.
+func (s *Server) Reload() error {
+	return s.app.ConfigReloader().ReloadFile(s.configFile)
+}
+
+// Drain stops accepting client connections, asks connected clients to
+// reconnect to another server, and waits up to the drain timeout for them to
+// disconnect. Returns the number of clients still connected. Call Close
+// afterward.
+func (s *Server) Drain() (remaining int) {
+	return s.app.Drain()
+}
+
+// Close stops the server, and closes the store and pinger.
+func (s *Server) Close() error {
+	return s.app.Close()
+}
@@ -0,0 +1,90 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package push
+
+import (
+	"errors"
+	"time"
+)
+
+// Errors returned by stores. The server answers these with the matching
+// client error, instead of an internal server error.
+var (
+	ErrInvalidID          = errors.New("push: Invalid device ID")
+	ErrInvalidChannel     = errors.New("push: Invalid channel ID")
+	ErrInvalidKey         = errors.New("push: Invalid channel primary key")
+	ErrNonexistentChannel = errors.New("push: Channel does not exist")
+	ErrChannelGone        = errors.New("push: Channel was unregistered")
+	ErrStaleVersion       = errors.New("push: Update version older than the stored version")
+)
+
+// Update is a pending channel update.
+type Update struct {
+	ChannelID string
+	Version   uint64
+	Data      string // Optional payload.
+}
+
+// Store keeps channel registrations, pending updates, and proprietary ping
+// registrations. Device and channel IDs are hex-encoded UUIDs; methods
+// return ErrInvalidID or ErrInvalidChannel for malformed IDs. Methods may be
+// called concurrently.
+type Store interface {
+	// CanStore indicates whether the store can keep the specified number of
+	// channels per device.
+	CanStore(channels int) bool
+
+	// Close closes the store, releasing its resources and unblocking pending
+	// operations.
+	Close() error
+
+	// KeyToIDs extracts the device and channel IDs from a key returned by
+	// IDsToKey, or returns ErrInvalidKey.
+	KeyToIDs(key string) (deviceID, channelID string, err error)
+
+	// IDsToKey encodes the device and channel IDs into a composite key. Keys
+	// are embedded in push endpoints.
+	IDsToKey(deviceID, channelID string) (key string, err error)
+
+	// Status indicates whether the store's backend is healthy.
+	Status() (ok bool, err error)
+
+	// Exists indicates whether the device has registered channels.
+	Exists(deviceID string) bool
+
+	// Register creates a channel record.
+	Register(deviceID, channelID string, version int64) error
+
+	// Update stores a new version for a channel. It returns
+	// ErrNonexistentChannel if the channel isn't registered, ErrChannelGone
+	// if it was unregistered, and ErrStaleVersion if a newer version is
+	// already stored.
+	Update(deviceID, channelID string, version int64) error
+
+	// Unregister marks a channel as inactive.
+	Unregister(deviceID, channelID string) error
+
+	// Drop removes a channel record.
+	Drop(deviceID, channelID string) error
+
+	// FetchAll returns a device's updates since the cutoff time, and its
+	// expired channels. If since is the zero time, all pending updates are
+	// returned.
+	FetchAll(deviceID string, since time.Time) (updates []Update,
+		expired []string, err error)
+
+	// DropAll removes all channel records for a device.
+	DropAll(deviceID string) error
+
+	// FetchPing returns the device's proprietary ping registration, or nil
+	// if the device has none.
+	FetchPing(deviceID string) ([]byte, error)
+
+	// PutPing stores a proprietary ping registration for the device.
+	PutPing(deviceID string, pingData []byte) error
+
+	// DropPing removes the device's proprietary ping registration.
+	DropPing(deviceID string) error
+}
@@ -0,0 +1,344 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoBan      = errors.New("Ban not found")
+	ErrNoBanStore = errors.New("Storage does not support bans")
+	ErrInvalidBan = errors.New("Invalid ban")
+)
+
+// Ban kinds. Bans apply to either a device ID or a client IP address.
+const (
+	BanUAID = "uaid"
+	BanIP   = "ip"
+)
+
+// Ban records a temporary ban for a device ID or client IP. Bans are kept in
+// the shared store, so that a client banned by one node is refused by all
+// nodes in the cluster.
+type Ban struct {
+	Kind     string `json:"kind"`
+	Value    string `json:"value"`
+	Reason   string `json:"reason"`
+	Score    int    `json:"score"`
+	BannedAt int64  `json:"bannedAt"` // Seconds since Epoch.
+	Expires  int64  `json:"expires"`  // Seconds since Epoch.
+}
+
+// Key returns the storage key for the ban.
+func (b *Ban) Key() string {
+	return BanKey(b.Kind, b.Value)
+}
+
+// BanKey returns the storage key for a ban of the given kind.
+func BanKey(kind, value string) string {
+	return kind + ":" + value
+}
+
+// BanStore is an optional interface implemented by storage adapters that
+// can hold bans. Abuse scoring requires the configured Store to satisfy this
+// interface.
+type BanStore interface {
+	// PutBan stores a ban until it expires.
+	PutBan(ban *Ban) error
+
+	// FetchBans returns all active bans.
+	FetchBans() ([]*Ban, error)
+
+	// FetchBan returns the ban with the given key, or ErrNoBan if the ban
+	// does not exist or has expired.
+	FetchBan(key string) (*Ban, error)
+
+	// DropBan lifts a ban.
+	DropBan(key string) error
+}
+
+// Violation is a kind of client misbehavior.
+type Violation int
+
+const (
+	ViolationPing     Violation = iota // Too many pings.
+	ViolationPayload                   // Malformed or unsupported command.
+	ViolationRegister                  // Too many registrations.
+	ViolationCrash                     // Command crashed the server.
+)
+
+func (v Violation) String() string {
+	switch v {
+	case ViolationPing:
+		return "too_many_pings"
+	case ViolationPayload:
+		return "bad_payload"
+	case ViolationRegister:
+		return "too_many_registers"
+	case ViolationCrash:
+		return "crash"
+	}
+	return "unknown"
+}
+
+type AbuseScorerConfig struct {
+	Enabled bool
+
+	// Threshold is the score at which a device ID or IP is banned.
+	Threshold int
+
+	// Window is the period over which violations are scored.
+	Window string
+
+	// BanPeriod is how long a ban lasts.
+	BanPeriod string `toml:"ban_period" env:"ban_period"`
+
+	// The score added for each kind of violation.
+	PingScore     int `toml:"ping_score" env:"ping_score"`
+	PayloadScore  int `toml:"payload_score" env:"payload_score"`
+	RegisterScore int `toml:"register_score" env:"register_score"`
+	CrashScore    int `toml:"crash_score" env:"crash_score"`
+
+	// CacheTTL is how long ban lookups are cached, so that handshakes don't
+	// fetch bans from the store for every connection. Bans stored by other
+	// nodes, or lifted through the admin API, apply to this node once the
+	// cached lookup expires. Disabled if empty.
+	CacheTTL string `toml:"cache_ttl" env:"cache_ttl"`
+
+	// CacheSize is the maximum number of cached ban lookups. Defaults to
+	// 10000.
+	CacheSize int `toml:"cache_size" env:"cache_size"`
+}
+
+// AbuseScorer aggregates client violations by device ID and IP, and bans
+// clients whose score exceeds the threshold within the scoring window. Scores
+// are tracked per node; bans are stored in the shared store.
+type AbuseScorer struct {
+	logger    *SimpleLogger
+	metrics   Statistician
+	bans      BanStore
+	threshold int
+	window    time.Duration
+	banPeriod time.Duration
+	weights   map[Violation]int
+	scoresMux sync.Mutex
+	scores    map[string]*abuseScore
+	cache     *banCache // May be nil.
+}
+
+// abuseScore is the violation score for a device ID or IP.
+type abuseScore struct {
+	score       int
+	windowStart time.Time
+}
+
+// NewAbuseScorer creates an abuse scorer from conf. The application store
+// must implement BanStore.
+func NewAbuseScorer(app *Application, conf AbuseScorerConfig) (
+	s *AbuseScorer, err error) {
+
+	bans, ok := app.Store().(BanStore)
+	if !ok {
+		return nil, ErrNoBanStore
+	}
+	s = &AbuseScorer{
+		logger:    app.Logger(),
+		metrics:   app.Metrics(),
+		bans:      bans,
+		threshold: conf.Threshold,
+		weights: map[Violation]int{
+			ViolationPing:     conf.PingScore,
+			ViolationPayload:  conf.PayloadScore,
+			ViolationRegister: conf.RegisterScore,
+			ViolationCrash:    conf.CrashScore,
+		},
+		scores: make(map[string]*abuseScore),
+	}
+	if s.window, err = time.ParseDuration(conf.Window); err != nil {
+		return nil, err
+	}
+	if s.banPeriod, err = time.ParseDuration(conf.BanPeriod); err != nil {
+		return nil, err
+	}
+	if len(conf.CacheTTL) > 0 {
+		ttl, err := time.ParseDuration(conf.CacheTTL)
+		if err != nil {
+			return nil, err
+		}
+		size := conf.CacheSize
+		if size <= 0 {
+			size = 10000
+		}
+		s.cache = newBanCache(size, ttl)
+	}
+	return s, nil
+}
+
+// Report records a violation for the device ID and client address, either
+// of which may be empty. Returns true if the violation banned the client.
+func (s *AbuseScorer) Report(uaid, addr string, v Violation) (banned bool) {
+	s.metrics.Increment("client.abuse." + v.String())
+	if len(uaid) > 0 && s.score(BanUAID, uaid, v) {
+		banned = true
+	}
+	if host := hostOf(addr); len(host) > 0 && s.score(BanIP, host, v) {
+		banned = true
+	}
+	return banned
+}
+
+// score adds the violation weight to the score for kind and value, and bans
+// the client if the score reaches the threshold.
+func (s *AbuseScorer) score(kind, value string, v Violation) (banned bool) {
+	weight := s.weights[v]
+	if weight <= 0 || s.threshold <= 0 {
+		return false
+	}
+	key := BanKey(kind, value)
+	now := timeNow()
+	s.scoresMux.Lock()
+	s.prune(now)
+	score, ok := s.scores[key]
+	if !ok || now.Sub(score.windowStart) >= s.window {
+		score = &abuseScore{windowStart: now}
+		s.scores[key] = score
+	}
+	score.score += weight
+	total := score.score
+	if total >= s.threshold {
+		// Reset the score; the ban covers subsequent violations.
+		delete(s.scores, key)
+	}
+	s.scoresMux.Unlock()
+	if total < s.threshold {
+		return false
+	}
+	ban := &Ban{
+		Kind:     kind,
+		Value:    value,
+		Reason:   v.String(),
+		Score:    total,
+		BannedAt: now.Unix(),
+		Expires:  now.Add(s.banPeriod).Unix(),
+	}
+	if err := s.bans.PutBan(ban); err != nil {
+		if s.logger.ShouldLog(ERROR) {
+			s.logger.Error("abuse", "Could not store ban", LogFields{
+				"key": key, "error": err.Error()})
+		}
+		return false
+	}
+	s.cache.Put(key, ban.Expires)
+	if s.logger.ShouldLog(WARNING) {
+		s.logger.Warn("abuse", "Client exceeded abuse threshold; banning",
+			LogFields{"key": key, "reason": ban.Reason,
+				"score": strconv.Itoa(total), "period": s.banPeriod.String()})
+	}
+	s.metrics.Increment("client.abuse.banned")
+	return true
+}
+
+// prune removes expired scores. The caller must hold the scores lock.
+func (s *AbuseScorer) prune(now time.Time) {
+	for key, score := range s.scores {
+		if now.Sub(score.windowStart) >= s.window {
+			delete(s.scores, key)
+		}
+	}
+}
+
+// Banned indicates whether the device ID or client IP is banned. Lookup
+// errors are logged, and the client is allowed.
+func (s *AbuseScorer) Banned(kind, value string) bool {
+	if len(value) == 0 {
+		return false
+	}
+	if kind == BanIP {
+		value = hostOf(value)
+	}
+	key := BanKey(kind, value)
+	if s.cache != nil {
+		if expires, ok := s.cache.Get(key); ok {
+			s.metrics.Increment("client.abuse.cache.hit")
+			return timeNow().Unix() < expires
+		}
+		s.metrics.Increment("client.abuse.cache.miss")
+	}
+	ban, err := s.bans.FetchBan(key)
+	if err != nil {
+		if err == ErrNoBan {
+			s.cache.Put(key, 0)
+		} else if s.logger.ShouldLog(WARNING) {
+			s.logger.Warn("abuse", "Could not fetch ban", LogFields{
+				"key": key, "error": err.Error()})
+		}
+		return false
+	}
+	s.cache.Put(key, ban.Expires)
+	return timeNow().Unix() < ban.Expires
+}
+
+// cachedBan is the result of a ban lookup.
+type cachedBan struct {
+	expires   int64 // Ban expiry, in seconds since Epoch; 0 if not banned.
+	expiresAt time.Time
+}
+
+// banCache is a bounded cache of ban lookups. Entries expire after the TTL.
+// A nil banCache caches nothing.
+type banCache struct {
+	ttl      time.Duration
+	size     int
+	cacheMux sync.Mutex
+	bans     map[string]cachedBan
+}
+
+func newBanCache(size int, ttl time.Duration) *banCache {
+	return &banCache{ttl: ttl, size: size, bans: make(map[string]cachedBan)}
+}
+
+// Get returns the cached ban expiry for key, if the lookup has not expired.
+func (c *banCache) Get(key string) (expires int64, ok bool) {
+	c.cacheMux.Lock()
+	defer c.cacheMux.Unlock()
+	entry, ok := c.bans[key]
+	if !ok {
+		return 0, false
+	}
+	if !timeNow().Before(entry.expiresAt) {
+		delete(c.bans, key)
+		return 0, false
+	}
+	return entry.expires, true
+}
+
+// Put caches the ban expiry for key. If the cache is full, expired entries
+// are removed; if none have expired, an arbitrary entry is evicted.
+func (c *banCache) Put(key string, expires int64) {
+	if c == nil {
+		return
+	}
+	c.cacheMux.Lock()
+	defer c.cacheMux.Unlock()
+	now := timeNow()
+	if _, ok := c.bans[key]; !ok && len(c.bans) >= c.size {
+		for k, entry := range c.bans {
+			if !now.Before(entry.expiresAt) {
+				delete(c.bans, k)
+			}
+		}
+		for k := range c.bans {
+			if len(c.bans) < c.size {
+				break
+			}
+			delete(c.bans, k)
+		}
+	}
+	c.bans[key] = cachedBan{expires, now.Add(c.ttl)}
+}
@@ -0,0 +1,157 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testBanStore wraps a Store with in-memory bans.
+type testBanStore struct {
+	Store
+	bans map[string]*Ban
+}
+
+func newTestBanStore(store Store) *testBanStore {
+	return &testBanStore{Store: store, bans: make(map[string]*Ban)}
+}
+
+func (s *testBanStore) PutBan(ban *Ban) error {
+	s.bans[ban.Key()] = ban
+	return nil
+}
+
+func (s *testBanStore) FetchBans() ([]*Ban, error) {
+	bans := make([]*Ban, 0, len(s.bans))
+	for _, ban := range s.bans {
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
+
+func (s *testBanStore) FetchBan(key string) (*Ban, error) {
+	ban, ok := s.bans[key]
+	if !ok {
+		return nil, ErrNoBan
+	}
+	return ban, nil
+}
+
+func (s *testBanStore) DropBan(key string) error {
+	if _, ok := s.bans[key]; !ok {
+		return ErrNoBan
+	}
+	delete(s.bans, key)
+	return nil
+}
+
+func TestAbuseScorer(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+
+	defer saveTimeFuncs()()
+	var now time.Time
+	timeNow = func() time.Time { return now }
+
+	Convey("Abuse scoring", t, func() {
+		now = time.Unix(1257894000, 0).UTC()
+		store := newTestBanStore(mckStore)
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(store)
+
+		scorer, err := NewAbuseScorer(app, AbuseScorerConfig{
+			Threshold:     100,
+			Window:        "10m",
+			BanPeriod:     "1h",
+			PingScore:     10,
+			PayloadScore:  20,
+			RegisterScore: 50,
+		})
+		So(err, ShouldBeNil)
+		uaid := "6a4f5b0e1c2d4e3f8a9b0c1d2e3f4a5b"
+		addr := "192.0.2.57:4321"
+
+		Convey("Should require a ban store", func() {
+			app.SetStore(mckStore)
+			_, err := NewAbuseScorer(app, AbuseScorerConfig{})
+			So(err, ShouldEqual, ErrNoBanStore)
+		})
+
+		Convey("Should ban device IDs and IPs that exceed the threshold", func() {
+			mckStat.EXPECT().Increment("client.abuse.too_many_registers").Times(2)
+			mckStat.EXPECT().Increment("client.abuse.banned").Times(2)
+
+			So(scorer.Report(uaid, addr, ViolationRegister), ShouldBeFalse)
+			So(scorer.Banned(BanUAID, uaid), ShouldBeFalse)
+			So(scorer.Report(uaid, addr, ViolationRegister), ShouldBeTrue)
+			So(scorer.Banned(BanUAID, uaid), ShouldBeTrue)
+			So(scorer.Banned(BanIP, "192.0.2.57:1234"), ShouldBeTrue)
+			So(scorer.Banned(BanIP, "192.0.2.58:4321"), ShouldBeFalse)
+
+			ban := store.bans[BanKey(BanIP, "192.0.2.57")]
+			So(ban, ShouldNotBeNil)
+			So(ban.Reason, ShouldEqual, "too_many_registers")
+			So(ban.Expires, ShouldEqual, now.Add(time.Hour).Unix())
+
+			now = now.Add(time.Hour)
+			So(scorer.Banned(BanUAID, uaid), ShouldBeFalse)
+		})
+
+		Convey("Should only score violations within the window", func() {
+			mckStat.EXPECT().Increment("client.abuse.bad_payload").Times(5)
+
+			for i := 0; i < 4; i++ {
+				So(scorer.Report(uaid, "", ViolationPayload), ShouldBeFalse)
+			}
+			now = now.Add(10 * time.Minute)
+			So(scorer.Report(uaid, "", ViolationPayload), ShouldBeFalse)
+			So(store.bans, ShouldBeEmpty)
+		})
+
+		Convey("Should cache ban lookups", func() {
+			cached, err := NewAbuseScorer(app, AbuseScorerConfig{
+				Threshold: 100,
+				Window:    "10m",
+				BanPeriod: "1h",
+				CacheTTL:  "10s",
+			})
+			So(err, ShouldBeNil)
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("client.abuse.cache.miss"),
+				mckStat.EXPECT().Increment("client.abuse.cache.hit"),
+				mckStat.EXPECT().Increment("client.abuse.cache.miss"),
+			)
+
+			So(cached.Banned(BanUAID, uaid), ShouldBeFalse)
+			// Bans stored by other nodes apply once the lookup expires.
+			store.PutBan(&Ban{Kind: BanUAID, Value: uaid,
+				Expires: now.Add(time.Hour).Unix()})
+			So(cached.Banned(BanUAID, uaid), ShouldBeFalse)
+			now = now.Add(10 * time.Second)
+			So(cached.Banned(BanUAID, uaid), ShouldBeTrue)
+		})
+
+		Convey("Should ignore violations without a score", func() {
+			mckStat.EXPECT().Increment("client.abuse.crash").Times(10)
+
+			for i := 0; i < 10; i++ {
+				So(scorer.Report(uaid, addr, ViolationCrash), ShouldBeFalse)
+			}
+		})
+	})
+}
@@ -0,0 +1,82 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"hash/fnv"
+	"io"
+	"sync"
+	"time"
+)
+
+type AdmissionConfig struct {
+	Enabled bool
+
+	// Waves is the number of device ID hash buckets. After a restart, one
+	// bucket is admitted per interval, until all clients are admitted.
+	Waves int
+
+	// Interval is the time between waves.
+	Interval string
+}
+
+// AdmissionControl smooths the reconnect stampede after a restart by
+// admitting reconnecting clients in waves, based on a hash of the device ID.
+// Clients outside the open waves are told when to retry. New clients without
+// a device ID are always admitted.
+type AdmissionControl struct {
+	waves    int
+	interval time.Duration
+	startMux sync.RWMutex
+	start    time.Time
+}
+
+// NewAdmissionControl creates an admission controller from conf. The first
+// wave opens immediately.
+func NewAdmissionControl(conf AdmissionConfig) (a *AdmissionControl, err error) {
+	a = &AdmissionControl{waves: conf.Waves, start: timeNow()}
+	if a.interval, err = time.ParseDuration(conf.Interval); err != nil {
+		return nil, err
+	}
+	if a.waves < 1 {
+		a.waves = 1
+	}
+	return a, nil
+}
+
+// Engage restarts admission from the first wave, as after a restart.
+func (a *AdmissionControl) Engage() {
+	a.startMux.Lock()
+	a.start = timeNow()
+	a.startMux.Unlock()
+}
+
+// Active indicates whether some waves have not yet been admitted.
+func (a *AdmissionControl) Active() bool {
+	return timeNow().Before(a.openAt(a.waves - 1))
+}
+
+// Admit returns zero if the client with the given device ID may connect, or
+// the time remaining until its wave opens.
+func (a *AdmissionControl) Admit(uaid string) (retryAfter time.Duration) {
+	if len(uaid) == 0 {
+		return 0
+	}
+	h := fnv.New32a()
+	io.WriteString(h, uaid)
+	wave := int(h.Sum32() % uint32(a.waves))
+	if retryAfter = a.openAt(wave).Sub(timeNow()); retryAfter < 0 {
+		return 0
+	}
+	return retryAfter
+}
+
+// openAt returns the time at which the given wave opens.
+func (a *AdmissionControl) openAt(wave int) time.Time {
+	a.startMux.RLock()
+	start := a.start
+	a.startMux.RUnlock()
+	return start.Add(time.Duration(wave) * a.interval)
+}
@@ -0,0 +1,77 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAdmissionControl(t *testing.T) {
+	defer saveTimeFuncs()()
+	var now time.Time
+	timeNow = func() time.Time { return now }
+
+	Convey("Admission control", t, func() {
+		now = time.Unix(1257894000, 0).UTC()
+		admission, err := NewAdmissionControl(AdmissionConfig{
+			Enabled:  true,
+			Waves:    4,
+			Interval: "30s",
+		})
+		So(err, ShouldBeNil)
+		uaids := []string{
+			"6a4f5b0e1c2d4e3f8a9b0c1d2e3f4a5b",
+			"d1c7bcaa3c8b4f7a8e8d5b9b1c2a3f4e",
+			"0f9e8d7c6b5a49382716a5b4c3d2e1f0",
+			"abcdefabcdef4abc8def0123456789ab",
+			"11223344556677889900aabbccddeeff",
+			"ffeeddccbbaa99887766554433221100",
+		}
+
+		Convey("Should admit all clients once every wave opens", func() {
+			So(admission.Active(), ShouldBeTrue)
+			for i := 0; i < 4; i++ {
+				for _, uaid := range uaids {
+					So(admission.Admit(uaid), ShouldBeLessThanOrEqualTo,
+						time.Duration(3-i)*30*time.Second)
+				}
+				now = now.Add(30 * time.Second)
+			}
+			So(admission.Active(), ShouldBeFalse)
+			for _, uaid := range uaids {
+				So(admission.Admit(uaid), ShouldEqual, 0)
+			}
+		})
+
+		Convey("Should defer some clients during the first wave", func() {
+			var deferred int
+			for _, uaid := range uaids {
+				if admission.Admit(uaid) > 0 {
+					deferred++
+				}
+			}
+			So(deferred, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("Should always admit new clients", func() {
+			So(admission.Admit(""), ShouldEqual, 0)
+		})
+
+		Convey("Should restart the waves when engaged", func() {
+			now = now.Add(2 * time.Minute)
+			So(admission.Active(), ShouldBeFalse)
+			admission.Engage()
+			So(admission.Active(), ShouldBeTrue)
+		})
+
+		Convey("Should reject invalid intervals", func() {
+			_, err := NewAdmissionControl(AdmissionConfig{Waves: 4, Interval: "soon"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
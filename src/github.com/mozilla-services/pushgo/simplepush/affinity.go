@@ -0,0 +1,113 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+)
+
+var ErrNoAffinityStore = errors.New(
+	"Storage adapter does not support connection affinity")
+
+type AffinityConfig struct {
+	// Enabled stores the node that each device last connected to, and
+	// redirects reconnecting devices back to that node if it is below the
+	// balancer's redirection threshold.
+	Enabled bool
+}
+
+// AffinityStore is an optional interface implemented by stores that keep the
+// last node each device connected to.
+type AffinityStore interface {
+	// FetchAffinity returns the WebSocket URL of the node that the device last
+	// connected to, or an empty string if unknown.
+	FetchAffinity(suaid string) (origin string, err error)
+
+	// PutAffinity records the node that the device connected to.
+	PutAffinity(suaid, origin string) error
+}
+
+// AffinityBalancer is an optional interface implemented by balancers that
+// track the free connections of their peers.
+type AffinityBalancer interface {
+	// HasCapacity indicates whether the peer at origin is below the
+	// redirection threshold, and accepts new connections.
+	HasCapacity(origin string) bool
+}
+
+// Affinity redirects reconnecting devices to the node they last connected
+// to, improving routing locality and cache hit rates. Devices are only
+// redirected if the balancer reports that the node has capacity;
+// otherwise, they fall back to the balancer. A nil Affinity never redirects.
+type Affinity struct {
+	app     *Application
+	logger  *SimpleLogger
+	metrics Statistician
+	store   AffinityStore
+	origin  string // This node's WebSocket URL.
+}
+
+// NewAffinity creates a connection affinity policy for the node at origin.
+func NewAffinity(app *Application, origin string) (*Affinity, error) {
+	store, ok := app.Store().(AffinityStore)
+	if !ok {
+		return nil, ErrNoAffinityStore
+	}
+	a := &Affinity{
+		app:     app,
+		logger:  app.Logger(),
+		metrics: app.Metrics(),
+		store:   store,
+		origin:  origin,
+	}
+	return a, nil
+}
+
+// Hint returns the node that the device last connected to, and whether the
+// device should be redirected there.
+func (a *Affinity) Hint(uaid string) (origin string, redirect bool) {
+	if a == nil {
+		return "", false
+	}
+	origin, err := a.store.FetchAffinity(uaid)
+	if err != nil {
+		if a.logger.ShouldLog(WARNING) {
+			a.logger.Warn("affinity", "Could not fetch connection affinity",
+				LogFields{"uaid": uaid, "error": err.Error()})
+		}
+		a.metrics.Increment("updates.client.affinity.error")
+		return "", false
+	}
+	if len(origin) == 0 {
+		a.metrics.Increment("updates.client.affinity.miss")
+		return "", false
+	}
+	if origin == a.origin {
+		a.metrics.Increment("updates.client.affinity.local")
+		return origin, false
+	}
+	b, ok := a.app.Balancer().(AffinityBalancer)
+	if !ok || !b.HasCapacity(origin) {
+		a.metrics.Increment("updates.client.affinity.full")
+		return origin, false
+	}
+	a.metrics.Increment("updates.client.affinity.redirect")
+	return origin, true
+}
+
+// Record stores this node as the device's last node, unless prevOrigin, as
+// returned by Hint, is already this node.
+func (a *Affinity) Record(uaid, prevOrigin string) {
+	if a == nil || prevOrigin == a.origin {
+		return
+	}
+	if err := a.store.PutAffinity(uaid, a.origin); err != nil {
+		if a.logger.ShouldLog(WARNING) {
+			a.logger.Warn("affinity", "Could not store connection affinity",
+				LogFields{"uaid": uaid, "error": err.Error()})
+		}
+		a.metrics.Increment("updates.client.affinity.error")
+	}
+}
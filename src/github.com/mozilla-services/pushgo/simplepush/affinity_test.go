@@ -0,0 +1,117 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// affinityStore keeps connection affinity records in memory.
+type affinityStore struct {
+	NoStore
+	origins map[string]string
+	err     error
+}
+
+func (s *affinityStore) FetchAffinity(uaid string) (string, error) {
+	return s.origins[uaid], s.err
+}
+
+func (s *affinityStore) PutAffinity(uaid, origin string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.origins[uaid] = origin
+	return nil
+}
+
+// capacityBalancer reports fixed peer capacities.
+type capacityBalancer struct {
+	NoBalancer
+	free map[string]bool
+}
+
+func (b *capacityBalancer) HasCapacity(origin string) bool {
+	return b.free[origin]
+}
+
+func TestAffinity(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	uaid := "5e1e5984569c4f00bf4bea47754a6403"
+
+	Convey("Connection affinity", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		store := &affinityStore{origins: make(map[string]string)}
+		app.SetStore(store)
+		balancer := &capacityBalancer{free: map[string]bool{
+			"ws://node1": true,
+		}}
+		app.SetBalancer(balancer)
+		a, err := NewAffinity(app, "ws://local")
+		So(err, ShouldBeNil)
+
+		Convey("Should redirect to the last node if it has capacity", func() {
+			store.origins[uaid] = "ws://node1"
+			mckStat.EXPECT().Increment("updates.client.affinity.redirect")
+			origin, redirect := a.Hint(uaid)
+			So(redirect, ShouldBeTrue)
+			So(origin, ShouldEqual, "ws://node1")
+		})
+
+		Convey("Should fall back to the balancer if the last node is full", func() {
+			store.origins[uaid] = "ws://node2"
+			mckStat.EXPECT().Increment("updates.client.affinity.full")
+			origin, redirect := a.Hint(uaid)
+			So(redirect, ShouldBeFalse)
+
+			a.Record(uaid, origin)
+			So(store.origins[uaid], ShouldEqual, "ws://local")
+		})
+
+		Convey("Should not redirect devices that last connected here", func() {
+			store.origins[uaid] = "ws://local"
+			mckStat.EXPECT().Increment("updates.client.affinity.local")
+			origin, redirect := a.Hint(uaid)
+			So(redirect, ShouldBeFalse)
+
+			// Unchanged affinity isn't stored again.
+			store.err = errors.New("memcache unavailable")
+			a.Record(uaid, origin)
+		})
+
+		Convey("Should not redirect if the store fails", func() {
+			store.err = errors.New("memcache unavailable")
+			mckStat.EXPECT().Increment("updates.client.affinity.error")
+			_, redirect := a.Hint(uaid)
+			So(redirect, ShouldBeFalse)
+		})
+
+		Convey("Should require a store that supports affinity", func() {
+			app.SetStore(&NoStore{})
+			_, err := NewAffinity(app, "ws://local")
+			So(err, ShouldEqual, ErrNoAffinityStore)
+		})
+
+		Convey("Should not redirect if disabled", func() {
+			var a *Affinity
+			_, redirect := a.Hint(uaid)
+			So(redirect, ShouldBeFalse)
+		})
+	})
+}
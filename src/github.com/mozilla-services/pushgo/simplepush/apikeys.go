@@ -0,0 +1,507 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoAPIKey         = errors.New("API key not found")
+	ErrNoAPIKeyStore    = errors.New("Storage does not support API keys")
+	ErrMissingAPIKey    = errors.New("Missing API key")
+	ErrInvalidAPIKey    = errors.New("Invalid API key")
+	ErrAPIKeyRevoked    = errors.New("API key revoked")
+	ErrAPIKeyTenant     = errors.New("API key not issued for this tenant")
+	ErrAPIKeyLimited    = errors.New("API key rate limit exceeded")
+	ErrInvalidRateLimit = errors.New("Invalid API key rate limit")
+	ErrAPIKeyConfigured = errors.New("API key is set in the configuration file")
+)
+
+const (
+	// apiKeyWindow is the rate limiting window for API keys.
+	apiKeyWindow = time.Minute
+
+	// maxMissingAPIKeys bounds the number of unknown key IDs cached by each
+	// node.
+	maxMissingAPIKeys = 1024
+)
+
+// APIKey is an app server credential issued to a tenant. Only the SHA-256
+// hash of the key's secret is stored; the secret is returned once, when the
+// key is created or rotated.
+type APIKey struct {
+	ID          string `json:"id"`
+	Tenant      string `json:"tenant"`
+	Hash        string `json:"hash,omitempty"`
+	PrevHash    string `json:"prevHash,omitempty"`    // Replaced secret.
+	PrevExpires int64  `json:"prevExpires,omitempty"` // Seconds since Epoch.
+	RateLimit   int    `json:"rateLimit"`             // Updates per minute.
+	CreatedAt   int64  `json:"createdAt"`             // Seconds since Epoch.
+	RotatedAt   int64  `json:"rotatedAt,omitempty"`   // Seconds since Epoch.
+	RevokedAt   int64  `json:"revokedAt,omitempty"`   // Seconds since Epoch.
+}
+
+// Revoked indicates whether the key has been revoked.
+func (k *APIKey) Revoked() bool {
+	return k.RevokedAt > 0
+}
+
+// Redacted returns a copy of the key without the secret hashes, for admin
+// API replies.
+func (k *APIKey) Redacted() *APIKey {
+	redacted := *k
+	redacted.Hash, redacted.PrevHash = "", ""
+	return &redacted
+}
+
+// matches indicates whether secret is the key's current secret, or a
+// replaced secret that hasn't expired.
+func (k *APIKey) matches(secret string, now time.Time) bool {
+	sum := hashAPIKeySecret(secret)
+	if subtle.ConstantTimeCompare([]byte(sum), []byte(k.Hash)) == 1 {
+		return true
+	}
+	return len(k.PrevHash) > 0 && now.Unix() < k.PrevExpires &&
+		subtle.ConstantTimeCompare([]byte(sum), []byte(k.PrevHash)) == 1
+}
+
+// APIKeyStore is an optional interface implemented by storage adapters that
+// can hold API keys. API keys require the configured Store to satisfy this
+// interface.
+type APIKeyStore interface {
+	// PutAPIKey creates or replaces an API key.
+	PutAPIKey(key *APIKey) error
+
+	// FetchAPIKeys returns all API keys, including revoked keys.
+	FetchAPIKeys() ([]*APIKey, error)
+
+	// FetchAPIKey returns the API key with the given ID, or ErrNoAPIKey if the
+	// key does not exist.
+	FetchAPIKey(id string) (*APIKey, error)
+}
+
+type APIKeyConfig struct {
+	Enabled bool
+
+	// Required rejects updates without an API key. If false, updates may
+	// omit the key, but keys that are sent must be valid.
+	Required bool
+
+	// CacheTTL is the amount of time to cache API keys. Revocations and
+	// rotations made on other nodes take effect within this period. Defaults
+	// to "1m".
+	CacheTTL string `toml:"cache_ttl" env:"cache_ttl"`
+
+	// RotateGrace is the amount of time that a rotated key's old secret
+	// remains valid. Defaults to "24h".
+	RotateGrace string `toml:"rotate_grace" env:"rotate_grace"`
+
+	// DefaultRateLimit is the number of updates per minute allowed for keys
+	// created without a rate limit. Limits apply per node. Defaults to 0,
+	// which is unlimited.
+	DefaultRateLimit int `toml:"default_rate_limit" env:"default_rate_limit"`
+
+	// Keys are issued in the configuration file instead of the store, so
+	// that they remain valid if the store loses them, as memcached does when
+	// it restarts or evicts items. They can't be rotated or revoked through
+	// the admin API.
+	Keys []ConfiguredAPIKey `toml:"keys"`
+}
+
+// ConfiguredAPIKey is an API key issued in the configuration file. Its token
+// is "{id}.{secret}"; only the hex-encoded SHA-256 hash of the secret is
+// configured.
+type ConfiguredAPIKey struct {
+	ID        string `toml:"id"`
+	Tenant    string `toml:"tenant"`
+	Hash      string `toml:"hash"`
+	RateLimit int    `toml:"rate_limit"`
+}
+
+// APIKeyUsage counts the updates sent with a key since this node started.
+type APIKeyUsage struct {
+	Accepted int64 `json:"accepted"`
+	Limited  int64 `json:"limited"`
+}
+
+// apiKeyEntry is a cached API key and its rate limiting window.
+type apiKeyEntry struct {
+	key         *APIKey
+	fetchedAt   time.Time
+	windowStart time.Time
+	count       int
+	usage       APIKeyUsage
+}
+
+// APIKeys authenticates app servers with per-tenant API keys, and enforces
+// per-key rate limits. Keys are set in the configuration file, or kept in the
+// shared store and cached by each node. Rotations and revocations are
+// published as control events, if the control plane is enabled, so that
+// other nodes don't wait for their cached copies to expire. A nil APIKeys
+// accepts all updates.
+type APIKeys struct {
+	app          *Application
+	logger       *SimpleLogger
+	metrics      Statistician
+	store        APIKeyStore // Nil if only configured keys are used.
+	required     bool
+	cacheTTL     time.Duration
+	rotateGrace  time.Duration
+	defaultLimit int
+	configured   map[string]*APIKey
+	keysMux      sync.Mutex
+	keys         map[string]*apiKeyEntry // By key ID.
+	missing      map[string]time.Time    // Unknown key IDs, by fetch time.
+}
+
+// NewAPIKeys creates an API key manager from conf. The application store
+// must implement APIKeyStore, unless all keys are set in conf.
+func NewAPIKeys(app *Application, conf APIKeyConfig) (k *APIKeys, err error) {
+	store, ok := app.Store().(APIKeyStore)
+	if !ok && len(conf.Keys) == 0 {
+		return nil, ErrNoAPIKeyStore
+	}
+	if conf.DefaultRateLimit < 0 {
+		return nil, ErrInvalidRateLimit
+	}
+	k = &APIKeys{
+		app:          app,
+		logger:       app.Logger(),
+		metrics:      app.Metrics(),
+		store:        store,
+		required:     conf.Required,
+		defaultLimit: conf.DefaultRateLimit,
+		configured:   make(map[string]*APIKey, len(conf.Keys)),
+		keys:         make(map[string]*apiKeyEntry),
+		missing:      make(map[string]time.Time),
+	}
+	for _, c := range conf.Keys {
+		if len(c.ID) == 0 || len(c.Tenant) == 0 || len(c.Hash) == 0 {
+			return nil, fmt.Errorf("Invalid configured API key: %q", c.ID)
+		}
+		if c.RateLimit < 0 {
+			return nil, ErrInvalidRateLimit
+		}
+		rateLimit := c.RateLimit
+		if rateLimit == 0 {
+			rateLimit = k.defaultLimit
+		}
+		k.configured[c.ID] = &APIKey{
+			ID:        c.ID,
+			Tenant:    c.Tenant,
+			Hash:      strings.ToLower(c.Hash),
+			RateLimit: rateLimit,
+		}
+	}
+	if k.cacheTTL, err = time.ParseDuration(conf.CacheTTL); err != nil {
+		return nil, err
+	}
+	if k.rotateGrace, err = time.ParseDuration(conf.RotateGrace); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Check authenticates the API key sent as a bearer token with an update for
+// tenant, and counts the update against the key's rate limit. Returns the
+// key, which is nil if the request has no key and keys are optional.
+func (k *APIKeys) Check(req *http.Request, tenant string) (*APIKey, error) {
+	if k == nil {
+		return nil, nil
+	}
+	authHeader := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		if k.required {
+			k.metrics.Increment("updates.apikey.rejected")
+			return nil, ErrMissingAPIKey
+		}
+		return nil, nil
+	}
+	key, err := k.Authenticate(strings.TrimSpace(authHeader[len("Bearer "):]),
+		tenant)
+	switch err {
+	case nil:
+		k.metrics.Increment("updates.apikey.accepted")
+	case ErrAPIKeyLimited:
+		k.metrics.Increment("updates.apikey.limited")
+	default:
+		k.metrics.Increment("updates.apikey.rejected")
+	}
+	return key, err
+}
+
+// Authenticate verifies a token of the form "{id}.{secret}" issued to
+// tenant, and counts an update against the key's rate limit.
+func (k *APIKeys) Authenticate(token, tenant string) (*APIKey, error) {
+	dot := strings.IndexByte(token, '.')
+	if dot < 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	keyID, secret := token[:dot], token[dot+1:]
+	now := timeNow()
+	entry, err := k.entry(keyID, now)
+	if err != nil {
+		return nil, err
+	}
+	k.keysMux.Lock()
+	defer k.keysMux.Unlock()
+	key := entry.key
+	if !key.matches(secret, now) {
+		return nil, ErrInvalidAPIKey
+	}
+	if key.Revoked() {
+		return nil, ErrAPIKeyRevoked
+	}
+	if key.Tenant != tenant {
+		return nil, ErrAPIKeyTenant
+	}
+	if now.Sub(entry.windowStart) >= apiKeyWindow {
+		entry.windowStart, entry.count = now, 0
+	}
+	if key.RateLimit > 0 && entry.count >= key.RateLimit {
+		entry.usage.Limited++
+		return key, ErrAPIKeyLimited
+	}
+	entry.count++
+	entry.usage.Accepted++
+	return key, nil
+}
+
+// RetryDelay returns the time remaining in the rate limiting window for the
+// key.
+func (k *APIKeys) RetryDelay(keyID string) time.Duration {
+	k.keysMux.Lock()
+	defer k.keysMux.Unlock()
+	entry, ok := k.keys[keyID]
+	if !ok {
+		return 0
+	}
+	delay := apiKeyWindow - timeNow().Sub(entry.windowStart)
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// entry returns the cached entry for the key, fetching the key from the
+// store if the entry is missing or stale. Rate limiting state is kept when
+// the entry is refreshed. Unknown keys are also cached, so that requests
+// with invalid tokens don't each query the store.
+func (k *APIKeys) entry(keyID string, now time.Time) (*apiKeyEntry, error) {
+	k.keysMux.Lock()
+	entry, ok := k.keys[keyID]
+	missingAt, isMissing := k.missing[keyID]
+	k.keysMux.Unlock()
+	if ok && now.Sub(entry.fetchedAt) < k.cacheTTL {
+		return entry, nil
+	}
+	if isMissing && now.Sub(missingAt) < k.cacheTTL {
+		return nil, ErrInvalidAPIKey
+	}
+	key, err := k.Fetch(keyID)
+	if err != nil {
+		if err == ErrNoAPIKey {
+			k.keysMux.Lock()
+			if len(k.missing) >= maxMissingAPIKeys {
+				k.missing = make(map[string]time.Time)
+			}
+			k.missing[keyID] = now
+			k.keysMux.Unlock()
+			return nil, ErrInvalidAPIKey
+		}
+		return nil, err
+	}
+	k.keysMux.Lock()
+	defer k.keysMux.Unlock()
+	delete(k.missing, keyID)
+	if entry, ok = k.keys[keyID]; !ok {
+		entry = new(apiKeyEntry)
+		k.keys[keyID] = entry
+	}
+	entry.key, entry.fetchedAt = key, now
+	return entry, nil
+}
+
+// Usage returns the key's usage on this node.
+func (k *APIKeys) Usage(keyID string) (usage APIKeyUsage) {
+	k.keysMux.Lock()
+	if entry, ok := k.keys[keyID]; ok {
+		usage = entry.usage
+	}
+	k.keysMux.Unlock()
+	return usage
+}
+
+// Create issues a key to tenant, and returns the key and its token. If
+// rateLimit is 0, the default rate limit applies.
+func (k *APIKeys) Create(tenant string, rateLimit int) (
+	key *APIKey, token string, err error) {
+
+	if rateLimit < 0 {
+		return nil, "", ErrInvalidRateLimit
+	}
+	if rateLimit == 0 {
+		rateLimit = k.defaultLimit
+	}
+	if k.store == nil {
+		return nil, "", ErrNoAPIKeyStore
+	}
+	keyID, err := idGenerate()
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := newAPIKeySecret()
+	if err != nil {
+		return nil, "", err
+	}
+	key = &APIKey{
+		ID:        strings.Replace(keyID, "-", "", -1),
+		Tenant:    tenant,
+		Hash:      hashAPIKeySecret(secret),
+		RateLimit: rateLimit,
+		CreatedAt: timeNow().Unix(),
+	}
+	if err = k.store.PutAPIKey(key); err != nil {
+		return nil, "", err
+	}
+	return key, key.ID + "." + secret, nil
+}
+
+// Rotate replaces the key's secret, and returns the key and its new token.
+// The old secret remains valid for the rotation grace period.
+func (k *APIKeys) Rotate(keyID string) (key *APIKey, token string, err error) {
+	if _, ok := k.configured[keyID]; ok {
+		return nil, "", ErrAPIKeyConfigured
+	}
+	if key, err = k.Fetch(keyID); err != nil {
+		return nil, "", err
+	}
+	if key.Revoked() {
+		return nil, "", ErrAPIKeyRevoked
+	}
+	secret, err := newAPIKeySecret()
+	if err != nil {
+		return nil, "", err
+	}
+	now := timeNow()
+	key.PrevHash, key.PrevExpires = key.Hash, now.Add(k.rotateGrace).Unix()
+	key.Hash = hashAPIKeySecret(secret)
+	key.RotatedAt = now.Unix()
+	if err = k.store.PutAPIKey(key); err != nil {
+		return nil, "", err
+	}
+	k.publishInvalidate(keyID)
+	return key, key.ID + "." + secret, nil
+}
+
+// Revoke revokes the key. Revoked keys are kept, so that they can be listed.
+func (k *APIKeys) Revoke(keyID string) (key *APIKey, err error) {
+	if _, ok := k.configured[keyID]; ok {
+		return nil, ErrAPIKeyConfigured
+	}
+	if key, err = k.Fetch(keyID); err != nil {
+		return nil, err
+	}
+	if !key.Revoked() {
+		key.RevokedAt = timeNow().Unix()
+		if err = k.store.PutAPIKey(key); err != nil {
+			return nil, err
+		}
+	}
+	k.publishInvalidate(keyID)
+	return key, nil
+}
+
+// Fetch returns the key with the given ID.
+func (k *APIKeys) Fetch(keyID string) (*APIKey, error) {
+	if key, ok := k.configured[keyID]; ok {
+		configured := *key
+		return &configured, nil
+	}
+	if k.store == nil {
+		return nil, ErrNoAPIKey
+	}
+	return k.store.FetchAPIKey(keyID)
+}
+
+// List returns the keys issued to tenant, or all keys if tenant is empty.
+func (k *APIKeys) List(tenant string) ([]*APIKey, error) {
+	keys := make([]*APIKey, 0, len(k.configured))
+	for _, key := range k.configured {
+		configured := *key
+		keys = append(keys, &configured)
+	}
+	if k.store != nil {
+		stored, err := k.store.FetchAPIKeys()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, stored...)
+	}
+	listed := make([]*APIKey, 0, len(keys))
+	for _, key := range keys {
+		if len(tenant) == 0 || key.Tenant == tenant {
+			listed = append(listed, key)
+		}
+	}
+	return listed, nil
+}
+
+// invalidate marks the cached key as stale, keeping its rate limiting state.
+func (k *APIKeys) invalidate(keyID string) {
+	if k == nil {
+		return
+	}
+	k.keysMux.Lock()
+	if entry, ok := k.keys[keyID]; ok {
+		entry.fetchedAt = time.Time{}
+	}
+	delete(k.missing, keyID)
+	k.keysMux.Unlock()
+}
+
+// publishInvalidate invalidates the cached key on all nodes. If the control
+// plane is disabled or the event can't be published, other nodes use their
+// cached copies until they expire.
+func (k *APIKeys) publishInvalidate(keyID string) {
+	k.invalidate(keyID)
+	control := k.app.ControlPlane()
+	if control == nil {
+		return
+	}
+	_, err := control.Publish(ControlAPIKey, map[string]string{"id": keyID})
+	if err != nil && k.logger.ShouldLog(WARNING) {
+		k.logger.Warn("apikeys", "Could not publish API key change",
+			LogFields{"key": keyID, "error": err.Error()})
+	}
+}
+
+// APIKeyHandler is an optional interface implemented by update handlers
+// that authenticate app servers with API keys.
+type APIKeyHandler interface {
+	APIKeys() *APIKeys
+}
+
+func newAPIKeySecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := cryptoRandRead(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
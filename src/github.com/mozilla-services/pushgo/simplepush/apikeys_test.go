@@ -0,0 +1,316 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testAPIKeyStore wraps a Store with in-memory API keys. Keys are copied,
+// as they would be by a remote store.
+type testAPIKeyStore struct {
+	Store
+	keys    map[string]APIKey
+	fetches int
+}
+
+func newTestAPIKeyStore(store Store) *testAPIKeyStore {
+	return &testAPIKeyStore{Store: store, keys: make(map[string]APIKey)}
+}
+
+func (s *testAPIKeyStore) PutAPIKey(key *APIKey) error {
+	s.keys[key.ID] = *key
+	return nil
+}
+
+func (s *testAPIKeyStore) FetchAPIKeys() ([]*APIKey, error) {
+	keys := make([]*APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		key := key
+		keys = append(keys, &key)
+	}
+	return keys, nil
+}
+
+func (s *testAPIKeyStore) FetchAPIKey(id string) (*APIKey, error) {
+	s.fetches++
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, ErrNoAPIKey
+	}
+	return &key, nil
+}
+
+func TestAPIKeys(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+
+	defer saveTimeFuncs()()
+	now := time.Unix(1257894000, 0).UTC()
+	timeNow = func() time.Time { return now }
+
+	Convey("API keys", t, func() {
+		store := newTestAPIKeyStore(mckStore)
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(store)
+
+		keys, err := NewAPIKeys(app, APIKeyConfig{
+			CacheTTL:         "1m",
+			RotateGrace:      "1h",
+			DefaultRateLimit: 2,
+		})
+		So(err, ShouldBeNil)
+
+		key, token, err := keys.Create("acme", 0)
+		So(err, ShouldBeNil)
+		So(key.RateLimit, ShouldEqual, 2)
+		So(token, ShouldStartWith, key.ID+".")
+		So(store.keys[key.ID].Hash, ShouldNotBeEmpty)
+		So(strings.Contains(token, store.keys[key.ID].Hash), ShouldBeFalse)
+
+		Convey("Should require a store that supports API keys", func() {
+			app.SetStore(mckStore)
+			_, err := NewAPIKeys(app, APIKeyConfig{CacheTTL: "1m", RotateGrace: "1h"})
+			So(err, ShouldEqual, ErrNoAPIKeyStore)
+		})
+
+		Convey("Should authenticate keys for their tenant", func() {
+			_, err := keys.Authenticate(token, "acme")
+			So(err, ShouldBeNil)
+			_, err = keys.Authenticate(token, "other")
+			So(err, ShouldEqual, ErrAPIKeyTenant)
+			_, err = keys.Authenticate(key.ID+".wrong", "acme")
+			So(err, ShouldEqual, ErrInvalidAPIKey)
+			_, err = keys.Authenticate("unknown.secret", "acme")
+			So(err, ShouldEqual, ErrInvalidAPIKey)
+			_, err = keys.Authenticate("secret", "acme")
+			So(err, ShouldEqual, ErrInvalidAPIKey)
+		})
+
+		Convey("Should cache unknown keys", func() {
+			fetches := store.fetches
+			_, err := keys.Authenticate("unknown.secret", "acme")
+			So(err, ShouldEqual, ErrInvalidAPIKey)
+			_, err = keys.Authenticate("unknown.secret", "acme")
+			So(err, ShouldEqual, ErrInvalidAPIKey)
+			So(store.fetches, ShouldEqual, fetches+1)
+
+			now = now.Add(2 * time.Minute)
+			_, err = keys.Authenticate("unknown.secret", "acme")
+			So(err, ShouldEqual, ErrInvalidAPIKey)
+			So(store.fetches, ShouldEqual, fetches+2)
+		})
+
+		Convey("Should authenticate configured keys", func() {
+			app.SetStore(mckStore)
+			configured, err := NewAPIKeys(app, APIKeyConfig{
+				CacheTTL:    "1m",
+				RotateGrace: "1h",
+				Keys: []ConfiguredAPIKey{{
+					ID:        "static",
+					Tenant:    "acme",
+					Hash:      hashAPIKeySecret("s3cr3t"),
+					RateLimit: 5,
+				}},
+			})
+			So(err, ShouldBeNil)
+			key, err := configured.Authenticate("static.s3cr3t", "acme")
+			So(err, ShouldBeNil)
+			So(key.RateLimit, ShouldEqual, 5)
+			_, err = configured.Authenticate("static.wrong", "acme")
+			So(err, ShouldEqual, ErrInvalidAPIKey)
+
+			listed, err := configured.List("acme")
+			So(err, ShouldBeNil)
+			So(listed, ShouldHaveLength, 1)
+			_, _, err = configured.Rotate("static")
+			So(err, ShouldEqual, ErrAPIKeyConfigured)
+			_, err = configured.Revoke("static")
+			So(err, ShouldEqual, ErrAPIKeyConfigured)
+			_, _, err = configured.Create("acme", 0)
+			So(err, ShouldEqual, ErrNoAPIKeyStore)
+		})
+
+		Convey("Should publish revocations to other nodes", func() {
+			mckStat.EXPECT().Increment(gomock.Any()).AnyTimes()
+			eh := NewEndpointHandler()
+			eh.setApp(app)
+			eh.apiKeys = keys
+			app.SetEndpointHandler(eh)
+			locator := &memoryLocator{}
+			app.SetLocator(locator)
+			c := NewControlPlane()
+			conf := c.ConfigStruct().(*ControlConfig)
+			conf.Enabled = true
+			conf.Interval = "1h"
+			So(c.Init(app, conf), ShouldBeNil)
+			defer c.Close()
+
+			_, err := keys.Authenticate(token, "acme")
+			So(err, ShouldBeNil)
+			// Another node revokes the key.
+			revoked := store.keys[key.ID]
+			revoked.RevokedAt = now.Unix()
+			store.keys[key.ID] = revoked
+			_, err = keys.Authenticate(token, "acme")
+			So(err, ShouldBeNil) // Cached.
+
+			locator.events = append(locator.events, ControlEvent{
+				ID: "1", Type: ControlAPIKey, Time: now.Unix(),
+				Args: map[string]string{"id": key.ID}})
+			So(c.Poll(), ShouldBeNil)
+			_, err = keys.Authenticate(token, "acme")
+			So(err, ShouldEqual, ErrAPIKeyRevoked)
+
+			// Local revocations are published.
+			_, err = keys.Revoke(key.ID)
+			So(err, ShouldBeNil)
+			So(locator.events, ShouldHaveLength, 2)
+			So(locator.events[1].Type, ShouldEqual, ControlAPIKey)
+			So(locator.events[1].Args["id"], ShouldEqual, key.ID)
+		})
+
+		Convey("Should limit update rates per key", func() {
+			_, err := keys.Authenticate(token, "acme")
+			So(err, ShouldBeNil)
+			now = now.Add(10 * time.Second)
+			_, err = keys.Authenticate(token, "acme")
+			So(err, ShouldBeNil)
+			_, err = keys.Authenticate(token, "acme")
+			So(err, ShouldEqual, ErrAPIKeyLimited)
+			So(keys.RetryDelay(key.ID), ShouldEqual, 50*time.Second)
+			So(keys.Usage(key.ID), ShouldResemble, APIKeyUsage{Accepted: 2, Limited: 1})
+
+			now = now.Add(50 * time.Second)
+			_, err = keys.Authenticate(token, "acme")
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Should accept the old secret after rotation", func() {
+			_, newToken, err := keys.Rotate(key.ID)
+			So(err, ShouldBeNil)
+			So(newToken, ShouldNotEqual, token)
+
+			_, err = keys.Authenticate(newToken, "acme")
+			So(err, ShouldBeNil)
+			_, err = keys.Authenticate(token, "acme")
+			So(err, ShouldBeNil)
+
+			now = now.Add(2 * time.Hour)
+			_, err = keys.Authenticate(token, "acme")
+			So(err, ShouldEqual, ErrInvalidAPIKey)
+			_, err = keys.Authenticate(newToken, "acme")
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Should reject revoked keys", func() {
+			_, err := keys.Authenticate(token, "acme")
+			So(err, ShouldBeNil)
+			revoked, err := keys.Revoke(key.ID)
+			So(err, ShouldBeNil)
+			So(revoked.Revoked(), ShouldBeTrue)
+			_, err = keys.Authenticate(token, "acme")
+			So(err, ShouldEqual, ErrAPIKeyRevoked)
+			_, _, err = keys.Rotate(key.ID)
+			So(err, ShouldEqual, ErrAPIKeyRevoked)
+		})
+
+		Convey("Should check update requests", func() {
+			req := &http.Request{Header: http.Header{}}
+			k, err := keys.Check(req, "acme")
+			So(k, ShouldBeNil)
+			So(err, ShouldBeNil)
+
+			mckStat.EXPECT().Increment("updates.apikey.rejected")
+			keys.required = true
+			_, err = keys.Check(req, "acme")
+			So(err, ShouldEqual, ErrMissingAPIKey)
+
+			mckStat.EXPECT().Increment("updates.apikey.accepted")
+			req.Header.Set("Authorization", "Bearer "+token)
+			k, err = keys.Check(req, "acme")
+			So(err, ShouldBeNil)
+			So(k.ID, ShouldEqual, key.ID)
+
+			var nilKeys *APIKeys
+			_, err = nilKeys.Check(req, "acme")
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Should manage keys through the admin API", func() {
+			mckStat.EXPECT().Increment(gomock.Any()).AnyTimes()
+
+			eh := NewEndpointHandler()
+			eh.setApp(app)
+			eh.apiKeys = keys
+			app.SetEndpointHandler(eh)
+
+			ah := NewAdminHandlers()
+			ah.Init(app, ah.ConfigStruct())
+			ah.authToken = []byte("s3cr3t")
+
+			newRequest := func(method, path, body string) *http.Request {
+				req := &http.Request{
+					Method: method,
+					Header: http.Header{},
+					URL:    &url.URL{Path: path},
+					Body:   ioutil.NopCloser(strings.NewReader(body)),
+				}
+				req.Header.Set("Authorization", "Bearer s3cr3t")
+				return req
+			}
+
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("POST", "/keys/",
+				`{"tenant":"acme","rateLimit":10}`))
+			So(resp.Code, ShouldEqual, 200)
+			created := new(apiKeyReply)
+			So(json.Unmarshal(resp.Body.Bytes(), created), ShouldBeNil)
+			So(created.Token, ShouldNotBeEmpty)
+			So(created.Hash, ShouldBeEmpty)
+			So(created.RateLimit, ShouldEqual, 10)
+
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/keys/", ""))
+			So(resp.Code, ShouldEqual, 200)
+			So(resp.Body.String(), ShouldNotContainSubstring, `"hash"`)
+
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("POST", "/keys/"+created.ID+"/rotate", ""))
+			So(resp.Code, ShouldEqual, 200)
+
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("DELETE", "/keys/"+created.ID, ""))
+			So(resp.Code, ShouldEqual, 200)
+
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("POST", "/keys/"+created.ID+"/rotate", ""))
+			So(resp.Code, ShouldEqual, 409)
+
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/keys/unknown", ""))
+			So(resp.Code, ShouldEqual, 404)
+		})
+	})
+}
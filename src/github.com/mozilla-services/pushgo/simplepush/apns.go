@@ -0,0 +1,661 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/pushgo/retry"
+)
+
+const (
+	// apnsMaxPayload is the largest notification payload accepted by APNs.
+	apnsMaxPayload = 2048
+
+	// apnsTokenSize is the size of a binary APNs device token.
+	apnsTokenSize = 32
+
+	// apnsPriority is the priority of background notifications. APNs requires
+	// the power-considerate priority for content-available notifications.
+	apnsPriority = 5
+
+	// apnsSentSize is the number of sent notifications remembered on each
+	// connection, to match error responses to devices, and to resend the
+	// notifications written after a failed one.
+	apnsSentSize = 100
+
+	// apnsFeedbackTTL is how long tokens reported by the feedback service are
+	// kept, if no updates are sent to the device.
+	apnsFeedbackTTL = 30 * 24 * time.Hour
+)
+
+// APNs error response status codes.
+const (
+	apnsStatusInvalidToken = 8
+	apnsStatusShutdown     = 10
+)
+
+type APNsPingConfig struct {
+	// CertFile and KeyFile are the PEM-encoded APNs provider certificate and
+	// private key.
+	CertFile string `toml:"cert_file" env:"cert_file"`
+	KeyFile  string `toml:"key_file" env:"key_file"`
+
+	// Gateway is the address of the APNs gateway. Use
+	// "gateway.sandbox.push.apple.com:2195" for development certificates.
+	Gateway string
+
+	// Feedback is the address of the APNs feedback service, polled every
+	// FeedbackInterval for devices that uninstalled the app. Use
+	// "feedback.sandbox.push.apple.com:2196" for development certificates.
+	// Polling is disabled if FeedbackInterval is "0".
+	Feedback         string
+	FeedbackInterval string `toml:"feedback_interval" env:"feedback_interval"`
+
+	// Conns is the number of gateway connections kept open.
+	Conns int
+
+	// DialTimeout is the timeout for connecting to and writing to APNs.
+	DialTimeout string `toml:"dial_timeout" env:"dial_timeout"`
+
+	// TTL is how long APNs stores a notification for an offline device.
+	TTL string
+
+	// MaxPayload is the size, in bytes, of the largest update payload sent
+	// in an APNs notification. Larger payloads are stored, and the device is
+	// sent a data-less wakeup instead.
+	MaxPayload int `toml:"max_payload" env:"max_payload"`
+
+	Retry retry.Config
+}
+
+// APNsPingData is the connect data sent by iOS clients.
+type APNsPingData struct {
+	Type       string `json:"type,omitempty"`
+	Token      string `json:"token"`                // Hex-encoded device token.
+	Registered int64  `json:"registered,omitempty"` // Seconds since Epoch.
+}
+
+// APNsPayload is the notification payload sent to iOS clients.
+type APNsPayload struct {
+	APS     APNsAPS `json:"aps"`
+	Version int64   `json:"version"`
+	Data    string  `json:"data,omitempty"`
+}
+
+type APNsAPS struct {
+	ContentAvailable int `json:"content-available"`
+}
+
+// APNsPing wakes iOS devices with background notifications, sent over the
+// APNs binary provider protocol. APNs only reports failed notifications,
+// asynchronously, after which it closes the connection and discards the
+// notifications sent after the failed one. Those are resent on another
+// connection, as long as they're still remembered.
+type APNsPing struct {
+	logger         *SimpleLogger
+	metrics        Statistician
+	store          Store
+	tlsConfig      *tls.Config
+	gateway        string
+	feedback       string
+	dialTimeout    time.Duration
+	ttl            time.Duration
+	maxPayload     int
+	rh             *retry.Helper
+	dial           func(addr string) (net.Conn, error)
+	conns          chan *apnsConn // Pooled gateway connections; nil if unused.
+	lastID         uint32         // Accessed atomically.
+	unavailableMux sync.Mutex
+	unavailable    map[string]time.Time // Uninstall times, by device token.
+	closeOnce      Once
+	closeSignal    chan bool
+	closeWait      sync.WaitGroup
+}
+
+func NewAPNsPing() *APNsPing {
+	return &APNsPing{
+		unavailable: make(map[string]time.Time),
+		closeSignal: make(chan bool),
+	}
+}
+
+func (r *APNsPing) ConfigStruct() interface{} {
+	return &APNsPingConfig{
+		Gateway:          "gateway.push.apple.com:2195",
+		Feedback:         "feedback.push.apple.com:2196",
+		FeedbackInterval: "1h",
+		Conns:            5,
+		DialTimeout:      "5s",
+		TTL:              "72h",
+		MaxPayload:       1024,
+		Retry: retry.Config{
+			Retries:   3,
+			Delay:     "200ms",
+			MaxDelay:  "5s",
+			MaxJitter: "400ms",
+		},
+	}
+}
+
+func (r *APNsPing) Name() string {
+	return "apns"
+}
+
+func (r *APNsPing) Init(app *Application, config interface{}) (err error) {
+	r.logger = app.Logger()
+	r.metrics = app.Metrics()
+	r.store = app.Store()
+	conf := config.(*APNsPingConfig)
+
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		r.logger.Panic("propping", "Could not load APNs certificate",
+			LogFields{"error": err.Error(), "cert_file": conf.CertFile})
+		return err
+	}
+	r.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	r.gateway = conf.Gateway
+	r.feedback = conf.Feedback
+	r.maxPayload = conf.MaxPayload
+
+	if r.dialTimeout, err = time.ParseDuration(conf.DialTimeout); err != nil {
+		r.logger.Panic("propping", "Could not parse APNs dial timeout",
+			LogFields{"error": err.Error(), "dial_timeout": conf.DialTimeout})
+		return err
+	}
+	if r.ttl, err = time.ParseDuration(conf.TTL); err != nil {
+		r.logger.Panic("propping", "Could not parse TTL",
+			LogFields{"error": err.Error(), "ttl": conf.TTL})
+		return err
+	}
+	feedbackInterval, err := time.ParseDuration(conf.FeedbackInterval)
+	if err != nil {
+		r.logger.Panic("propping", "Could not parse APNs feedback interval",
+			LogFields{"error": err.Error(),
+				"feedback_interval": conf.FeedbackInterval})
+		return err
+	}
+	if r.rh, err = conf.Retry.NewHelper(); err != nil {
+		r.logger.Panic("propping", "Error configuring retry helper",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	r.rh.CloseNotifier = r
+	r.rh.CanRetry = IsPingerTemporary
+
+	r.dial = r.dialTLS
+	r.setConns(conf.Conns)
+	if feedbackInterval > 0 {
+		r.closeWait.Add(1)
+		go r.pollFeedback(feedbackInterval)
+	}
+	return nil
+}
+
+// setConns sizes the gateway connection pool. Connections are opened as
+// needed.
+func (r *APNsPing) setConns(size int) {
+	if size < 1 {
+		size = 1
+	}
+	r.conns = make(chan *apnsConn, size)
+	for i := 0; i < size; i++ {
+		r.conns <- nil
+	}
+}
+
+// dialTLS connects to an APNs service with the provider certificate.
+func (r *APNsPing) dialTLS(addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conf := *r.tlsConfig
+	conf.ServerName = host
+	return tls.DialWithDialer(&net.Dialer{Timeout: r.dialTimeout}, "tcp",
+		addr, &conf)
+}
+
+// MaxPayload implements PayloadLimiter.MaxPayload().
+func (r *APNsPing) MaxPayload() int {
+	return r.maxPayload
+}
+
+func (r *APNsPing) CanBypassWebsocket() bool {
+	// Background notifications are delivered while the app is suspended.
+	return true
+}
+
+func (r *APNsPing) Register(uaid string, pingData []byte) (err error) {
+	ping := new(APNsPingData)
+	if err = json.Unmarshal(pingData, ping); err != nil {
+		return err
+	}
+	token, err := decodeAPNsToken(ping.Token)
+	if err != nil {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("propping", "Invalid APNs device token",
+				LogFields{"uaid": uaid, "token": ping.Token})
+		}
+		return err
+	}
+	// Normalize the token to match the feedback service, and record the
+	// registration time, so that feedback reported before the device
+	// re-registered is ignored.
+	ping.Token = hex.EncodeToString(token)
+	ping.Registered = timeNow().Unix()
+	if pingData, err = json.Marshal(ping); err != nil {
+		return err
+	}
+	if err = r.store.PutPing(uaid, pingData); err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Could not store APNs registration data",
+				LogFields{"error": err.Error()})
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *APNsPing) Send(uaid string, vers int64, data string) (ok bool, err error) {
+	pingData, err := r.store.FetchPing(uaid)
+	if err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Could not fetch APNs registration data",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return false, err
+	}
+	if len(pingData) == 0 {
+		if r.logger.ShouldLog(INFO) {
+			r.logger.Info("propping", "No APNs registration data for device",
+				LogFields{"uaid": uaid})
+		}
+		return false, nil
+	}
+	ping := new(APNsPingData)
+	if err = json.Unmarshal(pingData, ping); err != nil {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("propping", "Could not parse APNs registration data",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return false, err
+	}
+	token, err := decodeAPNsToken(ping.Token)
+	if err != nil {
+		return false, err
+	}
+	if r.uninstalled(ping) {
+		if r.logger.ShouldLog(INFO) {
+			r.logger.Info("propping", "APNs reported app uninstalled; dropping device",
+				LogFields{"uaid": uaid})
+		}
+		r.metrics.Increment("ping.apns.unregistered")
+		r.store.DropPing(uaid)
+		return false, nil
+	}
+	payload, err := json.Marshal(&APNsPayload{
+		APS:     APNsAPS{ContentAvailable: 1},
+		Version: vers,
+		Data:    data,
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(payload) > apnsMaxPayload {
+		// Send a data-less wakeup; the device fetches the update when it
+		// connects.
+		payload, _ = json.Marshal(&APNsPayload{
+			APS:     APNsAPS{ContentAvailable: 1},
+			Version: vers,
+		})
+	}
+	id := atomic.AddUint32(&r.lastID, 1)
+	expiry := uint32(timeNow().Add(r.ttl).Unix())
+	frame := encodeAPNsFrame(token, payload, id, expiry, apnsPriority)
+	sendOnce := func() error {
+		return r.write(uaid, id, frame)
+	}
+	retries, err := r.rh.RetryFunc(sendOnce)
+	r.metrics.IncrementBy("ping.apns.retry", int64(retries))
+	if err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Failed to send APNs notification",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		r.metrics.Increment("ping.apns.error")
+		return false, err
+	}
+	r.metrics.Increment("ping.apns.success")
+	return true, nil
+}
+
+// write sends a notification frame on a pooled gateway connection, dialing
+// a new connection if the pooled one was closed.
+func (r *APNsPing) write(uaid string, id uint32, frame []byte) (err error) {
+	var conn *apnsConn
+	select {
+	case <-r.closeSignal:
+		return PingerClosedErr
+	case conn = <-r.conns:
+	}
+	defer func() { r.conns <- conn }()
+	if conn != nil && !conn.sent(id, uaid, frame) {
+		// The gateway closed the connection.
+		conn = nil
+	}
+	if conn == nil {
+		c, err := r.dial(r.gateway)
+		if err != nil {
+			return &PingerError{"Could not connect to APNs: " + err.Error(), true}
+		}
+		conn = newAPNsConn(r, c)
+		conn.sent(id, uaid, frame)
+	}
+	conn.SetWriteDeadline(timeNow().Add(r.dialTimeout))
+	if _, err = conn.Write(frame); err != nil {
+		conn.Close()
+		conn = nil
+		return &PingerError{"Could not write to APNs: " + err.Error(), true}
+	}
+	return nil
+}
+
+// failed handles an error response from the gateway.
+func (r *APNsPing) failed(status byte, uaid string) {
+	if r.logger.ShouldLog(WARNING) {
+		r.logger.Warn("propping", "APNs rejected notification",
+			LogFields{"status": strconv.Itoa(int(status)), "uaid": uaid})
+	}
+	switch status {
+	case apnsStatusShutdown:
+		// The gateway closed the connection for maintenance. The failed
+		// notification was delivered.
+		return
+	case apnsStatusInvalidToken:
+		r.metrics.Increment("ping.apns.invalid_token")
+		if len(uaid) > 0 {
+			r.store.DropPing(uaid)
+		}
+		return
+	}
+	r.metrics.Increment("ping.apns.rejected")
+}
+
+// resend writes notifications that the gateway discarded after an earlier
+// one failed.
+func (r *APNsPing) resend(frames []apnsFrame) {
+	for _, f := range frames {
+		retries, err := r.rh.RetryFunc(func() error {
+			return r.write(f.uaid, f.id, f.frame)
+		})
+		r.metrics.IncrementBy("ping.apns.retry", int64(retries))
+		if err != nil {
+			if r.logger.ShouldLog(ERROR) {
+				r.logger.Error("propping", "Failed to resend APNs notification",
+					LogFields{"error": err.Error(), "uaid": f.uaid})
+			}
+			r.metrics.Increment("ping.apns.error")
+			continue
+		}
+		r.metrics.Increment("ping.apns.resent")
+	}
+}
+
+// uninstalled indicates whether the feedback service reported that the app
+// was uninstalled after the device registered.
+func (r *APNsPing) uninstalled(ping *APNsPingData) bool {
+	r.unavailableMux.Lock()
+	defer r.unavailableMux.Unlock()
+	removedAt, ok := r.unavailable[ping.Token]
+	if !ok {
+		return false
+	}
+	delete(r.unavailable, ping.Token)
+	return removedAt.Unix() >= ping.Registered
+}
+
+// pollFeedback periodically fetches uninstalled device tokens from the
+// feedback service.
+func (r *APNsPing) pollFeedback(interval time.Duration) {
+	defer r.closeWait.Done()
+	ticker := time.NewTicker(interval)
+	for ok := true; ok; {
+		select {
+		case ok = <-r.closeSignal:
+		case <-ticker.C:
+			r.fetchFeedback()
+		}
+	}
+	ticker.Stop()
+}
+
+// fetchFeedback reads the tokens reported by the feedback service since the
+// last poll.
+func (r *APNsPing) fetchFeedback() error {
+	conn, err := r.dial(r.feedback)
+	if err != nil {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("propping", "Could not connect to APNs feedback service",
+				LogFields{"error": err.Error()})
+		}
+		r.metrics.Increment("ping.apns.feedback.error")
+		return err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(timeNow().Add(r.dialTimeout))
+	removals, err := readAPNsFeedback(conn)
+	now := timeNow()
+	r.unavailableMux.Lock()
+	for token, removedAt := range r.unavailable {
+		if now.Sub(removedAt) > apnsFeedbackTTL {
+			delete(r.unavailable, token)
+		}
+	}
+	for token, removedAt := range removals {
+		r.unavailable[token] = removedAt
+	}
+	r.unavailableMux.Unlock()
+	r.metrics.IncrementBy("ping.apns.feedback", int64(len(removals)))
+	if err != nil {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("propping", "Error reading APNs feedback",
+				LogFields{"error": err.Error()})
+		}
+		r.metrics.Increment("ping.apns.feedback.error")
+	}
+	return err
+}
+
+func (r *APNsPing) Status() (bool, error) {
+	return true, nil
+}
+
+func (r *APNsPing) CloseNotify() <-chan bool {
+	return r.closeSignal
+}
+
+func (r *APNsPing) Close() error {
+	return r.closeOnce.Do(r.close)
+}
+
+func (r *APNsPing) close() error {
+	close(r.closeSignal)
+	r.closeWait.Wait()
+	if r.conns == nil {
+		return nil
+	}
+	for i := 0; i < cap(r.conns); i++ {
+		if conn := <-r.conns; conn != nil {
+			conn.Close()
+		}
+	}
+	return nil
+}
+
+// apnsFrame is a notification frame written to a gateway connection.
+type apnsFrame struct {
+	id    uint32
+	uaid  string
+	frame []byte
+}
+
+// apnsConn is a gateway connection. APNs responds only if a notification
+// fails, then closes the connection.
+type apnsConn struct {
+	net.Conn
+	pinger     *APNsPing
+	sentMux    sync.Mutex
+	sentFrames [apnsSentSize]apnsFrame // Ring of recent frames.
+	sentNext   int
+	sentCount  int
+	closed     bool // Set once the gateway responds or closes the connection.
+}
+
+func newAPNsConn(pinger *APNsPing, conn net.Conn) *apnsConn {
+	c := &apnsConn{
+		Conn:   conn,
+		pinger: pinger,
+	}
+	go c.readErrors()
+	return c
+}
+
+// sent records a notification frame before it's written. Returns false if
+// the gateway closed the connection, and the frame should be written to
+// another connection.
+func (c *apnsConn) sent(id uint32, uaid string, frame []byte) bool {
+	c.sentMux.Lock()
+	defer c.sentMux.Unlock()
+	if c.closed {
+		return false
+	}
+	c.sentFrames[c.sentNext] = apnsFrame{id, uaid, frame}
+	c.sentNext = (c.sentNext + 1) % apnsSentSize
+	if c.sentCount < apnsSentSize {
+		c.sentCount++
+	}
+	return true
+}
+
+// failedAt stops recording frames, and returns the device for a failed
+// notification ID, and the frames written after it. If the notification was
+// not recorded, the device is empty, and all recorded frames are returned;
+// the gateway may have discarded any of them.
+func (c *apnsConn) failedAt(id uint32) (uaid string, unsent []apnsFrame) {
+	c.sentMux.Lock()
+	defer c.sentMux.Unlock()
+	c.closed = true
+	oldest := (c.sentNext - c.sentCount + apnsSentSize) % apnsSentSize
+	for i := 0; i < c.sentCount; i++ {
+		f := c.sentFrames[(oldest+i)%apnsSentSize]
+		if f.id == id {
+			uaid, unsent = f.uaid, nil
+			continue
+		}
+		unsent = append(unsent, f)
+	}
+	return uaid, unsent
+}
+
+// stop closes the connection, and stops recording frames.
+func (c *apnsConn) stop() {
+	c.sentMux.Lock()
+	c.closed = true
+	c.sentMux.Unlock()
+	c.Close()
+}
+
+// readErrors waits for an error response from the gateway.
+func (c *apnsConn) readErrors() {
+	defer c.stop()
+	var reply [6]byte
+	if _, err := io.ReadFull(c.Conn, reply[:]); err != nil {
+		return
+	}
+	if reply[0] != 8 {
+		return
+	}
+	id := binary.BigEndian.Uint32(reply[2:])
+	uaid, unsent := c.failedAt(id)
+	c.pinger.failed(reply[1], uaid)
+	if len(unsent) > 0 {
+		go c.pinger.resend(unsent)
+	}
+}
+
+// decodeAPNsToken decodes a hex-encoded device token.
+func decodeAPNsToken(token string) ([]byte, error) {
+	b, err := hex.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != apnsTokenSize {
+		return nil, fmt.Errorf("APNs device token must be %d bytes",
+			apnsTokenSize)
+	}
+	return b, nil
+}
+
+// encodeAPNsFrame encodes a notification with the binary provider protocol:
+// command 2, the frame length, and the token, payload, identifier,
+// expiration, and priority items.
+func encodeAPNsFrame(token, payload []byte, id, expiry uint32,
+	priority byte) []byte {
+
+	var items bytes.Buffer
+	writeItem := func(itemID byte, data []byte) {
+		items.WriteByte(itemID)
+		binary.Write(&items, binary.BigEndian, uint16(len(data)))
+		items.Write(data)
+	}
+	var idBytes, expiryBytes [4]byte
+	binary.BigEndian.PutUint32(idBytes[:], id)
+	binary.BigEndian.PutUint32(expiryBytes[:], expiry)
+	writeItem(1, token)
+	writeItem(2, payload)
+	writeItem(3, idBytes[:])
+	writeItem(4, expiryBytes[:])
+	writeItem(5, []byte{priority})
+
+	frame := make([]byte, 5, 5+items.Len())
+	frame[0] = 2
+	binary.BigEndian.PutUint32(frame[1:], uint32(items.Len()))
+	return append(frame, items.Bytes()...)
+}
+
+// readAPNsFeedback reads feedback tuples until EOF: the uninstall time, in
+// seconds since Epoch, the token length, and the token. Returns the
+// uninstall times by hex-encoded token.
+func readAPNsFeedback(r io.Reader) (map[string]time.Time, error) {
+	removals := make(map[string]time.Time)
+	for {
+		var header [6]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return removals, nil
+			}
+			return removals, err
+		}
+		token := make([]byte, binary.BigEndian.Uint16(header[4:]))
+		if _, err := io.ReadFull(r, token); err != nil {
+			return removals, err
+		}
+		removedAt := int64(binary.BigEndian.Uint32(header[:4]))
+		removals[hex.EncodeToString(token)] = time.Unix(removedAt, 0)
+	}
+}
@@ -0,0 +1,218 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/pushgo/retry"
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// readAPNsItems decodes a notification frame into its items, by item ID.
+func readAPNsItems(r io.Reader) (map[byte][]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	items := make(map[byte][]byte)
+	for len(body) >= 3 {
+		size := binary.BigEndian.Uint16(body[1:3])
+		items[body[0]] = body[3 : 3+size]
+		body = body[3+size:]
+	}
+	return items, nil
+}
+
+func TestAPNsPing(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+
+	uaid := "5e1e5984569c4f00bf4bea47754a6403"
+	token := strings.Repeat("ab", apnsTokenSize)
+
+	Convey("APNs pings", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(mckStore)
+
+		now := time.Unix(1400000000, 0)
+		defer saveTimeFuncs()()
+		timeNow = func() time.Time { return now }
+
+		pinger := NewAPNsPing()
+		pinger.logger = app.Logger()
+		pinger.metrics = mckStat
+		pinger.store = mckStore
+		pinger.dialTimeout = 1 * time.Second
+		pinger.ttl = 1 * time.Hour
+		pinger.rh = &retry.Helper{CanRetry: IsPingerTemporary}
+		pinger.setConns(1)
+		gateway := make(chan net.Conn, 1)
+		pinger.dial = func(string) (net.Conn, error) {
+			client, server := net.Pipe()
+			gateway <- server
+			return client, nil
+		}
+		defer pinger.Close()
+
+		Convey("Should store normalized tokens with the registration time", func() {
+			mckStore.EXPECT().PutPing(uaid, []byte(`{"type":"apns","token":"`+
+				token+`","registered":1400000000}`))
+			So(pinger.Register(uaid, []byte(`{"type":"apns","token":"`+
+				strings.ToUpper(token)+`"}`)), ShouldBeNil)
+
+			So(pinger.Register(uaid, []byte(`{"token":"abcd"}`)), ShouldNotBeNil)
+		})
+
+		Convey("Should send background notifications", func() {
+			mckStore.EXPECT().FetchPing(uaid).Return(
+				[]byte(`{"token":"`+token+`","registered":1}`), nil)
+			mckStat.EXPECT().IncrementBy("ping.apns.retry", int64(0))
+			mckStat.EXPECT().Increment("ping.apns.success")
+
+			items := make(chan map[byte][]byte, 1)
+			go func() {
+				conn := <-gateway
+				frame, _ := readAPNsItems(conn)
+				items <- frame
+			}()
+			ok, err := pinger.Send(uaid, 10, "hello")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+
+			frame := <-items
+			So(frame[1], ShouldHaveLength, apnsTokenSize)
+			payload := new(APNsPayload)
+			So(json.Unmarshal(frame[2], payload), ShouldBeNil)
+			So(payload.APS.ContentAvailable, ShouldEqual, 1)
+			So(payload.Version, ShouldEqual, 10)
+			So(payload.Data, ShouldEqual, "hello")
+			So(binary.BigEndian.Uint32(frame[4]), ShouldEqual,
+				uint32(now.Add(1*time.Hour).Unix()))
+			So(frame[5], ShouldResemble, []byte{apnsPriority})
+		})
+
+		Convey("Should drop devices with invalid tokens", func() {
+			mckStore.EXPECT().FetchPing(uaid).Return(
+				[]byte(`{"token":"`+token+`"}`), nil)
+			mckStat.EXPECT().IncrementBy("ping.apns.retry", int64(0))
+			mckStat.EXPECT().Increment("ping.apns.success")
+			mckStat.EXPECT().Increment("ping.apns.invalid_token")
+			dropped := make(chan bool)
+			mckStore.EXPECT().DropPing(uaid).Do(func(string) { close(dropped) })
+
+			go func() {
+				conn := <-gateway
+				frame, _ := readAPNsItems(conn)
+				reply := []byte{8, apnsStatusInvalidToken, 0, 0, 0, 0}
+				copy(reply[2:], frame[3])
+				conn.Write(reply)
+				conn.Close()
+			}()
+			ok, _ := pinger.Send(uaid, 10, "")
+			So(ok, ShouldBeTrue)
+			select {
+			case <-dropped:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timed out waiting for invalid token error")
+			}
+		})
+
+		Convey("Should resend notifications discarded after a failed one", func() {
+			otherUAID := "d1c7c768b1be4c7093a69b52910d4baa"
+			mckStore.EXPECT().FetchPing(uaid).Return(
+				[]byte(`{"token":"`+token+`"}`), nil)
+			mckStore.EXPECT().FetchPing(otherUAID).Return(
+				[]byte(`{"token":"`+strings.Repeat("cd", apnsTokenSize)+`"}`), nil)
+			mckStat.EXPECT().IncrementBy("ping.apns.retry", int64(0)).Times(3)
+			mckStat.EXPECT().Increment("ping.apns.success").Times(2)
+			mckStat.EXPECT().Increment("ping.apns.invalid_token")
+			mckStore.EXPECT().DropPing(uaid)
+			resent := make(chan bool)
+			mckStat.EXPECT().Increment("ping.apns.resent").Do(
+				func(string) { close(resent) })
+
+			ids := make(chan []byte, 2)
+			go func() {
+				conn := <-gateway
+				failed, _ := readAPNsItems(conn)
+				discarded, _ := readAPNsItems(conn)
+				reply := []byte{8, apnsStatusInvalidToken, 0, 0, 0, 0}
+				copy(reply[2:], failed[3])
+				conn.Write(reply)
+				conn.Close()
+				ids <- discarded[3]
+
+				conn = <-gateway
+				again, _ := readAPNsItems(conn)
+				ids <- again[3]
+			}()
+			ok, _ := pinger.Send(uaid, 10, "")
+			So(ok, ShouldBeTrue)
+			ok, _ = pinger.Send(otherUAID, 11, "")
+			So(ok, ShouldBeTrue)
+			select {
+			case <-resent:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timed out waiting for discarded notification")
+			}
+			So(<-ids, ShouldResemble, <-ids)
+		})
+
+		Convey("Should drop devices that uninstalled the app", func() {
+			var feedback bytes.Buffer
+			for _, removedAt := range []uint32{1000, 3000} {
+				binary.Write(&feedback, binary.BigEndian, removedAt)
+				binary.Write(&feedback, binary.BigEndian, uint16(apnsTokenSize))
+				feedback.Write(bytes.Repeat([]byte{byte(removedAt)}, apnsTokenSize))
+			}
+			removals, err := readAPNsFeedback(&feedback)
+			So(err, ShouldBeNil)
+			So(removals, ShouldHaveLength, 2)
+			pinger.unavailable = removals
+
+			// Re-registered after the app was uninstalled.
+			mckStore.EXPECT().FetchPing(uaid).Return([]byte(`{"token":"`+
+				strings.Repeat("e8", apnsTokenSize)+`","registered":2000}`), nil)
+			mckStat.EXPECT().IncrementBy("ping.apns.retry", int64(0))
+			mckStat.EXPECT().Increment("ping.apns.success")
+			go func() {
+				readAPNsItems(<-gateway)
+			}()
+			ok, _ := pinger.Send(uaid, 10, "")
+			So(ok, ShouldBeTrue)
+
+			mckStore.EXPECT().FetchPing(uaid).Return([]byte(`{"token":"`+
+				strings.Repeat("b8", apnsTokenSize)+`","registered":2000}`), nil)
+			mckStat.EXPECT().Increment("ping.apns.unregistered")
+			mckStore.EXPECT().DropPing(uaid)
+			ok, err = pinger.Send(uaid, 10, "")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+			So(pinger.unavailable, ShouldBeEmpty)
+		})
+	})
+}
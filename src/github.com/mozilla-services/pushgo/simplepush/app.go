@@ -9,11 +9,11 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"runtime"
 	"sync"
-	"sync/atomic"
 	"text/template"
 	"time"
 )
@@ -34,13 +34,37 @@ type ApplicationConfig struct {
 	ResolveHost        bool   `toml:"resolve_host" env:"resolve_host"`
 	ClientMinPing      string `toml:"client_min_ping_interval" env:"client_min_ping_interval"`
 	ClientHelloTimeout string `toml:"client_hello_timeout" env:"client_hello_timeout"`
+	ClientHelloFrames  int    `toml:"client_hello_max_frames" env:"client_hello_max_frames"`
+	ClientHelloBytes   int    `toml:"client_hello_max_bytes" env:"client_hello_max_bytes"`
+	ClientMaxChannels  int    `toml:"client_hello_max_channels" env:"client_hello_max_channels"`
 	PushLongPongs      bool   `toml:"push_long_pongs" env:"push_long_pongs"`
+	AllowPurge         bool   `toml:"allow_purge" env:"allow_purge"`
+	StorePayloads      bool   `toml:"store_payloads" env:"store_payloads"`
 	ClientPongInterval string `toml:"client_pong_interval" env:"client_pong_interval"`
+	DupeHello          string `toml:"duplicate_hello" env:"duplicate_hello"`
+	ClientPingInterval string `toml:"client_ping_interval" env:"client_ping_interval"`
+	ClientMaxSilence   string `toml:"client_max_silence" env:"client_max_silence"`
+	ClientReadTimeout  string `toml:"client_read_timeout" env:"client_read_timeout"`
+	ClientWriteTimeout string `toml:"client_write_timeout" env:"client_write_timeout"`
+	HandshakeTimeout   string `toml:"client_handshake_timeout" env:"client_handshake_timeout"`
+	MaxRegisters       int    `toml:"client_max_registers" env:"client_max_registers"`
+	RegisterWindow     string `toml:"client_register_window" env:"client_register_window"`
+	Brownout           BrownoutConfig
+	Wake               WakeConfig
+	Shards             ShardConfig
+	Memory             MemoryConfig
+	Goroutines         GoroutineConfig
+	Resume             ResumeConfig
+	LogDedupe          LogDedupeConfig `toml:"log_dedupe" env:"log_dedupe"`
+	Drain              DrainConfig
+	ConnGauges         ConnGaugesConfig `toml:"conn_gauges" env:"conn_gauges"`
+	Residency          ResidencyConfig
 }
 
 func NewApplication() (a *Application) {
 	a = &Application{
-		workers:   make(map[string]Worker),
+		workers:   NewWorkerRegistry(),
+		brownout:  NewBrownout(),
 		closeChan: make(chan bool),
 	}
 	return a
@@ -51,25 +75,59 @@ type Application struct {
 	hostname           string
 	host               string
 	port               int
+	clientMux          sync.RWMutex // Protects the reloadable client settings.
 	clientMinPing      time.Duration
 	clientHelloTimeout time.Duration
+	clientHelloFrames  int
+	clientHelloBytes   int
+	clientMaxChannels  int
 	clientPongInterval time.Duration
+	clientPingInterval time.Duration
+	clientMaxSilence   time.Duration
+	clientReadTimeout  time.Duration
+	clientWriteTimeout time.Duration
+	handshakeTimeout   time.Duration
+	maxRegisters       int
+	registerWindow     time.Duration
 	pushLongPongs      bool
+	allowPurge         bool
+	storePayloads      bool
+	dupeHello          DupeHelloMode
 	tokenKey           []byte
 	endpointTemplate   *template.Template
 	log                *SimpleLogger
 	metrics            Statistician
-	workers            map[string]Worker
-	workerMux          sync.RWMutex
-	workerCount        int32
+	workers            *WorkerRegistry
+	settings           *ClientSettings
+	settingsMux        sync.RWMutex
+	brownout           *Brownout
+	logDedupe          *LogDeduper
+	drainer            *drainer
+	wake               *WakeTracker
+	shards             *EndpointShards
+	memory             *MemoryAccounts
+	goroutines         *GoroutineTracker
+	connGauges         *ConnGauges
+	residency          *Residency
+	sessions           *SessionCache
+	bridge             *Bridge
+	localWrites        *LocalWrites
+	tenants            *Tenants
+	control            *ControlPlane
+	reloader           *ConfigReloader
+	virtual            map[string]*VirtualServer // By host name.
 	store              Store
+	deadLetters        Store // Separate dead letter storage; may be nil.
 	router             Router
 	locator            Locator
 	balancer           Balancer
 	sh                 Handler // WebSocket handler.
 	eh                 Handler // HTTP update handler.
 	ph                 Handler // Performance profiling handlers.
+	ah                 Handler // Admin API handlers.
 	propping           PropPinger
+	customErasers      []namedEraser
+	customExporters    []namedExporter
 	closeChan          chan bool
 	closeOnce          Once
 }
@@ -83,6 +141,50 @@ func (a *Application) ConfigStruct() interface{} {
 		ResolveHost:        false,
 		ClientMinPing:      "20s",
 		ClientHelloTimeout: "30s",
+		HandshakeTimeout:   "10s",
+		DupeHello:          "flush",
+		MaxRegisters:       0,
+		RegisterWindow:     "1m",
+		Brownout: BrownoutConfig{
+			Recovery: 0.8,
+		},
+		Wake: WakeConfig{
+			Enabled: false,
+			Window:  "60s",
+		},
+		Shards: ShardConfig{
+			Enabled: false,
+		},
+		Memory: MemoryConfig{
+			Enabled: false,
+		},
+		Goroutines: GoroutineConfig{
+			Debug: false,
+		},
+		Resume: ResumeConfig{
+			Enabled: false,
+			TTL:     "30s",
+			Size:    10000,
+		},
+		Residency: ResidencyConfig{
+			Enabled:   false,
+			CacheSize: 100000,
+			CacheTTL:  "5m",
+		},
+		LogDedupe: LogDedupeConfig{
+			Enabled:  false,
+			Interval: "1m",
+			MaxKeys:  1000,
+		},
+		Drain: DrainConfig{
+			Timeout:  "30s",
+			MaxRetry: "30s",
+			Interval: "100ms",
+		},
+		ConnGauges: ConnGaugesConfig{
+			Enabled:  false,
+			Interval: "10s",
+		},
 	}
 }
 
@@ -115,28 +217,150 @@ func (a *Application) Init(_ *Application, config interface{}) (err error) {
 		return fmt.Errorf("Error parsing push endpoint template: %s", err)
 	}
 
-	if a.clientMinPing, err = time.ParseDuration(conf.ClientMinPing); err != nil {
+	if err = a.setClientTimings(conf); err != nil {
+		return err
+	}
+	if len(conf.ClientMaxSilence) > 0 {
+		if a.clientMaxSilence, err = time.ParseDuration(conf.ClientMaxSilence); err != nil {
+			return fmt.Errorf("Unable to parse 'client_max_silence': %s",
+				err.Error())
+		}
+	}
+	if len(conf.ClientReadTimeout) > 0 {
+		if a.clientReadTimeout, err = time.ParseDuration(conf.ClientReadTimeout); err != nil {
+			return fmt.Errorf("Unable to parse 'client_read_timeout': %s",
+				err.Error())
+		}
+	}
+	if len(conf.ClientWriteTimeout) > 0 {
+		if a.clientWriteTimeout, err = time.ParseDuration(conf.ClientWriteTimeout); err != nil {
+			return fmt.Errorf("Unable to parse 'client_write_timeout': %s",
+				err.Error())
+		}
+	}
+	a.clientHelloFrames = conf.ClientHelloFrames
+	a.clientHelloBytes = conf.ClientHelloBytes
+	a.clientMaxChannels = conf.ClientMaxChannels
+	if len(conf.HandshakeTimeout) > 0 {
+		if a.handshakeTimeout, err = time.ParseDuration(conf.HandshakeTimeout); err != nil {
+			return fmt.Errorf("Unable to parse 'client_handshake_timeout': %s",
+				err.Error())
+		}
+	}
+	if conf.MaxRegisters > 0 {
+		if a.registerWindow, err = time.ParseDuration(conf.RegisterWindow); err != nil {
+			return fmt.Errorf("Unable to parse 'client_register_window': %s",
+				err.Error())
+		}
+		a.maxRegisters = conf.MaxRegisters
+	}
+	a.pushLongPongs = conf.PushLongPongs
+	a.allowPurge = conf.AllowPurge
+	a.storePayloads = conf.StorePayloads
+	if a.dupeHello, err = ParseDupeHelloMode(conf.DupeHello); err != nil {
+		return fmt.Errorf("Unable to parse 'duplicate_hello': %s", err.Error())
+	}
+	a.brownout.configure(conf.Brownout)
+	if conf.Wake.Enabled {
+		if a.wake, err = NewWakeTracker(conf.Wake); err != nil {
+			return fmt.Errorf("Unable to parse 'wake.window': %s", err.Error())
+		}
+	}
+	if conf.Shards.Enabled {
+		if a.shards, err = NewEndpointShards(conf.Shards); err != nil {
+			return fmt.Errorf("Unable to parse 'shards.pools': %s", err.Error())
+		}
+	}
+	if conf.Memory.Enabled {
+		a.memory = NewMemoryAccounts()
+		a.memory.Register("workers", a.workers)
+	}
+	a.goroutines = NewGoroutineTracker(a, conf.Goroutines)
+	if conf.Resume.Enabled {
+		if a.sessions, err = NewSessionCache(conf.Resume); err != nil {
+			return fmt.Errorf("Unable to parse 'resume.ttl': %s", err.Error())
+		}
+	}
+	if conf.LogDedupe.Enabled {
+		if a.logDedupe, err = NewLogDeduper(conf.LogDedupe); err != nil {
+			return fmt.Errorf("Unable to parse 'log_dedupe.interval': %s",
+				err.Error())
+		}
+	}
+	if a.drainer, err = newDrainer(conf.Drain); err != nil {
+		return fmt.Errorf("Unable to parse 'drain' settings: %s", err.Error())
+	}
+	if conf.ConnGauges.Enabled {
+		if a.connGauges, err = NewConnGauges(a, conf.ConnGauges); err != nil {
+			return fmt.Errorf("Unable to parse 'conn_gauges.interval': %s",
+				err.Error())
+		}
+	}
+	if conf.Residency.Enabled {
+		if a.residency, err = NewResidency(a, conf.Residency); err != nil {
+			return fmt.Errorf("Unable to parse 'residency' settings: %s",
+				err.Error())
+		}
+	}
+	return
+}
+
+// setClientTimings sets the client ping intervals and handshake timeout from
+// conf. The settings are only changed if all are valid.
+func (a *Application) setClientTimings(conf *ApplicationConfig) (err error) {
+	var minPing, pongInterval, pingInterval, helloTimeout time.Duration
+	if minPing, err = time.ParseDuration(conf.ClientMinPing); err != nil {
 		return fmt.Errorf("Unable to parse 'client_min_ping_interval': %s",
 			err.Error())
 	}
 	if len(conf.ClientPongInterval) > 0 {
-		if a.clientPongInterval, err = time.ParseDuration(conf.ClientPongInterval); err != nil {
+		if pongInterval, err = time.ParseDuration(conf.ClientPongInterval); err != nil {
 			return fmt.Errorf("Unable to parse 'client_pong_interval': %s",
 				err.Error())
 		}
 	}
-	if a.clientHelloTimeout, err = time.ParseDuration(conf.ClientHelloTimeout); err != nil {
+	if len(conf.ClientPingInterval) > 0 {
+		if pingInterval, err = time.ParseDuration(conf.ClientPingInterval); err != nil {
+			return fmt.Errorf("Unable to parse 'client_ping_interval': %s",
+				err.Error())
+		}
+	}
+	if helloTimeout, err = time.ParseDuration(conf.ClientHelloTimeout); err != nil {
 		return fmt.Errorf("Unable to parse 'client_hello_timeout': %s",
 			err.Error())
 	}
-	a.pushLongPongs = conf.PushLongPongs
-	return
+	a.clientMux.Lock()
+	a.clientMinPing = minPing
+	a.clientPongInterval = pongInterval
+	a.clientPingInterval = pingInterval
+	a.clientHelloTimeout = helloTimeout
+	a.clientMux.Unlock()
+	return nil
+}
+
+// ReloadableSettings implements Reloadable.ReloadableSettings().
+func (a *Application) ReloadableSettings() []string {
+	return []string{"client_min_ping_interval", "client_pong_interval",
+		"client_ping_interval", "client_hello_timeout"}
+}
+
+// Reload applies changed client ping intervals and handshake timeouts to new
+// connections. Implements Reloadable.Reload().
+func (a *Application) Reload(config interface{}) error {
+	return a.setClientTimings(config.(*ApplicationConfig))
 }
 
 // Set a logger
 func (a *Application) SetLogger(logger Logger) (err error) {
-	a.log, err = NewLogger(logger)
-	return
+	if a.log, err = NewLogger(logger); err != nil {
+		return err
+	}
+	a.log.brownout = a.brownout
+	if a.logDedupe != nil {
+		a.log.dedupe = a.logDedupe
+		a.logDedupe.Start(logger)
+	}
+	return nil
 }
 
 func (a *Application) SetPropPinger(ping PropPinger) (err error) {
@@ -146,14 +370,34 @@ func (a *Application) SetPropPinger(ping PropPinger) (err error) {
 
 func (a *Application) SetMetrics(metrics Statistician) error {
 	a.metrics = metrics
+	if a.wake != nil {
+		a.wake.metrics = metrics
+	}
 	return nil
 }
 
 func (a *Application) SetStore(store Store) error {
+	if a.residency != nil {
+		residencyStore, ok := store.(ResidencyStore)
+		if !ok {
+			return ErrNoResidencyStore
+		}
+		a.residency.store = residencyStore
+	}
 	a.store = store
 	return nil
 }
 
+// SetDeadLetterStore sets a separate store for dead letters. The store must
+// implement DeadLetterStore.
+func (a *Application) SetDeadLetterStore(store Store) error {
+	if _, ok := store.(DeadLetterStore); !ok {
+		return ErrNoDeadLetterStore
+	}
+	a.deadLetters = store
+	return nil
+}
+
 func (a *Application) SetRouter(router Router) error {
 	a.router = router
 	return nil
@@ -184,16 +428,25 @@ func (a *Application) SetProfileHandlers(h Handler) error {
 	return nil
 }
 
+func (a *Application) SetAdminHandlers(h Handler) error {
+	a.ah = h
+	return nil
+}
+
 // Start the application
 func (a *Application) Run() (errChan chan error) {
-	errChan = make(chan error, 4)
+	errChan = make(chan error, 5)
 
 	go a.sh.Start(errChan)
 	go a.eh.Start(errChan)
 	go a.router.Start(errChan)
 	go a.ph.Start(errChan)
+	go a.ah.Start(errChan)
 
 	go a.sendClientCount()
+	if a.connGauges != nil {
+		go a.connGauges.Run(a.closeChan)
+	}
 	return errChan
 }
 
@@ -218,10 +471,108 @@ func (a *Application) Store() Store {
 	return a.store
 }
 
+// DeadLetters returns the dead letter queue. This is the separate dead
+// letter store, if configured, or the main store if it supports dead letters.
+// Returns nil if neither store supports dead letters.
+func (a *Application) DeadLetters() DeadLetterStore {
+	store := a.deadLetters
+	if store == nil {
+		store = a.store
+	}
+	deadLetters, _ := store.(DeadLetterStore)
+	return deadLetters
+}
+
 func (a *Application) Metrics() Statistician {
 	return a.metrics
 }
 
+// Wake returns the proprietary ping wakeup tracker, or nil if wakeup
+// tracking is disabled.
+func (a *Application) Wake() *WakeTracker {
+	return a.wake
+}
+
+// Residency returns the data residency policy, or nil if data residency is
+// disabled.
+func (a *Application) Residency() *Residency {
+	return a.residency
+}
+
+// SetTenants sets the dynamic per-tenant settings.
+func (a *Application) SetTenants(t *Tenants) {
+	a.tenants = t
+}
+
+// Tenants returns the dynamic per-tenant settings, or nil if disabled.
+func (a *Application) Tenants() *Tenants {
+	return a.tenants
+}
+
+// SetControlPlane sets the control event channel.
+func (a *Application) SetControlPlane(c *ControlPlane) {
+	a.control = c
+}
+
+// ControlPlane returns the control event channel, or nil if disabled.
+func (a *Application) ControlPlane() *ControlPlane {
+	return a.control
+}
+
+// SetConfigReloader sets the configuration reloader.
+func (a *Application) SetConfigReloader(r *ConfigReloader) {
+	a.reloader = r
+}
+
+// ConfigReloader returns the configuration reloader, or nil if the
+// application was not loaded from a configuration file.
+func (a *Application) ConfigReloader() *ConfigReloader {
+	return a.reloader
+}
+
+// SetBridge sets the upstream bridge used to register client channels.
+func (a *Application) SetBridge(b *Bridge) {
+	a.bridge = b
+}
+
+// Bridge returns the upstream bridge, or nil if bridge mode is disabled.
+func (a *Application) Bridge() *Bridge {
+	return a.bridge
+}
+
+// SetLocalWrites sets the queue storing updates delivered to local clients.
+func (a *Application) SetLocalWrites(q *LocalWrites) {
+	a.localWrites = q
+}
+
+// LocalWrites returns the queue storing updates delivered to local clients,
+// or nil if local-first delivery is disabled.
+func (a *Application) LocalWrites() *LocalWrites {
+	return a.localWrites
+}
+
+// Brownout returns the node's brownout mode state.
+func (a *Application) Brownout() *Brownout {
+	return a.brownout
+}
+
+// Memory returns the memory accounts, or nil if memory accounting is
+// disabled.
+func (a *Application) Memory() *MemoryAccounts {
+	return a.memory
+}
+
+// Goroutines returns the connection goroutine tracker.
+func (a *Application) Goroutines() *GoroutineTracker {
+	return a.goroutines
+}
+
+// Sessions returns the resumable sessions, or nil if session resumption is
+// disabled.
+func (a *Application) Sessions() *SessionCache {
+	return a.sessions
+}
+
 func (a *Application) Router() Router {
 	return a.router
 }
@@ -246,6 +597,10 @@ func (a *Application) ProfileHandlers() Handler {
 	return a.ph
 }
 
+func (a *Application) AdminHandlers() Handler {
+	return a.ah
+}
+
 func (a *Application) TokenKey() []byte {
 	return a.tokenKey
 }
@@ -254,13 +609,96 @@ func (a *Application) SetTokenKey(key string) (err error) {
 	if len(key) == 0 {
 		a.tokenKey = nil
 	} else {
-		a.tokenKey, err = base64.URLEncoding.DecodeString(key)
+		if a.tokenKey, err = base64.URLEncoding.DecodeString(key); err != nil {
+			return err
+		}
+		err = cryptoProvider.CheckKey(a.tokenKey)
 	}
 	return
 }
 
+// AddVirtualServer adds a logical push service sharing this server's
+// listeners. Returns an error if another virtual server has the same host.
+func (a *Application) AddVirtualServer(vs *VirtualServer) error {
+	if a.virtual == nil {
+		a.virtual = make(map[string]*VirtualServer)
+	}
+	if other, ok := a.virtual[vs.Host()]; ok {
+		return fmt.Errorf("Virtual servers '%s' and '%s' have the same host: %s",
+			other.Name(), vs.Name(), vs.Host())
+	}
+	a.virtual[vs.Host()] = vs
+	return nil
+}
+
+// AddEraser registers a hook that removes device data held by a component,
+// for right-to-erasure requests. Erasers run in registration order, after
+// the built-in erasers. Must be called before the application starts.
+func (a *Application) AddEraser(name string, eraser DataEraser) {
+	a.customErasers = append(a.customErasers,
+		namedEraser{name: name, eraser: eraser})
+}
+
+// erasers returns the built-in erasers for the configured components,
+// followed by the registered erasers.
+func (a *Application) erasers() (erasers []namedEraser) {
+	if a.store != nil {
+		erasers = append(erasers, namedEraser{"store", storeDataEraser(a.store)})
+	}
+	if deadLetters := a.DeadLetters(); deadLetters != nil {
+		erasers = append(erasers,
+			namedEraser{"dead_letters", deadLetterEraser{deadLetters}})
+	}
+	if a.sessions != nil {
+		erasers = append(erasers, namedEraser{"sessions", a.sessions})
+	}
+	if th, ok := a.sh.(TranscriptHandler); ok {
+		if transcripts := th.Transcripts(); transcripts != nil {
+			erasers = append(erasers, namedEraser{"transcripts", transcripts})
+		}
+	}
+	return append(erasers, a.customErasers...)
+}
+
+// AddExporter registers a hook that returns device data held by a component,
+// for data portability requests. The data is exported under name. Must be
+// called before the application starts.
+func (a *Application) AddExporter(name string, exporter DataExporter) {
+	a.customExporters = append(a.customExporters,
+		namedExporter{name: name, exporter: exporter})
+}
+
+// exporters returns the built-in exporters for the configured components,
+// followed by the registered exporters. Parked sessions are not exported:
+// they only hold connection state and copies of stored updates, and expire
+// within the resume TTL.
+func (a *Application) exporters() (exporters []namedExporter) {
+	if exporter, ok := a.store.(DataExporter); ok {
+		exporters = append(exporters, namedExporter{"store", exporter})
+	}
+	if deadLetters := a.DeadLetters(); deadLetters != nil {
+		exporters = append(exporters,
+			namedExporter{"dead_letters", deadLetterExporter{deadLetters}})
+	}
+	if th, ok := a.sh.(TranscriptHandler); ok {
+		if transcripts := th.Transcripts(); transcripts != nil {
+			exporters = append(exporters, namedExporter{"transcripts", transcripts})
+		}
+	}
+	return append(exporters, a.customExporters...)
+}
+
+// VirtualServer returns the virtual server for a request Host header, or nil
+// if the host doesn't match a virtual server.
+func (a *Application) VirtualServer(host string) *VirtualServer {
+	if len(a.virtual) == 0 {
+		return nil
+	}
+	return a.virtual[virtualHost(host)]
+}
+
 func (a *Application) WorkerCount() (count int) {
-	return int(atomic.LoadInt32(&a.workerCount))
+	return a.workers.Len()
 }
 
 func (a *Application) WorkerExists(uaid string) (collision bool) {
@@ -269,51 +707,64 @@ func (a *Application) WorkerExists(uaid string) (collision bool) {
 }
 
 func (a *Application) GetWorker(uaid string) (worker Worker, ok bool) {
-	a.workerMux.RLock()
-	worker, ok = a.workers[uaid]
-	a.workerMux.RUnlock()
+	return a.workers.Get(uaid)
+}
+
+// ClientSettings returns the settings sent to newly connected clients, or nil
+// if no settings have been pushed.
+func (a *Application) ClientSettings() (settings *ClientSettings) {
+	a.settingsMux.RLock()
+	settings = a.settings
+	a.settingsMux.RUnlock()
 	return
 }
 
+// PushSettings sends settings to all connected clients, and to clients that
+// connect later. Empty settings clear the pushed settings without notifying
+// connected clients. Returns the number of clients notified.
+func (a *Application) PushSettings(settings *ClientSettings) (sent int) {
+	a.settingsMux.Lock()
+	if settings.IsZero() {
+		a.settings = nil
+	} else {
+		a.settings = settings
+	}
+	a.settingsMux.Unlock()
+	if settings.IsZero() {
+		return 0
+	}
+	for _, worker := range a.workers.Workers() {
+		sender, ok := worker.(SettingsSender)
+		if !ok {
+			continue
+		}
+		if err := sender.SendSettings(settings); err == nil {
+			sent++
+		}
+	}
+	return sent
+}
+
 func (a *Application) AddWorker(uaid string, worker Worker) (replaced bool) {
 	if a.closeOnce.IsDone() {
 		worker.Close()
 		return
 	}
-	a.workerMux.Lock()
-	// Avoid incrementing the worker count for duplicate handshakes. Callers
-	// can use this to short-circuit other operations (e.g., re-registering
-	// with the router).
-	_, replaced = a.workers[uaid]
-	a.workers[uaid] = worker
-	a.workerMux.Unlock()
-	if !replaced {
-		atomic.AddInt32(&a.workerCount, 1)
-	}
-	return
+	// The registry avoids incrementing the worker count for duplicate
+	// handshakes. Callers can use this to short-circuit other operations
+	// (e.g., re-registering with the router).
+	return a.workers.Add(uaid, worker)
 }
 
 func (a *Application) RemoveWorker(uaid string, worker Worker) (removed bool) {
 	if a.closeOnce.IsDone() {
 		return
 	}
-	a.workerMux.Lock()
-	if prevWorker, ok := a.workers[uaid]; ok && prevWorker == worker {
-		delete(a.workers, uaid)
-		removed = true
-	}
-	a.workerMux.Unlock()
-	if removed {
-		atomic.AddInt32(&a.workerCount, -1)
-	}
-	return removed
+	return a.workers.Remove(uaid, worker)
 }
 
 func (a *Application) closeWorkers() {
-	a.workerMux.Lock()
-	defer a.workerMux.Unlock()
-	for uaid, worker := range a.workers {
-		delete(a.workers, uaid)
+	for _, worker := range a.workers.Drain() {
 		worker.Close()
 	}
 }
@@ -324,28 +775,79 @@ func (a *Application) CreateEndpoint(key string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return a.genEndpoint(token)
+	return a.genEndpoint(key, token)
 }
 
 // encodePK encodes a primary key if a token key is specified.
 func (a *Application) encodePK(key string) (token string, err error) {
-	tokenKey := a.TokenKey()
+	return encodeToken(a.TokenKey(), key)
+}
+
+// encodeToken encrypts a primary key with tokenKey. Returns the key as-is if
+// tokenKey is empty.
+func encodeToken(tokenKey []byte, key string) (token string, err error) {
 	if len(tokenKey) == 0 {
 		return key, nil
 	}
 	btoken := []byte(key)
-	return Encode(tokenKey, btoken)
+	return cryptoProvider.EncryptToken(tokenKey, btoken)
 }
 
-// genEndpoint generates an update endpoint.
-func (a *Application) genEndpoint(token string) (string, error) {
-	var currentHost string
-	if eh := a.EndpointHandler(); eh != nil {
-		currentHost = eh.URL()
+// genEndpoint generates an update endpoint for the encoded primary key.
+func (a *Application) genEndpoint(key, token string) (string, error) {
+	return a.executeEndpoint(a.endpointTemplate, key, token)
+}
+
+// executeEndpoint generates an update endpoint from an endpoint template.
+// Endpoints assigned to a node pool use the pool's URL as the current host.
+// Pools are matched against the plaintext primary key, since encrypted tokens
+// begin with a random IV.
+func (a *Application) executeEndpoint(endpointTemplate *template.Template,
+	key, token string) (string, error) {
+
+	currentHost, ok := a.shards.URL(key)
+	if !ok {
+		if eh := a.EndpointHandler(); eh != nil {
+			currentHost = eh.URL()
+		}
+	}
+	return execEndpoint(endpointTemplate, token, currentHost)
+}
+
+// GenerateEndpoint returns the update endpoint that a server with the given
+// token key and push_endpoint_template would issue for a channel, without
+// registering the channel. currentHost is substituted for {{.CurrentHost}}.
+// Used by tools that construct endpoints for testing.
+func GenerateEndpoint(tokenKey, pushEndpoint, currentHost, uaid,
+	chid string) (string, error) {
+
+	var key []byte
+	if len(tokenKey) > 0 {
+		var err error
+		if key, err = base64.URLEncoding.DecodeString(tokenKey); err != nil {
+			return "", err
+		}
+		if err = cryptoProvider.CheckKey(key); err != nil {
+			return "", err
+		}
 	}
+	endpointTemplate, err := template.New("Push").Parse(pushEndpoint)
+	if err != nil {
+		return "", err
+	}
+	token, err := encodeToken(key, joinIDs(uaid, chid))
+	if err != nil {
+		return "", err
+	}
+	return execEndpoint(endpointTemplate, token, currentHost)
+}
+
+func execEndpoint(endpointTemplate *template.Template, token,
+	currentHost string) (string, error) {
+
 	// cheezy variable replacement.
 	endpoint := new(bytes.Buffer)
-	if err := a.endpointTemplate.Execute(endpoint, struct {
+	if err := endpointTemplate.Execute(endpoint, struct {
 		Token       string
 		CurrentHost string
 	}{
@@ -363,6 +865,12 @@ func (a *Application) Close() error {
 
 func (a *Application) close() error {
 	var errors MultipleError
+	if ah := a.AdminHandlers(); ah != nil {
+		// Stop the admin listener.
+		if err := ah.Close(); err != nil {
+			errors = append(errors, err)
+		}
+	}
 	if eh := a.EndpointHandler(); eh != nil {
 		// Stop the update listener; close all connections.
 		if err := eh.Close(); err != nil {
@@ -385,12 +893,24 @@ func (a *Application) close() error {
 	a.closeWorkers()
 	// Stop publishing client counts.
 	close(a.closeChan)
+	if c := a.ControlPlane(); c != nil {
+		// Stop polling for control events.
+		if err := c.Close(); err != nil {
+			errors = append(errors, err)
+		}
+	}
 	if l := a.Locator(); l != nil {
 		// Deregister from the discovery service.
 		if err := a.locator.Close(); err != nil {
 			errors = append(errors, err)
 		}
 	}
+	if t := a.Tenants(); t != nil {
+		// Stop refreshing tenant settings.
+		if err := t.Close(); err != nil {
+			errors = append(errors, err)
+		}
+	}
 	if r := a.Router(); r != nil {
 		// Close the routing listener.
 		if err := r.Close(); err != nil {
@@ -409,21 +929,72 @@ func (a *Application) close() error {
 			errors = append(errors, err)
 		}
 	}
+	if s := a.deadLetters; s != nil {
+		if err := s.Close(); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if d := a.logDedupe; d != nil {
+		// Log summaries of suppressed warnings.
+		if err := d.Close(); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if m, ok := a.Metrics().(io.Closer); ok {
+		// Send final metrics, including the drain timer and client count.
+		if err := m.Close(); err != nil {
+			errors = append(errors, err)
+		}
+	}
 	if len(errors) > 0 {
 		return errors
 	}
 	return nil
 }
 
+// logBrownout logs a change to the brownout state. Logged at WARNING, so
+// that the message is not suppressed by brownout itself.
+func (a *Application) logBrownout() {
+	logger := a.Logger()
+	if !logger.ShouldLog(WARNING) {
+		return
+	}
+	status := a.brownout.Status()
+	if status.Active {
+		logger.Warn("app", "Entering brownout mode; shedding non-essential work",
+			LogFields{"reason": status.Reason})
+	} else {
+		logger.Warn("app", "Leaving brownout mode", nil)
+	}
+}
+
 func (a *Application) sendClientCount() {
 	metrics := a.Metrics()
-	ticker := time.NewTicker(1 * time.Second)
+	ticker := clock.NewTicker(1 * time.Second)
 	for ok := true; ok; {
 		select {
 		case ok = <-a.closeChan:
-		case <-ticker.C:
-			metrics.Gauge("goroutines", int64(runtime.NumGoroutine()))
-			metrics.Gauge("update.client.connections", int64(a.WorkerCount()))
+		case <-ticker.C():
+			goroutines, clients := runtime.NumGoroutine(), a.WorkerCount()
+			metrics.Gauge("goroutines", int64(goroutines))
+			metrics.Gauge("update.client.connections", int64(clients))
+			// Goroutines not accounted for by client connections. This should
+			// stay roughly constant; steady growth indicates a leak.
+			metrics.Gauge("goroutines.excess", int64(goroutines-clients))
+			if a.goroutines != nil {
+				running, orphans := a.goroutines.Counts()
+				metrics.Gauge("goroutines.connection", int64(running))
+				metrics.Gauge("goroutines.orphaned", int64(orphans))
+			}
+			if a.brownout.Check(clients, goroutines) {
+				a.logBrownout()
+			}
+			if a.brownout.Active() {
+				metrics.Gauge("brownout", 1)
+			} else {
+				metrics.Gauge("brownout", 0)
+			}
+			a.memory.Publish(metrics)
 		}
 	}
 	ticker.Stop()
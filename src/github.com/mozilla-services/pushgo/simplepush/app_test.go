@@ -62,6 +62,56 @@ func TestCreateEndpoint(t *testing.T) {
 			So(err, ShouldBeNil)
 			So(endpoint, ShouldEqual, "/AAAAAAAAAAAAAAAAAAAAAPfdsA==")
 		})
+
+		Convey("Should assign endpoints to node pools by key prefix", func() {
+			var err error
+			app.shards, err = NewEndpointShards(ShardConfig{
+				Enabled: true,
+				Pools: []string{"1=https://pool-a.example.com/",
+					"12=https://pool-b.example.com"},
+			})
+			So(err, ShouldBeNil)
+			app.SetTokenKey("")
+			app.SetEndpointHandler(mckEndHandler)
+
+			endpoint, err := app.CreateEndpoint("123")
+			So(err, ShouldBeNil)
+			So(endpoint, ShouldEqual, "https://pool-b.example.com/123")
+
+			endpoint, err = app.CreateEndpoint("189")
+			So(err, ShouldBeNil)
+			So(endpoint, ShouldEqual, "https://pool-a.example.com/189")
+
+			mckEndHandler.EXPECT().URL().Return("https://example.com")
+			endpoint, err = app.CreateEndpoint("456")
+			So(err, ShouldBeNil)
+			So(endpoint, ShouldEqual, "https://example.com/456")
+
+			app.SetTokenKey("O03rpLsdafhIhJEjEJt-CgVHyqHI650oy0pZZvplKDc=")
+			endpoint, err = app.CreateEndpoint("123")
+			So(err, ShouldBeNil)
+			So(endpoint, ShouldStartWith, "https://pool-b.example.com/")
+		})
+
+		Convey("Should reject invalid pool entries", func() {
+			_, err := NewEndpointShards(ShardConfig{
+				Pools: []string{"https://pool-a.example.com"}})
+			So(err, ShouldNotBeNil)
+			_, err = NewEndpointShards(ShardConfig{
+				Pools: []string{"1=https://a.example.com", "1=https://b.example.com"}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Should generate endpoints without a server", func() {
+			endpoint, err := GenerateEndpoint("", "{{.CurrentHost}}/update/{{.Token}}",
+				"https://example.com", "123", "456")
+			So(err, ShouldBeNil)
+			So(endpoint, ShouldEqual, "https://example.com/update/123.456")
+
+			_, err = GenerateEndpoint("lLyhlLk8qus1ky4ER8yjN5o=",
+				"{{.CurrentHost}}/update/{{.Token}}", "https://example.com", "123", "456")
+			So(err, ShouldEqual, aes.KeySizeError(17))
+		})
 	})
 }
 
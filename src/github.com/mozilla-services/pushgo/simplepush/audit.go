@@ -0,0 +1,285 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrAuditTampered = errors.New("Audit log chain is broken")
+
+type AuditConfig struct {
+	Enabled bool
+
+	// Path is the file to which audit records are appended, one JSON object
+	// per line. The file should not be shared with other logs.
+	Path string
+
+	// Key is an optional secret used to authenticate the record chain, so
+	// that records can't be rewritten without it. Without a key, the chain
+	// only detects edits that don't recompute the following hashes.
+	Key string
+
+	// Sync flushes each record to stable storage before the request returns.
+	Sync bool
+}
+
+// AuditRecord is an admin API action. Records are chained: each record
+// includes the hash of its predecessor, and its own hash covers every other
+// field, so that edited, reordered, or deleted records break the chain.
+type AuditRecord struct {
+	Seq       int64  `json:"seq"`
+	Time      string `json:"time"`             // RFC 3339.
+	Actor     string `json:"actor"`            // Authenticated user, if any.
+	Action    string `json:"action"`           // Method and path.
+	Target    string `json:"target,omitempty"` // Device ID, ban, or letter.
+	Tenant    string `json:"tenant,omitempty"`
+	Status    int    `json:"status"`
+	Result    string `json:"result"` // "intent", "ok", "denied", or "failed".
+	RequestID string `json:"rid,omitempty"`
+	Prev      string `json:"prev"`
+	Hash      string `json:"hash,omitempty"`
+}
+
+// AuditLog is an append-only, hash-chained log of admin actions. A nil
+// AuditLog records nothing.
+type AuditLog struct {
+	logger    *SimpleLogger
+	metrics   Statistician
+	key       []byte
+	sync      bool
+	writerMux sync.Mutex
+	writer    io.Writer
+	seq       int64
+	prev      string
+}
+
+// NewAuditLog opens the audit log named in conf, resuming the chain from
+// the last record in the file.
+func NewAuditLog(app *Application, conf AuditConfig) (*AuditLog, error) {
+	file, err := os.OpenFile(conf.Path,
+		os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	last, err := lastAuditRecord(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	l := newAuditLog(app, conf, file)
+	if last != nil {
+		l.seq, l.prev = last.Seq, last.Hash
+	}
+	return l, nil
+}
+
+func newAuditLog(app *Application, conf AuditConfig,
+	writer io.Writer) *AuditLog {
+
+	return &AuditLog{
+		logger:  app.Logger(),
+		metrics: app.Metrics(),
+		key:     []byte(conf.Key),
+		sync:    conf.Sync,
+		writer:  writer,
+	}
+}
+
+// Record appends an action to the log, assigning its sequence number, time,
+// and hashes.
+func (l *AuditLog) Record(record *AuditRecord) (err error) {
+	if l == nil {
+		return nil
+	}
+	l.writerMux.Lock()
+	defer l.writerMux.Unlock()
+	record.Seq = l.seq + 1
+	record.Time = timeNow().UTC().Format(time.RFC3339Nano)
+	record.Prev = l.prev
+	if record.Hash, err = hashAuditRecord(l.key, record); err == nil {
+		err = l.write(record)
+	}
+	if err != nil {
+		if l.logger.ShouldLog(ERROR) {
+			l.logger.Error("audit", "Could not write audit record",
+				LogFields{"action": record.Action, "actor": record.Actor,
+					"error": err.Error()})
+		}
+		l.metrics.Increment("admin.audit.error")
+		return err
+	}
+	l.seq, l.prev = record.Seq, record.Hash
+	l.metrics.Increment("admin.audit.recorded")
+	return nil
+}
+
+func (l *AuditLog) write(record *AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = l.writer.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if s, ok := l.writer.(interface {
+		Sync() error
+	}); ok && l.sync {
+		return s.Sync()
+	}
+	return nil
+}
+
+// Close closes the underlying writer, if it implements io.Closer.
+func (l *AuditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	if c, ok := l.writer.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// hashAuditRecord returns the hex-encoded hash of the record, excluding its
+// own hash. The hash is an HMAC if a key is given.
+func hashAuditRecord(key []byte, record *AuditRecord) (string, error) {
+	unhashed := *record
+	unhashed.Hash = ""
+	body, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+	var h hash.Hash
+	if len(key) > 0 {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyAuditLog checks the record chain read from r, which must start with
+// the first record, and returns the number of valid records preceding the
+// first broken link.
+func VerifyAuditLog(r io.Reader, key string) (valid int, err error) {
+	scanner := bufio.NewScanner(r)
+	var seq int64
+	var prev string
+	for scanner.Scan() {
+		record := new(AuditRecord)
+		if err = json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return valid, ErrAuditTampered
+		}
+		if record.Seq != seq+1 || record.Prev != prev {
+			return valid, ErrAuditTampered
+		}
+		sum, hashErr := hashAuditRecord([]byte(key), record)
+		if hashErr != nil || !hmac.Equal([]byte(sum), []byte(record.Hash)) {
+			return valid, ErrAuditTampered
+		}
+		seq, prev = record.Seq, record.Hash
+		valid++
+	}
+	return valid, scanner.Err()
+}
+
+// lastAuditRecord returns the last record read from r, or nil if r is empty.
+func lastAuditRecord(r io.Reader) (last *AuditRecord, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		record := new(AuditRecord)
+		if err = json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return nil, ErrAuditTampered
+		}
+		last = record
+	}
+	return last, scanner.Err()
+}
+
+// maxAuditBody is the number of request body bytes read for the audit
+// target. The rest of a longer body is passed to the handler unread.
+const maxAuditBody = 64 * 1024
+
+// auditBody holds the request body fields that identify the target and
+// tenant of an admin action.
+type auditBody struct {
+	UAID   string `json:"uaid"`
+	Kind   string `json:"kind"`
+	Value  string `json:"value"`
+	Tenant string `json:"tenant"`
+}
+
+// peekAuditBody decodes the target fields from a JSON request body, and
+// restores the body for the handler.
+func peekAuditBody(req *http.Request) (body auditBody) {
+	if req.Body == nil || req.Method == "GET" || req.Method == "DELETE" {
+		return
+	}
+	prefix, err := ioutil.ReadAll(io.LimitReader(req.Body, maxAuditBody))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), req.Body), req.Body}
+	if err == nil {
+		json.Unmarshal(prefix, &body)
+	}
+	return
+}
+
+// auditResponseWriter records the status code and resolved target of an
+// admin response.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	target string
+}
+
+// setAuditTarget records the target of an admin action that isn't known
+// until the action is handled, like the device for an endpoint.
+func setAuditTarget(resp http.ResponseWriter, target string) {
+	if aw, ok := resp.(*auditResponseWriter); ok {
+		aw.target = target
+	}
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// auditResult classifies a response status code.
+func auditResult(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return "denied"
+	case status >= 400:
+		return "failed"
+	}
+	return "ok"
+}
@@ -0,0 +1,180 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAuditLog(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	defer saveTimeFuncs()()
+	timeNow = func() time.Time { return time.Unix(1257894000, 0).UTC() }
+
+	Convey("Admin audit log", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+
+		buf := new(bytes.Buffer)
+		l := newAuditLog(app, AuditConfig{Key: "s3cr3t"}, buf)
+
+		Convey("Should chain records", func() {
+			mckStat.EXPECT().Increment("admin.audit.recorded").Times(3)
+			So(l.Record(&AuditRecord{Actor: "a", Action: "GET /peers"}), ShouldBeNil)
+			So(l.Record(&AuditRecord{Actor: "b", Action: "DELETE /bans/ip:1"}), ShouldBeNil)
+			So(l.Record(&AuditRecord{Actor: "c", Action: "PUT /brownout"}), ShouldBeNil)
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			So(lines, ShouldHaveLength, 3)
+			first, second := new(AuditRecord), new(AuditRecord)
+			So(json.Unmarshal([]byte(lines[0]), first), ShouldBeNil)
+			So(json.Unmarshal([]byte(lines[1]), second), ShouldBeNil)
+			So(first.Seq, ShouldEqual, 1)
+			So(first.Prev, ShouldEqual, "")
+			So(first.Time, ShouldEqual, "2009-11-10T23:00:00Z")
+			So(second.Seq, ShouldEqual, 2)
+			So(second.Prev, ShouldEqual, first.Hash)
+
+			valid, err := VerifyAuditLog(strings.NewReader(buf.String()), "s3cr3t")
+			So(err, ShouldBeNil)
+			So(valid, ShouldEqual, 3)
+
+			Convey("And detect edited records", func() {
+				edited := strings.Replace(buf.String(), `"actor":"b"`, `"actor":"x"`, 1)
+				valid, err := VerifyAuditLog(strings.NewReader(edited), "s3cr3t")
+				So(err, ShouldEqual, ErrAuditTampered)
+				So(valid, ShouldEqual, 1)
+			})
+
+			Convey("And detect deleted records", func() {
+				deleted := lines[0] + "\n" + lines[2] + "\n"
+				valid, err := VerifyAuditLog(strings.NewReader(deleted), "s3cr3t")
+				So(err, ShouldEqual, ErrAuditTampered)
+				So(valid, ShouldEqual, 1)
+
+				valid, err = VerifyAuditLog(strings.NewReader(lines[1]), "s3cr3t")
+				So(err, ShouldEqual, ErrAuditTampered)
+				So(valid, ShouldEqual, 0)
+			})
+
+			Convey("And reject records hashed without the key", func() {
+				_, err := VerifyAuditLog(strings.NewReader(buf.String()), "")
+				So(err, ShouldEqual, ErrAuditTampered)
+			})
+
+			Convey("And resume the chain", func() {
+				last, err := lastAuditRecord(strings.NewReader(buf.String()))
+				So(err, ShouldBeNil)
+				So(last.Seq, ShouldEqual, 3)
+
+				resumed := newAuditLog(app, AuditConfig{Key: "s3cr3t"}, buf)
+				resumed.seq, resumed.prev = last.Seq, last.Hash
+				mckStat.EXPECT().Increment("admin.audit.recorded")
+				So(resumed.Record(&AuditRecord{Action: "GET /memory"}), ShouldBeNil)
+				valid, err := VerifyAuditLog(strings.NewReader(buf.String()), "s3cr3t")
+				So(err, ShouldBeNil)
+				So(valid, ShouldEqual, 4)
+			})
+		})
+
+		Convey("Should record admin requests", func() {
+			mckStat.EXPECT().Increment(gomock.Any()).AnyTimes()
+
+			ah := NewAdminHandlers()
+			ah.Init(app, ah.ConfigStruct())
+			ah.authToken = []byte("s3cr3t")
+			ah.audit = l
+
+			newRequest := func(method, path, token string) *http.Request {
+				req := &http.Request{
+					Method: method,
+					Header: http.Header{},
+					URL:    &url.URL{Path: path, RawQuery: "tenant=acme"},
+				}
+				if len(token) > 0 {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+				return req
+			}
+			ah.ServeHTTP(httptest.NewRecorder(),
+				newRequest("GET", "/transcripts/123", "wrong"))
+			ah.ServeHTTP(httptest.NewRecorder(),
+				newRequest("DELETE", "/transcripts/123", "s3cr3t"))
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			So(lines, ShouldHaveLength, 3)
+			denied, intent, dropped := new(AuditRecord), new(AuditRecord),
+				new(AuditRecord)
+			So(json.Unmarshal([]byte(lines[0]), denied), ShouldBeNil)
+			So(json.Unmarshal([]byte(lines[1]), intent), ShouldBeNil)
+			So(json.Unmarshal([]byte(lines[2]), dropped), ShouldBeNil)
+
+			So(denied.Actor, ShouldEqual, "")
+			So(denied.Action, ShouldEqual, "GET /transcripts/123")
+			So(denied.Status, ShouldEqual, 401)
+			So(denied.Result, ShouldEqual, "denied")
+
+			So(intent.Actor, ShouldEqual, "token")
+			So(intent.Target, ShouldEqual, "123")
+			So(intent.Status, ShouldEqual, 0)
+			So(intent.Result, ShouldEqual, "intent")
+
+			So(dropped.Actor, ShouldEqual, "token")
+			So(dropped.Target, ShouldEqual, "123")
+			So(dropped.Tenant, ShouldEqual, "acme")
+			So(dropped.Result, ShouldEqual, auditResult(dropped.Status))
+
+			Convey("And take the target from the body", func() {
+				buf.Reset()
+				req := newRequest("POST", "/bans/", "s3cr3t")
+				req.URL.RawQuery = ""
+				req.Body = ioutil.NopCloser(strings.NewReader(
+					`{"kind":"ip","value":"127.0.0.1","tenant":"acme"}`))
+				ah.ServeHTTP(httptest.NewRecorder(), req)
+
+				lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+				So(lines, ShouldHaveLength, 2)
+				added := new(AuditRecord)
+				So(json.Unmarshal([]byte(lines[1]), added), ShouldBeNil)
+				So(added.Target, ShouldEqual, "ip:127.0.0.1")
+				So(added.Tenant, ShouldEqual, "acme")
+			})
+
+			Convey("And refuse requests that can't be recorded", func() {
+				ah.audit = newAuditLog(app, AuditConfig{}, failingWriter{})
+				resp := httptest.NewRecorder()
+				ah.ServeHTTP(resp, newRequest("DELETE", "/transcripts/123", "s3cr3t"))
+				So(resp.Code, ShouldEqual, http.StatusServiceUnavailable)
+			})
+		})
+	})
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, io.ErrShortWrite
+}
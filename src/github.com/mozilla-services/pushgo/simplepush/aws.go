@@ -131,7 +131,7 @@ func GetElastiCacheEndpointsTimeout(configEndpoint string, timeout time.Duration
 	select {
 	case endpoints = <-results:
 	case err = <-errors:
-	case <-time.After(timeout):
+	case <-clock.After(timeout):
 		err = ErrElastiCacheTimeout
 	}
 	return
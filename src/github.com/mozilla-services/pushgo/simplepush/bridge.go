@@ -0,0 +1,420 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/pushgo/client"
+	"github.com/mozilla-services/pushgo/id"
+)
+
+type BridgeConfig struct {
+	Enabled bool
+
+	// Origin is the WebSocket URL of the upstream push service.
+	Origin string
+
+	// State is the file that stores the bridge's upstream device ID and
+	// channel mappings across restarts.
+	State string
+
+	// Reconnect is the delay before reconnecting to the upstream service.
+	Reconnect string
+
+	// SaveDelay is how long to wait after a registration change before
+	// saving the state, so that a burst of changes is written once. Pending
+	// changes are saved when the bridge is closed.
+	SaveDelay string `toml:"save_delay" env:"save_delay"`
+}
+
+// Deliverer is implemented by update handlers that can store and deliver
+// updates received from other sources than app servers.
+type Deliverer interface {
+	Deliver(uaid, chid string, version int64, data string) error
+}
+
+// bridgeConn is the subset of client.Conn used by the bridge.
+type bridgeConn interface {
+	Register(chid string) (endpoint string, err error)
+	Unregister(chid string) error
+	ReadBatch() ([]client.Update, error)
+	AcceptBatch(updates []client.Update) error
+	Close() error
+}
+
+// dialBridge connects to an upstream service as deviceID, reregistering
+// chids. Returns the device ID assigned by the upstream service.
+func dialBridge(origin, deviceID string, chids []string) (
+	bridgeConn, string, error) {
+
+	conn, err := client.DialOrigin(origin)
+	if err != nil {
+		return nil, "", err
+	}
+	// Accept updates for channels registered before a restart.
+	conn.SpoolAll = true
+	if deviceID, err = conn.WriteHelo(deviceID, chids...); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	return conn, deviceID, nil
+}
+
+// bridgeChannel maps an upstream channel to a local device and channel.
+type bridgeChannel struct {
+	UAID      string `json:"uaid"`
+	ChannelID string `json:"channelID"`
+}
+
+// bridgeState is the persisted bridge state.
+type bridgeState struct {
+	DeviceID string                   `json:"deviceID"`
+	Channels map[string]bridgeChannel `json:"channels"` // By upstream channel ID.
+}
+
+// Bridge connects to an upstream push service as a client, for hierarchical
+// deployments where edge nodes are fed from a core cluster. Local channels
+// are registered upstream, and clients receive the upstream endpoints;
+// updates received from upstream are stored and delivered locally, then
+// acknowledged.
+type Bridge struct {
+	logger    *SimpleLogger
+	metrics   Statistician
+	deliverer Deliverer
+	origin    string
+	statePath string
+	reconnect time.Duration
+	saveDelay time.Duration
+	dial      func(origin, deviceID string, chids []string) (bridgeConn, string, error)
+	saveMux   sync.Mutex // Serializes state file writes.
+	stateMux  sync.Mutex
+	state     bridgeState
+	upstream  map[string]string // Upstream channel IDs, by local UAID and channel ID.
+	saveTimer Timer             // Pending state save; nil if the state is saved.
+	connMux   sync.RWMutex
+	conn      bridgeConn
+	closeChan chan bool
+	closeOnce Once
+}
+
+// NewBridge creates a bridge that delivers upstream updates with deliverer.
+// The saved state is loaded if it exists.
+func NewBridge(app *Application, conf BridgeConfig, deliverer Deliverer) (
+	b *Bridge, err error) {
+
+	b = &Bridge{
+		logger:    app.Logger(),
+		metrics:   app.Metrics(),
+		deliverer: deliverer,
+		origin:    conf.Origin,
+		statePath: conf.State,
+		dial:      dialBridge,
+		state:     bridgeState{Channels: make(map[string]bridgeChannel)},
+		upstream:  make(map[string]string),
+		closeChan: make(chan bool),
+	}
+	if b.reconnect, err = time.ParseDuration(conf.Reconnect); err != nil {
+		return nil, err
+	}
+	if len(conf.SaveDelay) > 0 {
+		if b.saveDelay, err = time.ParseDuration(conf.SaveDelay); err != nil {
+			return nil, err
+		}
+	}
+	if err = b.load(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func bridgeKey(uaid, chid string) string {
+	return uaid + "." + chid
+}
+
+// load reads the saved state. A missing state file is not an error.
+func (b *Bridge) load() error {
+	data, err := ioutil.ReadFile(b.statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err = json.Unmarshal(data, &b.state); err != nil {
+		return err
+	}
+	if b.state.Channels == nil {
+		b.state.Channels = make(map[string]bridgeChannel)
+	}
+	for upstream, local := range b.state.Channels {
+		b.upstream[bridgeKey(local.UAID, local.ChannelID)] = upstream
+	}
+	return nil
+}
+
+// scheduleSave saves the state after the save delay, unless a save is
+// already pending. The caller must hold the state lock.
+func (b *Bridge) scheduleSave() {
+	if b.saveTimer != nil {
+		return
+	}
+	b.saveTimer = clock.AfterFunc(b.saveDelay, b.flush)
+}
+
+// flush saves the state if a save is pending. Errors are logged; the
+// in-memory state is kept, and the next change retries the save.
+func (b *Bridge) flush() {
+	b.saveMux.Lock()
+	defer b.saveMux.Unlock()
+	b.stateMux.Lock()
+	if b.saveTimer == nil {
+		b.stateMux.Unlock()
+		return
+	}
+	b.saveTimer.Stop()
+	b.saveTimer = nil
+	data, err := json.Marshal(&b.state)
+	b.stateMux.Unlock()
+	if err == nil {
+		err = b.save(data)
+	}
+	if err != nil {
+		if b.logger.ShouldLog(ERROR) {
+			b.logger.Error("bridge", "Error saving bridge state",
+				LogFields{"path": b.statePath, "error": err.Error()})
+		}
+		b.metrics.Increment("bridge.save.error")
+		return
+	}
+	b.metrics.Increment("bridge.save")
+}
+
+// save atomically replaces the state file with data. The data is written and
+// synced to a temporary file in the same directory, then renamed over the
+// state file, so that a crash or failed write doesn't truncate the saved
+// state. The caller must hold the save lock.
+func (b *Bridge) save(data []byte) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(b.statePath),
+		filepath.Base(b.statePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), b.statePath)
+}
+
+// Connected indicates whether the bridge is connected upstream.
+func (b *Bridge) Connected() bool {
+	b.connMux.RLock()
+	defer b.connMux.RUnlock()
+	return b.conn != nil
+}
+
+// Register registers a local channel upstream, and returns the upstream
+// endpoint. Returns ErrBridgeUnavailable if the bridge is not connected.
+func (b *Bridge) Register(uaid, chid string) (endpoint string, err error) {
+	b.connMux.RLock()
+	conn := b.conn
+	b.connMux.RUnlock()
+	if conn == nil {
+		return "", ErrBridgeUnavailable
+	}
+	b.stateMux.Lock()
+	upstream, ok := b.upstream[bridgeKey(uaid, chid)]
+	b.stateMux.Unlock()
+	if !ok {
+		if upstream, err = id.Generate(); err != nil {
+			return "", err
+		}
+	}
+	if endpoint, err = conn.Register(upstream); err != nil {
+		if b.logger.ShouldLog(WARNING) {
+			b.logger.Warn("bridge", "Error registering upstream channel",
+				LogFields{"uaid": uaid, "chid": chid, "error": err.Error()})
+		}
+		b.metrics.Increment("bridge.register.error")
+		return "", ErrBridgeUnavailable
+	}
+	b.stateMux.Lock()
+	b.state.Channels[upstream] = bridgeChannel{uaid, chid}
+	b.upstream[bridgeKey(uaid, chid)] = upstream
+	b.scheduleSave()
+	b.stateMux.Unlock()
+	b.metrics.Increment("bridge.register")
+	return endpoint, nil
+}
+
+// Unregister removes a local channel upstream.
+func (b *Bridge) Unregister(uaid, chid string) {
+	key := bridgeKey(uaid, chid)
+	b.stateMux.Lock()
+	upstream, ok := b.upstream[key]
+	if ok {
+		delete(b.upstream, key)
+		delete(b.state.Channels, upstream)
+		b.scheduleSave()
+	}
+	b.stateMux.Unlock()
+	if !ok {
+		return
+	}
+	b.connMux.RLock()
+	conn := b.conn
+	b.connMux.RUnlock()
+	if conn != nil {
+		conn.Unregister(upstream)
+	}
+}
+
+// Run connects to the upstream service and relays updates until the bridge
+// is closed, reconnecting after errors.
+func (b *Bridge) Run() {
+	for {
+		if err := b.connect(); err != nil {
+			if b.logger.ShouldLog(WARNING) {
+				b.logger.Warn("bridge", "Upstream connection failed",
+					LogFields{"origin": b.origin, "error": err.Error()})
+			}
+			b.metrics.Increment("bridge.disconnect")
+		}
+		select {
+		case <-b.closeChan:
+			return
+		case <-clock.After(b.reconnect):
+		}
+	}
+}
+
+// connect opens an upstream connection, and relays updates until the
+// connection is closed.
+func (b *Bridge) connect() error {
+	b.stateMux.Lock()
+	deviceID := b.state.DeviceID
+	chids := make([]string, 0, len(b.state.Channels))
+	for upstream := range b.state.Channels {
+		chids = append(chids, upstream)
+	}
+	b.stateMux.Unlock()
+
+	conn, actualID, err := b.dial(b.origin, deviceID, chids)
+	if err != nil {
+		return err
+	}
+	if actualID != deviceID {
+		// The upstream service assigned a new device ID, and dropped any
+		// existing registrations.
+		if len(deviceID) > 0 && b.logger.ShouldLog(NOTICE) {
+			b.logger.Notice("bridge", "Upstream assigned a new device ID",
+				LogFields{"previous": deviceID, "deviceID": actualID})
+		}
+		b.stateMux.Lock()
+		b.state = bridgeState{
+			DeviceID: actualID,
+			Channels: make(map[string]bridgeChannel),
+		}
+		b.upstream = make(map[string]string)
+		b.scheduleSave()
+		b.stateMux.Unlock()
+	}
+	b.connMux.Lock()
+	b.conn = conn
+	b.connMux.Unlock()
+	b.metrics.Increment("bridge.connect")
+
+	// Close the connection if the bridge is closed while waiting for updates.
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-b.closeChan:
+			conn.Close()
+		case <-done:
+		}
+	}()
+	defer func() {
+		b.connMux.Lock()
+		b.conn = nil
+		b.connMux.Unlock()
+		conn.Close()
+	}()
+	for {
+		updates, err := conn.ReadBatch()
+		if err != nil {
+			return err
+		}
+		if accepted := b.relay(updates); len(accepted) > 0 {
+			if err = conn.AcceptBatch(accepted); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// relay stores and delivers upstream updates to local devices. Returns the
+// updates that can be acknowledged upstream. Updates that could not be
+// stored are not acknowledged, so that the upstream service redelivers them.
+func (b *Bridge) relay(updates []client.Update) (accepted []client.Update) {
+	accepted = make([]client.Update, 0, len(updates))
+	for _, update := range updates {
+		b.stateMux.Lock()
+		local, ok := b.state.Channels[update.ChannelId]
+		b.stateMux.Unlock()
+		if !ok {
+			// Unknown channel; acknowledge it to avoid redelivery.
+			b.metrics.Increment("bridge.updates.unknown")
+			accepted = append(accepted, update)
+			continue
+		}
+		err := b.deliverer.Deliver(local.UAID, local.ChannelID, update.Version,
+			update.Data)
+		if err != nil {
+			if b.logger.ShouldLog(WARNING) {
+				b.logger.Warn("bridge", "Error relaying upstream update", LogFields{
+					"uaid":    local.UAID,
+					"chid":    local.ChannelID,
+					"version": strconv.FormatInt(update.Version, 10),
+					"error":   err.Error()})
+			}
+			b.metrics.Increment("bridge.updates.error")
+			continue
+		}
+		b.metrics.Increment("bridge.updates.relayed")
+		accepted = append(accepted, update)
+	}
+	return accepted
+}
+
+// Close disconnects the bridge, and saves any pending state changes.
+func (b *Bridge) Close() error {
+	return b.closeOnce.Do(b.close)
+}
+
+func (b *Bridge) close() error {
+	close(b.closeChan)
+	b.flush()
+	return nil
+}
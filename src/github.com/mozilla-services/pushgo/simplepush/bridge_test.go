@@ -0,0 +1,208 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/pushgo/client"
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testBridgeConn implements bridgeConn.
+type testBridgeConn struct {
+	batches  chan []client.Update
+	accepted chan []client.Update
+	closed   chan bool
+	closeOne sync.Once
+	unregs   []string
+}
+
+func newTestBridgeConn() *testBridgeConn {
+	return &testBridgeConn{
+		batches:  make(chan []client.Update),
+		accepted: make(chan []client.Update, 1),
+		closed:   make(chan bool),
+	}
+}
+
+func (c *testBridgeConn) Register(chid string) (string, error) {
+	return "https://upstream.example.com/update/" + chid, nil
+}
+
+func (c *testBridgeConn) Unregister(chid string) error {
+	c.unregs = append(c.unregs, chid)
+	return nil
+}
+
+func (c *testBridgeConn) ReadBatch() ([]client.Update, error) {
+	select {
+	case updates := <-c.batches:
+		return updates, nil
+	case <-c.closed:
+		return nil, io.EOF
+	}
+}
+
+func (c *testBridgeConn) AcceptBatch(updates []client.Update) error {
+	c.accepted <- updates
+	return nil
+}
+
+func (c *testBridgeConn) Close() error {
+	c.closeOne.Do(func() { close(c.closed) })
+	return nil
+}
+
+// testDeliverer implements Deliverer.
+type testDeliverer struct {
+	fail      string // Fail deliveries to this channel.
+	delivered []string
+}
+
+func (d *testDeliverer) Deliver(uaid, chid string, version int64,
+	data string) error {
+
+	if chid == d.fail {
+		return errors.New("store unavailable")
+	}
+	d.delivered = append(d.delivered, uaid+"."+chid+":"+data)
+	return nil
+}
+
+func TestBridge(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStat.EXPECT().Increment(gomock.Any()).AnyTimes()
+
+	dir, err := ioutil.TempDir("", "pushgo-bridge")
+	if err != nil {
+		t.Fatalf("Error creating state directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer saveTimeFuncs()()
+
+	Convey("Upstream bridge", t, func() {
+		mockClock := newMockClock(time.Unix(1257894000, 0).UTC())
+		useMockClock(mockClock)
+
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+
+		conf := BridgeConfig{
+			Enabled:   true,
+			Origin:    "ws://upstream.example.com",
+			State:     filepath.Join(dir, "bridge.json"),
+			Reconnect: "5s",
+			SaveDelay: "1s",
+		}
+		os.Remove(conf.State)
+		deliverer := new(testDeliverer)
+		b, err := NewBridge(app, conf, deliverer)
+		So(err, ShouldBeNil)
+
+		conn := newTestBridgeConn()
+		var dialedID string
+		b.dial = func(origin, deviceID string, chids []string) (
+			bridgeConn, string, error) {
+
+			dialedID = deviceID
+			return conn, "dev1", nil
+		}
+
+		Convey("Should reject registrations while disconnected", func() {
+			_, err := b.Register("uaid1", "chid1")
+			So(err, ShouldEqual, ErrBridgeUnavailable)
+		})
+
+		Convey("Should relay upstream updates to local channels", func() {
+			done := make(chan error)
+			go func() { done <- b.connect() }()
+			for !b.Connected() {
+				runtime.Gosched()
+			}
+
+			endpoint, err := b.Register("uaid1", "chid1")
+			So(err, ShouldBeNil)
+			upstream := b.upstream["uaid1.chid1"]
+			So(endpoint, ShouldEqual,
+				"https://upstream.example.com/update/"+upstream)
+
+			updates := []client.Update{
+				{ChannelId: upstream, Version: 3, Data: "hi"},
+				{ChannelId: "unknown", Version: 1},
+			}
+			conn.batches <- updates
+			So(<-conn.accepted, ShouldResemble, updates)
+			So(deliverer.delivered, ShouldResemble, []string{"uaid1.chid1:hi"})
+
+			b.Close()
+			So(<-done, ShouldEqual, io.EOF)
+			So(b.Connected(), ShouldBeFalse)
+
+			Convey("And restore the channel mappings on restart", func() {
+				b, err := NewBridge(app, conf, deliverer)
+				So(err, ShouldBeNil)
+				So(b.state.DeviceID, ShouldEqual, "dev1")
+				So(b.state.Channels[upstream], ShouldResemble,
+					bridgeChannel{"uaid1", "chid1"})
+				So(dialedID, ShouldEqual, "")
+			})
+		})
+
+		Convey("Should not acknowledge updates that could not be stored", func() {
+			b.state.Channels["up1"] = bridgeChannel{"uaid1", "chid1"}
+			b.state.Channels["up2"] = bridgeChannel{"uaid1", "chid2"}
+			deliverer.fail = "chid2"
+			accepted := b.relay([]client.Update{
+				{ChannelId: "up1", Version: 1},
+				{ChannelId: "up2", Version: 1},
+			})
+			So(accepted, ShouldResemble, []client.Update{
+				{ChannelId: "up1", Version: 1}})
+		})
+
+		Convey("Should save registration changes together", func() {
+			b.conn = conn
+			_, err := b.Register("uaid1", "chid1")
+			So(err, ShouldBeNil)
+			_, err = b.Register("uaid1", "chid2")
+			So(err, ShouldBeNil)
+			_, err = os.Stat(conf.State)
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			mockClock.Advance(time.Second)
+			saved, err := NewBridge(app, conf, deliverer)
+			So(err, ShouldBeNil)
+			So(saved.state.Channels, ShouldHaveLength, 2)
+		})
+
+		Convey("Should unregister upstream channels", func() {
+			b.conn = conn
+			b.state.Channels["up1"] = bridgeChannel{"uaid1", "chid1"}
+			b.upstream["uaid1.chid1"] = "up1"
+			b.Unregister("uaid1", "chid1")
+			So(conn.unregs, ShouldResemble, []string{"up1"})
+			So(b.state.Channels, ShouldBeEmpty)
+		})
+	})
+}
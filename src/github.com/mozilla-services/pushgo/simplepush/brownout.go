@@ -0,0 +1,169 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type BrownoutConfig struct {
+	// Enabled starts the node in brownout mode. Brownout can also be toggled
+	// with the admin API.
+	Enabled bool
+
+	// MaxClients is the number of connected clients at which the node enters
+	// brownout automatically. Disabled if set to 0.
+	MaxClients int `toml:"max_clients" env:"max_clients"`
+
+	// MaxGoroutines is the number of goroutines at which the node enters
+	// brownout automatically. Disabled if set to 0.
+	MaxGoroutines int `toml:"max_goroutines" env:"max_goroutines"`
+
+	// Recovery is the fraction of each threshold below which an automatic
+	// brownout ends. Defaults to 0.8.
+	Recovery float64
+}
+
+// Brownout tracks whether the node is in brownout mode. In brownout, the node
+// sheds non-essential work (info and debug logging, delivery receipts, and
+// crash reports), so that its capacity goes to delivering updates. Brownout
+// is entered manually, via the config file or admin API, or automatically
+// when the node exceeds the configured thresholds.
+type Brownout struct {
+	active        int32 // Accessed atomically.
+	mux           sync.Mutex
+	forced        bool
+	auto          bool
+	reason        string
+	since         time.Time
+	maxClients    int
+	maxGoroutines int
+	recovery      float64
+}
+
+// BrownoutStatus is the brownout state reported by the health check and
+// admin API.
+type BrownoutStatus struct {
+	Active bool   `json:"active"`
+	Reason string `json:"reason,omitempty"`
+	Since  int64  `json:"since,omitempty"` // Seconds since Epoch.
+}
+
+// NewBrownout returns an inactive brownout tracker without thresholds.
+func NewBrownout() *Brownout {
+	return &Brownout{recovery: 0.8}
+}
+
+// configure sets the automatic thresholds, and enters brownout if enabled
+// in conf.
+func (b *Brownout) configure(conf BrownoutConfig) {
+	b.mux.Lock()
+	b.maxClients = conf.MaxClients
+	b.maxGoroutines = conf.MaxGoroutines
+	if conf.Recovery > 0 && conf.Recovery <= 1 {
+		b.recovery = conf.Recovery
+	}
+	b.mux.Unlock()
+	if conf.Enabled {
+		b.Enable("config")
+	}
+}
+
+// Active indicates whether the node is in brownout mode. Safe to call on a
+// nil Brownout.
+func (b *Brownout) Active() bool {
+	return b != nil && atomic.LoadInt32(&b.active) == 1
+}
+
+// Enable enters brownout mode until Disable is called. Returns true if the
+// node was not already in brownout.
+func (b *Brownout) Enable(reason string) (changed bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.forced = true
+	if b.auto {
+		// Keep the original reason and start time.
+		return false
+	}
+	return b.update(reason)
+}
+
+// Disable leaves brownout mode. If the node still exceeds a threshold, it
+// will re-enter brownout on the next check. Returns true if the node was in
+// brownout.
+func (b *Brownout) Disable() (changed bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.forced, b.auto = false, false
+	return b.update("")
+}
+
+// Check compares the client and goroutine counts against the thresholds,
+// entering or leaving automatic brownout as needed. Returns true if the
+// brownout state changed.
+func (b *Brownout) Check(clients, goroutines int) (changed bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.auto {
+		if exceeds(clients, b.maxClients, b.recovery) ||
+			exceeds(goroutines, b.maxGoroutines, b.recovery) {
+			return false
+		}
+		b.auto = false
+		return b.update("")
+	}
+	var reason string
+	if exceeds(clients, b.maxClients, 1) {
+		reason = "max_clients"
+	} else if exceeds(goroutines, b.maxGoroutines, 1) {
+		reason = "max_goroutines"
+	} else {
+		return false
+	}
+	b.auto = true
+	if b.forced {
+		return false
+	}
+	return b.update(reason)
+}
+
+// exceeds indicates whether value is at or above the given fraction of a
+// threshold. Thresholds of 0 are disabled.
+func exceeds(value, threshold int, fraction float64) bool {
+	return threshold > 0 && float64(value) >= float64(threshold)*fraction
+}
+
+// update recomputes the brownout state. The caller must hold the lock.
+func (b *Brownout) update(reason string) (changed bool) {
+	active := b.forced || b.auto
+	if active == (atomic.LoadInt32(&b.active) == 1) {
+		return false
+	}
+	if active {
+		b.reason, b.since = reason, timeNow()
+		atomic.StoreInt32(&b.active, 1)
+	} else {
+		b.reason, b.since = "", time.Time{}
+		atomic.StoreInt32(&b.active, 0)
+	}
+	return true
+}
+
+// Status returns the current brownout state.
+func (b *Brownout) Status() (status BrownoutStatus) {
+	if b == nil {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if atomic.LoadInt32(&b.active) == 1 {
+		status.Active = true
+		status.Reason = b.reason
+		status.Since = b.since.Unix()
+	}
+	return
+}
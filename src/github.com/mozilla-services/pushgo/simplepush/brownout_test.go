@@ -0,0 +1,69 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBrownout(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	Convey("Brownout mode", t, func() {
+		useMockFuncs()
+		defer useStdFuncs()
+		b := NewBrownout()
+		b.configure(BrownoutConfig{MaxClients: 100, MaxGoroutines: 1000})
+
+		Convey("Should enter and leave brownout automatically", func() {
+			So(b.Check(99, 500), ShouldBeFalse)
+			So(b.Active(), ShouldBeFalse)
+
+			So(b.Check(100, 500), ShouldBeTrue)
+			So(b.Status(), ShouldResemble, BrownoutStatus{
+				Active: true, Reason: "max_clients", Since: 1257894000})
+
+			// Stay in brownout until below the recovery threshold.
+			So(b.Check(85, 500), ShouldBeFalse)
+			So(b.Active(), ShouldBeTrue)
+			So(b.Check(79, 500), ShouldBeTrue)
+			So(b.Active(), ShouldBeFalse)
+		})
+
+		Convey("Should keep manual brownouts until disabled", func() {
+			So(b.Enable("incident"), ShouldBeTrue)
+			So(b.Enable("again"), ShouldBeFalse)
+			So(b.Check(0, 0), ShouldBeFalse)
+			So(b.Status().Reason, ShouldEqual, "incident")
+
+			So(b.Check(10, 1000), ShouldBeFalse)
+			So(b.Disable(), ShouldBeTrue)
+			So(b.Active(), ShouldBeFalse)
+		})
+
+		Convey("Should enter brownout if enabled in the config", func() {
+			b := NewBrownout()
+			b.configure(BrownoutConfig{Enabled: true})
+			So(b.Status().Reason, ShouldEqual, "config")
+			So(b.Check(1e6, 1e6), ShouldBeFalse)
+		})
+
+		Convey("Should suppress informational logging", func() {
+			mckLogger := NewMockLogger(mockCtrl)
+			logger, _ := NewLogger(mckLogger)
+			logger.brownout = b
+			b.Enable("incident")
+
+			So(logger.ShouldLog(DEBUG), ShouldBeFalse)
+			So(logger.ShouldLog(INFO), ShouldBeFalse)
+			mckLogger.EXPECT().ShouldLog(WARNING).Return(true)
+			So(logger.ShouldLog(WARNING), ShouldBeTrue)
+		})
+	})
+}
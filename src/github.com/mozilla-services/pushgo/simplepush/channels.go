@@ -0,0 +1,72 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+// ChannelInfo describes a channel registered to a device.
+type ChannelInfo struct {
+	ChannelID string `json:"channelID"`
+	Created   int64  `json:"created,omitempty"` // Seconds since Epoch; 0 if unknown.
+}
+
+// ChannelDescriber is an optional interface implemented by stores that can
+// return the creation times of a device's channels.
+type ChannelDescriber interface {
+	// DescribeChannels returns the device's registered channels.
+	DescribeChannels(suaid string) (channels []ChannelInfo, err error)
+}
+
+// FetchChannelInfo returns the channels registered to a device. Stores that
+// only implement ChannelLister return channels without creation times. ok is
+// false if the store cannot list channels.
+func FetchChannelInfo(store Store, uaid string) (
+	channels []ChannelInfo, ok bool, err error) {
+
+	if describer, ok := store.(ChannelDescriber); ok {
+		channels, err = describer.DescribeChannels(uaid)
+	} else if lister, ok := store.(ChannelLister); ok {
+		var chids []string
+		if chids, err = lister.FetchChannels(uaid); err == nil {
+			channels = make([]ChannelInfo, len(chids))
+			for i, chid := range chids {
+				channels[i].ChannelID = chid
+			}
+		}
+	} else {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	if channels == nil {
+		channels = []ChannelInfo{}
+	}
+	return channels, true, nil
+}
+
+// Channels returns the channels registered to the client's device, so that
+// the client can reconcile its local state after clearing its data or
+// migrating to a new profile. Channels is rejected as an unsupported command
+// if the store cannot list channels.
+func (w *WorkerWS) Channels(header *RequestHeader, _ []byte) (err error) {
+	uaid := w.UAID()
+	if uaid == "" {
+		return ErrNoHandshake
+	}
+	channels, ok, err := FetchChannelInfo(w.store, uaid)
+	if !ok {
+		return ErrUnsupportedType
+	}
+	status := 200
+	if err != nil {
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker", "Could not fetch channels",
+				LogFields{"rid": w.logID, "uaid": uaid, "error": ErrStr(err)})
+		}
+		status, _ = ErrToStatus(err)
+	} else {
+		w.metrics.Increment("updates.client.channels")
+	}
+	return w.WriteJSON(ChannelsReply{header.Type, status, channels})
+}
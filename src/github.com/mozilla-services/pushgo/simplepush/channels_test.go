@@ -0,0 +1,107 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// describingStore returns a fixed channel set with creation times.
+type describingStore struct {
+	NoStore
+	channels []ChannelInfo
+}
+
+func (s *describingStore) DescribeChannels(string) ([]ChannelInfo, error) {
+	return s.channels, nil
+}
+
+func TestWorkerChannels(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckSocket := NewMockSocket(mockCtrl)
+
+	uaid := "5e1e5984569c4f00bf4bea47754a6403"
+	header := &RequestHeader{Type: "channels"}
+
+	Convey("Channel list command", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+
+		Convey("Should reject unidentified clients", func() {
+			app.SetStore(&channelStore{})
+			wws := NewWorker(app, mckSocket, "test")
+
+			So(wws.Channels(header, nil), ShouldEqual, ErrNoHandshake)
+		})
+
+		Convey("Should reject the command if the store can't list channels", func() {
+			app.SetStore(&NoStore{})
+			wws := NewWorker(app, mckSocket, "test")
+			wws.SetUAID(uaid)
+
+			So(wws.Channels(header, nil), ShouldEqual, ErrUnsupportedType)
+		})
+
+		Convey("Should return channels with creation times", func() {
+			channels := []ChannelInfo{{"a", 1257894000}, {"b", 0}}
+			app.SetStore(&describingStore{channels: channels})
+			wws := NewWorker(app, mckSocket, "test")
+			wws.SetUAID(uaid)
+
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("updates.client.channels"),
+				mckSocket.EXPECT().WriteJSON(ChannelsReply{"channels", 200, channels}),
+			)
+			So(wws.Channels(header, nil), ShouldBeNil)
+		})
+
+		Convey("Should return channel IDs if creation times aren't stored", func() {
+			app.SetStore(&channelStore{chids: []string{"b", "a"}})
+			wws := NewWorker(app, mckSocket, "test")
+			wws.SetUAID(uaid)
+
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("updates.client.channels"),
+				mckSocket.EXPECT().WriteJSON(ChannelsReply{"channels", 200,
+					[]ChannelInfo{{ChannelID: "b"}, {ChannelID: "a"}}}),
+			)
+			So(wws.Channels(header, nil), ShouldBeNil)
+		})
+
+		Convey("Should return an empty list for devices without channels", func() {
+			app.SetStore(&channelStore{})
+			wws := NewWorker(app, mckSocket, "test")
+			wws.SetUAID(uaid)
+
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("updates.client.channels"),
+				mckSocket.EXPECT().WriteJSON(ChannelsReply{"channels", 200,
+					[]ChannelInfo{}}),
+			)
+			So(wws.Channels(header, nil), ShouldBeNil)
+		})
+
+		Convey("Should report store errors", func() {
+			app.SetStore(&channelStore{err: errors.New("oops")})
+			wws := NewWorker(app, mckSocket, "test")
+			wws.SetUAID(uaid)
+
+			mckSocket.EXPECT().WriteJSON(ChannelsReply{"channels", 500, nil})
+			So(wws.Channels(header, nil), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,68 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+)
+
+// ChannelLister is an optional interface implemented by stores that can list
+// the channels registered for a device.
+type ChannelLister interface {
+	// FetchChannels returns the IDs of the device's registered channels.
+	FetchChannels(suaid string) (chids []string, err error)
+}
+
+// ChannelChecksum returns the checksum of a channel set, sent by clients in
+// the handshake to detect drift between their channels and the server's:
+// the hex-encoded SHA-256 digest of the sorted channel IDs, each followed by
+// a newline.
+func ChannelChecksum(chids []string) string {
+	sorted := make([]string, len(chids))
+	copy(sorted, chids)
+	sort.Strings(sorted)
+	hash := sha256.New()
+	for _, chid := range sorted {
+		hash.Write([]byte(chid))
+		hash.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// checkDrift compares the client's channel checksum with the device's
+// registered channels. If they differ, the registered channels are returned,
+// so that the client can register missing channels and drop unknown ones.
+func (w *WorkerWS) checkDrift(uaid, checksum string) (chids []string,
+	drifted bool) {
+
+	lister, ok := w.store.(ChannelLister)
+	if !ok || len(checksum) == 0 {
+		return nil, false
+	}
+	chids, err := lister.FetchChannels(uaid)
+	if err != nil {
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker", "Could not fetch channels for drift check",
+				LogFields{"rid": w.logID, "uaid": uaid, "error": ErrStr(err)})
+		}
+		return nil, false
+	}
+	w.metrics.Increment("updates.client.hello.checksum")
+	if strings.EqualFold(checksum, ChannelChecksum(chids)) {
+		return nil, false
+	}
+	if w.logger.ShouldLog(INFO) {
+		w.logger.Info("worker", "Client channels differ from stored channels",
+			LogFields{"rid": w.logID, "uaid": uaid})
+	}
+	w.metrics.Increment("updates.client.hello.drift")
+	if chids == nil {
+		chids = []string{}
+	}
+	return chids, true
+}
@@ -0,0 +1,86 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// channelStore lists a fixed channel set.
+type channelStore struct {
+	NoStore
+	chids []string
+	err   error
+}
+
+func (s *channelStore) FetchChannels(string) ([]string, error) {
+	return s.chids, s.err
+}
+
+func TestChannelChecksum(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	uaid := "5e1e5984569c4f00bf4bea47754a6403"
+	checksum := "911169ddaaf146aff539f58c26c489af3b892dff0fe283c1c264c65ae5aa59a2"
+
+	Convey("Channel drift detection", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		store := &channelStore{chids: []string{"b", "a"}}
+		app.SetStore(store)
+		worker := NewWorker(app, NewMockSocket(mockCtrl), "test")
+
+		Convey("Should checksum sorted channel IDs", func() {
+			So(ChannelChecksum([]string{"b", "a"}), ShouldEqual, checksum)
+			So(ChannelChecksum(nil), ShouldEqual,
+				"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+		})
+
+		Convey("Should not list channels if the checksums match", func() {
+			mckStat.EXPECT().Increment("updates.client.hello.checksum")
+			_, drifted := worker.checkDrift(uaid, checksum)
+			So(drifted, ShouldBeFalse)
+		})
+
+		Convey("Should list channels if the checksums differ", func() {
+			mckStat.EXPECT().Increment("updates.client.hello.checksum")
+			mckStat.EXPECT().Increment("updates.client.hello.drift")
+			chids, drifted := worker.checkDrift(uaid, ChannelChecksum([]string{"a"}))
+			So(drifted, ShouldBeTrue)
+			So(chids, ShouldResemble, []string{"b", "a"})
+
+			store.chids = nil
+			mckStat.EXPECT().Increment("updates.client.hello.checksum")
+			mckStat.EXPECT().Increment("updates.client.hello.drift")
+			chids, drifted = worker.checkDrift(uaid, checksum)
+			So(drifted, ShouldBeTrue)
+			So(chids, ShouldNotBeNil)
+			So(chids, ShouldBeEmpty)
+		})
+
+		Convey("Should skip the check if the channels can't be listed", func() {
+			store.err = errors.New("oops")
+			_, drifted := worker.checkDrift(uaid, "bad")
+			So(drifted, ShouldBeFalse)
+
+			app.SetStore(&NoStore{})
+			worker = NewWorker(app, NewMockSocket(mockCtrl), "test")
+			_, drifted = worker.checkDrift(uaid, "bad")
+			So(drifted, ShouldBeFalse)
+		})
+	})
+}
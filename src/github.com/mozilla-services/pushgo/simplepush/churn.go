@@ -0,0 +1,191 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ChurnConfig struct {
+	Enabled bool
+
+	// Window is the period over which the baseline connection rate is
+	// averaged, rounded down to whole minutes.
+	Window string
+
+	// Threshold is the multiple of the baseline connection rate at which a
+	// reconnect storm is detected.
+	Threshold float64
+
+	// MinRate is the minimum number of connections per minute considered a
+	// storm, so that small nodes don't alert on a handful of reconnects.
+	MinRate int `toml:"min_rate" env:"min_rate"`
+
+	// EngageAdmission restarts admission control waves when a storm is
+	// detected. Requires admission control to be enabled.
+	EngageAdmission bool `toml:"engage_admission" env:"engage_admission"`
+}
+
+// ChurnMonitor tracks the per-minute WebSocket connect and disconnect rates,
+// and detects reconnect storms: minutes where the connect rate exceeds a
+// multiple of the recent baseline. Storms are logged and reported as metrics,
+// and can optionally engage admission control.
+type ChurnMonitor struct {
+	connects    int32 // Accessed atomically.
+	disconnects int32 // Accessed atomically.
+	logger      *SimpleLogger
+	metrics     Statistician
+	admission   *AdmissionControl
+	threshold   float64
+	minRate     int
+	historyMux  sync.Mutex
+	history     []int // Connects per minute, oldest first.
+	historyLen  int
+	storm       bool
+	closeChan   chan bool
+	closeOnce   Once
+}
+
+// NewChurnMonitor creates a churn monitor from conf. If admission is non-nil
+// and conf.EngageAdmission is set, detected storms engage admission control.
+func NewChurnMonitor(app *Application, conf ChurnConfig,
+	admission *AdmissionControl) (m *ChurnMonitor, err error) {
+
+	window, err := time.ParseDuration(conf.Window)
+	if err != nil {
+		return nil, err
+	}
+	m = &ChurnMonitor{
+		logger:     app.Logger(),
+		metrics:    app.Metrics(),
+		threshold:  conf.Threshold,
+		minRate:    conf.MinRate,
+		historyLen: int(window / time.Minute),
+		closeChan:  make(chan bool),
+	}
+	if m.historyLen < 1 {
+		m.historyLen = 1
+	}
+	if conf.EngageAdmission {
+		m.admission = admission
+	}
+	return m, nil
+}
+
+// Connect records a new client connection. Safe to call on a nil
+// ChurnMonitor.
+func (m *ChurnMonitor) Connect() {
+	if m != nil {
+		atomic.AddInt32(&m.connects, 1)
+	}
+}
+
+// Disconnect records a closed client connection. Safe to call on a nil
+// ChurnMonitor.
+func (m *ChurnMonitor) Disconnect() {
+	if m != nil {
+		atomic.AddInt32(&m.disconnects, 1)
+	}
+}
+
+// Run samples the connection rates once a minute until the monitor is
+// closed.
+func (m *ChurnMonitor) Run() {
+	ticker := clock.NewTicker(1 * time.Minute)
+	for ok := true; ok; {
+		select {
+		case ok = <-m.closeChan:
+		case <-ticker.C():
+			m.tick()
+		}
+	}
+	ticker.Stop()
+}
+
+// tick records the rates for the past minute and checks for a storm. Returns
+// true if a new storm was detected.
+func (m *ChurnMonitor) tick() (detected bool) {
+	connects := int(atomic.SwapInt32(&m.connects, 0))
+	disconnects := int(atomic.SwapInt32(&m.disconnects, 0))
+	m.metrics.Gauge("client.churn.connects", int64(connects))
+	m.metrics.Gauge("client.churn.disconnects", int64(disconnects))
+
+	m.historyMux.Lock()
+	baseline := m.baseline()
+	wasStorm := m.storm
+	m.storm = len(m.history) > 0 && connects >= m.minRate &&
+		float64(connects) > baseline*m.threshold
+	if !m.storm {
+		// Storm minutes are excluded, so that a long storm doesn't raise the
+		// baseline.
+		if len(m.history) >= m.historyLen {
+			m.history = m.history[1:]
+		}
+		m.history = append(m.history, connects)
+	}
+	isStorm := m.storm
+	m.historyMux.Unlock()
+
+	if !isStorm {
+		m.metrics.Gauge("client.churn.storm", 0)
+		if wasStorm && m.logger.ShouldLog(WARNING) {
+			m.logger.Warn("churn", "Reconnect storm subsided", LogFields{
+				"connects": strconv.Itoa(connects)})
+		}
+		return false
+	}
+	m.metrics.Gauge("client.churn.storm", 1)
+	if wasStorm {
+		return false
+	}
+	m.metrics.Increment("client.churn.storm.detected")
+	if m.logger.ShouldLog(WARNING) {
+		m.logger.Warn("churn", "Reconnect storm detected", LogFields{
+			"connects":    strconv.Itoa(connects),
+			"disconnects": strconv.Itoa(disconnects),
+			"baseline":    strconv.FormatFloat(baseline, 'f', 1, 64)})
+	}
+	if m.admission != nil {
+		m.admission.Engage()
+		m.metrics.Increment("client.churn.admission")
+	}
+	return true
+}
+
+// baseline returns the average connects per minute over the window. The
+// caller must hold the history lock.
+func (m *ChurnMonitor) baseline() float64 {
+	if len(m.history) == 0 {
+		return 0
+	}
+	var total int
+	for _, connects := range m.history {
+		total += connects
+	}
+	return float64(total) / float64(len(m.history))
+}
+
+// Storm indicates whether a reconnect storm is in progress.
+func (m *ChurnMonitor) Storm() bool {
+	if m == nil {
+		return false
+	}
+	m.historyMux.Lock()
+	defer m.historyMux.Unlock()
+	return m.storm
+}
+
+// Close stops the monitor.
+func (m *ChurnMonitor) Close() error {
+	return m.closeOnce.Do(m.close)
+}
+
+func (m *ChurnMonitor) close() error {
+	close(m.closeChan)
+	return nil
+}
@@ -0,0 +1,117 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestChurnMonitor(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStat.EXPECT().Gauge("client.churn.connects", gomock.Any()).AnyTimes()
+	mckStat.EXPECT().Gauge("client.churn.disconnects", gomock.Any()).AnyTimes()
+
+	defer saveTimeFuncs()()
+	var now time.Time
+	timeNow = func() time.Time { return now }
+
+	Convey("Churn monitoring", t, func() {
+		now = time.Unix(1257894000, 0).UTC()
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+
+		admission, err := NewAdmissionControl(AdmissionConfig{
+			Waves: 4, Interval: "30s"})
+		So(err, ShouldBeNil)
+		conf := ChurnConfig{
+			Enabled:   true,
+			Window:    "5m",
+			Threshold: 3,
+			MinRate:   10,
+		}
+		connect := func(m *ChurnMonitor, n int) {
+			for i := 0; i < n; i++ {
+				m.Connect()
+				m.Disconnect()
+			}
+		}
+
+		Convey("Should detect connect rates above the baseline", func() {
+			m, err := NewChurnMonitor(app, conf, admission)
+			So(err, ShouldBeNil)
+
+			mckStat.EXPECT().Gauge("client.churn.storm", int64(0)).Times(2)
+			connect(m, 10)
+			So(m.tick(), ShouldBeFalse)
+			connect(m, 12)
+			So(m.tick(), ShouldBeFalse)
+
+			gomock.InOrder(
+				mckStat.EXPECT().Gauge("client.churn.storm", int64(1)),
+				mckStat.EXPECT().Increment("client.churn.storm.detected"),
+				mckStat.EXPECT().Gauge("client.churn.storm", int64(1)),
+				mckStat.EXPECT().Gauge("client.churn.storm", int64(0)),
+			)
+			connect(m, 100)
+			So(m.tick(), ShouldBeTrue)
+			So(m.Storm(), ShouldBeTrue)
+			connect(m, 100)
+			So(m.tick(), ShouldBeFalse)
+			So(m.Storm(), ShouldBeTrue)
+			connect(m, 11)
+			So(m.tick(), ShouldBeFalse)
+			So(m.Storm(), ShouldBeFalse)
+		})
+
+		Convey("Should ignore storms below the minimum rate", func() {
+			m, err := NewChurnMonitor(app, conf, admission)
+			So(err, ShouldBeNil)
+
+			mckStat.EXPECT().Gauge("client.churn.storm", int64(0)).Times(2)
+			connect(m, 1)
+			So(m.tick(), ShouldBeFalse)
+			connect(m, 9)
+			So(m.tick(), ShouldBeFalse)
+		})
+
+		Convey("Should engage admission control if configured", func() {
+			conf.EngageAdmission = true
+			m, err := NewChurnMonitor(app, conf, admission)
+			So(err, ShouldBeNil)
+
+			now = now.Add(5 * time.Minute)
+			So(admission.Active(), ShouldBeFalse)
+			gomock.InOrder(
+				mckStat.EXPECT().Gauge("client.churn.storm", int64(0)),
+				mckStat.EXPECT().Gauge("client.churn.storm", int64(1)),
+				mckStat.EXPECT().Increment("client.churn.storm.detected"),
+				mckStat.EXPECT().Increment("client.churn.admission"),
+			)
+			connect(m, 10)
+			So(m.tick(), ShouldBeFalse)
+			connect(m, 50)
+			So(m.tick(), ShouldBeTrue)
+			So(admission.Active(), ShouldBeTrue)
+		})
+
+		Convey("Should reject invalid windows", func() {
+			conf.Window = "forever"
+			_, err := NewChurnMonitor(app, conf, admission)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,270 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+var (
+	ErrUnknownCodec     = errors.New("Unknown record codec")
+	ErrCodecUnsupported = errors.New("Record type not supported by codec")
+	ErrRecordVersion    = errors.New("Unsupported record version")
+	ErrInvalidRecord    = errors.New("Malformed record header")
+)
+
+// Codec IDs, stored in record headers. IDs must not be reused.
+const (
+	CodecJSON byte = iota + 1
+	CodecGob
+	CodecProtobuf
+)
+
+// Encoded records start with a 3-byte header: recordMagic, the codec ID, and
+// the record schema version. The magic byte never starts a JSON document, so
+// records written before codecs were introduced are decoded as JSON, with
+// schema version recordVersion. Each migration in recordMigrations bumps the
+// current schema version.
+const (
+	recordMagic     byte = 0xfe
+	recordVersion   byte = 1
+	recordHeaderLen      = 3
+)
+
+// Codec serializes store records.
+type Codec interface {
+	// ID returns the codec ID written to record headers.
+	ID() byte
+
+	// Name returns the codec name, used in the storage configuration.
+	Name() string
+
+	// Marshal encodes v. Returns ErrCodecUnsupported if the codec cannot
+	// encode values of that type.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes data into v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// AvailableCodecs maps codec names to codecs.
+var AvailableCodecs = map[string]Codec{
+	"json":     JSONCodec{},
+	"gob":      GobCodec{},
+	"protobuf": ProtobufCodec{},
+}
+
+// codecsByID maps header codec IDs to codecs.
+var codecsByID = make(map[byte]Codec)
+
+func init() {
+	for _, codec := range AvailableCodecs {
+		codecsByID[codec.ID()] = codec
+	}
+}
+
+// RecordCodec encodes store records with a configured codec, and decodes
+// records written with any available codec. JSON records are written without
+// a header until the schema version changes, so that they remain readable by
+// older nodes during a rolling upgrade. Values that the configured codec does
+// not support are also written as JSON. Records written with older schema
+// versions are migrated to the current version as they are decoded.
+type RecordCodec struct {
+	codec      Codec
+	migrations []RecordMigration
+}
+
+// NewRecordCodec returns a record codec that encodes values with the named
+// codec. Defaults to JSON if name is empty.
+func NewRecordCodec(name string) (*RecordCodec, error) {
+	if len(name) == 0 {
+		name = "json"
+	}
+	codec, ok := AvailableCodecs[name]
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	return &RecordCodec{codec, recordMigrations}, nil
+}
+
+// Version returns the current record schema version.
+func (c *RecordCodec) Version() byte {
+	if c == nil {
+		return recordVersion
+	}
+	return recordVersion + byte(len(c.migrations))
+}
+
+// Marshal encodes a record with the current schema version.
+func (c *RecordCodec) Marshal(v interface{}) ([]byte, error) {
+	if c == nil {
+		return json.Marshal(v)
+	}
+	version := c.Version()
+	codec := c.codec
+	if codec.ID() == CodecJSON && version == recordVersion {
+		return json.Marshal(v)
+	}
+	body, err := codec.Marshal(v)
+	if err == ErrCodecUnsupported {
+		if version == recordVersion {
+			return json.Marshal(v)
+		}
+		codec = JSONCodec{}
+		body, err = codec.Marshal(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, recordHeaderLen, recordHeaderLen+len(body))
+	record[0] = recordMagic
+	record[1] = codec.ID()
+	record[2] = version
+	return append(record, body...), nil
+}
+
+// Unmarshal decodes a record written by Marshal, using the codec named in
+// the record header, and migrates it to the current schema version.
+func (c *RecordCodec) Unmarshal(data []byte, v interface{}) error {
+	version, body, codec, err := c.header(data)
+	if err != nil {
+		return err
+	}
+	if err = codec.Unmarshal(body, v); err != nil {
+		return err
+	}
+	for ; version < c.Version(); version++ {
+		if err = c.migrations[version-recordVersion](v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stale indicates whether a record was written with an older schema
+// version, and should be rewritten. Malformed records are not stale.
+func (c *RecordCodec) Stale(data []byte) bool {
+	version, _, _, err := c.header(data)
+	return err == nil && version < c.Version()
+}
+
+// header parses a record header, returning the schema version, the record
+// body, and the codec that encoded the body.
+func (c *RecordCodec) header(data []byte) (version byte, body []byte,
+	codec Codec, err error) {
+
+	if len(data) == 0 || data[0] != recordMagic {
+		return recordVersion, data, JSONCodec{}, nil
+	}
+	if len(data) < recordHeaderLen {
+		return 0, nil, nil, ErrInvalidRecord
+	}
+	codec, ok := codecsByID[data[1]]
+	if !ok {
+		return 0, nil, nil, ErrUnknownCodec
+	}
+	if version = data[2]; version < recordVersion || version > c.Version() {
+		return 0, nil, nil, ErrRecordVersion
+	}
+	return version, data[recordHeaderLen:], codec, nil
+}
+
+// JSONCodec encodes records as JSON.
+type JSONCodec struct{}
+
+func (JSONCodec) ID() byte     { return CodecJSON }
+func (JSONCodec) Name() string { return "json" }
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec encodes records with encoding/gob.
+type GobCodec struct{}
+
+func (GobCodec) ID() byte     { return CodecGob }
+func (GobCodec) Name() string { return "gob" }
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// ProtobufCodec encodes channel records and channel lists using the messages
+// in store_record.proto, and any value that implements proto.Message. Other
+// records are not supported.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) ID() byte     { return CodecProtobuf }
+func (ProtobufCodec) Name() string { return "protobuf" }
+
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case *ChannelRecord:
+		rec := &StoredRecord{
+			State:       proto.Int32(int32(t.State)),
+			Version:     proto.Uint64(t.Version),
+			LastTouched: proto.Int64(t.LastTouched),
+		}
+		if t.ExpiresAt > 0 {
+			rec.ExpiresAt = proto.Int64(t.ExpiresAt)
+		}
+		if t.Created > 0 {
+			rec.Created = proto.Int64(t.Created)
+		}
+		if t.Payload > 0 {
+			rec.Payload = proto.Uint64(t.Payload)
+		}
+		return proto.Marshal(rec)
+	case ChannelIDs:
+		return proto.Marshal(&StoredChannelIDs{ChannelIds: t})
+	case proto.Message:
+		return proto.Marshal(t)
+	}
+	return nil, ErrCodecUnsupported
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	switch t := v.(type) {
+	case *ChannelRecord:
+		rec := new(StoredRecord)
+		if err := proto.Unmarshal(data, rec); err != nil {
+			return err
+		}
+		t.State = ChannelState(rec.GetState())
+		t.Version = rec.GetVersion()
+		t.LastTouched = rec.GetLastTouched()
+		t.ExpiresAt = rec.GetExpiresAt()
+		t.Created = rec.GetCreated()
+		t.Payload = rec.GetPayload()
+		return nil
+	case *ChannelIDs:
+		chids := new(StoredChannelIDs)
+		if err := proto.Unmarshal(data, chids); err != nil {
+			return err
+		}
+		*t = chids.GetChannelIds()
+		return nil
+	case proto.Message:
+		return proto.Unmarshal(data, t)
+	}
+	return ErrCodecUnsupported
+}
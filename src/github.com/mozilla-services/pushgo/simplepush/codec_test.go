@@ -0,0 +1,148 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRecordCodec(t *testing.T) {
+	Convey("Record codecs", t, func() {
+		rec := &ChannelRecord{State: StateLive, Version: 7, LastTouched: 1257894000}
+		chids := ChannelIDs{"0ff1ce", "decafbad"}
+
+		for _, name := range []string{"json", "gob", "protobuf"} {
+			codec, err := NewRecordCodec(name)
+			So(err, ShouldBeNil)
+
+			Convey("Should round-trip records with "+name, func() {
+				raw, err := codec.Marshal(rec)
+				So(err, ShouldBeNil)
+				actualRec := new(ChannelRecord)
+				So(codec.Unmarshal(raw, actualRec), ShouldBeNil)
+				So(actualRec, ShouldResemble, rec)
+
+				raw, err = codec.Marshal(chids)
+				So(err, ShouldBeNil)
+				var actualIDs ChannelIDs
+				So(codec.Unmarshal(raw, &actualIDs), ShouldBeNil)
+				So(actualIDs, ShouldResemble, chids)
+			})
+		}
+
+		Convey("Should round-trip update expiry and creation times", func() {
+			expiring := &ChannelRecord{State: StateLive, Version: 7,
+				LastTouched: 1257894000, ExpiresAt: 1257894060,
+				Created: 1257893000}
+			for _, name := range []string{"json", "gob", "protobuf"} {
+				codec, _ := NewRecordCodec(name)
+				raw, err := codec.Marshal(expiring)
+				So(err, ShouldBeNil)
+				actualRec := new(ChannelRecord)
+				So(codec.Unmarshal(raw, actualRec), ShouldBeNil)
+				So(actualRec, ShouldResemble, expiring)
+			}
+		})
+
+		Convey("Should write JSON records without a header", func() {
+			codec, _ := NewRecordCodec("")
+			raw, err := codec.Marshal(rec)
+			So(err, ShouldBeNil)
+			So(string(raw), ShouldEqual,
+				`{"State":1,"Version":7,"LastTouched":1257894000}`)
+		})
+
+		Convey("Should read records written with other codecs", func() {
+			gobCodec, _ := NewRecordCodec("gob")
+			raw, err := gobCodec.Marshal(rec)
+			So(err, ShouldBeNil)
+			protoCodec, _ := NewRecordCodec("protobuf")
+			actualRec := new(ChannelRecord)
+			So(protoCodec.Unmarshal(raw, actualRec), ShouldBeNil)
+			So(actualRec, ShouldResemble, rec)
+
+			legacy := []byte(`{"State":2,"Version":0,"LastTouched":1}`)
+			actualRec = new(ChannelRecord)
+			So(protoCodec.Unmarshal(legacy, actualRec), ShouldBeNil)
+			So(actualRec.State, ShouldEqual, StateRegistered)
+		})
+
+		Convey("Should shrink records with protobuf", func() {
+			jsonCodec, _ := NewRecordCodec("json")
+			protoCodec, _ := NewRecordCodec("protobuf")
+			jsonRaw, _ := jsonCodec.Marshal(rec)
+			protoRaw, err := protoCodec.Marshal(rec)
+			So(err, ShouldBeNil)
+			So(len(protoRaw), ShouldBeLessThan, len(jsonRaw))
+		})
+
+		Convey("Should fall back to JSON for unsupported types", func() {
+			protoCodec, _ := NewRecordCodec("protobuf")
+			ban := &Ban{Kind: BanIP, Value: "192.0.2.57", Expires: 1257897600}
+			raw, err := protoCodec.Marshal(ban)
+			So(err, ShouldBeNil)
+			So(raw[0], ShouldEqual, '{')
+			actualBan := new(Ban)
+			So(protoCodec.Unmarshal(raw, actualBan), ShouldBeNil)
+			So(actualBan, ShouldResemble, ban)
+		})
+
+		Convey("Should migrate records written with older schema versions", func() {
+			v1, _ := NewRecordCodec("json")
+			legacy, err := v1.Marshal(rec)
+			So(err, ShouldBeNil)
+			So(v1.Stale(legacy), ShouldBeFalse)
+
+			codec, _ := NewRecordCodec("protobuf")
+			codec.migrations = []RecordMigration{func(v interface{}) error {
+				if rec, ok := v.(*ChannelRecord); ok && rec.State == StateLive {
+					rec.Version++
+				}
+				return nil
+			}}
+			So(codec.Version(), ShouldEqual, recordVersion+1)
+			So(codec.Stale(legacy), ShouldBeTrue)
+			actualRec := new(ChannelRecord)
+			So(codec.Unmarshal(legacy, actualRec), ShouldBeNil)
+			So(actualRec.Version, ShouldEqual, 8)
+
+			raw, err := codec.Marshal(actualRec)
+			So(err, ShouldBeNil)
+			So(raw[2], ShouldEqual, recordVersion+1)
+			So(codec.Stale(raw), ShouldBeFalse)
+			actualRec = new(ChannelRecord)
+			So(codec.Unmarshal(raw, actualRec), ShouldBeNil)
+			So(actualRec.Version, ShouldEqual, 8)
+
+			// Nodes without the migration reject newer records.
+			So(v1.Unmarshal(raw, actualRec), ShouldEqual, ErrRecordVersion)
+		})
+
+		Convey("Should write JSON record headers after a migration", func() {
+			codec, _ := NewRecordCodec("json")
+			codec.migrations = []RecordMigration{
+				func(interface{}) error { return nil }}
+			raw, err := codec.Marshal(rec)
+			So(err, ShouldBeNil)
+			So(raw[:recordHeaderLen], ShouldResemble,
+				[]byte{recordMagic, CodecJSON, recordVersion + 1})
+		})
+
+		Convey("Should reject unknown codecs and versions", func() {
+			_, err := NewRecordCodec("xml")
+			So(err, ShouldEqual, ErrUnknownCodec)
+
+			codec, _ := NewRecordCodec("gob")
+			So(codec.Unmarshal([]byte{recordMagic, 0x7f, recordVersion},
+				rec), ShouldEqual, ErrUnknownCodec)
+			So(codec.Unmarshal([]byte{recordMagic, CodecGob, recordVersion + 1},
+				rec), ShouldEqual, ErrRecordVersion)
+			So(codec.Unmarshal([]byte{recordMagic, CodecGob}, rec),
+				ShouldEqual, ErrInvalidRecord)
+		})
+	})
+}
@@ -0,0 +1,164 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// DeflateSuffix is appended to a subprotocol name by clients that accept
+// compressed frames, such as "push-notification.v1+deflate". The WebSocket
+// library doesn't support the permessage-deflate extension, so compression
+// is negotiated as a subprotocol variant instead.
+const DeflateSuffix = "+deflate"
+
+var ErrInvalidLevel = errors.New("Invalid compression level")
+
+type CompressionConfig struct {
+	// Enabled accepts the "+deflate" subprotocol variants. Messages sent to
+	// these clients at or above MinSize bytes are compressed with zlib, and
+	// sent as binary frames. Smaller messages, and all client messages, are
+	// sent uncompressed as text frames.
+	Enabled bool
+
+	// Level is the zlib compression level, from 1 (fastest) to 9 (smallest).
+	// Defaults to 6.
+	Level int
+
+	// MinSize is the size, in bytes, of the smallest message that is
+	// compressed. Defaults to 512.
+	MinSize int `toml:"min_size" env:"min_size"`
+}
+
+// splitCompression returns the base subprotocol name, and whether the client
+// requested compressed frames.
+func splitCompression(name string) (base string, deflate bool) {
+	if strings.HasSuffix(name, DeflateSuffix) {
+		return name[:len(name)-len(DeflateSuffix)], true
+	}
+	return name, false
+}
+
+// Compression holds the compression settings shared by all connections.
+type Compression struct {
+	metrics Statistician
+	level   int
+	minSize int
+	writers sync.Pool // Recycled *deflateWriter objects.
+}
+
+// deflateWriter is a zlib writer and its output buffer. zlib writers allocate
+// several hundred KB of state, so writers are reset and reused instead of
+// created for each message.
+type deflateWriter struct {
+	buf bytes.Buffer
+	zw  *zlib.Writer
+}
+
+// NewCompression creates a compression policy from conf.
+func NewCompression(app *Application, conf CompressionConfig) (
+	*Compression, error) {
+
+	if conf.Level < flate.BestSpeed || conf.Level > flate.BestCompression {
+		return nil, ErrInvalidLevel
+	}
+	c := &Compression{
+		metrics: app.Metrics(),
+		level:   conf.Level,
+		minSize: conf.MinSize,
+	}
+	c.writers.New = c.newWriter
+	return c, nil
+}
+
+func (c *Compression) newWriter() interface{} {
+	w := new(deflateWriter)
+	// The level is validated by NewCompression.
+	w.zw, _ = zlib.NewWriterLevel(&w.buf, c.level)
+	return w
+}
+
+// compress returns the zlib-compressed form of data. The returned writer
+// holds the compressed bytes, and must be released by calling putWriter
+// after they are sent.
+func (c *Compression) compress(data []byte) (w *deflateWriter, err error) {
+	w = c.writers.Get().(*deflateWriter)
+	w.buf.Reset()
+	w.zw.Reset(&w.buf)
+	if _, err = w.zw.Write(data); err == nil {
+		err = w.zw.Close()
+	}
+	if err != nil {
+		c.putWriter(w)
+		return nil, err
+	}
+	return w, nil
+}
+
+func (c *Compression) putWriter(w *deflateWriter) {
+	c.writers.Put(w)
+}
+
+// Wrap returns a socket that compresses messages sent to the client.
+func (c *Compression) Wrap(socket Socket) Socket {
+	c.metrics.Increment("client.socket.deflate")
+	return &DeflateSocket{Socket: socket, compression: c}
+}
+
+// DeflateSocket compresses large text messages written to a Socket. Reads
+// are passed through unchanged.
+type DeflateSocket struct {
+	Socket
+	compression *Compression
+}
+
+// SendClose implements StatusCloser.SendClose by forwarding to the wrapped
+// socket. Does nothing if the wrapped socket cannot send a status.
+func (s *DeflateSocket) SendClose(status int) error {
+	sc, ok := s.Socket.(StatusCloser)
+	if !ok {
+		return nil
+	}
+	return sc.SendClose(status)
+}
+
+func (s *DeflateSocket) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.write(data)
+}
+
+func (s *DeflateSocket) WriteText(data string) error {
+	return s.write([]byte(data))
+}
+
+// write sends data as a compressed binary frame if it meets the size
+// threshold, and compression makes it smaller. Otherwise, data is sent as a
+// text frame.
+func (s *DeflateSocket) write(data []byte) error {
+	c := s.compression
+	if len(data) < c.minSize {
+		return s.Socket.WriteText(string(data))
+	}
+	w, err := c.compress(data)
+	if err != nil {
+		return err
+	}
+	defer c.putWriter(w)
+	if w.buf.Len() >= len(data) {
+		return s.Socket.WriteText(string(data))
+	}
+	c.metrics.IncrementBy("client.socket.deflate.saved",
+		int64(len(data)-w.buf.Len()))
+	return s.Socket.WriteBinary(w.buf.Bytes())
+}
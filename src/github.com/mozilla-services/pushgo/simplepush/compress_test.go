@@ -0,0 +1,88 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDeflateSocket(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+	mckSocket := NewMockSocket(mockCtrl)
+
+	Convey("Compressed frames", t, func() {
+		app := NewApplication()
+		app.SetMetrics(mckStat)
+		c, err := NewCompression(app, CompressionConfig{Level: 6, MinSize: 64})
+		So(err, ShouldBeNil)
+		mckStat.EXPECT().Increment("client.socket.deflate")
+		socket := c.Wrap(mckSocket)
+
+		Convey("Should send small messages as text", func() {
+			mckSocket.EXPECT().WriteText(`{"messageType":"ping"}`)
+			So(socket.WriteJSON(map[string]string{"messageType": "ping"}),
+				ShouldBeNil)
+		})
+
+		Convey("Should compress large messages", func() {
+			updates := make([]Update, 20)
+			for i := range updates {
+				updates[i] = Update{"0d6a6d0ca1ba4be1bc8a2cea8e4ddb1a", uint64(i), "", false}
+			}
+			reply := FlushReply{"notification", updates, nil, 0, 0}
+			expected, _ := json.Marshal(reply)
+
+			var frame []byte
+			mckStat.EXPECT().IncrementBy("client.socket.deflate.saved", gomock.Any())
+			mckSocket.EXPECT().WriteBinary(gomock.Any()).Do(func(data []byte) {
+				// The buffer is reused after WriteBinary returns.
+				frame = append([]byte(nil), data...)
+			})
+			So(socket.WriteJSON(reply), ShouldBeNil)
+			So(len(frame), ShouldBeLessThan, len(expected))
+
+			r, err := zlib.NewReader(bytes.NewReader(frame))
+			So(err, ShouldBeNil)
+			actual, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(actual), ShouldEqual, string(expected))
+		})
+
+		Convey("Should reset recycled writers", func() {
+			for _, data := range []string{strings.Repeat("a", 128), strings.Repeat("b", 256)} {
+				w, err := c.compress([]byte(data))
+				So(err, ShouldBeNil)
+				r, err := zlib.NewReader(bytes.NewReader(w.buf.Bytes()))
+				So(err, ShouldBeNil)
+				actual, err := ioutil.ReadAll(r)
+				So(err, ShouldBeNil)
+				So(string(actual), ShouldEqual, data)
+				c.putWriter(w)
+			}
+		})
+
+		Convey("Should send incompressible messages as text", func() {
+			data := `"qJx7Vb2mKp9ZtR4wLc8NfY3hDs6GuE1oAi5XzQ0jWk-TnM_vBy.PrHgSaFdCeOlI!UUvz?"`
+			mckSocket.EXPECT().WriteText(data)
+			So(socket.WriteText(data), ShouldBeNil)
+		})
+
+		Convey("Should reject invalid levels", func() {
+			_, err := NewCompression(app, CompressionConfig{Level: 10})
+			So(err, ShouldEqual, ErrInvalidLevel)
+		})
+	})
+}
@@ -89,6 +89,7 @@ const (
 	PluginEndpoint
 	PluginHealth
 	PluginProfile
+	PluginAdmin
 )
 
 var pluginNames = map[PluginType]string{
@@ -104,6 +105,7 @@ var pluginNames = map[PluginType]string{
 	PluginEndpoint: "endpoint",
 	PluginHealth:   "health",
 	PluginProfile:  "profile",
+	PluginAdmin:    "admin",
 }
 
 func (t PluginType) String() string {
@@ -180,7 +182,7 @@ func (l PluginLoaders) Load(logging int) (*Application, error) {
 	}
 
 	// Next, setup the router.
-	// Deps: PluginLogger, PluginMetrics.
+	// Deps: PluginLogger, PluginMetrics, PluginStore.
 	if obj, err = l.loadPlugin(PluginRouter, app); err != nil {
 		return nil, err
 	}
@@ -240,6 +242,14 @@ func (l PluginLoaders) Load(logging int) (*Application, error) {
 	ph := obj.(Handler)
 	app.SetProfileHandlers(ph)
 
+	// Set up the admin API.
+	// Deps: PluginLogger, PluginMetrics, PluginStore, PluginEndpoint.
+	if obj, err = l.loadPlugin(PluginAdmin, app); err != nil {
+		return nil, err
+	}
+	ah := obj.(Handler)
+	app.SetAdminHandlers(ah)
+
 	return app, nil
 }
 
@@ -375,6 +385,55 @@ func LoadApplicationFromFileName(filename string, logging int) (
 	return LoadApplication(configFile, env, logging)
 }
 
+// LoadTenants configures dynamic per-tenant settings from the optional
+// [tenants] section, or the environment.
+func LoadTenants(app *Application, env envconf.Environment,
+	configFile ConfigFile) error {
+
+	t := NewTenants()
+	sectionName := "tenants"
+	if _, ok := configFile[sectionName]; ok {
+		return LoadConfigForSection(app, sectionName, t, env, configFile)
+	}
+	return LoadConfigFromEnvironment(app, sectionName, t, env, t.ConfigStruct())
+}
+
+// LoadControlPlane configures control events from the optional [control]
+// section, or the environment. Control events require a discovery service
+// that implements ControlChannel.
+func LoadControlPlane(app *Application, env envconf.Environment,
+	configFile ConfigFile) error {
+
+	c := NewControlPlane()
+	sectionName := "control"
+	if _, ok := configFile[sectionName]; ok {
+		return LoadConfigForSection(app, sectionName, c, env, configFile)
+	}
+	return LoadConfigFromEnvironment(app, sectionName, c, env, c.ConfigStruct())
+}
+
+// LoadDeadLetterStore configures separate storage for dead letters from the
+// optional [dead_letters] section. The section takes a storage type and
+// options, like [storage]. If the section is omitted, dead letters are kept
+// in the main store.
+func LoadDeadLetterStore(app *Application, env envconf.Environment,
+	configFile ConfigFile) error {
+
+	sectionName := "dead_letters"
+	if _, ok := configFile[sectionName]; !ok {
+		return nil
+	}
+	obj, err := LoadExtensibleSection(app, sectionName, AvailableStores, env, configFile)
+	if err != nil {
+		return err
+	}
+	if err = app.SetDeadLetterStore(obj.(Store)); err != nil {
+		return fmt.Errorf("Invalid storage type for section '%s': %s",
+			sectionName, err)
+	}
+	return nil
+}
+
 func LoadApplication(configFile ConfigFile, env envconf.Environment,
 	logging int) (app *Application, err error) {
 
@@ -396,7 +455,14 @@ func LoadApplication(configFile ConfigFile, env envconf.Environment,
 			return metrics, nil
 		},
 		PluginStore: func(app *Application) (HasConfigStruct, error) {
-			return LoadExtensibleSection(app, "storage", AvailableStores, env, configFile)
+			obj, err := LoadExtensibleSection(app, "storage", AvailableStores, env, configFile)
+			if err != nil {
+				return nil, err
+			}
+			if err = LoadDeadLetterStore(app, env, configFile); err != nil {
+				return nil, err
+			}
+			return obj, nil
 		},
 		PluginRouter: func(app *Application) (HasConfigStruct, error) {
 			return LoadExtensibleSection(app, "router", AvailableRouters, env, configFile)
@@ -443,9 +509,36 @@ func LoadApplication(configFile ConfigFile, env envconf.Environment,
 			}
 			return h, nil
 		},
+		PluginAdmin: func(app *Application) (plugin HasConfigStruct, err error) {
+			h := NewAdminHandlers()
+			sectionName := "admin"
+			if _, ok := configFile[sectionName]; ok {
+				err = LoadConfigForSection(app, sectionName, h, env, configFile)
+			} else {
+				confStruct := h.ConfigStruct()
+				err = LoadConfigFromEnvironment(app, sectionName, h, env, confStruct)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return h, nil
+		},
 	}
 
-	return loaders.Load(logging)
+	if app, err = loaders.Load(logging); err != nil {
+		return nil, err
+	}
+	if err = LoadVirtualServers(app, configFile); err != nil {
+		return nil, err
+	}
+	if err = LoadTenants(app, env, configFile); err != nil {
+		return nil, err
+	}
+	if err = LoadControlPlane(app, env, configFile); err != nil {
+		return nil, err
+	}
+	app.SetConfigReloader(NewConfigReloader(app, configFile, env, logging))
+	return app, nil
 }
 
 func toEnvName(params ...string) string {
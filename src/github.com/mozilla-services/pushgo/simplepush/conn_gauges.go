@@ -0,0 +1,143 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net"
+	"time"
+)
+
+type ConnGaugesConfig struct {
+	// Enabled periodically reports the open connections and connection totals
+	// of each listener, and the number of clients by handshake state, as
+	// gauges.
+	Enabled bool
+
+	// Interval is how often the gauges are reported. Defaults to 10s.
+	Interval string
+}
+
+// ConnCounter is implemented by listeners that count their connections.
+type ConnCounter interface {
+	// ConnCount returns the number of open connections.
+	ConnCount() int
+
+	// Accepted returns the number of connections accepted.
+	Accepted() int64
+
+	// Rejected returns the number of accepts refused at capacity.
+	Rejected() int64
+}
+
+// ServingCounter is implemented by WebSocket handlers that count the clients
+// they serve.
+type ServingCounter interface {
+	// Serving returns the number of clients being served, including clients
+	// that have not completed the handshake.
+	Serving() int
+}
+
+// listenerHandler is implemented by handlers and routers with a listener.
+type listenerHandler interface {
+	Listener() net.Listener
+}
+
+// connCounter returns the connection counter for ln, unwrapping TLS
+// listeners.
+func connCounter(ln net.Listener) (ConnCounter, bool) {
+	for ln != nil {
+		if counter, ok := ln.(ConnCounter); ok {
+			return counter, true
+		}
+		reloader, ok := ln.(*reloadListener)
+		if !ok {
+			break
+		}
+		ln = reloader.Listener
+	}
+	return nil, false
+}
+
+// ConnGauges reports socket saturation: the open connections of each
+// listener, the connections accepted and refused since startup, and how many
+// clients are still handshaking. A nil ConnGauges reports nothing.
+type ConnGauges struct {
+	app      *Application
+	interval time.Duration
+}
+
+// NewConnGauges creates a connection gauge reporter from conf.
+func NewConnGauges(app *Application, conf ConnGaugesConfig) (
+	g *ConnGauges, err error) {
+
+	g = &ConnGauges{app: app}
+	if g.interval, err = time.ParseDuration(conf.Interval); err != nil {
+		return nil, err
+	}
+	if g.interval <= 0 {
+		g.interval = 10 * time.Second
+	}
+	return g, nil
+}
+
+// listeners returns the application's listeners, by name.
+func (g *ConnGauges) listeners() map[string]interface{} {
+	return map[string]interface{}{
+		"websocket": g.app.SocketHandler(),
+		"endpoint":  g.app.EndpointHandler(),
+		"router":    g.app.Router(),
+		"profile":   g.app.ProfileHandlers(),
+		"admin":     g.app.AdminHandlers(),
+	}
+}
+
+// Report publishes the gauges once.
+func (g *ConnGauges) Report() {
+	if g == nil {
+		return
+	}
+	metrics := g.app.Metrics()
+	for name, v := range g.listeners() {
+		lh, ok := v.(listenerHandler)
+		if !ok {
+			continue
+		}
+		counter, ok := connCounter(lh.Listener())
+		if !ok {
+			continue
+		}
+		prefix := "client.listener." + name
+		metrics.Gauge(prefix+".connections", int64(counter.ConnCount()))
+		metrics.Gauge(prefix+".accepted", counter.Accepted())
+		metrics.Gauge(prefix+".rejected", counter.Rejected())
+	}
+	active := g.app.WorkerCount()
+	metrics.Gauge("client.workers.active", int64(active))
+	if sc, ok := g.app.SocketHandler().(ServingCounter); ok {
+		// Clients are registered once they complete the handshake.
+		handshaking := sc.Serving() - active
+		if handshaking < 0 {
+			handshaking = 0
+		}
+		metrics.Gauge("client.workers.handshaking", int64(handshaking))
+	}
+}
+
+// Run reports the gauges every interval until closeChan is closed.
+func (g *ConnGauges) Run(closeChan <-chan bool) {
+	if g == nil {
+		return
+	}
+	ticker := clock.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closeChan:
+			return
+		case <-ticker.C():
+			g.Report()
+		}
+	}
+}
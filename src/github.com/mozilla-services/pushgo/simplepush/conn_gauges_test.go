@@ -0,0 +1,97 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConnGauges(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+	mckEndpoint := NewMockHandler(mockCtrl)
+
+	Convey("Connection gauges", t, func() {
+		app := NewApplication()
+		app.SetMetrics(mckStat)
+
+		sh := NewSocketHandler()
+		sh.listener = &LimitListener{conns: 3, accepted: 10, rejected: 2}
+		sh.serving = 3
+		app.SetSocketHandler(sh)
+		app.SetEndpointHandler(mckEndpoint)
+		app.AddWorker("d1c7c768b1be4c7093a69b52910d4baa", NewMockWorker(mockCtrl))
+
+		Convey("Should reject invalid intervals", func() {
+			_, err := NewConnGauges(app, ConnGaugesConfig{Interval: "often"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Should report listener and client gauges", func() {
+			g, err := NewConnGauges(app, ConnGaugesConfig{Interval: "1s"})
+			So(err, ShouldBeNil)
+
+			// TLS listeners are unwrapped.
+			mckEndpoint.EXPECT().Listener().Return(&reloadListener{
+				Listener: &LimitListener{conns: 1, accepted: 4}})
+			mckStat.EXPECT().Gauge("client.listener.websocket.connections", int64(3))
+			mckStat.EXPECT().Gauge("client.listener.websocket.accepted", int64(10))
+			mckStat.EXPECT().Gauge("client.listener.websocket.rejected", int64(2))
+			mckStat.EXPECT().Gauge("client.listener.endpoint.connections", int64(1))
+			mckStat.EXPECT().Gauge("client.listener.endpoint.accepted", int64(4))
+			mckStat.EXPECT().Gauge("client.listener.endpoint.rejected", int64(0))
+			mckStat.EXPECT().Gauge("client.workers.active", int64(1))
+			mckStat.EXPECT().Gauge("client.workers.handshaking", int64(2))
+			g.Report()
+		})
+
+		Convey("Should report on each clock tick", func() {
+			defer saveTimeFuncs()()
+			c := newMockClock(time.Unix(1257894000, 0).UTC())
+			useMockClock(c)
+
+			g, err := NewConnGauges(app, ConnGaugesConfig{Interval: "1s"})
+			So(err, ShouldBeNil)
+			reported := make(chan bool, 1)
+			mckEndpoint.EXPECT().Listener().Return(&LimitListener{}).AnyTimes()
+			mckStat.EXPECT().Gauge("client.workers.handshaking", int64(2)).Do(
+				func(string, int64) { reported <- true })
+			mckStat.EXPECT().Gauge(gomock.Any(), gomock.Any()).AnyTimes()
+
+			closeChan, stopped := make(chan bool), make(chan bool)
+			go func() {
+				g.Run(closeChan)
+				close(stopped)
+			}()
+			// Advance until the ticker is registered and fires.
+			timeout := time.After(5 * time.Second)
+		wait:
+			for {
+				select {
+				case <-reported:
+					break wait
+				case <-timeout:
+					t.Fatal("Timed out waiting for gauges")
+				case <-time.After(1 * time.Millisecond):
+					c.Advance(1 * time.Second)
+				}
+			}
+			close(closeChan)
+			<-stopped
+		})
+
+		Convey("Should not report if disabled", func() {
+			var g *ConnGauges
+			g.Report()
+			g.Run(nil)
+		})
+	})
+}
@@ -0,0 +1,195 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrTooManyConns = errors.New("Too many connections from client address")
+
+type ConnLimitConfig struct {
+	Enabled bool
+
+	// MaxPerIP is the maximum number of simultaneous WebSocket connections
+	// from a single IP address. 0 disables the limit.
+	MaxPerIP int `toml:"max_per_ip" env:"max_per_ip"`
+
+	// MaxPerNetwork is the maximum number of simultaneous connections from a
+	// network: a /24 for IPv4 addresses, or a /48 for IPv6. 0 disables the
+	// limit.
+	MaxPerNetwork int `toml:"max_per_network" env:"max_per_network"`
+
+	// MaxRejects is the number of connections from an IP that can be rejected
+	// within the window before the IP is blocked. 0 disables blocking.
+	MaxRejects int `toml:"max_rejects" env:"max_rejects"`
+
+	// Window is the period over which rejections are counted.
+	Window string
+
+	// BlockPeriod is how long a blocked IP is refused new connections.
+	BlockPeriod string `toml:"block_period" env:"block_period"`
+}
+
+// ConnLimiter caps the number of simultaneous connections from each client IP
+// and network, protecting the server from connection exhaustion by a single
+// client. Clients that repeatedly exceed the limit are blocked temporarily.
+type ConnLimiter struct {
+	logger        *SimpleLogger
+	metrics       Statistician
+	maxPerIP      int
+	maxPerNetwork int
+	maxRejects    int
+	window        time.Duration
+	blockPeriod   time.Duration
+	connsMux      sync.Mutex
+	ips           map[string]int // Open connections, by IP.
+	networks      map[string]int // Open connections, by network.
+	offenders     map[string]*connOffender
+}
+
+// connOffender tracks rejected connections for a client IP.
+type connOffender struct {
+	rejects      int
+	windowStart  time.Time
+	blockedUntil time.Time
+}
+
+// NewConnLimiter creates a connection limiter from conf.
+func NewConnLimiter(app *Application, conf ConnLimitConfig) (
+	l *ConnLimiter, err error) {
+
+	l = &ConnLimiter{
+		logger:        app.Logger(),
+		metrics:       app.Metrics(),
+		maxPerIP:      conf.MaxPerIP,
+		maxPerNetwork: conf.MaxPerNetwork,
+		maxRejects:    conf.MaxRejects,
+		ips:           make(map[string]int),
+		networks:      make(map[string]int),
+		offenders:     make(map[string]*connOffender),
+	}
+	if l.maxRejects > 0 {
+		if l.window, err = time.ParseDuration(conf.Window); err != nil {
+			return nil, err
+		}
+		if l.blockPeriod, err = time.ParseDuration(conf.BlockPeriod); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Allow indicates whether a connection from addr would be accepted, without
+// counting it. Used to reject connections before the WebSocket upgrade.
+func (l *ConnLimiter) Allow(addr string) error {
+	return l.check(addr, false)
+}
+
+// Acquire counts a connection from addr. Returns ErrTooManyConns if the
+// client is over the limit, or ErrClientBanned if the client is blocked.
+// Connections must be released when they are closed.
+func (l *ConnLimiter) Acquire(addr string) error {
+	return l.check(addr, true)
+}
+
+func (l *ConnLimiter) check(addr string, acquire bool) error {
+	ip := hostOf(addr)
+	if len(ip) == 0 {
+		return nil
+	}
+	network := networkOf(addr)
+	now := timeNow()
+	l.connsMux.Lock()
+	defer l.connsMux.Unlock()
+	if offender, ok := l.offenders[ip]; ok && now.Before(offender.blockedUntil) {
+		l.metrics.Increment("client.socket.blocked")
+		return ErrClientBanned
+	}
+	if l.maxPerIP > 0 && l.ips[ip] >= l.maxPerIP ||
+		l.maxPerNetwork > 0 && len(network) > 0 &&
+			l.networks[network] >= l.maxPerNetwork {
+
+		l.reject(ip, now)
+		return ErrTooManyConns
+	}
+	if acquire {
+		l.ips[ip]++
+		if len(network) > 0 {
+			l.networks[network]++
+		}
+	}
+	return nil
+}
+
+// reject counts a rejected connection, and blocks the client if it exceeded
+// the rejection limit. The caller must hold the connections lock.
+func (l *ConnLimiter) reject(ip string, now time.Time) {
+	l.metrics.Increment("client.socket.limited")
+	if l.maxRejects <= 0 {
+		return
+	}
+	l.prune(now)
+	offender, ok := l.offenders[ip]
+	if !ok || now.Sub(offender.windowStart) >= l.window {
+		offender = &connOffender{windowStart: now}
+		l.offenders[ip] = offender
+	}
+	offender.rejects++
+	if offender.rejects < l.maxRejects {
+		return
+	}
+	offender.blockedUntil = now.Add(l.blockPeriod)
+	if l.logger.ShouldLog(WARNING) {
+		l.logger.Warn("conn_limit", "Client exceeded connection limit; blocking",
+			LogFields{
+				"addr":    ip,
+				"rejects": strconv.Itoa(offender.rejects),
+				"until":   offender.blockedUntil.UTC().Format(time.RFC3339)})
+	}
+	l.metrics.Increment("client.socket.block")
+}
+
+// prune removes expired offenders. The caller must hold the connections lock.
+func (l *ConnLimiter) prune(now time.Time) {
+	for ip, offender := range l.offenders {
+		if now.Sub(offender.windowStart) >= l.window &&
+			!now.Before(offender.blockedUntil) {
+
+			delete(l.offenders, ip)
+		}
+	}
+}
+
+// Release stops counting a connection acquired from addr.
+func (l *ConnLimiter) Release(addr string) {
+	ip := hostOf(addr)
+	if len(ip) == 0 {
+		return
+	}
+	network := networkOf(addr)
+	l.connsMux.Lock()
+	defer l.connsMux.Unlock()
+	if l.ips[ip]--; l.ips[ip] <= 0 {
+		delete(l.ips, ip)
+	}
+	if len(network) == 0 {
+		return
+	}
+	if l.networks[network]--; l.networks[network] <= 0 {
+		delete(l.networks, network)
+	}
+}
+
+// Conns returns the number of open connections from the IP of addr, and from
+// its network.
+func (l *ConnLimiter) Conns(addr string) (ip, network int) {
+	l.connsMux.Lock()
+	defer l.connsMux.Unlock()
+	return l.ips[hostOf(addr)], l.networks[networkOf(addr)]
+}
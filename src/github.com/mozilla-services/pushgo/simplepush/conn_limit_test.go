@@ -0,0 +1,86 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConnLimiter(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	defer saveTimeFuncs()()
+	now := time.Unix(1257894000, 0).UTC()
+	timeNow = func() time.Time { return now }
+
+	Convey("Connection limits", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+
+		l, err := NewConnLimiter(app, ConnLimitConfig{
+			MaxPerIP:      2,
+			MaxPerNetwork: 3,
+			MaxRejects:    2,
+			Window:        "1m",
+			BlockPeriod:   "5m",
+		})
+		So(err, ShouldBeNil)
+
+		Convey("Should limit connections per IP", func() {
+			So(l.Acquire("192.0.2.1:1001"), ShouldBeNil)
+			So(l.Acquire("192.0.2.1:1002"), ShouldBeNil)
+			mckStat.EXPECT().Increment("client.socket.limited")
+			So(l.Allow("192.0.2.1:1003"), ShouldEqual, ErrTooManyConns)
+
+			l.Release("192.0.2.1:1001")
+			So(l.Acquire("192.0.2.1:1003"), ShouldBeNil)
+			ip, network := l.Conns("192.0.2.1:1003")
+			So(ip, ShouldEqual, 2)
+			So(network, ShouldEqual, 2)
+		})
+
+		Convey("Should limit connections per network", func() {
+			So(l.Acquire("192.0.2.1:1001"), ShouldBeNil)
+			So(l.Acquire("192.0.2.2:1001"), ShouldBeNil)
+			So(l.Acquire("192.0.2.3:1001"), ShouldBeNil)
+			mckStat.EXPECT().Increment("client.socket.limited")
+			So(l.Acquire("192.0.2.4:1001"), ShouldEqual, ErrTooManyConns)
+			So(l.Acquire("198.51.100.1:1001"), ShouldBeNil)
+		})
+
+		Convey("Should block repeat offenders", func() {
+			So(l.Acquire("192.0.2.1:1001"), ShouldBeNil)
+			So(l.Acquire("192.0.2.1:1002"), ShouldBeNil)
+			mckStat.EXPECT().Increment("client.socket.limited").Times(2)
+			mckStat.EXPECT().Increment("client.socket.block")
+			So(l.Acquire("192.0.2.1:1003"), ShouldEqual, ErrTooManyConns)
+			So(l.Acquire("192.0.2.1:1004"), ShouldEqual, ErrTooManyConns)
+
+			l.Release("192.0.2.1:1001")
+			mckStat.EXPECT().Increment("client.socket.blocked")
+			So(l.Allow("192.0.2.1:1005"), ShouldEqual, ErrClientBanned)
+
+			now = now.Add(5 * time.Minute)
+			So(l.Acquire("192.0.2.1:1005"), ShouldBeNil)
+		})
+
+		Convey("Should ignore addresses without an IP", func() {
+			So(l.Acquire(""), ShouldBeNil)
+			l.Release("")
+		})
+	})
+}
@@ -0,0 +1,375 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/pushgo/id"
+)
+
+var ErrNoControlChannel = errors.New(
+	"Discovery service does not support control events")
+
+// Built-in control event types.
+const (
+	// ControlMaintenance enables or disables maintenance mode, which puts
+	// nodes into brownout. Args: "enabled" ("true" or "false"), and an
+	// optional "reason".
+	ControlMaintenance = "maintenance"
+
+	// ControlTenants refreshes the dynamic tenant settings, so that changes
+	// such as tenant throttles apply without waiting for the next refresh.
+	ControlTenants = "tenants.refresh"
+
+	// ControlDisconnect closes a device's connection on the node that it is
+	// connected to, so that the device doesn't write new data while its data
+	// is erased. Args: "uaid".
+	ControlDisconnect = "device.disconnect"
+
+	// ControlAPIKey drops a rotated or revoked app server API key from each
+	// node's cache. Args: "id".
+	ControlAPIKey = "apikey.invalidate"
+)
+
+// ControlEvent is a configuration-critical event propagated to all nodes in
+// the cluster.
+type ControlEvent struct {
+	ID     string            `json:"id"`
+	Type   string            `json:"type"`
+	Args   map[string]string `json:"args,omitempty"`
+	Origin string            `json:"origin"` // The publishing node.
+	Time   int64             `json:"time"`   // Seconds since Epoch.
+
+	// Nanos is the publishing time in nanoseconds since Epoch, used to order
+	// events published in the same second. Events published by a node are
+	// strictly increasing. 0 for events published by older nodes.
+	Nanos int64 `json:"nanos,omitempty"`
+}
+
+// ControlChannel is an optional interface implemented by Locators that can
+// propagate control events to all nodes. Published events are kept for a
+// backend-defined period, so that nodes that poll in the meantime see them.
+type ControlChannel interface {
+	PublishEvent(event ControlEvent) error
+	FetchEvents() ([]ControlEvent, error)
+}
+
+type ControlConfig struct {
+	Enabled bool
+
+	// Interval is the polling interval for new events. Defaults to "2s".
+	Interval string
+
+	// History is the number of applied events returned by the admin API.
+	// Defaults to 100.
+	History int
+}
+
+// ControlHandler applies a control event to the local node.
+type ControlHandler func(event ControlEvent) error
+
+// ControlPlane propagates control events through the discovery service. Each
+// node applies an event once, and logs it for auditing. Nodes apply the
+// events still kept by the discovery service when they start, in the order
+// they were published.
+type ControlPlane struct {
+	app         *Application
+	logger      *SimpleLogger
+	metrics     Statistician
+	channel     ControlChannel
+	interval    time.Duration
+	handlers    map[string]ControlHandler
+	appliedMux  sync.Mutex
+	applied     map[string]time.Time // Times applied, by event ID.
+	lastNanos   int64                // Protected by appliedMux.
+	history     []ControlEvent
+	maxHistory  int
+	closeSignal chan bool
+	closeWait   sync.WaitGroup
+	closeOnce   Once
+}
+
+func NewControlPlane() *ControlPlane {
+	return &ControlPlane{
+		handlers:    make(map[string]ControlHandler),
+		applied:     make(map[string]time.Time),
+		closeSignal: make(chan bool),
+	}
+}
+
+func (c *ControlPlane) ConfigStruct() interface{} {
+	return &ControlConfig{
+		Enabled:  false,
+		Interval: "2s",
+		History:  100,
+	}
+}
+
+func (c *ControlPlane) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*ControlConfig)
+	c.app = app
+	c.logger = app.Logger()
+	c.metrics = app.Metrics()
+
+	if !conf.Enabled {
+		return nil
+	}
+	if c.interval, err = time.ParseDuration(conf.Interval); err != nil {
+		c.logger.Panic("control", "Could not parse interval",
+			LogFields{"error": err.Error(), "interval": conf.Interval})
+		return err
+	}
+	c.maxHistory = conf.History
+	channel, ok := app.Locator().(ControlChannel)
+	if !ok {
+		c.logger.Panic("control", "Discovery service does not support control events",
+			nil)
+		return ErrNoControlChannel
+	}
+	c.channel = channel
+	c.Handle(ControlMaintenance, c.maintenance)
+	c.Handle(ControlTenants, c.refreshTenants)
+	c.Handle(ControlDisconnect, c.disconnect)
+	c.Handle(ControlAPIKey, c.invalidateAPIKey)
+	if err = c.Poll(); err != nil {
+		c.logger.Panic("control", "Could not fetch control events",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	c.closeWait.Add(1)
+	go c.poll()
+	app.SetControlPlane(c)
+	return nil
+}
+
+// Handle registers the handler for an event type.
+func (c *ControlPlane) Handle(eventType string, handler ControlHandler) {
+	c.handlers[eventType] = handler
+}
+
+// Publish sends an event to all nodes, and applies it locally.
+func (c *ControlPlane) Publish(eventType string, args map[string]string) (
+	event ControlEvent, err error) {
+
+	if event.ID, err = id.Generate(); err != nil {
+		return event, err
+	}
+	event.Type = eventType
+	event.Args = args
+	event.Origin = c.app.Hostname()
+	event.Nanos = c.nextNanos()
+	event.Time = event.Nanos / int64(time.Second)
+	if err = c.channel.PublishEvent(event); err != nil {
+		c.metrics.Increment("control.publish.error")
+		return event, err
+	}
+	c.metrics.Increment("control.publish.success")
+	c.apply(event)
+	return event, nil
+}
+
+// nextNanos returns the publishing time for a new event, in nanoseconds
+// since Epoch. Times are strictly increasing, so that events published in
+// quick succession are applied in order even with a coarse clock.
+func (c *ControlPlane) nextNanos() int64 {
+	nanos := timeNow().UnixNano()
+	c.appliedMux.Lock()
+	if nanos <= c.lastNanos {
+		nanos = c.lastNanos + 1
+	}
+	c.lastNanos = nanos
+	c.appliedMux.Unlock()
+	return nanos
+}
+
+// Poll fetches and applies new events.
+func (c *ControlPlane) Poll() error {
+	fetchedAt := timeNow()
+	events, err := c.channel.FetchEvents()
+	if err != nil {
+		if c.logger.ShouldLog(ERROR) {
+			c.logger.Error("control", "Failed to fetch control events",
+				LogFields{"error": err.Error()})
+		}
+		c.metrics.Increment("control.fetch.error")
+		return err
+	}
+	sort.Sort(eventsByTime(events))
+	for _, event := range events {
+		c.apply(event)
+	}
+	// Forget events that the discovery service no longer keeps. Events
+	// published locally during the fetch are kept.
+	published := make(map[string]bool, len(events))
+	for _, event := range events {
+		published[event.ID] = true
+	}
+	c.appliedMux.Lock()
+	for eventID, appliedAt := range c.applied {
+		if !published[eventID] && appliedAt.Before(fetchedAt) {
+			delete(c.applied, eventID)
+		}
+	}
+	c.appliedMux.Unlock()
+	return nil
+}
+
+// poll periodically fetches new events.
+func (c *ControlPlane) poll() {
+	defer c.closeWait.Done()
+	ticker := clock.NewTicker(c.interval)
+	for ok := true; ok; {
+		select {
+		case ok = <-c.closeSignal:
+		case <-ticker.C():
+			c.Poll()
+		}
+	}
+	ticker.Stop()
+}
+
+// apply runs the handler for an event, unless the event was already applied.
+func (c *ControlPlane) apply(event ControlEvent) {
+	c.appliedMux.Lock()
+	if _, ok := c.applied[event.ID]; ok {
+		c.appliedMux.Unlock()
+		return
+	}
+	c.applied[event.ID] = timeNow()
+	c.appliedMux.Unlock()
+
+	args, _ := json.Marshal(event.Args)
+	fields := LogFields{
+		"id":     event.ID,
+		"type":   event.Type,
+		"origin": event.Origin,
+		"time":   strconv.FormatInt(event.Time, 10),
+		"args":   string(args),
+	}
+	handler, ok := c.handlers[event.Type]
+	if !ok {
+		if c.logger.ShouldLog(WARNING) {
+			c.logger.Warn("control", "Ignoring unknown control event", fields)
+		}
+		c.metrics.Increment("control.event.unknown")
+		return
+	}
+	if err := handler(event); err != nil {
+		fields["error"] = err.Error()
+		if c.logger.ShouldLog(ERROR) {
+			c.logger.Error("control", "Failed to apply control event", fields)
+		}
+		c.metrics.Increment("control.event.error")
+		return
+	}
+	// Logged at WARNING, so that the audit log is not suppressed by brownout.
+	if c.logger.ShouldLog(WARNING) {
+		c.logger.Warn("control", "Applied control event", fields)
+	}
+	c.metrics.Increment("control.event.applied")
+	c.appliedMux.Lock()
+	c.history = append(c.history, event)
+	if len(c.history) > c.maxHistory {
+		c.history = c.history[len(c.history)-c.maxHistory:]
+	}
+	c.appliedMux.Unlock()
+}
+
+// History returns the most recently applied events, oldest first.
+func (c *ControlPlane) History() []ControlEvent {
+	c.appliedMux.Lock()
+	defer c.appliedMux.Unlock()
+	history := make([]ControlEvent, len(c.history))
+	copy(history, c.history)
+	return history
+}
+
+// maintenance enables or disables maintenance mode.
+func (c *ControlPlane) maintenance(event ControlEvent) error {
+	enabled, err := strconv.ParseBool(event.Args["enabled"])
+	if err != nil {
+		return fmt.Errorf("Invalid 'enabled' argument: %q", event.Args["enabled"])
+	}
+	var changed bool
+	if enabled {
+		reason := event.Args["reason"]
+		if len(reason) == 0 {
+			reason = "maintenance"
+		}
+		changed = c.app.Brownout().Enable(reason)
+	} else {
+		changed = c.app.Brownout().Disable()
+	}
+	if changed {
+		c.app.logBrownout()
+	}
+	return nil
+}
+
+// refreshTenants fetches the dynamic tenant settings.
+func (c *ControlPlane) refreshTenants(event ControlEvent) error {
+	tenants := c.app.Tenants()
+	if tenants == nil {
+		return nil
+	}
+	return tenants.Refresh()
+}
+
+// disconnect closes a device's connection, if the device is connected to
+// this node.
+func (c *ControlPlane) disconnect(event ControlEvent) error {
+	uaid := event.Args["uaid"]
+	if !id.Valid(uaid) {
+		return fmt.Errorf("Invalid 'uaid' argument: %q", uaid)
+	}
+	if worker, ok := c.app.GetWorker(uaid); ok {
+		worker.Close()
+	}
+	return nil
+}
+
+// invalidateAPIKey drops an API key from the local cache, so that the key is
+// fetched again from the store.
+func (c *ControlPlane) invalidateAPIKey(event ControlEvent) error {
+	keyID := event.Args["id"]
+	if len(keyID) == 0 {
+		return fmt.Errorf("Missing 'id' argument")
+	}
+	if kh, ok := c.app.EndpointHandler().(APIKeyHandler); ok {
+		kh.APIKeys().invalidate(keyID)
+	}
+	return nil
+}
+
+func (c *ControlPlane) Close() error {
+	return c.closeOnce.Do(c.close)
+}
+
+func (c *ControlPlane) close() error {
+	close(c.closeSignal)
+	c.closeWait.Wait()
+	return nil
+}
+
+type eventsByTime []ControlEvent
+
+func (e eventsByTime) Len() int      { return len(e) }
+func (e eventsByTime) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e eventsByTime) Less(i, j int) bool {
+	if e[i].Time != e[j].Time {
+		return e[i].Time < e[j].Time
+	}
+	if e[i].Nanos != e[j].Nanos {
+		return e[i].Nanos < e[j].Nanos
+	}
+	return e[i].ID < e[j].ID
+}
@@ -0,0 +1,128 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// memoryLocator is a Locator that keeps control events in memory.
+type memoryLocator struct {
+	events []ControlEvent
+}
+
+func (*memoryLocator) Close() error                      { return nil }
+func (*memoryLocator) Contacts(string) ([]string, error) { return nil, nil }
+func (*memoryLocator) Status() (bool, error)             { return true, nil }
+
+func (l *memoryLocator) PublishEvent(event ControlEvent) error {
+	l.events = append(l.events, event)
+	return nil
+}
+
+func (l *memoryLocator) FetchEvents() ([]ControlEvent, error) {
+	events := make([]ControlEvent, len(l.events))
+	copy(events, l.events)
+	return events, nil
+}
+
+func TestControlPlane(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	defer saveTimeFuncs()()
+	var now time.Time
+	timeNow = func() time.Time { return now }
+
+	Convey("Control events", t, func() {
+		now = time.Unix(1257894000, 0)
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		locator := &memoryLocator{events: []ControlEvent{
+			{ID: "2", Type: ControlMaintenance, Time: 20,
+				Args: map[string]string{"enabled": "false"}},
+			{ID: "1", Type: ControlMaintenance, Time: 10,
+				Args: map[string]string{"enabled": "true"}},
+		}}
+		app.SetLocator(locator)
+
+		c := NewControlPlane()
+		conf := c.ConfigStruct().(*ControlConfig)
+		conf.Enabled = true
+		conf.Interval = "1h"
+		mckStat.EXPECT().Increment("control.event.applied").Times(2)
+		So(c.Init(app, conf), ShouldBeNil)
+		defer c.Close()
+		So(app.ControlPlane(), ShouldEqual, c)
+
+		Convey("Should apply existing events in order", func() {
+			So(app.Brownout().Active(), ShouldBeFalse)
+			history := c.History()
+			So(history, ShouldHaveLength, 2)
+			So(history[0].ID, ShouldEqual, "1")
+		})
+
+		Convey("Should apply published events once", func() {
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("control.publish.success"),
+				mckStat.EXPECT().Increment("control.event.applied"),
+			)
+			event, err := c.Publish(ControlMaintenance, map[string]string{
+				"enabled": "true", "reason": "upgrade"})
+			So(err, ShouldBeNil)
+			So(event.Origin, ShouldEqual, app.Hostname())
+			So(app.Brownout().Active(), ShouldBeTrue)
+			So(app.Brownout().Status().Reason, ShouldEqual, "upgrade")
+
+			now = now.Add(time.Second)
+			So(c.Poll(), ShouldBeNil)
+			So(c.History(), ShouldHaveLength, 3)
+		})
+
+		Convey("Should forget expired events", func() {
+			locator.events = nil
+			now = now.Add(time.Second)
+			So(c.Poll(), ShouldBeNil)
+			So(c.applied, ShouldBeEmpty)
+		})
+
+		Convey("Should order events published in the same second", func() {
+			mckStat.EXPECT().Increment("control.event.applied").Times(2)
+			locator.events = append(locator.events,
+				ControlEvent{ID: "5", Type: ControlMaintenance, Time: 50,
+					Nanos: 50000000002, Args: map[string]string{"enabled": "false"}},
+				ControlEvent{ID: "6", Type: ControlMaintenance, Time: 50,
+					Nanos: 50000000001, Args: map[string]string{"enabled": "true"}})
+			So(c.Poll(), ShouldBeNil)
+			So(app.Brownout().Active(), ShouldBeFalse)
+			history := c.History()
+			So(history, ShouldHaveLength, 4)
+			So(history[2].ID, ShouldEqual, "6")
+		})
+
+		Convey("Should count unknown and invalid events", func() {
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("control.event.unknown"),
+				mckStat.EXPECT().Increment("control.event.error"),
+			)
+			locator.events = append(locator.events,
+				ControlEvent{ID: "3", Type: "unknown", Time: 30},
+				ControlEvent{ID: "4", Type: ControlMaintenance, Time: 40})
+			So(c.Poll(), ShouldBeNil)
+			So(c.History(), ShouldHaveLength, 2)
+		})
+	})
+}
@@ -0,0 +1,286 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClientBanned   = errors.New("Client temporarily banned")
+	ErrInvalidDSN     = errors.New("Invalid Sentry DSN")
+	ErrSentryRejected = errors.New("Sentry rejected crash report")
+)
+
+// CrashReport describes a panic recovered while handling a client
+// connection.
+type CrashReport struct {
+	Time      int64  `json:"time"` // Seconds since Epoch.
+	RequestID string `json:"rid"`
+	UAID      string `json:"uaid,omitempty"`
+	Command   string `json:"cmd,omitempty"`
+	Addr      string `json:"addr,omitempty"`
+	Error     string `json:"error"`
+	Stack     string `json:"stack"`
+}
+
+// Fields returns the crash report as log fields.
+func (r *CrashReport) Fields() LogFields {
+	return LogFields{
+		"rid":   r.RequestID,
+		"uaid":  r.UAID,
+		"cmd":   r.Command,
+		"addr":  r.Addr,
+		"error": r.Error,
+		"stack": r.Stack,
+	}
+}
+
+// CrashNotifier sends crash reports to an external error tracker.
+type CrashNotifier interface {
+	Notify(report *CrashReport) error
+}
+
+type CrashPolicyConfig struct {
+	Enabled bool
+
+	// MaxCrashes is the number of crashes allowed for a client IP within the
+	// window before the IP is banned. Set to 0 to disable bans.
+	MaxCrashes int `toml:"max_crashes" env:"max_crashes"`
+
+	// Window is the period over which crashes are counted.
+	Window string
+
+	// BanPeriod is how long a banned IP is refused new connections.
+	BanPeriod string `toml:"ban_period" env:"ban_period"`
+
+	// SentryDSN is the Sentry project DSN. Crash reports are not sent to
+	// Sentry if unset.
+	SentryDSN string `toml:"sentry_dsn" env:"sentry_dsn"`
+}
+
+// CrashPolicy enforces a crash budget for each client IP. Clients that
+// repeatedly trigger panics, whether maliciously or due to a bug, are banned
+// temporarily instead of being allowed to reconnect and crash again.
+type CrashPolicy struct {
+	logger     *SimpleLogger
+	metrics    Statistician
+	notifier   CrashNotifier
+	brownout   *Brownout
+	maxCrashes int
+	window     time.Duration
+	banPeriod  time.Duration
+	clientsMux sync.Mutex
+	clients    map[string]*crashBudget
+}
+
+// crashBudget tracks crashes for a client IP.
+type crashBudget struct {
+	crashes     int
+	windowStart time.Time
+	bannedUntil time.Time
+}
+
+// NewCrashPolicy creates a crash policy from conf.
+func NewCrashPolicy(app *Application, conf CrashPolicyConfig) (
+	p *CrashPolicy, err error) {
+
+	p = &CrashPolicy{
+		logger:     app.Logger(),
+		metrics:    app.Metrics(),
+		brownout:   app.Brownout(),
+		maxCrashes: conf.MaxCrashes,
+		clients:    make(map[string]*crashBudget),
+	}
+	if p.window, err = time.ParseDuration(conf.Window); err != nil {
+		return nil, err
+	}
+	if p.banPeriod, err = time.ParseDuration(conf.BanPeriod); err != nil {
+		return nil, err
+	}
+	if len(conf.SentryDSN) > 0 {
+		if p.notifier, err = NewSentryNotifier(conf.SentryDSN,
+			app.Hostname()); err != nil {
+
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Record charges a crash to the client that caused it, and sends the report
+// to the crash notifier, if any. Reports are not sent in brownout mode.
+// Returns true if the client is now banned.
+func (p *CrashPolicy) Record(report *CrashReport) (banned bool) {
+	if p.notifier != nil && !p.brownout.Active() {
+		go p.notify(report)
+	}
+	host := hostOf(report.Addr)
+	if p.maxCrashes <= 0 || len(host) == 0 {
+		return false
+	}
+	now := timeNow()
+	p.clientsMux.Lock()
+	defer p.clientsMux.Unlock()
+	p.prune(now)
+	budget, ok := p.clients[host]
+	if !ok || now.Sub(budget.windowStart) >= p.window {
+		budget = &crashBudget{windowStart: now}
+		p.clients[host] = budget
+	}
+	budget.crashes++
+	if budget.crashes < p.maxCrashes {
+		return false
+	}
+	budget.bannedUntil = now.Add(p.banPeriod)
+	if p.logger.ShouldLog(WARNING) {
+		p.logger.Warn("crash", "Client exceeded crash budget; banning", LogFields{
+			"addr":    host,
+			"crashes": strconv.Itoa(budget.crashes),
+			"until":   budget.bannedUntil.UTC().Format(time.RFC3339)})
+	}
+	p.metrics.Increment("client.banned")
+	return true
+}
+
+// Banned indicates whether the client at addr is banned.
+func (p *CrashPolicy) Banned(addr string) bool {
+	host := hostOf(addr)
+	if len(host) == 0 {
+		return false
+	}
+	p.clientsMux.Lock()
+	budget, ok := p.clients[host]
+	banned := ok && timeNow().Before(budget.bannedUntil)
+	p.clientsMux.Unlock()
+	return banned
+}
+
+// prune removes expired crash budgets. The caller must hold the clients
+// lock.
+func (p *CrashPolicy) prune(now time.Time) {
+	for host, budget := range p.clients {
+		if now.Sub(budget.windowStart) >= p.window &&
+			!now.Before(budget.bannedUntil) {
+
+			delete(p.clients, host)
+		}
+	}
+}
+
+func (p *CrashPolicy) notify(report *CrashReport) {
+	if err := p.notifier.Notify(report); err != nil &&
+		p.logger.ShouldLog(WARNING) {
+
+		p.logger.Warn("crash", "Could not send crash report",
+			LogFields{"rid": report.RequestID, "error": err.Error()})
+	}
+}
+
+// SentryNotifier sends crash reports to Sentry, using the HTTP store API.
+type SentryNotifier struct {
+	storeURL   string
+	publicKey  string
+	secretKey  string
+	serverName string
+	client     *http.Client
+}
+
+// NewSentryNotifier creates a Sentry notifier for the given project DSN, of
+// the form "{scheme}://{public}:{secret}@{host}/{path}/{project}".
+func NewSentryNotifier(dsn, serverName string) (*SentryNotifier, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || len(u.Host) == 0 {
+		return nil, ErrInvalidDSN
+	}
+	secretKey, _ := u.User.Password()
+	slash := strings.LastIndex(u.Path, "/")
+	if slash < 0 || slash == len(u.Path)-1 {
+		return nil, ErrInvalidDSN
+	}
+	storeURL := fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host,
+		u.Path[:slash], u.Path[slash+1:])
+	return &SentryNotifier{
+		storeURL:   storeURL,
+		publicKey:  u.User.Username(),
+		secretKey:  secretKey,
+		serverName: serverName,
+		client:     &http.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+// sentryEvent is a Sentry event payload.
+type sentryEvent struct {
+	EventID    string       `json:"event_id"`
+	Message    string       `json:"message"`
+	Timestamp  string       `json:"timestamp"`
+	Level      string       `json:"level"`
+	Logger     string       `json:"logger"`
+	Platform   string       `json:"platform"`
+	Culprit    string       `json:"culprit"`
+	ServerName string       `json:"server_name"`
+	Extra      *CrashReport `json:"extra"`
+}
+
+// Notify implements CrashNotifier.Notify.
+func (n *SentryNotifier) Notify(report *CrashReport) error {
+	eventID, err := idGenerate()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(&sentryEvent{
+		EventID:    eventID,
+		Message:    report.Error,
+		Timestamp:  time.Unix(report.Time, 0).UTC().Format("2006-01-02T15:04:05"),
+		Level:      "error",
+		Logger:     "worker",
+		Platform:   "go",
+		Culprit:    report.Command,
+		ServerName: n.serverName,
+		Extra:      report,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", n.storeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=5, "+
+		"sentry_client=pushgo/%s, sentry_timestamp=%d, sentry_key=%s, "+
+		"sentry_secret=%s", VERSION, timeNow().Unix(), n.publicKey, n.secretKey))
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ErrSentryRejected
+	}
+	return nil
+}
+
+// hostOf returns the host portion of a remote address.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,85 @@
+// +build fips
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/base64"
+
+	// Restricts TLS to FIPS-approved settings. Requires a Go toolchain built
+	// with BoringCrypto, which also routes the crypto/aes, crypto/hmac, and
+	// crypto/sha256 primitives below through the validated module.
+	_ "crypto/tls/fipsonly"
+)
+
+// fipsMinKeyLen is the minimum key length, in bytes, accepted in FIPS mode.
+// NIST SP 800-107 requires at least 112 bits of security for HMAC keys; AES
+// keys are 128 bits or longer.
+const fipsMinKeyLen = 16
+
+func init() {
+	cryptoProvider = FIPSCrypto{}
+}
+
+// FIPSCrypto implements CryptoProvider with FIPS-approved algorithms only.
+// Endpoint tokens are encrypted with AES-GCM instead of unauthenticated
+// AES-CTR, so tokens issued by a standard build cannot be decrypted by a FIPS
+// build.
+type FIPSCrypto struct {
+	StdCrypto
+}
+
+// Name implements CryptoProvider.Name.
+func (FIPSCrypto) Name() string { return "fips" }
+
+// FIPS implements CryptoProvider.FIPS.
+func (FIPSCrypto) FIPS() bool { return true }
+
+// CheckKey implements CryptoProvider.CheckKey.
+func (FIPSCrypto) CheckKey(key []byte) error {
+	if len(key) < fipsMinKeyLen {
+		return ErrWeakKey
+	}
+	return nil
+}
+
+// EncryptToken implements CryptoProvider.EncryptToken.
+func (c FIPSCrypto) EncryptToken(key, value []byte) (string, error) {
+	if len(key) == 0 {
+		return string(value), nil
+	}
+	if len(value) == 0 {
+		return "", nil
+	}
+	aead, err := c.NewAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(aead, value)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptToken implements CryptoProvider.DecryptToken.
+func (c FIPSCrypto) DecryptToken(key []byte, token string) ([]byte, error) {
+	if len(token) == 0 {
+		return nil, nil
+	}
+	if len(key) == 0 {
+		return []byte(token), nil
+	}
+	sealed, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, sealed)
+}
@@ -0,0 +1,90 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"hash"
+)
+
+var ErrWeakKey = errors.New("Key too short for the configured crypto provider")
+
+// CryptoProvider supplies the primitives used to encrypt endpoint tokens,
+// encrypt records at rest, and sign routing requests. The provider is
+// selected at build time: building with the "fips" tag restricts the server
+// to FIPS 140-2 approved algorithms and a validated module.
+type CryptoProvider interface {
+	// Name returns the provider name, reported by the health check.
+	Name() string
+
+	// FIPS indicates whether the provider runs in FIPS mode.
+	FIPS() bool
+
+	// CheckKey returns an error if key is unsuitable for use with the
+	// provider.
+	CheckKey(key []byte) error
+
+	// EncryptToken encrypts an endpoint token.
+	EncryptToken(key, value []byte) (string, error)
+
+	// DecryptToken decrypts a token returned by EncryptToken.
+	DecryptToken(key []byte, token string) ([]byte, error)
+
+	// NewAEAD returns an authenticated cipher for the given key.
+	NewAEAD(key []byte) (cipher.AEAD, error)
+
+	// NewMAC returns a keyed hash for the given key.
+	NewMAC(key []byte) hash.Hash
+}
+
+// cryptoProvider is the active provider. It is set by crypto_std.go or
+// crypto_fips.go, depending on the build tags.
+var cryptoProvider CryptoProvider
+
+// Crypto returns the crypto provider selected at build time.
+func Crypto() CryptoProvider {
+	return cryptoProvider
+}
+
+// StdCrypto implements CryptoProvider with the Go standard library: AES-CTR
+// endpoint tokens, AES-GCM records, and HMAC-SHA256 signatures.
+type StdCrypto struct{}
+
+// Name implements CryptoProvider.Name.
+func (StdCrypto) Name() string { return "std" }
+
+// FIPS implements CryptoProvider.FIPS.
+func (StdCrypto) FIPS() bool { return false }
+
+// CheckKey implements CryptoProvider.CheckKey.
+func (StdCrypto) CheckKey(key []byte) error { return nil }
+
+// EncryptToken implements CryptoProvider.EncryptToken.
+func (StdCrypto) EncryptToken(key, value []byte) (string, error) {
+	return Encode(key, value)
+}
+
+// DecryptToken implements CryptoProvider.DecryptToken.
+func (StdCrypto) DecryptToken(key []byte, token string) ([]byte, error) {
+	return Decode(key, token)
+}
+
+// NewAEAD implements CryptoProvider.NewAEAD.
+func (StdCrypto) NewAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewMAC implements CryptoProvider.NewMAC.
+func (StdCrypto) NewMAC(key []byte) hash.Hash {
+	return hmac.New(sha256.New, key)
+}
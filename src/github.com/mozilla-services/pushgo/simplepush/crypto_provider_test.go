@@ -0,0 +1,64 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCryptoProvider(t *testing.T) {
+	Convey("Crypto provider", t, func() {
+		provider := Crypto()
+		So(provider, ShouldNotBeNil)
+		key := []byte("0123456789abcdef0123456789abcdef")
+
+		Convey("Should encrypt and decrypt endpoint tokens", func() {
+			pk := "6a4f5b0e1c2d4e3f8a9b0c1d2e3f4a5b.1"
+			token, err := provider.EncryptToken(key, []byte(pk))
+			So(err, ShouldBeNil)
+			So(token, ShouldNotEqual, pk)
+			value, err := provider.DecryptToken(key, token)
+			So(err, ShouldBeNil)
+			So(string(value), ShouldEqual, pk)
+		})
+
+		Convey("Should pass tokens through without a key", func() {
+			token, err := provider.EncryptToken(nil, []byte("abc.123"))
+			So(err, ShouldBeNil)
+			So(token, ShouldEqual, "abc.123")
+			value, err := provider.DecryptToken(nil, token)
+			So(err, ShouldBeNil)
+			So(string(value), ShouldEqual, "abc.123")
+		})
+
+		Convey("Should create authenticated ciphers and MACs", func() {
+			aead, err := provider.NewAEAD(key)
+			So(err, ShouldBeNil)
+			sealed, err := seal(aead, []byte("ping"))
+			So(err, ShouldBeNil)
+			opened, err := open(aead, sealed)
+			So(err, ShouldBeNil)
+			So(string(opened), ShouldEqual, "ping")
+
+			mac := provider.NewMAC(key)
+			mac.Write([]byte("ping"))
+			So(mac.Sum(nil), ShouldHaveLength, 32)
+		})
+
+		Convey("Should accept 256-bit keys", func() {
+			So(provider.CheckKey(key), ShouldBeNil)
+		})
+
+		Convey("Should report FIPS mode in the provider name", func() {
+			if provider.FIPS() {
+				So(provider.Name(), ShouldEqual, "fips")
+			} else {
+				So(provider.Name(), ShouldEqual, "std")
+			}
+		})
+	})
+}
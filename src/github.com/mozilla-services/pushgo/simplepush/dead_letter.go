@@ -0,0 +1,75 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+)
+
+var (
+	ErrNoDeadLetter      = errors.New("Dead letter not found")
+	ErrNoDeadLetterStore = errors.New("Storage does not support dead letters")
+)
+
+// DeadLetter records an update that the endpoint accepted but could not
+// persist. Dead letters can be inspected and replayed via the admin API.
+type DeadLetter struct {
+	ID        string `json:"id"`
+	UAID      string `json:"uaid"`
+	ChannelID string `json:"channelID"`
+	Version   int64  `json:"version"`
+	Data      string `json:"data,omitempty"`
+	Reason    string `json:"reason"`
+	FailedAt  int64  `json:"failedAt"` // Seconds since Epoch.
+	Attempts  int    `json:"attempts"`
+}
+
+// DeadLetterStore is an optional interface implemented by storage adapters
+// that can hold failed updates. The endpoint handler only dead-letters
+// updates if the configured Store satisfies this interface.
+type DeadLetterStore interface {
+	// PutDeadLetter appends a failed update to the queue.
+	PutDeadLetter(letter *DeadLetter) error
+
+	// FetchDeadLetters returns up to limit queued updates, oldest first. A
+	// limit <= 0 returns all queued updates.
+	FetchDeadLetters(limit int) ([]*DeadLetter, error)
+
+	// FetchDeadLetter returns the queued update with the given ID, or
+	// ErrNoDeadLetter if the update does not exist.
+	FetchDeadLetter(id string) (*DeadLetter, error)
+
+	// DropDeadLetter removes a queued update.
+	DropDeadLetter(id string) error
+}
+
+// Replayer is an optional interface implemented by update handlers that can
+// redeliver dead letters.
+type Replayer interface {
+	// Replay stores and delivers a dead letter. The caller is responsible for
+	// removing the letter from the queue if Replay succeeds.
+	Replay(letter *DeadLetter) error
+}
+
+// newDeadLetter creates a dead letter for the given update.
+func newDeadLetter(uaid, chid string, version int64, data string,
+	reason error, attempts int) (letter *DeadLetter, err error) {
+
+	letterID, err := idGenerate()
+	if err != nil {
+		return nil, err
+	}
+	letter = &DeadLetter{
+		ID:        letterID,
+		UAID:      uaid,
+		ChannelID: chid,
+		Version:   version,
+		Data:      data,
+		Reason:    ErrStr(reason),
+		FailedAt:  timeNow().UTC().Unix(),
+		Attempts:  attempts,
+	}
+	return letter, nil
+}
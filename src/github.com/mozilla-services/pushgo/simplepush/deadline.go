@@ -0,0 +1,175 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Deadline bounds the time spent handling a request, including store writes,
+// retries, and routing. A Deadline expires when its timeout elapses, or when
+// the client closes the connection. Implements http.CloseNotifier and
+// retry.CloseNotifier, so that it can be passed to the retry helper and the
+// router as a cancellation signal. A nil Deadline never expires.
+type Deadline struct {
+	calls      *CallLimiter
+	timer      Timer
+	expired    chan bool
+	expireOnce sync.Once
+	timedOut   bool
+	stopped    chan bool
+	stopOnce   sync.Once
+}
+
+// NewDeadline returns a deadline that expires after timeout, or when cn is
+// closed. Calls made through Do count against calls. cn and calls may be
+// nil.
+func NewDeadline(timeout time.Duration, cn http.CloseNotifier,
+	calls *CallLimiter) *Deadline {
+
+	d := &Deadline{
+		calls:   calls,
+		expired: make(chan bool),
+		stopped: make(chan bool),
+	}
+	d.timer = clock.AfterFunc(timeout, func() { d.expire(true) })
+	if cn != nil {
+		closeSignal := cn.CloseNotify()
+		go func() {
+			select {
+			case <-closeSignal:
+				d.expire(false)
+			case <-d.stopped:
+			}
+		}()
+	}
+	return d
+}
+
+func (d *Deadline) expire(timedOut bool) {
+	d.expireOnce.Do(func() {
+		d.timedOut = timedOut
+		close(d.expired)
+	})
+}
+
+// CloseNotify returns a channel that is closed when the deadline expires.
+func (d *Deadline) CloseNotify() <-chan bool {
+	if d == nil {
+		return nil
+	}
+	return d.expired
+}
+
+// Expired indicates whether the deadline has expired.
+func (d *Deadline) Expired() bool {
+	if d == nil {
+		return false
+	}
+	select {
+	case <-d.expired:
+		return true
+	default:
+	}
+	return false
+}
+
+// TimedOut indicates whether the deadline expired because its timeout
+// elapsed, rather than because the client went away.
+func (d *Deadline) TimedOut() bool {
+	return d.Expired() && d.timedOut
+}
+
+// Do calls f, returning ErrDeadlineExceeded if the deadline expires before f
+// returns. This keeps a stuck storage node from holding the request open.
+//
+// f can't be interrupted: the store interfaces don't accept a cancellation
+// signal. If the deadline expires first, f keeps running in its goroutine
+// until the store call returns, and its result is discarded. Each abandoned
+// call holds one goroutine, and one of the deadline's call slots, for as
+// long as the store blocks it; if all slots are held, Do waits for a free
+// slot until the deadline expires. Callers must not assume that f had no
+// effect: an abandoned update may still be written, and variables assigned
+// by f must not be read unless Do returns f's result. f is not called if the
+// deadline has already expired.
+func (d *Deadline) Do(f func() error) error {
+	if d == nil {
+		return f()
+	}
+	if d.Expired() || !d.calls.acquire(d.expired) {
+		return ErrDeadlineExceeded
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		defer d.calls.release()
+		errChan <- f()
+	}()
+	select {
+	case err := <-errChan:
+		return err
+	case <-d.expired:
+		return ErrDeadlineExceeded
+	}
+}
+
+// Stop releases the deadline's timer. Stop does not expire the deadline.
+func (d *Deadline) Stop() {
+	if d == nil {
+		return
+	}
+	d.stopOnce.Do(func() {
+		d.timer.Stop()
+		close(d.stopped)
+	})
+}
+
+// CallLimiter bounds the number of calls made through Deadline.Do that are
+// still running, including calls abandoned at their deadline, so that an
+// unresponsive store can't accumulate goroutines without bound. A nil
+// CallLimiter allows any number of calls.
+type CallLimiter struct {
+	slots chan bool
+}
+
+// NewCallLimiter returns a limiter that allows up to max running calls, or
+// nil if max is not positive.
+func NewCallLimiter(max int) *CallLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &CallLimiter{slots: make(chan bool, max)}
+}
+
+// acquire waits for a free call slot. Returns false if expired is closed
+// first.
+func (l *CallLimiter) acquire(expired <-chan bool) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- true:
+		return true
+	case <-expired:
+	}
+	return false
+}
+
+// release frees a slot taken by acquire.
+func (l *CallLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// Running returns the number of calls holding a slot.
+func (l *CallLimiter) Running() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.slots)
+}
@@ -0,0 +1,185 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testCloseNotifier is an http.CloseNotifier closed by the test.
+type testCloseNotifier chan bool
+
+func (cn testCloseNotifier) CloseNotify() <-chan bool { return cn }
+
+// testStuckStore wraps a Store with an Update method that blocks until
+// released, simulating an unresponsive storage node.
+type testStuckStore struct {
+	Store
+	release chan bool
+}
+
+func (s *testStuckStore) Update(uaid, chid string, version int64) error {
+	<-s.release
+	return nil
+}
+
+func TestDeadline(t *testing.T) {
+	Convey("Request deadlines", t, func() {
+		Convey("Should return results before the deadline", func() {
+			d := NewDeadline(1*time.Minute, nil, nil)
+			defer d.Stop()
+			errFail := errors.New("failed")
+			So(d.Do(func() error { return errFail }), ShouldEqual, errFail)
+			So(d.Expired(), ShouldBeFalse)
+		})
+
+		Convey("Should abandon calls that exceed the deadline", func() {
+			d := NewDeadline(10*time.Millisecond, nil, nil)
+			defer d.Stop()
+			release := make(chan bool)
+			defer close(release)
+			err := d.Do(func() error {
+				<-release
+				return nil
+			})
+			So(err, ShouldEqual, ErrDeadlineExceeded)
+			So(d.Expired(), ShouldBeTrue)
+			So(d.TimedOut(), ShouldBeTrue)
+		})
+
+		Convey("Should limit running calls", func() {
+			calls := NewCallLimiter(1)
+			release := make(chan bool)
+			d := NewDeadline(10*time.Millisecond, nil, calls)
+			defer d.Stop()
+			err := d.Do(func() error {
+				<-release
+				return nil
+			})
+			So(err, ShouldEqual, ErrDeadlineExceeded)
+			So(calls.Running(), ShouldEqual, 1)
+
+			// The abandoned call holds the only slot.
+			d = NewDeadline(10*time.Millisecond, nil, calls)
+			defer d.Stop()
+			called := false
+			err = d.Do(func() error {
+				called = true
+				return nil
+			})
+			So(err, ShouldEqual, ErrDeadlineExceeded)
+			So(called, ShouldBeFalse)
+
+			// Calls wait for the slot to be released.
+			d = NewDeadline(1*time.Minute, nil, calls)
+			defer d.Stop()
+			close(release)
+			So(d.Do(func() error { return nil }), ShouldBeNil)
+			So(NewCallLimiter(0), ShouldBeNil)
+		})
+
+		Convey("Should not start calls after the deadline expires", func() {
+			cn := make(testCloseNotifier)
+			d := NewDeadline(1*time.Minute, cn, nil)
+			defer d.Stop()
+			close(cn)
+			<-d.CloseNotify()
+			called := false
+			err := d.Do(func() error {
+				called = true
+				return nil
+			})
+			So(err, ShouldEqual, ErrDeadlineExceeded)
+			So(called, ShouldBeFalse)
+		})
+
+		Convey("Should expire when the clock passes the timeout", func() {
+			defer saveTimeFuncs()()
+			c := newMockClock(time.Unix(1257894000, 0).UTC())
+			useMockClock(c)
+
+			d := NewDeadline(1*time.Minute, nil, nil)
+			defer d.Stop()
+			c.Advance(59 * time.Second)
+			So(d.Expired(), ShouldBeFalse)
+			// Backward jumps should not expire the deadline.
+			c.Set(time.Unix(1257890000, 0).UTC())
+			So(d.Expired(), ShouldBeFalse)
+			c.Advance(2 * time.Hour)
+			So(d.Expired(), ShouldBeTrue)
+			So(d.TimedOut(), ShouldBeTrue)
+		})
+
+		Convey("Should expire when the client goes away", func() {
+			cn := make(testCloseNotifier)
+			d := NewDeadline(1*time.Minute, cn, nil)
+			defer d.Stop()
+			close(cn)
+			<-d.CloseNotify()
+			So(d.Expired(), ShouldBeTrue)
+			So(d.TimedOut(), ShouldBeFalse)
+		})
+
+		Convey("Should never expire if nil", func() {
+			var d *Deadline
+			So(d.Do(func() error { return nil }), ShouldBeNil)
+			So(d.Expired(), ShouldBeFalse)
+			So(d.CloseNotify(), ShouldBeNil)
+			d.Stop()
+		})
+	})
+}
+
+func TestEndpointDeadline(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+
+	Convey("Endpoint request deadlines", t, func() {
+		store := &testStuckStore{mckStore, make(chan bool)}
+		defer close(store.release)
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(store)
+
+		eh := NewEndpointHandler()
+		eh.setApp(app)
+		eh.timeout = 10 * time.Millisecond
+		app.SetEndpointHandler(eh)
+
+		Convey("Should reject updates if the store is unresponsive", func() {
+			resp := httptest.NewRecorder()
+			req := &http.Request{
+				Method: "PUT",
+				Header: http.Header{},
+				URL:    &url.URL{Path: "/update/123"},
+				Body:   formReader(url.Values{"version": {"3"}}),
+			}
+			gomock.InOrder(
+				mckStore.EXPECT().KeyToIDs("123").Return("123", "456", nil),
+				mckStat.EXPECT().Increment("updates.appserver.incoming"),
+				mckStat.EXPECT().Increment("updates.appserver.timeout"),
+			)
+			eh.ServeMux().ServeHTTP(resp, req)
+
+			So(resp.Code, ShouldEqual, ErrDeadlineExceeded.Status())
+		})
+	})
+}
@@ -0,0 +1,102 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sync"
+	"time"
+)
+
+type DedupeConfig struct {
+	Enabled bool
+
+	// Window is how long a delivered update version is remembered.
+	Window string
+}
+
+// DedupePolicy holds the deduplication window shared by all connections.
+type DedupePolicy struct {
+	window time.Duration
+}
+
+// NewDedupePolicy creates a deduplication policy from conf.
+func NewDedupePolicy(conf DedupeConfig) (p *DedupePolicy, err error) {
+	p = new(DedupePolicy)
+	if p.window, err = time.ParseDuration(conf.Window); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Filter returns a new delivery filter for a connection. Returns nil if p is
+// nil.
+func (p *DedupePolicy) Filter() *DeliveryFilter {
+	if p == nil {
+		return nil
+	}
+	return &DeliveryFilter{
+		window:    p.window,
+		delivered: make(map[string]deliveredVersion),
+	}
+}
+
+// deliveredVersion is the last update version delivered for a channel.
+type deliveredVersion struct {
+	version uint64
+	sentAt  time.Time
+}
+
+// DeliveryFilter suppresses duplicate deliveries of the same channel version
+// to a connection. With broadcast routing, a client that connects while an
+// update is being routed may receive the update from both the pending update
+// flush and a routed frame. A nil DeliveryFilter allows all updates.
+type DeliveryFilter struct {
+	window    time.Duration
+	filterMux sync.Mutex
+	delivered map[string]deliveredVersion // By channel ID.
+}
+
+// Allow indicates whether an update should be delivered, and records it as
+// delivered if so. Returns false if the same version was delivered within the
+// window.
+func (f *DeliveryFilter) Allow(chid string, version uint64) bool {
+	if f == nil {
+		return true
+	}
+	now := timeNow()
+	f.filterMux.Lock()
+	defer f.filterMux.Unlock()
+	return f.allow(now, chid, version)
+}
+
+// Updates filters a batch of pending updates, returning the updates that
+// should be delivered.
+func (f *DeliveryFilter) Updates(updates []Update) []Update {
+	if f == nil {
+		return updates
+	}
+	now := timeNow()
+	f.filterMux.Lock()
+	defer f.filterMux.Unlock()
+	allowed := updates[:0]
+	for _, update := range updates {
+		if f.allow(now, update.ChannelID, update.Version) {
+			allowed = append(allowed, update)
+		}
+	}
+	return allowed
+}
+
+// allow implements Allow. The caller must hold the filter lock.
+func (f *DeliveryFilter) allow(now time.Time, chid string,
+	version uint64) bool {
+
+	last, ok := f.delivered[chid]
+	if ok && last.version == version && now.Sub(last.sentAt) < f.window {
+		return false
+	}
+	f.delivered[chid] = deliveredVersion{version, now}
+	return true
+}
@@ -0,0 +1,58 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDeliveryFilter(t *testing.T) {
+	defer saveTimeFuncs()()
+	var now time.Time
+	timeNow = func() time.Time { return now }
+
+	Convey("Delivery deduplication", t, func() {
+		p, err := NewDedupePolicy(DedupeConfig{Enabled: true, Window: "1m"})
+		So(err, ShouldBeNil)
+		f := p.Filter()
+		now = time.Unix(1000, 0)
+
+		Convey("Should suppress routed updates already flushed", func() {
+			updates := f.Updates([]Update{
+				{ChannelID: "chid1", Version: 1},
+				{ChannelID: "chid2", Version: 3},
+			})
+			So(updates, ShouldHaveLength, 2)
+			So(f.Allow("chid2", 3), ShouldBeFalse)
+			So(f.Allow("chid2", 4), ShouldBeTrue)
+		})
+
+		Convey("Should suppress flushed updates already routed", func() {
+			So(f.Allow("chid1", 1), ShouldBeTrue)
+			updates := f.Updates([]Update{
+				{ChannelID: "chid1", Version: 1},
+				{ChannelID: "chid2", Version: 3},
+			})
+			So(updates, ShouldResemble, []Update{{ChannelID: "chid2", Version: 3}})
+		})
+
+		Convey("Should allow repeated versions after the window", func() {
+			So(f.Allow("chid1", 1), ShouldBeTrue)
+			now = now.Add(1 * time.Minute)
+			So(f.Allow("chid1", 1), ShouldBeTrue)
+		})
+
+		Convey("Should allow all updates if disabled", func() {
+			var f *DeliveryFilter
+			So(f.Allow("chid1", 1), ShouldBeTrue)
+			So(f.Allow("chid1", 1), ShouldBeTrue)
+			So(f.Updates([]Update{{ChannelID: "chid1", Version: 1}}),
+				ShouldHaveLength, 1)
+		})
+	})
+}
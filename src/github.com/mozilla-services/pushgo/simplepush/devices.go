@@ -0,0 +1,58 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"time"
+)
+
+// ConnectStore is an optional interface implemented by stores that record
+// when each device last completed a handshake.
+type ConnectStore interface {
+	// FetchLastConnect returns the time of the device's last handshake, or
+	// the zero time if unknown.
+	FetchLastConnect(suaid string) (t time.Time, err error)
+
+	// PutLastConnect records the time of the device's handshake.
+	PutLastConnect(suaid string, t time.Time) error
+}
+
+// DeviceInfo describes the stored state of a device, returned by the admin
+// API for debugging stuck clients.
+type DeviceInfo struct {
+	DeviceID  string `json:"uaid"`
+	Connected bool   `json:"connected"` // Connected to this node.
+
+	// LastConnect is the time of the device's last handshake, in
+	// milliseconds since Epoch; omitted if unknown.
+	LastConnect int64 `json:"lastConnect,omitempty"`
+
+	// Origin is the node that the device last connected to, if connection
+	// affinity is supported.
+	Origin string `json:"origin,omitempty"`
+
+	// Region is the device's region tag, if data residency is supported.
+	Region string `json:"region,omitempty"`
+
+	// Channels are the registered channels, if the store can list them.
+	Channels []ChannelInfo `json:"channels,omitempty"`
+
+	Pending []Update `json:"pending"` // Unacknowledged updates.
+	Expired []string `json:"expired"` // Unregistered channels.
+}
+
+// recordConnect stores the handshake time for the client's device.
+func (w *WorkerWS) recordConnect(uaid string) {
+	store, ok := w.store.(ConnectStore)
+	if !ok {
+		return
+	}
+	if err := store.PutLastConnect(uaid, timeNow()); err != nil {
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker", "Could not record handshake time",
+				LogFields{"rid": w.logID, "uaid": uaid, "error": ErrStr(err)})
+		}
+	}
+}
@@ -0,0 +1,219 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+type DozeConfig struct {
+	// Enabled accepts client hints in hello and ping messages, and defers
+	// low-priority updates for dozing clients.
+	Enabled bool
+
+	// MaxDefer is the longest that a low-priority update is held for a
+	// dozing client before it is sent anyway.
+	MaxDefer string `toml:"max_defer" env:"max_defer"`
+
+	// MaxPending is the number of updates held for each dozing client. Held
+	// updates are sent once the limit is reached.
+	MaxPending int `toml:"max_pending" env:"max_pending"`
+}
+
+// HeaderUrgency is the update urgency header sent by app servers: "very-low",
+// "low", "normal", or "high". Updates without an urgency are normal.
+const HeaderUrgency = "Urgency"
+
+// DeferredSender is an optional interface implemented by workers that can
+// hold low-priority updates for dozing clients.
+type DeferredSender interface {
+	// Defer holds the update if the client is dozing. Returns false if the
+	// update should be sent now.
+	Defer(chid string, version int64, data string) bool
+}
+
+// IsLowUrgency indicates whether an update with the given urgency may be
+// deferred for dozing clients.
+func IsLowUrgency(urgency string) bool {
+	switch strings.ToLower(strings.TrimSpace(urgency)) {
+	case "very-low", "low":
+		return true
+	}
+	return false
+}
+
+// hintPlatforms and hintBatteryLevels are the client hint values reported as
+// metrics. Other values are reported as "other" and "unknown", so that
+// clients can't create arbitrary metric names.
+var (
+	hintPlatforms = map[string]bool{
+		"firefoxos": true,
+		"android":   true,
+		"desktop":   true,
+	}
+	hintBatteryLevels = map[string]bool{
+		"critical": true,
+		"low":      true,
+		"medium":   true,
+		"high":     true,
+		"charging": true,
+	}
+)
+
+// normalize returns a copy of h with unrecognized values replaced.
+func (h ClientHints) normalize() ClientHints {
+	if h.Platform = strings.ToLower(h.Platform); !hintPlatforms[h.Platform] {
+		h.Platform = "other"
+	}
+	if h.Battery = strings.ToLower(h.Battery); !hintBatteryLevels[h.Battery] {
+		h.Battery = "unknown"
+	}
+	return h
+}
+
+// DozePolicy records client hint metrics, and holds the deferral limits
+// shared by all connections.
+type DozePolicy struct {
+	metrics    Statistician
+	maxDefer   time.Duration
+	maxPending int
+}
+
+// NewDozePolicy creates a doze policy from conf.
+func NewDozePolicy(app *Application, conf DozeConfig) (p *DozePolicy, err error) {
+	p = &DozePolicy{
+		metrics:    app.Metrics(),
+		maxPending: conf.MaxPending,
+	}
+	if p.maxDefer, err = time.ParseDuration(conf.MaxDefer); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Queue returns a new deferral queue for a connection. Returns nil if p is
+// nil.
+func (p *DozePolicy) Queue() *DozeQueue {
+	if p == nil {
+		return nil
+	}
+	return &DozeQueue{policy: p}
+}
+
+// DozeQueue tracks the hints sent by a connected client, and holds
+// low-priority updates while the client is dozing. Held updates are sent
+// with the next normal update, when the client stops dozing, or after the
+// maximum deferral time. Held updates are already stored, so they are
+// flushed again if the client reconnects. A nil DozeQueue never defers.
+type DozeQueue struct {
+	policy     *DozePolicy
+	pendingMux sync.Mutex
+	hints      *ClientHints // Normalized; nil if the client hasn't sent hints.
+	pending    []Update
+	dueAt      time.Time
+}
+
+// Observe records the client's hints. Returns the held updates if the
+// client stopped dozing.
+func (q *DozeQueue) Observe(hints *ClientHints) (due []Update) {
+	if q == nil || hints == nil {
+		return nil
+	}
+	current := hints.normalize()
+	q.pendingMux.Lock()
+	prev := q.hints
+	q.hints = &current
+	if !current.Doze {
+		due = q.release()
+	}
+	q.pendingMux.Unlock()
+	metrics := q.policy.metrics
+	if prev == nil || prev.Platform != current.Platform {
+		metrics.Increment("client.hints.platform." + current.Platform)
+	}
+	if prev == nil || prev.Battery != current.Battery {
+		metrics.Increment("client.hints.battery." + current.Battery)
+	}
+	if current.Doze && (prev == nil || !prev.Doze) {
+		metrics.Increment("client.hints.doze")
+	}
+	return due
+}
+
+// Defer holds a low-priority update if the client is dozing. Returns false
+// if the update should be sent now. If the queue is full, the held updates
+// are returned so that they can be sent with the update.
+func (q *DozeQueue) Defer(update Update) (deferred bool, due []Update) {
+	if q == nil {
+		return false, nil
+	}
+	q.pendingMux.Lock()
+	defer q.pendingMux.Unlock()
+	if q.hints == nil || !q.hints.Doze {
+		return false, nil
+	}
+	if q.policy.maxPending > 0 && len(q.pending) >= q.policy.maxPending {
+		return false, q.release()
+	}
+	for i, held := range q.pending {
+		if held.ChannelID == update.ChannelID {
+			// Only the latest version of a channel is sent.
+			q.pending[i] = update
+			return true, nil
+		}
+	}
+	if len(q.pending) == 0 {
+		q.dueAt = timeNow().Add(q.policy.maxDefer)
+	}
+	q.pending = append(q.pending, update)
+	q.policy.metrics.Increment("updates.client.deferred")
+	return true, nil
+}
+
+// Release returns and clears all held updates.
+func (q *DozeQueue) Release() []Update {
+	if q == nil {
+		return nil
+	}
+	q.pendingMux.Lock()
+	defer q.pendingMux.Unlock()
+	return q.release()
+}
+
+// Due returns and clears the held updates if the oldest was held for the
+// maximum deferral time as of now.
+func (q *DozeQueue) Due(now time.Time) []Update {
+	if q == nil {
+		return nil
+	}
+	q.pendingMux.Lock()
+	defer q.pendingMux.Unlock()
+	if len(q.pending) == 0 || now.Before(q.dueAt) {
+		return nil
+	}
+	return q.release()
+}
+
+// Deadline returns the time when the held updates should be sent, or the
+// zero value if no updates are held.
+func (q *DozeQueue) Deadline() time.Time {
+	if q == nil {
+		return time.Time{}
+	}
+	q.pendingMux.Lock()
+	defer q.pendingMux.Unlock()
+	if len(q.pending) == 0 {
+		return time.Time{}
+	}
+	return q.dueAt
+}
+
+func (q *DozeQueue) release() (due []Update) {
+	due, q.pending = q.pending, nil
+	q.dueAt = time.Time{}
+	return due
+}
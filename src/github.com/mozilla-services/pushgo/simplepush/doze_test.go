@@ -0,0 +1,134 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDozeQueue(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Doze-aware deferral", t, func() {
+		app := NewApplication()
+		app.SetMetrics(mckStat)
+		p, err := NewDozePolicy(app, DozeConfig{MaxDefer: "1m", MaxPending: 2})
+		So(err, ShouldBeNil)
+		q := p.Queue()
+
+		now := time.Now()
+		defer saveTimeFuncs()()
+		timeNow = func() time.Time { return now }
+
+		Convey("Should only defer updates for dozing clients", func() {
+			deferred, _ := q.Defer(Update{"a", 1, "", false})
+			So(deferred, ShouldBeFalse)
+
+			mckStat.EXPECT().Increment("client.hints.platform.android")
+			mckStat.EXPECT().Increment("client.hints.battery.high")
+			q.Observe(&ClientHints{Platform: "Android", Battery: "high"})
+			deferred, _ = q.Defer(Update{"a", 1, "", false})
+			So(deferred, ShouldBeFalse)
+		})
+
+		Convey("Should hold updates until the client wakes", func() {
+			mckStat.EXPECT().Increment("client.hints.platform.other")
+			mckStat.EXPECT().Increment("client.hints.battery.unknown")
+			mckStat.EXPECT().Increment("client.hints.doze")
+			So(q.Observe(&ClientHints{Platform: "toaster", Doze: true}), ShouldBeEmpty)
+
+			mckStat.EXPECT().Increment("updates.client.deferred")
+			deferred, _ := q.Defer(Update{"a", 1, "", false})
+			So(deferred, ShouldBeTrue)
+			// Newer versions replace held updates.
+			deferred, _ = q.Defer(Update{"a", 2, "", false})
+			So(deferred, ShouldBeTrue)
+			So(q.Deadline(), ShouldResemble, now.Add(1*time.Minute))
+
+			// Repeated hints are not counted again.
+			So(q.Observe(&ClientHints{Platform: "toaster", Doze: true}), ShouldBeEmpty)
+			So(q.Observe(&ClientHints{Platform: "toaster"}), ShouldResemble,
+				[]Update{{"a", 2, "", false}})
+			So(q.Deadline().IsZero(), ShouldBeTrue)
+		})
+
+		Convey("Should release held updates when full or due", func() {
+			mckStat.EXPECT().Increment(gomock.Any()).AnyTimes()
+			q.Observe(&ClientHints{Doze: true})
+			q.Defer(Update{"a", 1, "", false})
+			q.Defer(Update{"b", 1, "", false})
+			deferred, due := q.Defer(Update{"c", 1, "", false})
+			So(deferred, ShouldBeFalse)
+			So(due, ShouldHaveLength, 2)
+
+			q.Defer(Update{"d", 1, "", false})
+			So(q.Due(now.Add(30*time.Second)), ShouldBeEmpty)
+			So(q.Due(now.Add(1*time.Minute)), ShouldResemble, []Update{{"d", 1, "", false}})
+		})
+
+		Convey("Should never defer if disabled", func() {
+			var disabled *DozePolicy
+			q := disabled.Queue()
+			q.Observe(&ClientHints{Doze: true})
+			deferred, _ := q.Defer(Update{"a", 1, "", false})
+			So(deferred, ShouldBeFalse)
+			So(q.Release(), ShouldBeNil)
+		})
+
+		Convey("Should parse urgencies", func() {
+			So(IsLowUrgency("very-low"), ShouldBeTrue)
+			So(IsLowUrgency(" Low"), ShouldBeTrue)
+			So(IsLowUrgency("normal"), ShouldBeFalse)
+			So(IsLowUrgency(""), ShouldBeFalse)
+		})
+	})
+}
+
+func TestWorkerDefer(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStat.EXPECT().Increment(gomock.Any()).AnyTimes()
+	mckStat.EXPECT().Timer(gomock.Any(), gomock.Any()).AnyTimes()
+
+	Convey("Deferring updates for a connected client", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		p, err := NewDozePolicy(app, DozeConfig{MaxDefer: "1m"})
+		So(err, ShouldBeNil)
+
+		mckSocket := NewMockSocket(mockCtrl)
+		worker := NewWorker(app, mckSocket, "test")
+		worker.SetUAID("5e1e5984569c4f00bf4bea47754a6403")
+		worker.doze = p.Queue()
+		worker.doze.Observe(&ClientHints{Doze: true})
+
+		Convey("Should send held updates before the next normal update", func() {
+			So(worker.Defer("a", 1, "low"), ShouldBeTrue)
+
+			mckStat.EXPECT().IncrementBy("updates.sent", int64(1))
+			gomock.InOrder(
+				mckSocket.EXPECT().WriteJSON(FlushReply{"notification",
+					[]Update{{"a", 1, "low", false}}, nil, 0, 0}),
+				mckSocket.EXPECT().WriteJSON(FlushReply{"notification",
+					[]Update{{"b", 2, "high", false}}, nil, 0, 0}),
+			)
+			So(worker.Send("b", 2, "high"), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,137 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+type DrainConfig struct {
+	// Timeout is how long to wait for clients to disconnect after they are
+	// asked to reconnect elsewhere. Remaining connections are then closed.
+	// Draining is disabled if set to "" or "0".
+	Timeout string
+
+	// MaxRetry is the maximum reconnection delay advertised to clients. Each
+	// client is told to wait a random delay up to MaxRetry, so that clients
+	// don't all reconnect to the remaining nodes at once.
+	MaxRetry string `toml:"max_retry" env:"max_retry"`
+
+	// Interval is how often to check for remaining connections.
+	Interval string
+}
+
+// GoAway is a "goaway" frame sent to connected clients before the server
+// shuts down. Clients should close the connection, and reconnect after
+// RetryAfter seconds.
+type GoAway struct {
+	Type       string `json:"messageType"`
+	Status     int    `json:"status"`
+	RetryAfter int64  `json:"retryAfter"`
+}
+
+// GoAwaySender is an optional interface implemented by workers that can ask
+// clients to reconnect to another node.
+type GoAwaySender interface {
+	SendGoAway(retryAfter time.Duration) error
+}
+
+// drainer shuts down the client listener and waits for clients to leave.
+type drainer struct {
+	timeout  time.Duration
+	maxRetry time.Duration
+	interval time.Duration
+	jitter   func(max int64) int64
+}
+
+// newDrainer parses the drain settings in conf. Returns nil if draining is
+// disabled.
+func newDrainer(conf DrainConfig) (d *drainer, err error) {
+	d = &drainer{jitter: rand.Int63n}
+	if len(conf.Timeout) > 0 {
+		if d.timeout, err = time.ParseDuration(conf.Timeout); err != nil {
+			return nil, err
+		}
+	}
+	if d.timeout <= 0 {
+		return nil, nil
+	}
+	if d.maxRetry, err = time.ParseDuration(conf.MaxRetry); err != nil {
+		return nil, err
+	}
+	if d.interval, err = time.ParseDuration(conf.Interval); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// retryAfter returns a random reconnection delay, rounded up to whole
+// seconds.
+func (d *drainer) retryAfter() time.Duration {
+	var delay time.Duration
+	if d.maxRetry > 0 {
+		delay = time.Duration(d.jitter(int64(d.maxRetry)))
+	}
+	if rem := delay % time.Second; rem > 0 {
+		delay += time.Second - rem
+	}
+	return delay
+}
+
+// Drain stops accepting client connections, asks connected clients to
+// reconnect to another node, and waits up to the drain timeout for them to
+// disconnect. Update and routing listeners keep running, so that updates can
+// be delivered to clients that haven't disconnected yet. Drain does not close
+// the application; callers should call Close afterward. Returns the number of
+// clients still connected.
+func (a *Application) Drain() (remaining int) {
+	d := a.drainer
+	if d == nil || a.closeOnce.IsDone() {
+		return a.WorkerCount()
+	}
+	logger, metrics := a.Logger(), a.Metrics()
+	start := timeNow()
+	if s, ok := a.SocketHandler().(interface {
+		StopAccepting() error
+	}); ok {
+		s.StopAccepting()
+	}
+	workers := a.workers.Workers()
+	if logger.ShouldLog(INFO) {
+		logger.Info("app", "Draining client connections", LogFields{
+			"clients": strconv.Itoa(len(workers)),
+			"timeout": d.timeout.String()})
+	}
+	for _, worker := range workers {
+		sender, ok := worker.(GoAwaySender)
+		if !ok {
+			continue
+		}
+		if err := sender.SendGoAway(d.retryAfter()); err == nil {
+			metrics.Increment("client.socket.goaway")
+		}
+	}
+	ticker := clock.NewTicker(d.interval)
+	defer ticker.Stop()
+	deadline := clock.After(d.timeout)
+wait:
+	for remaining = a.WorkerCount(); remaining > 0; remaining = a.WorkerCount() {
+		select {
+		case <-ticker.C():
+		case <-deadline:
+			break wait
+		}
+	}
+	// Publish the final client count before the connections are closed.
+	metrics.Gauge("update.client.connections", int64(remaining))
+	metrics.Timer("server.drain", timeNow().Sub(start))
+	if logger.ShouldLog(INFO) {
+		logger.Info("app", "Finished draining client connections", LogFields{
+			"remaining": strconv.Itoa(remaining)})
+	}
+	return remaining
+}
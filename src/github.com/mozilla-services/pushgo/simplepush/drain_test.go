@@ -0,0 +1,97 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDrain(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Draining client connections", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+
+		d, err := newDrainer(DrainConfig{
+			Timeout:  "50ms",
+			MaxRetry: "30s",
+			Interval: "1ms",
+		})
+		So(err, ShouldBeNil)
+		d.jitter = func(max int64) int64 { return int64(1500 * time.Millisecond) }
+		app.drainer = d
+
+		leaving, staying := NewMockSocket(mockCtrl), NewMockSocket(mockCtrl)
+		leavingID := "5e1e5984569c4f00bf4bea47754a6403"
+		stayingID := "0d6a6d0ca1ba4be1bc8a2cea8e4ddb1a"
+		leavingWorker := NewWorker(app, leaving, "test")
+		leavingWorker.SetUAID(leavingID)
+		app.AddWorker(leavingID, leavingWorker)
+		stayingWorker := NewWorker(app, staying, "test")
+		stayingWorker.SetUAID(stayingID)
+		app.AddWorker(stayingID, stayingWorker)
+
+		Convey("Should ask clients to reconnect, then wait for them", func() {
+			goAway := GoAway{"goaway", 503, 2}
+			leaving.EXPECT().WriteJSON(goAway).Do(func(interface{}) {
+				// Simulate the client disconnecting.
+				app.RemoveWorker(leavingID, leavingWorker)
+			})
+			staying.EXPECT().WriteJSON(goAway)
+			mckStat.EXPECT().Increment("client.socket.goaway").Times(2)
+			mckStat.EXPECT().Gauge("update.client.connections", int64(1))
+			mckStat.EXPECT().Timer("server.drain", gomock.Any())
+
+			So(app.Drain(), ShouldEqual, 1)
+		})
+
+		Convey("Should send close frames with status 1001", func() {
+			closer := &statusCloserSocket{MockSocket: NewMockSocket(mockCtrl)}
+			closerID := "c0b1e1b2a8d84d0e8a1a4b6f8c2d0e4f"
+			closerWorker := NewWorker(app, closer, "test")
+			closerWorker.SetUAID(closerID)
+			closer.EXPECT().SetWriteDeadline(gomock.Any()).AnyTimes()
+			closer.EXPECT().WriteJSON(GoAway{"goaway", 503, 2})
+
+			So(closerWorker.SendGoAway(2*time.Second), ShouldBeNil)
+			So(closer.statuses, ShouldResemble, []int{CloseGoingAway})
+		})
+
+		Convey("Should return immediately if disabled", func() {
+			app.drainer = nil
+			So(app.Drain(), ShouldEqual, 2)
+		})
+
+		Convey("Should not drain disabled configurations", func() {
+			d, err := newDrainer(DrainConfig{Timeout: "0"})
+			So(err, ShouldBeNil)
+			So(d, ShouldBeNil)
+		})
+	})
+}
+
+// statusCloserSocket is a mock socket that records close statuses.
+type statusCloserSocket struct {
+	*MockSocket
+	statuses []int
+}
+
+func (s *statusCloserSocket) SendClose(status int) error {
+	s.statuses = append(s.statuses, status)
+	return nil
+}
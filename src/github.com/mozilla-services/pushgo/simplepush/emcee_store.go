@@ -104,24 +104,26 @@ type EmceeDriverConf struct {
 
 // EmceeStore is a memcached adapter.
 type EmceeStore struct {
-	Hosts          []string
-	MaxConns       int
-	PingPrefix     string
-	connectTimeout uint64
-	recvTimeout    uint64
-	sendTimeout    uint64
-	pollTimeout    uint64
-	retryTimeout   uint64
-	TimeoutLive    time.Duration
-	TimeoutReg     time.Duration
-	TimeoutDel     time.Duration
-	maxChannels    int
-	defaultHost    string
-	logger         *SimpleLogger
-	cond           sync.Cond
-	clients        *list.List
-	capacity       int
-	isClosed       bool
+	Hosts            []string
+	MaxConns         int
+	PingPrefix       string
+	connectTimeout   uint64
+	recvTimeout      uint64
+	sendTimeout      uint64
+	pollTimeout      uint64
+	retryTimeout     uint64
+	TimeoutLive      time.Duration
+	TimeoutReg       time.Duration
+	TimeoutDel       time.Duration
+	RejectDecreasing bool
+	maxChannels      int
+	defaultHost      string
+	logger           *SimpleLogger
+	cond             sync.Cond
+	clients          *list.List
+	capacity         int
+	isClosed         bool
+	cipher           *EnvelopeCipher
 }
 
 // EmceeConf specifies memcached adapter options.
@@ -179,6 +181,12 @@ func (s *EmceeStore) Init(app *Application, config interface{}) (err error) {
 	s.MaxConns = conf.Driver.MaxConns
 	s.PingPrefix = conf.Db.PingPrefix
 
+	if s.cipher, err = conf.Db.RecordCipher(); err != nil {
+		s.logger.Panic("emcee", "Db.EncryptionKey must be a valid AES key",
+			LogFields{"error": err.Error()})
+		return err
+	}
+
 	// The socket connection timeout in milliseconds.
 	if s.connectTimeout, err = parseTimeout(conf.Db.HandleTimeout, time.Millisecond); err != nil {
 		s.logger.Panic("emcee", "Db.HandleTimeout must be a valid duration",
@@ -216,6 +224,7 @@ func (s *EmceeStore) Init(app *Application, config interface{}) (err error) {
 	s.TimeoutLive = time.Duration(conf.Db.TimeoutLive) * time.Second
 	s.TimeoutReg = time.Duration(conf.Db.TimeoutReg) * time.Second
 	s.TimeoutDel = time.Duration(conf.Db.TimeoutReg) * time.Second
+	s.RejectDecreasing = conf.Db.RejectDecreasing
 
 	return nil
 }
@@ -349,7 +358,7 @@ func (s *EmceeStore) storeRegister(uaid, chid string, version int64) error {
 	}
 	rec := &ChannelRecord{
 		State:       StateRegistered,
-		LastTouched: time.Now().UTC().Unix(),
+		LastTouched: timeNow().UTC().Unix(),
 	}
 	if version != 0 {
 		rec.State = StateLive
@@ -403,10 +412,13 @@ func (s *EmceeStore) storeUpdate(uaid, chid string, version int64) error {
 				"version": fmt.Sprintf("%d", version)})
 		}
 		if cRec.State != StateDeleted {
+			if s.RejectDecreasing && cRec.Version > uint64(version) {
+				return ErrStaleVersion
+			}
 			newRecord := &ChannelRecord{
 				State:       StateLive,
 				Version:     uint64(version),
-				LastTouched: time.Now().UTC().Unix(),
+				LastTouched: timeNow().UTC().Unix(),
 			}
 			if err = s.storeRec(key, newRecord); err != nil {
 				return err
@@ -591,7 +603,7 @@ func (s *EmceeStore) FetchAll(uaid string, since time.Time) ([]Update, []string,
 		case StateLive:
 			version := channel.Version
 			if version == 0 {
-				version = uint64(time.Now().UTC().Unix())
+				version = uint64(timeNow().UTC().Unix())
 				if s.logger.ShouldLog(DEBUG) {
 					s.logger.Debug("emcee", "FetchAll Using Timestamp", LogFields{
 						"uaid": uaid,
@@ -665,8 +677,10 @@ func (s *EmceeStore) FetchPing(uaid string) (pingData []byte, err error) {
 	if err != nil {
 		return
 	}
-	err = client.Get(s.PingPrefix+uaid, &pingData)
-	return
+	if err = client.Get(s.PingPrefix+uaid, &pingData); err != nil {
+		return
+	}
+	return s.cipher.Open(pingData)
 }
 
 // PutPing stores the proprietary ping info blob for the given device ID in
@@ -680,7 +694,11 @@ func (s *EmceeStore) PutPing(uaid string, pingData []byte) (err error) {
 	if err != nil {
 		return err
 	}
-	return client.Set(s.PingPrefix+uaid, pingData, 0)
+	sealed, err := s.cipher.Seal(pingData)
+	if err != nil {
+		return err
+	}
+	return client.Set(s.PingPrefix+uaid, sealed, 0)
 }
 
 // DropPing removes all proprietary ping info for the given device ID.
@@ -787,7 +805,7 @@ func (s *EmceeStore) storeRec(pk string, rec *ChannelRecord) (err error) {
 	default:
 		ttl = s.TimeoutLive
 	}
-	rec.LastTouched = time.Now().UTC().Unix()
+	rec.LastTouched = timeNow().UTC().Unix()
 	client, err := s.getClient()
 	defer s.releaseWithout(client, &err)
 	if err != nil {
@@ -0,0 +1,155 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+)
+
+var ErrInvalidEnvelope = errors.New("Malformed encrypted record")
+
+// envelopeMagic prefixes encrypted records. Records without the prefix were
+// stored before encryption was enabled, and are returned as-is.
+var envelopeMagic = []byte("\xffenv1")
+
+// KeyWrapper encrypts and decrypts per-record data keys with a master key.
+// The master key never leaves the wrapper, so a wrapper backed by a key
+// management service can be used instead of a local key.
+type KeyWrapper interface {
+	// WrapKey encrypts a data key.
+	WrapKey(dataKey []byte) ([]byte, error)
+
+	// UnwrapKey decrypts a data key.
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// LocalKeyWrapper wraps data keys with a local AES master key.
+type LocalKeyWrapper struct {
+	aead cipher.AEAD
+}
+
+// NewLocalKeyWrapper creates a key wrapper from a base64-encoded 16, 24, or
+// 32-byte master key.
+func NewLocalKeyWrapper(masterKey string) (*LocalKeyWrapper, error) {
+	key, err := base64.URLEncoding.DecodeString(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if err = cryptoProvider.CheckKey(key); err != nil {
+		return nil, err
+	}
+	aead, err := cryptoProvider.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalKeyWrapper{aead}, nil
+}
+
+// WrapKey implements KeyWrapper.WrapKey.
+func (w *LocalKeyWrapper) WrapKey(dataKey []byte) ([]byte, error) {
+	return seal(w.aead, dataKey)
+}
+
+// UnwrapKey implements KeyWrapper.UnwrapKey.
+func (w *LocalKeyWrapper) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return open(w.aead, wrapped)
+}
+
+// EnvelopeCipher encrypts records at rest using envelope encryption: each
+// record is encrypted with a random data key, and the data key is wrapped
+// with the master key and stored alongside the record. A nil EnvelopeCipher
+// stores records in plaintext.
+type EnvelopeCipher struct {
+	wrapper KeyWrapper
+}
+
+// NewEnvelopeCipher returns an envelope cipher that wraps data keys with
+// wrapper.
+func NewEnvelopeCipher(wrapper KeyWrapper) *EnvelopeCipher {
+	return &EnvelopeCipher{wrapper}
+}
+
+// Seal encrypts a record. The sealed record is the magic prefix, the length
+// of the wrapped data key as a 16-bit big-endian integer, the wrapped key,
+// and the encrypted record.
+func (c *EnvelopeCipher) Seal(value []byte) ([]byte, error) {
+	if c == nil || len(value) == 0 {
+		return value, nil
+	}
+	dataKey, err := genKey(32)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := c.wrapper.WrapKey(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cryptoProvider.NewAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(aead, value)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, len(envelopeMagic)+2, len(envelopeMagic)+2+
+		len(wrapped)+len(sealed))
+	copy(record, envelopeMagic)
+	binary.BigEndian.PutUint16(record[len(envelopeMagic):], uint16(len(wrapped)))
+	record = append(record, wrapped...)
+	return append(record, sealed...), nil
+}
+
+// Open decrypts a sealed record. Plaintext records are returned unchanged, so
+// that encryption can be enabled for existing stores.
+func (c *EnvelopeCipher) Open(record []byte) ([]byte, error) {
+	if !bytes.HasPrefix(record, envelopeMagic) {
+		return record, nil
+	}
+	if c == nil {
+		return nil, ErrInvalidEnvelope
+	}
+	record = record[len(envelopeMagic):]
+	if len(record) < 2 {
+		return nil, ErrInvalidEnvelope
+	}
+	keyLen := int(binary.BigEndian.Uint16(record))
+	record = record[2:]
+	if len(record) < keyLen {
+		return nil, ErrInvalidEnvelope
+	}
+	dataKey, err := c.wrapper.UnwrapKey(record[:keyLen])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cryptoProvider.NewAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, record[keyLen:])
+}
+
+// seal encrypts value with a random nonce, returning the nonce followed by
+// the ciphertext.
+func seal(aead cipher.AEAD, value []byte) ([]byte, error) {
+	nonce, err := genKey(aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, value, nil), nil
+}
+
+// open decrypts a value encrypted by seal.
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, ErrInvalidEnvelope
+	}
+	return aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+}
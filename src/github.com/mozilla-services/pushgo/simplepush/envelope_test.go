@@ -0,0 +1,66 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEnvelopeCipher(t *testing.T) {
+	Convey("Envelope encryption", t, func() {
+		wrapper, err := NewLocalKeyWrapper("c3v0AlmmxXu_LSfdZY3l3eayLsIwkX48")
+		So(err, ShouldBeNil)
+		c := NewEnvelopeCipher(wrapper)
+		pingData := []byte(`{"regid":"APA91bHun4MxP5egoKMwt2KZFBaFUH"}`)
+
+		Convey("Should encrypt and decrypt records", func() {
+			sealed, err := c.Seal(pingData)
+			So(err, ShouldBeNil)
+			So(bytes.Contains(sealed, []byte("regid")), ShouldBeFalse)
+			opened, err := c.Open(sealed)
+			So(err, ShouldBeNil)
+			So(opened, ShouldResemble, pingData)
+		})
+
+		Convey("Should return plaintext records unchanged", func() {
+			opened, err := c.Open(pingData)
+			So(err, ShouldBeNil)
+			So(opened, ShouldResemble, pingData)
+		})
+
+		Convey("Should not encrypt records if disabled", func() {
+			var disabled *EnvelopeCipher
+			sealed, err := disabled.Seal(pingData)
+			So(err, ShouldBeNil)
+			So(sealed, ShouldResemble, pingData)
+		})
+
+		Convey("Should reject records sealed with another master key", func() {
+			sealed, err := c.Seal(pingData)
+			So(err, ShouldBeNil)
+			other, err := NewLocalKeyWrapper("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+			So(err, ShouldBeNil)
+			_, err = NewEnvelopeCipher(other).Open(sealed)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Should reject truncated records", func() {
+			sealed, err := c.Seal(pingData)
+			So(err, ShouldBeNil)
+			_, err = c.Open(sealed[:len(envelopeMagic)+1])
+			So(err, ShouldEqual, ErrInvalidEnvelope)
+			_, err = c.Open(sealed[:len(envelopeMagic)+10])
+			So(err, ShouldEqual, ErrInvalidEnvelope)
+		})
+
+		Convey("Should reject invalid master keys", func() {
+			_, err := NewLocalKeyWrapper("c2hvcnQ=")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
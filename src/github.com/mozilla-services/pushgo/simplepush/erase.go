@@ -0,0 +1,168 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"time"
+)
+
+// DataEraser is an optional interface implemented by components that hold
+// device data, so that the data can be removed for right-to-erasure
+// requests. Stores, dead letter stores, and socket handlers are checked for
+// this interface; other components register with Application.AddEraser.
+type DataEraser interface {
+	// EraseDevice removes all data held for the device, returning the number
+	// of records removed. Erasing a device without data is not an error.
+	EraseDevice(suaid string) (erased int, err error)
+}
+
+// namedEraser is an eraser registered with Application.AddEraser.
+type namedEraser struct {
+	name   string
+	eraser DataEraser
+}
+
+// ErasureStep is the result of one eraser.
+type ErasureStep struct {
+	Name   string `json:"name"`
+	Erased int    `json:"erased"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ErasureReport describes the data removed for a device.
+type ErasureReport struct {
+	DeviceID  string        `json:"uaid"`
+	Started   int64         `json:"started"`   // Milliseconds since Epoch.
+	Completed int64         `json:"completed"` // Milliseconds since Epoch.
+	Complete  bool          `json:"complete"`  // Set if every eraser succeeded.
+	Steps     []ErasureStep `json:"steps"`
+}
+
+// EraseDevice disconnects a device, and removes its data from the store, the
+// dead letter queue, parked sessions, transcripts, and registered erasers.
+// Devices connected to other nodes are disconnected through the control
+// plane, if enabled. Every eraser runs even if an earlier eraser fails; the
+// report records each result. Erasing is idempotent, so failed requests can
+// be retried.
+func EraseDevice(app *Application, uaid string) *ErasureReport {
+	report := &ErasureReport{
+		DeviceID: uaid,
+		Started:  timeNow().UnixNano() / int64(time.Millisecond),
+		Complete: true,
+	}
+	// Disconnect the device first, so that it doesn't write new data, or
+	// park its session, while it is erased.
+	step := ErasureStep{Name: "connection"}
+	if worker, ok := app.GetWorker(uaid); ok {
+		worker.Close()
+		step.Erased = 1
+	}
+	if control := app.ControlPlane(); control != nil {
+		_, err := control.Publish(ControlDisconnect,
+			map[string]string{"uaid": uaid})
+		if err != nil {
+			step.Error = ErrStr(err)
+			report.Complete = false
+		}
+	}
+	report.Steps = append(report.Steps, step)
+
+	for _, e := range app.erasers() {
+		step := ErasureStep{Name: e.name}
+		erased, err := e.eraser.EraseDevice(uaid)
+		step.Erased = erased
+		if err != nil {
+			step.Error = ErrStr(err)
+			report.Complete = false
+		}
+		report.Steps = append(report.Steps, step)
+	}
+	report.Completed = timeNow().UnixNano() / int64(time.Millisecond)
+	return report
+}
+
+// storeDataEraser returns the eraser for store. Stores that don't implement
+// DataEraser are erased with DropAll and DropPing.
+func storeDataEraser(store Store) DataEraser {
+	if eraser, ok := store.(DataEraser); ok {
+		return eraser
+	}
+	return storeEraser{store}
+}
+
+// storeEraser removes a device's channels and proprietary ping data from a
+// store that doesn't implement DataEraser. Other records, such as
+// tombstones, expire on their own.
+type storeEraser struct {
+	store Store
+}
+
+func (e storeEraser) EraseDevice(uaid string) (erased int, err error) {
+	updates, _, err := PeekAll(e.store, uaid)
+	if err != nil {
+		return 0, err
+	}
+	if err = e.store.DropAll(uaid); err != nil {
+		return 0, err
+	}
+	erased = len(updates)
+	pingData, err := e.store.FetchPing(uaid)
+	if err != nil {
+		return erased, err
+	}
+	if len(pingData) > 0 {
+		if err = e.store.DropPing(uaid); err != nil {
+			return erased, err
+		}
+		erased++
+	}
+	return erased, nil
+}
+
+// deadLetterEraser removes a device's updates from the dead letter queue.
+type deadLetterEraser struct {
+	deadLetters DeadLetterStore
+}
+
+func (e deadLetterEraser) EraseDevice(uaid string) (erased int, err error) {
+	letters, err := e.deadLetters.FetchDeadLetters(0)
+	if err != nil {
+		return 0, err
+	}
+	for _, letter := range letters {
+		if letter.UAID != uaid {
+			continue
+		}
+		if err = e.deadLetters.DropDeadLetter(letter.ID); err != nil {
+			return erased, err
+		}
+		erased++
+	}
+	return erased, nil
+}
+
+// EraseDevice discards the device's parked session. Implements
+// DataEraser.EraseDevice().
+func (c *SessionCache) EraseDevice(uaid string) (erased int, err error) {
+	if c == nil {
+		return 0, nil
+	}
+	c.sessionsMux.Lock()
+	defer c.sessionsMux.Unlock()
+	if elem, ok := c.byUAID[uaid]; ok {
+		c.remove(elem)
+		erased = 1
+	}
+	return erased, nil
+}
+
+// EraseDevice stops recording frames for the device, and discards its
+// transcript. Implements DataEraser.EraseDevice().
+func (r *TranscriptRecorder) EraseDevice(uaid string) (erased int, err error) {
+	if r != nil && r.Unflag(uaid) {
+		erased = 1
+	}
+	return erased, nil
+}
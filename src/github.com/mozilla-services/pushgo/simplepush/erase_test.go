@@ -0,0 +1,148 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// erasingStore removes a fixed number of records for each device.
+type erasingStore struct {
+	NoStore
+	erased int
+	err    error
+}
+
+func (s *erasingStore) EraseDevice(string) (int, error) {
+	return s.erased, s.err
+}
+
+func TestEraseDevice(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	defer saveTimeFuncs()()
+	timeNow = func() time.Time { return time.Unix(1257894000, 0) }
+
+	uaid := "d1c7c768b1be4c7093a69b52910d4baa"
+	otherUAID := "5e1e5984569c4f00bf4bea47754a6403"
+
+	Convey("Device erasure", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(&erasingStore{erased: 3})
+
+		Convey("Should disconnect the device and run every eraser", func() {
+			mckWorker := NewMockWorker(mockCtrl)
+			app.AddWorker(uaid, mckWorker)
+
+			deadLetters := newTestDeadLetterStore(&NoStore{})
+			deadLetters.PutDeadLetter(&DeadLetter{ID: "a", UAID: uaid})
+			deadLetters.PutDeadLetter(&DeadLetter{ID: "b", UAID: otherUAID})
+			deadLetters.PutDeadLetter(&DeadLetter{ID: "c", UAID: uaid})
+			app.SetDeadLetterStore(deadLetters)
+
+			app.sessions, _ = NewSessionCache(ResumeConfig{TTL: "30s", Size: 10})
+			app.sessions.Park(&parkedSession{token: "t1", uaid: uaid})
+			app.sessions.Park(&parkedSession{token: "t2", uaid: otherUAID})
+
+			sh := NewSocketHandler()
+			conf := sh.ConfigStruct().(*SocketHandlerConfig)
+			sh.transcripts = NewTranscriptRecorder(app, conf.Transcripts)
+			app.SetSocketHandler(sh)
+			mckStat.EXPECT().Gauge("client.transcript.flagged", gomock.Any()).Times(2)
+			sh.transcripts.Flag(uaid)
+
+			mckWorker.EXPECT().Close()
+			report := EraseDevice(app, uaid)
+			So(report, ShouldResemble, &ErasureReport{
+				DeviceID:  uaid,
+				Started:   1257894000000,
+				Completed: 1257894000000,
+				Complete:  true,
+				Steps: []ErasureStep{
+					{Name: "connection", Erased: 1},
+					{Name: "store", Erased: 3},
+					{Name: "dead_letters", Erased: 2},
+					{Name: "sessions", Erased: 1},
+					{Name: "transcripts", Erased: 1},
+				},
+			})
+			So(deadLetters.letters, ShouldHaveLength, 1)
+			So(app.sessions.Len(), ShouldEqual, 1)
+			So(sh.transcripts.Flagged(), ShouldBeEmpty)
+		})
+
+		Convey("Should disconnect devices on other nodes", func() {
+			locator := &memoryLocator{}
+			app.SetLocator(locator)
+			c := NewControlPlane()
+			conf := c.ConfigStruct().(*ControlConfig)
+			conf.Enabled = true
+			conf.Interval = "1h"
+			So(c.Init(app, conf), ShouldBeNil)
+			defer c.Close()
+
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("control.publish.success"),
+				mckStat.EXPECT().Increment("control.event.applied"),
+			)
+			report := EraseDevice(app, uaid)
+			So(report.Complete, ShouldBeTrue)
+			So(locator.events, ShouldHaveLength, 1)
+			So(locator.events[0].Type, ShouldEqual, ControlDisconnect)
+			So(locator.events[0].Args["uaid"], ShouldEqual, uaid)
+
+			// Other nodes close the device's connection.
+			mckWorker := NewMockWorker(mockCtrl)
+			app.AddWorker(uaid, mckWorker)
+			mckWorker.EXPECT().Close()
+			So(c.disconnect(locator.events[0]), ShouldBeNil)
+		})
+
+		Convey("Should drop channels and ping data from other stores", func() {
+			mckStore := NewMockStore(mockCtrl)
+			app.SetStore(mckStore)
+			gomock.InOrder(
+				mckStore.EXPECT().FetchAll(uaid, time.Time{}).Return(
+					[]Update{{ChannelID: "a"}, {ChannelID: "b"}}, nil, nil),
+				mckStore.EXPECT().DropAll(uaid),
+				mckStore.EXPECT().FetchPing(uaid).Return(nil, nil),
+			)
+			report := EraseDevice(app, uaid)
+			So(report.Complete, ShouldBeTrue)
+			So(report.Steps, ShouldResemble, []ErasureStep{
+				{Name: "connection"},
+				{Name: "store", Erased: 2},
+			})
+		})
+
+		Convey("Should report failed erasers, and run the remaining erasers", func() {
+			app.SetStore(&erasingStore{err: errors.New("oops")})
+			hook := &erasingStore{erased: 1}
+			app.AddEraser("archive", hook)
+
+			report := EraseDevice(app, uaid)
+			So(report.Complete, ShouldBeFalse)
+			So(report.Steps, ShouldResemble, []ErasureStep{
+				{Name: "connection"},
+				{Name: "store", Error: "oops"},
+				{Name: "archive", Erased: 1},
+			})
+		})
+	})
+}
@@ -53,6 +53,9 @@ var (
 	ErrExistingID         = &ServiceError{202, http.StatusServiceUnavailable, "Device ID already assigned to this client"}
 	ErrTooManyPings       = &ServiceError{203, http.StatusUnauthorized, "Client sent too many pings"}
 	ErrNonexistentChannel = &ServiceError{204, http.StatusServiceUnavailable, "The specified channel ID does not exist"}
+	ErrTooManyRegisters   = &ServiceError{205, http.StatusUnauthorized, "Client sent too many registrations"}
+	ErrBanned             = &ServiceError{206, http.StatusForbidden, "Client temporarily banned"}
+	ErrWrongRegion        = &ServiceError{207, http.StatusForbidden, "Device registered in another region"}
 )
 
 // 300-class errors indicate bad app server input (e.g., invalid update
@@ -60,6 +63,11 @@ var (
 var (
 	ErrBadVersion  = &ServiceError{301, http.StatusBadRequest, "Invalid update version"}
 	ErrDataTooLong = &ServiceError{302, http.StatusRequestEntityTooLarge, "Request payload too large"}
+	ErrChannelGone = &ServiceError{303, http.StatusGone, "The specified channel ID was unregistered"}
+
+	ErrVersionOverflow = &ServiceError{304, http.StatusBadRequest, "Update version out of range"}
+	ErrStaleVersion    = &ServiceError{305, http.StatusConflict, "Update version older than the stored version"}
+	ErrInvalidTTL      = &ServiceError{306, http.StatusBadRequest, "Invalid update TTL"}
 )
 
 // 400-class errors indicate problems with upstream services (e.g.,
@@ -67,6 +75,11 @@ var (
 var (
 	ErrInvalidKey         = &ServiceError{401, http.StatusInternalServerError, "Invalid channel primary key"}
 	ErrRecordUpdateFailed = &ServiceError{402, http.StatusServiceUnavailable, "Error updating channel record"}
+	ErrHandshakeTimeout   = &ServiceError{403, http.StatusServiceUnavailable, "Timed out completing handshake"}
+	ErrNotAdmitted        = &ServiceError{404, http.StatusServiceUnavailable, "Server recovering; retry later"}
+	ErrBridgeUnavailable  = &ServiceError{405, http.StatusServiceUnavailable, "Upstream push service unavailable"}
+	ErrQueueFull          = &ServiceError{406, http.StatusServiceUnavailable, "Update queue full"}
+	ErrDeadlineExceeded   = &ServiceError{407, http.StatusServiceUnavailable, "Request deadline exceeded"}
 )
 
 // ErrServerError is a catch-all service error.
@@ -75,14 +75,16 @@ type EtcdBalancerConf struct {
 // weighted random strategy.
 type EtcdBalancer struct {
 	client    *etcd.Client
-	maxConns  int
-	threshold float64
+	maxConns  func() int
 	dir       string
 	url       *url.URL
 	key       string
 	rh        *retry.Helper
 	connCount func() int
 
+	thresholdLock sync.RWMutex
+	threshold     float64 // Protected by thresholdLock.
+
 	fetchLock sync.RWMutex // Protects the following fields.
 	peers     *EtcdPeers
 	fetchErr  error
@@ -171,7 +173,7 @@ func (b *EtcdBalancer) Init(app *Application, config interface{}) (err error) {
 	b.metrics = app.Metrics()
 
 	b.connCount = app.WorkerCount
-	b.maxConns = app.SocketHandler().MaxConns()
+	b.maxConns = app.SocketHandler().MaxConns
 
 	b.threshold = conf.Threshold
 	b.dir = path.Clean(conf.Dir)
@@ -233,10 +235,34 @@ func (b *EtcdBalancer) shouldRedirect() (currentConns int64, ok bool) {
 		return
 	}
 	currentConns = int64(b.connCount())
-	ok = float64(currentConns+1)/float64(b.maxConns) >= b.threshold
+	ok = b.overThreshold(currentConns)
 	return
 }
 
+// overThreshold indicates whether a node with currentConns connections has
+// reached the redirection threshold.
+func (b *EtcdBalancer) overThreshold(currentConns int64) bool {
+	b.thresholdLock.RLock()
+	threshold := b.threshold
+	b.thresholdLock.RUnlock()
+	return float64(currentConns+1)/float64(b.maxConns()) >= threshold
+}
+
+// ReloadableSettings implements Reloadable.ReloadableSettings().
+func (*EtcdBalancer) ReloadableSettings() []string {
+	return []string{"threshold"}
+}
+
+// Reload applies a changed redirection threshold. Implements
+// Reloadable.Reload().
+func (b *EtcdBalancer) Reload(config interface{}) error {
+	conf := config.(*EtcdBalancerConf)
+	b.thresholdLock.Lock()
+	b.threshold = conf.Threshold
+	b.thresholdLock.Unlock()
+	return nil
+}
+
 // RedirectURL returns the absolute URL of an available peer. Implements
 // Balancer.RedirectURL().
 func (b *EtcdBalancer) RedirectURL() (url string, ok bool, err error) {
@@ -245,12 +271,12 @@ func (b *EtcdBalancer) RedirectURL() (url string, ok bool, err error) {
 		return "", false, nil
 	}
 	b.fetchLock.RLock()
-	if b.fetchErr != nil && time.Since(b.lastFetch) > b.ttl {
+	if b.fetchErr != nil && timeNow().Sub(b.lastFetch) > b.ttl {
 		err = b.fetchErr
 	}
 	peer, ok := b.peers.Choose()
 	b.fetchLock.RUnlock()
-	if !ok || int64(b.maxConns)-currentConns >= peer.FreeConns {
+	if !ok || int64(b.maxConns())-currentConns >= peer.FreeConns {
 		return "", false, ErrNoPeers
 	}
 	return peer.URL, true, err
@@ -258,11 +284,11 @@ func (b *EtcdBalancer) RedirectURL() (url string, ok bool, err error) {
 
 func (b *EtcdBalancer) updateCounts() {
 	defer b.closeWait.Done()
-	ticker := time.NewTicker(b.updateInterval)
+	ticker := clock.NewTicker(b.updateInterval)
 	for ok := true; ok; {
 		select {
 		case ok = <-b.closeSignal:
-		case t := <-ticker.C:
+		case t := <-ticker.C():
 			peers, err := b.Fetch()
 			b.fetchLock.Lock()
 			if err != nil {
@@ -280,11 +306,11 @@ func (b *EtcdBalancer) updateCounts() {
 func (b *EtcdBalancer) publishCounts() {
 	defer b.closeWait.Done()
 	publishInterval := time.Duration(0.75*b.ttl.Seconds()) * time.Second
-	ticker := time.NewTicker(publishInterval)
+	ticker := clock.NewTicker(publishInterval)
 	for ok := true; ok; {
 		select {
 		case ok = <-b.closeSignal:
-		case <-ticker.C:
+		case <-ticker.C():
 			b.Publish()
 		}
 	}
@@ -336,7 +362,7 @@ func (b *EtcdBalancer) close() (err error) {
 		b.log.Info("balancer", "Waiting for etcd changes to propagate",
 			LogFields{"closeDelay": b.closeDelay.String()})
 	}
-	time.Sleep(b.closeDelay)
+	<-clock.After(b.closeDelay)
 	return err
 }
 
@@ -408,6 +434,24 @@ func (b *EtcdBalancer) filterPeers(root *etcd.Node) (peers *EtcdPeers, err error
 	return peers, nil
 }
 
+// HasCapacity indicates whether the peer at origin was below the redirection
+// threshold as of the last fetch. Peers only publish their free connection
+// counts, so all nodes are assumed to share this node's connection limit.
+// Implements AffinityBalancer.HasCapacity().
+func (b *EtcdBalancer) HasCapacity(origin string) bool {
+	b.fetchLock.RLock()
+	defer b.fetchLock.RUnlock()
+	if b.peers == nil || b.fetchErr != nil && timeNow().Sub(b.lastFetch) > b.ttl {
+		return false
+	}
+	for _, peer := range b.peers.peers {
+		if peer.URL == origin {
+			return !b.overThreshold(int64(b.maxConns()) - peer.FreeConns)
+		}
+	}
+	return false
+}
+
 // Fetch retrieves a list of peer nodes from etcd, sorted by free connections.
 func (b *EtcdBalancer) Fetch() (peers *EtcdPeers, err error) {
 	var response *etcd.Response
@@ -440,7 +484,7 @@ func (b *EtcdBalancer) Fetch() (peers *EtcdPeers, err error) {
 
 // Publish stores the client count for the current node in etcd.
 func (b *EtcdBalancer) Publish() (err error) {
-	freeConns := strconv.Itoa(b.maxConns - b.connCount())
+	freeConns := strconv.Itoa(b.maxConns() - b.connCount())
 	if b.log.ShouldLog(INFO) {
 		b.log.Info("balancer", "Publishing free connection count to etcd",
 			LogFields{"host": b.url.Host, "conns": freeConns})
@@ -36,3 +36,20 @@ func BenchmarkChoose(b *testing.B) {
 		peers.Choose()
 	}
 }
+
+func TestHasCapacity(t *testing.T) {
+	b := &EtcdBalancer{
+		maxConns:  func() int { return 100 },
+		threshold: 0.55,
+		peers:     etcdPeers(),
+	}
+	if !b.HasCapacity("ws://localhost:8088") {
+		t.Errorf("Peer with 51 free connections should be below the threshold")
+	}
+	if b.HasCapacity("ws://localhost:8083") {
+		t.Errorf("Peer with 40 free connections should be over the threshold")
+	}
+	if b.HasCapacity("ws://localhost:8081") {
+		t.Errorf("Unknown peer should not have capacity")
+	}
+}
@@ -5,6 +5,7 @@
 package simplepush
 
 import (
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/http"
@@ -54,6 +55,14 @@ type EtcdLocatorConf struct {
 	// removing the host from etcd. This should be 1-2 times the refresh interval.
 	CloseDelay string `toml:"close_delay" env:"close_delay"`
 
+	// EventsDir is the etcd key prefix for control events. Defaults to
+	// "push_events".
+	EventsDir string `toml:"events_dir" env:"events_dir"`
+
+	// EventsTTL is the amount of time that control events are kept, so that
+	// nodes that start in the meantime apply them. Defaults to "10m".
+	EventsTTL string `toml:"events_ttl" env:"events_ttl"`
+
 	// Retry specifies request retry options.
 	Retry retry.Config
 }
@@ -69,6 +78,8 @@ type EtcdLocator struct {
 	rh              *retry.Helper
 	serverList      []string
 	dir             string
+	eventsDir       string
+	eventsTTL       time.Duration
 	url             string
 	key             string
 	client          *etcd.Client
@@ -98,6 +109,8 @@ func (*EtcdLocator) ConfigStruct() interface{} {
 		RefreshInterval: "10s",
 		StartDelay:      "10s",
 		CloseDelay:      "20s",
+		EventsDir:       "push_events",
+		EventsTTL:       "10m",
 		Retry: retry.Config{
 			Retries:   5,
 			Delay:     "200ms",
@@ -144,8 +157,16 @@ func (l *EtcdLocator) Init(app *Application, config interface{}) (err error) {
 		return err
 	}
 
+	if l.eventsTTL, err = time.ParseDuration(conf.EventsTTL); err != nil {
+		l.logger.Panic("locator", "Could not parse events TTL",
+			LogFields{"error": err.Error(),
+				"eventsTTL": conf.EventsTTL})
+		return err
+	}
+
 	l.serverList = conf.Servers
 	l.dir = path.Clean(conf.Dir)
+	l.eventsDir = path.Clean(conf.EventsDir)
 
 	// Use the hostname and port of the current server as the etcd key.
 	l.url = app.Router().URL()
@@ -196,7 +217,7 @@ func (l *EtcdLocator) Init(app *Application, config interface{}) (err error) {
 	l.closeWait.Add(2)
 	if l.startDelay > 0 {
 		l.closeWait.Add(1)
-		time.AfterFunc(l.startDelay, l.closeReady)
+		clock.AfterFunc(l.startDelay, l.closeReady)
 	}
 	go l.registerHost()
 	go l.refreshHosts()
@@ -272,7 +293,7 @@ func (l *EtcdLocator) close() (err error) {
 		l.logger.Info("locator", "Waiting for etcd deregistration to propagate",
 			LogFields{"closeDelay": l.closeDelay.String()})
 	}
-	time.Sleep(l.closeDelay)
+	<-clock.After(l.closeDelay)
 	return err
 }
 
@@ -285,7 +306,7 @@ func (l *EtcdLocator) Contacts(string) (contacts []string, err error) {
 	l.contactsLock.RLock()
 	contacts = make([]string, len(l.contacts))
 	copy(contacts, l.contacts)
-	if l.contactsErr != nil && time.Since(l.lastFetch) > l.defaultTTL {
+	if l.contactsErr != nil && timeNow().Sub(l.lastFetch) > l.defaultTTL {
 		err = l.contactsErr
 	}
 	l.contactsLock.RUnlock()
@@ -365,11 +386,11 @@ func (l *EtcdLocator) registerHost() {
 	defer l.closeWait.Done()
 	// auto refresh slightly more often than the TTL
 	timeout := 0.75 * l.defaultTTL.Seconds()
-	ticker := time.NewTicker(time.Duration(timeout) * time.Second)
+	ticker := clock.NewTicker(time.Duration(timeout) * time.Second)
 	for ok := true; ok; {
 		select {
 		case ok = <-l.closeSignal:
-		case <-ticker.C:
+		case <-ticker.C():
 			l.Register()
 		}
 	}
@@ -379,11 +400,11 @@ func (l *EtcdLocator) registerHost() {
 // refreshHosts polls etcd for new nodes.
 func (l *EtcdLocator) refreshHosts() {
 	defer l.closeWait.Done()
-	fetchTick := time.NewTicker(l.refreshInterval)
+	fetchTick := clock.NewTicker(l.refreshInterval)
 	for ok := true; ok; {
 		select {
 		case ok = <-l.closeSignal:
-		case t := <-fetchTick.C:
+		case t := <-fetchTick.C():
 			contacts, err := l.getServers()
 			l.contactsLock.Lock()
 			if err != nil {
@@ -399,6 +420,44 @@ func (l *EtcdLocator) refreshHosts() {
 	fetchTick.Stop()
 }
 
+// PublishEvent stores a control event in etcd. Implements
+// ControlChannel.PublishEvent().
+func (l *EtcdLocator) PublishEvent(event ControlEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	key := path.Join(l.eventsDir, event.ID)
+	ttl := uint64(l.eventsTTL / time.Second)
+	_, err = l.client.Set(key, string(data), ttl)
+	return err
+}
+
+// FetchEvents returns the control events stored in etcd. Implements
+// ControlChannel.FetchEvents().
+func (l *EtcdLocator) FetchEvents() (events []ControlEvent, err error) {
+	response, err := l.client.Get(l.eventsDir, false, false)
+	if err != nil {
+		if IsEtcdKeyNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	events = make([]ControlEvent, 0, len(response.Node.Nodes))
+	for _, node := range response.Node.Nodes {
+		var event ControlEvent
+		if err := json.Unmarshal([]byte(node.Value), &event); err != nil {
+			if l.logger.ShouldLog(WARNING) {
+				l.logger.Warn("locator", "Ignoring malformed control event",
+					LogFields{"key": node.Key, "error": err.Error()})
+			}
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
 func (l *EtcdLocator) CloseNotify() <-chan bool {
 	return l.closeSignal
 }
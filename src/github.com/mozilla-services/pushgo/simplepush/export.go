@@ -0,0 +1,184 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// DataExporter is an optional interface implemented by components that hold
+// device data beyond the Store interface, so that the data can be included
+// in data portability requests. Stores, dead letter stores, and socket
+// handlers are checked for this interface; other components register with
+// Application.AddExporter.
+type DataExporter interface {
+	// ExportDevice returns a JSON-encodable description of the data held for
+	// the device, or nil if the component holds no data for the device.
+	ExportDevice(suaid string) (data interface{}, err error)
+}
+
+// namedExporter is an exporter registered with Application.AddExporter.
+type namedExporter struct {
+	name     string
+	exporter DataExporter
+}
+
+// PendingUpdate describes an unacknowledged update, without its payload.
+type PendingUpdate struct {
+	ChannelID string `json:"channelID"`
+	Version   uint64 `json:"version"`
+	DataLen   int    `json:"dataLength,omitempty"` // Payload size, in bytes.
+}
+
+// DeviceExport contains all data stored for a device.
+type DeviceExport struct {
+	DeviceID string `json:"uaid"`
+	Exported int64  `json:"exported"` // Milliseconds since Epoch.
+
+	// LastConnect is the time of the device's last handshake, in
+	// milliseconds since Epoch; omitted if unknown.
+	LastConnect int64  `json:"lastConnect,omitempty"`
+	Origin      string `json:"origin,omitempty"`
+	Region      string `json:"region,omitempty"`
+
+	// Ping is the device's proprietary ping registration, if any.
+	Ping interface{} `json:"ping,omitempty"`
+
+	Channels []ChannelInfo   `json:"channels"`
+	Pending  []PendingUpdate `json:"pending"`
+	Expired  []string        `json:"expired"`
+
+	// Data contains the data held by each exporter, keyed by exporter name.
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// ExportDevice collects the data stored for a device, in a machine-readable
+// format: its registered channels, pending update metadata, proprietary ping
+// registration, and the data held by the store and registered exporters.
+// Update payloads are not exported. Pending updates are read without
+// discarding expired updates, so that exporting a device doesn't change it.
+// Unlike erasure, export stops at the first error, so that a partial export
+// isn't mistaken for a complete one.
+func ExportDevice(app *Application, uaid string) (export *DeviceExport, err error) {
+	store := app.Store()
+	export = &DeviceExport{
+		DeviceID: uaid,
+		Exported: timeNow().UnixNano() / int64(time.Millisecond),
+	}
+	if export.Channels, _, err = FetchChannelInfo(store, uaid); err != nil {
+		return nil, err
+	}
+	if export.Channels == nil {
+		export.Channels = []ChannelInfo{}
+	}
+	updates, expired, err := PeekAll(store, uaid)
+	if err != nil {
+		return nil, err
+	}
+	export.Pending = make([]PendingUpdate, len(updates))
+	for i, update := range updates {
+		export.Pending[i] = PendingUpdate{
+			ChannelID: update.ChannelID,
+			Version:   update.Version,
+			DataLen:   len(update.Data),
+		}
+	}
+	if export.Expired = expired; export.Expired == nil {
+		export.Expired = []string{}
+	}
+	pingData, err := store.FetchPing(uaid)
+	if err != nil {
+		if missing, ok := store.(pingMissingChecker); !ok || !missing.isMissingPing(err) {
+			return nil, err
+		}
+	}
+	if len(pingData) > 0 {
+		export.Ping = exportBlob(pingData)
+	}
+	if connects, ok := store.(ConnectStore); ok {
+		lastConnect, err := connects.FetchLastConnect(uaid)
+		if err != nil {
+			return nil, err
+		}
+		if !lastConnect.IsZero() {
+			export.LastConnect = lastConnect.UnixNano() / int64(time.Millisecond)
+		}
+	}
+	if affinity, ok := store.(AffinityStore); ok {
+		if export.Origin, err = affinity.FetchAffinity(uaid); err != nil {
+			return nil, err
+		}
+	}
+	if residency, ok := store.(ResidencyStore); ok {
+		if export.Region, err = residency.FetchRegion(uaid); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range app.exporters() {
+		data, err := e.exporter.ExportDevice(uaid)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			continue
+		}
+		if export.Data == nil {
+			export.Data = make(map[string]interface{})
+		}
+		export.Data[e.name] = data
+	}
+	return export, nil
+}
+
+// pingMissingChecker is implemented by stores whose FetchPing returns an
+// error, rather than empty data, for devices without ping registrations.
+type pingMissingChecker interface {
+	isMissingPing(err error) bool
+}
+
+// exportBlob returns an opaque blob as a JSON value if it contains valid
+// JSON, or as a string otherwise.
+func exportBlob(blob []byte) interface{} {
+	if json.Unmarshal(blob, new(interface{})) != nil {
+		return string(blob)
+	}
+	return json.RawMessage(blob)
+}
+
+// deadLetterExporter returns a device's updates in the dead letter queue,
+// without their payloads.
+type deadLetterExporter struct {
+	deadLetters DeadLetterStore
+}
+
+func (e deadLetterExporter) ExportDevice(uaid string) (data interface{}, err error) {
+	letters, err := e.deadLetters.FetchDeadLetters(0)
+	if err != nil {
+		return nil, err
+	}
+	var exported []DeadLetter
+	for _, letter := range letters {
+		if letter.UAID != uaid {
+			continue
+		}
+		exported = append(exported, *letter)
+		exported[len(exported)-1].Data = ""
+	}
+	if len(exported) == 0 {
+		return nil, nil
+	}
+	return exported, nil
+}
+
+// ExportDevice returns the device's recorded frames, if the device is
+// flagged. Implements DataExporter.ExportDevice().
+func (r *TranscriptRecorder) ExportDevice(uaid string) (data interface{}, err error) {
+	transcript := r.Transcript(uaid)
+	if transcript == nil {
+		return nil, nil
+	}
+	return transcript.Frames(), nil
+}
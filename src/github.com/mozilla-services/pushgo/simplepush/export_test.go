@@ -0,0 +1,115 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// exportingStore returns fixed channels, updates, ping data, and exported
+// data. Exporting must not discard updates, so FetchAll fails.
+type exportingStore struct {
+	describingStore
+	updates []Update
+	ping    []byte
+	data    interface{}
+	err     error
+}
+
+func (s *exportingStore) FetchAll(string, time.Time) ([]Update, []string, error) {
+	return nil, nil, errors.New("FetchAll called")
+}
+
+func (s *exportingStore) PeekAll(string) ([]Update, []string, error) {
+	return s.updates, []string{"expired"}, nil
+}
+
+func (s *exportingStore) FetchPing(string) ([]byte, error) {
+	return s.ping, nil
+}
+
+func (s *exportingStore) ExportDevice(string) (interface{}, error) {
+	return s.data, s.err
+}
+
+func TestExportDevice(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	defer saveTimeFuncs()()
+	timeNow = func() time.Time { return time.Unix(1257894000, 0) }
+
+	uaid := "d1c7c768b1be4c7093a69b52910d4baa"
+	otherUAID := "5e1e5984569c4f00bf4bea47754a6403"
+	chid := "6a2e8d4a4f5b4d3c9a1e2f3b4c5d6e7f"
+
+	Convey("Device export", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		store := &exportingStore{
+			describingStore: describingStore{channels: []ChannelInfo{
+				{ChannelID: chid, Created: 1257890000}}},
+			updates: []Update{{ChannelID: chid, Version: 3, Data: "hello"}},
+			ping:    []byte(`{"regid":"abc"}`),
+			data:    map[string]interface{}{"region": "eu"},
+		}
+		app.SetStore(store)
+
+		Convey("Should export stored data and exporter data", func() {
+			deadLetters := newTestDeadLetterStore(&NoStore{})
+			deadLetters.PutDeadLetter(&DeadLetter{ID: "a", UAID: uaid,
+				ChannelID: chid, Version: 2, Data: "secret", Reason: "gone"})
+			deadLetters.PutDeadLetter(&DeadLetter{ID: "b", UAID: otherUAID})
+			app.SetDeadLetterStore(deadLetters)
+
+			sh := NewSocketHandler()
+			conf := sh.ConfigStruct().(*SocketHandlerConfig)
+			sh.transcripts = NewTranscriptRecorder(app, conf.Transcripts)
+			app.SetSocketHandler(sh)
+			mckStat.EXPECT().Gauge("client.transcript.flagged", gomock.Any())
+			sh.transcripts.Flag(otherUAID)
+
+			export, err := ExportDevice(app, uaid)
+			So(err, ShouldBeNil)
+			body, err := json.Marshal(export)
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, `{"uaid":"`+uaid+`",`+
+				`"exported":1257894000000,"ping":{"regid":"abc"},`+
+				`"channels":[{"channelID":"`+chid+`","created":1257890000}],`+
+				`"pending":[{"channelID":"`+chid+`","version":3,"dataLength":5}],`+
+				`"expired":["expired"],"data":{`+
+				`"dead_letters":[{"id":"a","uaid":"`+uaid+`","channelID":"`+chid+`",`+
+				`"version":2,"reason":"gone","failedAt":0,"attempts":0}],`+
+				`"store":{"region":"eu"}}}`)
+		})
+
+		Convey("Should omit empty exporter data", func() {
+			store.data = nil
+			export, err := ExportDevice(app, uaid)
+			So(err, ShouldBeNil)
+			So(export.Data, ShouldBeNil)
+		})
+
+		Convey("Should fail if any exporter fails", func() {
+			app.AddExporter("archive", &exportingStore{err: errors.New("oops")})
+			export, err := ExportDevice(app, uaid)
+			So(err, ShouldNotBeNil)
+			So(export, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,136 @@
+// +build linux
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// inotifyMask selects the events that may replace or rewrite a watched file:
+// writes, renames into the directory (used by atomic replacements and
+// symlink swaps), and new files.
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO |
+	syscall.IN_CREATE
+
+// inotifyWatcher watches the directories of a set of files with inotify.
+// Directories are watched instead of the files, so that files replaced by a
+// rename, or through a symlinked directory, are still seen. Any event in a
+// watched directory is signaled; callers check whether the files changed.
+type inotifyWatcher struct {
+	fd        int
+	epfd      int
+	wakeR     int // Pipe used to interrupt EpollWait on close.
+	wakeW     int
+	changes   chan bool
+	closeOnce Once
+	done      chan bool
+}
+
+// newFileWatcher returns a watcher that signals when any of files changes.
+func newFileWatcher(files []string) (fileWatcher, error) {
+	fd, err := syscall.InotifyInit()
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init", err)
+	}
+	w := &inotifyWatcher{
+		fd:      fd,
+		epfd:    -1,
+		wakeR:   -1,
+		wakeW:   -1,
+		changes: make(chan bool, 1),
+		done:    make(chan bool),
+	}
+	if err = w.init(files); err != nil {
+		w.closeFDs()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *inotifyWatcher) init(files []string) error {
+	for _, file := range files {
+		// Adding a watch for the same directory again returns the existing
+		// watch.
+		if _, err := syscall.InotifyAddWatch(w.fd, filepath.Dir(file),
+			inotifyMask); err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+	}
+	var pipe [2]int
+	if err := syscall.Pipe(pipe[:]); err != nil {
+		return os.NewSyscallError("pipe", err)
+	}
+	w.wakeR, w.wakeW = pipe[0], pipe[1]
+	epfd, err := syscall.EpollCreate1(0)
+	if err != nil {
+		return os.NewSyscallError("epoll_create1", err)
+	}
+	w.epfd = epfd
+	for _, fd := range []int{w.fd, w.wakeR} {
+		event := &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+		if err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, event); err != nil {
+			return os.NewSyscallError("epoll_ctl", err)
+		}
+	}
+	return nil
+}
+
+// Changes returns a channel that receives a value after a watched file
+// changes. Changes that arrive before the last one is received are merged.
+func (w *inotifyWatcher) Changes() <-chan bool {
+	return w.changes
+}
+
+func (w *inotifyWatcher) run() {
+	defer close(w.done)
+	events := make([]syscall.EpollEvent, 2)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.EpollWait(w.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for _, event := range events[:n] {
+			if int(event.Fd) == w.wakeR {
+				return
+			}
+		}
+		if n, err = syscall.Read(w.fd, buf); err != nil || n <= 0 {
+			continue
+		}
+		select {
+		case w.changes <- true:
+		default:
+		}
+	}
+}
+
+// Close stops watching the files.
+func (w *inotifyWatcher) Close() error {
+	return w.closeOnce.Do(w.close)
+}
+
+func (w *inotifyWatcher) close() error {
+	syscall.Write(w.wakeW, []byte{0})
+	<-w.done
+	w.closeFDs()
+	return nil
+}
+
+func (w *inotifyWatcher) closeFDs() {
+	for _, fd := range []int{w.epfd, w.wakeR, w.wakeW, w.fd} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+}
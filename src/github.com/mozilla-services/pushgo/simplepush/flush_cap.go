@@ -0,0 +1,90 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sort"
+	"strconv"
+)
+
+type FlushCapConfig struct {
+	// MaxUpdates is the number of pending updates sent in each flush. The
+	// newest updates are sent first. Flushes are not capped if zero. Stores
+	// only keep the latest version of each channel, so this caps the number
+	// of channels flushed at once.
+	MaxUpdates int `toml:"max_updates" env:"max_updates"`
+
+	// Drop discards the older updates beyond the cap. Otherwise, they are
+	// left in the store, and sent in later flushes as the client acknowledges
+	// the newer updates.
+	Drop bool
+}
+
+// newestFirst sorts updates by descending version. Versions are typically
+// timestamps, so newer updates have higher versions.
+type newestFirst []Update
+
+func (u newestFirst) Len() int           { return len(u) }
+func (u newestFirst) Less(i, j int) bool { return u[i].Version > u[j].Version }
+func (u newestFirst) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+
+// FlushCap limits the number of pending updates sent to a client in one
+// flush, so that a device that was offline for a long time isn't sent
+// thousands of stale updates at once. Tenants may override the server cap.
+// A nil FlushCap never caps flushes.
+type FlushCap struct {
+	app        *Application
+	logger     *SimpleLogger
+	metrics    Statistician
+	store      Store
+	maxUpdates int
+	drop       bool
+}
+
+// NewFlushCap creates a flush cap from conf.
+func NewFlushCap(app *Application, conf FlushCapConfig) *FlushCap {
+	return &FlushCap{
+		app:        app,
+		logger:     app.Logger(),
+		metrics:    app.Metrics(),
+		store:      app.Store(),
+		maxUpdates: conf.MaxUpdates,
+		drop:       conf.Drop,
+	}
+}
+
+// Apply returns the newest updates within tenant's cap. The remaining updates
+// are dropped from the store if the cap drops excess updates.
+func (c *FlushCap) Apply(uaid, tenant string, updates []Update) []Update {
+	if c == nil {
+		return updates
+	}
+	maxUpdates, drop := c.app.Tenants().FlushLimit(tenant, c.maxUpdates, c.drop)
+	if maxUpdates <= 0 || len(updates) <= maxUpdates {
+		return updates
+	}
+	sorted := make([]Update, len(updates))
+	copy(sorted, updates)
+	sort.Stable(newestFirst(sorted))
+	updates, excess := sorted[:maxUpdates], sorted[maxUpdates:]
+	c.metrics.Increment("updates.flush.capped")
+	if !drop {
+		c.metrics.IncrementBy("updates.flush.held", int64(len(excess)))
+		return updates
+	}
+	for _, update := range excess {
+		if err := c.store.Drop(uaid, update.ChannelID); err != nil {
+			if c.logger.ShouldLog(WARNING) {
+				c.logger.Warn("flush_cap", "Could not drop excess update",
+					LogFields{"uaid": uaid, "chid": update.ChannelID,
+						"version": strconv.FormatUint(update.Version, 10),
+						"error":   ErrStr(err)})
+			}
+			continue
+		}
+		c.metrics.Increment("updates.flush.dropped")
+	}
+	return updates
+}
@@ -0,0 +1,66 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFlushCap(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+
+	uaid := "5e1e5984569c4f00bf4bea47754a6403"
+	updates := []Update{{"a", 3, "", false}, {"b", 5, "", false}, {"c", 1, "", false}, {"d", 4, "", false}}
+
+	Convey("Flush caps", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(mckStore)
+
+		Convey("Should not cap flushes within the limit", func() {
+			c := NewFlushCap(app, FlushCapConfig{MaxUpdates: 4})
+			So(c.Apply(uaid, DefaultTenant, updates), ShouldResemble, updates)
+		})
+
+		Convey("Should send the newest updates and hold the rest", func() {
+			c := NewFlushCap(app, FlushCapConfig{MaxUpdates: 2})
+			mckStat.EXPECT().Increment("updates.flush.capped")
+			mckStat.EXPECT().IncrementBy("updates.flush.held", int64(2))
+			So(c.Apply(uaid, DefaultTenant, updates), ShouldResemble,
+				[]Update{{"b", 5, "", false}, {"d", 4, "", false}})
+			// The fetched updates are not reordered.
+			So(updates[0], ShouldResemble, Update{"a", 3, "", false})
+		})
+
+		Convey("Should drop excess updates if configured", func() {
+			c := NewFlushCap(app, FlushCapConfig{MaxUpdates: 2, Drop: true})
+			mckStat.EXPECT().Increment("updates.flush.capped")
+			gomock.InOrder(
+				mckStore.EXPECT().Drop(uaid, "a").Return(errors.New("oops")),
+				mckStore.EXPECT().Drop(uaid, "c").Return(nil),
+				mckStat.EXPECT().Increment("updates.flush.dropped"),
+			)
+			So(c.Apply(uaid, DefaultTenant, updates), ShouldHaveLength, 2)
+		})
+
+		Convey("Should never cap if disabled", func() {
+			var c *FlushCap
+			So(c.Apply(uaid, DefaultTenant, updates), ShouldResemble, updates)
+		})
+	})
+}
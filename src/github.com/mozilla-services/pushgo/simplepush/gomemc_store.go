@@ -6,8 +6,8 @@ package simplepush
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
+	"net"
 	"sort"
 	"strconv"
 	"strings"
@@ -18,6 +18,10 @@ import (
 	"github.com/mozilla-services/pushgo/id"
 )
 
+// maxIndexSwaps is the number of times a shared index is read and swapped
+// before giving up, if other nodes keep changing it.
+const maxIndexSwaps = 10
+
 // NewGomemc creates an unconfigured memcached adapter.
 func NewGomemc() *GomemcStore {
 	return &GomemcStore{}
@@ -27,20 +31,52 @@ func NewGomemc() *GomemcStore {
 type GomemcDriverConf struct {
 	// Hosts is a list of memcached nodes.
 	Hosts []string `toml:"server" env:"server"`
+
+	// RegionHosts is a list of memcached nodes shared by all regions, for
+	// device region tags. Defaults to Hosts, which only enforces data
+	// residency if all regions share Hosts.
+	RegionHosts []string `toml:"region_server" env:"region_server"`
 }
 
 // GomemcStore is a memcached adapter.
 type GomemcStore struct {
-	Hosts         []string
-	PingPrefix    string
-	TimeoutLive   time.Duration
-	TimeoutReg    time.Duration
-	TimeoutDel    time.Duration
-	HandleTimeout time.Duration
-	maxChannels   int
-	defaultHost   string
-	logger        *SimpleLogger
-	client        *mc.Client
+	Hosts             []string
+	PingPrefix        string
+	DeadLetterPrefix  string
+	TombstonePrefix   string
+	RegisteredPrefix  string
+	BanPrefix         string
+	APIKeyPrefix      string
+	AffinityPrefix    string
+	PayloadPrefix     string
+	ConnectPrefix     string
+	FetchedPrefix     string
+	TenantPrefix      string
+	RegionPrefix      string
+	RoutePrefix       string
+	TimeoutLive       time.Duration
+	TimeoutReg        time.Duration
+	TimeoutDel        time.Duration
+	TimeoutDeadLetter time.Duration
+	TimeoutTombstone  time.Duration
+	TimeoutAffinity   time.Duration
+	PruneAfter        time.Duration
+	HandleTimeout     time.Duration
+	RejectDecreasing  bool
+	TrackConnects     bool
+	maxChannels       int
+	defaultHost       string
+	logger            *SimpleLogger
+	client            *mc.Client
+	regions           *mc.Client // Region tags; may be client.
+	cipher            *EnvelopeCipher
+	codec             *RecordCodec
+	writes            *WriteBuffer    // Buffered channel writes; may be nil.
+	migrator          *RecordMigrator // Stale record rewrites; may be nil.
+	replicator        *Replicator     // Cross-region replication; may be nil.
+	ops               *StoreOps       // Operation metrics; may be nil.
+	servers           *mc.ServerList
+	shards            map[string]string // Shard names, by server address.
 }
 
 // GomemcConf specifies memcached adapter options.
@@ -49,6 +85,9 @@ type GomemcConf struct {
 	MaxChannels               int              `toml:"max_channels" env:"max_channels"`
 	Driver                    GomemcDriverConf `toml:"memcache" env:"memcache"`
 	Db                        DbConf
+	WriteBehind               WriteBehindConfig `toml:"write_behind" env:"write_behind"`
+	Migrate                   MigratorConfig
+	Replication               ReplicationConfig
 }
 
 // ConfigStruct returns a configuration object with defaults. Implements
@@ -60,11 +99,50 @@ func (*GomemcStore) ConfigStruct() interface{} {
 			Hosts: []string{"127.0.0.1:11211"},
 		},
 		Db: DbConf{
-			TimeoutLive:   3 * 24 * 60 * 60,
-			TimeoutReg:    3 * 60 * 60,
-			TimeoutDel:    24 * 60 * 60,
-			HandleTimeout: "5s",
-			PingPrefix:    "_pc-",
+			TimeoutLive:       3 * 24 * 60 * 60,
+			TimeoutReg:        3 * 60 * 60,
+			TimeoutDel:        24 * 60 * 60,
+			HandleTimeout:     "5s",
+			PingPrefix:        "_pc-",
+			DeadLetterPrefix:  "_dlq-",
+			TimeoutDeadLetter: 7 * 24 * 60 * 60,
+			TombstonePrefix:   "_ts-",
+			TimeoutTombstone:  24 * 60 * 60,
+			RegisteredPrefix:  "_reg-",
+			BanPrefix:         "_ban-",
+			APIKeyPrefix:      "_key-",
+			AffinityPrefix:    "_aff-",
+			TimeoutAffinity:   24 * 60 * 60,
+			PayloadPrefix:     "_pl-",
+			ConnectPrefix:     "_lc-",
+			FetchedPrefix:     "_lf-",
+			TenantPrefix:      "_tn-",
+			RegionPrefix:      "_rg-",
+			RoutePrefix:       "_rt-",
+			Codec:             "json",
+		},
+		WriteBehind: WriteBehindConfig{
+			Enabled:      false,
+			Interval:     "100ms",
+			MaxPending:   1000,
+			Workers:      10,
+			WaitForFlush: false,
+		},
+		Migrate: MigratorConfig{
+			Enabled:   false,
+			QueueSize: 1000,
+		},
+		Replication: ReplicationConfig{
+			Enabled:    false,
+			MaxSkew:    "30s",
+			Interval:   "1s",
+			BatchSize:  500,
+			MaxPending: 100000,
+			Listener: TCPListenerConfig{
+				Addr:            ":8090",
+				MaxConns:        100,
+				KeepAlivePeriod: "3m",
+			},
 		},
 	}
 }
@@ -97,6 +175,30 @@ func (s *GomemcStore) Init(app *Application, config interface{}) (err error) {
 	}
 
 	s.PingPrefix = conf.Db.PingPrefix
+	s.DeadLetterPrefix = conf.Db.DeadLetterPrefix
+	s.TombstonePrefix = conf.Db.TombstonePrefix
+	s.RegisteredPrefix = conf.Db.RegisteredPrefix
+	s.BanPrefix = conf.Db.BanPrefix
+	s.APIKeyPrefix = conf.Db.APIKeyPrefix
+	s.AffinityPrefix = conf.Db.AffinityPrefix
+	s.PayloadPrefix = conf.Db.PayloadPrefix
+	s.ConnectPrefix = conf.Db.ConnectPrefix
+	s.FetchedPrefix = conf.Db.FetchedPrefix
+	s.TenantPrefix = conf.Db.TenantPrefix
+	s.RegionPrefix = conf.Db.RegionPrefix
+	s.RoutePrefix = conf.Db.RoutePrefix
+
+	if s.cipher, err = conf.Db.RecordCipher(); err != nil {
+		s.logger.Panic("gomemc", "Db.EncryptionKey must be a valid AES key",
+			LogFields{"error": err.Error()})
+		return err
+	}
+
+	if s.codec, err = NewRecordCodec(conf.Db.Codec); err != nil {
+		s.logger.Panic("gomemc", "Db.Codec must be json, gob, or protobuf",
+			LogFields{"error": err.Error(), "codec": conf.Db.Codec})
+		return err
+	}
 
 	if s.HandleTimeout, err = time.ParseDuration(conf.Db.HandleTimeout); err != nil {
 		s.logger.Panic("gomemc", "Db.HandleTimeout must be a valid duration",
@@ -107,9 +209,66 @@ func (s *GomemcStore) Init(app *Application, config interface{}) (err error) {
 	s.TimeoutLive = time.Duration(conf.Db.TimeoutLive) * time.Second
 	s.TimeoutReg = time.Duration(conf.Db.TimeoutReg) * time.Second
 	s.TimeoutDel = time.Duration(conf.Db.TimeoutReg) * time.Second
+	s.TimeoutDeadLetter = time.Duration(conf.Db.TimeoutDeadLetter) * time.Second
+	s.TimeoutTombstone = time.Duration(conf.Db.TimeoutTombstone) * time.Second
+	s.TimeoutAffinity = time.Duration(conf.Db.TimeoutAffinity) * time.Second
+	s.PruneAfter = time.Duration(conf.Db.PruneAfter) * time.Second
+	s.RejectDecreasing = conf.Db.RejectDecreasing
+	s.TrackConnects = conf.Db.TrackConnects
+	if s.PruneAfter > 0 && s.PruneAfter >= s.TimeoutLive &&
+		s.logger.ShouldLog(WARNING) {
+
+		s.logger.Warn("gomemc", "Db.PruneAfter exceeds Db.TimeoutLive; "+
+			"updates will expire before they are pruned",
+			LogFields{"prune_after": strconv.FormatInt(conf.Db.PruneAfter, 10)})
+	}
 
 	s.client = mc.NewFromSelector(serverList)
 	s.client.Timeout = s.HandleTimeout
+	s.regions = s.client
+	if len(conf.Driver.RegionHosts) > 0 {
+		regionList := new(mc.ServerList)
+		if err = regionList.SetServers(conf.Driver.RegionHosts...); err != nil {
+			s.logger.Panic("gomemc", "Failed to set region server host list",
+				LogFields{"error": err.Error()})
+			return err
+		}
+		s.regions = mc.NewFromSelector(regionList)
+		s.regions.Timeout = s.HandleTimeout
+	}
+
+	if conf.Db.OpMetrics {
+		s.ops = NewStoreOps(app.Metrics(), "gomemc", classifyGomemcErr)
+		s.servers = serverList
+		s.shards = make(map[string]string, len(s.Hosts))
+		serverList.Each(func(addr net.Addr) error {
+			s.shards[addr.String()] = strconv.Itoa(len(s.shards))
+			return nil
+		})
+	}
+
+	if conf.WriteBehind.Enabled {
+		if s.writes, err = NewWriteBuffer(app, conf.WriteBehind, s); err != nil {
+			s.logger.Panic("gomemc", "Invalid write-behind settings",
+				LogFields{"error": err.Error()})
+			return err
+		}
+		go s.writes.Run()
+	}
+
+	if conf.Migrate.Enabled {
+		s.migrator = NewRecordMigrator(app, conf.Migrate, s)
+		go s.migrator.Run()
+	}
+
+	if conf.Replication.Enabled {
+		if s.replicator, err = NewReplicator(app, conf.Replication, s); err != nil {
+			s.logger.Panic("gomemc", "Invalid replication settings",
+				LogFields{"error": err.Error()})
+			return err
+		}
+		go s.replicator.Run()
+	}
 
 	return nil
 }
@@ -121,8 +280,16 @@ func (s *GomemcStore) CanStore(channels int) bool {
 }
 
 // Close closes the connection pool and unblocks all pending operations with
-// errors. Safe to call multiple times. Implements Store.Close().
+// errors. Buffered writes are flushed, then unsent replicated changes. Safe
+// to call multiple times. Implements Store.Close().
 func (s *GomemcStore) Close() (err error) {
+	if s.migrator != nil {
+		s.migrator.Close()
+	}
+	if s.writes != nil {
+		err = s.writes.Close()
+	}
+	s.replicator.Close()
 	return
 }
 
@@ -164,6 +331,7 @@ func (s *GomemcStore) IDsToKey(uaid, chid string) (string, error) {
 // Status queries whether memcached is available for reading and writing.
 // Implements Store.Status().
 func (s *GomemcStore) Status() (success bool, err error) {
+	defer s.ops.Done("status", "", timeNow(), &err)
 	fakeID, err := id.Generate()
 	if err != nil {
 		return false, err
@@ -204,6 +372,7 @@ func (s *GomemcStore) Status() (success bool, err error) {
 // Exists returns a Boolean indicating whether a device has previously
 // registered with the Simple Push server. Implements Store.Exists().
 func (s *GomemcStore) Exists(uaid string) bool {
+	defer s.ops.Done("exists", s.shard(uaid), timeNow(), nil)
 	if ok, hasID := hasExistsHook(uaid); hasID {
 		return ok
 	}
@@ -211,6 +380,9 @@ func (s *GomemcStore) Exists(uaid string) bool {
 	if !id.Valid(uaid) {
 		return false
 	}
+	if s.writes != nil && s.writes.HasDevice(uaid) {
+		return true
+	}
 	if _, err = s.client.Get(uaid); err != nil && err != mc.ErrCacheMiss {
 		if s.logger.ShouldLog(ERROR) {
 			s.logger.Error("gomemc", "Exists encountered unknown error",
@@ -222,23 +394,44 @@ func (s *GomemcStore) Exists(uaid string) bool {
 
 // Stores a new channel record in memcached.
 func (s *GomemcStore) storeRegister(uaid, chid string, version int64) error {
+	return s.storeRegisterExpires(uaid, chid, version, 0, 0)
+}
+
+// storeRegisterExpires stores a new channel record. A live record's update
+// expires at expiresAt, in seconds since Epoch, unless expiresAt is 0. The
+// record is flagged as having data if payload matches the version.
+func (s *GomemcStore) storeRegisterExpires(uaid, chid string,
+	version, expiresAt int64, payload uint64) error {
+
 	key := joinIDs(uaid, chid)
 	chids, err := s.fetchAppIDArray(uaid)
 	if err != nil && err != mc.ErrCacheMiss {
 		return err
 	}
+	var created int64
 	if chids.IndexOf(chid) < 0 {
+		// The creation time is unknown if the record was dropped, and the
+		// channel is registered again by an update.
+		created = timeNow().UTC().Unix()
+		if err = s.storeRegistered(key, created); err != nil {
+			return err
+		}
 		if err = s.storeAppIDArray(uaid, append(chids, chid)); err != nil {
 			return err
 		}
 	}
 	rec := &ChannelRecord{
 		State:       StateRegistered,
-		LastTouched: time.Now().UTC().Unix(),
+		LastTouched: timeNow().UTC().Unix(),
+		Created:     created,
 	}
 	if version != 0 {
 		rec.State = StateLive
 		rec.Version = uint64(version)
+		rec.ExpiresAt = expiresAt
+		if payload == rec.Version {
+			rec.Payload = payload
+		}
 	}
 	if err = s.storeRec(key, rec); err != nil {
 		return err
@@ -250,6 +443,7 @@ func (s *GomemcStore) storeRegister(uaid, chid string, version int64) error {
 // channel ID. If version > 0, the record will be marked as active. Implements
 // Store.Register().
 func (s *GomemcStore) Register(uaid, chid string, version int64) (err error) {
+	defer s.ops.Done("register", s.shard(uaid), timeNow(), &err)
 	if len(uaid) == 0 {
 		return ErrNoID
 	}
@@ -262,13 +456,50 @@ func (s *GomemcStore) Register(uaid, chid string, version int64) (err error) {
 	if !id.Valid(chid) {
 		return ErrInvalidChannel
 	}
-	return s.storeRegister(uaid, chid, version)
+	if s.writes != nil {
+		return s.writes.Register(uaid, chid, version)
+	}
+	return s.register(uaid, chid, version)
+}
+
+// register stores a channel record, unless the channel was recently
+// unregistered.
+func (s *GomemcStore) register(uaid, chid string, version int64) error {
+	tombstoned, err := s.hasTombstone(joinIDs(uaid, chid))
+	if err != nil {
+		return err
+	}
+	if tombstoned {
+		return ErrChannelGone
+	}
+	if err = s.storeRegister(uaid, chid, version); err != nil {
+		return err
+	}
+	s.replicator.Put(ReplicaRegister, uaid, chid)
+	return nil
 }
 
 // Updates a channel record in memcached.
 func (s *GomemcStore) storeUpdate(uaid, chid string, version int64) error {
+	return s.storeUpdateExpires(uaid, chid, version, 0)
+}
+
+// storeUpdateExpires updates a channel record. The update expires at
+// expiresAt, in seconds since Epoch, unless expiresAt is 0.
+func (s *GomemcStore) storeUpdateExpires(uaid, chid string,
+	version, expiresAt int64) error {
+
 	key := joinIDs(uaid, chid)
-	cRec, err := s.fetchRec(key)
+	// Reject updates for recently unregistered channels, even if the record
+	// was dropped, instead of registering them again.
+	tombstoned, err := s.hasTombstone(key)
+	if err != nil {
+		return err
+	}
+	if tombstoned {
+		return ErrChannelGone
+	}
+	cRec, item, err := s.fetchRecItem(key)
 	if err != nil && err != mc.ErrCacheMiss {
 		if s.logger.ShouldLog(ERROR) {
 			s.logger.Error("gomemc", "Update error", LogFields{
@@ -283,12 +514,23 @@ func (s *GomemcStore) storeUpdate(uaid, chid string, version int64) error {
 			s.logger.Debug("gomemc", "Replacing record", LogFields{"pk": key})
 		}
 		if cRec.State != StateDeleted {
+			if s.RejectDecreasing && cRec.Version > uint64(version) {
+				return ErrStaleVersion
+			}
 			newRecord := &ChannelRecord{
 				State:       StateLive,
 				Version:     uint64(version),
-				LastTouched: time.Now().UTC().Unix(),
+				LastTouched: timeNow().UTC().Unix(),
+				ExpiresAt:   expiresAt,
+				Created:     cRec.Created,
+				Payload:     cRec.Payload,
 			}
-			return s.storeRec(key, newRecord)
+			if item == nil {
+				return s.storeRec(key, newRecord)
+			}
+			// Don't overwrite the record if the channel was unregistered
+			// concurrently.
+			return s.swapRec(item, newRecord)
 		}
 	}
 	// No record found or the record setting was DELETED
@@ -299,12 +541,19 @@ func (s *GomemcStore) storeUpdate(uaid, chid string, version int64) error {
 			"version":   strconv.FormatInt(version, 10),
 		})
 	}
-	return s.storeRegister(uaid, chid, version)
+	// The data may have been stored before the record was created again, in
+	// which case flagPayload skipped it.
+	payload, err := s.payloadVersion(key)
+	if err != nil {
+		return err
+	}
+	return s.storeRegisterExpires(uaid, chid, version, expiresAt, payload)
 }
 
 // Update updates the version for the given device ID and channel ID.
 // Implements Store.Update().
 func (s *GomemcStore) Update(uaid, chid string, version int64) (err error) {
+	defer s.ops.Done("update", s.shard(uaid), timeNow(), &err)
 	if len(uaid) == 0 {
 		return ErrNoID
 	}
@@ -318,9 +567,73 @@ func (s *GomemcStore) Update(uaid, chid string, version int64) (err error) {
 	if !id.Valid(chid) {
 		return ErrInvalidChannel
 	}
+	if s.writes != nil {
+		return s.writes.Update(uaid, chid, version)
+	}
+	return s.storeUpdate(uaid, chid, version)
+}
+
+// UpdateExpires updates the version for the given device ID and channel ID.
+// The update is discarded if it is not fetched before expiresAt. Buffered
+// writes for the device are flushed first, so that they don't replace the
+// expiring update. Implements ExpiringStore.UpdateExpires().
+func (s *GomemcStore) UpdateExpires(uaid, chid string, version int64,
+	expiresAt time.Time) (err error) {
+
+	defer s.ops.Done("update", s.shard(uaid), timeNow(), &err)
+	if len(uaid) == 0 {
+		return ErrNoID
+	}
+	if len(chid) == 0 {
+		return ErrNoChannel
+	}
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	if !id.Valid(chid) {
+		return ErrInvalidChannel
+	}
+	if s.writes != nil {
+		if err := s.writes.FlushDevice(uaid); err != nil {
+			return err
+		}
+	}
+	return s.storeUpdateExpires(uaid, chid, version, expiresAt.Unix())
+}
+
+// update implements writeBackend.update.
+func (s *GomemcStore) update(uaid, chid string, version int64) error {
 	return s.storeUpdate(uaid, chid, version)
 }
 
+// check implements writeBackend.check.
+func (s *GomemcStore) check(op writeOp, uaid, chid string, version int64) error {
+	key := joinIDs(uaid, chid)
+	tombstoned, err := s.hasTombstone(key)
+	if err != nil {
+		return err
+	}
+	if tombstoned {
+		return ErrChannelGone
+	}
+	if op != writeUpdate || !s.RejectDecreasing {
+		return nil
+	}
+	cRec, _, err := s.fetchRecItem(key)
+	if err != nil && err != mc.ErrCacheMiss {
+		return err
+	}
+	if cRec != nil && cRec.State != StateDeleted && cRec.Version > uint64(version) {
+		return ErrStaleVersion
+	}
+	return nil
+}
+
+// rejectsDecreasing implements writeBackend.rejectsDecreasing.
+func (s *GomemcStore) rejectsDecreasing() bool {
+	return s.RejectDecreasing
+}
+
 // Marks a memcached channel record as expired.
 func (s *GomemcStore) storeUnregister(uaid, chid string) error {
 	key := joinIDs(uaid, chid)
@@ -330,11 +643,26 @@ func (s *GomemcStore) storeUnregister(uaid, chid string) error {
 	}
 	pos := chids.IndexOf(chid)
 	if pos < 0 {
+		if tombstoned, _ := s.hasTombstone(key); tombstoned {
+			return ErrChannelGone
+		}
 		return ErrNonexistentChannel
 	}
 	if err := s.storeAppIDArray(uaid, remove(chids, pos)); err != nil {
 		return err
 	}
+	if err := s.dropRegistered(key); err != nil {
+		return err
+	}
+	if err := s.storeTombstone(key); err != nil {
+		if s.logger.ShouldLog(WARNING) {
+			s.logger.Warn("gomemc", "Could not store channel tombstone",
+				LogFields{
+					"pk":    key,
+					"error": err.Error(),
+				})
+		}
+	}
 	channel, err := s.fetchRec(key)
 	if err != nil {
 		if s.logger.ShouldLog(ERROR) {
@@ -363,6 +691,7 @@ func (s *GomemcStore) storeUnregister(uaid, chid string) error {
 // Unregister marks the channel ID associated with the given device ID
 // as inactive. Implements Store.Unregister().
 func (s *GomemcStore) Unregister(uaid, chid string) (err error) {
+	defer s.ops.Done("unregister", s.shard(uaid), timeNow(), &err)
 	if len(uaid) == 0 {
 		return ErrNoID
 	}
@@ -375,13 +704,24 @@ func (s *GomemcStore) Unregister(uaid, chid string) (err error) {
 	if !id.Valid(chid) {
 		return ErrInvalidChannel
 	}
-	return s.storeUnregister(uaid, chid)
+	if s.writes != nil {
+		// Write buffered registrations before removing the channel.
+		if err = s.writes.FlushDevice(uaid); err != nil {
+			return err
+		}
+	}
+	if err = s.storeUnregister(uaid, chid); err != nil {
+		return err
+	}
+	s.replicator.Put(ReplicaUnregister, uaid, chid)
+	return nil
 }
 
 // Drop removes a channel ID associated with the given device ID from
 // memcached. Deregistration calls should call s.Unregister() instead.
 // Implements Store.Drop().
 func (s *GomemcStore) Drop(uaid, chid string) (err error) {
+	defer s.ops.Done("drop", s.shard(uaid), timeNow(), &err)
 	if len(uaid) == 0 {
 		return ErrNoID
 	}
@@ -394,19 +734,130 @@ func (s *GomemcStore) Drop(uaid, chid string) (err error) {
 	if !id.Valid(chid) {
 		return ErrInvalidChannel
 	}
+	if s.writes != nil {
+		return s.writes.Drop(uaid, chid)
+	}
+	return s.drop(uaid, chid)
+}
+
+// drop removes a channel record and its payload from memcached.
+func (s *GomemcStore) drop(uaid, chid string) error {
 	key := joinIDs(uaid, chid)
-	if err = s.client.Delete(key); err != nil && err != mc.ErrCacheMiss {
+	if err := s.client.Delete(key); err != nil && err != mc.ErrCacheMiss {
+		return err
+	}
+	err := s.client.Delete(s.PayloadPrefix + key)
+	if err != nil && err != mc.ErrCacheMiss {
 		return err
 	}
 	return nil
 }
 
+// FetchChannels returns the IDs of the device's registered channels.
+// Implements ChannelLister.FetchChannels().
+func (s *GomemcStore) FetchChannels(uaid string) (_ []string, err error) {
+	defer s.ops.Done("fetch_channels", s.shard(uaid), timeNow(), &err)
+	if len(uaid) == 0 {
+		return nil, ErrNoID
+	}
+	if s.writes != nil {
+		// Read buffered registrations for the device.
+		if err = s.writes.FlushDevice(uaid); err != nil {
+			return nil, err
+		}
+	}
+	chids, err := s.fetchAppIDArray(uaid)
+	if err != nil && err != mc.ErrCacheMiss {
+		return nil, err
+	}
+	return chids, nil
+}
+
+// DescribeChannels returns the device's registered channels, with their
+// creation times if known. Implements ChannelDescriber.DescribeChannels().
+func (s *GomemcStore) DescribeChannels(uaid string) (_ []ChannelInfo, err error) {
+	defer s.ops.Done("describe_channels", s.shard(uaid), timeNow(), &err)
+	if len(uaid) == 0 {
+		return nil, ErrNoID
+	}
+	if s.writes != nil {
+		if err = s.writes.FlushDevice(uaid); err != nil {
+			return nil, err
+		}
+	}
+	chids, err := s.fetchAppIDArray(uaid)
+	if err != nil && err != mc.ErrCacheMiss {
+		return nil, err
+	}
+	channels := make([]ChannelInfo, len(chids))
+	if len(chids) == 0 {
+		return channels, nil
+	}
+	keys := make([]string, 0, 2*len(chids))
+	for _, chid := range chids {
+		key := joinIDs(uaid, chid)
+		keys = append(keys, s.RegisteredPrefix+key, key)
+	}
+	items, err := s.client.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, chid := range chids {
+		channels[i].ChannelID = chid
+		key := joinIDs(uaid, chid)
+		if raw, ok := items[s.RegisteredPrefix+key]; ok {
+			channels[i].Created, _ = strconv.ParseInt(string(raw.Value), 10, 64)
+			continue
+		}
+		// Channels registered before registration times were recorded fall
+		// back to the record's creation time. Acknowledged records are
+		// dropped, along with their creation times.
+		raw, ok := items[key]
+		if !ok {
+			continue
+		}
+		rec := new(ChannelRecord)
+		if err = s.codec.Unmarshal(raw.Value, rec); err != nil {
+			return nil, err
+		}
+		channels[i].Created = rec.Created
+	}
+	return channels, nil
+}
+
 // FetchAll returns all channel updates and expired channels for a device ID
-// since the specified cutoff time. Implements Store.FetchAll().
-func (s *GomemcStore) FetchAll(uaid string, since time.Time) ([]Update, []string, error) {
+// since the specified cutoff time. Expired and pruned updates are discarded.
+// Implements Store.FetchAll().
+func (s *GomemcStore) FetchAll(uaid string, since time.Time) (
+	_ []Update, _ []string, err error) {
+
+	defer s.ops.Done("fetch_all", s.shard(uaid), timeNow(), &err)
+	return s.fetchAll(uaid, since, true)
+}
+
+// PeekAll returns all channel updates and expired channels for a device ID,
+// like FetchAll, but leaves expired and pruned updates in place. Implements
+// UpdatePeeker.PeekAll().
+func (s *GomemcStore) PeekAll(uaid string) (_ []Update, _ []string, err error) {
+	defer s.ops.Done("peek_all", s.shard(uaid), timeNow(), &err)
+	return s.fetchAll(uaid, time.Time{}, false)
+}
+
+// fetchAll returns the device's updates and expired channels since the
+// cutoff time. Expired and pruned updates are skipped, and discarded from
+// the store if discard is set.
+func (s *GomemcStore) fetchAll(uaid string, since time.Time, discard bool) (
+	[]Update, []string, error) {
+
 	if len(uaid) == 0 {
 		return nil, nil, ErrNoID
 	}
+	if s.writes != nil {
+		// Read buffered writes for the device.
+		if err := s.writes.FlushDevice(uaid); err != nil {
+			return nil, nil, err
+		}
+	}
 	chids, err := s.fetchAppIDArray(uaid)
 	if err != nil && err != mc.ErrCacheMiss {
 		return nil, nil, err
@@ -426,16 +877,19 @@ func (s *GomemcStore) FetchAll(uaid string, since time.Time) ([]Update, []string
 		})
 	}
 
-	sinceUnix := since.Unix()
+	sinceUnix, nowUnix := since.Unix(), timeNow().Unix()
+	pruneUnix := s.pruneBefore(uaid, nowUnix)
+	var pruned []prunedRec
 	for index, key := range keys {
 		channel := new(ChannelRecord)
 		raw, err := s.client.Get(key)
 		if err != nil {
 			continue
 		}
-		if err = json.Unmarshal(raw.Value, &channel); err != nil {
+		if err = s.codec.Unmarshal(raw.Value, channel); err != nil {
 			continue
 		}
+		s.migrate(raw, channel, s.recTTL(channel.State))
 		chid := chids[index]
 		if s.logger.ShouldLog(DEBUG) {
 			s.logger.Debug("gomemc", "FetchAll Fetched record ", LogFields{
@@ -455,9 +909,19 @@ func (s *GomemcStore) FetchAll(uaid string, since time.Time) ([]Update, []string
 		}
 		switch channel.State {
 		case StateLive:
+			if channel.ExpiresAt > 0 && channel.ExpiresAt <= nowUnix {
+				if discard {
+					s.expireRec(raw, channel)
+				}
+				continue
+			}
+			if channel.LastTouched < pruneUnix {
+				pruned = append(pruned, prunedRec{raw, channel, chid})
+				continue
+			}
 			version := channel.Version
 			if version == 0 {
-				version = uint64(time.Now().UTC().Unix())
+				version = uint64(timeNow().UTC().Unix())
 				if s.logger.ShouldLog(DEBUG) {
 					s.logger.Debug("gomemc", "FetchAll Using Timestamp", LogFields{
 						"uaid": uaid,
@@ -468,6 +932,7 @@ func (s *GomemcStore) FetchAll(uaid string, since time.Time) ([]Update, []string
 			update := Update{
 				ChannelID: chid,
 				Version:   version,
+				Payload:   channel.HasPayload(),
 			}
 			updates = append(updates, update)
 		case StateDeleted:
@@ -489,15 +954,124 @@ func (s *GomemcStore) FetchAll(uaid string, since time.Time) ([]Update, []string
 			}
 		}
 	}
+	if len(pruned) > 0 {
+		newest := -1
+		if len(updates) == 0 {
+			// Always return the device's newest update, so that the app
+			// knows to sync.
+			newest = newestPruned(pruned)
+			channel := pruned[newest].channel
+			updates = append(updates, Update{
+				ChannelID: pruned[newest].chid,
+				Version:   channel.Version,
+				Payload:   channel.HasPayload(),
+			})
+		}
+		for i, rec := range pruned {
+			if i != newest && discard {
+				s.expireRec(rec.raw, rec.channel)
+			}
+		}
+	}
+	if discard && s.PruneAfter > 0 {
+		s.putFetched(uaid, nowUnix)
+	}
 	return updates, expired, nil
 }
 
+// prunedRec is a pending update skipped by fetchAll because the device has
+// been offline longer than PruneAfter.
+type prunedRec struct {
+	raw     *mc.Item
+	channel *ChannelRecord
+	chid    string
+}
+
+// newestPruned returns the index of the most recently stored pruned update.
+func newestPruned(pruned []prunedRec) (newest int) {
+	for i, rec := range pruned {
+		if rec.channel.LastTouched > pruned[newest].channel.LastTouched {
+			newest = i
+		}
+	}
+	return newest
+}
+
+// pruneBefore returns the time, in seconds since Epoch, before which the
+// device's pending updates should be pruned, or 0 if the device hasn't been
+// offline longer than PruneAfter. A device is offline from the time it last
+// fetched its updates; if that time is unknown, nothing is pruned.
+func (s *GomemcStore) pruneBefore(uaid string, nowUnix int64) int64 {
+	if s.PruneAfter <= 0 {
+		return 0
+	}
+	raw, err := s.client.Get(s.FetchedPrefix + uaid)
+	if err != nil {
+		if err != mc.ErrCacheMiss && s.logger.ShouldLog(WARNING) {
+			s.logger.Warn("gomemc", "Could not fetch last update fetch time",
+				LogFields{"uaid": uaid, "error": err.Error()})
+		}
+		return 0
+	}
+	fetchedUnix, err := strconv.ParseInt(string(raw.Value), 10, 64)
+	if err != nil {
+		return 0
+	}
+	pruneUnix := nowUnix - int64(s.PruneAfter/time.Second)
+	if fetchedUnix >= pruneUnix {
+		return 0
+	}
+	return pruneUnix
+}
+
+// putFetched records the time that the device fetched its updates, used to
+// determine how long the device was offline.
+func (s *GomemcStore) putFetched(uaid string, nowUnix int64) {
+	err := s.client.Set(&mc.Item{
+		Key:        s.FetchedPrefix + uaid,
+		Value:      []byte(strconv.FormatInt(nowUnix, 10)),
+		Expiration: int32(s.TimeoutLive.Seconds()),
+	})
+	if err != nil && s.logger.ShouldLog(WARNING) {
+		s.logger.Warn("gomemc", "Could not store last update fetch time",
+			LogFields{"uaid": uaid, "error": err.Error()})
+	}
+}
+
+// expireRec discards an update that was not fetched before its TTL expired,
+// or before the device's pending updates were pruned.
+// The channel remains registered, and keeps its version so that stale
+// updates are still rejected. raw is the record item read by FetchAll; the
+// record is left unchanged if it was updated after it was read.
+func (s *GomemcStore) expireRec(raw *mc.Item, channel *ChannelRecord) {
+	if s.logger.ShouldLog(DEBUG) {
+		s.logger.Debug("gomemc", "FetchAll Discarding expired update",
+			LogFields{"pk": raw.Key})
+	}
+	expired := &ChannelRecord{
+		State:       StateRegistered,
+		Version:     channel.Version,
+		LastTouched: channel.LastTouched,
+		Created:     channel.Created,
+	}
+	if err := s.swapRec(raw, expired); err != nil && err != ErrRecordUpdateFailed {
+		if s.logger.ShouldLog(WARNING) {
+			s.logger.Warn("gomemc", "Could not discard expired update",
+				LogFields{"pk": raw.Key, "error": err.Error()})
+		}
+	}
+}
+
 // DropAll removes all channel records for the given device ID. Implements
 // Store.DropAll().
-func (s *GomemcStore) DropAll(uaid string) error {
+func (s *GomemcStore) DropAll(uaid string) (err error) {
+	defer s.ops.Done("drop_all", s.shard(uaid), timeNow(), &err)
 	if !id.Valid(uaid) {
 		return ErrInvalidID
 	}
+	if s.writes != nil {
+		s.writes.Discard(uaid)
+	}
 	chids, err := s.fetchAppIDArray(uaid)
 	if err != nil && err != mc.ErrCacheMiss {
 		return err
@@ -505,57 +1079,1161 @@ func (s *GomemcStore) DropAll(uaid string) error {
 	for _, chid := range chids {
 		key := joinIDs(uaid, chid)
 		s.client.Delete(key)
+		s.client.Delete(s.RegisteredPrefix + key)
+		if s.replicator != nil {
+			// Reject older registrations relayed by other regions.
+			s.storeTombstone(key)
+		}
 	}
 	if err = s.client.Delete(uaid); err != nil && err != mc.ErrCacheMiss {
 		return err
 	}
+	s.replicator.Put(ReplicaDropAll, uaid, "")
 	return nil
 }
 
-// FetchPing retrieves proprietary ping information for the given device ID
-// from memcached. Implements Store.FetchPing().
-func (s *GomemcStore) FetchPing(uaid string) (pingData []byte, err error) {
-	if len(uaid) == 0 {
-		return nil, ErrNoID
-	}
+// EraseDevice removes all records for the given device ID: channel records,
+// payloads, tombstones, and registration times for the registered channels,
+// the channel index, the ping, affinity, route, and handshake records, and
+// the region tag. Tombstones for channels unregistered before the erasure are
+// not indexed, and expire after TimeoutTombstone. Implements
+// DataEraser.EraseDevice().
+func (s *GomemcStore) EraseDevice(uaid string) (erased int, err error) {
+	defer s.ops.Done("erase", s.shard(uaid), timeNow(), &err)
 	if !id.Valid(uaid) {
-		return nil, ErrInvalidID
+		return 0, ErrInvalidID
 	}
-	raw, err := s.client.Get(s.PingPrefix + uaid)
-	if err != nil {
-		return nil, err
+	if s.writes != nil {
+		s.writes.Discard(uaid)
+	}
+	chids, err := s.fetchAppIDArray(uaid)
+	if err != nil && err != mc.ErrCacheMiss {
+		return 0, err
+	}
+	keys := make([]string, 0, 4*len(chids)+7)
+	for _, chid := range chids {
+		key := joinIDs(uaid, chid)
+		keys = append(keys, key, s.PayloadPrefix+key, s.TombstonePrefix+key,
+			s.RegisteredPrefix+key)
+	}
+	keys = append(keys, uaid, s.PingPrefix+uaid, s.AffinityPrefix+uaid,
+		s.RoutePrefix+uaid, s.ConnectPrefix+uaid, s.FetchedPrefix+uaid,
+		s.TenantPrefix+uaid)
+	err = nil
+	for _, key := range keys {
+		switch deleteErr := s.client.Delete(key); deleteErr {
+		case nil:
+			erased++
+		case mc.ErrCacheMiss:
+		default:
+			// Keep deleting, so that a retry has fewer records to remove.
+			err = deleteErr
+		}
 	}
-	return raw.Value, nil
+	switch deleteErr := s.regions.Delete(s.RegionPrefix + uaid); deleteErr {
+	case nil:
+		erased++
+	case mc.ErrCacheMiss:
+	default:
+		err = deleteErr
+	}
+	if err == nil {
+		// Remove the device's channels from other regions.
+		s.replicator.Put(ReplicaDropAll, uaid, "")
+	}
+	return erased, err
 }
 
-// PutPing stores the proprietary ping info blob for the given device ID in
-// memcached. Implements Store.PutPing().
-func (s *GomemcStore) PutPing(uaid string, pingData []byte) error {
+// applyReplica applies a registration change from another region. Changes
+// are discarded if the channel was registered or unregistered in this region
+// at the same time or later. Implements replicaBackend.applyReplica().
+func (s *GomemcStore) applyReplica(replica *Replica) (applied bool, err error) {
+	uaid, chid := replica.DeviceID, replica.ChannelID
 	if !id.Valid(uaid) {
-		return ErrInvalidID
+		return false, ErrInvalidID
 	}
-	return s.client.Set(&mc.Item{
-		Key:        s.PingPrefix + uaid,
-		Value:      pingData,
-		Expiration: 0})
-}
-
-// DropPing removes all proprietary ping info for the given device ID.
-// Implements Store.DropPing().
-func (s *GomemcStore) DropPing(uaid string) error {
-	if len(uaid) == 0 {
-		return ErrNoID
+	if replica.Op != ReplicaDropAll && !id.Valid(chid) {
+		return false, ErrInvalidChannel
 	}
-	if !id.Valid(uaid) {
-		return ErrInvalidID
+	if s.writes != nil {
+		if err = s.writes.FlushDevice(uaid); err != nil {
+			return false, err
+		}
 	}
-	return s.client.Delete(s.PingPrefix + uaid)
+	chids, err := s.fetchAppIDArray(uaid)
+	if err != nil && err != mc.ErrCacheMiss {
+		return false, err
+	}
+	switch replica.Op {
+	case ReplicaRegister:
+		return s.applyRegister(replica, chids)
+	case ReplicaUnregister:
+		return s.applyUnregister(replica, chids)
+	case ReplicaDropAll:
+		return s.applyDropAll(replica, chids)
+	}
+	return false, ErrInvalidReplica
 }
 
-// Returns a duplicate-free list of subscriptions associated with the device
-// ID.
-func (s *GomemcStore) fetchAppIDArray(uaid string) (result ChannelIDs, err error) {
-	if len(uaid) == 0 {
+// applyRegister registers a channel from another region, unless the channel
+// is already registered, or was unregistered later.
+func (s *GomemcStore) applyRegister(replica *Replica, chids ChannelIDs) (
+	applied bool, err error) {
+
+	uaid, chid := replica.DeviceID, replica.ChannelID
+	if chids.IndexOf(chid) >= 0 {
+		return false, nil
+	}
+	key := joinIDs(uaid, chid)
+	unregisteredAt, err := s.tombstoneTime(key)
+	if err != nil {
+		return false, err
+	}
+	if unregisteredAt >= replica.Time {
+		return false, nil
+	}
+	if err = s.storeRegistered(key, replica.Time); err != nil {
+		return false, err
+	}
+	if err = s.storeAppIDArray(uaid, append(chids, chid)); err != nil {
+		return false, err
+	}
+	rec := &ChannelRecord{
+		State:       StateRegistered,
+		LastTouched: timeNow().UTC().Unix(),
+		Created:     replica.Time,
+	}
+	if err = s.storeRec(key, rec); err != nil {
+		return false, err
+	}
+	if unregisteredAt > 0 {
+		err = s.client.Delete(s.TombstonePrefix + key)
+		if err != nil && err != mc.ErrCacheMiss {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// applyUnregister unregisters a channel from another region, unless the
+// channel isn't registered, or was registered later.
+func (s *GomemcStore) applyUnregister(replica *Replica, chids ChannelIDs) (
+	applied bool, err error) {
+
+	uaid, chid := replica.DeviceID, replica.ChannelID
+	pos := chids.IndexOf(chid)
+	if pos < 0 {
+		return false, nil
+	}
+	key := joinIDs(uaid, chid)
+	registeredAt, err := s.registeredTime(key)
+	if err != nil {
+		return false, err
+	}
+	if registeredAt > replica.Time {
+		return false, nil
+	}
+	if err = s.storeAppIDArray(uaid, remove(chids, pos)); err != nil {
+		return false, err
+	}
+	if err = s.storeTombstoneAt(key, replica.Time); err != nil {
+		return false, err
+	}
+	if err = s.dropRegistered(key); err != nil {
+		return false, err
+	}
+	if err = s.drop(uaid, chid); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// applyDropAll removes a device's channels that were registered before a
+// reset in another region. Removed channels are tombstoned at the time of the
+// reset, so that older registrations relayed by a third region are discarded.
+func (s *GomemcStore) applyDropAll(replica *Replica, chids ChannelIDs) (
+	applied bool, err error) {
+
+	uaid := replica.DeviceID
+	kept := make(ChannelIDs, 0, len(chids))
+	for _, chid := range chids {
+		key := joinIDs(uaid, chid)
+		registeredAt, err := s.registeredTime(key)
+		if err != nil {
+			return false, err
+		}
+		if registeredAt > replica.Time {
+			kept = append(kept, chid)
+			continue
+		}
+		if err = s.storeTombstoneAt(key, replica.Time); err != nil {
+			return false, err
+		}
+		if err = s.dropRegistered(key); err != nil {
+			return false, err
+		}
+		if err = s.drop(uaid, chid); err != nil {
+			return false, err
+		}
+	}
+	if len(kept) == len(chids) {
+		return false, nil
+	}
+	if len(kept) > 0 {
+		err = s.storeAppIDArray(uaid, kept)
+	} else if err = s.client.Delete(uaid); err == mc.ErrCacheMiss {
+		err = nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// isMissingPing indicates whether err was returned by FetchPing for a device
+// without a ping registration. Implements pingMissingChecker.isMissingPing().
+func (s *GomemcStore) isMissingPing(err error) bool {
+	return err == mc.ErrCacheMiss
+}
+
+// FetchPing retrieves proprietary ping information for the given device ID
+// from memcached. Implements Store.FetchPing().
+func (s *GomemcStore) FetchPing(uaid string) (pingData []byte, err error) {
+	defer s.ops.Done("fetch_ping", s.shard(s.PingPrefix+uaid), timeNow(), &err)
+	if len(uaid) == 0 {
+		return nil, ErrNoID
+	}
+	if !id.Valid(uaid) {
+		return nil, ErrInvalidID
+	}
+	raw, err := s.client.Get(s.PingPrefix + uaid)
+	if err != nil {
+		return nil, err
+	}
+	return s.cipher.Open(raw.Value)
+}
+
+// PutPing stores the proprietary ping info blob for the given device ID in
+// memcached. Implements Store.PutPing().
+func (s *GomemcStore) PutPing(uaid string, pingData []byte) (err error) {
+	defer s.ops.Done("put_ping", s.shard(s.PingPrefix+uaid), timeNow(), &err)
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	sealed, err := s.cipher.Seal(pingData)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(&mc.Item{
+		Key:        s.PingPrefix + uaid,
+		Value:      sealed,
+		Expiration: 0})
+}
+
+// DropPing removes all proprietary ping info for the given device ID.
+// Implements Store.DropPing().
+func (s *GomemcStore) DropPing(uaid string) (err error) {
+	defer s.ops.Done("drop_ping", s.shard(s.PingPrefix+uaid), timeNow(), &err)
+	if len(uaid) == 0 {
+		return ErrNoID
+	}
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	return s.client.Delete(s.PingPrefix + uaid)
+}
+
+// FetchAffinity returns the node that the given device ID last connected to.
+// Implements AffinityStore.FetchAffinity().
+func (s *GomemcStore) FetchAffinity(uaid string) (origin string, err error) {
+	defer s.ops.Done("fetch_affinity", s.shard(s.AffinityPrefix+uaid), timeNow(), &err)
+	if len(uaid) == 0 {
+		return "", ErrNoID
+	}
+	if !id.Valid(uaid) {
+		return "", ErrInvalidID
+	}
+	raw, err := s.client.Get(s.AffinityPrefix + uaid)
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(raw.Value), nil
+}
+
+// PutAffinity stores the node that the given device ID connected to.
+// Implements AffinityStore.PutAffinity().
+func (s *GomemcStore) PutAffinity(uaid, origin string) (err error) {
+	defer s.ops.Done("put_affinity", s.shard(s.AffinityPrefix+uaid), timeNow(), &err)
+	if len(uaid) == 0 {
+		return ErrNoID
+	}
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	return s.client.Set(&mc.Item{
+		Key:        s.AffinityPrefix + uaid,
+		Value:      []byte(origin),
+		Expiration: int32(s.TimeoutAffinity.Seconds()),
+	})
+}
+
+// FetchRoute returns the routing URL of the node that the given device ID is
+// connected to. Implements RouteStore.FetchRoute().
+func (s *GomemcStore) FetchRoute(uaid string) (node string, err error) {
+	defer s.ops.Done("fetch_route", s.shard(s.RoutePrefix+uaid), timeNow(), &err)
+	if len(uaid) == 0 {
+		return "", ErrNoID
+	}
+	if !id.Valid(uaid) {
+		return "", ErrInvalidID
+	}
+	raw, err := s.client.Get(s.RoutePrefix + uaid)
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(raw.Value), nil
+}
+
+// PutRoute stores the routing URL of the node that the given device ID
+// connected to. Implements RouteStore.PutRoute().
+func (s *GomemcStore) PutRoute(uaid, node string) (err error) {
+	defer s.ops.Done("put_route", s.shard(s.RoutePrefix+uaid), timeNow(), &err)
+	if len(uaid) == 0 {
+		return ErrNoID
+	}
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	return s.client.Set(&mc.Item{
+		Key:        s.RoutePrefix + uaid,
+		Value:      []byte(node),
+		Expiration: int32(s.TimeoutLive.Seconds()),
+	})
+}
+
+// DropRoute removes the given device ID's route if it points to node. The
+// check and removal are not atomic: if the device reconnects to another node
+// in between, its new route is removed, and updates for the device are
+// broadcast until it reconnects. Implements RouteStore.DropRoute().
+func (s *GomemcStore) DropRoute(uaid, node string) (err error) {
+	defer s.ops.Done("drop_route", s.shard(s.RoutePrefix+uaid), timeNow(), &err)
+	if len(uaid) == 0 {
+		return ErrNoID
+	}
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	raw, err := s.client.Get(s.RoutePrefix + uaid)
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return nil
+		}
+		return err
+	}
+	if string(raw.Value) != node {
+		return nil
+	}
+	if err = s.client.Delete(s.RoutePrefix + uaid); err != nil &&
+		err != mc.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// FetchLastConnect returns the time of the given device ID's last handshake,
+// or the zero time if unknown. Implements ConnectStore.FetchLastConnect().
+func (s *GomemcStore) FetchLastConnect(uaid string) (t time.Time, err error) {
+	defer s.ops.Done("fetch_connect", s.shard(s.ConnectPrefix+uaid), timeNow(), &err)
+	if len(uaid) == 0 {
+		return t, ErrNoID
+	}
+	if !id.Valid(uaid) {
+		return t, ErrInvalidID
+	}
+	raw, err := s.client.Get(s.ConnectPrefix + uaid)
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return t, nil
+		}
+		return t, err
+	}
+	ms, err := strconv.ParseInt(string(raw.Value), 10, 64)
+	if err != nil {
+		return t, err
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), nil
+}
+
+// PutLastConnect records the time of the given device ID's handshake, if
+// handshake tracking is enabled. Implements ConnectStore.PutLastConnect().
+func (s *GomemcStore) PutLastConnect(uaid string, t time.Time) (err error) {
+	if !s.TrackConnects {
+		return nil
+	}
+	defer s.ops.Done("put_connect", s.shard(s.ConnectPrefix+uaid), timeNow(), &err)
+	if len(uaid) == 0 {
+		return ErrNoID
+	}
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	ms := t.UnixNano() / int64(time.Millisecond)
+	return s.client.Set(&mc.Item{
+		Key:        s.ConnectPrefix + uaid,
+		Value:      []byte(strconv.FormatInt(ms, 10)),
+		Expiration: int32(s.TimeoutLive.Seconds()),
+	})
+}
+
+// FetchRegion returns the region tag of the given device ID, or an empty
+// string if the device is untagged. Implements ResidencyStore.FetchRegion().
+func (s *GomemcStore) FetchRegion(uaid string) (region string, err error) {
+	defer s.ops.Done("fetch_region", "", timeNow(), &err)
+	if len(uaid) == 0 {
+		return "", ErrNoID
+	}
+	if !id.Valid(uaid) {
+		return "", ErrInvalidID
+	}
+	raw, err := s.regions.Get(s.RegionPrefix + uaid)
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(raw.Value), nil
+}
+
+// PutRegion tags the given device ID with region. Tags are stored on the
+// region servers, and do not expire. Implements ResidencyStore.PutRegion().
+func (s *GomemcStore) PutRegion(uaid, region string) (err error) {
+	defer s.ops.Done("put_region", "", timeNow(), &err)
+	if len(uaid) == 0 {
+		return ErrNoID
+	}
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	return s.regions.Set(&mc.Item{
+		Key:   s.RegionPrefix + uaid,
+		Value: []byte(region),
+	})
+}
+
+// FetchTenant returns the tenant of the given device ID, or an empty string
+// if the device is untagged. Implements TenantStore.FetchTenant().
+func (s *GomemcStore) FetchTenant(uaid string) (tenant string, err error) {
+	defer s.ops.Done("fetch_tenant", s.shard(s.TenantPrefix+uaid), timeNow(), &err)
+	if len(uaid) == 0 {
+		return "", ErrNoID
+	}
+	if !id.Valid(uaid) {
+		return "", ErrInvalidID
+	}
+	raw, err := s.client.Get(s.TenantPrefix + uaid)
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(raw.Value), nil
+}
+
+// PutTenant tags the given device ID with tenant. Tags do not expire.
+// Implements TenantStore.PutTenant().
+func (s *GomemcStore) PutTenant(uaid, tenant string) (err error) {
+	defer s.ops.Done("put_tenant", s.shard(s.TenantPrefix+uaid), timeNow(), &err)
+	if len(uaid) == 0 {
+		return ErrNoID
+	}
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	return s.client.Set(&mc.Item{
+		Key:   s.TenantPrefix + uaid,
+		Value: []byte(tenant),
+	})
+}
+
+// PutPayload stores the update data for the given channel version, and flags
+// the channel record so that the data is only fetched for that version. Only
+// the latest version's data is kept: data for a version older than the
+// stored record or payload is rejected with ErrStaleVersion. Implements
+// PayloadStore.PutPayload().
+func (s *GomemcStore) PutPayload(uaid, chid string, version int64,
+	data string) (err error) {
+
+	defer s.ops.Done("put_payload", s.shard(uaid), timeNow(), &err)
+	if len(uaid) == 0 {
+		return ErrNoID
+	}
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	if !id.Valid(chid) {
+		return ErrInvalidChannel
+	}
+	raw, err := s.codec.Marshal(&Update{
+		ChannelID: chid,
+		Version:   uint64(version),
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+	key := joinIDs(uaid, chid)
+	cRec, item, err := s.fetchRecItem(key)
+	if err != nil {
+		return err
+	}
+	if item != nil && cRec.Version > uint64(version) {
+		return ErrStaleVersion
+	}
+	if err = s.swapPayload(key, uint64(version), raw); err != nil {
+		return err
+	}
+	return s.flagPayload(key, uint64(version))
+}
+
+// swapPayload replaces the stored update data for a channel with raw, unless
+// the stored data is for a newer version.
+func (s *GomemcStore) swapPayload(key string, version uint64,
+	raw []byte) error {
+
+	expiration := int32(s.TimeoutLive.Seconds())
+	for attempt := 0; attempt < 3; attempt++ {
+		item, err := s.client.Get(s.PayloadPrefix + key)
+		if err == nil {
+			stored := new(Update)
+			if err = s.codec.Unmarshal(item.Value, stored); err != nil {
+				return err
+			}
+			if stored.Version > version {
+				return ErrStaleVersion
+			}
+			item.Value = raw
+			item.Expiration = expiration
+			err = s.client.CompareAndSwap(item)
+		} else if err == mc.ErrCacheMiss {
+			// Fails if a concurrent update stores its data first.
+			err = s.client.Add(&mc.Item{Key: s.PayloadPrefix + key, Value: raw,
+				Expiration: expiration})
+		}
+		if err != mc.ErrCASConflict && err != mc.ErrNotStored {
+			return err
+		}
+	}
+	return ErrRecordUpdateFailed
+}
+
+// flagPayload marks the channel record as having data for version. The flag
+// survives later writes of the same version, so the payload may be stored
+// before or after the version. Records that don't exist are left unflagged;
+// storeUpdateExpires flags them when the version creates the record. Records
+// updated to a newer version are left unflagged, and ErrStaleVersion is
+// returned.
+func (s *GomemcStore) flagPayload(key string, version uint64) error {
+	for attempt := 0; attempt < 3; attempt++ {
+		cRec, item, err := s.fetchRecItem(key)
+		if err != nil || item == nil {
+			return err
+		}
+		if cRec.Version > version {
+			return ErrStaleVersion
+		}
+		if cRec.Payload == version {
+			return nil
+		}
+		cRec.Payload = version
+		if err = s.swapRec(item, cRec); err != ErrRecordUpdateFailed {
+			return err
+		}
+	}
+	return ErrRecordUpdateFailed
+}
+
+// payloadVersion returns the channel version of the stored update data, or 0
+// if the channel has no data.
+func (s *GomemcStore) payloadVersion(key string) (uint64, error) {
+	raw, err := s.client.Get(s.PayloadPrefix + key)
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return 0, nil
+		}
+		return 0, err
+	}
+	stored := new(Update)
+	if err = s.codec.Unmarshal(raw.Value, stored); err != nil {
+		return 0, err
+	}
+	return stored.Version, nil
+}
+
+// FetchPayloads returns the stored data for each update flagged with a
+// payload, reading all payloads at once. Implements
+// PayloadStore.FetchPayloads().
+func (s *GomemcStore) FetchPayloads(uaid string, updates []Update) (
+	data []string, err error) {
+
+	defer s.ops.Done("fetch_payloads", s.shard(uaid), timeNow(), &err)
+	if len(uaid) == 0 {
+		return nil, ErrNoID
+	}
+	if !id.Valid(uaid) {
+		return nil, ErrInvalidID
+	}
+	var keys []string
+	for _, update := range updates {
+		if update.Payload {
+			keys = append(keys, s.PayloadPrefix+joinIDs(uaid, update.ChannelID))
+		}
+	}
+	data = make([]string, len(updates))
+	if len(keys) == 0 {
+		return data, nil
+	}
+	items, err := s.client.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, update := range updates {
+		if !update.Payload {
+			continue
+		}
+		raw, ok := items[s.PayloadPrefix+joinIDs(uaid, update.ChannelID)]
+		if !ok {
+			continue
+		}
+		stored := new(Update)
+		if err = s.codec.Unmarshal(raw.Value, stored); err != nil {
+			return nil, err
+		}
+		if stored.Version == update.Version {
+			data[i] = stored.Data
+		}
+	}
+	return data, nil
+}
+
+// PutDeadLetter stores a failed update and appends it to the dead letter
+// index. Implements DeadLetterStore.PutDeadLetter().
+func (s *GomemcStore) PutDeadLetter(letter *DeadLetter) (err error) {
+	defer s.ops.Done("put_dead_letter", "", timeNow(), &err)
+	raw, err := s.codec.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	err = s.client.Set(&mc.Item{
+		Key:        s.DeadLetterPrefix + letter.ID,
+		Value:      raw,
+		Expiration: int32(s.TimeoutDeadLetter.Seconds()),
+	})
+	if err != nil {
+		return err
+	}
+	return s.updateDeadLetterIDs(func(letterIDs ChannelIDs) ChannelIDs {
+		return append(letterIDs, letter.ID)
+	})
+}
+
+// FetchDeadLetters returns up to limit failed updates, oldest first. Expired
+// records are removed from the dead letter index. Implements
+// DeadLetterStore.FetchDeadLetters().
+func (s *GomemcStore) FetchDeadLetters(limit int) (_ []*DeadLetter, err error) {
+	defer s.ops.Done("fetch_dead_letters", "", timeNow(), &err)
+	letterIDs, err := s.fetchDeadLetterIDs()
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]*DeadLetter, 0, len(letterIDs))
+	var expired ChannelIDs
+	for _, letterID := range letterIDs {
+		if limit > 0 && len(letters) >= limit {
+			break
+		}
+		letter, err := s.fetchDeadLetter(letterID)
+		if err != nil {
+			if err == ErrNoDeadLetter {
+				expired = append(expired, letterID)
+			}
+			continue
+		}
+		letters = append(letters, letter)
+	}
+	if len(expired) > 0 {
+		err = s.updateDeadLetterIDs(func(letterIDs ChannelIDs) ChannelIDs {
+			live := make(ChannelIDs, 0, len(letterIDs))
+			for _, letterID := range letterIDs {
+				if expired.IndexOf(letterID) < 0 {
+					live = append(live, letterID)
+				}
+			}
+			return live
+		})
+		if err != nil && s.logger.ShouldLog(WARNING) {
+			s.logger.Warn("gomemc", "Could not remove expired dead letters",
+				LogFields{"error": err.Error()})
+		}
+	}
+	return letters, nil
+}
+
+// FetchDeadLetter returns the failed update with the given ID. Implements
+// DeadLetterStore.FetchDeadLetter().
+func (s *GomemcStore) FetchDeadLetter(letterID string) (
+	letter *DeadLetter, err error) {
+
+	defer s.ops.Done("fetch_dead_letter", "", timeNow(), &err)
+	return s.fetchDeadLetter(letterID)
+}
+
+// fetchDeadLetter implements FetchDeadLetter.
+func (s *GomemcStore) fetchDeadLetter(letterID string) (*DeadLetter, error) {
+	if !id.Valid(letterID) {
+		return nil, ErrNoDeadLetter
+	}
+	raw, err := s.client.Get(s.DeadLetterPrefix + letterID)
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return nil, ErrNoDeadLetter
+		}
+		return nil, err
+	}
+	letter := new(DeadLetter)
+	if err = s.codec.Unmarshal(raw.Value, letter); err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+// DropDeadLetter removes a failed update and its index entry. Implements
+// DeadLetterStore.DropDeadLetter().
+func (s *GomemcStore) DropDeadLetter(letterID string) (err error) {
+	defer s.ops.Done("drop_dead_letter", "", timeNow(), &err)
+	if !id.Valid(letterID) {
+		return ErrNoDeadLetter
+	}
+	err = s.client.Delete(s.DeadLetterPrefix + letterID)
+	if err != nil && err != mc.ErrCacheMiss {
+		return err
+	}
+	return s.updateDeadLetterIDs(func(letterIDs ChannelIDs) ChannelIDs {
+		if pos := letterIDs.IndexOf(letterID); pos >= 0 {
+			return remove(letterIDs, pos)
+		}
+		return letterIDs
+	})
+}
+
+// fetchDeadLetterIDs returns the IDs of all queued failed updates, in the
+// order they were added.
+func (s *GomemcStore) fetchDeadLetterIDs() (letterIDs ChannelIDs, err error) {
+	raw, err := s.client.Get(s.DeadLetterPrefix + "index")
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err = s.codec.Unmarshal(raw.Value, &letterIDs); err != nil {
+		return nil, err
+	}
+	return letterIDs, nil
+}
+
+// updateDeadLetterIDs replaces the dead letter index with the result of f.
+// The index is shared by all nodes, so it's swapped instead of set, and f is
+// called again if another node changes the index first. The index expires
+// with the last letter added to it.
+func (s *GomemcStore) updateDeadLetterIDs(f func(ChannelIDs) ChannelIDs) error {
+	return s.swapIndex(s.DeadLetterPrefix+"index",
+		int32(s.TimeoutDeadLetter.Seconds()), f)
+}
+
+// swapIndex replaces the ID list stored at key with the result of f, using
+// compare-and-swap so that concurrent changes from other nodes aren't lost.
+// Returns ErrRecordUpdateFailed if the list keeps changing.
+func (s *GomemcStore) swapIndex(key string, expiration int32,
+	f func(ChannelIDs) ChannelIDs) error {
+
+	for attempt := 0; attempt < maxIndexSwaps; attempt++ {
+		var ids ChannelIDs
+		raw, err := s.client.Get(key)
+		if err == nil {
+			if err = s.codec.Unmarshal(raw.Value, &ids); err != nil {
+				return err
+			}
+		} else if err != mc.ErrCacheMiss {
+			return err
+		}
+		value, err := s.codec.Marshal(f(ids))
+		if err != nil {
+			return err
+		}
+		if raw == nil {
+			// Fails if another node creates the index first.
+			err = s.client.Add(&mc.Item{Key: key, Value: value,
+				Expiration: expiration})
+		} else {
+			raw.Value = value
+			raw.Expiration = expiration
+			err = s.client.CompareAndSwap(raw)
+		}
+		if err != mc.ErrCASConflict && err != mc.ErrNotStored {
+			return err
+		}
+	}
+	return ErrRecordUpdateFailed
+}
+
+// PutBan stores a ban until it expires, and adds it to the ban index.
+// Implements BanStore.PutBan().
+func (s *GomemcStore) PutBan(ban *Ban) (err error) {
+	defer s.ops.Done("put_ban", "", timeNow(), &err)
+	ttl := ban.Expires - timeNow().Unix()
+	if ttl <= 0 {
+		return ErrInvalidBan
+	}
+	raw, err := s.codec.Marshal(ban)
+	if err != nil {
+		return err
+	}
+	key := ban.Key()
+	err = s.client.Set(&mc.Item{
+		Key:        s.BanPrefix + key,
+		Value:      raw,
+		Expiration: int32(ttl),
+	})
+	if err != nil {
+		return err
+	}
+	return s.swapIndex(s.BanPrefix+"index", 0,
+		func(keys ChannelIDs) ChannelIDs {
+			if keys.IndexOf(key) >= 0 {
+				return keys
+			}
+			return append(keys, key)
+		})
+}
+
+// FetchBans returns all active bans. Expired bans are removed from the ban
+// index. Implements BanStore.FetchBans().
+func (s *GomemcStore) FetchBans() (_ []*Ban, err error) {
+	defer s.ops.Done("fetch_bans", "", timeNow(), &err)
+	keys, err := s.fetchBanKeys()
+	if err != nil {
+		return nil, err
+	}
+	bans := make([]*Ban, 0, len(keys))
+	var expired ChannelIDs
+	for _, key := range keys {
+		ban, err := s.fetchBan(key)
+		if err != nil {
+			if err == ErrNoBan {
+				expired = append(expired, key)
+				continue
+			}
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+	if len(expired) > 0 {
+		// Bans added concurrently are kept.
+		if err = s.dropBanKeys(expired); err != nil {
+			return nil, err
+		}
+	}
+	return bans, nil
+}
+
+// FetchBan returns the ban with the given key. Implements
+// BanStore.FetchBan().
+func (s *GomemcStore) FetchBan(key string) (ban *Ban, err error) {
+	defer s.ops.Done("fetch_ban", "", timeNow(), &err)
+	return s.fetchBan(key)
+}
+
+// fetchBan implements FetchBan.
+func (s *GomemcStore) fetchBan(key string) (*Ban, error) {
+	raw, err := s.client.Get(s.BanPrefix + key)
+	if err != nil {
+		if err == mc.ErrCacheMiss || err == mc.ErrMalformedKey {
+			return nil, ErrNoBan
+		}
+		return nil, err
+	}
+	ban := new(Ban)
+	if err = s.codec.Unmarshal(raw.Value, ban); err != nil {
+		return nil, err
+	}
+	return ban, nil
+}
+
+// DropBan removes a ban and its index entry. Implements BanStore.DropBan().
+func (s *GomemcStore) DropBan(key string) (err error) {
+	defer s.ops.Done("drop_ban", "", timeNow(), &err)
+	err = s.client.Delete(s.BanPrefix + key)
+	if err != nil {
+		if err == mc.ErrCacheMiss || err == mc.ErrMalformedKey {
+			return ErrNoBan
+		}
+		return err
+	}
+	return s.dropBanKeys(ChannelIDs{key})
+}
+
+// fetchBanKeys returns the keys of all stored bans.
+func (s *GomemcStore) fetchBanKeys() (keys ChannelIDs, err error) {
+	raw, err := s.client.Get(s.BanPrefix + "index")
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err = s.codec.Unmarshal(raw.Value, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// dropBanKeys removes keys from the ban index.
+func (s *GomemcStore) dropBanKeys(dropped ChannelIDs) error {
+	return s.swapIndex(s.BanPrefix+"index", 0,
+		func(keys ChannelIDs) ChannelIDs {
+			live := make(ChannelIDs, 0, len(keys))
+			for _, key := range keys {
+				if dropped.IndexOf(key) < 0 {
+					live = append(live, key)
+				}
+			}
+			return live
+		})
+}
+
+// PutAPIKey stores an API key without expiration, and adds it to the key
+// index. Implements APIKeyStore.PutAPIKey().
+func (s *GomemcStore) PutAPIKey(key *APIKey) (err error) {
+	defer s.ops.Done("put_api_key", "", timeNow(), &err)
+	raw, err := s.codec.Marshal(key)
+	if err != nil {
+		return err
+	}
+	err = s.client.Set(&mc.Item{
+		Key:   s.APIKeyPrefix + key.ID,
+		Value: raw,
+	})
+	if err != nil {
+		return err
+	}
+	return s.swapIndex(s.APIKeyPrefix+"index", 0,
+		func(keyIDs ChannelIDs) ChannelIDs {
+			if keyIDs.IndexOf(key.ID) >= 0 {
+				return keyIDs
+			}
+			return append(keyIDs, key.ID)
+		})
+}
+
+// FetchAPIKeys returns all API keys. Evicted keys are removed from the key
+// index. Implements APIKeyStore.FetchAPIKeys().
+func (s *GomemcStore) FetchAPIKeys() (_ []*APIKey, err error) {
+	defer s.ops.Done("fetch_api_keys", "", timeNow(), &err)
+	keyIDs, err := s.fetchAPIKeyIDs()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*APIKey, 0, len(keyIDs))
+	var evicted ChannelIDs
+	for _, keyID := range keyIDs {
+		key, err := s.fetchAPIKey(keyID)
+		if err != nil {
+			if err == ErrNoAPIKey {
+				evicted = append(evicted, keyID)
+				continue
+			}
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(evicted) > 0 {
+		// Keys added concurrently are kept.
+		err = s.swapIndex(s.APIKeyPrefix+"index", 0,
+			func(keyIDs ChannelIDs) ChannelIDs {
+				live := make(ChannelIDs, 0, len(keyIDs))
+				for _, keyID := range keyIDs {
+					if evicted.IndexOf(keyID) < 0 {
+						live = append(live, keyID)
+					}
+				}
+				return live
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// FetchAPIKey returns the API key with the given ID. Implements
+// APIKeyStore.FetchAPIKey().
+func (s *GomemcStore) FetchAPIKey(id string) (key *APIKey, err error) {
+	defer s.ops.Done("fetch_api_key", "", timeNow(), &err)
+	return s.fetchAPIKey(id)
+}
+
+// fetchAPIKey implements FetchAPIKey.
+func (s *GomemcStore) fetchAPIKey(id string) (*APIKey, error) {
+	raw, err := s.client.Get(s.APIKeyPrefix + id)
+	if err != nil {
+		if err == mc.ErrCacheMiss || err == mc.ErrMalformedKey {
+			return nil, ErrNoAPIKey
+		}
+		return nil, err
+	}
+	key := new(APIKey)
+	if err = s.codec.Unmarshal(raw.Value, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// fetchAPIKeyIDs returns the IDs of all stored API keys.
+func (s *GomemcStore) fetchAPIKeyIDs() (keyIDs ChannelIDs, err error) {
+	raw, err := s.client.Get(s.APIKeyPrefix + "index")
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err = s.codec.Unmarshal(raw.Value, &keyIDs); err != nil {
+		return nil, err
+	}
+	return keyIDs, nil
+}
+
+// HasTombstone indicates whether the channel ID associated with the given
+// device ID was recently unregistered. Implements TombstoneStore.HasTombstone().
+func (s *GomemcStore) HasTombstone(uaid, chid string) (_ bool, err error) {
+	defer s.ops.Done("has_tombstone", s.shard(uaid), timeNow(), &err)
+	if len(uaid) == 0 {
+		return false, ErrNoID
+	}
+	if len(chid) == 0 {
+		return false, ErrNoChannel
+	}
+	if !id.Valid(uaid) {
+		return false, ErrInvalidID
+	}
+	if !id.Valid(chid) {
+		return false, ErrInvalidChannel
+	}
+	return s.hasTombstone(joinIDs(uaid, chid))
+}
+
+// storeTombstone marks a channel as recently unregistered.
+func (s *GomemcStore) storeTombstone(pk string) error {
+	return s.storeTombstoneAt(pk, timeNow().UTC().Unix())
+}
+
+// storeTombstoneAt records that a channel was unregistered at the given
+// time, in seconds since Epoch.
+func (s *GomemcStore) storeTombstoneAt(pk string, at int64) error {
+	if s.TimeoutTombstone <= 0 {
+		return nil
+	}
+	return s.client.Set(&mc.Item{
+		Key:        s.TombstonePrefix + pk,
+		Value:      []byte(strconv.FormatInt(at, 10)),
+		Expiration: int32(s.TimeoutTombstone.Seconds()),
+	})
+}
+
+// tombstoneTime returns the time that a channel was unregistered, in seconds
+// since Epoch, or 0 if the channel has no tombstone.
+func (s *GomemcStore) tombstoneTime(pk string) (int64, error) {
+	if s.TimeoutTombstone <= 0 {
+		return 0, nil
+	}
+	raw, err := s.client.Get(s.TombstonePrefix + pk)
+	if err != nil {
+		if err == mc.ErrCacheMiss {
+			return 0, nil
+		}
+		return 0, err
+	}
+	at, _ := strconv.ParseInt(string(raw.Value), 10, 64)
+	return at, nil
+}
+
+// storeRegistered records the time that a channel was registered, in seconds
+// since Epoch. Unlike the channel record, which is dropped when its update is
+// acknowledged, the registration time is kept until the channel is
+// unregistered.
+func (s *GomemcStore) storeRegistered(pk string, at int64) error {
+	return s.client.Set(&mc.Item{
+		Key:        s.RegisteredPrefix + pk,
+		Value:      []byte(strconv.FormatInt(at, 10)),
+		Expiration: 0,
+	})
+}
+
+// registeredTime returns the time that a channel was registered, in seconds
+// since Epoch. Channels registered before registration times were recorded
+// fall back to the creation time in the channel record, or 0 if the record
+// was dropped.
+func (s *GomemcStore) registeredTime(pk string) (int64, error) {
+	raw, err := s.client.Get(s.RegisteredPrefix + pk)
+	if err == nil {
+		at, _ := strconv.ParseInt(string(raw.Value), 10, 64)
+		return at, nil
+	}
+	if err != mc.ErrCacheMiss {
+		return 0, err
+	}
+	rec, err := s.fetchRec(pk)
+	if err != nil {
+		return 0, err
+	}
+	return rec.Created, nil
+}
+
+// dropRegistered removes a channel's registration time.
+func (s *GomemcStore) dropRegistered(pk string) error {
+	err := s.client.Delete(s.RegisteredPrefix + pk)
+	if err != nil && err != mc.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// hasTombstone indicates whether a channel was recently unregistered.
+func (s *GomemcStore) hasTombstone(pk string) (bool, error) {
+	if s.TimeoutTombstone <= 0 {
+		return false, nil
+	}
+	if _, err := s.client.Get(s.TombstonePrefix + pk); err != nil {
+		if err == mc.ErrCacheMiss {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Returns a duplicate-free list of subscriptions associated with the device
+// ID.
+func (s *GomemcStore) fetchAppIDArray(uaid string) (result ChannelIDs, err error) {
+	if len(uaid) == 0 {
 		return nil, nil
 	}
 	raw, err := s.client.Get(uaid)
@@ -575,9 +2253,10 @@ func (s *GomemcStore) fetchAppIDArray(uaid string) (result ChannelIDs, err error
 		}
 		return nil, err
 	}
-	if err = json.Unmarshal(raw.Value, &result); err != nil {
+	if err = s.codec.Unmarshal(raw.Value, &result); err != nil {
 		return result, err
 	}
+	s.migrate(raw, result, 0)
 	return
 }
 
@@ -595,7 +2274,7 @@ func (s *GomemcStore) storeAppIDArray(uaid string, chids ChannelIDs) error {
 			chids = remove(chids, i+dup)
 		}
 	}
-	raw, err := json.Marshal(chids)
+	raw, err := s.codec.Marshal(chids)
 	if err != nil {
 		if s.logger.ShouldLog(ERROR) {
 			s.logger.Error("gomemc", "Could not marshal AppIDArray", LogFields{"error": err.Error()})
@@ -608,6 +2287,13 @@ func (s *GomemcStore) storeAppIDArray(uaid string, chids ChannelIDs) error {
 // Retrieves a channel record from memcached. Returns an empty record if the
 // channel does not exist.
 func (s *GomemcStore) fetchRec(pk string) (*ChannelRecord, error) {
+	result, _, err := s.fetchRecItem(pk)
+	return result, err
+}
+
+// fetchRecItem retrieves a channel record and the underlying memcached item,
+// for use with swapRec. The item is nil if the record does not exist.
+func (s *GomemcStore) fetchRecItem(pk string) (*ChannelRecord, *mc.Item, error) {
 	result := new(ChannelRecord)
 	raw, err := s.client.Get(pk)
 	if err != nil {
@@ -618,16 +2304,20 @@ func (s *GomemcStore) fetchRec(pk string) (*ChannelRecord, error) {
 					"error": err.Error(),
 				})
 			}
-			return nil, err
+			return nil, nil, err
 		}
-	} else if err = json.Unmarshal(raw.Value, result); err != nil {
+		raw = nil
+	} else if err = s.codec.Unmarshal(raw.Value, result); err != nil {
 		if s.logger.ShouldLog(ERROR) {
 			s.logger.Error("gomemc", "Could not unmarshal rec", LogFields{
 				"pk":    pk,
 				"error": err.Error(),
 			})
 		}
-		return nil, err
+		return nil, nil, err
+	}
+	if raw != nil {
+		s.migrate(raw, result, s.recTTL(result.State))
 	}
 	if s.logger.ShouldLog(DEBUG) {
 		s.logger.Debug("gomemc", "Fetched", LogFields{
@@ -635,45 +2325,143 @@ func (s *GomemcStore) fetchRec(pk string) (*ChannelRecord, error) {
 			"result": fmt.Sprintf("state: %s, vers: %d, last: %d", result.State, result.Version, result.LastTouched),
 		})
 	}
-	return result, nil
+	return result, raw, nil
 }
 
 // Stores an updated channel record in memcached.
 func (s *GomemcStore) storeRec(pk string, rec *ChannelRecord) error {
-	var ttl time.Duration
-	switch rec.State {
-	case StateDeleted:
-		ttl = s.TimeoutDel
-	case StateRegistered:
-		ttl = s.TimeoutReg
-	default:
-		ttl = s.TimeoutLive
-	}
-	rec.LastTouched = time.Now().UTC().Unix()
-	raw, err := json.Marshal(rec)
+	item, err := s.recItem(pk, rec)
 	if err != nil {
+		return err
+	}
+	if err = s.client.Set(item); err != nil {
 		if s.logger.ShouldLog(ERROR) {
-			s.logger.Error("gomemc", "Failure to marshal item", LogFields{
+			s.logger.Error("gomemc", "Failure to set item", LogFields{
 				"pk":    pk,
 				"error": err.Error(),
 			})
 		}
+	}
+	return nil
+}
+
+// swapRec replaces a channel record retrieved with fetchRecItem. Returns
+// ErrRecordUpdateFailed if the record was changed or removed since it was
+// retrieved.
+func (s *GomemcStore) swapRec(item *mc.Item, rec *ChannelRecord) error {
+	newItem, err := s.recItem(item.Key, rec)
+	if err != nil {
 		return err
 	}
-	err = s.client.Set(&mc.Item{
-		Key:        pk,
-		Value:      raw,
-		Expiration: int32(ttl.Seconds()),
-	})
+	item.Value = newItem.Value
+	item.Expiration = newItem.Expiration
+	if err = s.client.CompareAndSwap(item); err != nil {
+		if s.logger.ShouldLog(WARNING) {
+			s.logger.Warn("gomemc", "Failure to swap item", LogFields{
+				"pk":    item.Key,
+				"error": err.Error(),
+			})
+		}
+		if err == mc.ErrCASConflict || err == mc.ErrNotStored {
+			return ErrRecordUpdateFailed
+		}
+		return err
+	}
+	return nil
+}
+
+// recItem encodes a channel record as a memcached item, using the timeout
+// for the record state.
+func (s *GomemcStore) recItem(pk string, rec *ChannelRecord) (*mc.Item, error) {
+	ttl := s.recTTL(rec.State)
+	rec.LastTouched = timeNow().UTC().Unix()
+	raw, err := s.codec.Marshal(rec)
 	if err != nil {
 		if s.logger.ShouldLog(ERROR) {
-			s.logger.Error("gomemc", "Failure to set item", LogFields{
+			s.logger.Error("gomemc", "Failure to marshal item", LogFields{
 				"pk":    pk,
 				"error": err.Error(),
 			})
 		}
+		return nil, err
 	}
-	return nil
+	return &mc.Item{
+		Key:        pk,
+		Value:      raw,
+		Expiration: int32(ttl.Seconds()),
+	}, nil
+}
+
+// shard returns the name of the memcached server that holds key: the index
+// of the server in the host list. Returns an empty string if operation
+// metrics are disabled.
+func (s *GomemcStore) shard(key string) string {
+	if s.ops == nil {
+		return ""
+	}
+	addr, err := s.servers.PickServer(key)
+	if err != nil {
+		return ""
+	}
+	return s.shards[addr.String()]
+}
+
+// classifyGomemcErr returns the class of a memcached adapter error, for
+// operation metrics.
+func classifyGomemcErr(err error) string {
+	if err == mc.ErrCacheMiss {
+		return StoreErrNotFound
+	}
+	if _, ok := err.(*mc.ConnectTimeoutError); ok {
+		return StoreErrTimeout
+	}
+	return ClassifyStoreError(err)
+}
+
+// recTTL returns the timeout for a channel record in the given state.
+func (s *GomemcStore) recTTL(state ChannelState) time.Duration {
+	switch state {
+	case StateDeleted:
+		return s.TimeoutDel
+	case StateRegistered:
+		return s.TimeoutReg
+	}
+	return s.TimeoutLive
+}
+
+// migrate queues a record read with an older schema version for rewriting
+// with the current version. v is the decoded record, and ttl is the record
+// timeout; rewritten records expire ttl after they are rewritten.
+func (s *GomemcStore) migrate(raw *mc.Item, v interface{}, ttl time.Duration) {
+	if s.migrator == nil || !s.codec.Stale(raw.Value) {
+		return
+	}
+	value, err := s.codec.Marshal(v)
+	if err != nil {
+		return
+	}
+	// Copied, since the item may be reused by the caller for a swap.
+	item := *raw
+	s.migrator.Add(&staleRecord{
+		key:   raw.Key,
+		value: value,
+		ttl:   int32(ttl.Seconds()),
+		item:  &item,
+	})
+}
+
+// rewrite replaces a stale record, unless the record changed after it was
+// read. Implements migrateBackend.rewrite().
+func (s *GomemcStore) rewrite(record *staleRecord) error {
+	item := record.item.(*mc.Item)
+	item.Value = record.value
+	item.Expiration = record.ttl
+	err := s.client.CompareAndSwap(item)
+	if err == mc.ErrCASConflict || err == mc.ErrNotStored {
+		// Rewritten with the current version by another writer, or removed.
+		return nil
+	}
+	return err
 }
 
 func init() {
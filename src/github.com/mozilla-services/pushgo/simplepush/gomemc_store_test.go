@@ -6,6 +6,7 @@ package simplepush
 
 import (
 	"bytes"
+	"encoding/json"
 	"net"
 	"testing"
 	"time"
@@ -88,6 +89,11 @@ func setup(t *testing.T) (testGm *GomemcStore, connected bool) {
 	return testGm, true
 }
 
+// dropTombstone removes the tombstone for an unregistered test channel.
+func dropTombstone(testGm *GomemcStore, uaid, chid string) {
+	testGm.client.Delete(testGm.TombstonePrefix + joinIDs(uaid, chid))
+}
+
 func Test_Status(t *testing.T) {
 	testGm, connected := setup(t)
 	if !connected {
@@ -259,6 +265,7 @@ func Test_storeUnregister(t *testing.T) {
 		t.Error("storeUnregistered failed to remove key")
 	}
 
+	dropTombstone(testGm, TESTUAID, TESTCHID)
 	testGm.DropAll(TESTUAID)
 }
 
@@ -287,9 +294,101 @@ func Test_Unregister(t *testing.T) {
 	if testGm.Unregister(TESTUAID, "Invalid") != ErrInvalidChannel {
 		t.Error("Unregister failed to reject invalid Channel")
 	}
+	dropTombstone(testGm, TESTUAID, TESTCHID)
+	testGm.DropAll(TESTUAID)
+}
+
+func Test_Tombstone(t *testing.T) {
+	testGm, connected := setup(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+
+	testGm.Register(TESTUAID, TESTCHID, 12345)
+	if err := testGm.Unregister(TESTUAID, TESTCHID); err != nil {
+		t.Errorf("Unregister returned error: %v", err)
+	}
+	if err := testGm.Unregister(TESTUAID, TESTCHID); err != ErrChannelGone {
+		t.Errorf("Unregister failed to reject unregistered channel: %v", err)
+	}
+	if err := testGm.Update(TESTUAID, TESTCHID, 67890); err != ErrChannelGone {
+		t.Errorf("Update failed to reject unregistered channel: %v", err)
+	}
+	if err := testGm.Register(TESTUAID, TESTCHID, 0); err != ErrChannelGone {
+		t.Errorf("Register failed to reject unregistered channel: %v", err)
+	}
+	if gone, err := testGm.HasTombstone(TESTUAID, TESTCHID); !gone || err != nil {
+		t.Errorf("HasTombstone failed to find tombstone: %v", err)
+	}
+	// Tombstones are kept after the record is dropped.
+	testGm.Drop(TESTUAID, TESTCHID)
+	if err := testGm.Update(TESTUAID, TESTCHID, 67890); err != ErrChannelGone {
+		t.Errorf("Update resurrected dropped channel: %v", err)
+	}
+	dropTombstone(testGm, TESTUAID, TESTCHID)
 	testGm.DropAll(TESTUAID)
 }
 
+func Test_Bans(t *testing.T) {
+	testGm, connected := setup(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+
+	ban := &Ban{Kind: BanUAID, Value: TESTUAID, Reason: "crash",
+		Expires: timeNow().Add(time.Minute).Unix()}
+	if err := testGm.PutBan(ban); err != nil {
+		t.Fatalf("PutBan returned error: %v", err)
+	}
+	if actual, err := testGm.FetchBan(ban.Key()); err != nil || actual.Reason != "crash" {
+		t.Errorf("FetchBan returned wrong ban: %#v, %v", actual, err)
+	}
+	bans, err := testGm.FetchBans()
+	if err != nil || len(bans) != 1 {
+		t.Errorf("FetchBans returned wrong bans: %#v, %v", bans, err)
+	}
+	if err = testGm.DropBan(ban.Key()); err != nil {
+		t.Errorf("DropBan returned error: %v", err)
+	}
+	if _, err = testGm.FetchBan(ban.Key()); err != ErrNoBan {
+		t.Errorf("FetchBan returned dropped ban: %v", err)
+	}
+	if err = testGm.DropBan(ban.Key()); err != ErrNoBan {
+		t.Errorf("DropBan failed to reject missing ban: %v", err)
+	}
+	ban.Expires = timeNow().Unix()
+	if err = testGm.PutBan(ban); err != ErrInvalidBan {
+		t.Errorf("PutBan failed to reject expired ban: %v", err)
+	}
+}
+
+func Test_APIKeys(t *testing.T) {
+	testGm, connected := setup(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+
+	key := &APIKey{ID: "0123456789abcdef", Tenant: "acme", Hash: "abc",
+		RateLimit: 10}
+	if err := testGm.PutAPIKey(key); err != nil {
+		t.Fatalf("PutAPIKey returned error: %v", err)
+	}
+	if actual, err := testGm.FetchAPIKey(key.ID); err != nil || actual.Tenant != "acme" {
+		t.Errorf("FetchAPIKey returned wrong key: %#v, %v", actual, err)
+	}
+	key.RevokedAt = timeNow().Unix()
+	if err := testGm.PutAPIKey(key); err != nil {
+		t.Fatalf("PutAPIKey returned error: %v", err)
+	}
+	keys, err := testGm.FetchAPIKeys()
+	if err != nil || len(keys) != 1 || !keys[0].Revoked() {
+		t.Errorf("FetchAPIKeys returned wrong keys: %#v, %v", keys, err)
+	}
+	if _, err = testGm.FetchAPIKey("missing"); err != ErrNoAPIKey {
+		t.Errorf("FetchAPIKey returned missing key: %v", err)
+	}
+}
+
 func Test_Drop(t *testing.T) {
 	testGm, connected := setup(t)
 	if !connected {
@@ -344,9 +443,418 @@ func Test_FetchAll(t *testing.T) {
 	if len(updates) != 0 {
 		t.Error("FetchAll found deleted record")
 	}
+	dropTombstone(testGm, TESTUAID, TESTCHID)
 	testGm.DropAll(TESTUAID)
 }
 
+func Test_UpdateExpires(t *testing.T) {
+	testGm, connected := setup(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testGm.DropAll(TESTUAID)
+
+	testGm.Register(TESTUAID, TESTCHID, 0)
+	err := testGm.UpdateExpires(TESTUAID, TESTCHID, 12345,
+		time.Now().Add(-time.Second))
+	if err != nil {
+		t.Errorf("UpdateExpires returned error: %v", err)
+	}
+	key, _ := testGm.IDsToKey(TESTUAID, TESTCHID)
+	updates, expired, err := testGm.PeekAll(TESTUAID)
+	if err != nil || len(updates) != 0 || len(expired) != 0 {
+		t.Errorf("PeekAll returned expired update: %v, %v, %v",
+			updates, expired, err)
+	}
+	if rec, _ := testGm.fetchRec(key); rec.State != StateLive {
+		t.Errorf("PeekAll discarded expired update: %v", rec)
+	}
+	updates, expired, err = testGm.FetchAll(TESTUAID, time.Time{})
+	if err != nil || len(updates) != 0 || len(expired) != 0 {
+		t.Errorf("FetchAll returned expired update: %v, %v, %v",
+			updates, expired, err)
+	}
+	rec, err := testGm.fetchRec(key)
+	if err != nil || rec.State != StateRegistered || rec.Version != 12345 {
+		t.Errorf("FetchAll failed to discard expired update: %v, %v", rec, err)
+	}
+
+	err = testGm.UpdateExpires(TESTUAID, TESTCHID, 67890,
+		time.Now().Add(time.Minute))
+	if err != nil {
+		t.Errorf("UpdateExpires returned error: %v", err)
+	}
+	updates, _, _ = testGm.FetchAll(TESTUAID, time.Time{})
+	if len(updates) != 1 || updates[0].Version != 67890 {
+		t.Errorf("FetchAll failed to return unexpired update: %v", updates)
+	}
+}
+
+func Test_PruneAfter(t *testing.T) {
+	testGm, connected := setup(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testGm.DropAll(TESTUAID)
+
+	defer saveTimeFuncs()()
+	testGm.PruneAfter = 1 * time.Hour
+	defer func() { testGm.PruneAfter = 0 }()
+
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	otherChid := "decafbad-0123-4567-89ab-cdef01234568"
+	testGm.Register(TESTUAID, TESTCHID, 0)
+	testGm.Register(TESTUAID, otherChid, 0)
+	if err := testGm.Update(TESTUAID, TESTCHID, 12345); err != nil {
+		t.Errorf("Update returned error: %v", err)
+	}
+	updates, _, _ := testGm.FetchAll(TESTUAID, time.Time{})
+	if len(updates) != 1 {
+		t.Errorf("FetchAll pruned a recent update: %v", updates)
+	}
+
+	now = now.Add(1 * time.Minute)
+	if err := testGm.Update(TESTUAID, otherChid, 67890); err != nil {
+		t.Errorf("Update returned error: %v", err)
+	}
+	now = now.Add(2 * time.Hour)
+	updates, expired, err := testGm.FetchAll(TESTUAID, time.Time{})
+	if err != nil || len(updates) != 1 || len(expired) != 0 {
+		t.Errorf("FetchAll returned stale updates: %v, %v, %v",
+			updates, expired, err)
+	} else if updates[0].ChannelID != otherChid || updates[0].Version != 67890 {
+		t.Errorf("FetchAll pruned the newest update: %v", updates)
+	}
+	key, _ := testGm.IDsToKey(TESTUAID, TESTCHID)
+	rec, err := testGm.fetchRec(key)
+	if err != nil || rec.State != StateRegistered || rec.Version != 12345 {
+		t.Errorf("FetchAll failed to prune stale update: %v, %v", rec, err)
+	}
+}
+
+func Test_FetchChannels(t *testing.T) {
+	testGm, connected := setup(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testGm.DropAll(TESTUAID)
+
+	testGm.Register(TESTUAID, TESTCHID, 0)
+	chids, err := testGm.FetchChannels(TESTUAID)
+	if err != nil || len(chids) != 1 || chids[0] != TESTCHID {
+		t.Errorf("FetchChannels returned wrong channels: %v, %v", chids, err)
+	}
+	testGm.Unregister(TESTUAID, TESTCHID)
+	if chids, err = testGm.FetchChannels(TESTUAID); err != nil || len(chids) != 0 {
+		t.Errorf("FetchChannels returned unregistered channel: %v, %v",
+			chids, err)
+	}
+	dropTombstone(testGm, TESTUAID, TESTCHID)
+}
+
+func Test_DescribeChannels(t *testing.T) {
+	testGm, connected := setup(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testGm.DropAll(TESTUAID)
+
+	defer saveTimeFuncs()()
+	created := time.Unix(1257894000, 0)
+	timeNow = func() time.Time { return created }
+
+	testGm.Register(TESTUAID, TESTCHID, 0)
+	timeNow = func() time.Time { return created.Add(1 * time.Hour) }
+	testGm.Update(TESTUAID, TESTCHID, 10)
+	channels, err := testGm.DescribeChannels(TESTUAID)
+	if err != nil || len(channels) != 1 || channels[0].ChannelID != TESTCHID ||
+		channels[0].Created != created.Unix() {
+
+		t.Errorf("DescribeChannels returned wrong channels: %v, %v",
+			channels, err)
+	}
+	// Registration times are kept after acknowledged records are dropped.
+	testGm.Drop(TESTUAID, TESTCHID)
+	channels, err = testGm.DescribeChannels(TESTUAID)
+	if err != nil || len(channels) != 1 || channels[0].Created != created.Unix() {
+		t.Errorf("DescribeChannels returned wrong channels: %v, %v",
+			channels, err)
+	}
+}
+
+func Test_EraseDevice(t *testing.T) {
+	testGm, connected := setup(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testGm.DropAll(TESTUAID)
+
+	testGm.Register(TESTUAID, TESTCHID, 10)
+	testGm.PutPing(TESTUAID, []byte(`{"regid":"abc"}`))
+	erased, err := testGm.EraseDevice(TESTUAID)
+	// The channel record, registration time, channel index, and ping record.
+	if err != nil || erased != 4 {
+		t.Errorf("EraseDevice returned wrong count: %d, %v", erased, err)
+	}
+	if chids, _ := testGm.FetchChannels(TESTUAID); len(chids) != 0 {
+		t.Errorf("EraseDevice kept channels: %v", chids)
+	}
+	if _, err = testGm.FetchPing(TESTUAID); err == nil {
+		t.Error("EraseDevice kept ping data")
+	}
+	if erased, err = testGm.EraseDevice(TESTUAID); err != nil || erased != 0 {
+		t.Errorf("EraseDevice is not idempotent: %d, %v", erased, err)
+	}
+}
+
+func Test_ExportDevice(t *testing.T) {
+	testGm, connected := setup(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testGm.DropPing(TESTUAID)
+
+	app := NewApplication()
+	app.SetStore(testGm)
+	testGm.DropPing(TESTUAID)
+	export, err := ExportDevice(app, TESTUAID)
+	if err != nil || export.Ping != nil {
+		t.Errorf("ExportDevice returned ping data for unregistered device: %v, %v",
+			export, err)
+	}
+	testGm.PutPing(TESTUAID, []byte(`{"regid":"abc"}`))
+	if export, err = ExportDevice(app, TESTUAID); err != nil {
+		t.Fatalf("ExportDevice returned an error: %v", err)
+	}
+	body, _ := json.Marshal(export.Ping)
+	if string(body) != `{"regid":"abc"}` {
+		t.Errorf("ExportDevice returned wrong ping data: %s", body)
+	}
+}
+
+func Test_Payloads(t *testing.T) {
+	testGm, connected := setup(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testGm.DropAll(TESTUAID)
+
+	dropTombstone(testGm, TESTUAID, TESTCHID)
+	testGm.Register(TESTUAID, TESTCHID, 1)
+	testGm.Update(TESTUAID, TESTCHID, 2)
+	if err := testGm.PutPayload(TESTUAID, TESTCHID, 2, "hello"); err != nil {
+		t.Errorf("PutPayload returned an error: %v", err)
+	}
+	updates, _, err := testGm.FetchAll(TESTUAID, time.Time{})
+	if err != nil || len(updates) != 1 || !updates[0].Payload {
+		t.Fatalf("FetchAll did not flag the payload: %#v, %v", updates, err)
+	}
+	stale := Update{TESTCHID, 1, "", true}
+	data, err := testGm.FetchPayloads(TESTUAID, []Update{stale, updates[0]})
+	if err != nil || len(data) != 2 || data[0] != "" || data[1] != "hello" {
+		t.Errorf("FetchPayloads returned wrong data: %q, %v", data, err)
+	}
+	// A newer version without data clears the flag.
+	testGm.Update(TESTUAID, TESTCHID, 3)
+	if updates, _, _ = testGm.FetchAll(TESTUAID, time.Time{}); len(updates) != 1 ||
+		updates[0].Payload {
+
+		t.Errorf("FetchAll flagged a version without data: %#v", updates)
+	}
+	// Acknowledging the update clears its data.
+	if err := testGm.Drop(TESTUAID, TESTCHID); err != nil {
+		t.Errorf("Drop returned an error: %v", err)
+	}
+	data, err = testGm.FetchPayloads(TESTUAID, []Update{{TESTCHID, 2, "", true}})
+	if err != nil || data[0] != "" {
+		t.Errorf("Drop kept the payload: %q, %v", data, err)
+	}
+	// Data stored before the version is kept if the update creates the record
+	// again.
+	if err := testGm.PutPayload(TESTUAID, TESTCHID, 4, "again"); err != nil {
+		t.Errorf("PutPayload returned an error: %v", err)
+	}
+	testGm.Update(TESTUAID, TESTCHID, 4)
+	updates, _, err = testGm.FetchAll(TESTUAID, time.Time{})
+	if err != nil || len(updates) != 1 || !updates[0].Payload {
+		t.Fatalf("FetchAll dropped the payload for a dropped record: %#v, %v",
+			updates, err)
+	}
+	data, err = testGm.FetchPayloads(TESTUAID, updates)
+	if err != nil || data[0] != "again" {
+		t.Errorf("FetchPayloads returned wrong data: %q, %v", data, err)
+	}
+	// Data for a stale version doesn't replace the data of a newer one.
+	testGm.Update(TESTUAID, TESTCHID, 5)
+	if err := testGm.PutPayload(TESTUAID, TESTCHID, 5, "newer"); err != nil {
+		t.Errorf("PutPayload returned an error: %v", err)
+	}
+	if err := testGm.PutPayload(TESTUAID, TESTCHID, 4, "stale"); err != ErrStaleVersion {
+		t.Errorf("PutPayload accepted stale data: %v", err)
+	}
+	updates, _, err = testGm.FetchAll(TESTUAID, time.Time{})
+	if err != nil || len(updates) != 1 || !updates[0].Payload {
+		t.Fatalf("FetchAll unflagged the newer payload: %#v, %v", updates, err)
+	}
+	data, err = testGm.FetchPayloads(TESTUAID, updates)
+	if err != nil || data[0] != "newer" {
+		t.Errorf("Stale data replaced the newer payload: %q, %v", data, err)
+	}
+}
+
+func Test_Region(t *testing.T) {
+	testGm, connected := setup(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testGm.EraseDevice(TESTUAID)
+
+	if region, err := testGm.FetchRegion(TESTUAID); err != nil || region != "" {
+		t.Errorf("FetchRegion returned a tag for an untagged device: %q, %v",
+			region, err)
+	}
+	if err := testGm.PutRegion(TESTUAID, "eu"); err != nil {
+		t.Errorf("PutRegion returned an error: %v", err)
+	}
+	if region, err := testGm.FetchRegion(TESTUAID); err != nil || region != "eu" {
+		t.Errorf("FetchRegion returned the wrong region: %q, %v", region, err)
+	}
+	// Erasure removes the tag.
+	if _, err := testGm.EraseDevice(TESTUAID); err != nil {
+		t.Errorf("EraseDevice returned an error: %v", err)
+	}
+	if region, err := testGm.FetchRegion(TESTUAID); err != nil || region != "" {
+		t.Errorf("EraseDevice kept the region tag: %q, %v", region, err)
+	}
+}
+
+func Test_Routes(t *testing.T) {
+	testGm, connected := setup(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testGm.EraseDevice(TESTUAID)
+
+	nodeA, nodeB := "http://node-a:3000", "http://node-b:3000"
+	if err := testGm.PutRoute(TESTUAID, nodeA); err != nil {
+		t.Errorf("PutRoute returned an error: %v", err)
+	}
+	if node, err := testGm.FetchRoute(TESTUAID); err != nil || node != nodeA {
+		t.Errorf("FetchRoute returned the wrong node: %q, %v", node, err)
+	}
+	// Nodes can't drop routes recorded by other nodes.
+	if err := testGm.DropRoute(TESTUAID, nodeB); err != nil {
+		t.Errorf("DropRoute returned an error: %v", err)
+	}
+	if node, err := testGm.FetchRoute(TESTUAID); err != nil || node != nodeA {
+		t.Errorf("DropRoute removed another node's route: %q, %v", node, err)
+	}
+	if err := testGm.DropRoute(TESTUAID, nodeA); err != nil {
+		t.Errorf("DropRoute returned an error: %v", err)
+	}
+	if node, err := testGm.FetchRoute(TESTUAID); err != nil || node != "" {
+		t.Errorf("DropRoute kept the route: %q, %v", node, err)
+	}
+}
+
+func Test_ApplyReplica(t *testing.T) {
+	testGm, connected := setup(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testGm.DropAll(TESTUAID)
+	defer dropTombstone(testGm, TESTUAID, TESTCHID)
+
+	testGm.DropAll(TESTUAID)
+	dropTombstone(testGm, TESTUAID, TESTCHID)
+	now := timeNow().UTC().Unix()
+	apply := func(op string, at int64) bool {
+		applied, err := testGm.applyReplica(&Replica{Op: op,
+			DeviceID: TESTUAID, ChannelID: TESTCHID, Time: at})
+		if err != nil {
+			t.Fatalf("applyReplica(%q) returned an error: %v", op, err)
+		}
+		return applied
+	}
+	registered := func() bool {
+		chids, _ := testGm.FetchChannels(TESTUAID)
+		return ChannelIDs(chids).IndexOf(TESTCHID) >= 0
+	}
+	if !apply(ReplicaRegister, now-10) || !registered() {
+		t.Errorf("Replicated registration not applied")
+	}
+	// Unregistrations older than the registration are stale.
+	if apply(ReplicaUnregister, now-20) || !registered() {
+		t.Errorf("Stale unregistration applied")
+	}
+	if !apply(ReplicaUnregister, now-5) || registered() {
+		t.Errorf("Replicated unregistration not applied")
+	}
+	// Registrations older than the unregistration are stale.
+	if apply(ReplicaRegister, now-8) || registered() {
+		t.Errorf("Stale registration applied")
+	}
+	if !apply(ReplicaRegister, now) || !registered() {
+		t.Errorf("Newer registration not applied")
+	}
+	if apply(ReplicaDropAll, now-1) || !registered() {
+		t.Errorf("Stale device reset applied")
+	}
+	if !apply(ReplicaDropAll, now) || registered() {
+		t.Errorf("Replicated device reset not applied")
+	}
+	// Registrations older than the reset are stale, even if relayed later.
+	if apply(ReplicaRegister, now-1) || registered() {
+		t.Errorf("Registration older than device reset applied")
+	}
+	// Acknowledged records are dropped, but the registration time is kept.
+	dropTombstone(testGm, TESTUAID, TESTCHID)
+	if !apply(ReplicaRegister, now+10) || !registered() {
+		t.Errorf("Newer registration not applied after device reset")
+	}
+	testGm.Update(TESTUAID, TESTCHID, 10)
+	testGm.Drop(TESTUAID, TESTCHID)
+	if apply(ReplicaUnregister, now+5) || !registered() {
+		t.Errorf("Stale unregistration applied to acknowledged channel")
+	}
+	if apply(ReplicaDropAll, now+5) || !registered() {
+		t.Errorf("Stale device reset applied to acknowledged channel")
+	}
+}
+
+func Test_LastConnect(t *testing.T) {
+	testGm, connected := setup(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+
+	testGm.client.Delete(testGm.ConnectPrefix + TESTUAID)
+	defer testGm.client.Delete(testGm.ConnectPrefix + TESTUAID)
+
+	connectedAt := time.Unix(1257894000, 0)
+	testGm.TrackConnects = false
+	if err := testGm.PutLastConnect(TESTUAID, connectedAt); err != nil {
+		t.Errorf("PutLastConnect returned an error: %v", err)
+	}
+	if lastConnect, err := testGm.FetchLastConnect(TESTUAID); err != nil ||
+		!lastConnect.IsZero() {
+
+		t.Errorf("Handshake recorded with tracking disabled: %v, %v",
+			lastConnect, err)
+	}
+	testGm.TrackConnects = true
+	if err := testGm.PutLastConnect(TESTUAID, connectedAt); err != nil {
+		t.Errorf("PutLastConnect returned an error: %v", err)
+	}
+	if lastConnect, err := testGm.FetchLastConnect(TESTUAID); err != nil ||
+		!lastConnect.Equal(connectedAt) {
+
+		t.Errorf("FetchLastConnect returned wrong time: %v, %v",
+			lastConnect, err)
+	}
+}
+
 func Test_Ping(t *testing.T) {
 	testGm, connected := setup(t)
 	if !connected {
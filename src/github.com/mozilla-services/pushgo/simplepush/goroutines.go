@@ -0,0 +1,164 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+type GoroutineConfig struct {
+	// Debug logs an error when a connection closes while goroutines spawned
+	// on its behalf are still running. Leaked goroutines are always counted.
+	Debug bool
+}
+
+// GoroutineTracker counts the goroutines spawned on behalf of client
+// connections, and the goroutines that outlive their connections, so that
+// leaks can be detected in production.
+type GoroutineTracker struct {
+	app      *Application
+	debug    bool
+	countMux sync.Mutex
+	running  int // Goroutines spawned for open or closed connections.
+	orphans  int // Goroutines still running after their connection closed.
+}
+
+// NewGoroutineTracker creates a goroutine tracker from conf. The tracker
+// uses the application's logger and metrics, which may be set later.
+func NewGoroutineTracker(app *Application,
+	conf GoroutineConfig) *GoroutineTracker {
+
+	return &GoroutineTracker{app: app, debug: conf.Debug}
+}
+
+// Conn returns a tracker for the goroutines spawned on behalf of a
+// connection. logID identifies the connection in log messages.
+func (t *GoroutineTracker) Conn(logID string) *ConnGoroutines {
+	if t == nil {
+		return nil
+	}
+	return &ConnGoroutines{
+		tracker: t,
+		logID:   logID,
+		running: make(map[string]int),
+	}
+}
+
+// Counts returns the number of goroutines spawned for connections, and the
+// number still running after their connections closed.
+func (t *GoroutineTracker) Counts() (running, orphans int) {
+	if t == nil {
+		return 0, 0
+	}
+	t.countMux.Lock()
+	defer t.countMux.Unlock()
+	return t.running, t.orphans
+}
+
+func (t *GoroutineTracker) started() {
+	t.countMux.Lock()
+	t.running++
+	t.countMux.Unlock()
+}
+
+func (t *GoroutineTracker) finished(orphaned bool) {
+	t.countMux.Lock()
+	t.running--
+	if orphaned {
+		t.orphans--
+	}
+	t.countMux.Unlock()
+}
+
+func (t *GoroutineTracker) orphaned(count int) {
+	t.countMux.Lock()
+	t.orphans += count
+	t.countMux.Unlock()
+}
+
+func (t *GoroutineTracker) leaked(logID string, leaked map[string]int) {
+	count := 0
+	kinds := make([]string, 0, len(leaked))
+	for kind, n := range leaked {
+		count += n
+		kinds = append(kinds, kind)
+	}
+	t.app.Metrics().IncrementBy("client.socket.goroutine.leak", int64(count))
+	if logger := t.app.Logger(); t.debug && logger.ShouldLog(ERROR) {
+		sort.Strings(kinds)
+		logger.Error("goroutines", "Goroutines still running after close",
+			LogFields{"rid": logID, "kinds": strings.Join(kinds, ",")})
+	}
+}
+
+// ConnGoroutines tracks the goroutines spawned on behalf of a connection. A
+// nil ConnGoroutines runs goroutines untracked.
+type ConnGoroutines struct {
+	tracker    *GoroutineTracker
+	logID      string
+	runningMux sync.Mutex
+	running    map[string]int // By kind.
+	closed     bool
+}
+
+// Go runs f in a new goroutine, identified by kind.
+func (c *ConnGoroutines) Go(kind string, f func()) {
+	if c == nil {
+		go f()
+		return
+	}
+	c.runningMux.Lock()
+	c.running[kind]++
+	c.runningMux.Unlock()
+	c.tracker.started()
+	go func() {
+		defer c.done(kind)
+		f()
+	}()
+}
+
+func (c *ConnGoroutines) done(kind string) {
+	c.runningMux.Lock()
+	c.running[kind]--
+	if c.running[kind] == 0 {
+		delete(c.running, kind)
+	}
+	orphaned := c.closed
+	c.runningMux.Unlock()
+	c.tracker.finished(orphaned)
+}
+
+// Close marks the connection as closed, and returns the number of goroutines
+// of each kind that are still running. These are counted as orphaned until
+// they exit.
+func (c *ConnGoroutines) Close() (leaked map[string]int) {
+	if c == nil {
+		return nil
+	}
+	c.runningMux.Lock()
+	if c.closed {
+		c.runningMux.Unlock()
+		return nil
+	}
+	c.closed = true
+	if len(c.running) > 0 {
+		count := 0
+		leaked = make(map[string]int, len(c.running))
+		for kind, n := range c.running {
+			leaked[kind] = n
+			count += n
+		}
+		// Counted before releasing the lock, so that goroutines exiting
+		// concurrently see the connection as closed.
+		c.tracker.orphaned(count)
+	}
+	c.runningMux.Unlock()
+	if len(leaked) > 0 {
+		c.tracker.leaked(c.logID, leaked)
+	}
+	return leaked
+}
@@ -0,0 +1,79 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGoroutineTracker(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Connection goroutine tracking", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		tracker := NewGoroutineTracker(app, GoroutineConfig{Debug: true})
+		conn := tracker.Conn("rid")
+
+		// exited waits for tracked goroutines to exit.
+		exited := func() {
+			for running, _ := tracker.Counts(); running > 0; running, _ = tracker.Counts() {
+				runtime.Gosched()
+			}
+		}
+
+		Convey("Should not report goroutines that exit before close", func() {
+			done := make(chan bool)
+			conn.Go("handshake", func() { close(done) })
+			<-done
+			exited()
+			So(conn.Close(), ShouldBeNil)
+		})
+
+		Convey("Should report goroutines that outlive the connection", func() {
+			release := make(chan bool)
+			conn.Go("handshake", func() { <-release })
+			running, orphans := tracker.Counts()
+			So(running, ShouldEqual, 1)
+			So(orphans, ShouldEqual, 0)
+
+			mckStat.EXPECT().IncrementBy("client.socket.goroutine.leak", int64(1))
+			mckLogger.EXPECT().Log(ERROR, "goroutines",
+				"Goroutines still running after close", LogFields{
+					"rid": "rid", "kinds": "handshake"})
+			So(conn.Close(), ShouldResemble, map[string]int{"handshake": 1})
+			running, orphans = tracker.Counts()
+			So(running, ShouldEqual, 1)
+			So(orphans, ShouldEqual, 1)
+
+			// Closing again doesn't count the goroutine twice.
+			So(conn.Close(), ShouldBeNil)
+
+			close(release)
+			exited()
+			_, orphans = tracker.Counts()
+			So(orphans, ShouldEqual, 0)
+		})
+
+		Convey("Should run goroutines untracked if disabled", func() {
+			var tracker *GoroutineTracker
+			conn := tracker.Conn("rid")
+			done := make(chan bool)
+			conn.Go("handshake", func() { close(done) })
+			<-done
+			So(conn.Close(), ShouldBeNil)
+		})
+	})
+}
@@ -56,10 +56,18 @@ type Handler interface {
 	Close() error
 }
 
+// SocketServer serves client connections. The socket handler implements
+// SocketServer for WebSocket connections; tests can serve mock sockets.
+type SocketServer interface {
+	// ServeSocket reads and responds to client commands on socket, blocking
+	// until the connection is closed. req is the client's handshake request.
+	ServeSocket(socket Socket, req *http.Request)
+}
+
 type ListenerConfig interface {
 	UseTLS() bool
 	GetMaxConns() int
-	Listen() (net.Listener, error)
+	Listen(app *Application) (net.Listener, error)
 }
 
 type TCPListenerConfig struct {
@@ -68,6 +76,35 @@ type TCPListenerConfig struct {
 	KeepAlivePeriod string `toml:"tcp_keep_alive" env:"tcp_keep_alive"`
 	CertFile        string `toml:"cert_file" env:"cert_file"`
 	KeyFile         string `toml:"key_file" env:"key_file"`
+
+	// OCSPFile is a DER-encoded OCSP response for the certificate, stapled
+	// to TLS handshakes. It should be refreshed by an external tool.
+	OCSPFile string `toml:"ocsp_file" env:"ocsp_file"`
+
+	// OCSPRefresh is how often an OCSP response is requested from the
+	// responder named in the certificate, if OCSPFile is not set. The
+	// certificate file must include the issuer. Disabled if empty.
+	OCSPRefresh string `toml:"ocsp_refresh_interval" env:"ocsp_refresh_interval"`
+
+	// CertReload enables reloading the certificate, key, and OCSP response
+	// files when they change, without closing existing connections. Changes
+	// are detected with inotify on Linux; on other platforms, the files are
+	// checked at this interval. Disabled if empty.
+	CertReload string `toml:"cert_reload_interval" env:"cert_reload_interval"`
+
+	// ReadTimeout bounds the time to read a request, including its headers
+	// and body. WriteTimeout bounds the time to write the response.
+	// IdleTimeout closes connections that do not start a request within the
+	// timeout of connecting, or of completing the previous request. Only
+	// applied to HTTP servers configured with ConfigureServer. Disabled if
+	// empty.
+	ReadTimeout  string `toml:"read_timeout" env:"read_timeout"`
+	WriteTimeout string `toml:"write_timeout" env:"write_timeout"`
+	IdleTimeout  string `toml:"idle_timeout" env:"idle_timeout"`
+
+	// MaxHeaderBytes is the maximum size of request headers. Defaults to
+	// http.DefaultMaxHeaderBytes if 0.
+	MaxHeaderBytes int `toml:"max_header_bytes" env:"max_header_bytes"`
 }
 
 func (conf TCPListenerConfig) UseTLS() bool {
@@ -78,13 +115,58 @@ func (conf TCPListenerConfig) GetMaxConns() int {
 	return conf.MaxConns
 }
 
-func (conf TCPListenerConfig) Listen() (ln net.Listener, err error) {
+// ConfigureServer applies the request timeouts and header size limit to srv,
+// protecting it from clients that send requests slowly to exhaust
+// connections.
+func (conf TCPListenerConfig) ConfigureServer(srv *ServeCloser) (err error) {
+	if len(conf.ReadTimeout) > 0 {
+		if srv.ReadTimeout, err = time.ParseDuration(conf.ReadTimeout); err != nil {
+			return err
+		}
+	}
+	if len(conf.WriteTimeout) > 0 {
+		if srv.WriteTimeout, err = time.ParseDuration(conf.WriteTimeout); err != nil {
+			return err
+		}
+	}
+	if len(conf.IdleTimeout) > 0 {
+		idleTimeout, err := time.ParseDuration(conf.IdleTimeout)
+		if err != nil {
+			return err
+		}
+		srv.SetIdleTimeout(idleTimeout)
+	}
+	srv.MaxHeaderBytes = conf.MaxHeaderBytes
+	return nil
+}
+
+func (conf TCPListenerConfig) Listen(app *Application) (ln net.Listener, err error) {
 	keepAlivePeriod, err := time.ParseDuration(conf.KeepAlivePeriod)
 	if err != nil {
 		return nil, err
 	}
 	if conf.UseTLS() {
-		return ListenTLS(conf.Addr, conf.CertFile, conf.KeyFile, conf.MaxConns, keepAlivePeriod)
+		var reloadInterval, ocspRefresh time.Duration
+		if len(conf.CertReload) > 0 {
+			if reloadInterval, err = time.ParseDuration(conf.CertReload); err != nil {
+				return nil, err
+			}
+		}
+		if len(conf.OCSPRefresh) > 0 && len(conf.OCSPFile) == 0 {
+			if ocspRefresh, err = time.ParseDuration(conf.OCSPRefresh); err != nil {
+				return nil, err
+			}
+		}
+		certs, err := NewCertReloader(app, conf.CertFile, conf.KeyFile,
+			conf.OCSPFile, reloadInterval, ocspRefresh)
+		if err != nil {
+			return nil, err
+		}
+		if ln, err = ListenTLS(conf.Addr, certs, conf.MaxConns, keepAlivePeriod); err != nil {
+			certs.Close()
+			return nil, err
+		}
+		return ln, nil
 	}
 	return Listen(conf.Addr, conf.MaxConns, keepAlivePeriod)
 }
@@ -0,0 +1,1273 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mozilla-services/pushgo/id"
+)
+
+var ErrNoAdminToken = errors.New("Admin API requires an auth token or OIDC")
+
+type AdminHandlersConfig struct {
+	Enabled bool
+
+	// AuthToken is a static bearer token that grants access to the admin API.
+	// Optional if OIDC is enabled.
+	AuthToken string `toml:"auth_token" env:"auth_token"`
+
+	// OIDC accepts bearer tokens issued by an OpenID Connect provider, so
+	// that access can be granted and audited per user.
+	OIDC OIDCConfig `toml:"oidc" env:"oidc"`
+
+	// Audit records every admin request, including rejected ones, in an
+	// append-only, tamper-evident log.
+	Audit AuditConfig
+
+	Listener TCPListenerConfig
+}
+
+// AdminHandlers exposes operational endpoints, like the dead letter queue.
+// The admin API is disabled by default, and should only be reachable from
+// trusted networks.
+type AdminHandlers struct {
+	app       *Application
+	logger    *SimpleLogger
+	metrics   Statistician
+	store     Store
+	listener  net.Listener
+	server    *ServeCloser
+	mux       *mux.Router
+	url       string
+	maxConns  int
+	authToken []byte
+	oidc      *OIDCVerifier
+	audit     *AuditLog
+}
+
+func NewAdminHandlers() (h *AdminHandlers) {
+	h = &AdminHandlers{mux: mux.NewRouter()}
+	h.mux.HandleFunc("/dlq/", h.ListDeadLettersHandler).Methods("GET")
+	h.mux.HandleFunc("/dlq/{id}", h.DeadLetterHandler).Methods("GET")
+	h.mux.HandleFunc("/dlq/{id}", h.DropDeadLetterHandler).Methods("DELETE")
+	h.mux.HandleFunc("/dlq/{id}/replay", h.ReplayDeadLetterHandler).Methods("POST")
+	h.mux.HandleFunc("/inject", h.InjectHandler).Methods("POST")
+	h.mux.HandleFunc("/keys/", h.ListAPIKeysHandler).Methods("GET")
+	h.mux.HandleFunc("/keys/", h.CreateAPIKeyHandler).Methods("POST")
+	h.mux.HandleFunc("/keys/{id}", h.APIKeyHandler).Methods("GET")
+	h.mux.HandleFunc("/keys/{id}", h.RevokeAPIKeyHandler).Methods("DELETE")
+	h.mux.HandleFunc("/keys/{id}/rotate", h.RotateAPIKeyHandler).Methods("POST")
+	h.mux.HandleFunc("/bans/", h.ListBansHandler).Methods("GET")
+	h.mux.HandleFunc("/bans/", h.AddBanHandler).Methods("POST")
+	h.mux.HandleFunc("/bans/{key}", h.BanHandler).Methods("GET")
+	h.mux.HandleFunc("/bans/{key}", h.DropBanHandler).Methods("DELETE")
+	h.mux.HandleFunc("/settings", h.SettingsHandler).Methods("GET")
+	h.mux.HandleFunc("/settings", h.PushSettingsHandler).Methods("POST")
+	h.mux.HandleFunc("/brownout", h.BrownoutHandler).Methods("GET")
+	h.mux.HandleFunc("/brownout", h.EnableBrownoutHandler).Methods("PUT")
+	h.mux.HandleFunc("/brownout", h.DisableBrownoutHandler).Methods("DELETE")
+	h.mux.HandleFunc("/sandbox", h.SandboxHandler).Methods("GET")
+	h.mux.HandleFunc("/sandbox", h.ResetSandboxHandler).Methods("DELETE")
+	h.mux.HandleFunc("/transcripts/", h.ListTranscriptsHandler).Methods("GET")
+	h.mux.HandleFunc("/transcripts/{uaid}", h.TranscriptHandler).Methods("GET")
+	h.mux.HandleFunc("/transcripts/{uaid}", h.FlagTranscriptHandler).Methods("PUT")
+	h.mux.HandleFunc("/transcripts/{uaid}", h.DropTranscriptHandler).Methods("DELETE")
+	h.mux.HandleFunc("/devices/{uaid}", h.DeviceHandler).Methods("GET")
+	h.mux.HandleFunc("/devices/{uaid}", h.DropDeviceHandler).Methods("DELETE")
+	h.mux.HandleFunc("/devices/{uaid}/erase", h.EraseDeviceHandler).Methods("POST")
+	h.mux.HandleFunc("/devices/{uaid}/export", h.ExportDeviceHandler).Methods("GET")
+	h.mux.HandleFunc("/devices/{uaid}/channels", h.ChannelsHandler).Methods("GET")
+	h.mux.HandleFunc("/devices/{uaid}/channels/{chid}", h.DropChannelHandler).Methods("DELETE")
+	h.mux.HandleFunc("/peers", h.PeersHandler).Methods("GET")
+	h.mux.HandleFunc("/memory", h.MemoryHandler).Methods("GET")
+	h.mux.HandleFunc("/events", h.EventsHandler).Methods("GET")
+	h.mux.HandleFunc("/events", h.PublishEventHandler).Methods("POST")
+	return h
+}
+
+func (h *AdminHandlers) ConfigStruct() interface{} {
+	return &AdminHandlersConfig{
+		Enabled: false,
+		Listener: TCPListenerConfig{
+			Addr:            ":8083",
+			MaxConns:        100,
+			KeepAlivePeriod: "3m",
+			ReadTimeout:     "1m",
+			IdleTimeout:     "30s",
+			MaxHeaderBytes:  1 << 16,
+		},
+		OIDC: OIDCConfig{
+			RefreshInterval: "1h",
+			Leeway:          "1m",
+			Timeout:         "5s",
+		},
+	}
+}
+
+func (h *AdminHandlers) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*AdminHandlersConfig)
+	h.app = app
+	h.logger = app.Logger()
+	h.metrics = app.Metrics()
+	h.store = app.Store()
+
+	if !conf.Enabled {
+		return nil
+	}
+
+	if conf.OIDC.Enabled {
+		if h.oidc, err = NewOIDCVerifier(app, conf.OIDC); err != nil {
+			h.logger.Panic("handlers_admin", "Invalid admin OIDC configuration",
+				LogFields{"error": err.Error()})
+			return err
+		}
+	} else if len(conf.AuthToken) == 0 {
+		h.logger.Panic("handlers_admin", "Missing admin auth token", nil)
+		return ErrNoAdminToken
+	}
+	if len(conf.AuthToken) > 0 {
+		h.authToken = []byte(conf.AuthToken)
+	}
+
+	if conf.Audit.Enabled {
+		if h.audit, err = NewAuditLog(app, conf.Audit); err != nil {
+			h.logger.Panic("handlers_admin", "Could not open admin audit log",
+				LogFields{"error": err.Error(), "path": conf.Audit.Path})
+			return err
+		}
+	}
+
+	if h.listener, err = conf.Listener.Listen(app); err != nil {
+		h.logger.Panic("handlers_admin", "Could not attach admin listener",
+			LogFields{"error": err.Error()})
+		return err
+	}
+
+	var scheme string
+	if conf.Listener.UseTLS() {
+		scheme = "https"
+	} else {
+		scheme = "http"
+	}
+	host, port := HostPort(h.listener, app)
+	h.url = CanonicalURL(scheme, host, port)
+
+	h.maxConns = conf.Listener.MaxConns
+	h.server = NewServeCloser(&http.Server{
+		Handler: &LogHandler{http.HandlerFunc(h.ServeHTTP), h.logger},
+		ErrorLog: log.New(&LogWriter{
+			Logger: h.logger,
+			Name:   "handlers_admin",
+			Level:  ERROR,
+		}, "", 0),
+	})
+	if err = conf.Listener.ConfigureServer(h.server); err != nil {
+		h.logger.Panic("handlers_admin", "Invalid admin server timeouts",
+			LogFields{"error": err.Error()})
+		return err
+	}
+
+	return nil
+}
+
+func (h *AdminHandlers) Listener() net.Listener { return h.listener }
+func (h *AdminHandlers) MaxConns() int          { return h.maxConns }
+func (h *AdminHandlers) URL() string            { return h.url }
+func (h *AdminHandlers) ServeMux() ServeMux     { return (*RouteMux)(h.mux) }
+
+// ServeHTTP rejects requests without a valid bearer token, and records the
+// request in the audit log. Authorized requests are recorded before they're
+// handled, and refused if the record can't be written; the result is
+// recorded separately.
+func (h *AdminHandlers) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	subject, ok := h.authorizeRequest(resp, req)
+	if !ok {
+		if h.audit != nil {
+			h.audit.Record(h.auditRecord(req, subject, auditBody{},
+				http.StatusUnauthorized))
+		}
+		return
+	}
+	if h.audit == nil {
+		h.mux.ServeHTTP(resp, req)
+		return
+	}
+	body := peekAuditBody(req)
+	if err := h.audit.Record(h.auditRecord(req, subject, body, 0)); err != nil {
+		writeJSON(resp, http.StatusServiceUnavailable,
+			[]byte(`"Could not record admin request"`))
+		return
+	}
+	aw := &auditResponseWriter{ResponseWriter: resp}
+	h.mux.ServeHTTP(aw, req)
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	record := h.auditRecord(req, subject, body, aw.status)
+	if len(aw.target) > 0 {
+		record.Target = aw.target
+	}
+	h.audit.Record(record)
+}
+
+func (h *AdminHandlers) authorizeRequest(resp http.ResponseWriter,
+	req *http.Request) (subject string, ok bool) {
+
+	subject, err := h.authorize(req)
+	if err != nil {
+		if h.logger.ShouldLog(WARNING) {
+			h.logger.Warn("handlers_admin", "Rejected unauthorized admin request",
+				LogFields{"rid": req.Header.Get(HeaderID), "path": req.URL.Path,
+					"error": err.Error()})
+		}
+		h.metrics.Increment("admin.unauthorized")
+		resp.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(resp, http.StatusUnauthorized, []byte(`"Unauthorized"`))
+		return "", false
+	}
+	if h.logger.ShouldLog(INFO) {
+		h.logger.Info("handlers_admin", "Admin request",
+			LogFields{"rid": req.Header.Get(HeaderID), "method": req.Method,
+				"path": req.URL.Path, "subject": subject})
+	}
+	return subject, true
+}
+
+// auditRecord describes an admin request. A zero status records the intent
+// to handle the request. The target is taken from the matched route, or the
+// device ID or ban in the body; the tenant from the "tenant" query parameter
+// or body field.
+func (h *AdminHandlers) auditRecord(req *http.Request, subject string,
+	body auditBody, status int) *AuditRecord {
+
+	record := &AuditRecord{
+		Actor:     subject,
+		Action:    req.Method + " " + req.URL.Path,
+		Tenant:    req.URL.Query().Get("tenant"),
+		Status:    status,
+		RequestID: req.Header.Get(HeaderID),
+	}
+	if status == 0 {
+		record.Result = "intent"
+	} else {
+		record.Result = auditResult(status)
+	}
+	if len(record.Tenant) == 0 {
+		record.Tenant = body.Tenant
+	}
+	var match mux.RouteMatch
+	if h.mux.Match(req, &match) {
+		for _, name := range []string{"uaid", "key", "id"} {
+			if target, ok := match.Vars[name]; ok {
+				record.Target = target
+				break
+			}
+		}
+	}
+	if len(record.Target) > 0 {
+		return record
+	}
+	if len(body.UAID) > 0 {
+		record.Target = body.UAID
+	} else if len(body.Kind) > 0 && len(body.Value) > 0 {
+		record.Target = BanKey(body.Kind, body.Value)
+	}
+	return record
+}
+
+// authorize checks the request's bearer token against the static token,
+// then the OIDC provider, and returns the authenticated subject. Requests
+// authorized by the static token have the subject "token".
+func (h *AdminHandlers) authorize(req *http.Request) (subject string, err error) {
+	authHeader := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return "", ErrNoAdminToken
+	}
+	token := strings.TrimSpace(authHeader[len("Bearer "):])
+	if len(h.authToken) > 0 &&
+		subtle.ConstantTimeCompare([]byte(token), h.authToken) == 1 {
+		return "token", nil
+	}
+	if h.oidc == nil {
+		return "", ErrMalformedToken
+	}
+	claims, err := h.oidc.Verify(token)
+	if err != nil {
+		h.metrics.Increment("admin.oidc.rejected")
+		return "", err
+	}
+	h.metrics.Increment("admin.oidc.accepted")
+	if len(claims.Email) > 0 {
+		return claims.Email, nil
+	}
+	return claims.Subject, nil
+}
+
+func (h *AdminHandlers) Start(errChan chan<- error) {
+	if h.server == nil {
+		if h.logger.ShouldLog(INFO) {
+			h.logger.Info("handlers_admin", "Admin server disabled", nil)
+		}
+		return
+	}
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Starting admin server",
+			LogFields{"url": h.url})
+	}
+	errChan <- h.server.Serve(h.listener)
+}
+
+// deadLetters returns the dead letter queue, or writes an error response if
+// no store supports dead letters.
+func (h *AdminHandlers) deadLetters(resp http.ResponseWriter) (
+	deadLetters DeadLetterStore, ok bool) {
+
+	if deadLetters = h.app.DeadLetters(); deadLetters == nil {
+		writeJSON(resp, http.StatusNotImplemented,
+			[]byte(`"Storage does not support dead letters"`))
+		return nil, false
+	}
+	return deadLetters, true
+}
+
+func (h *AdminHandlers) ListDeadLettersHandler(resp http.ResponseWriter, req *http.Request) {
+	deadLetters, ok := h.deadLetters(resp)
+	if !ok {
+		return
+	}
+	limit := 100
+	if slimit := req.FormValue("limit"); len(slimit) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(slimit); err != nil || limit < 0 {
+			writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid limit"`))
+			return
+		}
+	}
+	letters, err := deadLetters.FetchDeadLetters(limit)
+	if err != nil {
+		h.writeError(resp, req, "Could not fetch dead letters", err)
+		return
+	}
+	if letters == nil {
+		letters = []*DeadLetter{}
+	}
+	h.writeReply(resp, req, letters)
+}
+
+func (h *AdminHandlers) DeadLetterHandler(resp http.ResponseWriter, req *http.Request) {
+	deadLetters, ok := h.deadLetters(resp)
+	if !ok {
+		return
+	}
+	letter, err := deadLetters.FetchDeadLetter(mux.Vars(req)["id"])
+	if err != nil {
+		h.writeError(resp, req, "Could not fetch dead letter", err)
+		return
+	}
+	h.writeReply(resp, req, letter)
+}
+
+func (h *AdminHandlers) DropDeadLetterHandler(resp http.ResponseWriter, req *http.Request) {
+	deadLetters, ok := h.deadLetters(resp)
+	if !ok {
+		return
+	}
+	if err := deadLetters.DropDeadLetter(mux.Vars(req)["id"]); err != nil {
+		h.writeError(resp, req, "Could not drop dead letter", err)
+		return
+	}
+	h.metrics.Increment("admin.deadletter.dropped")
+	writeSuccess(resp)
+}
+
+func (h *AdminHandlers) ReplayDeadLetterHandler(resp http.ResponseWriter, req *http.Request) {
+	deadLetters, ok := h.deadLetters(resp)
+	if !ok {
+		return
+	}
+	replayer, ok := h.app.EndpointHandler().(Replayer)
+	if !ok {
+		writeJSON(resp, http.StatusNotImplemented,
+			[]byte(`"Update handler does not support replay"`))
+		return
+	}
+	letter, err := deadLetters.FetchDeadLetter(mux.Vars(req)["id"])
+	if err != nil {
+		h.writeError(resp, req, "Could not fetch dead letter", err)
+		return
+	}
+	if err = replayer.Replay(letter); err != nil {
+		if err == ErrStaleVersion {
+			// Superseded by a newer update; the letter can't be replayed.
+			deadLetters.DropDeadLetter(letter.ID)
+			h.metrics.Increment("admin.deadletter.superseded")
+			writeJSON(resp, http.StatusConflict,
+				[]byte(`"Dead letter superseded by a newer version"`))
+			return
+		}
+		h.writeError(resp, req, "Could not replay dead letter", err)
+		return
+	}
+	if err = deadLetters.DropDeadLetter(letter.ID); err != nil {
+		// The update was delivered; the letter will be dropped when it expires.
+		if h.logger.ShouldLog(WARNING) {
+			h.logger.Warn("handlers_admin", "Could not drop replayed dead letter",
+				LogFields{"id": letter.ID, "error": err.Error()})
+		}
+	}
+	h.metrics.Increment("admin.deadletter.replayed")
+	writeSuccess(resp)
+}
+
+// InjectHandler sends a synthetic update to a device, bypassing the update
+// listener, and returns a trace of the store and delivery steps. The body is
+// a JSON object with an "endpoint" token, or a "uaid" and optional
+// "channelID", and optional "version" and "data" fields.
+func (h *AdminHandlers) InjectHandler(resp http.ResponseWriter, req *http.Request) {
+	injector, ok := h.app.EndpointHandler().(Injector)
+	if !ok {
+		writeJSON(resp, http.StatusNotImplemented,
+			[]byte(`"Update handler does not support injection"`))
+		return
+	}
+	request := new(InjectRequest)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid injection"`))
+		return
+	}
+	if len(request.UAID) > 0 && !id.Valid(request.UAID) {
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid device ID"`))
+		return
+	}
+	if request.RequestID = req.Header.Get(HeaderID); len(request.RequestID) == 0 {
+		request.RequestID, _ = idGenerate()
+	}
+	trace, err := injector.Inject(request)
+	switch err {
+	case nil:
+	case ErrInvalidID:
+		writeJSON(resp, http.StatusNotFound, []byte(`"Unknown device"`))
+		return
+	case ErrNoChannels:
+		writeJSON(resp, http.StatusNotFound, []byte(`"Device has no channels"`))
+		return
+	case ErrNoChannelList:
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Missing channel ID"`))
+		return
+	case ErrDataTooLong:
+		writeJSON(resp, http.StatusRequestEntityTooLarge,
+			[]byte(`"Update data too long"`))
+		return
+	default:
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid injection target"`))
+		return
+	}
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Injected synthetic update", LogFields{
+			"rid":       trace.RequestID,
+			"uaid":      trace.UAID,
+			"chid":      trace.ChannelID,
+			"delivered": strconv.FormatBool(trace.Delivered)})
+	}
+	h.metrics.Increment("admin.injected")
+	setAuditTarget(resp, trace.UAID)
+	h.writeReply(resp, req, trace)
+}
+
+// apiKeys returns the app server API keys, or writes an error response if
+// API keys are disabled.
+func (h *AdminHandlers) apiKeys(resp http.ResponseWriter) (
+	keys *APIKeys, ok bool) {
+
+	if kh, hasKeys := h.app.EndpointHandler().(APIKeyHandler); hasKeys {
+		keys = kh.APIKeys()
+	}
+	if ok = keys != nil; !ok {
+		writeJSON(resp, http.StatusNotImplemented,
+			[]byte(`"API keys are disabled"`))
+	}
+	return
+}
+
+// apiKeyReply is an API key returned by the admin API. The token is only
+// included when the key is created or rotated.
+type apiKeyReply struct {
+	*APIKey
+	Token string       `json:"token,omitempty"`
+	Usage *APIKeyUsage `json:"usage,omitempty"`
+}
+
+// createAPIKeyRequest is the body of a request to create an API key. A zero
+// rate limit uses the configured default.
+type createAPIKeyRequest struct {
+	Tenant    string `json:"tenant"`
+	RateLimit int    `json:"rateLimit"`
+}
+
+// ListAPIKeysHandler returns all API keys, or the keys issued to the tenant
+// given in the "tenant" query parameter.
+func (h *AdminHandlers) ListAPIKeysHandler(resp http.ResponseWriter, req *http.Request) {
+	keys, ok := h.apiKeys(resp)
+	if !ok {
+		return
+	}
+	listed, err := keys.List(req.URL.Query().Get("tenant"))
+	if err != nil {
+		h.writeError(resp, req, "Could not fetch API keys", err)
+		return
+	}
+	replies := make([]*APIKey, len(listed))
+	for i, key := range listed {
+		replies[i] = key.Redacted()
+	}
+	h.writeReply(resp, req, replies)
+}
+
+// CreateAPIKeyHandler issues an API key to a tenant. The reply includes the
+// key's token, which is not stored and can't be retrieved later.
+func (h *AdminHandlers) CreateAPIKeyHandler(resp http.ResponseWriter, req *http.Request) {
+	keys, ok := h.apiKeys(resp)
+	if !ok {
+		return
+	}
+	request := new(createAPIKeyRequest)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil ||
+		len(request.Tenant) == 0 || request.RateLimit < 0 {
+
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid API key"`))
+		return
+	}
+	key, token, err := keys.Create(request.Tenant, request.RateLimit)
+	if err != nil {
+		h.writeError(resp, req, "Could not create API key", err)
+		return
+	}
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Created API key", LogFields{
+			"rid":    req.Header.Get(HeaderID),
+			"key":    key.ID,
+			"tenant": key.Tenant})
+	}
+	h.metrics.Increment("admin.apikey.created")
+	h.writeReply(resp, req, &apiKeyReply{APIKey: key.Redacted(), Token: token})
+}
+
+// APIKeyHandler returns an API key and its usage on this node.
+func (h *AdminHandlers) APIKeyHandler(resp http.ResponseWriter, req *http.Request) {
+	keys, ok := h.apiKeys(resp)
+	if !ok {
+		return
+	}
+	key, err := keys.Fetch(mux.Vars(req)["id"])
+	if err != nil {
+		h.writeError(resp, req, "Could not fetch API key", err)
+		return
+	}
+	usage := keys.Usage(key.ID)
+	h.writeReply(resp, req, &apiKeyReply{APIKey: key.Redacted(), Usage: &usage})
+}
+
+// RotateAPIKeyHandler replaces an API key's secret, and returns the new
+// token. The old token remains valid for the rotation grace period.
+func (h *AdminHandlers) RotateAPIKeyHandler(resp http.ResponseWriter, req *http.Request) {
+	keys, ok := h.apiKeys(resp)
+	if !ok {
+		return
+	}
+	key, token, err := keys.Rotate(mux.Vars(req)["id"])
+	if err != nil {
+		h.writeError(resp, req, "Could not rotate API key", err)
+		return
+	}
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Rotated API key", LogFields{
+			"rid":    req.Header.Get(HeaderID),
+			"key":    key.ID,
+			"tenant": key.Tenant})
+	}
+	h.metrics.Increment("admin.apikey.rotated")
+	h.writeReply(resp, req, &apiKeyReply{APIKey: key.Redacted(), Token: token})
+}
+
+// RevokeAPIKeyHandler revokes an API key. Nodes stop accepting the key when
+// the revocation is published, or once their cached copy expires.
+func (h *AdminHandlers) RevokeAPIKeyHandler(resp http.ResponseWriter, req *http.Request) {
+	keys, ok := h.apiKeys(resp)
+	if !ok {
+		return
+	}
+	key, err := keys.Revoke(mux.Vars(req)["id"])
+	if err != nil {
+		h.writeError(resp, req, "Could not revoke API key", err)
+		return
+	}
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Revoked API key", LogFields{
+			"rid":    req.Header.Get(HeaderID),
+			"key":    key.ID,
+			"tenant": key.Tenant})
+	}
+	h.metrics.Increment("admin.apikey.revoked")
+	h.writeReply(resp, req, key.Redacted())
+}
+
+// bans returns the ban store, or writes an error response if the store does
+// not support bans.
+func (h *AdminHandlers) bans(resp http.ResponseWriter) (bans BanStore, ok bool) {
+	if bans, ok = h.store.(BanStore); !ok {
+		writeJSON(resp, http.StatusNotImplemented,
+			[]byte(`"Storage does not support bans"`))
+	}
+	return
+}
+
+// ListBansHandler returns all active bans.
+func (h *AdminHandlers) ListBansHandler(resp http.ResponseWriter, req *http.Request) {
+	bans, ok := h.bans(resp)
+	if !ok {
+		return
+	}
+	list, err := bans.FetchBans()
+	if err != nil {
+		h.writeError(resp, req, "Could not fetch bans", err)
+		return
+	}
+	if list == nil {
+		list = []*Ban{}
+	}
+	h.writeReply(resp, req, list)
+}
+
+// BanHandler returns the ban with the given key.
+func (h *AdminHandlers) BanHandler(resp http.ResponseWriter, req *http.Request) {
+	bans, ok := h.bans(resp)
+	if !ok {
+		return
+	}
+	ban, err := bans.FetchBan(mux.Vars(req)["key"])
+	if err != nil {
+		h.writeError(resp, req, "Could not fetch ban", err)
+		return
+	}
+	h.writeReply(resp, req, ban)
+}
+
+// addBanRequest is the body of a manual ban request.
+type addBanRequest struct {
+	Kind   string `json:"kind"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+	Period string `json:"period"`
+}
+
+// AddBanHandler bans a device ID or IP address. The ban period is a duration
+// string, like "1h".
+func (h *AdminHandlers) AddBanHandler(resp http.ResponseWriter, req *http.Request) {
+	bans, ok := h.bans(resp)
+	if !ok {
+		return
+	}
+	request := new(addBanRequest)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid ban"`))
+		return
+	}
+	period, err := time.ParseDuration(request.Period)
+	if err != nil || period <= 0 {
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid ban period"`))
+		return
+	}
+	switch request.Kind {
+	case BanUAID:
+		ok = id.Valid(request.Value)
+	case BanIP:
+		ok = net.ParseIP(request.Value) != nil
+	default:
+		ok = false
+	}
+	if !ok {
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid ban"`))
+		return
+	}
+	if len(request.Reason) == 0 {
+		request.Reason = "admin"
+	}
+	now := timeNow()
+	ban := &Ban{
+		Kind:     request.Kind,
+		Value:    request.Value,
+		Reason:   request.Reason,
+		BannedAt: now.Unix(),
+		Expires:  now.Add(period).Unix(),
+	}
+	if err = bans.PutBan(ban); err != nil {
+		h.writeError(resp, req, "Could not store ban", err)
+		return
+	}
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Added ban", LogFields{
+			"rid":    req.Header.Get(HeaderID),
+			"key":    ban.Key(),
+			"reason": ban.Reason,
+			"period": period.String()})
+	}
+	h.metrics.Increment("admin.ban.added")
+	h.writeReply(resp, req, ban)
+}
+
+// DropBanHandler lifts the ban with the given key.
+func (h *AdminHandlers) DropBanHandler(resp http.ResponseWriter, req *http.Request) {
+	bans, ok := h.bans(resp)
+	if !ok {
+		return
+	}
+	key := mux.Vars(req)["key"]
+	if err := bans.DropBan(key); err != nil {
+		h.writeError(resp, req, "Could not drop ban", err)
+		return
+	}
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Dropped ban",
+			LogFields{"rid": req.Header.Get(HeaderID), "key": key})
+	}
+	h.metrics.Increment("admin.ban.dropped")
+	writeSuccess(resp)
+}
+
+// SettingsHandler returns the settings sent to newly connected clients.
+func (h *AdminHandlers) SettingsHandler(resp http.ResponseWriter, req *http.Request) {
+	settings := h.app.ClientSettings()
+	if settings == nil {
+		settings = &ClientSettings{}
+	}
+	h.writeReply(resp, req, settings)
+}
+
+// PushSettingsHandler pushes client settings to all connected clients. An
+// empty settings object clears previously pushed settings.
+func (h *AdminHandlers) PushSettingsHandler(resp http.ResponseWriter, req *http.Request) {
+	settings := new(ClientSettings)
+	if err := json.NewDecoder(req.Body).Decode(settings); err != nil ||
+		settings.PingInterval < 0 || settings.Backoff < 0 {
+
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid settings"`))
+		return
+	}
+	settings.Type = "settings"
+	sent := h.app.PushSettings(settings)
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Pushed client settings", LogFields{
+			"rid":          req.Header.Get(HeaderID),
+			"pingInterval": strconv.FormatInt(settings.PingInterval, 10),
+			"backoff":      strconv.FormatInt(settings.Backoff, 10),
+			"clients":      strconv.Itoa(sent)})
+	}
+	h.metrics.Increment("admin.settings.pushed")
+	h.writeReply(resp, req, struct {
+		Clients int `json:"clients"`
+	}{sent})
+}
+
+// BrownoutHandler returns the node's brownout state.
+func (h *AdminHandlers) BrownoutHandler(resp http.ResponseWriter, req *http.Request) {
+	h.writeReply(resp, req, h.app.Brownout().Status())
+}
+
+// EnableBrownoutHandler puts the node in brownout mode until it is disabled.
+// The request body may specify a reason, like {"reason": "incident-42"}.
+func (h *AdminHandlers) EnableBrownoutHandler(resp http.ResponseWriter, req *http.Request) {
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil && err != io.EOF {
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid request"`))
+		return
+	}
+	if len(request.Reason) == 0 {
+		request.Reason = "admin"
+	}
+	if h.app.Brownout().Enable(request.Reason) {
+		h.app.logBrownout()
+		h.metrics.Increment("admin.brownout.enabled")
+	}
+	h.writeReply(resp, req, h.app.Brownout().Status())
+}
+
+// DisableBrownoutHandler takes the node out of brownout mode.
+func (h *AdminHandlers) DisableBrownoutHandler(resp http.ResponseWriter, req *http.Request) {
+	if h.app.Brownout().Disable() {
+		h.app.logBrownout()
+		h.metrics.Increment("admin.brownout.disabled")
+	}
+	h.writeReply(resp, req, h.app.Brownout().Status())
+}
+
+// sandbox returns the pinger sandbox, or writes an error response if the
+// pinger is not in sandbox mode.
+func (h *AdminHandlers) sandbox(resp http.ResponseWriter) (
+	sandbox *PingSandbox, ok bool) {
+
+	if pinger, isSandboxed := h.app.PropPinger().(SandboxPinger); isSandboxed {
+		sandbox = pinger.Sandbox()
+	}
+	if ok = sandbox != nil; !ok {
+		writeJSON(resp, http.StatusNotImplemented,
+			[]byte(`"Pinger is not in sandbox mode"`))
+	}
+	return
+}
+
+// SandboxHandler returns the pings recorded by a sandboxed pinger.
+func (h *AdminHandlers) SandboxHandler(resp http.ResponseWriter, req *http.Request) {
+	sandbox, ok := h.sandbox(resp)
+	if !ok {
+		return
+	}
+	h.writeReply(resp, req, sandbox.Sends())
+}
+
+// ResetSandboxHandler discards the pings recorded by a sandboxed pinger.
+func (h *AdminHandlers) ResetSandboxHandler(resp http.ResponseWriter, req *http.Request) {
+	sandbox, ok := h.sandbox(resp)
+	if !ok {
+		return
+	}
+	sandbox.Reset()
+	writeSuccess(resp)
+}
+
+// transcripts returns the client transcript recorder, or writes an error
+// response if transcript recording is disabled.
+func (h *AdminHandlers) transcripts(resp http.ResponseWriter) (
+	transcripts *TranscriptRecorder, ok bool) {
+
+	if th, hasTranscripts := h.app.SocketHandler().(TranscriptHandler); hasTranscripts {
+		transcripts = th.Transcripts()
+	}
+	if ok = transcripts != nil; !ok {
+		writeJSON(resp, http.StatusNotImplemented,
+			[]byte(`"Transcript recording is disabled"`))
+	}
+	return
+}
+
+// ListTranscriptsHandler returns the device IDs flagged for recording.
+func (h *AdminHandlers) ListTranscriptsHandler(resp http.ResponseWriter, req *http.Request) {
+	transcripts, ok := h.transcripts(resp)
+	if !ok {
+		return
+	}
+	h.writeReply(resp, req, transcripts.Flagged())
+}
+
+// TranscriptHandler returns the frames recorded for a flagged device.
+func (h *AdminHandlers) TranscriptHandler(resp http.ResponseWriter, req *http.Request) {
+	transcripts, ok := h.transcripts(resp)
+	if !ok {
+		return
+	}
+	transcript := transcripts.Transcript(mux.Vars(req)["uaid"])
+	if transcript == nil {
+		writeJSON(resp, http.StatusNotFound, []byte(`"Device not flagged"`))
+		return
+	}
+	h.writeReply(resp, req, transcript.Frames())
+}
+
+// FlagTranscriptHandler starts recording frames for a device.
+func (h *AdminHandlers) FlagTranscriptHandler(resp http.ResponseWriter, req *http.Request) {
+	transcripts, ok := h.transcripts(resp)
+	if !ok {
+		return
+	}
+	uaid := mux.Vars(req)["uaid"]
+	if !id.Valid(uaid) {
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid device ID"`))
+		return
+	}
+	if err := transcripts.Flag(uaid); err != nil {
+		writeJSON(resp, http.StatusConflict, []byte(`"Too many flagged devices"`))
+		return
+	}
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Flagged device for transcript recording",
+			LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid})
+	}
+	h.metrics.Increment("admin.transcript.flagged")
+	writeSuccess(resp)
+}
+
+// DropTranscriptHandler stops recording frames for a device, and discards
+// its transcript.
+func (h *AdminHandlers) DropTranscriptHandler(resp http.ResponseWriter, req *http.Request) {
+	transcripts, ok := h.transcripts(resp)
+	if !ok {
+		return
+	}
+	if !transcripts.Unflag(mux.Vars(req)["uaid"]) {
+		writeJSON(resp, http.StatusNotFound, []byte(`"Device not flagged"`))
+		return
+	}
+	h.metrics.Increment("admin.transcript.dropped")
+	writeSuccess(resp)
+}
+
+// ChannelsHandler returns the channels registered to a device, and their
+// creation times if known. The REST equivalent of the "channels" command.
+func (h *AdminHandlers) ChannelsHandler(resp http.ResponseWriter, req *http.Request) {
+	uaid := mux.Vars(req)["uaid"]
+	if !id.Valid(uaid) {
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid device ID"`))
+		return
+	}
+	channels, ok, err := FetchChannelInfo(h.store, uaid)
+	if !ok {
+		writeJSON(resp, http.StatusNotImplemented,
+			[]byte(`"Storage does not support listing channels"`))
+		return
+	}
+	if err != nil {
+		h.writeError(resp, req, "Could not fetch channels", err)
+		return
+	}
+	h.writeReply(resp, req, channels)
+}
+
+// DeviceHandler returns the stored state of a device: its registered
+// channels, pending updates, last handshake time, and last node. The device
+// state is read without changing it: expired updates are not discarded.
+func (h *AdminHandlers) DeviceHandler(resp http.ResponseWriter, req *http.Request) {
+	uaid := mux.Vars(req)["uaid"]
+	if !id.Valid(uaid) {
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid device ID"`))
+		return
+	}
+	info := &DeviceInfo{
+		DeviceID:  uaid,
+		Connected: h.app.WorkerExists(uaid),
+	}
+	var err error
+	if info.Pending, info.Expired, err = PeekAll(h.store, uaid); err != nil {
+		h.writeError(resp, req, "Could not fetch pending updates", err)
+		return
+	}
+	if info.Pending == nil {
+		info.Pending = []Update{}
+	}
+	if info.Expired == nil {
+		info.Expired = []string{}
+	}
+	if info.Channels, _, err = FetchChannelInfo(h.store, uaid); err != nil {
+		h.writeError(resp, req, "Could not fetch channels", err)
+		return
+	}
+	if store, ok := h.store.(ConnectStore); ok {
+		lastConnect, err := store.FetchLastConnect(uaid)
+		if err != nil {
+			h.writeError(resp, req, "Could not fetch handshake time", err)
+			return
+		}
+		if !lastConnect.IsZero() {
+			info.LastConnect = lastConnect.UnixNano() / int64(time.Millisecond)
+		}
+	}
+	if store, ok := h.store.(AffinityStore); ok {
+		if info.Origin, err = store.FetchAffinity(uaid); err != nil {
+			h.writeError(resp, req, "Could not fetch connection affinity", err)
+			return
+		}
+	}
+	if store, ok := h.store.(ResidencyStore); ok {
+		if info.Region, err = store.FetchRegion(uaid); err != nil {
+			h.writeError(resp, req, "Could not fetch device region", err)
+			return
+		}
+	}
+	h.writeReply(resp, req, info)
+}
+
+// DropDeviceHandler removes all channels and proprietary ping data for a
+// device, and disconnects the device if it is connected to this node.
+func (h *AdminHandlers) DropDeviceHandler(resp http.ResponseWriter, req *http.Request) {
+	uaid := mux.Vars(req)["uaid"]
+	if !id.Valid(uaid) {
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid device ID"`))
+		return
+	}
+	if err := h.store.DropAll(uaid); err != nil {
+		h.writeError(resp, req, "Could not drop device", err)
+		return
+	}
+	if err := h.store.DropPing(uaid); err != nil {
+		// Most devices don't have proprietary ping data.
+		if h.logger.ShouldLog(DEBUG) {
+			h.logger.Debug("handlers_admin", "Could not drop ping data",
+				LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid,
+					"error": err.Error()})
+		}
+	}
+	if worker, ok := h.app.GetWorker(uaid); ok {
+		worker.Close()
+	}
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Dropped device",
+			LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid})
+	}
+	h.metrics.Increment("admin.device.dropped")
+	writeSuccess(resp)
+}
+
+// EraseDeviceHandler removes all data held for a device, for right-to-erasure
+// requests, and returns an erasure report. Responds with a 500 if any data
+// could not be removed; the request can be retried.
+func (h *AdminHandlers) EraseDeviceHandler(resp http.ResponseWriter, req *http.Request) {
+	uaid := mux.Vars(req)["uaid"]
+	if !id.Valid(uaid) {
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid device ID"`))
+		return
+	}
+	report := EraseDevice(h.app, uaid)
+	body, err := json.Marshal(report)
+	if err != nil {
+		h.writeError(resp, req, "Could not encode reply", err)
+		return
+	}
+	if !report.Complete {
+		if h.logger.ShouldLog(ERROR) {
+			h.logger.Error("handlers_admin", "Device erasure incomplete",
+				LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid})
+		}
+		h.metrics.Increment("admin.device.erase_failed")
+		writeJSON(resp, http.StatusInternalServerError, body)
+		return
+	}
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Erased device",
+			LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid})
+	}
+	h.metrics.Increment("admin.device.erased")
+	writeJSON(resp, http.StatusOK, body)
+}
+
+// ExportDeviceHandler returns all data stored for a device as a JSON
+// attachment, for data portability requests.
+func (h *AdminHandlers) ExportDeviceHandler(resp http.ResponseWriter, req *http.Request) {
+	uaid := mux.Vars(req)["uaid"]
+	if !id.Valid(uaid) {
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid device ID"`))
+		return
+	}
+	export, err := ExportDevice(h.app, uaid)
+	if err != nil {
+		h.writeError(resp, req, "Could not export device", err)
+		return
+	}
+	body, err := json.Marshal(export)
+	if err != nil {
+		h.writeError(resp, req, "Could not encode reply", err)
+		return
+	}
+	if h.logger.ShouldLog(INFO) {
+		h.logger.Info("handlers_admin", "Exported device",
+			LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid})
+	}
+	h.metrics.Increment("admin.device.exported")
+	resp.Header().Set("Content-Disposition",
+		`attachment; filename="`+uaid+`.json"`)
+	writeJSON(resp, http.StatusOK, body)
+}
+
+// DropChannelHandler unregisters a device's channel. The device is told that
+// the channel was unregistered the next time it fetches updates.
+func (h *AdminHandlers) DropChannelHandler(resp http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	uaid, chid := vars["uaid"], vars["chid"]
+	if !id.Valid(uaid) {
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid device ID"`))
+		return
+	}
+	switch err := h.store.Unregister(uaid, chid); err {
+	case nil:
+	case ErrInvalidChannel:
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid channel ID"`))
+		return
+	case ErrNonexistentChannel, ErrChannelGone:
+		writeJSON(resp, http.StatusNotFound, []byte(`"Channel not found"`))
+		return
+	default:
+		h.writeError(resp, req, "Could not drop channel", err)
+		return
+	}
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_admin", "Dropped channel",
+			LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid,
+				"chid": chid})
+	}
+	h.metrics.Increment("admin.channel.dropped")
+	writeSuccess(resp)
+}
+
+// PeersHandler returns the peering handshake results for this node's peers,
+// and whether the cluster is running mixed software versions.
+func (h *AdminHandlers) PeersHandler(resp http.ResponseWriter, req *http.Request) {
+	var peering *Peering
+	if pr, ok := h.app.Router().(PeeringRouter); ok {
+		peering = pr.Peering()
+	}
+	if peering == nil {
+		writeJSON(resp, http.StatusNotImplemented,
+			[]byte(`"Peering handshakes are disabled"`))
+		return
+	}
+	h.writeReply(resp, req, struct {
+		Local PeerInfo     `json:"local"`
+		Mixed bool         `json:"mixed"`
+		Peers []PeerStatus `json:"peers"`
+	}{peering.Local(), peering.Mixed(), peering.Peers()})
+}
+
+// MemoryHandler returns the approximate bytes held by each subsystem.
+func (h *AdminHandlers) MemoryHandler(resp http.ResponseWriter, req *http.Request) {
+	memory := h.app.Memory()
+	if memory == nil {
+		writeJSON(resp, http.StatusNotImplemented,
+			[]byte(`"Memory accounting is disabled"`))
+		return
+	}
+	usage := memory.Usage()
+	var total int64
+	for _, bytes := range usage {
+		total += bytes
+	}
+	h.writeReply(resp, req, struct {
+		Total      int64            `json:"total"`
+		Subsystems map[string]int64 `json:"subsystems"`
+	}{total, usage})
+}
+
+// controlPlane returns the control event channel, or writes an error
+// response if control events are disabled.
+func (h *AdminHandlers) controlPlane(resp http.ResponseWriter) (
+	control *ControlPlane, ok bool) {
+
+	if control = h.app.ControlPlane(); control == nil {
+		writeJSON(resp, http.StatusNotImplemented,
+			[]byte(`"Control events are disabled"`))
+		return nil, false
+	}
+	return control, true
+}
+
+// EventsHandler returns the control events most recently applied by this
+// node.
+func (h *AdminHandlers) EventsHandler(resp http.ResponseWriter, req *http.Request) {
+	control, ok := h.controlPlane(resp)
+	if !ok {
+		return
+	}
+	h.writeReply(resp, req, control.History())
+}
+
+// PublishEventHandler sends a control event to all nodes in the cluster.
+func (h *AdminHandlers) PublishEventHandler(resp http.ResponseWriter, req *http.Request) {
+	control, ok := h.controlPlane(resp)
+	if !ok {
+		return
+	}
+	var request struct {
+		Type string            `json:"type"`
+		Args map[string]string `json:"args"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil ||
+		len(request.Type) == 0 {
+
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid event"`))
+		return
+	}
+	event, err := control.Publish(request.Type, request.Args)
+	if err != nil {
+		h.writeError(resp, req, "Could not publish event", err)
+		return
+	}
+	h.metrics.Increment("admin.event.published")
+	h.writeReply(resp, req, event)
+}
+
+func (h *AdminHandlers) writeReply(resp http.ResponseWriter,
+	req *http.Request, reply interface{}) {
+
+	body, err := json.Marshal(reply)
+	if err != nil {
+		h.writeError(resp, req, "Could not encode reply", err)
+		return
+	}
+	writeJSON(resp, http.StatusOK, body)
+}
+
+func (h *AdminHandlers) writeError(resp http.ResponseWriter,
+	req *http.Request, message string, err error) {
+
+	if err == ErrNoDeadLetter {
+		writeJSON(resp, http.StatusNotFound, []byte(`"Dead letter not found"`))
+		return
+	}
+	if err == ErrNoBan {
+		writeJSON(resp, http.StatusNotFound, []byte(`"Ban not found"`))
+		return
+	}
+	if err == ErrNoAPIKey {
+		writeJSON(resp, http.StatusNotFound, []byte(`"API key not found"`))
+		return
+	}
+	if err == ErrAPIKeyRevoked {
+		writeJSON(resp, http.StatusConflict, []byte(`"API key revoked"`))
+		return
+	}
+	if err == ErrAPIKeyConfigured {
+		writeJSON(resp, http.StatusConflict,
+			[]byte(`"API key is set in the configuration file"`))
+		return
+	}
+	if err == ErrNoAPIKeyStore {
+		writeJSON(resp, http.StatusNotImplemented,
+			[]byte(`"Storage does not support API keys"`))
+		return
+	}
+	if h.logger.ShouldLog(ERROR) {
+		h.logger.Error("handlers_admin", message, LogFields{
+			"rid": req.Header.Get(HeaderID), "error": err.Error()})
+	}
+	status, _ := ErrToStatus(err)
+	writeJSON(resp, status, []byte(`"`+message+`"`))
+}
+
+func (h *AdminHandlers) Close() (err error) {
+	if h.listener != nil {
+		if err = h.listener.Close(); err != nil {
+			if h.logger.ShouldLog(ERROR) {
+				h.logger.Error("handlers_admin", "Error closing admin listener",
+					LogFields{"error": err.Error(), "url": h.url})
+			}
+		}
+	}
+	if h.server != nil {
+		h.server.Close()
+	}
+	if auditErr := h.audit.Close(); auditErr != nil && err == nil {
+		err = auditErr
+	}
+	return
+}
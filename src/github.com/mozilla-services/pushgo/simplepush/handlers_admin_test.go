@@ -0,0 +1,897 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testDeadLetterStore wraps a Store with an in-memory dead letter queue.
+type testDeadLetterStore struct {
+	Store
+	letters []*DeadLetter
+}
+
+func newTestDeadLetterStore(store Store) *testDeadLetterStore {
+	return &testDeadLetterStore{Store: store}
+}
+
+func (s *testDeadLetterStore) PutDeadLetter(letter *DeadLetter) error {
+	s.letters = append(s.letters, letter)
+	return nil
+}
+
+func (s *testDeadLetterStore) FetchDeadLetters(limit int) ([]*DeadLetter, error) {
+	if limit > 0 && limit < len(s.letters) {
+		return s.letters[:limit], nil
+	}
+	return s.letters, nil
+}
+
+func (s *testDeadLetterStore) FetchDeadLetter(id string) (*DeadLetter, error) {
+	for _, letter := range s.letters {
+		if letter.ID == id {
+			return letter, nil
+		}
+	}
+	return nil, ErrNoDeadLetter
+}
+
+func (s *testDeadLetterStore) DropDeadLetter(id string) error {
+	for i, letter := range s.letters {
+		if letter.ID == id {
+			s.letters = append(s.letters[:i], s.letters[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNoDeadLetter
+}
+
+func TestAdminDeadLetters(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+	mckRouter := NewMockRouter(mockCtrl)
+
+	Convey("Admin dead letter API", t, func() {
+		store := newTestDeadLetterStore(mckStore)
+		store.letters = []*DeadLetter{
+			{ID: "a", UAID: "123", ChannelID: "456", Version: 1},
+			{ID: "b", UAID: "123", ChannelID: "789", Version: 2},
+		}
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(store)
+		app.SetRouter(mckRouter)
+
+		eh := NewEndpointHandler()
+		eh.setApp(app)
+		app.SetEndpointHandler(eh)
+
+		ah := NewAdminHandlers()
+		ah.Init(app, ah.ConfigStruct())
+		ah.authToken = []byte("s3cr3t")
+
+		newRequest := func(method, path, token string) *http.Request {
+			req := &http.Request{
+				Method: method,
+				Header: http.Header{},
+				URL:    &url.URL{Path: path},
+			}
+			if len(token) > 0 {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			return req
+		}
+
+		Convey("Should reject requests without a valid token", func() {
+			mckStat.EXPECT().Increment("admin.unauthorized").Times(2)
+
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/dlq/", ""))
+			So(resp.Code, ShouldEqual, 401)
+
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/dlq/", "wrong"))
+			So(resp.Code, ShouldEqual, 401)
+		})
+
+		Convey("Should list queued updates", func() {
+			resp := httptest.NewRecorder()
+			req := newRequest("GET", "/dlq/", "s3cr3t")
+			req.URL.RawQuery = "limit=1"
+			ah.ServeHTTP(resp, req)
+
+			So(resp.Code, ShouldEqual, 200)
+			body, isJSON := getJSON(resp.HeaderMap, resp.Body)
+			So(isJSON, ShouldBeTrue)
+			So(body.String(), ShouldEqual, `[{"id":"a","uaid":"123",`+
+				`"channelID":"456","version":1,"reason":"","failedAt":0,`+
+				`"attempts":0}]`)
+		})
+
+		Convey("Should use a separate dead letter store", func() {
+			app.SetStore(mckStore)
+			So(app.SetDeadLetterStore(mckStore), ShouldEqual, ErrNoDeadLetterStore)
+			So(app.SetDeadLetterStore(store), ShouldBeNil)
+
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/dlq/b", "s3cr3t"))
+			So(resp.Code, ShouldEqual, 200)
+		})
+
+		Convey("Should return a 501 if storage does not support dead letters", func() {
+			app.SetStore(mckStore)
+
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/dlq/", "s3cr3t"))
+			So(resp.Code, ShouldEqual, 501)
+		})
+
+		Convey("Should return a 404 for unknown updates", func() {
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/dlq/c", "s3cr3t"))
+			So(resp.Code, ShouldEqual, 404)
+		})
+
+		Convey("Should drop queued updates", func() {
+			mckStat.EXPECT().Increment("admin.deadletter.dropped")
+
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("DELETE", "/dlq/a", "s3cr3t"))
+			So(resp.Code, ShouldEqual, 200)
+			So(store.letters, ShouldHaveLength, 1)
+			So(store.letters[0].ID, ShouldEqual, "b")
+		})
+
+		Convey("Should replay and drop queued updates", func() {
+			gomock.InOrder(
+				mckStore.EXPECT().FetchAll("123", time.Time{}).Return(
+					[]Update{{ChannelID: "456", Version: 5}}, nil, nil),
+				mckStore.EXPECT().Update("123", "789", int64(2)).Return(nil),
+				mckStat.EXPECT().Increment("updates.appserver.replayed"),
+				mckStat.EXPECT().Increment("updates.routed.outgoing"),
+				mckRouter.EXPECT().Route(nil, "123", "789", int64(2),
+					gomock.Any(), "", "").Return(true, nil),
+				mckStat.EXPECT().Increment("router.broadcast.hit"),
+				mckStat.EXPECT().Timer("updates.routed.hits", gomock.Any()),
+				mckStat.EXPECT().Increment("updates.appserver.received"),
+				mckStat.EXPECT().Increment("admin.deadletter.replayed"),
+			)
+
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("POST", "/dlq/b/replay", "s3cr3t"))
+			So(resp.Code, ShouldEqual, 200)
+			So(store.letters, ShouldHaveLength, 1)
+			So(store.letters[0].ID, ShouldEqual, "a")
+		})
+
+		Convey("Should drop updates superseded by newer versions", func() {
+			gomock.InOrder(
+				mckStore.EXPECT().FetchAll("123", time.Time{}).Return(
+					[]Update{{ChannelID: "789", Version: 3}}, nil, nil),
+				mckStat.EXPECT().Increment("admin.deadletter.superseded"),
+			)
+
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("POST", "/dlq/b/replay", "s3cr3t"))
+			So(resp.Code, ShouldEqual, 409)
+			So(store.letters, ShouldHaveLength, 1)
+			So(store.letters[0].ID, ShouldEqual, "a")
+		})
+	})
+}
+
+func TestAdminBans(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+
+	Convey("Admin ban API", t, func() {
+		useMockFuncs()
+		defer useStdFuncs()
+		store := newTestBanStore(mckStore)
+		store.bans["ip:192.0.2.57"] = &Ban{Kind: "ip", Value: "192.0.2.57",
+			Reason: "crash", Score: 100, BannedAt: 1257894000, Expires: 1257897600}
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(store)
+
+		ah := NewAdminHandlers()
+		ah.Init(app, ah.ConfigStruct())
+		ah.authToken = []byte("s3cr3t")
+
+		newRequest := func(method, path, body string) *http.Request {
+			req := &http.Request{
+				Method: method,
+				Header: http.Header{},
+				URL:    &url.URL{Path: path},
+				Body:   ioutil.NopCloser(strings.NewReader(body)),
+			}
+			req.Header.Set("Authorization", "Bearer s3cr3t")
+			return req
+		}
+
+		Convey("Should list active bans", func() {
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/bans/", ""))
+
+			So(resp.Code, ShouldEqual, 200)
+			body, isJSON := getJSON(resp.HeaderMap, resp.Body)
+			So(isJSON, ShouldBeTrue)
+			So(body.String(), ShouldEqual, `[{"kind":"ip","value":"192.0.2.57",`+
+				`"reason":"crash","score":100,"bannedAt":1257894000,`+
+				`"expires":1257897600}]`)
+		})
+
+		Convey("Should return a 404 for unknown bans", func() {
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/bans/ip:192.0.2.58", ""))
+			So(resp.Code, ShouldEqual, 404)
+		})
+
+		Convey("Should add bans", func() {
+			mckStat.EXPECT().Increment("admin.ban.added")
+
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("POST", "/bans/",
+				`{"kind":"uaid","value":"6a4f5b0e1c2d4e3f8a9b0c1d2e3f4a5b","period":"2h"}`))
+			So(resp.Code, ShouldEqual, 200)
+			ban := store.bans["uaid:6a4f5b0e1c2d4e3f8a9b0c1d2e3f4a5b"]
+			So(ban, ShouldNotBeNil)
+			So(ban.Reason, ShouldEqual, "admin")
+			So(ban.Expires, ShouldEqual, 1257894000+2*60*60)
+		})
+
+		Convey("Should reject invalid bans", func() {
+			for _, body := range []string{
+				`{"kind":"uaid","value":"123","period":"1h"}`,
+				`{"kind":"ip","value":"example.com","period":"1h"}`,
+				`{"kind":"host","value":"192.0.2.1","period":"1h"}`,
+				`{"kind":"ip","value":"192.0.2.1","period":"-1h"}`,
+				`{"kind":"ip",`,
+			} {
+				resp := httptest.NewRecorder()
+				ah.ServeHTTP(resp, newRequest("POST", "/bans/", body))
+				So(resp.Code, ShouldEqual, 400)
+			}
+			So(store.bans, ShouldHaveLength, 1)
+		})
+
+		Convey("Should drop bans", func() {
+			mckStat.EXPECT().Increment("admin.ban.dropped")
+
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("DELETE", "/bans/ip:192.0.2.57", ""))
+			So(resp.Code, ShouldEqual, 200)
+			So(store.bans, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestAdminBrownout(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Admin brownout API", t, func() {
+		useMockFuncs()
+		defer useStdFuncs()
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+
+		ah := NewAdminHandlers()
+		ah.Init(app, ah.ConfigStruct())
+		ah.authToken = []byte("s3cr3t")
+
+		newRequest := func(method, body string) *http.Request {
+			req := &http.Request{
+				Method: method,
+				Header: http.Header{},
+				URL:    &url.URL{Path: "/brownout"},
+				Body:   ioutil.NopCloser(strings.NewReader(body)),
+			}
+			req.Header.Set("Authorization", "Bearer s3cr3t")
+			return req
+		}
+
+		Convey("Should enable and disable brownout", func() {
+			mckStat.EXPECT().Increment("admin.brownout.enabled")
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("PUT", `{"reason":"incident-42"}`))
+			So(resp.Code, ShouldEqual, 200)
+			So(resp.Body.String(), ShouldEqual,
+				`{"active":true,"reason":"incident-42","since":1257894000}`)
+			So(app.Brownout().Active(), ShouldBeTrue)
+
+			mckStat.EXPECT().Increment("admin.brownout.disabled")
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("DELETE", ""))
+			So(resp.Code, ShouldEqual, 200)
+			So(resp.Body.String(), ShouldEqual, `{"active":false}`)
+			So(app.Brownout().Active(), ShouldBeFalse)
+		})
+
+		Convey("Should default the brownout reason", func() {
+			mckStat.EXPECT().Increment("admin.brownout.enabled")
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("PUT", ""))
+			So(resp.Code, ShouldEqual, 200)
+			So(app.Brownout().Status().Reason, ShouldEqual, "admin")
+		})
+
+		Convey("Should report the brownout state", func() {
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", ""))
+			So(resp.Code, ShouldEqual, 200)
+			So(resp.Body.String(), ShouldEqual, `{"active":false}`)
+		})
+	})
+}
+
+func TestAdminSandbox(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+
+	Convey("Admin sandbox API", t, func() {
+		useMockFuncs()
+		defer useStdFuncs()
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(mckStore)
+
+		ah := NewAdminHandlers()
+		ah.Init(app, ah.ConfigStruct())
+		ah.authToken = []byte("s3cr3t")
+
+		newRequest := func(method string) *http.Request {
+			req := &http.Request{
+				Method: method,
+				Header: http.Header{},
+				URL:    &url.URL{Path: "/sandbox"},
+			}
+			req.Header.Set("Authorization", "Bearer s3cr3t")
+			return req
+		}
+
+		Convey("Should list and reset sandboxed pings", func() {
+			pinger := new(SandboxPing)
+			pinger.Init(app, pinger.ConfigStruct())
+			app.SetPropPinger(pinger)
+			pinger.Sandbox().Record(SandboxSend{Pinger: "sandbox",
+				UAID: "deadbeef", Version: 1})
+
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET"))
+			So(resp.Code, ShouldEqual, 200)
+			So(resp.Body.String(), ShouldEqual,
+				`[{"pinger":"sandbox","uaid":"deadbeef","version":1,"recorded":1257894000}]`)
+
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("DELETE"))
+			So(resp.Code, ShouldEqual, 200)
+			So(pinger.Sandbox().Sends(), ShouldBeEmpty)
+		})
+
+		Convey("Should reject requests if the pinger is not sandboxed", func() {
+			app.SetPropPinger(new(NoopPing))
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET"))
+			So(resp.Code, ShouldEqual, 501)
+		})
+	})
+}
+
+func TestAdminMemory(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+
+	Convey("Admin memory API", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(mckStore)
+
+		ah := NewAdminHandlers()
+		ah.Init(app, ah.ConfigStruct())
+		ah.authToken = []byte("s3cr3t")
+
+		req := &http.Request{
+			Method: "GET",
+			Header: http.Header{},
+			URL:    &url.URL{Path: "/memory"},
+		}
+		req.Header.Set("Authorization", "Bearer s3cr3t")
+
+		Convey("Should report usage by subsystem", func() {
+			app.memory = NewMemoryAccounts()
+			app.memory.Register("token_cache", fixedSizer(1024))
+			app.memory.Register("write_buffer", fixedSizer(256))
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, req)
+			So(resp.Code, ShouldEqual, 200)
+			So(resp.Body.String(), ShouldEqual,
+				`{"total":1280,"subsystems":{"token_cache":1024,"write_buffer":256}}`)
+		})
+
+		Convey("Should reject requests if memory accounting is disabled", func() {
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, req)
+			So(resp.Code, ShouldEqual, 501)
+		})
+	})
+}
+
+func TestAdminTranscripts(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Admin transcript API", t, func() {
+		useMockFuncs()
+		defer useStdFuncs()
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+
+		ah := NewAdminHandlers()
+		ah.Init(app, ah.ConfigStruct())
+		ah.authToken = []byte("s3cr3t")
+
+		uaid := "d1c7c768b1be4c7093a69b52910d4baa"
+		newRequest := func(method, path string) *http.Request {
+			req := &http.Request{
+				Method: method,
+				Header: http.Header{},
+				URL:    &url.URL{Path: path},
+			}
+			req.Header.Set("Authorization", "Bearer s3cr3t")
+			return req
+		}
+
+		Convey("Should flag devices and return their transcripts", func() {
+			sh := NewSocketHandler()
+			conf := sh.ConfigStruct().(*SocketHandlerConfig)
+			sh.transcripts = NewTranscriptRecorder(app, conf.Transcripts)
+			app.SetSocketHandler(sh)
+
+			gomock.InOrder(
+				mckStat.EXPECT().Gauge("client.transcript.flagged", int64(1)),
+				mckStat.EXPECT().Increment("admin.transcript.flagged"),
+			)
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("PUT", "/transcripts/"+uaid))
+			So(resp.Code, ShouldEqual, 200)
+
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/transcripts/"))
+			So(resp.Body.String(), ShouldEqual, `["`+uaid+`"]`)
+
+			sh.Transcripts().Transcript(uaid).Record("rid", TranscriptOut,
+				[]byte(`{"messageType":"register","pushEndpoint":"https://example.com"}`))
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/transcripts/"+uaid))
+			So(resp.Code, ShouldEqual, 200)
+			So(resp.Body.String(), ShouldEqual, `[{"time":1257894000000,"dir":"out","rid":"rid",`+
+				`"data":{"messageType":"register","pushEndpoint":"[scrubbed]"}}]`)
+
+			gomock.InOrder(
+				mckStat.EXPECT().Gauge("client.transcript.flagged", int64(0)),
+				mckStat.EXPECT().Increment("admin.transcript.dropped"),
+			)
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("DELETE", "/transcripts/"+uaid))
+			So(resp.Code, ShouldEqual, 200)
+
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/transcripts/"+uaid))
+			So(resp.Code, ShouldEqual, 404)
+		})
+
+		Convey("Should reject requests if recording is disabled", func() {
+			app.SetSocketHandler(NewSocketHandler())
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/transcripts/"))
+			So(resp.Code, ShouldEqual, 501)
+		})
+	})
+}
+
+func TestAdminChannels(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	uaid := "d1c7c768b1be4c7093a69b52910d4baa"
+
+	Convey("Admin channel list", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+
+		newRequest := func(uaid string) *http.Request {
+			req := &http.Request{
+				Method: "GET",
+				Header: http.Header{},
+				URL:    &url.URL{Path: "/devices/" + uaid + "/channels"},
+			}
+			req.Header.Set("Authorization", "Bearer s3cr3t")
+			return req
+		}
+		newHandlers := func(store Store) *AdminHandlers {
+			app.SetStore(store)
+			ah := NewAdminHandlers()
+			ah.Init(app, ah.ConfigStruct())
+			ah.authToken = []byte("s3cr3t")
+			return ah
+		}
+
+		Convey("Should return channels and creation times", func() {
+			ah := newHandlers(&describingStore{channels: []ChannelInfo{
+				{"a", 1257894000}, {"b", 0}}})
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest(uaid))
+			So(resp.Code, ShouldEqual, 200)
+			So(resp.Body.String(), ShouldEqual,
+				`[{"channelID":"a","created":1257894000},{"channelID":"b"}]`)
+		})
+
+		Convey("Should reject invalid device IDs", func() {
+			ah := newHandlers(&channelStore{})
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("bogus"))
+			So(resp.Code, ShouldEqual, 400)
+		})
+
+		Convey("Should reject requests if the store can't list channels", func() {
+			ah := newHandlers(&NoStore{})
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest(uaid))
+			So(resp.Code, ShouldEqual, 501)
+		})
+	})
+}
+
+// connectStore records device handshake times.
+type connectStore struct {
+	*MockStore
+	lastConnect map[string]time.Time
+}
+
+func (s *connectStore) FetchLastConnect(uaid string) (time.Time, error) {
+	return s.lastConnect[uaid], nil
+}
+
+func (s *connectStore) PutLastConnect(uaid string, t time.Time) error {
+	s.lastConnect[uaid] = t
+	return nil
+}
+
+func TestAdminDevices(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+
+	uaid := "d1c7c768b1be4c7093a69b52910d4baa"
+	chid := "6a2e8d4a4f5b4d3c9a1e2f3b4c5d6e7f"
+
+	Convey("Admin device API", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		store := &connectStore{mckStore, map[string]time.Time{
+			uaid: time.Unix(1257894000, 0)}}
+		app.SetStore(store)
+
+		ah := NewAdminHandlers()
+		ah.Init(app, ah.ConfigStruct())
+		ah.authToken = []byte("s3cr3t")
+
+		newRequest := func(method, path string) *http.Request {
+			req := &http.Request{
+				Method: method,
+				Header: http.Header{},
+				URL:    &url.URL{Path: path},
+			}
+			req.Header.Set("Authorization", "Bearer s3cr3t")
+			return req
+		}
+
+		Convey("Should return pending updates and the last handshake time", func() {
+			mckStore.EXPECT().FetchAll(uaid, time.Time{}).Return(
+				[]Update{{ChannelID: chid, Version: 3}}, nil, nil)
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/devices/"+uaid))
+			So(resp.Code, ShouldEqual, 200)
+			So(resp.Body.String(), ShouldEqual, `{"uaid":"`+uaid+`",`+
+				`"connected":false,"lastConnect":1257894000000,`+
+				`"pending":[{"channelID":"`+chid+`","version":3,"data":""}],"expired":[]}`)
+		})
+
+		Convey("Should report store errors", func() {
+			mckStore.EXPECT().FetchAll(uaid, time.Time{}).Return(
+				nil, nil, errors.New("oops"))
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/devices/"+uaid))
+			So(resp.Code, ShouldEqual, 500)
+		})
+
+		Convey("Should drop and disconnect devices", func() {
+			mckWorker := NewMockWorker(mockCtrl)
+			app.AddWorker(uaid, mckWorker)
+			gomock.InOrder(
+				mckStore.EXPECT().DropAll(uaid),
+				mckStore.EXPECT().DropPing(uaid),
+				mckWorker.EXPECT().Close(),
+				mckStat.EXPECT().Increment("admin.device.dropped"),
+			)
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("DELETE", "/devices/"+uaid))
+			So(resp.Code, ShouldEqual, 200)
+		})
+
+		Convey("Should drop channels", func() {
+			gomock.InOrder(
+				mckStore.EXPECT().Unregister(uaid, chid),
+				mckStat.EXPECT().Increment("admin.channel.dropped"),
+			)
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("DELETE",
+				"/devices/"+uaid+"/channels/"+chid))
+			So(resp.Code, ShouldEqual, 200)
+
+			mckStore.EXPECT().Unregister(uaid, chid).Return(ErrNonexistentChannel)
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("DELETE",
+				"/devices/"+uaid+"/channels/"+chid))
+			So(resp.Code, ShouldEqual, 404)
+		})
+
+		Convey("Should erase devices and return a report", func() {
+			useMockFuncs()
+			defer useStdFuncs()
+
+			// The store doesn't implement DataEraser, so its channels and
+			// ping data are dropped.
+			gomock.InOrder(
+				mckStore.EXPECT().FetchAll(uaid, time.Time{}).Return(
+					[]Update{{ChannelID: chid, Version: 3}}, nil, nil),
+				mckStore.EXPECT().DropAll(uaid),
+				mckStore.EXPECT().FetchPing(uaid).Return([]byte(`{}`), nil),
+				mckStore.EXPECT().DropPing(uaid),
+				mckStat.EXPECT().Increment("admin.device.erased"),
+			)
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("POST", "/devices/"+uaid+"/erase"))
+			So(resp.Code, ShouldEqual, 200)
+			So(resp.Body.String(), ShouldEqual, `{"uaid":"`+uaid+`",`+
+				`"started":1257894000000,"completed":1257894000000,`+
+				`"complete":true,"steps":[{"name":"connection","erased":0},`+
+				`{"name":"store","erased":2}]}`)
+
+			app.AddEraser("archive", &erasingStore{err: errors.New("oops")})
+			gomock.InOrder(
+				mckStore.EXPECT().FetchAll(uaid, time.Time{}),
+				mckStore.EXPECT().DropAll(uaid),
+				mckStore.EXPECT().FetchPing(uaid),
+				mckStat.EXPECT().Increment("admin.device.erase_failed"),
+			)
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("POST", "/devices/"+uaid+"/erase"))
+			So(resp.Code, ShouldEqual, 500)
+		})
+
+		Convey("Should export devices as attachments", func() {
+			useMockFuncs()
+			defer useStdFuncs()
+
+			gomock.InOrder(
+				mckStore.EXPECT().FetchAll(uaid, time.Time{}).Return(
+					[]Update{{ChannelID: chid, Version: 3, Data: "hi"}}, nil, nil),
+				mckStore.EXPECT().FetchPing(uaid),
+				mckStat.EXPECT().Increment("admin.device.exported"),
+			)
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/devices/"+uaid+"/export"))
+			So(resp.Code, ShouldEqual, 200)
+			So(resp.Header().Get("Content-Disposition"), ShouldEqual,
+				`attachment; filename="`+uaid+`.json"`)
+			So(resp.Body.String(), ShouldEqual, `{"uaid":"`+uaid+`",`+
+				`"exported":1257894000000,"lastConnect":1257894000000,`+
+				`"channels":[],"pending":[{"channelID":"`+chid+`","version":3,`+
+				`"dataLength":2}],"expired":[]}`)
+
+			mckStore.EXPECT().FetchAll(uaid, time.Time{}).Return(
+				nil, nil, errors.New("oops"))
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("GET", "/devices/"+uaid+"/export"))
+			So(resp.Code, ShouldEqual, 500)
+		})
+
+		Convey("Should reject invalid device IDs", func() {
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest("DELETE", "/devices/bogus"))
+			So(resp.Code, ShouldEqual, 400)
+		})
+	})
+}
+
+// listingStore lists a fixed channel set for every device.
+type listingStore struct {
+	*MockStore
+	chids []string
+}
+
+func (s *listingStore) FetchChannels(string) ([]string, error) {
+	return s.chids, nil
+}
+
+func TestAdminInject(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+	mckRouter := NewMockRouter(mockCtrl)
+
+	uaid := "d1c7c768b1be4c7093a69b52910d4baa"
+
+	Convey("Admin update injection", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(&listingStore{mckStore, []string{"456", "789"}})
+		app.SetRouter(mckRouter)
+
+		eh := NewEndpointHandler()
+		eh.setApp(app)
+		eh.setMaxDataLen(16)
+		app.SetEndpointHandler(eh)
+
+		ah := NewAdminHandlers()
+		ah.Init(app, ah.ConfigStruct())
+		ah.authToken = []byte("s3cr3t")
+
+		newRequest := func(body string) *http.Request {
+			req := &http.Request{
+				Method: "POST",
+				Header: http.Header{},
+				URL:    &url.URL{Path: "/inject"},
+				Body:   ioutil.NopCloser(strings.NewReader(body)),
+			}
+			req.Header.Set("Authorization", "Bearer s3cr3t")
+			req.Header.Set(HeaderID, "rid")
+			return req
+		}
+
+		Convey("Should store and deliver to a device's first channel", func() {
+			gomock.InOrder(
+				mckStore.EXPECT().Exists(uaid).Return(true),
+				mckStat.EXPECT().Increment("updates.injected"),
+				mckStore.EXPECT().Update(uaid, "456", int64(5)).Return(nil),
+				mckStat.EXPECT().Increment("updates.routed.outgoing"),
+				mckRouter.EXPECT().Route(nil, uaid, "456", int64(5),
+					gomock.Any(), "rid", "hi").Return(true, nil),
+				mckStat.EXPECT().Increment("router.broadcast.hit"),
+				mckStat.EXPECT().Timer("updates.routed.hits", gomock.Any()),
+				mckStat.EXPECT().Increment("updates.appserver.received"),
+				mckStat.EXPECT().Increment("admin.injected"),
+			)
+
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest(
+				`{"uaid":"`+uaid+`","version":5,"data":"hi"}`))
+			So(resp.Code, ShouldEqual, 200)
+			body, isJSON := getJSON(resp.HeaderMap, resp.Body)
+			So(isJSON, ShouldBeTrue)
+			So(body.String(), ShouldContainSubstring, `"channelID":"456"`)
+			So(body.String(), ShouldContainSubstring, `"delivered":true`)
+			So(body.String(), ShouldContainSubstring, `"name":"deliver"`)
+		})
+
+		Convey("Should trace storage failures", func() {
+			gomock.InOrder(
+				mckStore.EXPECT().Exists(uaid).Return(true),
+				mckStat.EXPECT().Increment("updates.injected"),
+				mckStore.EXPECT().Update(uaid, "789", int64(5)).Return(
+					ErrRecordUpdateFailed),
+				mckStat.EXPECT().Increment("admin.injected"),
+			)
+
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest(
+				`{"uaid":"`+uaid+`","channelID":"789","version":5}`))
+			So(resp.Code, ShouldEqual, 200)
+			So(resp.Body.String(), ShouldContainSubstring,
+				`"error":"Error updating channel record"`)
+			So(resp.Body.String(), ShouldContainSubstring, `"delivered":false`)
+		})
+
+		Convey("Should reject unknown devices and invalid targets", func() {
+			mckStore.EXPECT().Exists(uaid).Return(false)
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest(`{"uaid":"`+uaid+`"}`))
+			So(resp.Code, ShouldEqual, 404)
+
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest(`{"uaid":"abc"}`))
+			So(resp.Code, ShouldEqual, 400)
+
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest(`{}`))
+			So(resp.Code, ShouldEqual, 400)
+
+			resp = httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest(
+				`{"uaid":"`+uaid+`","data":"0123456789abcdefg"}`))
+			So(resp.Code, ShouldEqual, 413)
+		})
+	})
+}
@@ -6,6 +6,7 @@ package simplepush
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
@@ -14,10 +15,13 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+
+	"github.com/mozilla-services/pushgo/retry"
 )
 
 func NewEndpointHandler() (h *EndpointHandler) {
 	h = &EndpointHandler{mux: mux.NewRouter()}
+	h.mux.HandleFunc("/update/{key}", h.DeleteHandler).Methods("DELETE")
 	h.mux.HandleFunc("/update/{key}", h.UpdateHandler)
 	return h
 }
@@ -26,9 +30,68 @@ type EndpointHandlerConfig struct {
 	MaxDataLen  int  `toml:"max_data_len" env:"max_data_len"`
 	AlwaysRoute bool `toml:"always_route" env:"always_route"`
 	EnableCORS  bool `toml:"enable_cors" env:"enable_cors"`
-	Listener    TCPListenerConfig
+
+	// DeadLetters queues updates that could not be stored for later replay
+	// via the admin API. Requires a store that supports dead letters.
+	DeadLetters bool `toml:"dead_letters" env:"dead_letters"`
+
+	// Retry configures retries for failed storage updates, before they're
+	// queued as dead letters. Only used if DeadLetters is enabled.
+	Retry retry.Config
+
+	// AllowDelete lets app servers deactivate a channel by sending a DELETE
+	// request to its push endpoint. Requires encrypted endpoint tokens.
+	AllowDelete bool `toml:"allow_delete" env:"allow_delete"`
+
+	// Bridge relays updates from an upstream push service to local clients.
+	Bridge BridgeConfig
+
+	// TokenCache caches resolved endpoint tokens.
+	TokenCache TokenCacheConfig `toml:"token_cache" env:"token_cache"`
+
+	// Queue stores and routes updates in a bounded worker pool.
+	Queue UpdateQueueConfig
+
+	// LocalFirst delivers updates for clients connected to this server before
+	// storing them, and stores them in a bounded worker pool. Ignored if
+	// AlwaysRoute is set.
+	LocalFirst LocalFirstConfig `toml:"local_first" env:"local_first"`
+
+	// RequestTimeout bounds the time spent storing and routing an update,
+	// including retries. Updates that exceed the timeout are rejected with a
+	// 503. Disabled if empty.
+	RequestTimeout string `toml:"request_timeout" env:"request_timeout"`
+
+	// MaxCalls limits the store and proprietary ping calls running on behalf
+	// of requests with a timeout, including calls abandoned when their
+	// request timed out. Requests wait for a free slot until their timeout.
+	// Unlimited if zero.
+	MaxCalls int `toml:"max_calls" env:"max_calls"`
+
+	// RetryAfter adds Retry-After headers to 503 responses.
+	RetryAfter RetryAfterConfig `toml:"retry_after" env:"retry_after"`
+
+	// Versions configures versions generated for updates sent without one.
+	Versions VersionConfig
+
+	// APIKeys authenticates app servers with per-tenant API keys, sent as
+	// bearer tokens, and limits their update rates. Requires a store that
+	// supports API keys.
+	APIKeys APIKeyConfig `toml:"api_keys" env:"api_keys"`
+
+	Listener TCPListenerConfig
 }
 
+// HeaderTTL is the update TTL header sent by app servers, in seconds. Updates
+// that are not delivered within the TTL are discarded. Updates without a TTL
+// are kept until the channel record times out.
+const HeaderTTL = "TTL"
+
+// MaxTTL is the longest TTL accepted from app servers, in seconds. Longer
+// TTLs are rejected rather than clamped, and would overflow time.Duration
+// beyond about 292 years.
+const MaxTTL = 30 * 24 * 60 * 60
+
 type EndpointHandler struct {
 	app         *Application
 	logger      *SimpleLogger
@@ -36,6 +99,11 @@ type EndpointHandler struct {
 	store       Store
 	router      Router
 	pinger      PropPinger
+	pingerName  string
+	wake        *WakeTracker
+	tiering     *PayloadTiering
+	payloads    *StoredPayloads
+	residency   *Residency
 	balancer    Balancer
 	hostname    string
 	tokenKey    []byte
@@ -48,6 +116,21 @@ type EndpointHandler struct {
 	alwaysRoute bool
 	closeOnce   Once
 	enableCors  bool
+	rh          *retry.Helper
+	deadLetters DeadLetterStore
+	tombstones  TombstoneStore
+	expiring    ExpiringStore
+	allowDelete bool
+	bridge      *Bridge
+	tokenCache  *TokenCache
+	queue       *UpdateQueue
+	localWrites *LocalWrites
+	asyncReply  bool
+	timeout     time.Duration
+	calls       *CallLimiter
+	retryAfter  *RetryAdvisor
+	versions    *VersionSource
+	apiKeys     *APIKeys
 }
 
 func (h *EndpointHandler) ConfigStruct() interface{} {
@@ -55,10 +138,60 @@ func (h *EndpointHandler) ConfigStruct() interface{} {
 		MaxDataLen:  4096,
 		AlwaysRoute: false,
 		EnableCORS:  false,
+		DeadLetters: false,
+		AllowDelete: false,
+		Retry: retry.Config{
+			Retries:   2,
+			Delay:     "50ms",
+			MaxDelay:  "200ms",
+			MaxJitter: "50ms",
+		},
+		Bridge: BridgeConfig{
+			Enabled:   false,
+			State:     "bridge.json",
+			Reconnect: "5s",
+			SaveDelay: "1s",
+		},
+		TokenCache: TokenCacheConfig{
+			Enabled: false,
+			Size:    10000,
+		},
+		Queue: UpdateQueueConfig{
+			Enabled:    false,
+			Size:       1000,
+			Workers:    50,
+			AsyncReply: false,
+		},
+		LocalFirst: LocalFirstConfig{
+			Enabled: false,
+			Size:    1000,
+			Workers: 10,
+		},
+		RetryAfter: RetryAfterConfig{
+			Enabled:    false,
+			MinDelay:   "1s",
+			MaxDelay:   "5m",
+			MaxJitter:  "5s",
+			MaxTracked: 10000,
+		},
+		Versions: VersionConfig{
+			Resolution: "s",
+			Monotonic:  false,
+		},
+		APIKeys: APIKeyConfig{
+			Enabled:     false,
+			Required:    false,
+			CacheTTL:    "1m",
+			RotateGrace: "24h",
+		},
+		MaxCalls: 1000,
 		Listener: TCPListenerConfig{
 			Addr:            ":8081",
 			MaxConns:        1000,
 			KeepAlivePeriod: "3m",
+			ReadTimeout:     "1m",
+			IdleTimeout:     "30s",
+			MaxHeaderBytes:  1 << 16,
 		},
 	}
 }
@@ -67,7 +200,13 @@ func (h *EndpointHandler) Init(app *Application, config interface{}) (err error)
 	conf := config.(*EndpointHandlerConfig)
 	h.setApp(app)
 
-	if h.listener, err = conf.Listener.Listen(); err != nil {
+	if err = conf.Listener.ConfigureServer(h.server); err != nil {
+		h.logger.Panic("handlers_endpoint", "Invalid update server timeouts",
+			LogFields{"error": err.Error()})
+		return err
+	}
+
+	if h.listener, err = conf.Listener.Listen(app); err != nil {
 		h.logger.Panic("handlers_endpoint", "Could not attach update listener",
 			LogFields{"error": err.Error()})
 		return err
@@ -87,6 +226,89 @@ func (h *EndpointHandler) Init(app *Application, config interface{}) (err error)
 	h.alwaysRoute = conf.AlwaysRoute
 	h.enableCors = conf.EnableCORS
 
+	if h.versions, err = NewVersionSource(conf.Versions); err != nil {
+		h.logger.Panic("handlers_endpoint", "Invalid version configuration",
+			LogFields{"error": err.Error(), "resolution": conf.Versions.Resolution})
+		return err
+	}
+
+	if conf.DeadLetters {
+		if h.deadLetters = app.DeadLetters(); h.deadLetters == nil &&
+			h.logger.ShouldLog(WARNING) {
+
+			h.logger.Warn("handlers_endpoint",
+				"Storage does not support dead letters; disabling", nil)
+		}
+	}
+
+	if h.deadLetters != nil {
+		if h.rh, err = conf.Retry.NewHelper(); err != nil {
+			h.logger.Panic("handlers_endpoint", "Error configuring retry helper",
+				LogFields{"error": err.Error()})
+			return err
+		}
+		h.rh.CanRetry = isTemporaryStoreErr
+	}
+
+	if conf.AllowDelete {
+		// Plaintext tokens can be derived from the device and channel IDs, so
+		// only encrypted tokens authenticate the app server.
+		if len(h.tokenKey) > 0 {
+			h.allowDelete = true
+		} else if h.logger.ShouldLog(WARNING) {
+			h.logger.Warn("handlers_endpoint",
+				"Deleting endpoints requires a token key; disabling", nil)
+		}
+	}
+
+	if conf.Bridge.Enabled {
+		if h.bridge, err = NewBridge(app, conf.Bridge, h); err != nil {
+			h.logger.Panic("handlers_endpoint", "Could not configure upstream bridge",
+				LogFields{"error": err.Error(), "origin": conf.Bridge.Origin})
+			return err
+		}
+		app.SetBridge(h.bridge)
+	}
+
+	if conf.TokenCache.Enabled {
+		h.tokenCache = NewTokenCache(app, conf.TokenCache)
+	}
+
+	if conf.Queue.Enabled {
+		h.queue = NewUpdateQueue(app, conf.Queue, h.processUpdate)
+		h.asyncReply = conf.Queue.AsyncReply
+	}
+
+	if conf.LocalFirst.Enabled && !conf.AlwaysRoute {
+		h.localWrites = NewLocalWrites(app, conf.LocalFirst, h.storeDelivered)
+		app.SetLocalWrites(h.localWrites)
+	}
+
+	if len(conf.RequestTimeout) > 0 {
+		if h.timeout, err = time.ParseDuration(conf.RequestTimeout); err != nil {
+			h.logger.Panic("handlers_endpoint", "Invalid request timeout",
+				LogFields{"error": err.Error(), "timeout": conf.RequestTimeout})
+			return err
+		}
+		h.calls = NewCallLimiter(conf.MaxCalls)
+	}
+
+	if conf.RetryAfter.Enabled {
+		if h.retryAfter, err = NewRetryAdvisor(app, conf.RetryAfter); err != nil {
+			h.logger.Panic("handlers_endpoint", "Invalid Retry-After settings",
+				LogFields{"error": err.Error()})
+			return err
+		}
+	}
+
+	if conf.APIKeys.Enabled {
+		if h.apiKeys, err = NewAPIKeys(app, conf.APIKeys); err != nil {
+			h.logger.Panic("handlers_endpoint", "Could not configure API keys",
+				LogFields{"error": err.Error()})
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -95,14 +317,25 @@ func (h *EndpointHandler) MaxConns() int          { return h.maxConns }
 func (h *EndpointHandler) URL() string            { return h.url }
 func (h *EndpointHandler) ServeMux() ServeMux     { return (*RouteMux)(h.mux) }
 
+// APIKeys returns the app server API keys, or nil if API keys are disabled.
+// Implements APIKeyHandler.APIKeys().
+func (h *EndpointHandler) APIKeys() *APIKeys { return h.apiKeys }
+
 // setApp sets the parent application for this update handler.
 func (h *EndpointHandler) setApp(app *Application) {
 	h.app = app
 	h.logger = app.Logger()
 	h.metrics = app.Metrics()
 	h.store = app.Store()
+	h.tombstones, _ = h.store.(TombstoneStore)
+	h.expiring, _ = h.store.(ExpiringStore)
 	h.router = app.Router()
 	h.pinger = app.PropPinger()
+	h.pingerName = PingerName(h.pinger)
+	h.wake = app.Wake()
+	h.tiering = NewPayloadTiering(app)
+	h.payloads = NewStoredPayloads(app)
+	h.residency = app.Residency()
 	h.tokenKey = app.TokenKey()
 	h.server = NewServeCloser(&http.Server{
 		ConnState: func(c net.Conn, state http.ConnState) {
@@ -131,17 +364,32 @@ func (h *EndpointHandler) Start(errChan chan<- error) {
 		h.logger.Info("handlers_endpoint", "Starting update server",
 			LogFields{"url": h.url})
 	}
+	if h.bridge != nil {
+		go h.bridge.Run()
+	}
+	if h.queue != nil {
+		h.queue.Start()
+	}
+	if h.localWrites != nil {
+		h.localWrites.Start()
+	}
 	errChan <- h.server.Serve(h.listener)
 }
 
 func (h *EndpointHandler) decodePK(token string) (key string, err error) {
+	return decodeToken(h.tokenKey, token)
+}
+
+// decodeToken decrypts an endpoint token with tokenKey. Returns the token
+// as-is if tokenKey is empty.
+func decodeToken(tokenKey []byte, token string) (key string, err error) {
 	if len(token) == 0 {
 		return "", fmt.Errorf("Missing primary key")
 	}
-	if len(h.tokenKey) == 0 {
+	if len(tokenKey) == 0 {
 		return token, nil
 	}
-	bpk, err := Decode(h.tokenKey, token)
+	bpk, err := cryptoProvider.DecryptToken(tokenKey, token)
 	if err != nil {
 		return "", err
 	}
@@ -149,7 +397,27 @@ func (h *EndpointHandler) decodePK(token string) (key string, err error) {
 }
 
 func (h *EndpointHandler) resolvePK(token string) (uaid, chid string, err error) {
-	pk, err := h.decodePK(token)
+	return h.resolveToken(nil, token)
+}
+
+// resolveToken resolves an endpoint token issued by the virtual server vs, or
+// by this server if vs is nil.
+func (h *EndpointHandler) resolveToken(vs *VirtualServer, token string) (
+	uaid, chid string, err error) {
+
+	tokenKey, cacheKey := h.tokenKey, token
+	if vs != nil {
+		// Cache tokens per virtual server, so that a token issued by one
+		// virtual server isn't accepted by another.
+		tokenKey, cacheKey = vs.TokenKey(), vs.Name()+":"+token
+	}
+	if h.tokenCache != nil {
+		var ok bool
+		if uaid, chid, ok = h.tokenCache.Get(cacheKey); ok {
+			return uaid, chid, nil
+		}
+	}
+	pk, err := decodeToken(tokenKey, token)
 	if err != nil {
 		err = fmt.Errorf("Error decoding primary key: %s", err)
 		return "", "", err
@@ -161,24 +429,71 @@ func (h *EndpointHandler) resolvePK(token string) (uaid, chid string, err error)
 	if uaid, chid, err = h.store.KeyToIDs(pk); err != nil {
 		return "", "", err
 	}
+	if h.tokenCache != nil {
+		h.tokenCache.Put(cacheKey, uaid, chid)
+	}
 	return uaid, chid, nil
 }
 
-func (h *EndpointHandler) doPropPing(uaid string, version int64, data string) (ok bool, err error) {
+// InvalidateTokens removes the cached tokens for an unregistered channel.
+// Implements TokenInvalidator.InvalidateTokens().
+func (h *EndpointHandler) InvalidateTokens(uaid, chid string) {
+	if h.tokenCache != nil {
+		h.tokenCache.Invalidate(uaid, chid)
+	}
+}
+
+// doPropPing sends a proprietary ping for the update. Returns true if the
+// pinger delivered the update, and the WebSocket can be bypassed. Oversized
+// payloads are sent as data-less wakeups, and the update is delivered as
+// usual.
+func (h *EndpointHandler) doPropPing(uaid, chid string, version int64, data string) (ok bool, err error) {
 	if h.pinger == nil {
 		return false, nil
 	}
+	wakeup := h.tiering.Wakeup(uaid, chid, version, data)
+	if wakeup {
+		data = ""
+	}
 	if ok, err = h.pinger.Send(uaid, version, data); err != nil {
+		h.wake.Failed(h.pingerName)
 		return false, fmt.Errorf("Could not send proprietary ping: %s", err)
 	}
 	if !ok {
 		return false, nil
 	}
+	h.wake.Sent(h.pingerName, uaid)
+	if wakeup {
+		// The device must reconnect to fetch the payload.
+		return false, nil
+	}
 	/* if this is a GCM connected host, boot vers immediately to GCM
 	 */
 	return h.pinger.CanBypassWebsocket(), nil
 }
 
+// getUpdateExpiry returns the time when an update expires, from the TTL
+// header or form field in req, in seconds. Returns the zero value if the
+// update does not expire, and ErrInvalidTTL if the TTL is not an integer
+// between 0 and MaxTTL.
+func (h *EndpointHandler) getUpdateExpiry(req *http.Request) (
+	expiresAt time.Time, err error) {
+
+	sttl := req.Header.Get(HeaderTTL)
+	if len(sttl) == 0 {
+		sttl = req.FormValue("ttl")
+	}
+	if len(sttl) == 0 {
+		return time.Time{}, nil
+	}
+	ttl, err := strconv.ParseInt(sttl, 10, 64)
+	if err != nil || ttl < 0 || ttl > MaxTTL {
+		return time.Time{}, ErrInvalidTTL
+	}
+	h.metrics.Increment("updates.appserver.ttl")
+	return timeNow().Add(time.Duration(ttl) * time.Second), nil
+}
+
 // getUpdateParams extracts the update version and data from req.
 func (h *EndpointHandler) getUpdateParams(req *http.Request) (version int64, data string, err error) {
 	if req.Header.Get("Content-Type") == "" {
@@ -187,11 +502,11 @@ func (h *EndpointHandler) getUpdateParams(req *http.Request) (version int64, dat
 	}
 	svers := req.FormValue("version")
 	if svers != "" {
-		if version, err = strconv.ParseInt(svers, 10, 64); err != nil || version < 0 {
-			return 0, "", ErrBadVersion
+		if version, err = ParseVersion(svers); err != nil {
+			return 0, "", err
 		}
 	} else {
-		version = timeNow().UTC().Unix()
+		version = h.versions.Next()
 	}
 
 	data = req.FormValue("data")
@@ -263,17 +578,30 @@ func (h *EndpointHandler) UpdateHandler(resp http.ResponseWriter, req *http.Requ
 			h.metrics.Increment("updates.appserver.toolong")
 			return
 		}
+		if err == ErrVersionOverflow {
+			writeJSON(resp, http.StatusBadRequest, []byte(`"Version Out of Range"`))
+			h.metrics.Increment("updates.appserver.invalid")
+			return
+		}
 		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid Version"`))
 		h.metrics.Increment("updates.appserver.invalid")
 		return
 	}
+	expiresAt, err := h.getUpdateExpiry(req)
+	if err != nil {
+		writeJSON(resp, http.StatusBadRequest, []byte(`"Invalid TTL"`))
+		h.metrics.Increment("updates.appserver.invalid")
+		return
+	}
+	lowUrgency := IsLowUrgency(req.Header.Get(HeaderUrgency))
 
 	// TODO:
 	// is there a magic flag for proxyable endpoints?
 	// e.g. update/p/gcm/LSoC or something?
 	// (Note, this would allow us to use smarter FE proxies.)
 	token := mux.Vars(req)["key"]
-	if uaid, chid, err = h.resolvePK(token); err != nil {
+	vs := h.app.VirtualServer(req.Host)
+	if uaid, chid, err = h.resolveToken(vs, token); err != nil {
 		if logWarning {
 			h.logger.Warn("handlers_endpoint", "Invalid primary key for update",
 				LogFields{"error": err.Error(), "rid": requestID, "token": token})
@@ -283,18 +611,84 @@ func (h *EndpointHandler) UpdateHandler(resp http.ResponseWriter, req *http.Requ
 		return
 	}
 
+	cn, _ := resp.(http.CloseNotifier)
+	var deadline *Deadline
+	if h.timeout > 0 {
+		// Abandon store calls, proprietary pings, and routing if the client
+		// goes away, or if the update isn't handled before the deadline.
+		deadline = NewDeadline(h.timeout, cn, h.calls)
+		defer deadline.Stop()
+	}
+
+	var key *APIKey
+	err = deadline.Do(func() (err error) {
+		key, err = h.apiKeys.Check(req, tenantName(vs))
+		return
+	})
+	if err == ErrDeadlineExceeded {
+		h.writeTimeout(resp, requestID, uaid, chid)
+		return
+	}
+	if err != nil {
+		h.writeKeyError(resp, requestID, key, err)
+		return
+	}
+
 	// At this point we should have a valid endpoint in the URL
 	h.metrics.Increment("updates.appserver.incoming")
+	if vs != nil {
+		vs.Metrics().Increment("updates.appserver.incoming")
+	}
+	if h.retryAfter != nil {
+		h.retryAfter.Check(uaid, chid)
+	}
+
+	// Don't store or route updates for devices registered in other regions.
+	err = deadline.Do(func() error { return h.residency.Check(uaid) })
+	if err == ErrDeadlineExceeded {
+		h.writeTimeout(resp, requestID, uaid, chid)
+		return
+	}
+	if err != nil {
+		status, message := ErrToStatus(err)
+		writeJSON(resp, status, []byte(`"`+message+`"`))
+		return
+	}
+
+	// Don't ping unregistered channels. Proprietary pings are sent before the
+	// update is stored, so the tombstone is checked here; otherwise, the store
+	// rejects the update with ErrChannelGone, and that single check covers
+	// local delivery and routing.
+	if h.pinger != nil {
+		gone, err := h.isGone(deadline, uaid, chid)
+		if err == ErrDeadlineExceeded {
+			h.writeTimeout(resp, requestID, uaid, chid)
+			return
+		}
+		if gone {
+			h.writeGone(resp, requestID, uaid, chid)
+			return
+		}
+	}
 
 	// is there a Proprietary Ping for this?
-	updateSent, err = h.doPropPing(uaid, version, data)
+	var pinged bool
+	err = deadline.Do(func() (err error) {
+		pinged, err = h.doPropPing(uaid, chid, version, data)
+		return
+	})
+	if err == ErrDeadlineExceeded {
+		h.writeTimeout(resp, requestID, uaid, chid)
+		return
+	}
 	if err != nil {
 		if logWarning {
 			h.logger.Warn("handlers_endpoint", "Could not send proprietary ping",
 				LogFields{"rid": requestID, "uaid": uaid, "error": err.Error()})
 		}
-	} else if updateSent {
+	} else if pinged {
 		// Neat! Might as well return.
+		updateSent = true
 		h.metrics.Increment("updates.appserver.received")
 		writeSuccess(resp)
 		return
@@ -306,7 +700,184 @@ func (h *EndpointHandler) UpdateHandler(resp http.ResponseWriter, req *http.Requ
 				"version": strconv.FormatInt(version, 10)})
 	}
 
-	if err = h.store.Update(uaid, chid, version); err != nil {
+	if deadline != nil {
+		cn = deadline
+	}
+	if h.queue == nil {
+		updateSent = h.storeAndDeliver(resp, cn, deadline, requestID, uaid, chid,
+			version, data, lowUrgency, expiresAt)
+		return
+	}
+	job := &updateJob{
+		requestID:  requestID,
+		uaid:       uaid,
+		chid:       chid,
+		version:    version,
+		data:       data,
+		lowUrgency: lowUrgency,
+		expiresAt:  expiresAt,
+	}
+	if h.asyncReply {
+		if !h.queue.Put(job) {
+			h.writeQueueFull(resp, requestID, uaid, chid)
+			return
+		}
+		writeJSON(resp, http.StatusAccepted, []byte(`"Update queued"`))
+		return
+	}
+	job.cn = cn
+	job.deadline = deadline
+	job.done = make(chan bool)
+	if !h.queue.Put(job) {
+		h.writeQueueFull(resp, requestID, uaid, chid)
+		return
+	}
+	// Queued updates are processed even if the queue closes, so wait for the
+	// result instead of asking the app server to retry a delivered update.
+	select {
+	case <-job.done:
+		job.reply.copyTo(resp)
+		updateSent = job.sent
+	case <-deadline.CloseNotify():
+		h.writeTimeout(resp, requestID, uaid, chid)
+	}
+	return
+}
+
+// processUpdate stores and routes a queued update.
+func (h *EndpointHandler) processUpdate(job *updateJob) {
+	if job.deadline == nil && h.timeout > 0 {
+		// Async replies don't hold the connection open, so the deadline starts
+		// when the update is dequeued.
+		job.deadline = NewDeadline(h.timeout, nil, h.calls)
+		job.cn = job.deadline
+	}
+	defer job.deadline.Stop()
+	if job.deadline.Expired() {
+		// The request timed out or was closed while the update was queued.
+		h.metrics.Increment("endpoint.queue.expired")
+		return
+	}
+	job.sent = h.storeAndDeliver(&job.reply, job.cn, job.deadline,
+		job.requestID, job.uaid, job.chid, job.version, job.data, job.lowUrgency,
+		job.expiresAt)
+}
+
+// writeQueueFull rejects an update received while the update queue is full.
+func (h *EndpointHandler) writeQueueFull(resp http.ResponseWriter,
+	requestID, uaid, chid string) {
+
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_endpoint", "Update queue full, rejecting request",
+			LogFields{"rid": requestID})
+	}
+	if h.retryAfter != nil {
+		h.retryAfter.Advise(resp, uaid, chid, h.queue.RecoveryEstimate())
+	}
+	status, _ := ErrToStatus(ErrQueueFull)
+	writeJSON(resp, status, []byte(`"Server busy; retry later"`))
+}
+
+// writeKeyError rejects an update with a missing, invalid, or rate limited
+// API key.
+func (h *EndpointHandler) writeKeyError(resp http.ResponseWriter,
+	requestID string, key *APIKey, err error) {
+
+	if h.logger.ShouldLog(WARNING) {
+		fields := LogFields{"rid": requestID, "error": err.Error()}
+		if key != nil {
+			fields["key"] = key.ID
+			fields["tenant"] = key.Tenant
+		}
+		h.logger.Warn("handlers_endpoint", "Rejected update API key", fields)
+	}
+	if err == ErrAPIKeyLimited {
+		delay := h.apiKeys.RetryDelay(key.ID)
+		resp.Header().Set("Retry-After",
+			strconv.FormatInt(int64((delay+time.Second-1)/time.Second), 10))
+		writeJSON(resp, 429, []byte(`"Rate limit exceeded"`))
+		return
+	}
+	if err == ErrMissingAPIKey || err == ErrInvalidAPIKey ||
+		err == ErrAPIKeyRevoked || err == ErrAPIKeyTenant {
+
+		resp.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(resp, http.StatusUnauthorized, []byte(`"Invalid API key"`))
+		return
+	}
+	// The key could not be fetched.
+	writeJSON(resp, http.StatusServiceUnavailable,
+		[]byte(`"Could not verify API key"`))
+}
+
+// writeTimeout rejects an update that could not be stored before the
+// request deadline.
+func (h *EndpointHandler) writeTimeout(resp http.ResponseWriter,
+	requestID, uaid, chid string) {
+
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_endpoint", "Request deadline exceeded",
+			LogFields{"rid": requestID, "uaid": uaid, "chid": chid})
+	}
+	h.metrics.Increment("updates.appserver.timeout")
+	if h.retryAfter != nil {
+		// The store is unresponsive; wait at least as long as the deadline.
+		h.retryAfter.Advise(resp, uaid, chid, h.timeout)
+	}
+	status, _ := ErrToStatus(ErrDeadlineExceeded)
+	writeJSON(resp, status, []byte(`"Server busy; retry later"`))
+}
+
+// storeAndDeliver stores the update version, then routes the update to the
+// client. Store writes and routing are abandoned if the deadline expires.
+// Low-urgency updates for dozing clients connected to this server are held
+// by the client's worker after they are stored. With local-first delivery,
+// other updates for clients connected to this server are sent first, and
+// stored in the background. Updates with an expiry are discarded if the
+// client doesn't fetch them in time. Returns true if the update was
+// delivered.
+func (h *EndpointHandler) storeAndDeliver(resp http.ResponseWriter,
+	cn http.CloseNotifier, deadline *Deadline, requestID, uaid, chid string,
+	version int64, data string, lowUrgency bool, expiresAt time.Time) (
+	updateSent bool) {
+
+	if h.localWrites != nil && !lowUrgency {
+		if queued, delivered := h.deliverLocal(requestID, uaid, chid, version,
+			data, expiresAt); queued {
+
+			if !delivered {
+				// The update will be stored for the client's next connection.
+				writeJSON(resp, http.StatusAccepted, []byte("{}"))
+				return
+			}
+			writeSuccess(resp)
+			return true
+		}
+	}
+
+	logWarning := h.logger.ShouldLog(WARNING)
+	attempts, err := h.updateStoreExpires(deadline, uaid, chid, version,
+		expiresAt)
+	if err == ErrChannelGone {
+		h.writeGone(resp, requestID, uaid, chid)
+		return
+	}
+	if err == ErrStaleVersion {
+		h.writeStale(resp, requestID, uaid, chid, version)
+		return
+	}
+	if err == ErrDeadlineExceeded {
+		h.writeTimeout(resp, requestID, uaid, chid)
+		return
+	}
+	if err != nil {
+		if h.putDeadLetter(deadline, uaid, chid, version, data, err, attempts,
+			requestID) {
+
+			writeJSON(resp, http.StatusAccepted,
+				[]byte(`"Update queued for redelivery"`))
+			return
+		}
 		if logWarning {
 			h.logger.Warn("handlers_endpoint", "Could not update channel", LogFields{
 				"rid":     requestID,
@@ -320,8 +891,14 @@ func (h *EndpointHandler) UpdateHandler(resp http.ResponseWriter, req *http.Requ
 		writeJSON(resp, status, []byte(`"Could not update channel version"`))
 		return
 	}
+	h.payloads.Put(deadline, uaid, chid, version, data)
+	if lowUrgency && h.deferLocal(uaid, chid, version, data) {
+		// The update is stored, and will be sent when the client wakes.
+		h.metrics.Increment("updates.appserver.deferred")
+		writeJSON(resp, http.StatusAccepted, []byte("{}"))
+		return
+	}
 
-	cn, _ := resp.(http.CloseNotifier)
 	if !h.deliver(cn, uaid, chid, version, requestID, data) {
 		// We've accepted the valid endpoint, stored the data for
 		// eventual pickup by the client, but failed to deliver to
@@ -331,8 +908,409 @@ func (h *EndpointHandler) UpdateHandler(resp http.ResponseWriter, req *http.Requ
 	}
 
 	writeSuccess(resp)
-	updateSent = true
-	return
+	return true
+}
+
+// deliverLocal queues an update for a client connected to this server to be
+// stored in the background, then sends it to the client. Returns false if the
+// client is not connected, or the write queue is full; the caller should
+// store the update before delivering it.
+func (h *EndpointHandler) deliverLocal(requestID, uaid, chid string,
+	version int64, data string, expiresAt time.Time) (queued, delivered bool) {
+
+	worker, ok := h.app.GetWorker(uaid)
+	if !ok {
+		return false, false
+	}
+	// Queue the write first, so that the client can't acknowledge the update
+	// before it's queued.
+	if !h.localWrites.Put(requestID, uaid, chid, version, data, expiresAt) {
+		return false, false
+	}
+	if err := worker.Send(chid, version, data); err != nil {
+		h.metrics.Increment("updates.appserver.rejected")
+		return true, false
+	}
+	h.metrics.Increment("updates.appserver.received")
+	h.metrics.Increment("updates.local.delivered")
+	return true, true
+}
+
+// storeDelivered stores an update delivered to a local client, retrying
+// temporary errors. Updates that still can't be stored are queued as dead
+// letters, if enabled. If the channel was unregistered, the client is told
+// to drop it.
+func (h *EndpointHandler) storeDelivered(write *localWrite) {
+	attempts, err := h.updateStoreExpires(nil, write.uaid, write.chid,
+		write.version, write.expiresAt)
+	if err == nil {
+		h.payloads.Put(nil, write.uaid, write.chid, write.version, write.data)
+		return
+	}
+	if err == ErrChannelGone {
+		if worker, ok := h.app.GetWorker(write.uaid); ok {
+			if sender, ok := worker.(ExpiredSender); ok {
+				sender.SendExpired(write.chid)
+			}
+		}
+	}
+	if err == ErrStaleVersion || err == ErrChannelGone {
+		// The client already has the update; there's nothing to store.
+		h.metrics.Increment("updates.local.rejected")
+		return
+	}
+	if h.putDeadLetter(nil, write.uaid, write.chid, write.version, write.data,
+		err, attempts, write.requestID) {
+
+		return
+	}
+	if h.logger.ShouldLog(ERROR) {
+		h.logger.Error("handlers_endpoint", "Could not store delivered update",
+			LogFields{
+				"rid":     write.requestID,
+				"uaid":    write.uaid,
+				"chid":    write.chid,
+				"version": strconv.FormatInt(write.version, 10),
+				"error":   err.Error()})
+	}
+	h.metrics.Increment("updates.local.store_error")
+}
+
+// deferLocal holds a low-urgency update for a dozing client connected to this
+// server. Returns false if the update should be delivered now.
+func (h *EndpointHandler) deferLocal(uaid, chid string, version int64,
+	data string) bool {
+
+	worker, ok := h.app.GetWorker(uaid)
+	if !ok {
+		return false
+	}
+	sender, ok := worker.(DeferredSender)
+	return ok && sender.Defer(chid, version, data)
+}
+
+// DeleteHandler deactivates the channel for a push endpoint, allowing app
+// servers to unsubscribe users who opt out. If the client is connected to
+// this server, the channel is sent in the expired list of a notification.
+func (h *EndpointHandler) DeleteHandler(resp http.ResponseWriter, req *http.Request) {
+	requestID := req.Header.Get(HeaderID)
+	logWarning := h.logger.ShouldLog(WARNING)
+
+	if h.enableCors {
+		h.addCorsHeaders(resp)
+	}
+
+	if !h.allowDelete {
+		writeJSON(resp, http.StatusMethodNotAllowed, []byte(`"Method Not Allowed"`))
+		h.metrics.Increment("updates.appserver.invalid")
+		return
+	}
+
+	token := mux.Vars(req)["key"]
+	uaid, chid, err := h.resolveToken(h.app.VirtualServer(req.Host), token)
+	if err != nil {
+		if logWarning {
+			h.logger.Warn("handlers_endpoint", "Invalid primary key for delete",
+				LogFields{"error": err.Error(), "rid": requestID, "token": token})
+		}
+		writeJSON(resp, http.StatusNotFound, []byte(`"Invalid Token"`))
+		h.metrics.Increment("updates.appserver.invalid")
+		return
+	}
+
+	h.InvalidateTokens(uaid, chid)
+	if err = h.store.Unregister(uaid, chid); err != nil {
+		if err == ErrChannelGone {
+			h.writeGone(resp, requestID, uaid, chid)
+			return
+		}
+		if err == ErrNonexistentChannel {
+			writeJSON(resp, http.StatusNotFound, []byte(`"Unknown Channel"`))
+			h.metrics.Increment("updates.appserver.invalid")
+			return
+		}
+		if logWarning {
+			h.logger.Warn("handlers_endpoint", "Could not unregister channel",
+				LogFields{"rid": requestID, "uaid": uaid, "chid": chid,
+					"error": err.Error()})
+		}
+		status, _ := ErrToStatus(err)
+		h.metrics.Increment("updates.appserver.error")
+		writeJSON(resp, status, []byte(`"Could not unregister channel"`))
+		return
+	}
+
+	if h.logger.ShouldLog(INFO) {
+		h.logger.Info("handlers_endpoint", "Channel unregistered by app server",
+			LogFields{"rid": requestID, "uaid": uaid, "chid": chid})
+	}
+	h.metrics.Increment("updates.appserver.unregister")
+
+	// Clients connected to other servers are not notified.
+	if worker, ok := h.app.GetWorker(uaid); ok {
+		if sender, ok := worker.(ExpiredSender); ok {
+			sender.SendExpired(chid)
+		}
+	}
+
+	writeSuccess(resp)
+}
+
+// isGone indicates whether the channel was recently unregistered. Channels
+// are assumed registered if the tombstone can't be read; the error is
+// returned so that callers can reject updates that exceed the deadline.
+func (h *EndpointHandler) isGone(deadline *Deadline, uaid, chid string) (
+	bool, error) {
+
+	if h.tombstones == nil {
+		return false, nil
+	}
+	var gone bool
+	err := deadline.Do(func() (err error) {
+		gone, err = h.tombstones.HasTombstone(uaid, chid)
+		return
+	})
+	return err == nil && gone, err
+}
+
+// writeGone rejects an update for an unregistered channel. App servers should
+// stop sending updates to the endpoint.
+func (h *EndpointHandler) writeGone(resp http.ResponseWriter,
+	requestID, uaid, chid string) {
+
+	if h.logger.ShouldLog(INFO) {
+		h.logger.Info("handlers_endpoint", "Rejecting update for unregistered channel",
+			LogFields{"rid": requestID, "uaid": uaid, "chid": chid})
+	}
+	writeJSON(resp, http.StatusGone, []byte(`"Channel unregistered"`))
+	h.metrics.Increment("updates.appserver.gone")
+}
+
+// writeStale rejects an update with a version lower than the stored version.
+func (h *EndpointHandler) writeStale(resp http.ResponseWriter,
+	requestID, uaid, chid string, version int64) {
+
+	if h.logger.ShouldLog(INFO) {
+		h.logger.Info("handlers_endpoint", "Rejecting decreasing update version",
+			LogFields{"rid": requestID, "uaid": uaid, "chid": chid,
+				"version": strconv.FormatInt(version, 10)})
+	}
+	writeJSON(resp, http.StatusConflict, []byte(`"Version Decreased"`))
+	h.metrics.Increment("updates.appserver.stale")
+}
+
+// updateStore stores the update version, retrying temporary errors if a
+// retry helper is configured. Returns ErrDeadlineExceeded if the update is
+// not stored before the deadline; deadline may be nil.
+func (h *EndpointHandler) updateStore(deadline *Deadline, uaid, chid string,
+	version int64) (attempts int, err error) {
+
+	return h.updateStoreExpires(deadline, uaid, chid, version, time.Time{})
+}
+
+// updateStoreExpires stores the update version like updateStore. The update
+// expires at expiresAt, unless expiresAt is zero or the store does not
+// support expiring updates.
+func (h *EndpointHandler) updateStoreExpires(deadline *Deadline, uaid,
+	chid string, version int64, expiresAt time.Time) (attempts int, err error) {
+
+	update := func() error {
+		// A write abandoned at the deadline may still be stored; the update
+		// isn't delivered, and the client receives it on its next connection.
+		return deadline.Do(func() error {
+			if h.expiring != nil && !expiresAt.IsZero() {
+				return h.expiring.UpdateExpires(uaid, chid, version, expiresAt)
+			}
+			return h.store.Update(uaid, chid, version)
+		})
+	}
+	if h.rh == nil {
+		return 1, update()
+	}
+	rh := h.rh
+	if deadline != nil {
+		// Stop retrying when the deadline expires.
+		requestHelper := *h.rh
+		requestHelper.CloseNotifier = deadline
+		rh = &requestHelper
+	}
+	retries, err := rh.RetryFunc(update)
+	if err != nil && deadline.TimedOut() {
+		err = ErrDeadlineExceeded
+	}
+	return retries + 1, err
+}
+
+// putDeadLetter queues an update that could not be stored, within deadline.
+// Returns false if dead letters are disabled, the error is not temporary, or
+// the update could not be queued.
+func (h *EndpointHandler) putDeadLetter(deadline *Deadline, uaid, chid string,
+	version int64, data string, reason error, attempts int,
+	requestID string) bool {
+
+	if h.deadLetters == nil || !isTemporaryStoreErr(reason) {
+		return false
+	}
+	letter, err := newDeadLetter(uaid, chid, version, data, reason, attempts)
+	if err == nil {
+		err = deadline.Do(func() error {
+			return h.deadLetters.PutDeadLetter(letter)
+		})
+	}
+	if err != nil {
+		if h.logger.ShouldLog(ERROR) {
+			h.logger.Error("handlers_endpoint", "Could not queue dead letter",
+				LogFields{"rid": requestID, "uaid": uaid, "chid": chid,
+					"error": err.Error()})
+		}
+		return false
+	}
+	if h.logger.ShouldLog(WARNING) {
+		h.logger.Warn("handlers_endpoint", "Queued update as dead letter",
+			LogFields{"rid": requestID, "uaid": uaid, "chid": chid,
+				"id": letter.ID, "reason": letter.Reason})
+	}
+	h.metrics.Increment("updates.appserver.deadletter")
+	return true
+}
+
+// Replay stores and delivers a dead letter. Returns ErrStaleVersion if a
+// newer version is pending for the channel. Versions that were already
+// delivered and acknowledged are not stored, so they can't be checked.
+// Implements Replayer.Replay().
+func (h *EndpointHandler) Replay(letter *DeadLetter) (err error) {
+	updates, _, err := PeekAll(h.store, letter.UAID)
+	if err != nil {
+		return err
+	}
+	for _, update := range updates {
+		if update.ChannelID == letter.ChannelID &&
+			int64(update.Version) > letter.Version {
+
+			return ErrStaleVersion
+		}
+	}
+	if err = h.store.Update(letter.UAID, letter.ChannelID, letter.Version); err != nil {
+		return err
+	}
+	h.payloads.Put(nil, letter.UAID, letter.ChannelID, letter.Version,
+		letter.Data)
+	h.metrics.Increment("updates.appserver.replayed")
+	h.deliver(nil, letter.UAID, letter.ChannelID, letter.Version,
+		"", letter.Data)
+	return nil
+}
+
+// Deliver stores and delivers an update received from an upstream bridge.
+// Implements Deliverer.Deliver().
+func (h *EndpointHandler) Deliver(uaid, chid string, version int64,
+	data string) (err error) {
+
+	if err = h.residency.Check(uaid); err != nil {
+		return err
+	}
+	if _, err = h.updateStore(nil, uaid, chid, version); err != nil {
+		return err
+	}
+	h.payloads.Put(nil, uaid, chid, version, data)
+	h.deliver(nil, uaid, chid, version, "", data)
+	return nil
+}
+
+// Inject stores and delivers a synthetic update, bypassing the update
+// listener, and traces each step. Returns an error only if the target can't
+// be resolved; storage and delivery failures are reported in the trace.
+// Implements Injector.Inject().
+func (h *EndpointHandler) Inject(req *InjectRequest) (
+	trace *InjectTrace, err error) {
+
+	if len(req.Data) > h.maxDataLen {
+		return nil, ErrDataTooLong
+	}
+	trace = newInjectTrace(req.RequestID)
+	if trace.UAID, trace.ChannelID, err = h.injectTarget(req); err == nil {
+		err = h.residency.Check(trace.UAID)
+	}
+	if err != nil {
+		trace.Step("resolve", "", err)
+		return nil, err
+	}
+	trace.Step("resolve", "", nil)
+	if trace.Version = req.Version; trace.Version == 0 {
+		trace.Version = h.versions.Next()
+	}
+	h.metrics.Increment("updates.injected")
+
+	attempts, err := h.updateStore(nil, trace.UAID, trace.ChannelID,
+		trace.Version)
+	trace.Step("store", fmt.Sprintf("attempts=%d", attempts), err)
+	if err != nil {
+		h.logInjected(trace)
+		return trace, nil
+	}
+	h.payloads.Put(nil, trace.UAID, trace.ChannelID, trace.Version, req.Data)
+
+	_, trace.Connected = h.app.GetWorker(trace.UAID)
+	trace.Delivered = h.deliver(nil, trace.UAID, trace.ChannelID,
+		trace.Version, trace.RequestID, req.Data)
+	detail := "routed"
+	if trace.Connected {
+		detail = "local"
+	}
+	if !trace.Delivered {
+		// The client will receive the update when it reconnects.
+		detail = "pending"
+	}
+	trace.Step("deliver", detail, nil)
+	h.logInjected(trace)
+	return trace, nil
+}
+
+// injectTarget resolves the device and channel for an injected update.
+func (h *EndpointHandler) injectTarget(req *InjectRequest) (
+	uaid, chid string, err error) {
+
+	if len(req.Endpoint) > 0 {
+		return h.resolvePK(req.Endpoint)
+	}
+	if len(req.UAID) == 0 {
+		return "", "", ErrNoInjectTarget
+	}
+	if !h.store.Exists(req.UAID) {
+		return "", "", ErrInvalidID
+	}
+	if len(req.ChannelID) > 0 {
+		return req.UAID, req.ChannelID, nil
+	}
+	// Pending updates only cover channels with unacknowledged updates, and
+	// reading them may discard expired updates; list the channels instead.
+	lister, ok := h.store.(ChannelLister)
+	if !ok {
+		return "", "", ErrNoChannelList
+	}
+	chids, err := lister.FetchChannels(req.UAID)
+	if err != nil {
+		return "", "", err
+	}
+	if len(chids) == 0 {
+		return "", "", ErrNoChannels
+	}
+	return req.UAID, chids[0], nil
+}
+
+func (h *EndpointHandler) logInjected(trace *InjectTrace) {
+	if !h.logger.ShouldLog(INFO) {
+		return
+	}
+	steps, _ := json.Marshal(trace.Steps)
+	h.logger.Info("handlers_endpoint", "Injected update", LogFields{
+		"rid":       trace.RequestID,
+		"uaid":      trace.UAID,
+		"chid":      trace.ChannelID,
+		"version":   strconv.FormatInt(trace.Version, 10),
+		"delivered": strconv.FormatBool(trace.Delivered),
+		"steps":     string(steps),
+	})
 }
 
 // deliver routes an incoming update to the appropriate server.
@@ -340,6 +1318,9 @@ func (h *EndpointHandler) deliver(cn http.CloseNotifier, uaid, chid string,
 	version int64, requestID string, data string) (delivered bool) {
 
 	worker, workerConnected := h.app.GetWorker(uaid)
+	if !workerConnected {
+		h.app.Sessions().Missed(uaid)
+	}
 	var routingTime time.Duration
 
 	// Always route to other servers first, in case we're holding open a stale
@@ -378,7 +1359,6 @@ func (h *EndpointHandler) deliver(cn http.CloseNotifier, uaid, chid string,
 			delivered = true
 		}
 	}
-
 	// Increment the appropriate final metric whether deliver did or
 	// did not work
 	if delivered {
@@ -404,9 +1384,26 @@ func (h *EndpointHandler) close() (err error) {
 			LogFields{"error": err.Error(), "url": h.url})
 	}
 	h.server.Close()
+	if h.queue != nil {
+		h.queue.Close()
+	}
+	if h.localWrites != nil {
+		// Store updates that were already delivered.
+		h.localWrites.Close()
+	}
+	if h.bridge != nil {
+		h.bridge.Close()
+	}
 	return
 }
 
+// isTemporaryStoreErr indicates whether a storage error may be retried. Errors
+// caused by invalid input are permanent.
+func isTemporaryStoreErr(err error) bool {
+	_, isServiceErr := err.(*ServiceError)
+	return !isServiceErr || err == ErrRecordUpdateFailed
+}
+
 func validPK(pk string) bool {
 	for i := 0; i < len(pk); i++ {
 		b := pk[i]
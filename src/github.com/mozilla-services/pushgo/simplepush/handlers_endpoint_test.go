@@ -17,6 +17,7 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/rafrombrc/gomock/gomock"
 	. "github.com/smartystreets/goconvey/convey"
@@ -245,6 +246,79 @@ func TestEndpointContentType(t *testing.T) {
 	})
 }
 
+func TestEndpointUpdateTTL(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Update TTLs", t, func() {
+		app := NewApplication()
+		app.SetMetrics(mckStat)
+		eh := NewEndpointHandler()
+		eh.setApp(app)
+
+		now := time.Now()
+		defer saveTimeFuncs()()
+		timeNow = func() time.Time { return now }
+
+		Convey("Should not expire updates without a TTL", func() {
+			expiresAt, err := eh.getUpdateExpiry(&http.Request{
+				Method: "PUT",
+				Header: http.Header{},
+				URL:    &url.URL{Path: "/update/123"},
+			})
+			So(err, ShouldBeNil)
+			So(expiresAt.IsZero(), ShouldBeTrue)
+		})
+
+		Convey("Should prefer the TTL header to the form field", func() {
+			mckStat.EXPECT().Increment("updates.appserver.ttl")
+			expiresAt, err := eh.getUpdateExpiry(&http.Request{
+				Method: "PUT",
+				Header: http.Header{HeaderTTL: {"60"}},
+				URL:    &url.URL{Path: "/update/123", RawQuery: "ttl=30"},
+			})
+			So(err, ShouldBeNil)
+			So(expiresAt, ShouldResemble, now.Add(60*time.Second))
+		})
+
+		Convey("Should accept a TTL form field", func() {
+			mckStat.EXPECT().Increment("updates.appserver.ttl")
+			expiresAt, err := eh.getUpdateExpiry(&http.Request{
+				Method: "PUT",
+				Header: http.Header{},
+				URL:    &url.URL{Path: "/update/123", RawQuery: "ttl=0"},
+			})
+			So(err, ShouldBeNil)
+			So(expiresAt, ShouldResemble, now)
+		})
+
+		Convey("Should accept the maximum TTL", func() {
+			mckStat.EXPECT().Increment("updates.appserver.ttl")
+			expiresAt, err := eh.getUpdateExpiry(&http.Request{
+				Method: "PUT",
+				Header: http.Header{HeaderTTL: {"2592000"}},
+				URL:    &url.URL{Path: "/update/123"},
+			})
+			So(err, ShouldBeNil)
+			So(expiresAt, ShouldResemble, now.Add(MaxTTL*time.Second))
+		})
+
+		Convey("Should reject invalid TTLs", func() {
+			for _, ttl := range []string{"-1", "soon", "1.5", "2592001",
+				"9223372036854775807"} {
+				_, err := eh.getUpdateExpiry(&http.Request{
+					Method: "PUT",
+					Header: http.Header{HeaderTTL: {ttl}},
+					URL:    &url.URL{Path: "/update/123"},
+				})
+				So(err, ShouldEqual, ErrInvalidTTL)
+			}
+		})
+	})
+}
+
 func TestEndpointInvalidParams(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -576,6 +650,29 @@ func TestEndpointDelivery(t *testing.T) {
 				So(isJSON, ShouldBeTrue)
 				So(body.String(), ShouldEqual, `"Could not update channel version"`)
 			})
+
+			Convey("Should return a 410 if the channel was unregistered", func() {
+				resp := httptest.NewRecorder()
+				req := &http.Request{
+					Method: "PUT",
+					Header: http.Header{},
+					URL:    &url.URL{Path: "/update/123"},
+					Body:   formReader(url.Values{"version": {"2"}}),
+				}
+				gomock.InOrder(
+					mckStore.EXPECT().KeyToIDs("123").Return("123", "456", nil),
+					mckStat.EXPECT().Increment("updates.appserver.incoming"),
+					mckStore.EXPECT().Update("123", "456", int64(2)).Return(
+						ErrChannelGone),
+					mckStat.EXPECT().Increment("updates.appserver.gone"),
+				)
+				eh.ServeMux().ServeHTTP(resp, req)
+
+				So(resp.Code, ShouldEqual, 410)
+				body, isJSON := getJSON(resp.HeaderMap, resp.Body)
+				So(isJSON, ShouldBeTrue)
+				So(body.String(), ShouldEqual, `"Channel unregistered"`)
+			})
 		})
 
 		Convey("Should always route updates if `AlwaysRoute` is enabled", func() {
@@ -656,3 +753,450 @@ func TestEndpointDelivery(t *testing.T) {
 		})
 	})
 }
+
+func TestEndpointLocalFirst(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStat.EXPECT().Gauge("updates.local.pending", gomock.Any()).AnyTimes()
+	mckStore := NewMockStore(mockCtrl)
+	mckRouter := NewMockRouter(mockCtrl)
+	mckWorker := NewMockWorker(mockCtrl)
+
+	Convey("Local-first delivery", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(mckStore)
+		app.SetRouter(mckRouter)
+
+		eh := NewEndpointHandler()
+		eh.setApp(app)
+		eh.localWrites = NewLocalWrites(app, LocalFirstConfig{
+			Enabled: true,
+			Size:    10,
+			Workers: 1,
+		}, eh.storeDelivered)
+		app.SetEndpointHandler(eh)
+		app.AddWorker("123", mckWorker)
+
+		newRequest := func() *http.Request {
+			return &http.Request{
+				Method: "PUT",
+				Header: http.Header{},
+				URL:    &url.URL{Path: "/update/123"},
+				Body:   formReader(url.Values{"version": {"3"}}),
+			}
+		}
+
+		Convey("Should deliver the update before storing it", func() {
+			resp := httptest.NewRecorder()
+			gomock.InOrder(
+				mckStore.EXPECT().KeyToIDs("123").Return("123", "456", nil),
+				mckStat.EXPECT().Increment("updates.appserver.incoming"),
+				mckWorker.EXPECT().Send("456", int64(3), "").Return(nil),
+				mckStat.EXPECT().Increment("updates.appserver.received"),
+				mckStat.EXPECT().Increment("updates.local.delivered"),
+			)
+			eh.ServeMux().ServeHTTP(resp, newRequest())
+			So(resp.Code, ShouldEqual, 200)
+
+			mckStore.EXPECT().Update("123", "456", int64(3)).Return(nil)
+			eh.localWrites.Start()
+			eh.localWrites.Close()
+		})
+
+		Convey("Should not store acknowledged updates", func() {
+			resp := httptest.NewRecorder()
+			gomock.InOrder(
+				mckStore.EXPECT().KeyToIDs("123").Return("123", "456", nil),
+				mckStat.EXPECT().Increment("updates.appserver.incoming"),
+				mckWorker.EXPECT().Send("456", int64(3), "").Return(nil),
+				mckStat.EXPECT().Increment("updates.appserver.received"),
+				mckStat.EXPECT().Increment("updates.local.delivered"),
+			)
+			eh.ServeMux().ServeHTTP(resp, newRequest())
+			So(resp.Code, ShouldEqual, 200)
+
+			eh.localWrites.Acked("123", "456", 3)
+			mckStat.EXPECT().Increment("updates.local.canceled")
+			eh.localWrites.Start()
+			eh.localWrites.Close()
+		})
+
+		Convey("Should count delivered updates rejected by the store", func() {
+			resp := httptest.NewRecorder()
+			gomock.InOrder(
+				mckStore.EXPECT().KeyToIDs("123").Return("123", "456", nil),
+				mckStat.EXPECT().Increment("updates.appserver.incoming"),
+				mckWorker.EXPECT().Send("456", int64(3), "").Return(nil),
+				mckStat.EXPECT().Increment("updates.appserver.received"),
+				mckStat.EXPECT().Increment("updates.local.delivered"),
+			)
+			eh.ServeMux().ServeHTTP(resp, newRequest())
+			So(resp.Code, ShouldEqual, 200)
+
+			gomock.InOrder(
+				mckStore.EXPECT().Update("123", "456", int64(3)).Return(
+					ErrStaleVersion),
+				mckStat.EXPECT().Increment("updates.local.rejected"),
+			)
+			eh.localWrites.Start()
+			eh.localWrites.Close()
+		})
+
+		Convey("Should store the update if local delivery fails", func() {
+			resp := httptest.NewRecorder()
+			gomock.InOrder(
+				mckStore.EXPECT().KeyToIDs("123").Return("123", "456", nil),
+				mckStat.EXPECT().Increment("updates.appserver.incoming"),
+				mckWorker.EXPECT().Send("456", int64(3), "").Return(
+					errors.New("client gone")),
+				mckStat.EXPECT().Increment("updates.appserver.rejected"),
+			)
+			eh.ServeMux().ServeHTTP(resp, newRequest())
+			So(resp.Code, ShouldEqual, 202)
+
+			mckStore.EXPECT().Update("123", "456", int64(3)).Return(nil)
+			eh.localWrites.Start()
+			eh.localWrites.Close()
+		})
+
+		Convey("Should store before delivery if the write queue is full", func() {
+			eh.localWrites = NewLocalWrites(app, LocalFirstConfig{
+				Enabled: true,
+				Size:    0,
+				Workers: 1,
+			}, eh.storeDelivered)
+			resp := httptest.NewRecorder()
+			gomock.InOrder(
+				mckStore.EXPECT().KeyToIDs("123").Return("123", "456", nil),
+				mckStat.EXPECT().Increment("updates.appserver.incoming"),
+				mckStat.EXPECT().Increment("updates.local.full"),
+				mckStore.EXPECT().Update("123", "456", int64(3)).Return(nil),
+				mckWorker.EXPECT().Send("456", int64(3), "").Return(nil),
+				mckStat.EXPECT().Increment("updates.appserver.received"),
+			)
+			eh.ServeMux().ServeHTTP(resp, newRequest())
+			So(resp.Code, ShouldEqual, 200)
+		})
+	})
+}
+
+func TestEndpointDeadLetters(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+
+	Convey("Dead letters", t, func() {
+		store := newTestDeadLetterStore(mckStore)
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(store)
+
+		eh := NewEndpointHandler()
+		eh.setApp(app)
+		eh.deadLetters = store
+		app.SetEndpointHandler(eh)
+
+		newRequest := func() *http.Request {
+			return &http.Request{
+				Method: "PUT",
+				Header: http.Header{},
+				URL:    &url.URL{Path: "/update/123"},
+				Body: formReader(url.Values{
+					"version": {"3"},
+					"data":    {"Hello"},
+				}),
+			}
+		}
+
+		Convey("Should queue updates if storage is unavailable", func() {
+			resp := httptest.NewRecorder()
+			gomock.InOrder(
+				mckStore.EXPECT().KeyToIDs("123").Return("123", "456", nil),
+				mckStat.EXPECT().Increment("updates.appserver.incoming"),
+				mckStore.EXPECT().Update("123", "456", int64(3)).Return(
+					ErrRecordUpdateFailed),
+				mckStat.EXPECT().Increment("updates.appserver.deadletter"),
+			)
+			eh.ServeMux().ServeHTTP(resp, newRequest())
+
+			So(resp.Code, ShouldEqual, 202)
+			body, isJSON := getJSON(resp.HeaderMap, resp.Body)
+			So(isJSON, ShouldBeTrue)
+			So(body.String(), ShouldEqual, `"Update queued for redelivery"`)
+			So(store.letters, ShouldResemble, []*DeadLetter{{
+				ID:        testID,
+				UAID:      "123",
+				ChannelID: "456",
+				Version:   3,
+				Data:      "Hello",
+				Reason:    ErrRecordUpdateFailed.Error(),
+				FailedAt:  timeNow().Unix(),
+				Attempts:  1,
+			}})
+		})
+
+		Convey("Should not queue updates with invalid channels", func() {
+			resp := httptest.NewRecorder()
+			gomock.InOrder(
+				mckStore.EXPECT().KeyToIDs("123").Return("123", "456", nil),
+				mckStat.EXPECT().Increment("updates.appserver.incoming"),
+				mckStore.EXPECT().Update("123", "456", int64(3)).Return(
+					ErrNonexistentChannel),
+				mckStat.EXPECT().Increment("updates.appserver.error"),
+			)
+			eh.ServeMux().ServeHTTP(resp, newRequest())
+
+			So(resp.Code, ShouldEqual, ErrNonexistentChannel.Status())
+			So(store.letters, ShouldBeEmpty)
+		})
+	})
+}
+
+// testTombstoneStore wraps a Store with an in-memory set of unregistered
+// channels.
+type testTombstoneStore struct {
+	Store
+	tombstones map[string]bool
+	lookups    int
+}
+
+func (s *testTombstoneStore) HasTombstone(uaid, chid string) (bool, error) {
+	s.lookups++
+	return s.tombstones[joinIDs(uaid, chid)], nil
+}
+
+func TestEndpointTombstones(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+	mckPinger := NewMockPropPinger(mockCtrl)
+
+	Convey("Should not ping or store updates for unregistered channels", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(&testTombstoneStore{Store: mckStore,
+			tombstones: map[string]bool{"123.456": true}})
+		app.SetPropPinger(mckPinger)
+
+		eh := NewEndpointHandler()
+		eh.setApp(app)
+		app.SetEndpointHandler(eh)
+
+		resp := httptest.NewRecorder()
+		req := &http.Request{
+			Method: "PUT",
+			Header: http.Header{},
+			URL:    &url.URL{Path: "/update/123"},
+			Body:   formReader(url.Values{"version": {"2"}}),
+		}
+		gomock.InOrder(
+			mckStore.EXPECT().KeyToIDs("123").Return("123", "456", nil),
+			mckStat.EXPECT().Increment("updates.appserver.incoming"),
+			mckStat.EXPECT().Increment("updates.appserver.gone"),
+		)
+		eh.ServeMux().ServeHTTP(resp, req)
+
+		So(resp.Code, ShouldEqual, 410)
+	})
+
+	Convey("Should leave tombstone checks to the store without a pinger", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		store := &testTombstoneStore{Store: mckStore,
+			tombstones: map[string]bool{"123.456": true}}
+		app.SetStore(store)
+
+		eh := NewEndpointHandler()
+		eh.setApp(app)
+		app.SetEndpointHandler(eh)
+
+		resp := httptest.NewRecorder()
+		req := &http.Request{
+			Method: "PUT",
+			Header: http.Header{},
+			URL:    &url.URL{Path: "/update/123"},
+			Body:   formReader(url.Values{"version": {"2"}}),
+		}
+		gomock.InOrder(
+			mckStore.EXPECT().KeyToIDs("123").Return("123", "456", nil),
+			mckStat.EXPECT().Increment("updates.appserver.incoming"),
+			mckStore.EXPECT().Update("123", "456", int64(2)).Return(
+				ErrChannelGone),
+			mckStat.EXPECT().Increment("updates.appserver.gone"),
+		)
+		eh.ServeMux().ServeHTTP(resp, req)
+
+		So(resp.Code, ShouldEqual, 410)
+		So(store.lookups, ShouldEqual, 0)
+	})
+}
+
+// testPayloadStore adds in-memory payload storage to a Store.
+type testPayloadStore struct {
+	Store
+	payloads *payloadStore
+}
+
+func (s *testPayloadStore) PutPayload(uaid, chid string, version int64,
+	data string) error {
+
+	return s.payloads.PutPayload(uaid, chid, version, data)
+}
+
+func (s *testPayloadStore) FetchPayloads(uaid string, updates []Update) (
+	[]string, error) {
+
+	return s.payloads.FetchPayloads(uaid, updates)
+}
+
+func TestEndpointStalePayload(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+
+	Convey("Should keep the data of newer versions", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		store := &testPayloadStore{Store: mckStore,
+			payloads: &payloadStore{payloads: map[string]Update{
+				"123.456": {"456", 5, "newer", false}}}}
+		app.SetStore(store)
+		app.storePayloads = true
+
+		eh := NewEndpointHandler()
+		eh.setApp(app)
+		app.SetEndpointHandler(eh)
+
+		resp := httptest.NewRecorder()
+		req := &http.Request{
+			Method: "PUT",
+			Header: http.Header{},
+			URL:    &url.URL{Path: "/update/123"},
+			Body: formReader(url.Values{"version": {"4"},
+				"data": {"stale"}}),
+		}
+		gomock.InOrder(
+			mckStore.EXPECT().KeyToIDs("123").Return("123", "456", nil),
+			mckStat.EXPECT().Increment("updates.appserver.incoming"),
+			mckStore.EXPECT().Update("123", "456", int64(4)).Return(
+				ErrStaleVersion),
+			mckStat.EXPECT().Increment("updates.appserver.stale"),
+		)
+		eh.ServeMux().ServeHTTP(resp, req)
+
+		So(resp.Code, ShouldEqual, 409)
+		So(store.payloads.payloads["123.456"].Data, ShouldEqual, "newer")
+	})
+}
+
+func TestEndpointDelete(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+	mckSocket := NewMockSocket(mockCtrl)
+
+	Convey("App server unsubscribes", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(mckStore)
+		app.SetTokenKey("c3v0AlmmxXu_LSfdZY3l3eayLsIwkX48")
+
+		eh := NewEndpointHandler()
+		eh.setApp(app)
+		app.SetEndpointHandler(eh)
+
+		uaid := "5b9fa2ad2a6f4a27ae0e21cba7b5c73e"
+		chid := "0e1e6a3b5b5d4b0b8d5b4e5e2c3a5f6d"
+		req := &http.Request{
+			Method: "DELETE",
+			Header: http.Header{},
+			URL: &url.URL{
+				Path: "/update/j1bqzFq9WiwFZbqay-y7xVlfSvtO1eY="}, // "123.456"
+		}
+
+		Convey("Should reject deletes if disabled", func() {
+			resp := httptest.NewRecorder()
+			mckStat.EXPECT().Increment("updates.appserver.invalid")
+			eh.ServeMux().ServeHTTP(resp, req)
+
+			So(resp.Code, ShouldEqual, 405)
+		})
+
+		Convey("Should notify connected clients", func() {
+			eh.allowDelete = true
+			wws := NewWorker(app, mckSocket, "test")
+			wws.SetUAID(uaid)
+			app.AddWorker(uaid, wws)
+
+			resp := httptest.NewRecorder()
+			gomock.InOrder(
+				mckStore.EXPECT().KeyToIDs("123.456").Return(uaid, chid, nil),
+				mckStore.EXPECT().Unregister(uaid, chid).Return(nil),
+				mckStat.EXPECT().Increment("updates.appserver.unregister"),
+				mckSocket.EXPECT().WriteJSON(FlushReply{"notification", nil,
+					[]string{chid}, 0, 0}),
+			)
+			eh.ServeMux().ServeHTTP(resp, req)
+
+			So(resp.Code, ShouldEqual, 200)
+		})
+
+		Convey("Should return a 404 for unknown channels", func() {
+			eh.allowDelete = true
+
+			resp := httptest.NewRecorder()
+			gomock.InOrder(
+				mckStore.EXPECT().KeyToIDs("123.456").Return(uaid, chid, nil),
+				mckStore.EXPECT().Unregister(uaid, chid).Return(
+					ErrNonexistentChannel),
+				mckStat.EXPECT().Increment("updates.appserver.invalid"),
+			)
+			eh.ServeMux().ServeHTTP(resp, req)
+
+			So(resp.Code, ShouldEqual, 404)
+			body, isJSON := getJSON(resp.HeaderMap, resp.Body)
+			So(isJSON, ShouldBeTrue)
+			So(body.String(), ShouldEqual, `"Unknown Channel"`)
+		})
+	})
+}
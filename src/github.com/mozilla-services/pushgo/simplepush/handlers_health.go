@@ -12,15 +12,18 @@ import (
 )
 
 type StatusReport struct {
-	Healthy          bool             `json:"ok"`
-	Clients          int              `json:"clientCount"`
-	MaxClientConns   int              `json:"maxClients"`
-	MaxEndpointConns int              `json:"maxEndpointConns"`
-	Plugins          []PluginReport   `json:"plugins"`
-	Goroutines       int              `json:"goroutines"`
-	Version          string           `json:"version"`
-	MemStats         runtime.MemStats `json:"memory"`
-	InstanceID       string           `json:"instance,omitempty"`
+	Healthy          bool                 `json:"ok"`
+	Clients          int                  `json:"clientCount"`
+	MaxClientConns   int                  `json:"maxClients"`
+	MaxEndpointConns int                  `json:"maxEndpointConns"`
+	Plugins          []PluginReport       `json:"plugins"`
+	Goroutines       int                  `json:"goroutines"`
+	Version          string               `json:"version"`
+	Crypto           string               `json:"crypto"`
+	MemStats         runtime.MemStats     `json:"memory"`
+	InstanceID       string               `json:"instance,omitempty"`
+	Brownout         BrownoutStatus       `json:"brownout"`
+	Wake             map[string]WakeStats `json:"wake,omitempty"`
 }
 
 // TODO: Remove; add a Typ() method to HasConfigStruct.
@@ -79,6 +82,11 @@ func (h *HealthHandlers) Init(app *Application, _ interface{}) error {
 	endpointMux.HandleFunc("/status/", h.StatusHandler)
 	endpointMux.HandleFunc("/realstatus/", h.RealStatusHandler)
 	endpointMux.HandleFunc("/metrics/", h.MetricsHandler)
+	if e, ok := h.metrics.(PrometheusExporter); ok {
+		if registry := e.Prometheus(); registry != nil {
+			endpointMux.Handle(registry.Path(), registry)
+		}
+	}
 
 	return nil
 }
@@ -120,7 +128,10 @@ func (h *HealthHandlers) RealStatusHandler(resp http.ResponseWriter,
 		MaxClientConns:   h.sh.MaxConns(),
 		MaxEndpointConns: h.eh.MaxConns(),
 		Version:          VERSION,
+		Crypto:           cryptoProvider.Name(),
 		InstanceID:       id,
+		Brownout:         h.app.Brownout().Status(),
+		Wake:             h.app.Wake().Stats(),
 	}
 	runtime.ReadMemStats(&status.MemStats)
 
@@ -45,7 +45,7 @@ func (p *ProfileHandlers) Init(app *Application, config interface{}) (err error)
 		return nil
 	}
 
-	if p.listener, err = conf.Listener.Listen(); err != nil {
+	if p.listener, err = conf.Listener.Listen(app); err != nil {
 		p.logger.Panic("handlers_pprof", "Could not attach profiling listener",
 			LogFields{"error": err.Error()})
 		return err
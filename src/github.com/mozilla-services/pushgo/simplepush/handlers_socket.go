@@ -5,48 +5,214 @@
 package simplepush
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
-	"time"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"github.com/gorilla/mux"
 	"golang.org/x/net/websocket"
 )
 
 func NewSocketHandler() (h *SocketHandler) {
-	h = &SocketHandler{mux: mux.NewRouter()}
-	h.mux.Handle("/", websocket.Server{
+	h = &SocketHandler{
+		mux:      mux.NewRouter(),
+		versions: make(map[int]ProtocolServer),
+	}
+	server := websocket.Server{
 		Handler:   h.PushSocketHandler,
-		Handshake: h.checkOrigin,
-	})
+		Handshake: h.handshake,
+	}
+	h.mux.Handle("/", server)
+	h.mux.Handle("/v{version:[0-9]+}", server)
+	h.HandleVersion(DefaultProtocolVersion, h.ServeSocket)
 	return h
 }
 
 type SocketHandlerConfig struct {
-	Origins  []string
-	Listener TCPListenerConfig
+	Origins      []string
+	AdaptivePing AdaptivePingConfig `toml:"adaptive_ping" env:"adaptive_ping"`
+	Crashes      CrashPolicyConfig
+	Abuse        AbuseScorerConfig
+	ConnLimit    ConnLimitConfig `toml:"conn_limit" env:"conn_limit"`
+	Admission    AdmissionConfig
+	Churn        ChurnConfig
+	Traffic      TrafficConfig
+	RTT          RTTConfig
+	Dedupe       DedupeConfig
+	Redelivery   RedeliveryConfig
+	Transcripts  TranscriptConfig
+	Protocol     ProtocolConfig
+	Sequence     SequenceConfig
+	Clock        ClockConfig
+	Affinity     AffinityConfig
+	Doze         DozeConfig
+	Compression  CompressionConfig
+	FlushCap     FlushCapConfig `toml:"flush_cap" env:"flush_cap"`
+	Subprotocol  SubprotocolConfig
+	Multiplex    MultiplexConfig
+	Listener     TCPListenerConfig
 }
 
 type SocketHandler struct {
-	app       *Application
-	logger    *SimpleLogger
-	metrics   Statistician
-	store     Store
-	locator   Locator
-	origins   []*url.URL
-	listener  net.Listener
-	server    Server
-	mux       *mux.Router
-	url       string
-	maxConns  int
-	closeOnce Once
+	app         *Application
+	logger      *SimpleLogger
+	metrics     Statistician
+	store       Store
+	locator     Locator
+	origins     []*url.URL
+	advisor     *PingAdvisor
+	crashes     *CrashPolicy
+	abuse       *AbuseScorer
+	connLimit   *ConnLimiter
+	admission   *AdmissionControl
+	churn       *ChurnMonitor
+	traffic     *TrafficRecorder
+	rtt         *RTTPolicy
+	dedupe      *DedupePolicy
+	redelivery  *RedeliveryPolicy
+	transcripts *TranscriptRecorder
+	protocol    *ProtocolValidator
+	sequence    *SequencePolicy
+	skew        *SkewMonitor
+	affinity    *Affinity
+	tiering     *PayloadTiering
+	payloads    *StoredPayloads
+	doze        *DozePolicy
+	flushCap    *FlushCap
+	compression *Compression
+	versions    map[int]ProtocolServer // Protocol servers, by version.
+	subprotocol SubprotocolConfig
+	multiplex   MultiplexConfig
+	listener    net.Listener
+	server      Server
+	mux         *mux.Router
+	url         string
+	maxConns    int32 // Accessed atomically.
+	serving     int32 // Accessed atomically.
+	stopOnce    Once
+	closeOnce   Once
 }
 
 func (h *SocketHandler) ConfigStruct() interface{} {
 	return &SocketHandlerConfig{
+		AdaptivePing: AdaptivePingConfig{
+			Enabled:     false,
+			MinInterval: "1m",
+			MaxInterval: "30m",
+			Samples:     5,
+		},
+		Crashes: CrashPolicyConfig{
+			Enabled:    false,
+			MaxCrashes: 5,
+			Window:     "10m",
+			BanPeriod:  "10m",
+		},
+		Abuse: AbuseScorerConfig{
+			Enabled:       false,
+			Threshold:     100,
+			Window:        "10m",
+			BanPeriod:     "1h",
+			PingScore:     10,
+			PayloadScore:  20,
+			RegisterScore: 50,
+			CrashScore:    25,
+			CacheTTL:      "10s",
+			CacheSize:     10000,
+		},
+		ConnLimit: ConnLimitConfig{
+			Enabled:       false,
+			MaxPerIP:      10,
+			MaxPerNetwork: 1000,
+			MaxRejects:    20,
+			Window:        "1m",
+			BlockPeriod:   "10m",
+		},
+		Admission: AdmissionConfig{
+			Enabled:  false,
+			Waves:    10,
+			Interval: "30s",
+		},
+		Churn: ChurnConfig{
+			Enabled:   false,
+			Window:    "15m",
+			Threshold: 3,
+			MinRate:   100,
+		},
+		Traffic: TrafficConfig{
+			Enabled:    false,
+			SampleRate: 0.01,
+			Path:       "traffic.jsonl",
+			MaxEvents:  1000,
+		},
+		RTT: RTTConfig{
+			Enabled:        false,
+			MinDeadline:    "5s",
+			MaxDeadline:    "1m",
+			Factor:         10,
+			CoalesceFactor: 0.5,
+			MaxCoalesce:    "50ms",
+		},
+		Dedupe: DedupeConfig{
+			Enabled: false,
+			Window:  "1m",
+		},
+		Redelivery: RedeliveryConfig{
+			Enabled:    false,
+			Timeout:    "30s",
+			MaxRetries: 3,
+			Backoff:    2,
+			MaxLost:    0,
+		},
+		Transcripts: TranscriptConfig{
+			Enabled:    false,
+			Size:       200,
+			MaxFlagged: 100,
+			Scrub:      []string{"pushEndpoint", "connect", "data"},
+		},
+		Protocol: ProtocolConfig{
+			Validate:      false,
+			RejectUnknown: false,
+			Publish:       false,
+			Strict:        "off",
+		},
+		Sequence: SequenceConfig{
+			Enabled:    false,
+			MaxUnacked: 1000,
+		},
+		Clock: ClockConfig{
+			Enabled: false,
+		},
+		Affinity: AffinityConfig{
+			Enabled: false,
+		},
+		Doze: DozeConfig{
+			Enabled:    false,
+			MaxDefer:   "15m",
+			MaxPending: 50,
+		},
+		Compression: CompressionConfig{
+			Enabled: false,
+			Level:   6,
+			MinSize: 512,
+		},
+		FlushCap: FlushCapConfig{
+			MaxUpdates: 0,
+			Drop:       false,
+		},
+		Subprotocol: SubprotocolConfig{
+			Strict: false,
+		},
+		Multiplex: MultiplexConfig{
+			Enabled:     false,
+			MaxSessions: 100,
+			QueueSize:   10,
+		},
 		Listener: TCPListenerConfig{
 			Addr:            ":8080",
 			MaxConns:        1000,
@@ -63,11 +229,137 @@ func (h *SocketHandler) Init(app *Application, config interface{}) (err error) {
 			LogFields{"error": err.Error()})
 		return err
 	}
+	if conf.AdaptivePing.Enabled {
+		if h.advisor, err = NewPingAdvisor(conf.AdaptivePing); err != nil {
+			h.logger.Panic("handlers_socket", "Could not configure adaptive pings",
+				LogFields{"error": err.Error()})
+			return err
+		}
+	}
+	if conf.Crashes.Enabled {
+		if h.crashes, err = NewCrashPolicy(app, conf.Crashes); err != nil {
+			h.logger.Panic("handlers_socket", "Could not configure crash policy",
+				LogFields{"error": err.Error()})
+			return err
+		}
+	}
+	if conf.Abuse.Enabled {
+		if h.abuse, err = NewAbuseScorer(app, conf.Abuse); err != nil {
+			h.logger.Panic("handlers_socket", "Could not configure abuse scoring",
+				LogFields{"error": err.Error()})
+			return err
+		}
+	}
+	if conf.ConnLimit.Enabled {
+		if h.connLimit, err = NewConnLimiter(app, conf.ConnLimit); err != nil {
+			h.logger.Panic("handlers_socket", "Could not configure connection limits",
+				LogFields{"error": err.Error()})
+			return err
+		}
+	}
+	if conf.Admission.Enabled {
+		if h.admission, err = NewAdmissionControl(conf.Admission); err != nil {
+			h.logger.Panic("handlers_socket", "Could not configure admission control",
+				LogFields{"error": err.Error()})
+			return err
+		}
+	}
+	if conf.Churn.Enabled {
+		if h.churn, err = NewChurnMonitor(app, conf.Churn, h.admission); err != nil {
+			h.logger.Panic("handlers_socket", "Could not configure churn monitoring",
+				LogFields{"error": err.Error()})
+			return err
+		}
+	}
+	if conf.Traffic.Enabled {
+		if h.traffic, err = NewTrafficRecorder(app, conf.Traffic); err != nil {
+			h.logger.Panic("handlers_socket", "Could not open traffic recording",
+				LogFields{"error": err.Error(), "path": conf.Traffic.Path})
+			return err
+		}
+	}
+	if conf.RTT.Enabled {
+		if h.rtt, err = NewRTTPolicy(app, conf.RTT); err != nil {
+			h.logger.Panic("handlers_socket", "Could not configure RTT estimation",
+				LogFields{"error": err.Error()})
+			return err
+		}
+	}
+	if conf.Dedupe.Enabled {
+		if h.dedupe, err = NewDedupePolicy(conf.Dedupe); err != nil {
+			h.logger.Panic("handlers_socket", "Invalid deduplication window",
+				LogFields{"error": err.Error(), "window": conf.Dedupe.Window})
+			return err
+		}
+	}
+	if conf.Redelivery.Enabled {
+		if h.redelivery, err = NewRedeliveryPolicy(conf.Redelivery); err != nil {
+			h.logger.Panic("handlers_socket", "Invalid re-delivery timeout",
+				LogFields{"error": err.Error(), "timeout": conf.Redelivery.Timeout})
+			return err
+		}
+	}
+	if conf.Transcripts.Enabled {
+		h.transcripts = NewTranscriptRecorder(app, conf.Transcripts)
+	}
+	protocol, err := NewProtocolValidator(app, conf.Protocol)
+	if err != nil {
+		h.logger.Panic("handlers_socket", "Could not configure protocol validation",
+			LogFields{"error": err.Error(), "strict": conf.Protocol.Strict})
+		return err
+	}
+	if protocol.Enabled() {
+		h.protocol = protocol
+	}
+	if conf.Sequence.Enabled {
+		h.sequence = NewSequencePolicy(app, conf.Sequence)
+	}
+	if conf.Clock.Enabled {
+		h.skew = NewSkewMonitor(app)
+	}
+	if conf.Doze.Enabled {
+		if h.doze, err = NewDozePolicy(app, conf.Doze); err != nil {
+			h.logger.Panic("handlers_socket", "Invalid maximum deferral time",
+				LogFields{"error": err.Error(), "max_defer": conf.Doze.MaxDefer})
+			return err
+		}
+	}
+	if conf.Compression.Enabled {
+		if h.compression, err = NewCompression(app, conf.Compression); err != nil {
+			h.logger.Panic("handlers_socket", "Invalid compression level",
+				LogFields{"error": err.Error(),
+					"level": strconv.Itoa(conf.Compression.Level)})
+			return err
+		}
+	}
+	// The flush cap is always set, so that tenants can cap flushes even if
+	// the server doesn't.
+	h.flushCap = NewFlushCap(app, conf.FlushCap)
+	h.subprotocol = conf.Subprotocol
+	if conf.Protocol.Publish {
+		h.mux.HandleFunc("/protocol.json", h.ProtocolHandler)
+	}
+	if conf.Multiplex.Enabled {
+		h.multiplex = conf.Multiplex
+		h.mux.Handle("/mux", websocket.Server{
+			Handler:   h.MultiplexSocketHandler,
+			Handshake: h.handshake,
+		})
+	}
 	if err = h.listenWithConfig(conf.Listener); err != nil {
 		h.logger.Panic("handlers_socket", "Could not attach WebSocket listener",
 			LogFields{"error": err.Error()})
 		return err
 	}
+	if conf.Affinity.Enabled {
+		if h.affinity, err = NewAffinity(app, h.url); err != nil {
+			h.logger.Panic("handlers_socket", "Could not configure connection affinity",
+				LogFields{"error": err.Error()})
+			return err
+		}
+	}
+	h.tiering = NewPayloadTiering(app)
+	h.payloads = NewStoredPayloads(app)
 	h.server = NewServeCloser(&http.Server{
 		Handler: &LogHandler{h.mux, h.logger},
 		ErrorLog: log.New(&LogWriter{
@@ -90,7 +382,7 @@ func (h *SocketHandler) setApp(app *Application) {
 
 // listenWithConfig starts a listener for this WebSocket handler.
 func (h *SocketHandler) listenWithConfig(conf ListenerConfig) (err error) {
-	if h.listener, err = conf.Listen(); err != nil {
+	if h.listener, err = conf.Listen(h.app); err != nil {
 		return err
 	}
 	var scheme string
@@ -101,7 +393,7 @@ func (h *SocketHandler) listenWithConfig(conf ListenerConfig) (err error) {
 	}
 	host, port := HostPort(h.listener, h.app)
 	h.url = CanonicalURL(scheme, host, port)
-	h.maxConns = conf.GetMaxConns()
+	atomic.StoreInt32(&h.maxConns, int32(conf.GetMaxConns()))
 	return nil
 }
 
@@ -117,10 +409,37 @@ func (h *SocketHandler) setOrigins(origins []string) (err error) {
 }
 
 func (h *SocketHandler) Listener() net.Listener { return h.listener }
-func (h *SocketHandler) MaxConns() int          { return h.maxConns }
+func (h *SocketHandler) MaxConns() int          { return int(atomic.LoadInt32(&h.maxConns)) }
 func (h *SocketHandler) URL() string            { return h.url }
 func (h *SocketHandler) ServeMux() ServeMux     { return (*RouteMux)(h.mux) }
 
+// ReloadableSettings implements Reloadable.ReloadableSettings().
+func (h *SocketHandler) ReloadableSettings() []string {
+	return []string{"listener.max_connections"}
+}
+
+// Reload applies a changed client connection limit. Clients above a lowered
+// limit stay connected. Implements Reloadable.Reload().
+func (h *SocketHandler) Reload(config interface{}) error {
+	conf := config.(*SocketHandlerConfig)
+	maxConns := conf.Listener.GetMaxConns()
+	if maxConns < 1 {
+		return fmt.Errorf("Invalid max_connections: %d", maxConns)
+	}
+	if !setListenerMaxConns(h.listener, maxConns) {
+		return fmt.Errorf("Listener does not limit connections")
+	}
+	atomic.StoreInt32(&h.maxConns, int32(maxConns))
+	return nil
+}
+
+// Transcripts implements TranscriptHandler.Transcripts.
+func (h *SocketHandler) Transcripts() *TranscriptRecorder { return h.transcripts }
+
+// Serving returns the number of clients being served, including clients that
+// have not completed the handshake. Implements ServingCounter.Serving().
+func (h *SocketHandler) Serving() int { return int(atomic.LoadInt32(&h.serving)) }
+
 func (h *SocketHandler) Start(errChan chan<- error) {
 	rn, ok := h.app.Locator().(ReadyNotifier)
 	if ok {
@@ -131,26 +450,147 @@ func (h *SocketHandler) Start(errChan chan<- error) {
 		h.logger.Info("handlers_socket", "Starting WebSocket server",
 			LogFields{"url": h.url})
 	}
+	if h.churn != nil {
+		go h.churn.Run()
+	}
 	errChan <- h.server.Serve(h.listener)
 }
 
+// ProtocolHandler serves the protocol message schemas.
+func (h *SocketHandler) ProtocolHandler(resp http.ResponseWriter, req *http.Request) {
+	body, err := json.Marshal(ProtocolSchemas())
+	if err != nil {
+		writeJSON(resp, http.StatusInternalServerError,
+			[]byte(`"Could not encode protocol schemas"`))
+		return
+	}
+	writeJSON(resp, http.StatusOK, body)
+}
+
+// PushSocketHandler serves a connection with the negotiated protocol
+// version's server.
 func (h *SocketHandler) PushSocketHandler(ws *websocket.Conn) {
-	requestID := ws.Request().Header.Get(HeaderID)
-	worker := NewWorker(h.app, (*WebSocket)(ws), requestID)
+	req := ws.Request()
+	if !h.acquireConn(ws, req) {
+		return
+	}
+	defer h.releaseConn(req)
+	version := pathVersion(req)
+	if protocols := ws.Config().Protocol; version == 0 && len(protocols) > 0 {
+		base, _ := splitCompression(protocols[0])
+		version, _ = ParseSubprotocol(base)
+	}
+	if version == 0 {
+		version = DefaultProtocolVersion
+	}
+	h.versions[version](h.socket(ws), req)
+}
+
+// socket returns the Socket for a connection, compressing messages if the
+// client negotiated a compressed subprotocol.
+func (h *SocketHandler) socket(ws *websocket.Conn) Socket {
+	if protocols := ws.Config().Protocol; len(protocols) > 0 {
+		if _, deflate := splitCompression(protocols[0]); deflate {
+			return h.compression.Wrap((*WebSocket)(ws))
+		}
+	}
+	return (*WebSocket)(ws)
+}
+
+// MultiplexSocketHandler serves a multiplexed connection, carrying a session
+// for each device.
+func (h *SocketHandler) MultiplexSocketHandler(ws *websocket.Conn) {
+	req := ws.Request()
+	if !h.acquireConn(ws, req) {
+		return
+	}
+	defer h.releaseConn(req)
+	if h.logger.ShouldLog(INFO) {
+		h.logger.Info("handlers_socket", "multiplexed websocket connection",
+			LogFields{"rid": req.Header.Get(HeaderID)})
+	}
+	h.metrics.Increment("client.mux.connect")
+	NewMultiplexer(h.app, h.multiplex, h, h.socket(ws), req).Run()
+	ws.Close()
+}
+
+// acquireConn counts a connection against the client's connection limits.
+// Connections over the limit are closed. Returns false if the connection was
+// closed.
+func (h *SocketHandler) acquireConn(ws *websocket.Conn, req *http.Request) bool {
+	if h.connLimit == nil {
+		return true
+	}
+	if err := h.connLimit.Acquire(req.RemoteAddr); err != nil {
+		if h.logger.ShouldLog(NOTICE) {
+			h.logger.Notice("handlers_socket", "Closing connection over limit",
+				LogFields{"rid": req.Header.Get(HeaderID), "addr": req.RemoteAddr,
+					"error": err.Error()})
+		}
+		ws.Close()
+		return false
+	}
+	return true
+}
+
+// releaseConn stops counting a closed connection.
+func (h *SocketHandler) releaseConn(req *http.Request) {
+	if h.connLimit != nil {
+		h.connLimit.Release(req.RemoteAddr)
+	}
+}
+
+// ServeSocket implements SocketServer.ServeSocket.
+func (h *SocketHandler) ServeSocket(socket Socket, req *http.Request) {
+	requestID := req.Header.Get(HeaderID)
+	worker := NewWorker(h.app, socket, requestID)
+	if vs := h.app.VirtualServer(req.Host); vs != nil {
+		worker.virtual = vs
+		worker.metrics = vs.ClientMetrics()
+	}
+	if h.advisor != nil {
+		worker.advisor = h.advisor
+		worker.network = networkOf(req.RemoteAddr)
+	}
+	if h.crashes != nil || h.abuse != nil {
+		worker.crashes = h.crashes
+		worker.abuse = h.abuse
+		worker.addr = req.RemoteAddr
+	}
+	worker.admission = h.admission
+	worker.traffic = h.traffic.Sample()
+	worker.rtt = h.rtt.Estimator()
+	worker.coalesce = worker.rtt.Coalescer(worker.sendUpdates)
+	worker.dedupe = h.dedupe.Filter()
+	worker.redelivery = h.redelivery.Tracker()
+	worker.transcripts = h.transcripts
+	worker.protocol = h.protocol
+	worker.sequencer = h.sequence
+	worker.skew = h.skew
+	worker.affinity = h.affinity
+	worker.tiering = h.tiering
+	worker.payloads = h.payloads
+	worker.doze = h.doze.Queue()
+	worker.flushCap = h.flushCap
 
 	if h.logger.ShouldLog(INFO) {
 		h.logger.Info("handlers_socket", "websocket connection",
 			LogFields{"rid": requestID})
 	}
+	atomic.AddInt32(&h.serving, 1)
 	defer func() {
-		now := time.Now()
+		now := timeNow()
 		// Clean-up the resources
 		worker.Close()
+		atomic.AddInt32(&h.serving, -1)
 		h.metrics.Timer("client.socket.lifespan", now.Sub(worker.Born()))
 		h.metrics.Increment("client.socket.disconnect")
+		h.churn.Disconnect()
+		worker.traffic.Close()
 	}()
 
 	h.metrics.Increment("client.socket.connect")
+	h.churn.Connect()
 
 	worker.Run()
 	if h.logger.ShouldLog(INFO) {
@@ -159,6 +599,44 @@ func (h *SocketHandler) PushSocketHandler(ws *websocket.Conn) {
 	}
 }
 
+// handshake rejects connections from banned clients, checks the WebSocket
+// origin, then negotiates the protocol version.
+func (h *SocketHandler) handshake(conf *websocket.Config, req *http.Request) error {
+	if h.crashes != nil && h.crashes.Banned(req.RemoteAddr) ||
+		h.abuse != nil && h.abuse.Banned(BanIP, req.RemoteAddr) {
+
+		if h.logger.ShouldLog(NOTICE) {
+			h.logger.Notice("handlers_socket", "Rejecting banned client",
+				LogFields{"rid": req.Header.Get(HeaderID), "addr": req.RemoteAddr})
+		}
+		h.metrics.Increment("client.socket.banned")
+		return ErrClientBanned
+	}
+	if h.connLimit != nil {
+		if err := h.connLimit.Allow(req.RemoteAddr); err != nil {
+			if h.logger.ShouldLog(NOTICE) {
+				h.logger.Notice("handlers_socket", "Rejecting connection over limit",
+					LogFields{"rid": req.Header.Get(HeaderID), "addr": req.RemoteAddr,
+						"error": err.Error()})
+			}
+			return err
+		}
+	}
+	if err := h.checkOrigin(conf, req); err != nil {
+		return err
+	}
+	offered := strings.Join(conf.Protocol, ", ")
+	if _, err := h.negotiate(conf, pathVersion(req)); err != nil {
+		if h.logger.ShouldLog(NOTICE) {
+			h.logger.Notice("handlers_socket", "Rejecting unsupported subprotocol",
+				LogFields{"rid": req.Header.Get(HeaderID), "protocols": offered,
+					"path": req.URL.Path})
+		}
+		return err
+	}
+	return nil
+}
+
 func (h *SocketHandler) checkOrigin(conf *websocket.Config, req *http.Request) (err error) {
 	if conf.Origin, err = websocket.Origin(conf, req); err != nil {
 		if h.logger.ShouldLog(NOTICE) {
@@ -189,20 +667,37 @@ func (h *SocketHandler) Close() error {
 	return h.closeOnce.Do(h.close)
 }
 
-func (h *SocketHandler) close() (err error) {
-	if h.logger.ShouldLog(INFO) {
-		h.logger.Info("handlers_socket", "Closing WebSocket handler",
-			LogFields{"url": h.url})
-	}
+// StopAccepting closes the WebSocket listener without closing existing
+// connections, so that clients can be drained before shutdown.
+func (h *SocketHandler) StopAccepting() error {
+	return h.stopOnce.Do(h.stopAccepting)
+}
+
+func (h *SocketHandler) stopAccepting() (err error) {
 	if h.listener != nil {
 		if err = h.listener.Close(); err != nil && h.logger.ShouldLog(ERROR) {
 			h.logger.Error("handlers_socket", "Error closing WebSocket listener",
 				LogFields{"error": err.Error(), "url": h.url})
 		}
 	}
+	return
+}
+
+func (h *SocketHandler) close() (err error) {
+	if h.logger.ShouldLog(INFO) {
+		h.logger.Info("handlers_socket", "Closing WebSocket handler",
+			LogFields{"url": h.url})
+	}
+	err = h.StopAccepting()
 	if h.server != nil {
 		h.server.Close()
 	}
+	if h.churn != nil {
+		h.churn.Close()
+	}
+	if h.traffic != nil {
+		h.traffic.Close()
+	}
 	return
 }
 
@@ -6,6 +6,7 @@ package simplepush
 
 import (
 	"errors"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -24,7 +25,7 @@ type listenerConfig struct {
 
 func (conf listenerConfig) UseTLS() bool     { return conf.useTLS }
 func (conf listenerConfig) GetMaxConns() int { return conf.maxConns }
-func (conf listenerConfig) Listen() (net.Listener, error) {
+func (conf listenerConfig) Listen(app *Application) (net.Listener, error) {
 	return conf.listener, nil
 }
 
@@ -65,7 +66,7 @@ func TestSocketListenConfig(t *testing.T) {
 
 	// Should forward Listen errors.
 	listenErr := errors.New("splines not reticulated")
-	mckListenerConfig.EXPECT().Listen().Return(nil, listenErr)
+	mckListenerConfig.EXPECT().Listen(app).Return(nil, listenErr)
 	if err := sh.listenWithConfig(mckListenerConfig); err != listenErr {
 		t.Errorf("Wrong error: got %#v; want %#v", err, listenErr)
 	}
@@ -73,7 +74,7 @@ func TestSocketListenConfig(t *testing.T) {
 	// Should use the wss:// scheme if UseTLS returns true.
 	ml := newMockListener(netAddr{"test", "[::1]:8080"})
 	gomock.InOrder(
-		mckListenerConfig.EXPECT().Listen().Return(ml, nil),
+		mckListenerConfig.EXPECT().Listen(app).Return(ml, nil),
 		mckListenerConfig.EXPECT().UseTLS().Return(true),
 		mckListenerConfig.EXPECT().GetMaxConns().Return(1),
 	)
@@ -262,6 +263,58 @@ func TestSocketOrigin(t *testing.T) {
 	}
 }
 
+func TestSocketServeMockSocket(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+	mckRouter := NewMockRouter(mockCtrl)
+	mckSocket := NewMockSocket(mockCtrl)
+
+	app := NewApplication()
+	app.SetLogger(mckLogger)
+	app.SetMetrics(mckStat)
+	app.SetStore(mckStore)
+	app.SetRouter(mckRouter)
+
+	sh := NewSocketHandler()
+	sh.setApp(app)
+	var server SocketServer = sh
+
+	uaid := "5e1e5984569c4f00bf4bea47754a6403"
+	mckSocket.EXPECT().SetReadDeadline(gomock.Any()).AnyTimes()
+	gomock.InOrder(
+		mckStat.EXPECT().Increment("client.socket.connect"),
+		mckSocket.EXPECT().ReadBinary().Return([]byte(
+			`{"messageType":"hello","uaid":"`+uaid+`","channelIDs":[]}`), nil),
+		mckStore.EXPECT().CanStore(0).Return(true),
+		mckRouter.EXPECT().Register(uaid),
+		mckSocket.EXPECT().WriteText(
+			`{"messageType":"hello","uaid":"`+uaid+`","status":200}`),
+		mckStat.EXPECT().Increment("updates.client.hello"),
+		mckStore.EXPECT().FetchAll(uaid, gomock.Any()).Return(nil, nil, nil),
+		mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+		mckSocket.EXPECT().ReadBinary().Return(nil, io.EOF),
+		mckRouter.EXPECT().Unregister(uaid),
+		mckSocket.EXPECT().Close(),
+		mckStat.EXPECT().Timer("client.socket.lifespan", gomock.Any()),
+		mckStat.EXPECT().Increment("client.socket.disconnect"),
+	)
+
+	server.ServeSocket(mckSocket, &http.Request{
+		Header:     http.Header{},
+		RemoteAddr: "192.0.2.57:4321",
+	})
+	if app.WorkerExists(uaid) {
+		t.Errorf("Worker for device ID %q not removed", uaid)
+	}
+}
+
 func TestSocketSameOrigin(t *testing.T) {
 	tests := []struct {
 		name     string
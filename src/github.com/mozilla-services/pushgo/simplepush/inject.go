@@ -0,0 +1,77 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNoInjectTarget = errors.New("Injection requires an endpoint or device ID")
+	ErrNoChannels     = errors.New("Device has no registered channels")
+	ErrNoChannelList  = errors.New("Store cannot list channels; a channel ID is required")
+)
+
+// Injector is an optional interface implemented by update handlers that
+// accept synthetic updates from the admin API, so that support staff can
+// verify delivery to a specific device.
+type Injector interface {
+	Inject(req *InjectRequest) (*InjectTrace, error)
+}
+
+// InjectRequest describes a synthetic update. The target is either an
+// endpoint token, or a device ID and optional channel ID. If the channel is
+// omitted, the update is sent on the device's first registered channel, if
+// the store can list channels.
+type InjectRequest struct {
+	Endpoint  string `json:"endpoint,omitempty"`
+	UAID      string `json:"uaid,omitempty"`
+	ChannelID string `json:"channelID,omitempty"`
+	Version   int64  `json:"version,omitempty"` // Defaults to the next version.
+	Data      string `json:"data,omitempty"`
+	RequestID string `json:"-"`
+}
+
+// InjectStep is a traced step of an injected update.
+type InjectStep struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"t"` // Milliseconds since injection.
+	Error  string `json:"error,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// InjectTrace reports how an injected update was stored and delivered.
+type InjectTrace struct {
+	RequestID string       `json:"rid"`
+	UAID      string       `json:"uaid"`
+	ChannelID string       `json:"channelID"`
+	Version   int64        `json:"version"`
+	Connected bool         `json:"connected"` // Device connected to this node.
+	Delivered bool         `json:"delivered"`
+	Steps     []InjectStep `json:"steps"`
+	start     time.Time
+}
+
+func newInjectTrace(requestID string) *InjectTrace {
+	return &InjectTrace{
+		RequestID: requestID,
+		Steps:     []InjectStep{},
+		start:     timeNow(),
+	}
+}
+
+// Step records a completed step. err may be nil.
+func (t *InjectTrace) Step(name, detail string, err error) {
+	step := InjectStep{
+		Name:   name,
+		Offset: int64(timeNow().Sub(t.start) / time.Millisecond),
+		Detail: detail,
+	}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	t.Steps = append(t.Steps, step)
+}
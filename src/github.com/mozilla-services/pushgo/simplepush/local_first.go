@@ -0,0 +1,218 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sync"
+	"time"
+)
+
+type LocalFirstConfig struct {
+	Enabled bool
+
+	// Size is the maximum number of delivered updates waiting to be stored.
+	// Updates received while the queue is full are stored before delivery.
+	Size int
+
+	// Workers is the number of goroutines storing delivered updates.
+	Workers int
+}
+
+// localWrite is an update delivered to a local client, waiting to be stored.
+// The version and data are replaced if a newer update for the channel is
+// delivered before the write starts.
+type localWrite struct {
+	requestID string
+	uaid      string
+	chid      string
+	version   int64
+	data      string
+	expiresAt time.Time
+	after     chan bool // Closed when the previous write for the channel ends.
+	done      chan bool // Closed when the write ends, or is canceled.
+	started   bool
+	canceled  bool
+}
+
+// LocalWrites stores updates delivered directly to clients connected to this
+// server, with a bounded queue and a fixed pool of workers. Writes for the
+// same channel are stored in order. A write is canceled if the client
+// acknowledges the update before it starts, since the acknowledgement would
+// drop it anyway; otherwise, the acknowledgement waits for the write to end,
+// so that the update isn't stored again after it's dropped.
+type LocalWrites struct {
+	metrics    Statistician
+	writes     chan *localWrite
+	workers    int
+	store      func(*localWrite)
+	pendingMux sync.Mutex
+	pending    map[string]*localWrite // By channel key.
+	wg         sync.WaitGroup
+	closeChan  chan bool
+	closeOnce  Once
+	closeMux   sync.RWMutex // Held while queueing, so that Close drains every write.
+}
+
+// NewLocalWrites creates a write queue that stores updates with store.
+func NewLocalWrites(app *Application, conf LocalFirstConfig,
+	store func(*localWrite)) *LocalWrites {
+
+	workers := conf.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	return &LocalWrites{
+		metrics:   app.Metrics(),
+		writes:    make(chan *localWrite, conf.Size),
+		workers:   workers,
+		store:     store,
+		pending:   make(map[string]*localWrite),
+		closeChan: make(chan bool),
+	}
+}
+
+// Start starts the workers.
+func (q *LocalWrites) Start() {
+	q.wg.Add(q.workers)
+	for i := 0; i < q.workers; i++ {
+		go q.run()
+	}
+}
+
+func (q *LocalWrites) run() {
+	defer q.wg.Done()
+	for {
+		select {
+		case write := <-q.writes:
+			q.do(write)
+		case <-q.closeChan:
+			// Store delivered updates before exiting.
+			for {
+				select {
+				case write := <-q.writes:
+					q.do(write)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *LocalWrites) do(write *localWrite) {
+	defer close(write.done)
+	defer q.remove(write)
+	if write.after != nil {
+		<-write.after
+	}
+	q.pendingMux.Lock()
+	canceled := write.canceled
+	write.started = !canceled
+	q.pendingMux.Unlock()
+	if canceled {
+		q.metrics.Increment("updates.local.canceled")
+		return
+	}
+	q.store(write)
+}
+
+// remove forgets a finished write, unless a later write for the channel
+// replaced it.
+func (q *LocalWrites) remove(write *localWrite) {
+	key := joinIDs(write.uaid, write.chid)
+	q.pendingMux.Lock()
+	if q.pending[key] == write {
+		delete(q.pending, key)
+	}
+	q.pendingMux.Unlock()
+}
+
+// Put queues an update for a channel, before it's delivered. Returns false if
+// the queue is full or closed; the caller should store the update before
+// delivering it.
+func (q *LocalWrites) Put(requestID, uaid, chid string, version int64,
+	data string, expiresAt time.Time) bool {
+
+	q.closeMux.RLock()
+	defer q.closeMux.RUnlock()
+	select {
+	case <-q.closeChan:
+		return false
+	default:
+	}
+	key := joinIDs(uaid, chid)
+	q.pendingMux.Lock()
+	defer q.pendingMux.Unlock()
+	prev, ok := q.pending[key]
+	if ok && !prev.started && !prev.canceled {
+		// Coalesce with the queued write. The store rejects or ignores older
+		// versions, so only the latest is kept.
+		if version >= prev.version {
+			prev.requestID, prev.version, prev.data, prev.expiresAt =
+				requestID, version, data, expiresAt
+		}
+		return true
+	}
+	write := &localWrite{
+		requestID: requestID,
+		uaid:      uaid,
+		chid:      chid,
+		version:   version,
+		data:      data,
+		expiresAt: expiresAt,
+		done:      make(chan bool),
+	}
+	if ok {
+		write.after = prev.done
+	}
+	select {
+	case q.writes <- write:
+		q.pending[key] = write
+		q.metrics.Gauge("updates.local.pending", int64(len(q.writes)))
+		return true
+	default:
+		q.metrics.Increment("updates.local.full")
+		return false
+	}
+}
+
+// Acked cancels the queued write for a channel if the client acknowledged its
+// version, or waits for the write to end if it already started. Writes for
+// newer versions are kept.
+func (q *LocalWrites) Acked(uaid, chid string, version int64) {
+	key := joinIDs(uaid, chid)
+	q.pendingMux.Lock()
+	write, ok := q.pending[key]
+	if !ok {
+		q.pendingMux.Unlock()
+		return
+	}
+	wait := write.done
+	if !write.started {
+		// Canceled writes stay pending until they're dequeued, so that later
+		// writes for the channel are still stored in order.
+		if write.version <= version {
+			write.canceled = true
+		}
+		wait = write.after
+	}
+	q.pendingMux.Unlock()
+	if wait != nil {
+		<-wait
+	}
+}
+
+// Close stops accepting writes, and waits for queued writes to finish.
+func (q *LocalWrites) Close() error {
+	return q.closeOnce.Do(q.close)
+}
+
+func (q *LocalWrites) close() error {
+	q.closeMux.Lock()
+	close(q.closeChan)
+	q.closeMux.Unlock()
+	q.wg.Wait()
+	return nil
+}
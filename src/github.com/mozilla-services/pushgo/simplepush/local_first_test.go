@@ -0,0 +1,119 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLocalWrites(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStat.EXPECT().Gauge("updates.local.pending", gomock.Any()).AnyTimes()
+
+	Convey("Local-first write queue", t, func() {
+		app := NewApplication()
+		app.SetMetrics(mckStat)
+
+		var (
+			storedMux sync.Mutex
+			stored    []int64
+		)
+		storedVersions := func() []int64 {
+			storedMux.Lock()
+			defer storedMux.Unlock()
+			return stored
+		}
+		q := NewLocalWrites(app, LocalFirstConfig{
+			Enabled: true,
+			Size:    2,
+			Workers: 1,
+		}, func(write *localWrite) {
+			storedMux.Lock()
+			stored = append(stored, write.version)
+			storedMux.Unlock()
+		})
+		noExpiry := time.Time{}
+
+		Convey("Should reject writes if the queue is full", func() {
+			So(q.Put("", "123", "456", 1, "", noExpiry), ShouldBeTrue)
+			So(q.Put("", "123", "789", 1, "", noExpiry), ShouldBeTrue)
+			mckStat.EXPECT().Increment("updates.local.full")
+			So(q.Put("", "123", "abc", 1, "", noExpiry), ShouldBeFalse)
+			q.Start()
+			q.Close()
+			So(storedVersions(), ShouldResemble, []int64{1, 1})
+		})
+
+		Convey("Should coalesce queued writes for the same channel", func() {
+			So(q.Put("", "123", "456", 1, "", noExpiry), ShouldBeTrue)
+			So(q.Put("", "123", "456", 3, "", noExpiry), ShouldBeTrue)
+			So(q.Put("", "123", "456", 2, "", noExpiry), ShouldBeTrue)
+			q.Start()
+			q.Close()
+			So(storedVersions(), ShouldResemble, []int64{3})
+		})
+
+		Convey("Should cancel acknowledged writes", func() {
+			So(q.Put("", "123", "456", 1, "", noExpiry), ShouldBeTrue)
+			q.Acked("123", "456", 1)
+			mckStat.EXPECT().Increment("updates.local.canceled")
+			q.Start()
+			q.Close()
+			So(storedVersions(), ShouldBeEmpty)
+		})
+
+		Convey("Should keep writes for newer versions", func() {
+			So(q.Put("", "123", "456", 2, "", noExpiry), ShouldBeTrue)
+			q.Acked("123", "456", 1)
+			q.Start()
+			q.Close()
+			So(storedVersions(), ShouldResemble, []int64{2})
+		})
+
+		Convey("Should wait for started writes before acknowledging", func() {
+			started, release := make(chan bool), make(chan bool)
+			q.store = func(write *localWrite) {
+				close(started)
+				<-release
+				storedMux.Lock()
+				stored = append(stored, write.version)
+				storedMux.Unlock()
+			}
+			q.Start()
+			So(q.Put("", "123", "456", 1, "", noExpiry), ShouldBeTrue)
+			<-started
+			acked := make(chan bool)
+			go func() {
+				q.Acked("123", "456", 1)
+				close(acked)
+			}()
+			select {
+			case <-acked:
+				t.Fatal("Acked returned before the write ended")
+			case <-time.After(10 * time.Millisecond):
+			}
+			close(release)
+			<-acked
+			So(storedVersions(), ShouldResemble, []int64{1})
+			q.Close()
+		})
+
+		Convey("Should drain queued writes on close", func() {
+			So(q.Put("", "123", "456", 1, "", noExpiry), ShouldBeTrue)
+			q.Start()
+			q.Close()
+			So(storedVersions(), ShouldResemble, []int64{1})
+			So(q.Put("", "123", "456", 2, "", noExpiry), ShouldBeFalse)
+		})
+	})
+}
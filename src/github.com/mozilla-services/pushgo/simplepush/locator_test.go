@@ -178,7 +178,7 @@ func TestLocatorReadyNotify(t *testing.T) {
 			return
 		}
 		ok := false
-		expected := Update{chid, uint64(version), data}
+		expected := Update{chid, uint64(version), data, false}
 		for _, update := range flushReply.Updates {
 			if ok = update == expected; ok {
 				break
@@ -15,6 +15,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/mozilla-services/pushgo/id"
@@ -68,6 +69,8 @@ var AvailableLoggers = make(AvailableExtensions)
 
 type SimpleLogger struct {
 	Logger
+	brownout *Brownout
+	dedupe   *LogDeduper
 }
 
 type LoggerConfig interface {
@@ -99,6 +102,29 @@ var logEmitters = map[string]func(*Application, LoggerConfig) (
 		return NewProtobufEmitter(w, conf.GetEnvVersion(),
 			hostname, loggerName), nil
 	},
+	"gelf": func(app *Application, conf LoggerConfig) (LogEmitter, error) {
+		w, err := conf.Open()
+		if err != nil {
+			return nil, err
+		}
+		hostname := app.Hostname()
+		loggerName := fmt.Sprintf("%s-%s", conf.GetName(), VERSION)
+		// Chunk datagrams for Graylog's UDP input, and delimit messages with
+		// null bytes for its TCP input. Log files are newline-delimited.
+		var (
+			chunkSize int
+			delimiter byte = '\n'
+		)
+		if netConf, ok := conf.(*NetworkLoggerConfig); ok {
+			if strings.HasPrefix(netConf.Proto, "udp") ||
+				netConf.Proto == "unixgram" {
+				chunkSize = netConf.GELFChunkSize
+			}
+			delimiter = 0
+		}
+		return NewGELFEmitter(w, hostname, loggerName, chunkSize,
+			delimiter), nil
+	},
 	"text": func(_ *Application, conf LoggerConfig) (LogEmitter, error) {
 		w, err := conf.Open()
 		if err != nil {
@@ -129,7 +155,16 @@ func IStr(i interface{}) (reply string) {
 
 // SimplePush Logger implementation, utilizes the passed in Logger
 func NewLogger(log Logger) (*SimpleLogger, error) {
-	return &SimpleLogger{log}, nil
+	return &SimpleLogger{Logger: log}, nil
+}
+
+// ShouldLog indicates whether messages at the given level should be logged.
+// Informational and debug messages are suppressed in brownout mode.
+func (sl *SimpleLogger) ShouldLog(level LogLevel) bool {
+	if level >= INFO && sl.brownout.Active() {
+		return false
+	}
+	return sl.Logger.ShouldLog(level)
 }
 
 // Default logging calls for convenience
@@ -145,7 +180,12 @@ func (sl *SimpleLogger) Notice(mtype, msg string, fields LogFields) error {
 	return sl.Logger.Log(NOTICE, mtype, msg, fields)
 }
 
+// Warn logs a warning. Repeats of recent warnings are suppressed if log
+// deduplication is enabled.
 func (sl *SimpleLogger) Warn(mtype, msg string, fields LogFields) error {
+	if !sl.dedupe.Allow(mtype, msg) {
+		return nil
+	}
 	return sl.Logger.Log(WARNING, mtype, msg, fields)
 }
 
@@ -173,12 +213,46 @@ type NetworkLoggerConfig struct {
 	EnvVersion string `toml:"env_version" env:"env_version"`
 	Name       string `toml:"name" env:"name"`
 	Filter     int32
+
+	// BufferSize is the number of messages buffered while sending or
+	// reconnecting. If 0, messages are written synchronously, and the
+	// connection is not re-established if it fails.
+	BufferSize int `toml:"buffer_size" env:"buffer_size"`
+
+	// ReconnectDelay is the initial delay before reconnecting to the remote
+	// host, doubled after each failed attempt up to MaxReconnectDelay.
+	ReconnectDelay    string `toml:"reconnect_delay" env:"reconnect_delay"`
+	MaxReconnectDelay string `toml:"max_reconnect_delay" env:"max_reconnect_delay"`
+
+	// GELFChunkSize is the maximum UDP datagram size for GELF messages.
+	// Larger messages are split into chunks.
+	GELFChunkSize int `toml:"gelf_chunk_size" env:"gelf_chunk_size"`
 }
 
 func (conf *NetworkLoggerConfig) Open() (io.Writer, error) {
 	if len(conf.Addr) == 0 {
 		return nil, fmt.Errorf("Missing remote host")
 	}
+	conn, err := conf.dial()
+	if err != nil || conf.BufferSize <= 0 {
+		return conn, err
+	}
+	delay, err := time.ParseDuration(conf.ReconnectDelay)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error parsing reconnect delay: %s", err)
+	}
+	maxDelay, err := time.ParseDuration(conf.MaxReconnectDelay)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error parsing maximum reconnect delay: %s", err)
+	}
+	return NewNetLogWriter(conn, conf.dial, delay, maxDelay,
+		conf.BufferSize), nil
+}
+
+// dial connects to the remote host.
+func (conf *NetworkLoggerConfig) dial() (net.Conn, error) {
 	if conf.UseTLS {
 		conn, err := tls.Dial(conf.Proto, conf.Addr, nil)
 		if err != nil {
@@ -204,7 +278,7 @@ func (conf *NetworkLoggerConfig) GetEnvVersion() string {
 // UDP, or a Unix domain socket.
 type NetworkLogger struct {
 	LogEmitter
-	filter LogLevel
+	filter LogLevel // Accessed atomically.
 }
 
 func (nl *NetworkLogger) ConfigStruct() interface{} {
@@ -214,6 +288,11 @@ func (nl *NetworkLogger) ConfigStruct() interface{} {
 		EnvVersion: "2",
 		Name:       "pushgo",
 		Filter:     0,
+
+		BufferSize:        1000,
+		ReconnectDelay:    "1s",
+		MaxReconnectDelay: "30s",
+		GELFChunkSize:     GELFChunkSize,
 	}
 }
 
@@ -232,11 +311,20 @@ func (nl *NetworkLogger) Init(app *Application, config interface{}) (err error)
 }
 
 func (nl *NetworkLogger) ShouldLog(level LogLevel) bool {
-	return level <= nl.filter
+	return level <= LogLevel(atomic.LoadInt32((*int32)(&nl.filter)))
 }
 
 func (nl *NetworkLogger) SetFilter(level LogLevel) {
-	nl.filter = level
+	atomic.StoreInt32((*int32)(&nl.filter), int32(level))
+}
+
+// ReloadableSettings implements Reloadable.ReloadableSettings().
+func (*NetworkLogger) ReloadableSettings() []string { return []string{"filter"} }
+
+// Reload applies a changed log level. Implements Reloadable.Reload().
+func (nl *NetworkLogger) Reload(config interface{}) error {
+	nl.SetFilter(LogLevel(config.(*NetworkLoggerConfig).Filter))
+	return nil
 }
 
 func (nl *NetworkLogger) Log(level LogLevel, messageType, payload string, fields LogFields) (err error) {
@@ -276,7 +364,7 @@ func (conf *FileLoggerConfig) GetEnvVersion() string {
 // A FileLogger writes log messages to a file.
 type FileLogger struct {
 	LogEmitter
-	filter LogLevel
+	filter LogLevel // Accessed atomically.
 }
 
 func (fl *FileLogger) ConfigStruct() interface{} {
@@ -303,11 +391,20 @@ func (fl *FileLogger) Init(app *Application, config interface{}) (err error) {
 }
 
 func (fl *FileLogger) ShouldLog(level LogLevel) bool {
-	return level <= fl.filter
+	return level <= LogLevel(atomic.LoadInt32((*int32)(&fl.filter)))
 }
 
 func (fl *FileLogger) SetFilter(level LogLevel) {
-	fl.filter = level
+	atomic.StoreInt32((*int32)(&fl.filter), int32(level))
+}
+
+// ReloadableSettings implements Reloadable.ReloadableSettings().
+func (*FileLogger) ReloadableSettings() []string { return []string{"filter"} }
+
+// Reload applies a changed log level. Implements Reloadable.Reload().
+func (fl *FileLogger) Reload(config interface{}) error {
+	fl.SetFilter(LogLevel(config.(*FileLoggerConfig).Filter))
+	return nil
 }
 
 func (fl *FileLogger) Log(level LogLevel, messageType, payload string, fields LogFields) (err error) {
@@ -337,7 +434,7 @@ func (conf *StdOutLoggerConfig) GetEnvVersion() string {
 // StdOutLogger writes log messages to standard output.
 type StdOutLogger struct {
 	LogEmitter
-	filter LogLevel
+	filter LogLevel // Accessed atomically.
 }
 
 func (ml *StdOutLogger) ConfigStruct() interface{} {
@@ -364,11 +461,20 @@ func (ml *StdOutLogger) Init(app *Application, config interface{}) (err error) {
 }
 
 func (ml *StdOutLogger) ShouldLog(level LogLevel) bool {
-	return level <= ml.filter
+	return level <= LogLevel(atomic.LoadInt32((*int32)(&ml.filter)))
 }
 
 func (ml *StdOutLogger) SetFilter(level LogLevel) {
-	ml.filter = level
+	atomic.StoreInt32((*int32)(&ml.filter), int32(level))
+}
+
+// ReloadableSettings implements Reloadable.ReloadableSettings().
+func (*StdOutLogger) ReloadableSettings() []string { return []string{"filter"} }
+
+// Reload applies a changed log level. Implements Reloadable.Reload().
+func (ml *StdOutLogger) Reload(config interface{}) error {
+	ml.SetFilter(LogLevel(config.(*StdOutLoggerConfig).Filter))
+	return nil
 }
 
 func (ml *StdOutLogger) Log(level LogLevel, messageType, payload string, fields LogFields) (err error) {
@@ -419,7 +525,7 @@ func (w *logResponseWriter) WriteHeader(statusCode int) {
 
 // setStatus records the response time and status code.
 func (w *logResponseWriter) setStatus(statusCode int) {
-	w.RespondedAt = time.Now()
+	w.RespondedAt = clock.Now()
 	w.StatusCode = statusCode
 }
 
@@ -507,7 +613,7 @@ func (h *LogHandler) logResponse(writer *logResponseWriter, req *http.Request, r
 
 // ServeHTTP implements http.Handler.ServeHTTP.
 func (h *LogHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
-	receivedAt := time.Now()
+	receivedAt := clock.Now()
 
 	// The `X-Request-Id` header is used by Heroku, restify, etc. to correlate
 	// logs for the same request.
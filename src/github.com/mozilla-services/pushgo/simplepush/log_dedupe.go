@@ -0,0 +1,161 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+type LogDedupeConfig struct {
+	Enabled bool
+
+	// Interval is how long repeats of a warning are suppressed after it is
+	// logged. At the end of the interval, a summary with the number of
+	// suppressed repeats is logged.
+	Interval string
+
+	// MaxKeys is the maximum number of distinct warnings tracked. Warnings
+	// logged while the limit is reached are not suppressed.
+	MaxKeys int `toml:"max_keys" env:"max_keys"`
+}
+
+// logKey identifies repeated warnings. Fields are ignored, so that warnings
+// for different clients or errors are collapsed.
+type logKey struct {
+	mtype, msg string
+}
+
+// logRepeat tracks the repeats of a warning within an interval.
+type logRepeat struct {
+	until      time.Time
+	suppressed int
+}
+
+// LogDeduper collapses repeated identical warnings into periodic summaries, so
+// that a burst of warnings (e.g., "Websocket Error" during a network event)
+// does not flood the log. A nil LogDeduper suppresses nothing.
+type LogDeduper struct {
+	logger    Logger
+	interval  time.Duration
+	maxKeys   int
+	repeatMux sync.Mutex
+	repeats   map[logKey]*logRepeat
+	closeChan chan bool
+	closeOnce Once
+	done      chan bool
+}
+
+// NewLogDeduper creates a log deduper from conf. Summaries are not logged
+// until Start is called.
+func NewLogDeduper(conf LogDedupeConfig) (d *LogDeduper, err error) {
+	d = &LogDeduper{
+		maxKeys:   conf.MaxKeys,
+		repeats:   make(map[logKey]*logRepeat),
+		closeChan: make(chan bool),
+		done:      make(chan bool),
+	}
+	if d.interval, err = time.ParseDuration(conf.Interval); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Start logs summaries to logger until the deduper is closed.
+func (d *LogDeduper) Start(logger Logger) {
+	d.logger = logger
+	go d.run()
+}
+
+// Allow indicates whether a warning should be logged, or suppressed as a
+// repeat of a recently logged warning.
+func (d *LogDeduper) Allow(mtype, msg string) bool {
+	if d == nil {
+		return true
+	}
+	key := logKey{mtype, msg}
+	now := timeNow()
+	d.repeatMux.Lock()
+	defer d.repeatMux.Unlock()
+	repeat, ok := d.repeats[key]
+	if ok && now.Before(repeat.until) {
+		repeat.suppressed++
+		return false
+	}
+	if ok {
+		// Summarize the previous interval before logging the next warning.
+		d.summarize(key, repeat)
+		repeat.until = now.Add(d.interval)
+		repeat.suppressed = 0
+		return true
+	}
+	if d.maxKeys <= 0 || len(d.repeats) < d.maxKeys {
+		d.repeats[key] = &logRepeat{until: now.Add(d.interval)}
+	}
+	return true
+}
+
+// Flush summarizes and stops tracking warnings whose interval has elapsed.
+func (d *LogDeduper) Flush() {
+	if d == nil {
+		return
+	}
+	d.flush(false)
+}
+
+// flush summarizes and stops tracking warnings. If all is false, only warnings
+// whose interval has elapsed are summarized.
+func (d *LogDeduper) flush(all bool) {
+	now := timeNow()
+	d.repeatMux.Lock()
+	defer d.repeatMux.Unlock()
+	for key, repeat := range d.repeats {
+		if !all && now.Before(repeat.until) {
+			continue
+		}
+		d.summarize(key, repeat)
+		delete(d.repeats, key)
+	}
+}
+
+// summarize logs the number of repeats suppressed in an interval, if any.
+func (d *LogDeduper) summarize(key logKey, repeat *logRepeat) {
+	if repeat.suppressed == 0 || d.logger == nil {
+		return
+	}
+	d.logger.Log(WARNING, key.mtype, key.msg, LogFields{
+		"repeated": strconv.Itoa(repeat.suppressed),
+		"interval": d.interval.String(),
+	})
+}
+
+func (d *LogDeduper) run() {
+	defer close(d.done)
+	ticker := clock.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closeChan:
+			d.flush(true)
+			return
+		case <-ticker.C():
+			d.flush(false)
+		}
+	}
+}
+
+// Close stops the deduper, summarizing all suppressed warnings.
+func (d *LogDeduper) Close() error {
+	return d.closeOnce.Do(d.close)
+}
+
+func (d *LogDeduper) close() error {
+	close(d.closeChan)
+	if d.logger != nil {
+		<-d.done
+	}
+	return nil
+}
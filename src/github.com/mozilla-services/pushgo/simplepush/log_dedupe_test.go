@@ -0,0 +1,74 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLogDeduper(t *testing.T) {
+	Convey("Log deduplication", t, func() {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		defer saveTimeFuncs()()
+		now := time.Unix(1257894000, 0).UTC()
+		timeNow = func() time.Time { return now }
+
+		mckLogger := NewMockLogger(mockCtrl)
+		d, err := NewLogDeduper(LogDedupeConfig{Interval: "1m", MaxKeys: 2})
+		So(err, ShouldBeNil)
+		d.logger = mckLogger
+
+		Convey("Should summarize repeated warnings", func() {
+			So(d.Allow("worker", "Websocket Error"), ShouldBeTrue)
+			So(d.Allow("worker", "Websocket Error"), ShouldBeFalse)
+			So(d.Allow("worker", "Websocket Error"), ShouldBeFalse)
+			So(d.Allow("worker", "Invalid command"), ShouldBeTrue)
+
+			d.Flush() // The interval has not elapsed.
+			now = now.Add(1 * time.Minute)
+			mckLogger.EXPECT().Log(WARNING, "worker", "Websocket Error",
+				LogFields{"repeated": "2", "interval": "1m0s"})
+			d.Flush()
+			So(d.repeats, ShouldBeEmpty)
+			So(d.Allow("worker", "Websocket Error"), ShouldBeTrue)
+		})
+
+		Convey("Should summarize before logging the next interval", func() {
+			So(d.Allow("worker", "Websocket Error"), ShouldBeTrue)
+			So(d.Allow("worker", "Websocket Error"), ShouldBeFalse)
+			now = now.Add(2 * time.Minute)
+			mckLogger.EXPECT().Log(WARNING, "worker", "Websocket Error",
+				LogFields{"repeated": "1", "interval": "1m0s"})
+			So(d.Allow("worker", "Websocket Error"), ShouldBeTrue)
+			So(d.Allow("worker", "Websocket Error"), ShouldBeFalse)
+		})
+
+		Convey("Should not suppress untracked warnings", func() {
+			So(d.Allow("worker", "a"), ShouldBeTrue)
+			So(d.Allow("worker", "b"), ShouldBeTrue)
+			So(d.Allow("worker", "c"), ShouldBeTrue)
+			So(d.Allow("worker", "c"), ShouldBeTrue)
+			So(d.Allow("worker", "b"), ShouldBeFalse)
+		})
+
+		Convey("Should allow all warnings if nil", func() {
+			var d *LogDeduper
+			So(d.Allow("worker", "Websocket Error"), ShouldBeTrue)
+			So(d.Allow("worker", "Websocket Error"), ShouldBeTrue)
+			d.Flush()
+		})
+
+		Convey("Should reject invalid intervals", func() {
+			_, err := NewLogDeduper(LogDedupeConfig{Interval: "often"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -7,6 +7,7 @@ package simplepush
 import (
 	"bytes"
 	"encoding/json"
+	"reflect"
 	"testing"
 )
 
@@ -133,3 +134,85 @@ func TestProtobufEmitter(t *testing.T) {
 			buf.Bytes(), expected)
 	}
 }
+
+func TestGELFEmitter(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	buf := new(bytes.Buffer)
+	ge := NewGELFEmitter(buf, "example.com", "test-gelf-emitter", 0, 0)
+	expected := []byte(`{
+		"_a": "b",
+		"_id_": "c",
+		"_logger": "test-gelf-emitter",
+		"_pid": 1234,
+		"_remote_addr": "d",
+		"_type": "test",
+		"host": "example.com",
+		"level": 6,
+		"short_message": "Howdy",
+		"timestamp": 1257894000,
+		"version": "1.1"
+	}`)
+	err := ge.Emit(INFO, "test", "Howdy",
+		LogFields{"a": "b", "id": "c", "remote addr": "d"})
+	if err != nil {
+		t.Errorf("Error marshaling GELF log message: %s", err)
+	}
+	data := buf.Bytes()
+	if len(data) == 0 || data[len(data)-1] != 0 {
+		t.Fatalf("GELF log message not null-delimited: %q", data)
+	}
+	// Compare decoded messages, since float encoding varies by Go version.
+	var actualFields, expectedFields map[string]interface{}
+	if err := json.Unmarshal(data[:len(data)-1], &actualFields); err != nil {
+		t.Fatalf("Error decoding GELF log message: %s", err)
+	}
+	json.Unmarshal(expected, &expectedFields)
+	if !reflect.DeepEqual(actualFields, expectedFields) {
+		t.Errorf("Malformed GELF log message: got %#v; want %#v",
+			actualFields, expectedFields)
+	}
+}
+
+// gelfChunkWriter records each write as a separate datagram.
+type gelfChunkWriter [][]byte
+
+func (w *gelfChunkWriter) Write(p []byte) (int, error) {
+	*w = append(*w, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func TestGELFEmitterChunks(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	chunks := new(gelfChunkWriter)
+	ge := NewGELFEmitter(chunks, "example.com", "test-gelf-emitter", 64, 0)
+	if err := ge.Emit(INFO, "test", "Howdy", LogFields{"a": "b"}); err != nil {
+		t.Fatalf("Error sending chunked GELF log message: %s", err)
+	}
+	if len(*chunks) < 2 {
+		t.Fatalf("Message not chunked: got %d datagrams", len(*chunks))
+	}
+	msg := new(bytes.Buffer)
+	for i, chunk := range *chunks {
+		if len(chunk) > 64 {
+			t.Errorf("Chunk %d exceeds chunk size: %d bytes", i, len(chunk))
+		}
+		header := append([]byte{0x1e, 0x0f, 0xd1, 0xc7, 0xc7, 0x68, 0xb1,
+			0xbe, 0x4c, 0x70}, byte(i), byte(len(*chunks)))
+		if !bytes.Equal(chunk[:12], header) {
+			t.Errorf("Malformed chunk header: got %#v; want %#v",
+				chunk[:12], header)
+		}
+		msg.Write(chunk[12:])
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(msg.Bytes(), &fields); err != nil {
+		t.Fatalf("Error decoding reassembled GELF message: %s", err)
+	}
+	if fields["short_message"] != "Howdy" || fields["_a"] != "b" {
+		t.Errorf("Malformed reassembled GELF message: %#v", fields)
+	}
+}
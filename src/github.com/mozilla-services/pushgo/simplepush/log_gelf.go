@@ -0,0 +1,146 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// GELFChunkSize is the default maximum size of a GELF UDP datagram,
+	// including the chunk header.
+	GELFChunkSize = 1420
+
+	gelfChunkHeaderSize = 12  // Magic bytes, message ID, sequence number and count.
+	gelfMaxChunks       = 128 // Maximum chunks per message.
+)
+
+// gelfChunkMagic identifies chunked GELF messages.
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+// NewGELFEmitter creates a Graylog Extended Log Format (GELF) message emitter.
+// If chunkSize is positive, each message is written in a single datagram,
+// and messages larger than chunkSize are split into GELF chunks; this is the
+// framing expected by Graylog's GELF UDP input. Otherwise, messages are
+// written as a stream delimited by delimiter: a null byte for Graylog's GELF
+// TCP input, or a newline for files.
+func NewGELFEmitter(writer io.Writer, hostname, loggerName string,
+	chunkSize int, delimiter byte) *GELFEmitter {
+
+	return &GELFEmitter{
+		Writer:    writer,
+		LogName:   loggerName,
+		Pid:       int32(osGetPid()),
+		Hostname:  hostname,
+		ChunkSize: chunkSize,
+		Delimiter: delimiter,
+	}
+}
+
+// A GELFEmitter emits GELF 1.1 log messages. Log fields are sent as
+// additional fields, prefixed with an underscore.
+type GELFEmitter struct {
+	io.Writer
+	LogName   string
+	Pid       int32
+	Hostname  string
+	ChunkSize int
+	Delimiter byte
+}
+
+// Emit encodes and sends a GELF log message. Implements LogEmitter.Emit.
+func (ge *GELFEmitter) Emit(level LogLevel, messageType, payload string,
+	fields LogFields) (err error) {
+
+	msg := make(map[string]interface{}, len(fields)+8)
+	for name, val := range fields {
+		msg[gelfFieldName(name)] = val
+	}
+	msg["version"] = "1.1"
+	msg["host"] = ge.Hostname
+	msg["short_message"] = payload
+	msg["timestamp"] = float64(timeNow().UnixNano()/1e6) / 1e3
+	msg["level"] = int32(level)
+	msg["_type"] = messageType
+	msg["_logger"] = ge.LogName
+	msg["_pid"] = ge.Pid
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("Error encoding GELF log message: %s", err)
+	}
+	if ge.ChunkSize > 0 {
+		err = ge.writeChunks(data)
+	} else {
+		_, err = ge.Writer.Write(append(data, ge.Delimiter))
+	}
+	if err != nil {
+		return fmt.Errorf("Error sending GELF log message: %s", err)
+	}
+	return nil
+}
+
+// writeChunks writes a message in a single datagram, or as a sequence of
+// chunks if the message exceeds the chunk size.
+func (ge *GELFEmitter) writeChunks(data []byte) (err error) {
+	if len(data) <= ge.ChunkSize {
+		_, err = ge.Writer.Write(data)
+		return
+	}
+	bodySize := ge.ChunkSize - gelfChunkHeaderSize
+	if bodySize < 1 {
+		return fmt.Errorf("Chunk size %d too small", ge.ChunkSize)
+	}
+	count := (len(data) + bodySize - 1) / bodySize
+	if count > gelfMaxChunks {
+		return fmt.Errorf("Message size %d exceeds maximum size %d",
+			len(data), gelfMaxChunks*bodySize)
+	}
+	msgID, err := idGenerateBytes()
+	if err != nil {
+		return err
+	}
+	chunk := make([]byte, 0, ge.ChunkSize)
+	for i := 0; i < count; i++ {
+		start := i * bodySize
+		end := start + bodySize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk = append(chunk[:0], gelfChunkMagic...)
+		chunk = append(chunk, msgID[:8]...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, data[start:end]...)
+		if _, err = ge.Writer.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying write stream. Implements LogEmitter.Close.
+func (ge *GELFEmitter) Close() error {
+	return TryClose(ge.Writer)
+}
+
+// gelfFieldName converts a log field name into a GELF additional field name.
+// Characters other than letters, digits, underscores, dashes, and dots are
+// replaced with underscores. The reserved "_id" field is renamed to "_id_".
+func gelfFieldName(name string) string {
+	name = "_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+			r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+	if name == "_id" {
+		return "_id_"
+	}
+	return name
+}
@@ -0,0 +1,178 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var ErrLogBufferFull = errors.New("Log buffer full")
+
+// NetLogWriter sends framed log messages to a remote Heka instance. Messages
+// are buffered and written in the background, so that a slow or unavailable
+// Heka instance does not block the server. If the connection fails,
+// NetLogWriter reconnects with exponential backoff, and buffers messages until
+// the connection is restored. Messages logged while the buffer is full are
+// dropped; the number of dropped messages is reported to standard error on
+// reconnect.
+//
+// Each message is sent with a single write, so every UDP datagram contains a
+// complete Heka frame.
+type NetLogWriter struct {
+	dial      func() (net.Conn, error)
+	conn      net.Conn
+	delay     time.Duration
+	maxDelay  time.Duration
+	queue     chan []byte
+	dropped   int64 // Accessed atomically.
+	closeChan chan bool
+	closeOnce Once
+	done      chan bool
+}
+
+// NewNetLogWriter creates a writer that sends messages over conn, and redials
+// with dial if the connection fails. delay is the initial reconnect delay,
+// doubled after each failed attempt up to maxDelay. At most size messages are
+// buffered.
+func NewNetLogWriter(conn net.Conn, dial func() (net.Conn, error),
+	delay, maxDelay time.Duration, size int) *NetLogWriter {
+
+	if size < 1 {
+		size = 1
+	}
+	if maxDelay < delay {
+		maxDelay = delay
+	}
+	w := &NetLogWriter{
+		dial:      dial,
+		conn:      conn,
+		delay:     delay,
+		maxDelay:  maxDelay,
+		queue:     make(chan []byte, size),
+		closeChan: make(chan bool),
+		done:      make(chan bool),
+	}
+	go w.run()
+	return w
+}
+
+// Write queues a message for sending. The message is copied, so that callers
+// can reuse their buffers. Implements io.Writer.Write.
+func (w *NetLogWriter) Write(p []byte) (int, error) {
+	select {
+	case <-w.closeChan:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	frame := make([]byte, len(p))
+	copy(frame, p)
+	select {
+	case w.queue <- frame:
+	default:
+		atomic.AddInt64(&w.dropped, 1)
+		return 0, ErrLogBufferFull
+	}
+	return len(p), nil
+}
+
+// Dropped returns the number of messages dropped since the last reconnect.
+func (w *NetLogWriter) Dropped() int64 {
+	return atomic.LoadInt64(&w.dropped)
+}
+
+func (w *NetLogWriter) run() {
+	defer close(w.done)
+	for {
+		select {
+		case <-w.closeChan:
+			w.drain()
+			if w.conn != nil {
+				w.conn.Close()
+			}
+			return
+		case frame := <-w.queue:
+			w.send(frame)
+		}
+	}
+}
+
+// send writes a message, reconnecting until the message is written or the
+// writer is closed.
+func (w *NetLogWriter) send(frame []byte) {
+	delay := w.delay
+	for {
+		if w.conn == nil {
+			if !w.reconnect(&delay) {
+				return
+			}
+			continue
+		}
+		if _, err := w.conn.Write(frame); err == nil {
+			return
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+// reconnect redials the remote host, waiting delay before the attempt and
+// doubling it for the next attempt. Returns false if the writer was closed
+// while waiting.
+func (w *NetLogWriter) reconnect(delay *time.Duration) bool {
+	select {
+	case <-w.closeChan:
+		return false
+	case <-clock.After(*delay):
+	}
+	if *delay *= 2; *delay > w.maxDelay {
+		*delay = w.maxDelay
+	}
+	conn, err := w.dial()
+	if err != nil {
+		return true
+	}
+	w.conn = conn
+	if dropped := atomic.SwapInt64(&w.dropped, 0); dropped > 0 {
+		log.Printf("NetLogWriter: Dropped %d log messages while disconnected",
+			dropped)
+	}
+	return true
+}
+
+// drain writes buffered messages over the current connection, without
+// reconnecting.
+func (w *NetLogWriter) drain() {
+	for {
+		select {
+		case frame := <-w.queue:
+			if w.conn == nil {
+				continue
+			}
+			if _, err := w.conn.Write(frame); err != nil {
+				w.conn.Close()
+				w.conn = nil
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Close flushes buffered messages and closes the connection. Implements
+// io.Closer.Close.
+func (w *NetLogWriter) Close() error {
+	return w.closeOnce.Do(w.close)
+}
+
+func (w *NetLogWriter) close() error {
+	close(w.closeChan)
+	<-w.done
+	return nil
+}
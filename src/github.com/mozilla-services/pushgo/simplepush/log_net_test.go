@@ -0,0 +1,83 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNetLogWriter(t *testing.T) {
+	Convey("Network log writer", t, func() {
+		Convey("Should copy and send messages", func() {
+			client, server := net.Pipe()
+			defer server.Close()
+			w := NewNetLogWriter(client, nil, time.Millisecond,
+				time.Millisecond, 10)
+			defer w.Close()
+
+			frame := []byte("frame")
+			n, err := w.Write(frame)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 5)
+			copy(frame, "reuse")
+
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(server, buf)
+			So(err, ShouldBeNil)
+			So(string(buf), ShouldEqual, "frame")
+		})
+
+		Convey("Should reconnect if the connection fails", func() {
+			client, server := net.Pipe()
+			server.Close()
+			newClient, newServer := net.Pipe()
+			defer newServer.Close()
+			dials := 0
+			dial := func() (net.Conn, error) {
+				if dials++; dials < 3 {
+					return nil, errors.New("connection refused")
+				}
+				return newClient, nil
+			}
+			w := NewNetLogWriter(client, dial, time.Millisecond,
+				2*time.Millisecond, 10)
+			defer w.Close()
+
+			_, err := w.Write([]byte("hello"))
+			So(err, ShouldBeNil)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(newServer, buf)
+			So(err, ShouldBeNil)
+			So(string(buf), ShouldEqual, "hello")
+			So(dials, ShouldEqual, 3)
+		})
+
+		Convey("Should drop messages if the buffer is full", func() {
+			client, server := net.Pipe() // Blocks until read.
+			defer server.Close()
+			w := NewNetLogWriter(client, nil, time.Millisecond,
+				time.Millisecond, 1)
+
+			var err error
+			for i := 0; i < 3 && err == nil; i++ {
+				_, err = w.Write([]byte("x"))
+			}
+			So(err, ShouldEqual, ErrLogBufferFull)
+			So(w.Dropped(), ShouldEqual, 1)
+
+			go io.Copy(ioutil.Discard, server)
+			So(w.Close(), ShouldBeNil)
+			_, err = w.Write([]byte("x"))
+			So(err, ShouldEqual, io.ErrClosedPipe)
+		})
+	})
+}
@@ -39,6 +39,15 @@ type ChannelRecord struct {
 	State       ChannelState
 	Version     uint64
 	LastTouched int64
+	ExpiresAt   int64  `json:",omitempty"` // Seconds since Epoch; 0 if the update doesn't expire.
+	Created     int64  `json:",omitempty"` // Seconds since Epoch; 0 if unknown.
+	Payload     uint64 `json:",omitempty"` // Version with stored data; 0 if none.
+}
+
+// HasPayload indicates whether update data is stored for the record's
+// version.
+func (r *ChannelRecord) HasPayload() bool {
+	return r.Payload > 0 && r.Payload == r.Version
 }
 
 // ChannelIDs is a list of decoded channel IDs.
@@ -0,0 +1,85 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sync"
+)
+
+// Size estimates used by subsystems that report their memory usage. These
+// are deliberately rough: the goal is to localize growth, not to match the
+// heap profile.
+const (
+	// mapEntryBytes approximates the per-entry overhead of a map, including
+	// bucket slack.
+	mapEntryBytes = 48
+
+	// idBytes approximates the size of a device or channel ID string,
+	// including the string header.
+	idBytes = 52
+)
+
+type MemoryConfig struct {
+	// Enabled publishes the approximate memory held by each subsystem as
+	// gauges, and through the admin API.
+	Enabled bool
+}
+
+// MemorySizer is implemented by subsystems that hold memory proportional to
+// load, such as registries, queues, and caches.
+type MemorySizer interface {
+	// MemoryUsage returns the approximate number of bytes held.
+	MemoryUsage() int64
+}
+
+// MemoryAccounts tracks the approximate memory held by each registered
+// subsystem, so that leaks can be localized without heap profiling. A nil
+// MemoryAccounts ignores registrations.
+type MemoryAccounts struct {
+	sizersMux sync.RWMutex
+	sizers    map[string]MemorySizer // By subsystem name.
+}
+
+// NewMemoryAccounts returns an empty set of memory accounts.
+func NewMemoryAccounts() *MemoryAccounts {
+	return &MemoryAccounts{sizers: make(map[string]MemorySizer)}
+}
+
+// Register adds a subsystem, replacing any existing subsystem with the same
+// name.
+func (m *MemoryAccounts) Register(name string, sizer MemorySizer) {
+	if m == nil {
+		return
+	}
+	m.sizersMux.Lock()
+	m.sizers[name] = sizer
+	m.sizersMux.Unlock()
+}
+
+// Usage returns the approximate bytes held by each subsystem.
+func (m *MemoryAccounts) Usage() map[string]int64 {
+	if m == nil {
+		return nil
+	}
+	m.sizersMux.RLock()
+	defer m.sizersMux.RUnlock()
+	usage := make(map[string]int64, len(m.sizers))
+	for name, sizer := range m.sizers {
+		usage[name] = sizer.MemoryUsage()
+	}
+	return usage
+}
+
+// Publish records the usage of each subsystem as a gauge.
+func (m *MemoryAccounts) Publish(metrics Statistician) {
+	var total int64
+	for name, bytes := range m.Usage() {
+		metrics.Gauge("memory."+name+".bytes", bytes)
+		total += bytes
+	}
+	if m != nil {
+		metrics.Gauge("memory.total.bytes", total)
+	}
+}
@@ -0,0 +1,66 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fixedSizer reports a fixed memory usage.
+type fixedSizer int64
+
+func (s fixedSizer) MemoryUsage() int64 { return int64(s) }
+
+func TestMemoryAccounts(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Memory accounting", t, func() {
+		m := NewMemoryAccounts()
+
+		Convey("Should report usage by subsystem", func() {
+			m.Register("token_cache", fixedSizer(1024))
+			m.Register("update_queue", fixedSizer(512))
+			m.Register("update_queue", fixedSizer(256))
+			So(m.Usage(), ShouldResemble, map[string]int64{
+				"token_cache":  1024,
+				"update_queue": 256,
+			})
+		})
+
+		Convey("Should publish usage as gauges", func() {
+			m.Register("token_cache", fixedSizer(1024))
+			m.Register("update_queue", fixedSizer(256))
+			gomock.InOrder(
+				mckStat.EXPECT().Gauge("memory.token_cache.bytes", int64(1024)),
+				mckStat.EXPECT().Gauge("memory.total.bytes", int64(1280)),
+			)
+			mckStat.EXPECT().Gauge("memory.update_queue.bytes", int64(256))
+			m.Publish(mckStat)
+		})
+
+		Convey("Should track registered workers", func() {
+			workers := NewWorkerRegistry()
+			m.Register("workers", workers)
+			So(m.Usage()["workers"], ShouldEqual, 0)
+			workers.Add("5e1e5984569c4f00bf4bea47754a6403", &NoWorker{})
+			workers.Add("7e0e3d9b0c1c4c9e8f1e0a0b5a6c1d2e", &NoWorker{})
+			So(m.Usage()["workers"], ShouldEqual,
+				2*(mapEntryBytes+idBytes+workerEntryBytes))
+		})
+
+		Convey("Should ignore registrations if disabled", func() {
+			var m *MemoryAccounts
+			m.Register("workers", NewWorkerRegistry())
+			So(m.Usage(), ShouldBeNil)
+			m.Publish(mckStat)
+		})
+	})
+}
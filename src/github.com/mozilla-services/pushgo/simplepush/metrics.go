@@ -46,6 +46,7 @@ type MetricsConfig struct {
 	Counters       MetricConfig
 	Timers         MetricConfig
 	Gauges         MetricConfig
+	Prometheus     PrometheusConfig
 }
 
 type Statistician interface {
@@ -77,6 +78,7 @@ type Metrics struct {
 	app            *Application
 	logger         *SimpleLogger
 	statsd         *statsd.Client
+	prometheus     *PrometheusRegistry
 	born           time.Time
 	storeSnapshots bool
 }
@@ -85,6 +87,10 @@ func (m *Metrics) ConfigStruct() interface{} {
 	return &MetricsConfig{
 		StoreSnapshots: true,
 		Gauges:         MetricConfig{Suffix: "{{.Host}}"},
+		Prometheus: PrometheusConfig{
+			Namespace: "pushgo",
+			Path:      "/metrics",
+		},
 	}
 }
 
@@ -101,6 +107,10 @@ func (m *Metrics) Init(app *Application, config interface{}) (err error) {
 		}
 	}
 
+	if conf.Prometheus.Enabled {
+		m.prometheus = NewPrometheusRegistry(conf.Prometheus, app.Hostname())
+	}
+
 	err = m.setCounterAffixes(conf.Counters.Prefix, conf.Counters.Suffix)
 	if err != nil {
 		m.logger.Panic("metrics", "Error setting counter name affixes",
@@ -119,7 +129,7 @@ func (m *Metrics) Init(app *Application, config interface{}) (err error) {
 			LogFields{"error": err.Error()})
 		return err
 	}
-	m.born = time.Now()
+	m.born = clock.Now()
 
 	if m.storeSnapshots = conf.StoreSnapshots; m.storeSnapshots {
 		m.counter = make(map[string]int64)
@@ -218,6 +228,22 @@ func (m *Metrics) formatMetric(metric string, prefix, suffix string,
 	return strings.Join(parts, ".")
 }
 
+// Prometheus returns the Prometheus registry, or nil if the exporter is
+// disabled.
+// Close closes the statsd connection. The application closes the metrics
+// last, so that metrics recorded while shutting down are sent before the
+// process exits.
+func (m *Metrics) Close() error {
+	if m.statsd == nil {
+		return nil
+	}
+	return m.statsd.Close()
+}
+
+func (m *Metrics) Prometheus() *PrometheusRegistry {
+	return m.prometheus
+}
+
 func (m *Metrics) Snapshot() map[string]interface{} {
 	if !m.storeSnapshots {
 		return nil
@@ -235,7 +261,7 @@ func (m *Metrics) Snapshot() map[string]interface{} {
 		oldMetrics[m.formatGauge(k, "gauge")] = v
 	}
 	m.RUnlock()
-	age := time.Now().Unix() - m.born.Unix()
+	age := clock.Now().Unix() - m.born.Unix()
 	oldMetrics[m.formatMetric("server.age", "", "")] = age
 	return oldMetrics
 }
@@ -254,6 +280,10 @@ func (m *Metrics) IncrementBy(metric string, count int64) {
 				"type": "counter"})
 	}
 
+	if m.prometheus != nil {
+		m.prometheus.IncrementBy(metric, count)
+	}
+
 	if statsd := m.statsd; statsd != nil {
 		if count >= 0 {
 			statsd.Inc(m.formatCounter(metric), count, 1.0)
@@ -296,6 +326,9 @@ func (m *Metrics) Timer(metric string, duration time.Duration) {
 			LogFields{"value": strconv.FormatInt(value, 10),
 				"type": "timer"})
 	}
+	if m.prometheus != nil {
+		m.prometheus.Observe(metric, duration)
+	}
 	if m.statsd != nil {
 		m.statsd.Timing(m.formatTimer(metric), value, 1.0)
 	}
@@ -308,6 +341,10 @@ func (m *Metrics) Gauge(metric string, value int64) {
 		m.Unlock()
 	}
 
+	if m.prometheus != nil {
+		m.prometheus.Gauge(metric, value)
+	}
+
 	if statsd := m.statsd; statsd != nil {
 		if value >= 0 {
 			statsd.Gauge(m.formatGauge(metric), value, 1.0)
@@ -329,6 +366,10 @@ func (m *Metrics) GaugeDelta(metric string, delta int64) {
 		m.Unlock()
 	}
 
+	if m.prometheus != nil {
+		m.prometheus.GaugeDelta(metric, delta)
+	}
+
 	if m.statsd != nil {
 		m.statsd.GaugeDelta(m.formatGauge(metric), delta, 1.0)
 	}
@@ -0,0 +1,130 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+// RecordMigration upgrades a decoded store record from one schema version to
+// the next; for example, by filling in a default for a field that older
+// records lack. v is a pointer to the decoded record. Migrations must ignore
+// record types that they do not change.
+type RecordMigration func(v interface{}) error
+
+// recordMigrations upgrade records written with each schema version:
+// recordMigrations[i] upgrades records from version recordVersion+i. Append
+// a migration to bump the schema version. Nodes reject records written with
+// newer schema versions, so all nodes should be upgraded before records
+// written with a new version are expected to be read.
+var recordMigrations []RecordMigration
+
+type MigratorConfig struct {
+	// Enabled rewrites records read with an older schema version in the
+	// background, so that migrations are not repeated on every read. Records
+	// are always migrated on read.
+	Enabled bool
+
+	// QueueSize is the maximum number of records waiting to be rewritten.
+	// Records read while the queue is full are rewritten on a later read.
+	QueueSize int `toml:"queue_size" env:"queue_size"`
+}
+
+// staleRecord is a record read with an older schema version, re-encoded with
+// the current version.
+type staleRecord struct {
+	key   string
+	value []byte // The re-encoded record.
+	ttl   int32  // The record expiration, in seconds.
+	item  interface{}
+}
+
+// migrateBackend is implemented by stores that support background record
+// migration. rewrite replaces a stale record with its re-encoded value, unless
+// the record changed after it was read.
+type migrateBackend interface {
+	rewrite(record *staleRecord) error
+}
+
+// RecordMigrator rewrites stale records in the background. A nil
+// RecordMigrator discards stale records.
+type RecordMigrator struct {
+	logger    *SimpleLogger
+	metrics   Statistician
+	backend   migrateBackend
+	queue     chan *staleRecord
+	closeChan chan bool
+	closeOnce Once
+	done      chan bool
+}
+
+// NewRecordMigrator creates a record migrator for backend from conf.
+func NewRecordMigrator(app *Application, conf MigratorConfig,
+	backend migrateBackend) *RecordMigrator {
+
+	size := conf.QueueSize
+	if size < 1 {
+		size = 1
+	}
+	return &RecordMigrator{
+		logger:    app.Logger(),
+		metrics:   app.Metrics(),
+		backend:   backend,
+		queue:     make(chan *staleRecord, size),
+		closeChan: make(chan bool),
+		done:      make(chan bool),
+	}
+}
+
+// Add queues a stale record for rewriting. Records are dropped if the queue
+// is full or the migrator is closed.
+func (m *RecordMigrator) Add(record *staleRecord) {
+	if m == nil {
+		return
+	}
+	select {
+	case <-m.closeChan:
+		return
+	default:
+	}
+	select {
+	case m.queue <- record:
+	default:
+		m.metrics.Increment("store.migrate.dropped")
+	}
+}
+
+// Run rewrites queued records until the migrator is closed.
+func (m *RecordMigrator) Run() {
+	defer close(m.done)
+	for {
+		select {
+		case <-m.closeChan:
+			return
+		case record := <-m.queue:
+			m.rewrite(record)
+		}
+	}
+}
+
+func (m *RecordMigrator) rewrite(record *staleRecord) {
+	if err := m.backend.rewrite(record); err != nil {
+		if m.logger.ShouldLog(WARNING) {
+			m.logger.Warn("migrate", "Failed to rewrite stale record",
+				LogFields{"key": record.key, "error": err.Error()})
+		}
+		m.metrics.Increment("store.migrate.error")
+		return
+	}
+	m.metrics.Increment("store.migrate.rewritten")
+}
+
+// Close stops the migrator. Queued records are discarded; they are migrated
+// again when read.
+func (m *RecordMigrator) Close() error {
+	return m.closeOnce.Do(m.close)
+}
+
+func (m *RecordMigrator) close() error {
+	close(m.closeChan)
+	<-m.done
+	return nil
+}
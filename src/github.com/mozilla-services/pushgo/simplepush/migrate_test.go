@@ -0,0 +1,73 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testMigrateBackend records rewritten records.
+type testMigrateBackend struct {
+	rewritten chan *staleRecord
+	err       error
+}
+
+func (b *testMigrateBackend) rewrite(record *staleRecord) error {
+	b.rewritten <- record
+	return b.err
+}
+
+func TestRecordMigrator(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Background record migration", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		backend := &testMigrateBackend{rewritten: make(chan *staleRecord, 1)}
+		m := NewRecordMigrator(app, MigratorConfig{Enabled: true, QueueSize: 1},
+			backend)
+
+		Convey("Should drop stale records if the queue is full", func() {
+			mckStat.EXPECT().Increment("store.migrate.dropped")
+			m.Add(&staleRecord{key: "a"})
+			m.Add(&staleRecord{key: "b"})
+		})
+
+		Convey("Should rewrite queued records", func() {
+			mckStat.EXPECT().Increment("store.migrate.rewritten")
+			go m.Run()
+			m.Add(&staleRecord{key: "a"})
+			record := <-backend.rewritten
+			So(record.key, ShouldEqual, "a")
+			So(m.Close(), ShouldBeNil)
+		})
+
+		Convey("Should count failed rewrites", func() {
+			backend.err = errors.New("oops")
+			mckStat.EXPECT().Increment("store.migrate.error")
+			go m.Run()
+			m.Add(&staleRecord{key: "a"})
+			<-backend.rewritten
+			So(m.Close(), ShouldBeNil)
+		})
+
+		Convey("Should discard stale records if disabled", func() {
+			var m *RecordMigrator
+			m.Add(&staleRecord{key: "a"})
+		})
+	})
+}
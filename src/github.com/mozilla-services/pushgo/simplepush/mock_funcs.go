@@ -20,6 +20,7 @@ var (
 	idGenerateBytes func() ([]byte, error)
 	osGetPid        func() int
 	timeNow         func() time.Time
+	clock           Clock
 )
 
 // useStdFuncs sets the non-deterministic function aliases to their default
@@ -30,6 +31,7 @@ func useStdFuncs() {
 	idGenerateBytes = id.GenerateBytes
 	osGetPid = os.Getpid
 	timeNow = time.Now
+	clock = stdClock{}
 }
 
 func init() {
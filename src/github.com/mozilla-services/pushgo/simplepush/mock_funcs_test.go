@@ -45,6 +45,143 @@ func useMockFuncs() {
 	}
 }
 
+// saveTimeFuncs records the current clock and timeNow, and returns a function
+// that restores them. Tests that replace either should defer the result:
+// defer saveTimeFuncs()().
+func saveTimeFuncs() (restore func()) {
+	prevClock, prevTimeNow := clock, timeNow
+	return func() { clock, timeNow = prevClock, prevTimeNow }
+}
+
+// useMockClock replaces the clock and timeNow with c. Timers and tickers only
+// fire when the test advances c.
+func useMockClock(c *mockClock) {
+	clock = c
+	timeNow = c.Now
+}
+
+// newMockClock returns a fake clock set to now.
+func newMockClock(now time.Time) *mockClock {
+	return &mockClock{now: now}
+}
+
+// mockClock is a fake Clock for testing. Timers fire when the clock is moved
+// forward past their deadline; moving the clock backward does not fire or
+// reschedule timers.
+type mockClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*mockTimer
+}
+
+func (c *mockClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *mockClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *mockClock) NewTimer(d time.Duration) Timer {
+	return c.addTimer(d, 0, nil)
+}
+
+func (c *mockClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.addTimer(d, 0, f)
+}
+
+func (c *mockClock) NewTicker(d time.Duration) Ticker {
+	return mockTicker{c.addTimer(d, d, nil)}
+}
+
+func (c *mockClock) addTimer(d, period time.Duration, f func()) *mockTimer {
+	t := &mockTimer{clock: c, period: period, f: f}
+	if f == nil {
+		t.c = make(chan time.Time, 1)
+	}
+	c.Lock()
+	t.fireAt = c.now.Add(d)
+	t.active = true
+	c.timers = append(c.timers, t)
+	c.Unlock()
+	return t
+}
+
+// Advance moves the clock forward by d, firing due timers.
+func (c *mockClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the clock to now, firing due timers. now may be in the past, to
+// simulate a backward clock jump.
+func (c *mockClock) Set(now time.Time) {
+	c.Lock()
+	c.now = now
+	var due []*mockTimer
+	for _, t := range c.timers {
+		if !t.active || t.fireAt.After(now) {
+			continue
+		}
+		due = append(due, t)
+		if t.period > 0 {
+			for !t.fireAt.After(now) {
+				t.fireAt = t.fireAt.Add(t.period)
+			}
+		} else {
+			t.active = false
+		}
+	}
+	c.Unlock()
+	for _, t := range due {
+		if t.f != nil {
+			t.f()
+			continue
+		}
+		select {
+		case t.c <- now:
+		default:
+		}
+	}
+}
+
+// mockTimer is a Timer created by a mockClock.
+type mockTimer struct {
+	clock  *mockClock
+	c      chan time.Time
+	f      func()
+	fireAt time.Time
+	period time.Duration
+	active bool
+}
+
+func (t *mockTimer) C() <-chan time.Time { return t.c }
+
+func (t *mockTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (t *mockTimer) Reset(d time.Duration) bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	wasActive := t.active
+	t.fireAt = t.clock.now.Add(d)
+	t.active = true
+	return wasActive
+}
+
+// mockTicker is a Ticker created by a mockClock.
+type mockTicker struct {
+	*mockTimer
+}
+
+func (t mockTicker) Stop() { t.mockTimer.Stop() }
+
 // netAddr implements net.Addr.
 type netAddr struct {
 	network string
@@ -174,6 +174,35 @@ func (_mr *_MockHandlerRecorder) Close() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Close")
 }
 
+// Mock of SocketServer interface
+type MockSocketServer struct {
+	ctrl     *gomock.Controller
+	recorder *_MockSocketServerRecorder
+}
+
+// Recorder for MockSocketServer (not exported)
+type _MockSocketServerRecorder struct {
+	mock *MockSocketServer
+}
+
+func NewMockSocketServer(ctrl *gomock.Controller) *MockSocketServer {
+	mock := &MockSocketServer{ctrl: ctrl}
+	mock.recorder = &_MockSocketServerRecorder{mock}
+	return mock
+}
+
+func (_m *MockSocketServer) EXPECT() *_MockSocketServerRecorder {
+	return _m.recorder
+}
+
+func (_m *MockSocketServer) ServeSocket(_param0 Socket, _param1 *http.Request) {
+	_m.ctrl.Call(_m, "ServeSocket", _param0, _param1)
+}
+
+func (_mr *_MockSocketServerRecorder) ServeSocket(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ServeSocket", arg0, arg1)
+}
+
 // Mock of ListenerConfig interface
 type MockListenerConfig struct {
 	ctrl     *gomock.Controller
@@ -215,13 +244,13 @@ func (_mr *_MockListenerConfigRecorder) GetMaxConns() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetMaxConns")
 }
 
-func (_m *MockListenerConfig) Listen() (net.Listener, error) {
-	ret := _m.ctrl.Call(_m, "Listen")
+func (_m *MockListenerConfig) Listen(_param0 *Application) (net.Listener, error) {
+	ret := _m.ctrl.Call(_m, "Listen", _param0)
 	ret0, _ := ret[0].(net.Listener)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-func (_mr *_MockListenerConfigRecorder) Listen() *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "Listen")
+func (_mr *_MockListenerConfigRecorder) Listen(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Listen", arg0)
 }
@@ -104,3 +104,129 @@ func (_m *MockWorker) Close() error {
 func (_mr *_MockWorkerRecorder) Close() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Close")
 }
+
+// Mock of ExpiredSender interface
+type MockExpiredSender struct {
+	ctrl     *gomock.Controller
+	recorder *_MockExpiredSenderRecorder
+}
+
+// Recorder for MockExpiredSender (not exported)
+type _MockExpiredSenderRecorder struct {
+	mock *MockExpiredSender
+}
+
+func NewMockExpiredSender(ctrl *gomock.Controller) *MockExpiredSender {
+	mock := &MockExpiredSender{ctrl: ctrl}
+	mock.recorder = &_MockExpiredSenderRecorder{mock}
+	return mock
+}
+
+func (_m *MockExpiredSender) EXPECT() *_MockExpiredSenderRecorder {
+	return _m.recorder
+}
+
+func (_m *MockExpiredSender) SendExpired(chids ...string) error {
+	_s := []interface{}{}
+	for _, _x := range chids {
+		_s = append(_s, _x)
+	}
+	ret := _m.ctrl.Call(_m, "SendExpired", _s...)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockExpiredSenderRecorder) SendExpired(arg0 ...interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SendExpired", arg0...)
+}
+
+// Mock of CommandHandler interface
+type MockCommandHandler struct {
+	ctrl     *gomock.Controller
+	recorder *_MockCommandHandlerRecorder
+}
+
+// Recorder for MockCommandHandler (not exported)
+type _MockCommandHandlerRecorder struct {
+	mock *MockCommandHandler
+}
+
+func NewMockCommandHandler(ctrl *gomock.Controller) *MockCommandHandler {
+	mock := &MockCommandHandler{ctrl: ctrl}
+	mock.recorder = &_MockCommandHandlerRecorder{mock}
+	return mock
+}
+
+func (_m *MockCommandHandler) EXPECT() *_MockCommandHandlerRecorder {
+	return _m.recorder
+}
+
+func (_m *MockCommandHandler) Hello(header *RequestHeader, message []byte) error {
+	ret := _m.ctrl.Call(_m, "Hello", header, message)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockCommandHandlerRecorder) Hello(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Hello", arg0, arg1)
+}
+
+func (_m *MockCommandHandler) Ack(header *RequestHeader, message []byte) error {
+	ret := _m.ctrl.Call(_m, "Ack", header, message)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockCommandHandlerRecorder) Ack(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Ack", arg0, arg1)
+}
+
+func (_m *MockCommandHandler) Register(header *RequestHeader, message []byte) error {
+	ret := _m.ctrl.Call(_m, "Register", header, message)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockCommandHandlerRecorder) Register(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Register", arg0, arg1)
+}
+
+func (_m *MockCommandHandler) Unregister(header *RequestHeader, message []byte) error {
+	ret := _m.ctrl.Call(_m, "Unregister", header, message)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockCommandHandlerRecorder) Unregister(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Unregister", arg0, arg1)
+}
+
+func (_m *MockCommandHandler) Ping(header *RequestHeader, message []byte) error {
+	ret := _m.ctrl.Call(_m, "Ping", header, message)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockCommandHandlerRecorder) Ping(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Ping", arg0, arg1)
+}
+
+func (_m *MockCommandHandler) Purge(header *RequestHeader, message []byte) error {
+	ret := _m.ctrl.Call(_m, "Purge", header, message)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockCommandHandlerRecorder) Purge(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Purge", arg0, arg1)
+}
+
+func (_m *MockCommandHandler) Channels(header *RequestHeader, message []byte) error {
+	ret := _m.ctrl.Call(_m, "Channels", header, message)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockCommandHandlerRecorder) Channels(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Channels", arg0, arg1)
+}
@@ -0,0 +1,174 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type MultiPingConfig struct {
+	// Pingers lists the enabled pingers: "gcm" and "apns". Each pinger is
+	// configured in its own subsection, e.g. [propping.apns].
+	Pingers []string
+
+	// Default is the pinger for connect data without a "type" field, like
+	// GCM registrations from older clients.
+	Default string
+
+	GCM  GCMPingConfig  `toml:"gcm" env:"gcm"`
+	APNs APNsPingConfig `toml:"apns" env:"apns"`
+}
+
+// connectType is the pinger selector in a client's connect data.
+type connectType struct {
+	Type string `json:"type"`
+}
+
+// MultiPing selects a proprietary pinger for each device, by the "type"
+// field of the connect data sent in the client's handshake. For example,
+// {"type": "apns", "token": "..."} registers an iOS device with APNs, and
+// {"type": "gcm", "regid": "..."} registers an Android device with GCM.
+type MultiPing struct {
+	logger  *SimpleLogger
+	store   Store
+	pingers map[string]PropPinger
+	def     string
+}
+
+func (r *MultiPing) ConfigStruct() interface{} {
+	return &MultiPingConfig{
+		Pingers: []string{"gcm"},
+		Default: "gcm",
+		GCM:     *new(GCMPing).ConfigStruct().(*GCMPingConfig),
+		APNs:    *new(APNsPing).ConfigStruct().(*APNsPingConfig),
+	}
+}
+
+func (r *MultiPing) Name() string {
+	return "multi"
+}
+
+func (r *MultiPing) Init(app *Application, config interface{}) (err error) {
+	r.logger = app.Logger()
+	r.store = app.Store()
+	conf := config.(*MultiPingConfig)
+
+	r.pingers = make(map[string]PropPinger, len(conf.Pingers))
+	for _, name := range conf.Pingers {
+		var pinger PropPinger
+		switch name {
+		case "gcm":
+			gcm := NewGCMPing()
+			err, pinger = gcm.Init(app, &conf.GCM), gcm
+		case "apns":
+			apns := NewAPNsPing()
+			err, pinger = apns.Init(app, &conf.APNs), apns
+		default:
+			err = fmt.Errorf("Unknown pinger type: %s", name)
+		}
+		if err != nil {
+			r.logger.Panic("propping", "Could not configure pinger",
+				LogFields{"error": err.Error(), "pinger": name})
+			r.Close()
+			return err
+		}
+		r.pingers[name] = pinger
+	}
+	r.def = conf.Default
+	if _, ok := r.pingers[r.def]; !ok {
+		r.logger.Panic("propping", "Default pinger is not enabled",
+			LogFields{"default": r.def})
+		r.Close()
+		return ConfigurationErr
+	}
+	return nil
+}
+
+// pinger returns the pinger selected by connect data.
+func (r *MultiPing) pinger(pingData []byte) (PropPinger, error) {
+	selector := new(connectType)
+	if err := json.Unmarshal(pingData, selector); err != nil {
+		return nil, err
+	}
+	name := selector.Type
+	if len(name) == 0 {
+		name = r.def
+	}
+	pinger, ok := r.pingers[name]
+	if !ok {
+		return nil, UnsupportedProtocolErr
+	}
+	return pinger, nil
+}
+
+func (r *MultiPing) Register(uaid string, pingData []byte) error {
+	pinger, err := r.pinger(pingData)
+	if err != nil {
+		return err
+	}
+	return pinger.Register(uaid, pingData)
+}
+
+func (r *MultiPing) Send(uaid string, vers int64, data string) (bool, error) {
+	// The selected pinger fetches the connect data again. Pings are only
+	// sent to offline devices, so the extra read is uncommon.
+	pingData, err := r.store.FetchPing(uaid)
+	if err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("propping", "Could not fetch registration data",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return false, err
+	}
+	if len(pingData) == 0 {
+		return false, nil
+	}
+	pinger, err := r.pinger(pingData)
+	if err != nil {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("propping", "Could not select pinger for device",
+				LogFields{"error": err.Error(), "uaid": uaid})
+		}
+		return false, err
+	}
+	return pinger.Send(uaid, vers, data)
+}
+
+// MaxPayload implements PayloadLimiter.MaxPayload(), returning the smallest
+// limit of the enabled pingers.
+func (r *MultiPing) MaxPayload() (max int) {
+	for _, pinger := range r.pingers {
+		if limit := MaxPayload(pinger); limit > 0 && (max == 0 || limit < max) {
+			max = limit
+		}
+	}
+	return max
+}
+
+func (r *MultiPing) CanBypassWebsocket() bool {
+	for _, pinger := range r.pingers {
+		if !pinger.CanBypassWebsocket() {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *MultiPing) Status() (bool, error) {
+	for _, pinger := range r.pingers {
+		if ok, err := pinger.Status(); !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (r *MultiPing) Close() error {
+	for _, pinger := range r.pingers {
+		pinger.Close()
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMultiPing(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStore := NewMockStore(mockCtrl)
+	mckGCM := NewMockPropPinger(mockCtrl)
+	mckAPNs := NewMockPropPinger(mockCtrl)
+
+	uaid := "5e1e5984569c4f00bf4bea47754a6403"
+
+	Convey("Pinger selection", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		pinger := &MultiPing{
+			logger:  app.Logger(),
+			store:   mckStore,
+			pingers: map[string]PropPinger{"gcm": mckGCM, "apns": mckAPNs},
+			def:     "gcm",
+		}
+
+		Convey("Should register devices with the selected pinger", func() {
+			connect := []byte(`{"type":"apns","token":"abcd"}`)
+			mckAPNs.EXPECT().Register(uaid, connect)
+			So(pinger.Register(uaid, connect), ShouldBeNil)
+
+			connect = []byte(`{"regid":"abcd"}`)
+			mckGCM.EXPECT().Register(uaid, connect)
+			So(pinger.Register(uaid, connect), ShouldBeNil)
+
+			So(pinger.Register(uaid, []byte(`{"type":"udp"}`)), ShouldEqual,
+				UnsupportedProtocolErr)
+		})
+
+		Convey("Should send with the registered pinger", func() {
+			mckStore.EXPECT().FetchPing(uaid).Return(
+				[]byte(`{"type":"apns","token":"abcd"}`), nil)
+			mckAPNs.EXPECT().Send(uaid, int64(1), "data").Return(true, nil)
+			ok, err := pinger.Send(uaid, 1, "data")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+
+			mckStore.EXPECT().FetchPing(uaid).Return(nil, nil)
+			ok, err = pinger.Send(uaid, 1, "data")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Should only bypass the socket if all pingers can", func() {
+			mckGCM.EXPECT().CanBypassWebsocket().Return(true).AnyTimes()
+			mckAPNs.EXPECT().CanBypassWebsocket().Return(false).AnyTimes()
+			So(pinger.CanBypassWebsocket(), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,322 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxSessionIDLen is the maximum length of a client-assigned session ID.
+const maxSessionIDLen = 64
+
+type MultiplexConfig struct {
+	Enabled bool
+
+	// MaxSessions is the maximum number of concurrent sessions per
+	// connection. Frames for new sessions beyond the limit are rejected.
+	MaxSessions int `toml:"max_sessions" env:"max_sessions"`
+
+	// QueueSize is the number of unread frames buffered per session. A
+	// session that falls behind is closed, without affecting the others.
+	QueueSize int `toml:"queue_size" env:"queue_size"`
+}
+
+// MultiplexFrame wraps a message for a session on a multiplexed connection.
+// Clients open a session by sending a frame with a new session ID, and close
+// it with a Closed frame. The server closes sessions the same way; Status is
+// set if the session was rejected.
+type MultiplexFrame struct {
+	Session string          `json:"session"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Closed  bool            `json:"closed,omitempty"`
+	Status  int             `json:"status,omitempty"`
+}
+
+// Multiplexer carries multiple client sessions over a single WebSocket, for
+// gateways and bridges that aggregate many devices. Each session is served
+// by its own worker, as if it were a separate connection; per-connection
+// limits like the ping rate and registration limit apply per session.
+type Multiplexer struct {
+	logger      *SimpleLogger
+	metrics     Statistician
+	server      SocketServer
+	socket      Socket
+	req         *http.Request
+	maxSessions int
+	queueSize   int
+	writeMux    sync.Mutex
+	sessionsMux sync.Mutex
+	sessions    map[string]*muxSocket
+	closed      bool
+	wg          sync.WaitGroup
+}
+
+// NewMultiplexer creates a multiplexer that serves sessions on socket with
+// server.
+func NewMultiplexer(app *Application, conf MultiplexConfig,
+	server SocketServer, socket Socket, req *http.Request) *Multiplexer {
+
+	return &Multiplexer{
+		logger:      app.Logger(),
+		metrics:     app.Metrics(),
+		server:      server,
+		socket:      socket,
+		req:         req,
+		maxSessions: conf.MaxSessions,
+		queueSize:   conf.QueueSize,
+		sessions:    make(map[string]*muxSocket),
+	}
+}
+
+// Run reads and dispatches frames until the connection is closed or a frame
+// is malformed, then closes all sessions and waits for their workers to exit.
+func (m *Multiplexer) Run() {
+	for {
+		raw, err := m.socket.ReadBinary()
+		if err != nil {
+			break
+		}
+		frame := new(MultiplexFrame)
+		if err = json.Unmarshal(raw, frame); err != nil ||
+			len(frame.Session) == 0 || len(frame.Session) > maxSessionIDLen {
+
+			if m.logger.ShouldLog(WARNING) {
+				m.logger.Warn("multiplex", "Invalid multiplexed frame",
+					LogFields{"rid": m.req.Header.Get(HeaderID), "error": ErrStr(err)})
+			}
+			m.metrics.Increment("client.mux.invalid")
+			break
+		}
+		if frame.Closed {
+			if s := m.session(frame.Session); s != nil {
+				s.Close()
+			}
+			continue
+		}
+		s := m.open(frame.Session)
+		if s == nil {
+			m.metrics.Increment("client.mux.rejected")
+			m.writeFrame(&MultiplexFrame{Session: frame.Session, Closed: true,
+				Status: 429})
+			continue
+		}
+		if !s.deliver(frame.Message) {
+			if m.logger.ShouldLog(NOTICE) {
+				m.logger.Notice("multiplex", "Closing slow multiplexed session",
+					LogFields{"rid": m.req.Header.Get(HeaderID), "session": frame.Session})
+			}
+			m.metrics.Increment("client.mux.overflow")
+			s.Close()
+		}
+	}
+	m.sessionsMux.Lock()
+	m.closed = true
+	sessions := make([]*muxSocket, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.sessionsMux.Unlock()
+	for _, s := range sessions {
+		s.Close()
+	}
+	m.wg.Wait()
+}
+
+// Sessions returns the number of open sessions.
+func (m *Multiplexer) Sessions() int {
+	m.sessionsMux.Lock()
+	defer m.sessionsMux.Unlock()
+	return len(m.sessions)
+}
+
+func (m *Multiplexer) session(id string) *muxSocket {
+	m.sessionsMux.Lock()
+	defer m.sessionsMux.Unlock()
+	return m.sessions[id]
+}
+
+// open returns the session for id, starting a worker for new sessions.
+// Returns nil if the session limit has been reached.
+func (m *Multiplexer) open(id string) *muxSocket {
+	m.sessionsMux.Lock()
+	defer m.sessionsMux.Unlock()
+	if s, ok := m.sessions[id]; ok {
+		return s
+	}
+	if m.closed || len(m.sessions) >= m.maxSessions {
+		return nil
+	}
+	s := &muxSocket{
+		mux:       m,
+		id:        id,
+		inbox:     make(chan []byte, m.queueSize),
+		closeChan: make(chan bool),
+	}
+	m.sessions[id] = s
+	m.metrics.Increment("client.mux.session")
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.server.ServeSocket(s, m.req)
+		s.Close()
+	}()
+	return s
+}
+
+// remove removes a closed session. Returns false if the connection is
+// closed.
+func (m *Multiplexer) remove(id string) (ok bool) {
+	m.sessionsMux.Lock()
+	delete(m.sessions, id)
+	ok = !m.closed
+	m.sessionsMux.Unlock()
+	return ok
+}
+
+// writeFrame writes a frame to the connection. Writes are serialized, and
+// use the write deadline of the sending session.
+func (m *Multiplexer) writeFrame(frame *MultiplexFrame) error {
+	return m.writeFrameBy(frame, time.Time{})
+}
+
+func (m *Multiplexer) writeFrameBy(frame *MultiplexFrame,
+	deadline time.Time) error {
+
+	m.writeMux.Lock()
+	defer m.writeMux.Unlock()
+	m.socket.SetWriteDeadline(deadline)
+	return m.socket.WriteJSON(frame)
+}
+
+// muxTimeoutError is returned by session reads that exceed the read
+// deadline. It implements net.Error, like socket timeouts.
+type muxTimeoutError struct{}
+
+func (muxTimeoutError) Error() string   { return "multiplexed session read timeout" }
+func (muxTimeoutError) Timeout() bool   { return true }
+func (muxTimeoutError) Temporary() bool { return true }
+
+// muxSocket is a session on a multiplexed connection. It implements Socket,
+// so that each session can be served by a worker.
+type muxSocket struct {
+	mux         *Multiplexer
+	id          string
+	inbox       chan []byte
+	closeChan   chan bool
+	closeOnce   Once
+	deadlineMux sync.Mutex
+	readBy      time.Time
+	writeBy     time.Time
+}
+
+// deliver queues a message for the session. Returns false if the queue is
+// full.
+func (s *muxSocket) deliver(message []byte) bool {
+	select {
+	case <-s.closeChan:
+		return true
+	default:
+	}
+	select {
+	case s.inbox <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *muxSocket) Origin() string {
+	return s.mux.socket.Origin()
+}
+
+func (s *muxSocket) SetReadDeadline(t time.Time) error {
+	s.deadlineMux.Lock()
+	s.readBy = t
+	s.deadlineMux.Unlock()
+	return nil
+}
+
+func (s *muxSocket) SetWriteDeadline(t time.Time) error {
+	s.deadlineMux.Lock()
+	s.writeBy = t
+	s.deadlineMux.Unlock()
+	return nil
+}
+
+func (s *muxSocket) ReadJSON(v interface{}) error {
+	data, err := s.ReadBinary()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *muxSocket) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.WriteBinary(data)
+}
+
+func (s *muxSocket) ReadBinary() (data []byte, err error) {
+	s.deadlineMux.Lock()
+	readBy := s.readBy
+	s.deadlineMux.Unlock()
+	var timeout <-chan time.Time
+	if !readBy.IsZero() {
+		timer := clock.NewTimer(readBy.Sub(timeNow()))
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+	select {
+	case data = <-s.inbox:
+		return data, nil
+	case <-s.closeChan:
+		return nil, io.EOF
+	case <-timeout:
+		return nil, muxTimeoutError{}
+	}
+}
+
+func (s *muxSocket) WriteBinary(data []byte) error {
+	select {
+	case <-s.closeChan:
+		return io.EOF
+	default:
+	}
+	s.deadlineMux.Lock()
+	writeBy := s.writeBy
+	s.deadlineMux.Unlock()
+	return s.mux.writeFrameBy(&MultiplexFrame{Session: s.id, Message: data},
+		writeBy)
+}
+
+func (s *muxSocket) ReadText() (string, error) {
+	data, err := s.ReadBinary()
+	return string(data), err
+}
+
+func (s *muxSocket) WriteText(data string) error {
+	return s.WriteBinary([]byte(data))
+}
+
+// Close closes the session, and notifies the client if the connection is
+// still open.
+func (s *muxSocket) Close() error {
+	return s.closeOnce.Do(s.close)
+}
+
+func (s *muxSocket) close() error {
+	close(s.closeChan)
+	if !s.mux.remove(s.id) {
+		return nil
+	}
+	return s.mux.writeFrame(&MultiplexFrame{Session: s.id, Closed: true})
+}
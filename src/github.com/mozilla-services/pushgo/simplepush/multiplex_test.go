@@ -0,0 +1,137 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMultiplexer(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Multiplexed connections", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+
+		mckSocket := NewMockSocket(mockCtrl)
+		mckServer := NewMockSocketServer(mockCtrl)
+		req := &http.Request{Header: http.Header{}}
+		conf := MultiplexConfig{Enabled: true, MaxSessions: 1, QueueSize: 2}
+		m := NewMultiplexer(app, conf, mckServer, mckSocket, req)
+
+		// drain reads from a session until it is closed.
+		drain := func(s Socket, _ *http.Request) {
+			for {
+				if _, err := s.ReadBinary(); err != nil {
+					return
+				}
+			}
+		}
+
+		Convey("Should route frames to sessions", func() {
+			var (
+				data     string
+				readErr  error
+				writeErr error
+			)
+			replied := make(chan bool)
+			mckStat.EXPECT().Increment("client.mux.session")
+			mckServer.EXPECT().ServeSocket(gomock.Any(), req).Do(
+				func(s Socket, req *http.Request) {
+					data, readErr = s.ReadText()
+					writeErr = s.WriteText(`{"status":200}`)
+					close(replied)
+					drain(s, req)
+				})
+			mckSocket.EXPECT().SetWriteDeadline(time.Time{})
+			mckSocket.EXPECT().WriteJSON(&MultiplexFrame{
+				Session: "a",
+				Message: json.RawMessage(`{"status":200}`),
+			})
+			gomock.InOrder(
+				mckSocket.EXPECT().ReadBinary().Return(
+					[]byte(`{"session":"a","message":{"messageType":"hello"}}`), nil),
+				mckSocket.EXPECT().ReadBinary().Do(func() {
+					<-replied
+				}).Return(nil, io.EOF),
+			)
+			m.Run()
+			So(readErr, ShouldBeNil)
+			So(data, ShouldEqual, `{"messageType":"hello"}`)
+			So(writeErr, ShouldBeNil)
+			So(m.Sessions(), ShouldEqual, 0)
+		})
+
+		Convey("Should reject sessions beyond the limit", func() {
+			mckStat.EXPECT().Increment("client.mux.session")
+			mckStat.EXPECT().Increment("client.mux.rejected")
+			mckServer.EXPECT().ServeSocket(gomock.Any(), req).Do(drain)
+			gomock.InOrder(
+				mckSocket.EXPECT().ReadBinary().Return(
+					[]byte(`{"session":"a","message":{}}`), nil),
+				mckSocket.EXPECT().ReadBinary().Return(
+					[]byte(`{"session":"b","message":{}}`), nil),
+				mckSocket.EXPECT().SetWriteDeadline(time.Time{}),
+				mckSocket.EXPECT().WriteJSON(&MultiplexFrame{
+					Session: "b", Closed: true, Status: 429}),
+				mckSocket.EXPECT().ReadBinary().Return(nil, io.EOF),
+			)
+			m.Run()
+		})
+
+		Convey("Should close sessions on request", func() {
+			mckStat.EXPECT().Increment("client.mux.session")
+			mckServer.EXPECT().ServeSocket(gomock.Any(), req).Do(drain)
+			gomock.InOrder(
+				mckSocket.EXPECT().ReadBinary().Return(
+					[]byte(`{"session":"a","message":{}}`), nil),
+				mckSocket.EXPECT().ReadBinary().Return(
+					[]byte(`{"session":"a","closed":true}`), nil),
+				mckSocket.EXPECT().SetWriteDeadline(time.Time{}),
+				mckSocket.EXPECT().WriteJSON(&MultiplexFrame{
+					Session: "a", Closed: true}),
+				mckSocket.EXPECT().ReadBinary().Return(nil, io.EOF),
+			)
+			m.Run()
+			So(m.Sessions(), ShouldEqual, 0)
+		})
+
+		Convey("Should close the connection on invalid frames", func() {
+			mckStat.EXPECT().Increment("client.mux.invalid")
+			mckSocket.EXPECT().ReadBinary().Return([]byte(`{"message":{}}`), nil)
+			m.Run()
+		})
+
+		Convey("Should time out session reads", func() {
+			s := &muxSocket{
+				mux:       m,
+				id:        "a",
+				inbox:     make(chan []byte, 1),
+				closeChan: make(chan bool),
+			}
+			So(s.SetReadDeadline(timeNow()), ShouldBeNil)
+			_, err := s.ReadBinary()
+			ne, ok := err.(net.Error)
+			So(ok, ShouldBeTrue)
+			So(ne.Timeout(), ShouldBeTrue)
+		})
+	})
+}
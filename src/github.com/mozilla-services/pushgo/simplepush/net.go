@@ -149,10 +149,20 @@ func NewServeCloser(srv *http.Server) (s *ServeCloser) {
 // the underlying listeners before closing the server.
 type ServeCloser struct {
 	*http.Server
-	stateHook func(net.Conn, http.ConnState)
-	connsLock sync.Mutex // Protects conns.
-	conns     map[net.Conn]bool
-	closeOnce Once
+	stateHook   func(net.Conn, http.ConnState)
+	connsLock   sync.Mutex // Protects conns and idleTimers.
+	conns       map[net.Conn]bool
+	idleTimeout time.Duration
+	idleTimers  map[net.Conn]Timer
+	closeOnce   Once
+}
+
+// SetIdleTimeout closes connections that do not start a request within d of
+// connecting, or of completing the previous request. Disabled if d is 0.
+// Must be called before the server accepts connections.
+func (s *ServeCloser) SetIdleTimeout(d time.Duration) {
+	s.idleTimeout = d
+	s.idleTimers = make(map[net.Conn]Timer)
 }
 
 // Close stops the server. The returned error is always nil; it is included
@@ -199,6 +209,22 @@ func (s *ServeCloser) removeConn(c net.Conn) {
 	delete(s.conns, c)
 }
 
+// setIdle starts or stops the idle timer for c.
+func (s *ServeCloser) setIdle(c net.Conn, idle bool) {
+	if s.idleTimeout <= 0 {
+		return
+	}
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	if timer, ok := s.idleTimers[c]; ok {
+		timer.Stop()
+		delete(s.idleTimers, c)
+	}
+	if idle {
+		s.idleTimers[c] = clock.AfterFunc(s.idleTimeout, func() { c.Close() })
+	}
+}
+
 func (s *ServeCloser) connState(c net.Conn, state http.ConnState) {
 	if state == http.StateNew {
 		// Track new connections.
@@ -208,6 +234,7 @@ func (s *ServeCloser) connState(c net.Conn, state http.ConnState) {
 		// Callers must track hijacked connections separately.
 		s.removeConn(c)
 	}
+	s.setIdle(c, state == http.StateNew || state == http.StateIdle)
 	if s.stateHook != nil {
 		s.stateHook(c, state)
 	}
@@ -224,10 +251,13 @@ type keepAliver interface {
 // Based on tcpKeepAliveListener from package net/http, copyright 2009,
 // The Go Authors.
 type LimitListener struct {
+	accepted int64 // Accessed atomically; must be 64-bit aligned.
+	rejected int64 // Accessed atomically; must be 64-bit aligned.
 	net.Listener
 	MaxConns        int
 	KeepAlivePeriod time.Duration
 	conns           int32
+	maxConns        int32 // Set by SetMaxConns; accessed atomically.
 	closeOnce       Once
 }
 
@@ -237,6 +267,30 @@ func (l *LimitListener) removeConn() { atomic.AddInt32(&l.conns, -1) }
 // ConnCount returns the number of active connections.
 func (l *LimitListener) ConnCount() int { return int(atomic.LoadInt32(&l.conns)) }
 
+// SetMaxConns changes the connection limit. Connections above the new limit
+// are not closed.
+func (l *LimitListener) SetMaxConns(maxConns int) {
+	atomic.StoreInt32(&l.maxConns, int32(maxConns))
+}
+
+// limit returns the connection limit set by SetMaxConns, or MaxConns if the
+// limit has not changed.
+func (l *LimitListener) limit() int {
+	if maxConns := atomic.LoadInt32(&l.maxConns); maxConns > 0 {
+		return int(maxConns)
+	}
+	return l.MaxConns
+}
+
+// Accepted returns the number of connections accepted since the listener was
+// created.
+func (l *LimitListener) Accepted() int64 { return atomic.LoadInt64(&l.accepted) }
+
+// Rejected returns the number of times Accept failed because the listener
+// was at capacity. The server retries after a delay, so pending connections
+// wait in the kernel backlog; a rising count indicates saturation.
+func (l *LimitListener) Rejected() int64 { return atomic.LoadInt64(&l.rejected) }
+
 // setKeepAlive enables TCP keep-alive on c. If the keep-alive period is not
 // set or c is not a TCP connection, setKeepAlive is a no-op.
 func (l *LimitListener) setKeepAlive(c net.Conn) {
@@ -258,7 +312,8 @@ func (l *LimitListener) Accept() (conn net.Conn, err error) {
 		// closed.
 		return nil, errClosed
 	}
-	if l.ConnCount() >= l.MaxConns {
+	if l.ConnCount() >= l.limit() {
+		atomic.AddInt64(&l.rejected, 1)
 		return nil, errTooBusy
 	}
 	socket, err := l.Listener.Accept()
@@ -267,6 +322,7 @@ func (l *LimitListener) Accept() (conn net.Conn, err error) {
 	}
 	l.setKeepAlive(socket)
 	l.addConn()
+	atomic.AddInt64(&l.accepted, 1)
 	return &limitConn{Conn: socket, removeConn: l.removeConn}, nil
 }
 
@@ -275,6 +331,23 @@ func (l *LimitListener) Close() error {
 	return l.closeOnce.Do(l.Listener.Close)
 }
 
+// setListenerMaxConns changes the connection limit of ln, unwrapping TLS
+// listeners. Returns false if ln does not limit connections.
+func setListenerMaxConns(ln net.Listener, maxConns int) bool {
+	for ln != nil {
+		if limiter, ok := ln.(*LimitListener); ok {
+			limiter.SetMaxConns(maxConns)
+			return true
+		}
+		reloader, ok := ln.(*reloadListener)
+		if !ok {
+			break
+		}
+		ln = reloader.Listener
+	}
+	return false
+}
+
 // Listen returns an active HTTP listener. This is identical to ListenAndServe
 // from package net/http, but listens on a random port if addr is omitted, and
 // does not call http.Server.Serve. Copyright 2009, The Go Authors.
@@ -289,25 +362,23 @@ func Listen(addr string, maxConns int, keepAlivePeriod time.Duration) (
 		KeepAlivePeriod: keepAlivePeriod}, nil
 }
 
-// ListenTLS returns an active HTTPS listener. Based on ListenAndServeTLS from
-// package net/http, copyright 2009, The Go Authors.
-func ListenTLS(addr, certFile, keyFile string, maxConns int,
+// ListenTLS returns an active HTTPS listener that serves the certificate
+// loaded by certs. The listener closes certs when it is closed. Based on
+// ListenAndServeTLS from package net/http, copyright 2009, The Go Authors.
+func ListenTLS(addr string, certs *CertReloader, maxConns int,
 	keepAlivePeriod time.Duration) (net.Listener, error) {
 
 	ln, err := Listen(addr, maxConns, keepAlivePeriod)
 	if err != nil {
 		return nil, err
 	}
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return nil, err
-	}
-	return newTLSListener(ln, cert), nil
+	return &reloadListener{Listener: ln, certs: certs}, nil
 }
 
-// newTLSListener returns a TLS listener with required Mozilla settings.
-func newTLSListener(ln net.Listener, cert tls.Certificate) net.Listener {
-	config := &tls.Config{
+// newTLSServerConfig returns a TLS server configuration with required Mozilla
+// settings.
+func newTLSServerConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
 		NextProtos:   []string{"http/1.1"},
 		Certificates: []tls.Certificate{cert},
 		// The following are Mozilla required TLS settings.
@@ -325,5 +396,4 @@ func newTLSListener(ln net.Listener, cert tls.Certificate) net.Listener {
 			tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
 			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA},
 	}
-	return tls.NewListener(ln, config)
 }
@@ -77,6 +77,11 @@ func newTLSConfig() (conf *tls.Config, err error) {
 	return conf, nil
 }
 
+// newTLSListener returns a TLS listener with required Mozilla settings.
+func newTLSListener(ln net.Listener, cert tls.Certificate) net.Listener {
+	return tls.NewListener(ln, newTLSServerConfig(cert))
+}
+
 // closeAfter is like time.After, but returns a Boolean channel that is
 // closed after duration d. This allows multiple select statements to
 // receive from the same timer channel.
@@ -243,6 +248,10 @@ func TestNetLimitListenerClose(t *testing.T) {
 		bc.Close()
 		t.Fatalf("Expected %#v rejecting connection to busy listener", errTooBusy)
 	}
+	if accepted, rejected := l.Accepted(), l.Rejected(); accepted != 1 || rejected != 1 {
+		t.Errorf("Wrong connection totals: got (%d, %d); want (1, 1)",
+			accepted, rejected)
+	}
 	l.Close()
 	cc, err := l.Accept()
 	if err != nil {
@@ -316,6 +325,51 @@ func TestNetServeCloserClose(t *testing.T) {
 	wg.Wait()
 }
 
+// closeRecorder wraps a net.Conn, recording whether it was closed.
+type closeRecorder struct {
+	net.Conn
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestNetServeCloserIdleTimeout(t *testing.T) {
+	defer saveTimeFuncs()()
+	c := newMockClock(time.Unix(1257894000, 0).UTC())
+	useMockClock(c)
+
+	srv := NewServeCloser(&http.Server{})
+	srv.SetIdleTimeout(1 * time.Minute)
+	conn := new(closeRecorder)
+
+	srv.connState(conn, http.StateNew)
+	c.Advance(59 * time.Second)
+	srv.connState(conn, http.StateActive)
+	c.Advance(5 * time.Minute)
+	if conn.closed {
+		t.Fatalf("Closed active connection")
+	}
+	srv.connState(conn, http.StateIdle)
+	c.Advance(1 * time.Minute)
+	if !conn.closed {
+		t.Errorf("Idle connection not closed after timeout")
+	}
+	srv.connState(conn, http.StateClosed)
+	if len(srv.idleTimers) > 0 {
+		t.Errorf("Idle timer not removed for closed connection")
+	}
+
+	conn = new(closeRecorder)
+	srv.connState(conn, http.StateNew)
+	c.Advance(1 * time.Minute)
+	if !conn.closed {
+		t.Errorf("New connection without a request not closed after timeout")
+	}
+}
+
 func TestNetServeCloserNotify(t *testing.T) {
 	pipe := newPipeListener()
 	l := &LimitListener{Listener: pipe, MaxConns: 1}
@@ -681,6 +735,30 @@ func TestNetLimitListener(t *testing.T) {
 	}
 }
 
+func TestNetLimitListenerSetMaxConns(t *testing.T) {
+	accept := func() (net.Conn, error) { return stubConn(0), nil }
+	limiter := &LimitListener{Listener: &mockListener{accept: accept}, MaxConns: 1}
+	ln := &reloadListener{Listener: limiter}
+	if _, err := limiter.Accept(); err != nil {
+		t.Fatalf("Error accepting connection: %s", err)
+	}
+	if _, err := limiter.Accept(); err != errTooBusy {
+		t.Errorf("Wrong error before raising limit: got %v; want %s", err, errTooBusy)
+	}
+	if !setListenerMaxConns(ln, 2) {
+		t.Fatalf("Failed to set limit for wrapped listener")
+	}
+	if _, err := limiter.Accept(); err != nil {
+		t.Errorf("Error accepting connection after raising limit: %s", err)
+	}
+	if _, err := limiter.Accept(); err != errTooBusy {
+		t.Errorf("Wrong error after raising limit: got %v; want %s", err, errTooBusy)
+	}
+	if setListenerMaxConns(&mockListener{accept: accept}, 2) {
+		t.Errorf("Set limit for listener without a limit")
+	}
+}
+
 func TestNetBadTLSCipher(t *testing.T) {
 	tlsConf, err := newTLSConfig()
 	if err != nil {
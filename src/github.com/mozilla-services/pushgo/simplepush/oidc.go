@@ -0,0 +1,469 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoOIDCIssuer      = errors.New("OIDC requires an issuer")
+	ErrNoOIDCAudience    = errors.New("OIDC requires an audience")
+	ErrMalformedToken    = errors.New("Malformed bearer token")
+	ErrUnsupportedAlg    = errors.New("Unsupported token signing algorithm")
+	ErrUnknownSigningKey = errors.New("Unknown token signing key")
+	ErrInvalidSignature  = errors.New("Invalid token signature")
+	ErrWrongIssuer       = errors.New("Token issued by an untrusted issuer")
+	ErrWrongAudience     = errors.New("Token not issued for this audience")
+	ErrTokenExpired      = errors.New("Token expired")
+	ErrTokenNotYetValid  = errors.New("Token not yet valid")
+	ErrMissingScope      = errors.New("Token missing a required scope")
+)
+
+// oidcMinRefresh is the minimum interval between key fetches triggered by
+// tokens signed with unknown keys, so that forged tokens can't be used to
+// flood the identity provider.
+const oidcMinRefresh = 30 * time.Second
+
+type OIDCConfig struct {
+	Enabled bool
+
+	// Issuer is the identity provider URL, matched against the "iss" claim.
+	// Signing keys are discovered from the provider configuration at
+	// "{issuer}/.well-known/openid-configuration" unless JWKSURL is set.
+	Issuer string
+
+	// Audience is the client ID that tokens must be issued for.
+	Audience string
+
+	// Scopes lists the scopes that tokens must grant. No default value;
+	// tokens need not grant any scopes if unspecified.
+	Scopes []string
+
+	// JWKSURL overrides the discovered signing key set URL.
+	JWKSURL string `toml:"jwks_url" env:"jwks_url"`
+
+	// RefreshInterval is the maximum amount of time to cache signing keys.
+	// Defaults to "1h".
+	RefreshInterval string `toml:"refresh_interval" env:"refresh_interval"`
+
+	// Leeway is the allowed clock skew for token expiration and activation
+	// times. Defaults to "1m".
+	Leeway string
+
+	// Timeout is the timeout for identity provider requests. Defaults to
+	// "5s".
+	Timeout string
+}
+
+// OIDCClaims are the verified claims of an OIDC bearer token.
+type OIDCClaims struct {
+	Issuer    string
+	Subject   string
+	Email     string
+	Scopes    []string
+	ExpiresAt time.Time
+}
+
+// Has indicates whether the token grants the scope.
+func (c *OIDCClaims) Has(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcHeader is a JSON Web Token header.
+type oidcHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// oidcPayload is a JSON Web Token claim set. The audience may be a string or
+// an array; the scopes may be a space-delimited "scope" string, or an "scp"
+// string or array.
+type oidcPayload struct {
+	Iss   string          `json:"iss"`
+	Sub   string          `json:"sub"`
+	Email string          `json:"email"`
+	Aud   json.RawMessage `json:"aud"`
+	Exp   int64           `json:"exp"`
+	Nbf   int64           `json:"nbf"`
+	Scope string          `json:"scope"`
+	Scp   json.RawMessage `json:"scp"`
+}
+
+// oidcJWK is a JSON Web Key. Only RSA and P-256 signing keys are supported.
+type oidcJWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// OIDCVerifier verifies OIDC bearer tokens signed by a trusted identity
+// provider, caching the provider's signing keys. Tokens must be signed with
+// RS256 or ES256.
+type OIDCVerifier struct {
+	logger    *SimpleLogger
+	metrics   Statistician
+	issuer    string
+	audience  string
+	scopes    []string
+	jwksURL   string
+	refresh   time.Duration
+	leeway    time.Duration
+	client    *http.Client
+	keysMux   sync.Mutex
+	keys      map[string]crypto.PublicKey // By key ID.
+	fetchedAt time.Time
+}
+
+// NewOIDCVerifier creates a token verifier from conf.
+func NewOIDCVerifier(app *Application, conf OIDCConfig) (
+	v *OIDCVerifier, err error) {
+
+	if len(conf.Issuer) == 0 {
+		return nil, ErrNoOIDCIssuer
+	}
+	if len(conf.Audience) == 0 {
+		return nil, ErrNoOIDCAudience
+	}
+	v = &OIDCVerifier{
+		logger:   app.Logger(),
+		metrics:  app.Metrics(),
+		issuer:   conf.Issuer,
+		audience: conf.Audience,
+		scopes:   conf.Scopes,
+		jwksURL:  conf.JWKSURL,
+	}
+	if v.refresh, err = time.ParseDuration(conf.RefreshInterval); err != nil {
+		return nil, err
+	}
+	if v.leeway, err = time.ParseDuration(conf.Leeway); err != nil {
+		return nil, err
+	}
+	timeout, err := time.ParseDuration(conf.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	v.client = &http.Client{Timeout: timeout}
+	return v, nil
+}
+
+// Verify checks the token's signature, issuer, audience, validity period,
+// and scopes, and returns its claims.
+func (v *OIDCVerifier) Verify(token string) (claims *OIDCClaims, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+	var header oidcHeader
+	if err = decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrMalformedToken
+	}
+	sig, err := decodeBase64URL(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifySignature(header.Alg, key,
+		[]byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	var payload oidcPayload
+	if err = decodeSegment(parts[1], &payload); err != nil {
+		return nil, ErrMalformedToken
+	}
+	return v.check(&payload)
+}
+
+// check validates the claims of a token with a valid signature.
+func (v *OIDCVerifier) check(payload *oidcPayload) (*OIDCClaims, error) {
+	if payload.Iss != v.issuer {
+		return nil, ErrWrongIssuer
+	}
+	audience, err := stringOrArray(payload.Aud)
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	if !containsString(audience, v.audience) {
+		return nil, ErrWrongAudience
+	}
+	now := timeNow()
+	if payload.Exp == 0 || now.Sub(time.Unix(payload.Exp, 0)) > v.leeway {
+		return nil, ErrTokenExpired
+	}
+	if payload.Nbf > 0 && time.Unix(payload.Nbf, 0).Sub(now) > v.leeway {
+		return nil, ErrTokenNotYetValid
+	}
+	claims := &OIDCClaims{
+		Issuer:    payload.Iss,
+		Subject:   payload.Sub,
+		Email:     payload.Email,
+		ExpiresAt: time.Unix(payload.Exp, 0),
+	}
+	if len(payload.Scope) > 0 {
+		claims.Scopes = strings.Fields(payload.Scope)
+	} else if claims.Scopes, err = stringOrArray(payload.Scp); err != nil {
+		return nil, ErrMalformedToken
+	}
+	for _, scope := range v.scopes {
+		if !claims.Has(scope) {
+			return nil, ErrMissingScope
+		}
+	}
+	return claims, nil
+}
+
+// key returns the signing key with the given ID, fetching the provider's key
+// set if the cached keys are stale or don't include the key. If the token
+// doesn't specify a key ID, the provider must publish exactly one key.
+func (v *OIDCVerifier) key(kid string) (key crypto.PublicKey, err error) {
+	v.keysMux.Lock()
+	defer v.keysMux.Unlock()
+	age := timeNow().Sub(v.fetchedAt)
+	fetched := false
+	if v.fetchedAt.IsZero() || age >= v.refresh {
+		v.fetchKeys()
+		fetched = true
+	}
+	if key, err = v.findKey(kid); err == nil || fetched || age < oidcMinRefresh {
+		return
+	}
+	// The provider may have rotated its keys since the last fetch.
+	if v.fetchKeys() {
+		key, err = v.findKey(kid)
+	}
+	return
+}
+
+func (v *OIDCVerifier) findKey(kid string) (crypto.PublicKey, error) {
+	if len(kid) == 0 && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, nil
+		}
+	}
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownSigningKey
+}
+
+// fetchKeys replaces the cached signing keys with the provider's current key
+// set. The cached keys are kept if the fetch fails. The caller must hold
+// keysMux.
+func (v *OIDCVerifier) fetchKeys() bool {
+	v.fetchedAt = timeNow()
+	keys, err := v.loadKeys()
+	if err != nil {
+		if v.logger.ShouldLog(ERROR) {
+			v.logger.Error("oidc", "Could not fetch OIDC signing keys",
+				LogFields{"issuer": v.issuer, "error": err.Error()})
+		}
+		v.metrics.Increment("admin.oidc.keys.error")
+		return false
+	}
+	v.keys = keys
+	v.metrics.Increment("admin.oidc.keys.fetched")
+	return true
+}
+
+func (v *OIDCVerifier) loadKeys() (keys map[string]crypto.PublicKey, err error) {
+	jwksURL := v.jwksURL
+	if len(jwksURL) == 0 {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		configURL := strings.TrimRight(v.issuer, "/") +
+			"/.well-known/openid-configuration"
+		if err = v.getJSON(configURL, &discovery); err != nil {
+			return nil, err
+		}
+		if len(discovery.JWKSURI) == 0 {
+			return nil, fmt.Errorf("Missing jwks_uri in provider configuration")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+	var jwks struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+	if err = v.getJSON(jwksURL, &jwks); err != nil {
+		return nil, err
+	}
+	keys = make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if len(jwk.Use) > 0 && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			// Skip keys with unsupported types or curves.
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (v *OIDCVerifier) getJSON(url string, dst interface{}) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return fmt.Errorf("Unexpected status code: %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+// PublicKey decodes the key parameters.
+func (jwk *oidcJWK) PublicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if e.BitLen() > 31 {
+			return nil, fmt.Errorf("Invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("Unsupported curve: %s", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		curve := elliptic.P256()
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("Invalid P-256 point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type: %s", jwk.Kty)
+}
+
+// verifySignature checks a JWS signature. The algorithm must match the key
+// type, so that tokens can't select a weaker algorithm.
+func verifySignature(alg string, key crypto.PublicKey, input, sig []byte) error {
+	digest := sha256.Sum256(input)
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrUnsupportedAlg
+		}
+		if rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], sig) != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrUnsupportedAlg
+		}
+		if len(sig) != 64 {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	return ErrUnsupportedAlg
+}
+
+// decodeBase64URL decodes an unpadded base64url string.
+func decodeBase64URL(s string) ([]byte, error) {
+	if pad := len(s) % 4; pad > 0 {
+		s += strings.Repeat("=", 4-pad)
+	}
+	return base64.URLEncoding.DecodeString(s)
+}
+
+func decodeSegment(s string, dst interface{}) error {
+	b, err := decodeBase64URL(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := decodeBase64URL(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("Empty key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// stringOrArray decodes a JSON string or array of strings.
+func stringOrArray(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return []string{s}, nil
+	}
+	var a []string
+	if err := json.Unmarshal(raw, &a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func encodeBase64URL(b []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(b), "=")
+}
+
+func encodeSegment(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return encodeBase64URL(b)
+}
+
+// signTestToken returns a JWT with the given claims, signed with key.
+func signTestToken(alg, kid string, key interface{},
+	claims map[string]interface{}) string {
+
+	input := encodeSegment(map[string]string{"alg": alg, "kid": kid}) + "." +
+		encodeSegment(claims)
+	digest := sha256.Sum256([]byte(input))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, k, digest[:])
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):32], rb)
+		copy(sig[64-len(sb):], sb)
+	}
+	return input + "." + encodeBase64URL(sig)
+}
+
+func TestOIDCVerifier(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	defer saveTimeFuncs()()
+	now := time.Unix(1257894000, 0).UTC()
+	timeNow = func() time.Time { return now }
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Error generating RSA key: %s", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating ECDSA key: %s", err)
+	}
+	jwks := []map[string]string{{
+		"kid": "rsa1",
+		"kty": "RSA",
+		"use": "sig",
+		"n":   encodeBase64URL(rsaKey.N.Bytes()),
+		"e":   encodeBase64URL(big.NewInt(int64(rsaKey.E)).Bytes()),
+	}, {
+		"kid": "ec1",
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   encodeBase64URL(ecKey.X.Bytes()),
+		"y":   encodeBase64URL(ecKey.Y.Bytes()),
+	}}
+
+	var fetches int
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(
+		func(resp http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/.well-known/openid-configuration":
+				json.NewEncoder(resp).Encode(map[string]string{
+					"issuer":   srv.URL,
+					"jwks_uri": srv.URL + "/keys",
+				})
+			case "/keys":
+				fetches++
+				json.NewEncoder(resp).Encode(map[string]interface{}{"keys": jwks})
+			default:
+				http.NotFound(resp, req)
+			}
+		}))
+	defer srv.Close()
+
+	Convey("OIDC token verification", t, func() {
+		fetches = 0
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+
+		v, err := NewOIDCVerifier(app, OIDCConfig{
+			Issuer:          srv.URL,
+			Audience:        "pushgo-admin",
+			Scopes:          []string{"push:admin"},
+			RefreshInterval: "1h",
+			Leeway:          "1m",
+			Timeout:         "5s",
+		})
+		So(err, ShouldBeNil)
+
+		claims := func() map[string]interface{} {
+			return map[string]interface{}{
+				"iss":   srv.URL,
+				"sub":   "1234",
+				"email": "ops@example.com",
+				"aud":   []string{"pushgo-admin", "other"},
+				"exp":   now.Add(5 * time.Minute).Unix(),
+				"scope": "openid push:admin",
+			}
+		}
+
+		Convey("Should accept RS256 and ES256 tokens", func() {
+			mckStat.EXPECT().Increment("admin.oidc.keys.fetched")
+
+			c, err := v.Verify(signTestToken("RS256", "rsa1", rsaKey, claims()))
+			So(err, ShouldBeNil)
+			So(c.Subject, ShouldEqual, "1234")
+			So(c.Email, ShouldEqual, "ops@example.com")
+			So(c.Scopes, ShouldResemble, []string{"openid", "push:admin"})
+
+			_, err = v.Verify(signTestToken("ES256", "ec1", ecKey, claims()))
+			So(err, ShouldBeNil)
+			So(fetches, ShouldEqual, 1)
+		})
+
+		Convey("Should reject invalid tokens", func() {
+			mckStat.EXPECT().Increment("admin.oidc.keys.fetched")
+
+			_, err := v.Verify("a.b")
+			So(err, ShouldEqual, ErrMalformedToken)
+
+			token := signTestToken("RS256", "rsa1", rsaKey, claims())
+			_, err = v.Verify(token[:len(token)-4] + "AAAA")
+			So(err, ShouldEqual, ErrInvalidSignature)
+
+			_, err = v.Verify(signTestToken("ES256", "rsa1", ecKey, claims()))
+			So(err, ShouldEqual, ErrUnsupportedAlg)
+
+			c := claims()
+			c["iss"] = "https://evil.example.com"
+			_, err = v.Verify(signTestToken("RS256", "rsa1", rsaKey, c))
+			So(err, ShouldEqual, ErrWrongIssuer)
+
+			c = claims()
+			c["aud"] = "other"
+			_, err = v.Verify(signTestToken("RS256", "rsa1", rsaKey, c))
+			So(err, ShouldEqual, ErrWrongAudience)
+
+			c = claims()
+			c["exp"] = now.Add(-2 * time.Minute).Unix()
+			_, err = v.Verify(signTestToken("RS256", "rsa1", rsaKey, c))
+			So(err, ShouldEqual, ErrTokenExpired)
+
+			c = claims()
+			c["nbf"] = now.Add(2 * time.Minute).Unix()
+			_, err = v.Verify(signTestToken("RS256", "rsa1", rsaKey, c))
+			So(err, ShouldEqual, ErrTokenNotYetValid)
+
+			c = claims()
+			c["scope"] = "openid"
+			_, err = v.Verify(signTestToken("RS256", "rsa1", rsaKey, c))
+			So(err, ShouldEqual, ErrMissingScope)
+		})
+
+		Convey("Should refetch keys for unknown key IDs", func() {
+			mckStat.EXPECT().Increment("admin.oidc.keys.fetched").Times(2)
+			other, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+			_, err := v.Verify(signTestToken("RS256", "rsa2", other, claims()))
+			So(err, ShouldEqual, ErrUnknownSigningKey)
+			So(fetches, ShouldEqual, 1)
+
+			// Rate limited until the minimum refresh interval elapses.
+			_, err = v.Verify(signTestToken("RS256", "rsa2", other, claims()))
+			So(err, ShouldEqual, ErrUnknownSigningKey)
+			So(fetches, ShouldEqual, 1)
+
+			v.fetchedAt = v.fetchedAt.Add(-oidcMinRefresh)
+			_, err = v.Verify(signTestToken("RS256", "rsa2", other, claims()))
+			So(err, ShouldEqual, ErrUnknownSigningKey)
+			So(fetches, ShouldEqual, 2)
+		})
+
+		Convey("Should authorize admin requests", func() {
+			mckStat.EXPECT().Increment("admin.oidc.keys.fetched")
+			mckStat.EXPECT().Increment("admin.oidc.accepted")
+			mckStat.EXPECT().Increment("admin.oidc.rejected")
+			mckStat.EXPECT().Increment("admin.unauthorized")
+
+			ah := NewAdminHandlers()
+			ah.Init(app, ah.ConfigStruct())
+			ah.oidc = v
+
+			newRequest := func(token string) *http.Request {
+				req := &http.Request{
+					Method: "GET",
+					Header: http.Header{},
+					URL:    &url.URL{Path: "/sandbox"},
+				}
+				req.Header.Set("Authorization", "Bearer "+token)
+				return req
+			}
+
+			subject, err := ah.authorize(newRequest(
+				signTestToken("RS256", "rsa1", rsaKey, claims())))
+			So(err, ShouldBeNil)
+			So(subject, ShouldEqual, "ops@example.com")
+
+			c := claims()
+			delete(c, "scope")
+			resp := httptest.NewRecorder()
+			ah.ServeHTTP(resp, newRequest(signTestToken("RS256", "rsa1", rsaKey, c)))
+			So(resp.Code, ShouldEqual, 401)
+		})
+	})
+}
@@ -0,0 +1,93 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"strconv"
+)
+
+// StoredPayloads stores update data alongside channel versions, so that
+// devices offline when an update is sent receive its data when they
+// reconnect. Payloads are cleared when the device acknowledges the update. A
+// nil StoredPayloads stores nothing.
+type StoredPayloads struct {
+	logger  *SimpleLogger
+	metrics Statistician
+	store   PayloadStore
+}
+
+// NewStoredPayloads returns the payload storage policy, or nil if payload
+// storage is disabled or the store cannot hold payloads.
+func NewStoredPayloads(app *Application) *StoredPayloads {
+	if !app.storePayloads {
+		return nil
+	}
+	logger := app.Logger()
+	store, ok := app.Store().(PayloadStore)
+	if !ok {
+		if logger.ShouldLog(WARNING) {
+			logger.Warn("payloads", "Storage adapter does not support payloads; "+
+				"update data will only be delivered to connected clients", nil)
+		}
+		return nil
+	}
+	return &StoredPayloads{
+		logger:  logger,
+		metrics: app.Metrics(),
+		store:   store,
+	}
+}
+
+// Put stores the data for a channel version, within deadline. Callers store
+// the data after the version, so that the data of a stale or rejected update
+// never replaces the data of a newer one; a device that reconnects in
+// between receives the update without its data. Updates without data are
+// ignored, as is data for a version older than the stored one. Other errors
+// are logged, but not returned: the device will still receive the update
+// without its data.
+func (p *StoredPayloads) Put(deadline *Deadline, uaid, chid string,
+	version int64, data string) {
+
+	if p == nil || len(data) == 0 {
+		return
+	}
+	err := deadline.Do(func() error {
+		return p.store.PutPayload(uaid, chid, version, data)
+	})
+	if err == ErrStaleVersion {
+		return
+	}
+	if err != nil {
+		if p.logger.ShouldLog(WARNING) {
+			p.logger.Warn("payloads", "Could not store update data",
+				LogFields{"uaid": uaid, "chid": chid,
+					"version": strconv.FormatInt(version, 10),
+					"size":    strconv.Itoa(len(data)), "error": err.Error()})
+		}
+		p.metrics.Increment("updates.payload.error")
+		return
+	}
+	p.metrics.Increment("updates.payload.stored")
+}
+
+// Attach fills in the data of flushed updates from stored payloads. Updates
+// that already have data are left unchanged.
+func (p *StoredPayloads) Attach(uaid string, updates []Update) {
+	if p == nil {
+		return
+	}
+	attached, err := attachPayloads(p.store, uaid, updates)
+	if err != nil {
+		if p.logger.ShouldLog(WARNING) {
+			p.logger.Warn("payloads", "Could not fetch update data",
+				LogFields{"uaid": uaid, "error": err.Error()})
+		}
+		p.metrics.Increment("updates.payload.error")
+		return
+	}
+	if attached > 0 {
+		p.metrics.IncrementBy("updates.payload.fetched", int64(attached))
+	}
+}
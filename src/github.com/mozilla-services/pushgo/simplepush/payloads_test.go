@@ -0,0 +1,83 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStoredPayloads(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	uaid := "5e1e5984569c4f00bf4bea47754a6403"
+	chid := "0d6a6d0ca1ba4be1bc8a2cea8e4ddb1a"
+
+	Convey("Stored payloads", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		store := &payloadStore{payloads: make(map[string]Update)}
+		app.SetStore(store)
+		app.storePayloads = true
+
+		payloads := NewStoredPayloads(app)
+		So(payloads, ShouldNotBeNil)
+
+		Convey("Should store data and attach it on flush", func() {
+			mckStat.EXPECT().Increment("updates.payload.stored")
+			payloads.Put(nil, uaid, chid, 2, "hello")
+
+			mckStat.EXPECT().IncrementBy("updates.payload.fetched", int64(1))
+			updates := []Update{{chid, 2, "", true}, {"other", 3, "inline", false}}
+			payloads.Attach(uaid, updates)
+			So(updates[0].Data, ShouldEqual, "hello")
+			So(updates[1].Data, ShouldEqual, "inline")
+		})
+
+		Convey("Should ignore updates without data", func() {
+			payloads.Put(nil, uaid, chid, 2, "")
+			So(store.payloads, ShouldBeEmpty)
+		})
+
+		Convey("Should not attach data for other versions", func() {
+			mckStat.EXPECT().Increment("updates.payload.stored")
+			payloads.Put(nil, uaid, chid, 2, "hello")
+			updates := []Update{{chid, 3, "", true}}
+			payloads.Attach(uaid, updates)
+			So(updates[0].Data, ShouldBeEmpty)
+		})
+
+		Convey("Should count storage errors", func() {
+			store.err = errors.New("oops")
+			mckStat.EXPECT().Increment("updates.payload.error").Times(2)
+			payloads.Put(nil, uaid, chid, 2, "hello")
+			payloads.Attach(uaid, []Update{{chid, 2, "", true}})
+		})
+
+		Convey("Should be disabled by default", func() {
+			app.storePayloads = false
+			So(NewStoredPayloads(app), ShouldBeNil)
+			var disabled *StoredPayloads
+			disabled.Put(nil, uaid, chid, 2, "hello")
+			So(store.payloads, ShouldBeEmpty)
+		})
+
+		Convey("Should be disabled for stores without payload support", func() {
+			app.SetStore(&NoStore{})
+			So(NewStoredPayloads(app), ShouldBeNil)
+		})
+	})
+}
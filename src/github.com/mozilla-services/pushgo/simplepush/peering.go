@@ -0,0 +1,446 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PeeringProtocol is the node-to-node protocol version, incremented for
+// changes to routing requests that older nodes can't handle. Nodes that
+// don't support the peering handshake report version 0.
+const PeeringProtocol = 1
+
+// PeerCapSigned is advertised by nodes that sign routing requests, and
+// reject unsigned requests. Nodes also advertise the routing formats that
+// they accept.
+const PeerCapSigned = "signed"
+
+// peerSignatureID is signed in place of a device ID by handshake requests.
+// Device IDs can't contain slashes, so handshake signatures can't be
+// replayed as routing signatures.
+const peerSignatureID = "/peer"
+
+// maxPeerInfoLen is the maximum size of a handshake request body.
+const maxPeerInfoLen = 64 * 1024
+
+type PeeringConfig struct {
+	Enabled bool
+
+	// ClusterID identifies the cluster. Nodes refuse to route to peers that
+	// report a different cluster ID. No default value; peers with any cluster
+	// ID are accepted if unspecified.
+	ClusterID string `toml:"cluster_id" env:"cluster_id"`
+
+	// MinProtocol is the oldest peer protocol version accepted. Defaults to
+	// 0, which accepts nodes that don't support the handshake; raise it to 1
+	// once a rolling upgrade completes.
+	MinProtocol int `toml:"min_protocol" env:"min_protocol"`
+
+	// TTL is the amount of time to cache a peer's handshake. Expired
+	// handshakes are refreshed in the background, and peers that aren't
+	// routed to for another TTL are forgotten. Defaults to "5m".
+	TTL string
+
+	// RetryDelay is the amount of time to wait before retrying a failed
+	// handshake. Updates are not routed to the peer in the meantime.
+	// Defaults to "10s".
+	RetryDelay string `toml:"retry_delay" env:"retry_delay"`
+}
+
+// PeerInfo is exchanged by nodes in the peering handshake.
+type PeerInfo struct {
+	Node         string   `json:"node"` // The node's routing URL.
+	Version      string   `json:"version"`
+	Protocol     int      `json:"protocol"`
+	ClusterID    string   `json:"clusterID,omitempty"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// Has indicates whether the peer advertised the capability.
+func (info *PeerInfo) Has(capability string) bool {
+	for _, c := range info.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerStatus is the result of a handshake with a peer.
+type PeerStatus struct {
+	PeerInfo
+	Compatible bool   `json:"compatible"`
+	Reason     string `json:"reason,omitempty"` // Why the peer is incompatible.
+	CheckedAt  int64  `json:"checkedAt"`        // Seconds since Epoch.
+	expiresAt  time.Time
+}
+
+// peerCall is a handshake in progress. Callers that need the result wait
+// for done to be closed.
+type peerCall struct {
+	done   chan struct{}
+	status *PeerStatus
+}
+
+// Peering performs handshakes with peer nodes before routing to them, and
+// refuses to route to peers in other clusters, or with incompatible protocol
+// versions or capabilities. Handshakes are cached for the configured TTL.
+// Handshake requests are signed with the routing key, if one is set. A nil
+// Peering allows all peers.
+type Peering struct {
+	logger      *SimpleLogger
+	metrics     Statistician
+	local       PeerInfo
+	minProtocol int
+	required    []string // Capabilities required from peers.
+	ttl         time.Duration
+	retryDelay  time.Duration
+	signingKey  []byte
+	maxSkew     time.Duration
+	rclient     *http.Client
+	peersMux    sync.RWMutex
+	peers       map[string]*PeerStatus // By routing URL.
+	calls       map[string]*peerCall   // Handshakes in progress.
+}
+
+// NewPeering creates a peering handshake for the node described by local,
+// using rclient for handshake requests. Peers that support the handshake
+// must advertise the required capabilities.
+func NewPeering(app *Application, local PeerInfo, required []string,
+	conf PeeringConfig, rclient *http.Client) (p *Peering, err error) {
+
+	p = &Peering{
+		logger:      app.Logger(),
+		metrics:     app.Metrics(),
+		local:       local,
+		minProtocol: conf.MinProtocol,
+		required:    required,
+		rclient:     rclient,
+		peers:       make(map[string]*PeerStatus),
+		calls:       make(map[string]*peerCall),
+	}
+	if p.ttl, err = time.ParseDuration(conf.TTL); err != nil {
+		return nil, err
+	}
+	if len(conf.RetryDelay) == 0 {
+		conf.RetryDelay = "10s"
+	}
+	if p.retryDelay, err = time.ParseDuration(conf.RetryDelay); err != nil {
+		return nil, err
+	}
+	if len(p.local.Version) == 0 {
+		p.local.Version = VERSION
+	}
+	if p.local.Protocol == 0 {
+		p.local.Protocol = PeeringProtocol
+	}
+	p.local.ClusterID = conf.ClusterID
+	return p, nil
+}
+
+// setSigningKey sets the key used to sign and verify handshake requests, and
+// the maximum allowed clock skew between nodes. Unsigned handshakes are
+// answered, but not recorded, if no key is set.
+func (p *Peering) setSigningKey(key []byte, maxSkew time.Duration) {
+	p.signingKey = key
+	p.maxSkew = maxSkew
+}
+
+// Local returns the handshake info for this node.
+func (p *Peering) Local() PeerInfo {
+	return p.local
+}
+
+// Allow indicates whether updates can be routed to the contact. Performs a
+// handshake if the contact is unknown; concurrent callers share the same
+// handshake. Expired handshakes are refreshed in the background, using the
+// previous result until the refresh completes.
+func (p *Peering) Allow(contact string) bool {
+	if p == nil || contact == p.local.Node {
+		return true
+	}
+	p.peersMux.RLock()
+	status := p.peers[contact]
+	p.peersMux.RUnlock()
+	if status != nil {
+		if !timeNow().Before(status.expiresAt) {
+			if call, started := p.begin(contact); started {
+				go p.run(contact, call)
+			}
+		}
+		return status.Compatible
+	}
+	call, started := p.begin(contact)
+	if started {
+		p.run(contact, call)
+	} else {
+		<-call.done
+	}
+	return call.status.Compatible
+}
+
+// begin returns the in-progress handshake with the contact, or starts a new
+// one if none is in progress. If started is true, the caller must complete
+// the handshake with run.
+func (p *Peering) begin(contact string) (call *peerCall, started bool) {
+	p.peersMux.Lock()
+	defer p.peersMux.Unlock()
+	if call = p.calls[contact]; call != nil {
+		return call, false
+	}
+	call = &peerCall{done: make(chan struct{})}
+	p.calls[contact] = call
+	return call, true
+}
+
+// run performs a handshake started by begin, records the result, and wakes
+// any waiting callers. Failed handshakes are recorded as incompatible, and
+// retried after the retry delay.
+func (p *Peering) run(contact string, call *peerCall) {
+	info, err := p.handshake(contact)
+	if err != nil {
+		if p.logger.ShouldLog(WARNING) {
+			p.logger.Warn("peering", "Peering handshake failed",
+				LogFields{"peer": contact, "error": err.Error()})
+		}
+		p.metrics.Increment("router.peer.handshake.error")
+		call.status = p.recordFailure(contact, err)
+	} else {
+		call.status = p.record(info)
+	}
+	p.peersMux.Lock()
+	delete(p.calls, contact)
+	p.peersMux.Unlock()
+	close(call.done)
+}
+
+// handshake sends the local node info to the contact, and returns the
+// contact's info. Nodes that don't support the handshake are reported with
+// protocol version 0.
+func (p *Peering) handshake(contact string) (info PeerInfo, err error) {
+	body, err := json.Marshal(p.local)
+	if err != nil {
+		return info, err
+	}
+	req, err := http.NewRequest("POST", contact+"/peer",
+		bytes.NewReader(body))
+	if err != nil {
+		return info, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(p.signingKey) > 0 {
+		sentAt := timeNow().Unix()
+		req.Header.Set(HeaderRouteTime, strconv.FormatInt(sentAt, 10))
+		req.Header.Set(HeaderRouteSignature,
+			signRoute(p.signingKey, peerSignatureID, sentAt, body))
+	}
+	resp, err := p.rclient.Do(req)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	p.metrics.Increment("router.peer.handshake")
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		io.Copy(ioutil.Discard, resp.Body)
+		return PeerInfo{Node: contact}, nil
+	default:
+		return info, fmt.Errorf("Unexpected handshake status: %d",
+			resp.StatusCode)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return info, err
+	}
+	// Record the peer by the URL used to reach it.
+	info.Node = contact
+	return info, nil
+}
+
+// check indicates whether the local node can route to a peer. Returns the
+// reason if the peer is incompatible.
+func (p *Peering) check(info PeerInfo) (ok bool, reason string) {
+	if len(p.local.ClusterID) > 0 && len(info.ClusterID) > 0 &&
+		info.ClusterID != p.local.ClusterID {
+		return false, fmt.Sprintf("Cluster ID mismatch: %s", info.ClusterID)
+	}
+	if info.Protocol < p.minProtocol {
+		return false, fmt.Sprintf("Unsupported protocol version: %d",
+			info.Protocol)
+	}
+	if info.Protocol == 0 {
+		// Older nodes don't advertise capabilities.
+		return true, ""
+	}
+	if info.Has(PeerCapSigned) != p.local.Has(PeerCapSigned) {
+		return false, "Routing signature mismatch"
+	}
+	for _, capability := range p.required {
+		if !info.Has(capability) {
+			return false, fmt.Sprintf("Missing capability: %s", capability)
+		}
+	}
+	return true, ""
+}
+
+// record stores the handshake result for a peer.
+func (p *Peering) record(info PeerInfo) *PeerStatus {
+	ok, reason := p.check(info)
+	now := timeNow()
+	status := &PeerStatus{
+		PeerInfo:   info,
+		Compatible: ok,
+		Reason:     reason,
+		CheckedAt:  now.Unix(),
+		expiresAt:  now.Add(p.ttl),
+	}
+	p.peersMux.Lock()
+	prev := p.peers[info.Node]
+	p.peers[info.Node] = status
+	p.prune(now)
+	versions := p.versions()
+	p.peersMux.Unlock()
+	p.metrics.Gauge("router.peer.versions", int64(len(versions)))
+	if !ok && (prev == nil || prev.Compatible) {
+		if p.logger.ShouldLog(ERROR) {
+			p.logger.Error("peering", "Refusing to route to incompatible peer",
+				LogFields{"peer": info.Node, "version": info.Version,
+					"protocol": strconv.Itoa(info.Protocol), "reason": reason})
+		}
+		p.metrics.Increment("router.peer.incompatible")
+	}
+	return status
+}
+
+// recordFailure stores a failed handshake with a peer. The peer's last
+// known info is kept, so that a transient failure doesn't change the
+// reported versions.
+func (p *Peering) recordFailure(contact string, err error) *PeerStatus {
+	now := timeNow()
+	status := &PeerStatus{
+		PeerInfo:  PeerInfo{Node: contact},
+		Reason:    fmt.Sprintf("Handshake failed: %s", err),
+		CheckedAt: now.Unix(),
+		expiresAt: now.Add(p.retryDelay),
+	}
+	p.peersMux.Lock()
+	if prev := p.peers[contact]; prev != nil {
+		status.PeerInfo = prev.PeerInfo
+	}
+	p.peers[contact] = status
+	p.prune(now)
+	p.peersMux.Unlock()
+	return status
+}
+
+// prune removes peers whose handshakes expired more than a TTL ago; peers
+// that are still routed to are refreshed when they expire. The caller must
+// hold the peers lock.
+func (p *Peering) prune(now time.Time) {
+	for node, status := range p.peers {
+		if now.Sub(status.expiresAt) > p.ttl {
+			delete(p.peers, node)
+		}
+	}
+}
+
+// versions returns the distinct software versions of this node and its
+// peers. The caller must hold the peers lock.
+func (p *Peering) versions() map[string]bool {
+	versions := map[string]bool{p.local.Version: true}
+	for _, status := range p.peers {
+		if len(status.Version) > 0 {
+			versions[status.Version] = true
+		}
+	}
+	return versions
+}
+
+// Peers returns the handshake results for all known peers, sorted by URL.
+func (p *Peering) Peers() []PeerStatus {
+	p.peersMux.RLock()
+	peers := make([]PeerStatus, 0, len(p.peers))
+	for _, status := range p.peers {
+		peers = append(peers, *status)
+	}
+	p.peersMux.RUnlock()
+	sort.Sort(peersByNode(peers))
+	return peers
+}
+
+// Mixed indicates whether this node and its peers run different software
+// versions, as during a rolling upgrade.
+func (p *Peering) Mixed() bool {
+	p.peersMux.RLock()
+	defer p.peersMux.RUnlock()
+	return len(p.versions()) > 1
+}
+
+// HandshakeHandler replies with the local node's info. The requesting peer
+// decides whether to route to this node. If a signing key is set, unsigned
+// requests are rejected, and the requesting peer's info is recorded;
+// otherwise, the info can't be trusted, and is ignored.
+func (p *Peering) HandshakeHandler(resp http.ResponseWriter, req *http.Request) {
+	var (
+		body []byte
+		err  error
+	)
+	signed := len(p.signingKey) > 0
+	if signed {
+		body, err = verifySigned(req, p.signingKey, p.maxSkew, peerSignatureID,
+			maxPeerInfoLen)
+		if err != nil {
+			if p.logger.ShouldLog(WARNING) {
+				p.logger.Warn("peering", "Rejected unsigned handshake",
+					LogFields{"error": err.Error()})
+			}
+			p.metrics.Increment("router.peer.handshake.unsigned")
+			http.Error(resp, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	} else if body, err = ioutil.ReadAll(io.LimitReader(req.Body,
+		maxPeerInfoLen)); err != nil {
+
+		http.Error(resp, "Invalid peer info", http.StatusBadRequest)
+		return
+	}
+	var info PeerInfo
+	if err = json.Unmarshal(body, &info); err != nil || len(info.Node) == 0 {
+		http.Error(resp, "Invalid peer info", http.StatusBadRequest)
+		return
+	}
+	if signed {
+		p.record(info)
+	}
+	if body, err = json.Marshal(p.local); err != nil {
+		http.Error(resp, "Could not encode peer info",
+			http.StatusInternalServerError)
+		return
+	}
+	writeJSON(resp, http.StatusOK, body)
+}
+
+type peersByNode []PeerStatus
+
+func (p peersByNode) Len() int           { return len(p) }
+func (p peersByNode) Less(i, j int) bool { return p[i].Node < p[j].Node }
+func (p peersByNode) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// PeeringRouter is an optional interface implemented by routers that
+// perform peering handshakes. Peering returns nil if handshakes are
+// disabled.
+type PeeringRouter interface {
+	Peering() *Peering
+}
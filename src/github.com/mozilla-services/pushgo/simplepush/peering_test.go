@@ -0,0 +1,191 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPeering(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStat.EXPECT().Increment("router.peer.handshake").AnyTimes()
+	mckStat.EXPECT().Gauge("router.peer.versions", gomock.Any()).AnyTimes()
+
+	defer saveTimeFuncs()()
+	var now time.Time
+	timeNow = func() time.Time { return now }
+	signingKey := []byte("0123456789abcdef0123456789abcdef")
+
+	Convey("Peering handshakes", t, func() {
+		now = time.Unix(1257894000, 0).UTC()
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+
+		newPeering := func(node, version, clusterID string,
+			capabilities ...string) *Peering {
+
+			p, err := NewPeering(app, PeerInfo{
+				Node:         node,
+				Version:      version,
+				Capabilities: capabilities,
+			}, []string{RouteFormatCapnp}, PeeringConfig{
+				Enabled:     true,
+				ClusterID:   clusterID,
+				MinProtocol: 1,
+				TTL:         "5m",
+			}, new(http.Client))
+			So(err, ShouldBeNil)
+			return p
+		}
+		local := newPeering("http://local:3000", "1.5.0", "cluster1",
+			RouteFormatCapnp)
+
+		Convey("Should route to compatible peers", func() {
+			peer := newPeering("", "1.5.1", "cluster1", RouteFormatCapnp)
+			peer.setSigningKey(signingKey, 5*time.Second)
+			local.setSigningKey(signingKey, 5*time.Second)
+			server := httptest.NewServer(http.HandlerFunc(peer.HandshakeHandler))
+			defer server.Close()
+
+			So(local.Allow(server.URL), ShouldBeTrue)
+			So(local.Mixed(), ShouldBeTrue)
+			peers := local.Peers()
+			So(peers, ShouldHaveLength, 1)
+			So(peers[0].Node, ShouldEqual, server.URL)
+			So(peers[0].Version, ShouldEqual, "1.5.1")
+
+			// The peer records the handshake, too.
+			peers = peer.Peers()
+			So(peers, ShouldHaveLength, 1)
+			So(peers[0].Node, ShouldEqual, "http://local:3000")
+			So(peers[0].Compatible, ShouldBeTrue)
+
+			// Cached handshakes don't send requests.
+			server.Close()
+			So(local.Allow(server.URL), ShouldBeTrue)
+		})
+
+		Convey("Should not record unsigned handshakes", func() {
+			peer := newPeering("", "1.5.1", "cluster1", RouteFormatCapnp)
+			server := httptest.NewServer(http.HandlerFunc(peer.HandshakeHandler))
+			defer server.Close()
+
+			So(local.Allow(server.URL), ShouldBeTrue)
+			So(peer.Peers(), ShouldBeEmpty)
+
+			peer.setSigningKey(signingKey, 5*time.Second)
+			mckStat.EXPECT().Increment("router.peer.handshake.unsigned")
+			resp, err := http.Post(server.URL, "application/json",
+				bytes.NewReader([]byte(`{"node":"http://attacker:3000"}`)))
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+			So(peer.Peers(), ShouldBeEmpty)
+		})
+
+		Convey("Should refresh expired handshakes in the background", func() {
+			handshakes := make(chan bool, 2)
+			peer := newPeering("", "1.5.1", "cluster1", RouteFormatCapnp)
+			server := httptest.NewServer(http.HandlerFunc(
+				func(resp http.ResponseWriter, req *http.Request) {
+					peer.HandshakeHandler(resp, req)
+					handshakes <- true
+				}))
+			defer server.Close()
+
+			So(local.Allow(server.URL), ShouldBeTrue)
+			<-handshakes
+
+			now = now.Add(6 * time.Minute)
+			peer.local.ClusterID = "cluster2"
+			mckStat.EXPECT().Increment("router.peer.incompatible")
+			So(local.Allow(server.URL), ShouldBeTrue)
+			<-handshakes
+			for local.Peers()[0].Compatible {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(local.Allow(server.URL), ShouldBeFalse)
+		})
+
+		Convey("Should forget peers that aren't routed to", func() {
+			local.record(PeerInfo{Node: "http://remote-1:3000", Protocol: 1,
+				ClusterID: "cluster1", Capabilities: []string{RouteFormatCapnp}})
+			now = now.Add(11 * time.Minute)
+			local.record(PeerInfo{Node: "http://remote-2:3000", Protocol: 1,
+				ClusterID: "cluster1", Capabilities: []string{RouteFormatCapnp}})
+			peers := local.Peers()
+			So(peers, ShouldHaveLength, 1)
+			So(peers[0].Node, ShouldEqual, "http://remote-2:3000")
+		})
+
+		Convey("Should refuse to route to other clusters", func() {
+			peer := newPeering("", "1.5.0", "cluster2", RouteFormatCapnp)
+			server := httptest.NewServer(http.HandlerFunc(peer.HandshakeHandler))
+			defer server.Close()
+
+			mckStat.EXPECT().Increment("router.peer.incompatible")
+			So(local.Allow(server.URL), ShouldBeFalse)
+			So(local.Allow(server.URL), ShouldBeFalse)
+			So(local.Mixed(), ShouldBeFalse)
+			So(local.Peers()[0].Reason, ShouldEqual, "Cluster ID mismatch: cluster2")
+		})
+
+		Convey("Should refuse peers without required capabilities", func() {
+			peer := newPeering("", "1.5.0", "cluster1", RouteFormatProtobuf)
+			server := httptest.NewServer(http.HandlerFunc(peer.HandshakeHandler))
+			defer server.Close()
+
+			mckStat.EXPECT().Increment("router.peer.incompatible")
+			So(local.Allow(server.URL), ShouldBeFalse)
+		})
+
+		Convey("Should refuse nodes without handshake support", func() {
+			server := httptest.NewServer(http.NotFoundHandler())
+			defer server.Close()
+
+			mckStat.EXPECT().Increment("router.peer.incompatible")
+			So(local.Allow(server.URL), ShouldBeFalse)
+			So(local.Peers()[0].Protocol, ShouldEqual, 0)
+
+			// Older nodes are accepted during rolling upgrades.
+			local.minProtocol = 0
+			ok, _ := local.check(PeerInfo{Node: server.URL})
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Should cache failed handshakes until the retry delay", func() {
+			server := httptest.NewServer(http.NotFoundHandler())
+			server.Close()
+
+			mckStat.EXPECT().Increment("router.peer.handshake.error")
+			So(local.Allow(server.URL), ShouldBeFalse)
+			So(local.Allow(server.URL), ShouldBeFalse)
+			peers := local.Peers()
+			So(peers, ShouldHaveLength, 1)
+			So(peers[0].Compatible, ShouldBeFalse)
+			So(peers[0].Reason, ShouldStartWith, "Handshake failed")
+		})
+
+		Convey("Should allow all peers if disabled", func() {
+			var p *Peering
+			So(p.Allow("http://remote:3000"), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,153 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+)
+
+// fakePostgresResult is a canned result for a query.
+type fakePostgresResult struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+// fakePostgres is a database/sql driver that records the statements it
+// receives, including BEGIN, COMMIT, and ROLLBACK. Queries are answered by the
+// first result whose key prefixes the query; other statements succeed without
+// rows.
+type fakePostgres struct {
+	queries chan string
+	sync.Mutex
+	results map[string]fakePostgresResult
+}
+
+func newFakePostgres(results map[string]fakePostgresResult) *fakePostgres {
+	return &fakePostgres{
+		queries: make(chan string, 50),
+		results: results,
+	}
+}
+
+func (f *fakePostgres) setResult(prefix string, res fakePostgresResult) {
+	f.Lock()
+	f.results[prefix] = res
+	f.Unlock()
+}
+
+func (f *fakePostgres) result(query string) (res fakePostgresResult) {
+	f.Lock()
+	defer f.Unlock()
+	for prefix, r := range f.results {
+		if strings.HasPrefix(query, prefix) {
+			return r
+		}
+	}
+	return
+}
+
+// Open implements driver.Driver.
+func (f *fakePostgres) Open(name string) (driver.Conn, error) {
+	return fakePostgresConn{f}, nil
+}
+
+type fakePostgresConn struct {
+	f *fakePostgres
+}
+
+func (c fakePostgresConn) Prepare(query string) (driver.Stmt, error) {
+	return fakePostgresStmt{c.f, query}, nil
+}
+
+func (c fakePostgresConn) Close() error { return nil }
+
+func (c fakePostgresConn) Begin() (driver.Tx, error) {
+	c.f.queries <- "BEGIN"
+	return fakePostgresTx{c.f}, nil
+}
+
+type fakePostgresTx struct {
+	f *fakePostgres
+}
+
+func (tx fakePostgresTx) Commit() error {
+	tx.f.queries <- "COMMIT"
+	return nil
+}
+
+func (tx fakePostgresTx) Rollback() error {
+	tx.f.queries <- "ROLLBACK"
+	return nil
+}
+
+type fakePostgresStmt struct {
+	f     *fakePostgres
+	query string
+}
+
+func (s fakePostgresStmt) Close() error  { return nil }
+func (s fakePostgresStmt) NumInput() int { return -1 }
+
+func (s fakePostgresStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.f.queries <- s.query
+	return driver.RowsAffected(0), nil
+}
+
+func (s fakePostgresStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.f.queries <- s.query
+	res := s.f.result(s.query)
+	return &fakePostgresRows{columns: res.columns, rows: res.rows}, nil
+}
+
+type fakePostgresRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakePostgresRows) Columns() []string { return r.columns }
+func (r *fakePostgresRows) Close() error      { return nil }
+
+func (r *fakePostgresRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+var registerFakePostgres sync.Once
+
+// openFakePostgres opens a database/sql handle to f. The fake driver is
+// registered once, and dispatches to whichever server is stored in
+// fakePostgresServer.
+func openFakePostgres(f *fakePostgres) *sql.DB {
+	registerFakePostgres.Do(func() {
+		sql.Register("simplepush_postgres_test", fakePostgresDriver{})
+	})
+	fakePostgresLock.Lock()
+	fakePostgresServer = f
+	fakePostgresLock.Unlock()
+	db, _ := sql.Open("simplepush_postgres_test", "")
+	return db
+}
+
+// fakePostgresDriver opens connections to fakePostgresServer.
+type fakePostgresDriver struct{}
+
+func (fakePostgresDriver) Open(name string) (driver.Conn, error) {
+	fakePostgresLock.Lock()
+	defer fakePostgresLock.Unlock()
+	return fakePostgresServer.Open(name)
+}
+
+var (
+	fakePostgresServer *fakePostgres
+	fakePostgresLock   sync.Mutex
+)
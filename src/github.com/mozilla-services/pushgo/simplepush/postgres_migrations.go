@@ -0,0 +1,148 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// postgresMigration is a schema change. Migrations are applied in order,
+// and must not be edited once released; add a new migration instead.
+type postgresMigration struct {
+	version int
+	name    string
+	stmts   []string
+}
+
+// postgresMigrations is the schema history of the PostgreSQL store. Times
+// are stored as Unix timestamps, in seconds, like channel records in the
+// other stores.
+var postgresMigrations = []postgresMigration{
+	{1, "create_devices_and_channels", []string{
+		`CREATE TABLE devices (
+			uaid text PRIMARY KEY,
+			created_at bigint NOT NULL
+		)`,
+		`CREATE TABLE channels (
+			uaid text NOT NULL REFERENCES devices (uaid),
+			chid text NOT NULL,
+			state smallint NOT NULL,
+			version bigint NOT NULL DEFAULT 0,
+			updated_at bigint NOT NULL,
+			PRIMARY KEY (uaid, chid)
+		)`,
+		`CREATE INDEX channels_updated_at ON channels (updated_at)`,
+		`CREATE TABLE tombstones (
+			uaid text NOT NULL,
+			chid text NOT NULL,
+			expires_at bigint NOT NULL,
+			PRIMARY KEY (uaid, chid)
+		)`,
+		`CREATE INDEX tombstones_expires_at ON tombstones (expires_at)`,
+		`CREATE TABLE pings (
+			uaid text PRIMARY KEY,
+			ping_data bytea NOT NULL,
+			updated_at bigint NOT NULL
+		)`,
+	}},
+	{2, "create_dead_letters", []string{
+		`CREATE TABLE dead_letters (
+			seq bigserial PRIMARY KEY,
+			id text NOT NULL UNIQUE,
+			uaid text NOT NULL,
+			chid text NOT NULL,
+			version bigint NOT NULL,
+			data text NOT NULL,
+			reason text NOT NULL,
+			failed_at bigint NOT NULL,
+			attempts integer NOT NULL
+		)`,
+		`CREATE INDEX dead_letters_failed_at ON dead_letters (failed_at)`,
+	}},
+}
+
+// postgresMigrationLock is the advisory lock key held while migrating, so
+// that servers starting at the same time don't apply a migration twice.
+const postgresMigrationLock = 0x70757368676f // "pushgo"
+
+// PostgresSchemaError indicates that the database schema version doesn't
+// match the migrations known to this server.
+type PostgresSchemaError struct {
+	Current, Latest int
+}
+
+// Error implements the error interface.
+func (err *PostgresSchemaError) Error() string {
+	if err.Current > err.Latest {
+		return fmt.Sprintf("PostgreSQL schema version %d is newer than the "+
+			"latest version supported by this server (%d)", err.Current,
+			err.Latest)
+	}
+	return fmt.Sprintf("PostgreSQL schema version %d is out of date; "+
+		"migrate to version %d", err.Current, err.Latest)
+}
+
+// migratePostgres applies pending migrations in a single transaction, and
+// returns the applied migrations. If apply is false, migratePostgres only
+// checks that the schema is up to date. Fails with a PostgresSchemaError if
+// the schema is newer than the latest migration, so that an older server
+// doesn't write to a schema it doesn't understand.
+func migratePostgres(db *sql.DB, migrations []postgresMigration,
+	apply bool) (applied []postgresMigration, err error) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	if _, err = tx.Exec("SELECT pg_advisory_xact_lock($1)",
+		int64(postgresMigrationLock)); err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name text NOT NULL,
+		applied_at bigint NOT NULL
+	)`); err != nil {
+		return nil, err
+	}
+	var current int
+	if err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return nil, err
+	}
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].version
+	}
+	if current > latest || (current < latest && !apply) {
+		return nil, &PostgresSchemaError{current, latest}
+	}
+	for _, migration := range migrations {
+		if migration.version <= current {
+			continue
+		}
+		for _, stmt := range migration.stmts {
+			if _, err = tx.Exec(stmt); err != nil {
+				return nil, fmt.Errorf("Error applying migration %d (%s): %s",
+					migration.version, migration.name, err)
+			}
+		}
+		if _, err = tx.Exec(
+			"INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)",
+			migration.version, migration.name, timeNow().UTC().Unix()); err != nil {
+			return nil, err
+		}
+		applied = append(applied, migration)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
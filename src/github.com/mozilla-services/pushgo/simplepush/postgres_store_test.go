@@ -0,0 +1,347 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"database/sql/driver"
+	"net"
+	"testing"
+	"time"
+)
+
+func setupPostgres(t *testing.T) (testPs *PostgresStore, connected bool) {
+	testPs = NewPostgresStore()
+	conf := testPs.ConfigStruct().(*PostgresConf)
+	conf.PruneInterval = "0"
+	c, err := net.Dial("tcp", "127.0.0.1:5432")
+	if err != nil {
+		return testPs, false
+	}
+	c.Close()
+	logger, _ := NewLogger(&TestLogger{DEBUG, t})
+	testApp := &Application{}
+	testApp.SetLogger(logger)
+	if err = testPs.Init(testApp, conf); err != nil {
+		t.Logf("Could not connect to PostgreSQL: %s", err)
+		return testPs, false
+	}
+	return testPs, true
+}
+
+// migrationQueries returns the statements received by a fake server, up to
+// and including the statement that ends the migration transaction.
+func migrationQueries(f *fakePostgres) (queries []string) {
+	for {
+		q := <-f.queries
+		queries = append(queries, q)
+		if q == "COMMIT" || q == "ROLLBACK" {
+			return queries
+		}
+	}
+}
+
+func Test_PostgresConfigStruct(t *testing.T) {
+	testPs := NewPostgresStore()
+	if _, ok := testPs.ConfigStruct().(*PostgresConf); !ok {
+		t.Error("PostgresStore invalid configuration struct")
+	}
+}
+
+func Test_PostgresURLWithTimeout(t *testing.T) {
+	tests := []struct {
+		url     string
+		timeout time.Duration
+		result  string
+	}{
+		{"postgres://localhost/push", 1500 * time.Millisecond,
+			"postgres://localhost/push?connect_timeout=2"},
+		{"postgres://localhost/push?connect_timeout=10", time.Second,
+			"postgres://localhost/push?connect_timeout=10"},
+		{"postgres://localhost/push", 0, "postgres://localhost/push"},
+	}
+	for _, test := range tests {
+		result, err := postgresURLWithTimeout(test.url, test.timeout)
+		if err != nil || result != test.result {
+			t.Errorf("postgresURLWithTimeout(%q, %s): got %q, %v; want %q",
+				test.url, test.timeout, result, err, test.result)
+		}
+	}
+}
+
+func Test_PostgresMigrate(t *testing.T) {
+	f := newFakePostgres(map[string]fakePostgresResult{
+		"SELECT COALESCE": {
+			columns: []string{"coalesce"},
+			rows:    [][]driver.Value{{int64(2)}},
+		},
+	})
+	db := openFakePostgres(f)
+	defer db.Close()
+	migrations := append(postgresMigrations, postgresMigration{
+		3, "add_test_column", []string{"ALTER TABLE devices ADD test text"}})
+
+	// Only pending migrations should be applied.
+	applied, err := migratePostgres(db, migrations, true)
+	if err != nil {
+		t.Fatalf("migratePostgres returned error: %s", err)
+	}
+	if len(applied) != 1 || applied[0].version != 3 {
+		t.Errorf("migratePostgres applied wrong migrations: %v", applied)
+	}
+	queries := migrationQueries(f)
+	expected := []string{"BEGIN", "SELECT pg_advisory_xact_lock($1)"}
+	for i, query := range expected {
+		if i >= len(queries) || queries[i] != query {
+			t.Fatalf("Wrong migration prologue: %q", queries)
+		}
+	}
+	expected = []string{
+		"ALTER TABLE devices ADD test text",
+		"INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)",
+		"COMMIT",
+	}
+	if tail := queries[len(queries)-3:]; !equalStrings(tail, expected) {
+		t.Errorf("Wrong migration statements: %q", queries)
+	}
+
+	// Outdated schemas should be rejected if migrations are disabled.
+	_, err = migratePostgres(db, migrations, false)
+	if err, ok := err.(*PostgresSchemaError); !ok || err.Current != 2 ||
+		err.Latest != 3 {
+		t.Errorf("migratePostgres accepted outdated schema: %v", err)
+	}
+	if queries = migrationQueries(f); queries[len(queries)-1] != "ROLLBACK" {
+		t.Errorf("migratePostgres committed outdated schema: %q", queries)
+	}
+
+	// Older servers should refuse newer schemas.
+	f.setResult("SELECT COALESCE", fakePostgresResult{
+		columns: []string{"coalesce"},
+		rows:    [][]driver.Value{{int64(4)}},
+	})
+	_, err = migratePostgres(db, migrations, true)
+	if err, ok := err.(*PostgresSchemaError); !ok || err.Current != 4 {
+		t.Errorf("migratePostgres accepted newer schema: %v", err)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func Test_PostgresStatus(t *testing.T) {
+	testPs, connected := setupPostgres(t)
+	if !connected {
+		t.Skip("Skipping Status check, no server.")
+	}
+	defer testPs.Close()
+
+	if success, err := testPs.Status(); !success || err != nil {
+		t.Errorf("Status failed: %v", err)
+	}
+}
+
+func Test_PostgresRegister(t *testing.T) {
+	testPs, connected := setupPostgres(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testPs.Close()
+	defer testPs.EraseDevice(TESTUAID)
+
+	if err := testPs.Register(TESTUAID, TESTCHID, 0); err != nil {
+		t.Errorf("Register returned error: %v", err)
+	}
+	if !testPs.Exists(TESTUAID) {
+		t.Error("Exists could not locate registered device")
+	}
+	if testPs.Exists(TESTCHID) {
+		t.Error("Exists found unregistered device")
+	}
+	if err := testPs.Register("", TESTCHID, 0); err != ErrNoID {
+		t.Errorf("Register accepted missing device ID: %v", err)
+	}
+	if err := testPs.Register(TESTUAID, "invalid", 0); err != ErrInvalidChannel {
+		t.Errorf("Register accepted invalid channel ID: %v", err)
+	}
+	// Registered channels are not returned until updated.
+	updates, expired, err := testPs.FetchAll(TESTUAID, time.Time{})
+	if err != nil || len(updates) != 0 || len(expired) != 0 {
+		t.Errorf("FetchAll returned registered channel: %v, %v, %v",
+			updates, expired, err)
+	}
+}
+
+func Test_PostgresUpdate(t *testing.T) {
+	testPs, connected := setupPostgres(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testPs.Close()
+	defer testPs.EraseDevice(TESTUAID)
+
+	testPs.Register(TESTUAID, TESTCHID, 0)
+	if err := testPs.Update(TESTUAID, TESTCHID, 12345); err != nil {
+		t.Errorf("Update returned error: %v", err)
+	}
+	updates, _, err := testPs.FetchAll(TESTUAID, time.Time{})
+	if err != nil {
+		t.Errorf("FetchAll returned error: %v", err)
+	}
+	if len(updates) != 1 || updates[0].ChannelID != TESTCHID ||
+		updates[0].Version != 12345 {
+		t.Errorf("FetchAll returned wrong updates: %v", updates)
+	}
+
+	testPs.RejectDecreasing = true
+	if err := testPs.Update(TESTUAID, TESTCHID, 123); err != ErrStaleVersion {
+		t.Errorf("Update accepted decreasing version: %v", err)
+	}
+}
+
+func Test_PostgresUnregister(t *testing.T) {
+	testPs, connected := setupPostgres(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testPs.Close()
+	defer testPs.EraseDevice(TESTUAID)
+
+	testPs.Register(TESTUAID, TESTCHID, 12345)
+	if err := testPs.Unregister(TESTUAID, TESTCHID); err != nil {
+		t.Errorf("Unregister returned error: %v", err)
+	}
+	if err := testPs.Unregister(TESTUAID, TESTCHID); err != ErrChannelGone {
+		t.Errorf("Unregister failed to reject unregistered channel: %v", err)
+	}
+	if err := testPs.Update(TESTUAID, TESTCHID, 67890); err != ErrChannelGone {
+		t.Errorf("Update failed to reject unregistered channel: %v", err)
+	}
+	if gone, err := testPs.HasTombstone(TESTUAID, TESTCHID); !gone || err != nil {
+		t.Errorf("HasTombstone failed to find tombstone: %v", err)
+	}
+	// The device is kept after its last channel is unregistered.
+	if !testPs.Exists(TESTUAID) {
+		t.Error("Exists could not locate device without channels")
+	}
+}
+
+func Test_PostgresDrop(t *testing.T) {
+	testPs, connected := setupPostgres(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testPs.Close()
+	defer testPs.EraseDevice(TESTUAID)
+
+	testPs.Register(TESTUAID, TESTCHID, 12345)
+	if err := testPs.Drop(TESTUAID, TESTCHID); err != nil {
+		t.Errorf("Drop returned error: %v", err)
+	}
+	updates, _, _ := testPs.FetchAll(TESTUAID, time.Time{})
+	if len(updates) != 0 {
+		t.Errorf("FetchAll returned dropped channel: %v", updates)
+	}
+	// Acknowledged channels can still be unregistered.
+	if err := testPs.Unregister(TESTUAID, TESTCHID); err != nil {
+		t.Errorf("Unregister rejected acknowledged channel: %v", err)
+	}
+	if err := testPs.Update(TESTUAID, TESTCHID, 67890); err != ErrChannelGone {
+		t.Errorf("Update registered unregistered channel again: %v", err)
+	}
+	if err := testPs.DropAll(TESTUAID); err != nil {
+		t.Errorf("DropAll returned error: %v", err)
+	}
+	if testPs.Exists(TESTUAID) {
+		t.Error("Exists found dropped device")
+	}
+}
+
+func Test_PostgresPing(t *testing.T) {
+	testPs, connected := setupPostgres(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testPs.Close()
+	defer testPs.EraseDevice(TESTUAID)
+
+	if err := testPs.PutPing(TESTUAID, []byte("ping data")); err != nil {
+		t.Errorf("PutPing returned error: %v", err)
+	}
+	if data, err := testPs.FetchPing(TESTUAID); string(data) != "ping data" {
+		t.Errorf("FetchPing returned wrong data: %q, %v", data, err)
+	}
+	if err := testPs.DropPing(TESTUAID); err != nil {
+		t.Errorf("DropPing returned error: %v", err)
+	}
+	if data, err := testPs.FetchPing(TESTUAID); data != nil || err != nil {
+		t.Errorf("FetchPing returned dropped ping: %q, %v", data, err)
+	}
+}
+
+func Test_PostgresEraseDevice(t *testing.T) {
+	testPs, connected := setupPostgres(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testPs.Close()
+
+	testPs.Register(TESTUAID, TESTCHID, 12345)
+	testPs.PutPing(TESTUAID, []byte("ping data"))
+	if erased, err := testPs.EraseDevice(TESTUAID); erased == 0 || err != nil {
+		t.Errorf("EraseDevice returned %d, %v", erased, err)
+	}
+	if testPs.Exists(TESTUAID) {
+		t.Error("Exists found erased device")
+	}
+	if data, _ := testPs.FetchPing(TESTUAID); data != nil {
+		t.Errorf("FetchPing returned erased ping: %q", data)
+	}
+}
+
+func Test_PostgresDeadLetters(t *testing.T) {
+	testPs, connected := setupPostgres(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testPs.Close()
+
+	first := &DeadLetter{ID: "d1c7c768b1be4c7093a69b52910d4baa", UAID: TESTUAID,
+		ChannelID: TESTCHID, Version: 1, Data: "hello", Reason: "timeout",
+		FailedAt: timeNow().Unix(), Attempts: 3}
+	second := &DeadLetter{ID: "5e1e5984569c4f00bf4bea47754a6403", UAID: TESTUAID,
+		ChannelID: TESTCHID, Version: 2, Reason: "timeout",
+		FailedAt: timeNow().Unix(), Attempts: 1}
+	defer testPs.DropDeadLetter(first.ID)
+	defer testPs.DropDeadLetter(second.ID)
+	for _, letter := range []*DeadLetter{first, second} {
+		if err := testPs.PutDeadLetter(letter); err != nil {
+			t.Fatalf("PutDeadLetter returned error: %v", err)
+		}
+	}
+	letters, err := testPs.FetchDeadLetters(1)
+	if err != nil || len(letters) != 1 || *letters[0] != *first {
+		t.Errorf("FetchDeadLetters returned wrong letters: %v, %v", letters, err)
+	}
+	if letter, err := testPs.FetchDeadLetter(second.ID); err != nil ||
+		*letter != *second {
+
+		t.Errorf("FetchDeadLetter returned wrong letter: %v, %v", letter, err)
+	}
+	if err = testPs.DropDeadLetter(first.ID); err != nil {
+		t.Errorf("DropDeadLetter returned error: %v", err)
+	}
+	if _, err = testPs.FetchDeadLetter(first.ID); err != ErrNoDeadLetter {
+		t.Errorf("FetchDeadLetter returned dropped letter: %v", err)
+	}
+}
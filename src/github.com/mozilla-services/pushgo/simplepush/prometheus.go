@@ -0,0 +1,264 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPrometheusBuckets are the default timer histogram buckets, in
+// seconds.
+var defaultPrometheusBuckets = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type PrometheusConfig struct {
+	Enabled bool
+
+	// Namespace is prepended to all exported metric names.
+	Namespace string
+
+	// Path is the endpoint handler path for the exposition.
+	Path string
+
+	// Buckets are the upper bounds of the timer histogram buckets, in
+	// seconds.
+	Buckets []float64
+
+	// Instance is the "instance" label of every exported sample, to tell
+	// apart nodes sharing a host. Defaults to the host name, which is also
+	// exported as the "host" label.
+	Instance string
+}
+
+// PrometheusExporter is an optional interface implemented by Statisticians
+// that export metrics in the Prometheus text format. Prometheus returns nil
+// if the exporter is disabled.
+type PrometheusExporter interface {
+	Prometheus() *PrometheusRegistry
+}
+
+type promHistogram struct {
+	counts []uint64 // Cumulative counts, one per bucket.
+	sum    float64
+	count  uint64
+}
+
+// PrometheusRegistry tracks counters, gauges, and timer histograms for
+// scraping. Metrics are registered on first use. A metric's type never
+// changes: since Prometheus counters must be monotonic, counter decrements
+// are exported as a separate "_decrements_total" counter. Every sample is
+// labeled with the host and instance.
+type PrometheusRegistry struct {
+	sync.Mutex
+	namespace  string
+	path       string
+	buckets    []float64
+	labels     string // Formatted host and instance labels.
+	counters   map[string]int64
+	decrements map[string]int64
+	gauges     map[string]int64
+	timers     map[string]*promHistogram
+}
+
+// NewPrometheusRegistry creates a registry from conf, labeling samples with
+// host.
+func NewPrometheusRegistry(conf PrometheusConfig,
+	host string) *PrometheusRegistry {
+
+	buckets := conf.Buckets
+	if len(buckets) == 0 {
+		buckets = defaultPrometheusBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	path := conf.Path
+	if len(path) == 0 {
+		path = "/metrics"
+	}
+	instance := conf.Instance
+	if len(instance) == 0 {
+		instance = host
+	}
+	return &PrometheusRegistry{
+		namespace: conf.Namespace,
+		path:      path,
+		buckets:   buckets,
+		labels: `host="` + escapePromLabel(host) + `",instance="` +
+			escapePromLabel(instance) + `"`,
+		counters:   make(map[string]int64),
+		decrements: make(map[string]int64),
+		gauges:     make(map[string]int64),
+		timers:     make(map[string]*promHistogram),
+	}
+}
+
+// Path returns the handler path.
+func (r *PrometheusRegistry) Path() string {
+	return r.path
+}
+
+func (r *PrometheusRegistry) IncrementBy(metric string, count int64) {
+	r.Lock()
+	if count < 0 {
+		r.decrements[metric] -= count
+	} else {
+		r.counters[metric] += count
+	}
+	r.Unlock()
+}
+
+func (r *PrometheusRegistry) Gauge(metric string, value int64) {
+	r.Lock()
+	r.gauges[metric] = value
+	r.Unlock()
+}
+
+func (r *PrometheusRegistry) GaugeDelta(metric string, delta int64) {
+	r.Lock()
+	r.gauges[metric] += delta
+	r.Unlock()
+}
+
+func (r *PrometheusRegistry) Observe(metric string, duration time.Duration) {
+	value := duration.Seconds()
+	r.Lock()
+	h, ok := r.timers[metric]
+	if !ok {
+		h = &promHistogram{counts: make([]uint64, len(r.buckets))}
+		r.timers[metric] = h
+	}
+	for i, bound := range r.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+	r.Unlock()
+}
+
+// name converts a dotted metric name into a valid Prometheus name.
+func (r *PrometheusRegistry) name(metric, suffix string) string {
+	name := metric
+	if len(r.namespace) > 0 {
+		name = r.namespace + "_" + metric
+	}
+	name = strings.Map(cleanPrometheusName, name) + suffix
+	if name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// cleanPrometheusName is a mapping function passed to strings.Map that
+// replaces characters not permitted in Prometheus metric names.
+func cleanPrometheusName(r rune) rune {
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		r == '_' || r == ':' {
+		return r
+	}
+	return '_'
+}
+
+// escapePromLabel escapes a label value for the text exposition format.
+func escapePromLabel(value string) string {
+	return promLabelEscaper.Replace(value)
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatPromFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteTo writes all registered metrics in the text exposition format.
+func (r *PrometheusRegistry) WriteTo(w io.Writer) (n int64, err error) {
+	bw := bufio.NewWriter(w)
+	write := func(s string) {
+		c, _ := bw.WriteString(s)
+		n += int64(c)
+	}
+	header := func(name, typ string) {
+		write("# TYPE " + name + " " + typ + "\n")
+	}
+
+	sample := func(name string, value string) {
+		write(name + "{" + r.labels + "} " + value + "\n")
+	}
+
+	r.Lock()
+	names := make(map[string]bool, len(r.counters)+len(r.decrements))
+	for metric := range r.counters {
+		names[metric] = true
+	}
+	for metric := range r.decrements {
+		names[metric] = true
+	}
+	for _, metric := range sortedKeys(names) {
+		name := r.name(metric, "_total")
+		header(name, "counter")
+		sample(name, strconv.FormatInt(r.counters[metric], 10))
+		if decrements, ok := r.decrements[metric]; ok {
+			name = r.name(metric, "_decrements_total")
+			header(name, "counter")
+			sample(name, strconv.FormatInt(decrements, 10))
+		}
+	}
+
+	names = make(map[string]bool, len(r.gauges))
+	for metric := range r.gauges {
+		names[metric] = true
+	}
+	for _, metric := range sortedKeys(names) {
+		name := r.name(metric, "")
+		header(name, "gauge")
+		sample(name, strconv.FormatInt(r.gauges[metric], 10))
+	}
+
+	names = make(map[string]bool, len(r.timers))
+	for metric := range r.timers {
+		names[metric] = true
+	}
+	for _, metric := range sortedKeys(names) {
+		h := r.timers[metric]
+		name := r.name(metric, "_seconds")
+		header(name, "histogram")
+		for i, bound := range r.buckets {
+			write(name + "_bucket{" + r.labels + `,le="` +
+				formatPromFloat(bound) + `"} ` +
+				strconv.FormatUint(h.counts[i], 10) + "\n")
+		}
+		count := strconv.FormatUint(h.count, 10)
+		write(name + "_bucket{" + r.labels + `,le="+Inf"} ` + count + "\n")
+		sample(name+"_sum", formatPromFloat(h.sum))
+		sample(name+"_count", count)
+	}
+	r.Unlock()
+
+	return n, bw.Flush()
+}
+
+func (r *PrometheusRegistry) ServeHTTP(resp http.ResponseWriter,
+	req *http.Request) {
+
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(resp)
+}
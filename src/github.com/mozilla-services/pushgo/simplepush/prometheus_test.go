@@ -0,0 +1,104 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPrometheusRegistry(t *testing.T) {
+	Convey("Prometheus exporter", t, func() {
+		r := NewPrometheusRegistry(PrometheusConfig{
+			Namespace: "pushgo",
+			Buckets:   []float64{0.5, 0.1},
+			Instance:  "node-1",
+		}, "push1.example.com")
+		So(r.Path(), ShouldEqual, "/metrics")
+
+		Convey("Should export counters, gauges, and histograms", func() {
+			r.IncrementBy("updates.appserver.incoming", 2)
+			r.IncrementBy("updates.appserver.incoming", 1)
+			r.IncrementBy("client.socket.connect", 1)
+			r.IncrementBy("client.socket.connect", -1)
+			r.Gauge("update.client.connections", 5)
+			r.GaugeDelta("update.client.connections", -2)
+			r.Observe("updates.handled", 50*time.Millisecond)
+			r.Observe("updates.handled", 300*time.Millisecond)
+			r.Observe("updates.handled", 2*time.Second)
+
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, &http.Request{Method: "GET"})
+			So(resp.Header().Get("Content-Type"), ShouldStartWith, "text/plain")
+			labels := `host="push1.example.com",instance="node-1"`
+			So(resp.Body.String(), ShouldEqual, strings.Join([]string{
+				"# TYPE pushgo_client_socket_connect_total counter",
+				"pushgo_client_socket_connect_total{" + labels + "} 1",
+				"# TYPE pushgo_client_socket_connect_decrements_total counter",
+				"pushgo_client_socket_connect_decrements_total{" + labels + "} 1",
+				"# TYPE pushgo_updates_appserver_incoming_total counter",
+				"pushgo_updates_appserver_incoming_total{" + labels + "} 3",
+				"# TYPE pushgo_update_client_connections gauge",
+				"pushgo_update_client_connections{" + labels + "} 3",
+				"# TYPE pushgo_updates_handled_seconds histogram",
+				"pushgo_updates_handled_seconds_bucket{" + labels + `,le="0.1"} 1`,
+				"pushgo_updates_handled_seconds_bucket{" + labels + `,le="0.5"} 2`,
+				"pushgo_updates_handled_seconds_bucket{" + labels + `,le="+Inf"} 3`,
+				"pushgo_updates_handled_seconds_sum{" + labels + "} 2.35",
+				"pushgo_updates_handled_seconds_count{" + labels + "} 3",
+				"",
+			}, "\n"))
+		})
+
+		Convey("Should default the instance to the host", func() {
+			r := NewPrometheusRegistry(PrometheusConfig{}, `push"1`)
+			r.Gauge("update.client.connections", 1)
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, &http.Request{Method: "GET"})
+			So(resp.Body.String(), ShouldContainSubstring,
+				`update_client_connections{host="push\"1",instance="push\"1"} 1`)
+		})
+	})
+}
+
+func TestMetricsPrometheus(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(false).AnyTimes()
+
+	Convey("Metrics with the Prometheus exporter", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+
+		m := new(Metrics)
+		conf := m.ConfigStruct().(*MetricsConfig)
+		So(m.Init(app, conf), ShouldBeNil)
+		So(m.Prometheus(), ShouldBeNil)
+
+		conf.Prometheus.Enabled = true
+		So(m.Init(app, conf), ShouldBeNil)
+		registry := m.Prometheus()
+		So(registry, ShouldNotBeNil)
+
+		m.Increment("updates.appserver.incoming")
+		m.Timer("updates.handled", time.Second)
+		m.Gauge("update.client.connections", 1)
+
+		Convey("Should record alongside snapshots", func() {
+			So(m.Snapshot()["counter.updates.appserver.incoming"], ShouldEqual, 1)
+			So(registry.counters["updates.appserver.incoming"], ShouldEqual, 1)
+			So(registry.timers["updates.handled"].count, ShouldEqual, 1)
+			So(registry.gauges["update.client.connections"], ShouldEqual, 1)
+		})
+	})
+}
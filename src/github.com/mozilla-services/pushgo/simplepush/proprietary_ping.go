@@ -38,6 +38,9 @@ func init() {
 	AvailablePings["noop"] = func() HasConfigStruct { return new(NoopPing) }
 	AvailablePings["udp"] = func() HasConfigStruct { return new(UDPPing) }
 	AvailablePings["gcm"] = func() HasConfigStruct { return new(GCMPing) }
+	AvailablePings["sandbox"] = func() HasConfigStruct { return new(SandboxPing) }
+	AvailablePings["apns"] = func() HasConfigStruct { return NewAPNsPing() }
+	AvailablePings["multi"] = func() HasConfigStruct { return new(MultiPing) }
 	AvailablePings.SetDefault("noop")
 }
 
@@ -77,6 +80,10 @@ func (r *NoopPing) Init(app *Application, config interface{}) (err error) {
 	return nil
 }
 
+func (r *NoopPing) Name() string {
+	return "noop"
+}
+
 // Register the ping to a user
 func (r *NoopPing) Register(string, []byte) error {
 	return nil
@@ -120,6 +127,10 @@ func (ml *UDPPing) ConfigStruct() interface{} {
 	}
 }
 
+func (r *UDPPing) Name() string {
+	return "udp"
+}
+
 func (r *UDPPing) Init(app *Application, config interface{}) error {
 	r.app = app
 	r.config = config.(*UDPPingConfig)
@@ -184,7 +195,9 @@ type GCMPing struct {
 	dryRun      bool
 	apiKey      string
 	ttl         uint64
+	maxPayload  int
 	rh          *retry.Helper
+	sandbox     *PingSandbox // Records requests instead of sending; may be nil.
 	closeOnce   Once
 	closeSignal chan bool
 }
@@ -197,6 +210,16 @@ type GCMPingConfig struct {
 	URL         string //GCM URL
 	IdleConns   int    `toml:"idle_conns" env:"idle_conns"`
 	Retry       retry.Config
+
+	// MaxPayload is the size, in bytes, of the largest update payload sent
+	// in a GCM message. Larger payloads are stored, and the device is sent a
+	// data-less wakeup instead. Payloads are unlimited if set to 0.
+	MaxPayload int `toml:"max_payload" env:"max_payload"`
+
+	// Sandbox records GCM requests in a buffer of SandboxSize requests,
+	// instead of sending them. For staging environments.
+	Sandbox     bool
+	SandboxSize int `toml:"sandbox_size" env:"sandbox_size"`
 }
 
 type GCMRequest struct {
@@ -223,6 +246,8 @@ func (r *GCMPing) ConfigStruct() interface{} {
 		DryRun:      false,
 		TTL:         "72h",
 		IdleConns:   50,
+		MaxPayload:  4096,
+		SandboxSize: 100,
 		Retry: retry.Config{
 			Retries:   5,
 			Delay:     "200ms",
@@ -232,6 +257,10 @@ func (r *GCMPing) ConfigStruct() interface{} {
 	}
 }
 
+func (r *GCMPing) Name() string {
+	return "gcm"
+}
+
 func (r *GCMPing) Init(app *Application, config interface{}) (err error) {
 	r.logger = app.Logger()
 	r.metrics = app.Metrics()
@@ -241,6 +270,14 @@ func (r *GCMPing) Init(app *Application, config interface{}) (err error) {
 	r.url = conf.URL
 	r.collapseKey = conf.CollapseKey
 	r.dryRun = conf.DryRun
+	r.maxPayload = conf.MaxPayload
+	if conf.Sandbox {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("propping", "GCM sandbox mode enabled; pings will not be sent",
+				nil)
+		}
+		r.sandbox = NewPingSandbox(conf.SandboxSize)
+	}
 
 	if r.apiKey = conf.APIKey; len(r.apiKey) == 0 {
 		r.logger.Panic("propping", "Missing GCM API key", nil)
@@ -271,6 +308,15 @@ func (r *GCMPing) Init(app *Application, config interface{}) (err error) {
 	return nil
 }
 
+func (r *GCMPing) Sandbox() *PingSandbox {
+	return r.sandbox
+}
+
+// MaxPayload implements PayloadLimiter.MaxPayload().
+func (r *GCMPing) MaxPayload() int {
+	return r.maxPayload
+}
+
 func (r *GCMPing) CanBypassWebsocket() bool {
 	// GCM can work even if the client's websocket connection
 	// has timed out or closed. We do not need to try to send the
@@ -301,7 +347,7 @@ func (r *GCMPing) retryAfter(header string) (ok bool) {
 	select {
 	case <-r.closeSignal:
 		return false
-	case <-time.After(d):
+	case <-clock.After(d):
 	}
 	return true
 }
@@ -360,6 +406,21 @@ func (r *GCMPing) Send(uaid string, vers int64, data string) (ok bool, err error
 		}
 		return false, err
 	}
+	if r.sandbox != nil {
+		if r.logger.ShouldLog(INFO) {
+			r.logger.Info("propping", "Recording sandboxed GCM request",
+				LogFields{"uaid": uaid, "body": string(body)})
+		}
+		r.sandbox.Record(SandboxSend{
+			Pinger:  r.Name(),
+			UAID:    uaid,
+			Version: vers,
+			Data:    data,
+			Request: string(body),
+		})
+		r.metrics.Increment("ping.gcm.sandbox")
+		return true, nil
+	}
 	sendOnce := func() (err error) {
 		req, err := http.NewRequest("POST", r.url, bytes.NewReader(body))
 		if err != nil {
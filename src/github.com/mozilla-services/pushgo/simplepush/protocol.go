@@ -0,0 +1,515 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+type RequestHeader struct {
+	Type string `json:"messageType"`
+}
+
+type HelloRequest struct {
+	DeviceID   string          `json:"uaid"`
+	ChannelIDs HelloChannels   `json:"channelIDs"`
+	PingData   json.RawMessage `json:"connect"`
+	Sequence   bool            `json:"sequence"` // Number notification frames.
+	Resume     string          `json:"resume"`   // Resumption token.
+	Hints      *ClientHints    `json:"hints,omitempty"`
+	Checksum   string          `json:"checksum,omitempty"` // See ChannelChecksum.
+}
+
+// ClientHints describe the client's power state. Clients send hints in hello
+// and ping messages; dozing clients may have low-priority updates deferred.
+type ClientHints struct {
+	Platform string `json:"platform,omitempty"` // "firefoxos", "android", or "desktop".
+	Doze     bool   `json:"doze,omitempty"`
+	Battery  string `json:"battery,omitempty"` // "critical", "low", "medium", "high", or "charging".
+}
+
+// HelloChannels is the channel ID array sent in a handshake. Only the number
+// of channels is used, so the array is counted without decoding its
+// elements. This keeps large handshakes from allocating per channel before
+// the channel limits are checked.
+type HelloChannels struct {
+	Sent  bool // Set if the array was sent, even if empty.
+	Count int
+}
+
+// UnmarshalJSON implements json.Unmarshaler. The decoder has already checked
+// that data is well-formed.
+func (c *HelloChannels) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*c = HelloChannels{}
+		return nil
+	}
+	if len(data) < 2 || data[0] != '[' {
+		return fmt.Errorf("channelIDs: expected array")
+	}
+	count, depth, empty := 0, 0, true
+	inString, escaped := false, false
+	for _, b := range data[1 : len(data)-1] {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case b == '\\':
+				escaped = true
+			case b == '"':
+				inString = false
+			}
+			continue
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '"':
+			inString = true
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				count++
+			}
+		}
+		empty = false
+	}
+	if !empty {
+		count++
+	}
+	*c = HelloChannels{Sent: true, Count: count}
+	return nil
+}
+
+type HelloReply struct {
+	Type         string  `json:"messageType"`
+	DeviceID     string  `json:"uaid"`
+	Status       int     `json:"status"`
+	RedirectURL  *string `json:"redirect,omitempty"`
+	PingInterval int64   `json:"pingInterval,omitempty"` // Seconds.
+	MaxSilence   int64   `json:"maxSilence,omitempty"`   // Seconds.
+	RetryAfter   int64   `json:"retryAfter,omitempty"`   // Seconds.
+	Error        string  `json:"error,omitempty"`
+	Sequence     bool    `json:"sequence,omitempty"`
+	Resume       string  `json:"resume,omitempty"` // Resumption token.
+
+	// ChannelIDs lists the registered channels if they differ from the
+	// client's checksum.
+	ChannelIDs []string `json:"channelIDs,omitempty"`
+}
+
+type RegisterRequest struct {
+	ChannelID string `json:"channelID"`
+}
+
+type RegisterReply struct {
+	Type      string `json:"messageType"`
+	DeviceID  string `json:"uaid"`
+	Status    int    `json:"status"`
+	ChannelID string `json:"channelID"`
+	Endpoint  string `json:"pushEndpoint"`
+}
+
+type UnregisterRequest struct {
+	ChannelID string `json:"channelID"`
+}
+
+type UnregisterReply struct {
+	Type      string `json:"messageType"`
+	Status    int    `json:"status"`
+	ChannelID string `json:"channelID"`
+}
+
+type FlushReply struct {
+	Type    string   `json:"messageType"`
+	Updates []Update `json:"updates,omitempty"`
+	Expired []string `json:"expired,omitempty"`
+	Seq     uint64   `json:"seq,omitempty"`
+	Time    int64    `json:"timestamp,omitempty"` // Milliseconds since Epoch.
+}
+
+type ACKRequest struct {
+	Updates []Update `json:"updates"`
+	Expired []string `json:"expired"`
+	Seq     uint64   `json:"seq"` // The acknowledged frame, if numbered.
+}
+
+type PingRequest struct {
+	Time  int64        `json:"time"` // The client time, in milliseconds since Epoch.
+	Hints *ClientHints `json:"hints,omitempty"`
+}
+
+type PingReply struct {
+	Type   string `json:"messageType"`
+	Status int    `json:"status"`
+}
+
+type PurgeReply struct {
+	Type   string `json:"messageType"`
+	Status int    `json:"status"`
+}
+
+type ChannelsReply struct {
+	Type     string        `json:"messageType"`
+	Status   int           `json:"status"`
+	Channels []ChannelInfo `json:"channels"`
+}
+
+// clientMessages are the messages sent by clients, by message type.
+var clientMessages = map[string]interface{}{
+	"hello":      HelloRequest{},
+	"register":   RegisterRequest{},
+	"unregister": UnregisterRequest{},
+	"ack":        ACKRequest{},
+	"ping":       PingRequest{},
+	"purge":      struct{}{},
+	"channels":   struct{}{},
+}
+
+// deprecatedCommands are client commands accepted for backward
+// compatibility, and rejected in strict mode.
+var deprecatedCommands = map[string]bool{
+	"purge": true,
+}
+
+// serverMessages are the messages sent by the server, by message type.
+var serverMessages = map[string]interface{}{
+	"hello":        HelloReply{},
+	"register":     RegisterReply{},
+	"unregister":   UnregisterReply{},
+	"notification": FlushReply{},
+	"ping":         PingReply{},
+	"purge":        PurgeReply{},
+	"channels":     ChannelsReply{},
+	"settings":     ClientSettings{},
+}
+
+type ProtocolConfig struct {
+	// Validate checks client messages against the protocol schemas before
+	// they are handled. Clients that send invalid messages are disconnected.
+	Validate bool
+
+	// RejectUnknown rejects messages with fields that are not defined by the
+	// protocol. Requires validate.
+	RejectUnknown bool `toml:"reject_unknown" env:"reject_unknown"`
+
+	// Publish serves the protocol schemas at /protocol.json on the WebSocket
+	// listener, for client implementers.
+	Publish bool
+
+	// Strict is the strict protocol mode: "off", "observe", or "enforce".
+	// Strict mode rejects messages with unknown top-level fields, message
+	// types that are not lowercase, and deprecated commands. In observe mode,
+	// these messages are counted, but accepted.
+	Strict string
+}
+
+// StrictMode determines how a validator handles messages that violate the
+// strict protocol.
+type StrictMode int
+
+const (
+	StrictOff StrictMode = iota
+	StrictObserve
+	StrictEnforce
+)
+
+var strictModes = map[string]StrictMode{
+	"off":     StrictOff,
+	"observe": StrictObserve,
+	"enforce": StrictEnforce,
+}
+
+// ParseStrictMode returns the strict protocol mode with the given name.
+func ParseStrictMode(name string) (mode StrictMode, err error) {
+	mode, ok := strictModes[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("Unknown strict protocol mode: %q", name)
+	}
+	return mode, nil
+}
+
+// Schema is a JSON Schema (draft 4) describing a protocol message or field.
+// Only the keywords needed to describe the protocol are supported.
+type Schema struct {
+	Schema     string             `json:"$schema,omitempty"`
+	Title      string             `json:"title,omitempty"`
+	Type       string             `json:"type,omitempty"`
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+	Items      *Schema            `json:"items,omitempty"`
+	Enum       []string           `json:"enum,omitempty"`
+	Minimum    *int64             `json:"minimum,omitempty"`
+}
+
+// ProtocolDefinition is the machine-readable protocol definition, published
+// to client implementers.
+type ProtocolDefinition struct {
+	Client map[string]*Schema `json:"client"` // Client messages, by type.
+	Server map[string]*Schema `json:"server"` // Server messages, by type.
+}
+
+// ProtocolSchemas generates the schemas for all protocol messages. Client
+// schemas do not require a messageType: pings may be sent as empty objects.
+func ProtocolSchemas() *ProtocolDefinition {
+	def := &ProtocolDefinition{
+		Client: make(map[string]*Schema, len(clientMessages)),
+		Server: make(map[string]*Schema, len(serverMessages)),
+	}
+	for msgType, v := range clientMessages {
+		def.Client[msgType] = messageSchema(msgType, v, false)
+	}
+	for msgType, v := range serverMessages {
+		def.Server[msgType] = messageSchema(msgType, v, true)
+	}
+	return def
+}
+
+func messageSchema(msgType string, v interface{}, isServer bool) *Schema {
+	s := schemaOf(reflect.TypeOf(v), isServer)
+	s.Schema = "http://json-schema.org/draft-04/schema#"
+	s.Title = msgType
+	if s.Properties == nil {
+		s.Properties = make(map[string]*Schema)
+	}
+	s.Properties["messageType"] = &Schema{Type: "string", Enum: []string{msgType}}
+	if isServer {
+		s.Required = append([]string{"messageType"}, s.Required...)
+	}
+	return s
+}
+
+var (
+	rawMessageType    = reflect.TypeOf(json.RawMessage{})
+	helloChannelsType = reflect.TypeOf(HelloChannels{})
+)
+
+// schemaOf generates a schema for values of type t. Struct fields are named
+// by their JSON tags. If required is true, fields without omitempty are
+// required; clients may omit any field.
+func schemaOf(t reflect.Type, required bool) *Schema {
+	if t == rawMessageType {
+		return &Schema{} // Any value.
+	}
+	if t == helloChannelsType {
+		return &Schema{Type: "array", Items: &Schema{}}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), required)
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Schema{Type: "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		min := int64(0)
+		return &Schema{Type: "integer", Minimum: &min}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaOf(t.Elem(), required)}
+	case reflect.Struct:
+		s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if len(field.PkgPath) > 0 {
+				continue // Unexported.
+			}
+			name, opts := field.Name, ""
+			if tag := field.Tag.Get("json"); len(tag) > 0 {
+				if tag == "-" {
+					continue
+				}
+				if i := strings.Index(tag, ","); i >= 0 {
+					tag, opts = tag[:i], tag[i:]
+				}
+				if len(tag) > 0 {
+					name = tag
+				}
+			}
+			if name == "messageType" {
+				continue // Added by messageSchema.
+			}
+			s.Properties[name] = schemaOf(field.Type, required)
+			if required && !strings.Contains(opts, ",omitempty") {
+				s.Required = append(s.Required, name)
+			}
+		}
+		return s
+	}
+	return &Schema{}
+}
+
+// Validate checks that v, a value decoded by encoding/json, matches the
+// schema's types. Required fields are not checked, as client schemas have
+// none, nor are enums, as message types are case-insensitive.
+// Nulls are accepted for any field, as the decoder treats them as absent.
+// If rejectUnknown is true, objects may not contain undefined fields.
+func (s *Schema) Validate(v interface{}, rejectUnknown bool) error {
+	return s.validate("message", v, rejectUnknown)
+}
+
+func (s *Schema) validate(path string, v interface{},
+	rejectUnknown bool) error {
+
+	if v == nil {
+		return nil
+	}
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return schemaTypeError(path, s.Type)
+		}
+		for name, value := range obj {
+			prop, ok := s.Properties[name]
+			if !ok {
+				if rejectUnknown {
+					return fmt.Errorf("%s: unknown field %q", path, name)
+				}
+				continue
+			}
+			if err := prop.validate(path+"."+name, value, rejectUnknown); err != nil {
+				return err
+			}
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return schemaTypeError(path, s.Type)
+		}
+		if s.Items == nil {
+			break
+		}
+		for i, item := range items {
+			if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item,
+				rejectUnknown); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return schemaTypeError(path, s.Type)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return schemaTypeError(path, s.Type)
+		}
+	case "number", "integer":
+		n, ok := v.(float64)
+		if !ok || s.Type == "integer" && n != math.Trunc(n) {
+			return schemaTypeError(path, s.Type)
+		}
+		if s.Minimum != nil && n < float64(*s.Minimum) {
+			return fmt.Errorf("%s: must be at least %d", path, *s.Minimum)
+		}
+	}
+	return nil
+}
+
+func schemaTypeError(path, expected string) error {
+	return fmt.Errorf("%s: expected %s", path, expected)
+}
+
+// ProtocolValidator checks client messages against the protocol schemas,
+// and enforces strict mode. A nil ProtocolValidator accepts all messages.
+type ProtocolValidator struct {
+	metrics       Statistician
+	schemas       map[string]*Schema
+	validate      bool
+	rejectUnknown bool
+	strict        StrictMode
+}
+
+// NewProtocolValidator creates a validator from conf.
+func NewProtocolValidator(app *Application, conf ProtocolConfig) (
+	p *ProtocolValidator, err error) {
+
+	p = &ProtocolValidator{
+		metrics:       app.Metrics(),
+		schemas:       ProtocolSchemas().Client,
+		validate:      conf.Validate,
+		rejectUnknown: conf.RejectUnknown,
+	}
+	if len(conf.Strict) > 0 {
+		if p.strict, err = ParseStrictMode(conf.Strict); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Enabled indicates whether the validator checks messages.
+func (p *ProtocolValidator) Enabled() bool {
+	return p.validate || p.strict != StrictOff
+}
+
+// Validate checks a compacted client message of the given type. Messages of
+// unknown types are accepted; they are rejected by DispatchCommand.
+func (p *ProtocolValidator) Validate(msgType string, message []byte) error {
+	if p == nil {
+		return nil
+	}
+	schema, ok := p.schemas[strings.ToLower(msgType)]
+	if !ok {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(message, &v); err != nil {
+		return err
+	}
+	if p.strict != StrictOff {
+		if err := p.checkStrict(msgType, schema, v); err != nil {
+			return err
+		}
+	}
+	if !p.validate {
+		return nil
+	}
+	return schema.Validate(v, p.rejectUnknown)
+}
+
+// checkStrict counts strict protocol violations, and returns the first if
+// strict mode is enforced.
+func (p *ProtocolValidator) checkStrict(msgType string, schema *Schema,
+	v interface{}) (err error) {
+
+	violation := func(name string, violationErr error) {
+		p.metrics.Increment("client.protocol.strict." + name)
+		if err == nil {
+			err = violationErr
+		}
+	}
+	lowerType := strings.ToLower(msgType)
+	if msgType != lowerType {
+		violation("command_case", fmt.Errorf("message type not lowercase: %q",
+			msgType))
+	}
+	if deprecatedCommands[lowerType] {
+		violation("deprecated", fmt.Errorf("deprecated command: %q", lowerType))
+	}
+	if obj, ok := v.(map[string]interface{}); ok {
+		for name := range obj {
+			if _, ok := schema.Properties[name]; !ok {
+				violation("unknown_field", fmt.Errorf("message: unknown field %q",
+					name))
+				break
+			}
+		}
+	}
+	if p.strict == StrictObserve {
+		return nil
+	}
+	return err
+}
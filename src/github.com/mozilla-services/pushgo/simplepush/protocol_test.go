@@ -0,0 +1,133 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProtocolSchemas(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Protocol schemas", t, func() {
+		app := NewApplication()
+		app.SetMetrics(mckStat)
+		def := ProtocolSchemas()
+
+		Convey("Should describe message fields", func() {
+			ack := def.Client["ack"]
+			So(ack.Type, ShouldEqual, "object")
+			So(ack.Required, ShouldBeEmpty)
+			updates := ack.Properties["updates"]
+			So(updates.Type, ShouldEqual, "array")
+			So(updates.Items.Properties["channelID"].Type, ShouldEqual, "string")
+			So(updates.Items.Properties["version"].Type, ShouldEqual, "integer")
+			So(*updates.Items.Properties["version"].Minimum, ShouldEqual, int64(0))
+
+			hello := def.Server["hello"]
+			So(hello.Required, ShouldResemble, []string{"messageType", "uaid", "status"})
+			So(hello.Properties["messageType"].Enum, ShouldResemble, []string{"hello"})
+			So(hello.Properties["redirect"].Type, ShouldEqual, "string")
+
+			channelIDs := def.Client["hello"].Properties["channelIDs"]
+			So(channelIDs.Type, ShouldEqual, "array")
+		})
+
+		Convey("Should count handshake channel IDs without decoding them", func() {
+			count := func(message string) (HelloChannels, error) {
+				request := new(HelloRequest)
+				err := json.Unmarshal([]byte(message), request)
+				return request.ChannelIDs, err
+			}
+			channels, err := count(`{"channelIDs":[]}`)
+			So(err, ShouldBeNil)
+			So(channels, ShouldResemble, HelloChannels{Sent: true, Count: 0})
+
+			channels, err = count(`{"channelIDs":[ "a,b", "c\"]", {"d":[1,2]}, [3] ]}`)
+			So(err, ShouldBeNil)
+			So(channels, ShouldResemble, HelloChannels{Sent: true, Count: 4})
+
+			channels, err = count(`{"channelIDs":null}`)
+			So(err, ShouldBeNil)
+			So(channels.Sent, ShouldBeFalse)
+
+			_, err = count(`{"channelIDs":"a,b"}`)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Should validate client messages", func() {
+			p, err := NewProtocolValidator(app, ProtocolConfig{Validate: true})
+			So(err, ShouldBeNil)
+			So(p.Validate("hello", []byte(`{"messageType":"hello","uaid":"","channelIDs":[],"extra":1}`)),
+				ShouldBeNil)
+			So(p.Validate("ping", []byte(`{}`)), ShouldBeNil)
+			So(p.Validate("register", []byte(`{"messageType":"register","channelID":1}`)),
+				ShouldNotBeNil)
+			So(p.Validate("ACK", []byte(`{"messageType":"ack","updates":[{"channelID":"a","version":1.5}]}`)),
+				ShouldNotBeNil)
+			So(p.Validate("ack", []byte(`{"messageType":"ack","updates":[{"channelID":"a","version":-1}]}`)),
+				ShouldNotBeNil)
+			So(p.Validate("unknown", []byte(`{"messageType":"unknown"}`)), ShouldBeNil)
+		})
+
+		Convey("Should optionally reject unknown fields", func() {
+			p, err := NewProtocolValidator(app, ProtocolConfig{
+				Validate: true, RejectUnknown: true})
+			So(err, ShouldBeNil)
+			So(p.Validate("hello", []byte(`{"messageType":"hello","uaid":"","extra":1}`)),
+				ShouldNotBeNil)
+			So(p.Validate("ack", []byte(`{"messageType":"ack","updates":[{"channelID":"a","version":1,"extra":1}]}`)),
+				ShouldNotBeNil)
+			So(p.Validate("unregister", []byte(`{"messageType":"unregister","channelID":"a"}`)),
+				ShouldBeNil)
+		})
+
+		Convey("Should reject strict protocol violations", func() {
+			p, err := NewProtocolValidator(app, ProtocolConfig{Strict: "enforce"})
+			So(err, ShouldBeNil)
+			So(p.Enabled(), ShouldBeTrue)
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("client.protocol.strict.command_case"),
+				mckStat.EXPECT().Increment("client.protocol.strict.deprecated"),
+				mckStat.EXPECT().Increment("client.protocol.strict.unknown_field"),
+			)
+			So(p.Validate("Register", []byte(`{"messageType":"Register","channelID":"a"}`)),
+				ShouldNotBeNil)
+			So(p.Validate("purge", []byte(`{"messageType":"purge"}`)), ShouldNotBeNil)
+			So(p.Validate("hello", []byte(`{"messageType":"hello","extra":1}`)),
+				ShouldNotBeNil)
+			// Nested fields are only checked by reject_unknown.
+			So(p.Validate("ack", []byte(`{"messageType":"ack","updates":[{"extra":1}]}`)),
+				ShouldBeNil)
+		})
+
+		Convey("Should count strict protocol violations in observe mode", func() {
+			p, err := NewProtocolValidator(app, ProtocolConfig{Strict: "observe"})
+			So(err, ShouldBeNil)
+			mckStat.EXPECT().Increment("client.protocol.strict.deprecated")
+			So(p.Validate("purge", []byte(`{"messageType":"purge"}`)), ShouldBeNil)
+			// Schema validation is disabled.
+			So(p.Validate("register", []byte(`{"messageType":"register","channelID":1}`)),
+				ShouldBeNil)
+		})
+
+		Convey("Should reject unknown strict modes", func() {
+			_, err := NewProtocolValidator(app, ProtocolConfig{Strict: "strict"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Should accept all messages if disabled", func() {
+			var p *ProtocolValidator
+			So(p.Validate("register", []byte(`{"channelID":1}`)), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,199 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sync"
+	"time"
+)
+
+type RedeliveryConfig struct {
+	Enabled bool
+
+	// Timeout is how long a connected client has to acknowledge an update
+	// before it is resent.
+	Timeout string
+
+	// MaxRetries is the number of times an unacknowledged update is resent
+	// before it is counted as potentially lost.
+	MaxRetries int `toml:"max_retries" env:"max_retries"`
+
+	// Backoff multiplies the timeout after each retry.
+	Backoff float64
+
+	// MaxLost closes connections after this many updates exhausted their
+	// retries without an intervening acknowledgement. This cleans up clients
+	// that stopped processing frames while the socket remains open. Zero
+	// disables the limit.
+	MaxLost int `toml:"max_lost" env:"max_lost"`
+}
+
+// RedeliveryPolicy holds the re-delivery schedule shared by all connections.
+type RedeliveryPolicy struct {
+	timeout    time.Duration
+	maxRetries int
+	backoff    float64
+	maxLost    int
+}
+
+// NewRedeliveryPolicy creates a re-delivery policy from conf.
+func NewRedeliveryPolicy(conf RedeliveryConfig) (p *RedeliveryPolicy, err error) {
+	p = &RedeliveryPolicy{
+		maxRetries: conf.MaxRetries,
+		backoff:    conf.Backoff,
+		maxLost:    conf.MaxLost,
+	}
+	if p.timeout, err = time.ParseDuration(conf.Timeout); err != nil {
+		return nil, err
+	}
+	if p.backoff < 1 {
+		p.backoff = 1
+	}
+	return p, nil
+}
+
+// Tracker returns a new re-delivery tracker for a connection. Returns nil if
+// p is nil.
+func (p *RedeliveryPolicy) Tracker() *RedeliveryTracker {
+	if p == nil {
+		return nil
+	}
+	return &RedeliveryTracker{
+		policy:  p,
+		pending: make(map[string]*pendingDelivery),
+	}
+}
+
+// delay returns the time to wait for an acknowledgement after the given
+// number of retries.
+func (p *RedeliveryPolicy) delay(retries int) time.Duration {
+	delay := float64(p.timeout)
+	for i := 0; i < retries; i++ {
+		delay *= p.backoff
+	}
+	return time.Duration(delay)
+}
+
+// pendingDelivery is an update or expired channel awaiting acknowledgement.
+type pendingDelivery struct {
+	update  Update
+	expired bool
+	retries int
+	dueAt   time.Time
+}
+
+// RedeliveryTracker resends updates that a connected client has not
+// acknowledged within the timeout, backing off between retries. Updates
+// that are still unacknowledged after the last retry are dropped from the
+// tracker and reported as potentially lost; they remain in the store, and
+// are flushed again on the next handshake. A nil RedeliveryTracker resends
+// nothing.
+type RedeliveryTracker struct {
+	policy     *RedeliveryPolicy
+	pendingMux sync.Mutex
+	pending    map[string]*pendingDelivery // By channel ID.
+	lost       int                         // Lost since the last acknowledgement.
+}
+
+// Sent records updates and expired channels sent to the client. A newer
+// version of a pending update restarts its schedule.
+func (t *RedeliveryTracker) Sent(updates []Update, expired []string) {
+	if t == nil {
+		return
+	}
+	dueAt := timeNow().Add(t.policy.delay(0))
+	t.pendingMux.Lock()
+	for _, update := range updates {
+		t.pending[update.ChannelID] = &pendingDelivery{
+			update: update, dueAt: dueAt}
+	}
+	for _, chid := range expired {
+		t.pending[chid] = &pendingDelivery{
+			update: Update{ChannelID: chid}, expired: true, dueAt: dueAt}
+	}
+	t.pendingMux.Unlock()
+}
+
+// Acked stops tracking acknowledged updates and expired channels. Updates
+// are kept if a newer version was sent after the acknowledged version. Any
+// acknowledgement resets the lost update count.
+func (t *RedeliveryTracker) Acked(updates []Update, expired []string) {
+	if t == nil {
+		return
+	}
+	t.pendingMux.Lock()
+	t.lost = 0
+	for _, update := range updates {
+		if p, ok := t.pending[update.ChannelID]; ok && !p.expired &&
+			update.Version >= p.update.Version {
+			delete(t.pending, update.ChannelID)
+		}
+	}
+	for _, chid := range expired {
+		if p, ok := t.pending[chid]; ok && p.expired {
+			delete(t.pending, chid)
+		}
+	}
+	t.pendingMux.Unlock()
+}
+
+// Deadline returns the time the next pending update is due for re-delivery,
+// or the zero value if no updates are pending.
+func (t *RedeliveryTracker) Deadline() (dueAt time.Time) {
+	if t == nil {
+		return
+	}
+	t.pendingMux.Lock()
+	defer t.pendingMux.Unlock()
+	for _, p := range t.pending {
+		if dueAt.IsZero() || p.dueAt.Before(dueAt) {
+			dueAt = p.dueAt
+		}
+	}
+	return
+}
+
+// Due returns the updates and expired channels that should be resent at
+// now, and schedules their next retry. lost is the number of updates that
+// exhausted their retries; these are no longer tracked.
+func (t *RedeliveryTracker) Due(now time.Time) (updates []Update,
+	expired []string, lost int) {
+
+	if t == nil {
+		return nil, nil, 0
+	}
+	t.pendingMux.Lock()
+	defer t.pendingMux.Unlock()
+	for chid, p := range t.pending {
+		if now.Before(p.dueAt) {
+			continue
+		}
+		if p.retries >= t.policy.maxRetries {
+			delete(t.pending, chid)
+			lost++
+			t.lost++
+			continue
+		}
+		p.retries++
+		p.dueAt = now.Add(t.policy.delay(p.retries))
+		if p.expired {
+			expired = append(expired, chid)
+		} else {
+			updates = append(updates, p.update)
+		}
+	}
+	return
+}
+
+// Unresponsive indicates whether the client exceeded the lost update limit,
+// and should be disconnected.
+func (t *RedeliveryTracker) Unresponsive() bool {
+	if t == nil {
+		return false
+	}
+	t.pendingMux.Lock()
+	defer t.pendingMux.Unlock()
+	return t.policy.maxLost > 0 && t.lost >= t.policy.maxLost
+}
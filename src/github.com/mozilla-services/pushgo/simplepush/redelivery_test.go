@@ -0,0 +1,101 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRedeliveryTracker(t *testing.T) {
+	defer saveTimeFuncs()()
+	var now time.Time
+	timeNow = func() time.Time { return now }
+
+	Convey("Unacknowledged update re-delivery", t, func() {
+		p, err := NewRedeliveryPolicy(RedeliveryConfig{
+			Enabled: true, Timeout: "10s", MaxRetries: 2, Backoff: 2})
+		So(err, ShouldBeNil)
+		tr := p.Tracker()
+		now = time.Unix(1000, 0)
+
+		Convey("Should resend updates with backoff, then report them lost", func() {
+			tr.Sent([]Update{{"chid1", 1, "", false}}, nil)
+			So(tr.Deadline(), ShouldResemble, now.Add(10*time.Second))
+
+			updates, expired, lost := tr.Due(now.Add(5 * time.Second))
+			So(updates, ShouldBeEmpty)
+
+			now = now.Add(10 * time.Second)
+			updates, expired, lost = tr.Due(now)
+			So(updates, ShouldResemble, []Update{{"chid1", 1, "", false}})
+			So(expired, ShouldBeEmpty)
+			So(lost, ShouldEqual, 0)
+			So(tr.Deadline(), ShouldResemble, now.Add(20*time.Second))
+
+			now = now.Add(20 * time.Second)
+			updates, _, _ = tr.Due(now)
+			So(updates, ShouldHaveLength, 1)
+			So(tr.Deadline(), ShouldResemble, now.Add(40*time.Second))
+
+			now = now.Add(40 * time.Second)
+			updates, _, lost = tr.Due(now)
+			So(updates, ShouldBeEmpty)
+			So(lost, ShouldEqual, 1)
+			So(tr.Deadline().IsZero(), ShouldBeTrue)
+		})
+
+		Convey("Should stop tracking acknowledged updates", func() {
+			tr.Sent([]Update{{"chid1", 1, "", false}}, []string{"chid2"})
+			tr.Sent([]Update{{"chid1", 2, "", false}}, nil)
+			tr.Acked([]Update{{"chid1", 1, "", false}}, []string{"chid2"})
+
+			now = now.Add(10 * time.Second)
+			updates, expired, _ := tr.Due(now)
+			So(updates, ShouldResemble, []Update{{"chid1", 2, "", false}})
+			So(expired, ShouldBeEmpty)
+
+			tr.Acked([]Update{{"chid1", 2, "", false}}, nil)
+			So(tr.Deadline().IsZero(), ShouldBeTrue)
+		})
+
+		Convey("Should flag clients that stop acknowledging updates", func() {
+			p.maxLost = 2
+			tr.Sent([]Update{{"chid1", 1, "", false}, {"chid2", 1, "", false}}, nil)
+			for i := 0; i < 2; i++ {
+				now = now.Add(time.Hour)
+				tr.Due(now)
+			}
+			So(tr.Unresponsive(), ShouldBeFalse)
+			now = now.Add(time.Hour)
+			_, _, lost := tr.Due(now)
+			So(lost, ShouldEqual, 2)
+			So(tr.Unresponsive(), ShouldBeTrue)
+
+			tr.Acked([]Update{{"chid3", 1, "", false}}, nil)
+			So(tr.Unresponsive(), ShouldBeFalse)
+		})
+
+		Convey("Should resend expired channels", func() {
+			tr.Sent(nil, []string{"chid1"})
+			now = now.Add(10 * time.Second)
+			updates, expired, _ := tr.Due(now)
+			So(updates, ShouldBeEmpty)
+			So(expired, ShouldResemble, []string{"chid1"})
+		})
+
+		Convey("Should resend nothing if disabled", func() {
+			var tr *RedeliveryTracker
+			tr.Sent([]Update{{"chid1", 1, "", false}}, nil)
+			So(tr.Deadline().IsZero(), ShouldBeTrue)
+			updates, expired, lost := tr.Due(now.Add(time.Hour))
+			So(updates, ShouldBeNil)
+			So(expired, ShouldBeNil)
+			So(lost, ShouldEqual, 0)
+		})
+	})
+}
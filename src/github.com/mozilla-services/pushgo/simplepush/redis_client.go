@@ -0,0 +1,416 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRedisNil      StorageError = "Redis key not found"
+	ErrRedisProtocol StorageError = "Malformed Redis reply"
+	ErrRedisNoMaster StorageError = "No Redis master available from sentinels"
+	ErrRedisClosed   StorageError = "Redis connection pool closed"
+	ErrRedisStatus   StorageError = "Redis returned unexpected health check result"
+)
+
+// RedisError is an error reply returned by a Redis server.
+type RedisError string
+
+// Error implements the error interface.
+func (err RedisError) Error() string {
+	return string(err)
+}
+
+// failedOver indicates whether the server rejected a command because it is a
+// replica or is still loading its dataset, as after a failover.
+func (err RedisError) failedOver() bool {
+	return strings.HasPrefix(string(err), "READONLY") ||
+		strings.HasPrefix(string(err), "LOADING")
+}
+
+// RedisConn is a Redis connection. Commands may be pipelined with Send;
+// Do flushes pending commands and reads their replies. A connection is not
+// safe for concurrent use.
+type RedisConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	timeout time.Duration
+	pending int
+	err     error // Sticky I/O or protocol error; the connection is broken.
+}
+
+func newRedisConn(conn net.Conn, timeout time.Duration) *RedisConn {
+	return &RedisConn{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		timeout: timeout,
+	}
+}
+
+// Err returns a non-nil error if the connection is broken.
+func (c *RedisConn) Err() error {
+	return c.err
+}
+
+// Close closes the underlying network connection.
+func (c *RedisConn) Close() error {
+	return c.conn.Close()
+}
+
+// Send buffers a command without waiting for its reply.
+func (c *RedisConn) Send(cmd string, args ...string) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.w.WriteString("*" + strconv.Itoa(len(args)+1) + "\r\n")
+	c.writeArg(cmd)
+	for _, arg := range args {
+		c.writeArg(arg)
+	}
+	c.pending++
+	return nil
+}
+
+func (c *RedisConn) writeArg(arg string) {
+	c.w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+	c.w.WriteString(arg)
+	c.w.WriteString("\r\n")
+}
+
+// Do sends a command, flushes all pending commands, and returns the reply to
+// the last one. If an earlier pipelined command failed, its error is
+// returned instead. Replies are nil for missing keys, string for status
+// replies, int64 for integers, []byte for bulk strings, and []interface{}
+// for arrays.
+func (c *RedisConn) Do(cmd string, args ...string) (reply interface{}, err error) {
+	if err = c.Send(cmd, args...); err != nil {
+		return nil, err
+	}
+	if c.timeout > 0 {
+		c.conn.SetDeadline(timeNow().Add(c.timeout))
+	}
+	if err = c.w.Flush(); err != nil {
+		c.err = err
+		return nil, err
+	}
+	for ; c.pending > 0; c.pending-- {
+		r, replyErr := c.readReply()
+		if c.err != nil {
+			return nil, c.err
+		}
+		if replyErr != nil && err == nil {
+			err = replyErr
+		}
+		reply = r
+	}
+	return reply, err
+}
+
+// readReply reads a single reply. Error replies are returned as RedisErrors;
+// I/O and protocol errors also break the connection.
+func (c *RedisConn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		c.err = err
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		replyErr := RedisError(line[1:])
+		if replyErr.failedOver() {
+			// Break the connection, so that the pool reconnects to the
+			// current master instead of reusing it.
+			c.err = replyErr
+		}
+		return nil, replyErr
+	case ':':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			c.err = ErrRedisProtocol
+			return nil, c.err
+		}
+		return n, nil
+	case '$':
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			c.err = ErrRedisProtocol
+			return nil, c.err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(c.r, data); err != nil {
+			c.err = err
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			c.err = ErrRedisProtocol
+			return nil, c.err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, size)
+		var itemErr error
+		for i := range items {
+			if items[i], err = c.readReply(); c.err != nil {
+				return nil, c.err
+			}
+			if err != nil && itemErr == nil {
+				// Error replies are returned by EXEC for failed commands.
+				itemErr = err
+			}
+		}
+		return items, itemErr
+	}
+	c.err = ErrRedisProtocol
+	return nil, c.err
+}
+
+func (c *RedisConn) readLine() ([]byte, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return nil, ErrRedisProtocol
+		}
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ErrRedisProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+// redisDoer runs a single command on a connection or pool.
+type redisDoer interface {
+	Do(cmd string, args ...string) (interface{}, error)
+}
+
+// RedisPoolConf specifies Redis connection options.
+type RedisPoolConf struct {
+	// Server is the address of a single Redis node. Ignored if Sentinels is
+	// set.
+	Server string
+
+	// Sentinels are the addresses of Redis Sentinel nodes, queried in order
+	// for the address of the current master.
+	Sentinels []string
+
+	// MasterName is the name of the master monitored by the sentinels.
+	MasterName string
+
+	Password string
+	Database int
+
+	// MaxIdle is the maximum number of idle connections kept open.
+	MaxIdle int
+
+	// Timeout is the dial, read, and write timeout.
+	Timeout time.Duration
+}
+
+// RedisPool is a pool of connections to a single Redis node, or to the
+// master reported by a set of sentinels. Broken connections are discarded,
+// so connections made after a failover are opened to the new master.
+type RedisPool struct {
+	conf   RedisPoolConf
+	dial   func(network, addr string, timeout time.Duration) (net.Conn, error)
+	idle   chan *RedisConn
+	closed chan bool
+	once   sync.Once
+}
+
+// NewRedisPool creates a connection pool. Connections are opened on demand.
+func NewRedisPool(conf RedisPoolConf) *RedisPool {
+	return &RedisPool{
+		conf:   conf,
+		dial:   net.DialTimeout,
+		idle:   make(chan *RedisConn, conf.MaxIdle),
+		closed: make(chan bool),
+	}
+}
+
+// Get returns an idle connection, or opens a new one.
+func (p *RedisPool) Get() (*RedisConn, error) {
+	select {
+	case <-p.closed:
+		return nil, ErrRedisClosed
+	case c := <-p.idle:
+		return c, nil
+	default:
+	}
+	return p.open()
+}
+
+// Put returns a connection to the pool. Broken connections, including
+// connections to a node that replied with -READONLY or -LOADING, connections
+// with unread replies, and connections exceeding MaxIdle are closed.
+func (p *RedisPool) Put(c *RedisConn) {
+	if c.err != nil || c.pending > 0 {
+		c.Close()
+		return
+	}
+	select {
+	case <-p.closed:
+		c.Close()
+	case p.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+// Do runs a single command on a pooled connection.
+func (p *RedisPool) Do(cmd string, args ...string) (interface{}, error) {
+	c, err := p.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer p.Put(c)
+	return c.Do(cmd, args...)
+}
+
+// Close closes all idle connections. Connections in use are closed when
+// they are returned. Safe to call multiple times.
+func (p *RedisPool) Close() error {
+	p.once.Do(func() {
+		close(p.closed)
+		for {
+			select {
+			case c := <-p.idle:
+				c.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// open dials the server or current master, then authenticates and selects
+// the configured database.
+func (p *RedisPool) open() (c *RedisConn, err error) {
+	addr := p.conf.Server
+	if len(p.conf.Sentinels) > 0 {
+		if addr, err = p.master(); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := p.dial("tcp", addr, p.conf.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c = newRedisConn(conn, p.conf.Timeout)
+	if len(p.conf.Password) > 0 {
+		if _, err = c.Do("AUTH", p.conf.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if p.conf.Database != 0 {
+		if _, err = c.Do("SELECT", strconv.Itoa(p.conf.Database)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// master asks each sentinel in turn for the current master address.
+func (p *RedisPool) master() (addr string, err error) {
+	err = ErrRedisNoMaster
+	for _, sentinel := range p.conf.Sentinels {
+		if addr, err = p.askSentinel(sentinel); err == nil {
+			return addr, nil
+		}
+	}
+	return "", err
+}
+
+func (p *RedisPool) askSentinel(sentinel string) (string, error) {
+	conn, err := p.dial("tcp", sentinel, p.conf.Timeout)
+	if err != nil {
+		return "", err
+	}
+	c := newRedisConn(conn, p.conf.Timeout)
+	defer c.Close()
+	reply, err := c.Do("SENTINEL", "get-master-addr-by-name", p.conf.MasterName)
+	if err != nil {
+		return "", err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 2 {
+		return "", ErrRedisNoMaster
+	}
+	host, hostOk := items[0].([]byte)
+	port, portOk := items[1].([]byte)
+	if !hostOk || !portOk {
+		return "", ErrRedisProtocol
+	}
+	return net.JoinHostPort(string(host), string(port)), nil
+}
+
+// redisBytes converts a bulk string reply. Returns ErrRedisNil for missing
+// keys.
+func redisBytes(reply interface{}, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	switch r := reply.(type) {
+	case []byte:
+		return r, nil
+	case nil:
+		return nil, ErrRedisNil
+	}
+	return nil, fmt.Errorf("Unexpected Redis reply type %T", reply)
+}
+
+// redisInt converts an integer reply.
+func redisInt(reply interface{}, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	if n, ok := reply.(int64); ok {
+		return n, nil
+	}
+	return 0, fmt.Errorf("Unexpected Redis reply type %T", reply)
+}
+
+// redisStrings converts an array of bulk strings. Missing values are
+// returned as empty strings.
+func redisStrings(reply interface{}, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok {
+		if reply == nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unexpected Redis reply type %T", reply)
+	}
+	values := make([]string, len(items))
+	for i, item := range items {
+		if b, ok := item.([]byte); ok {
+			values[i] = string(b)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,169 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// readRedisCommand reads a command sent by a RedisConn.
+func readRedisCommand(r *bufio.Reader) (args []string, err error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	for i := 0; i < n; i++ {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		arg := make([]byte, size+2)
+		if _, err = io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args = append(args, string(arg[:size]))
+	}
+	return args, nil
+}
+
+// fakeRedis serves canned replies, keyed by command name, over pipes.
+type fakeRedis struct {
+	replies  map[string]string
+	commands chan []string
+	dialed   chan string
+}
+
+func newFakeRedis(replies map[string]string) *fakeRedis {
+	return &fakeRedis{
+		replies:  replies,
+		commands: make(chan []string, 20),
+		dialed:   make(chan string, 5),
+	}
+}
+
+func (f *fakeRedis) Dial(network, addr string, timeout time.Duration) (
+	net.Conn, error) {
+
+	f.dialed <- addr
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		for {
+			args, err := readRedisCommand(r)
+			if err != nil {
+				return
+			}
+			f.commands <- args
+			if _, err = io.WriteString(server, f.replies[args[0]]); err != nil {
+				return
+			}
+		}
+	}()
+	return client, nil
+}
+
+func TestRedisConn(t *testing.T) {
+	Convey("Redis connections", t, func() {
+		f := newFakeRedis(map[string]string{
+			"AUTH":     "+OK\r\n",
+			"SELECT":   "+OK\r\n",
+			"GET":      "$5\r\nhello\r\n",
+			"EXISTS":   ":1\r\n",
+			"MGET":     "*2\r\n$1\r\na\r\n$-1\r\n",
+			"MULTI":    "+OK\r\n",
+			"SET":      "+QUEUED\r\n",
+			"EXEC":     "*-1\r\n",
+			"DEL":      "-ERR wrong number of arguments\r\n",
+			"INCR":     "-READONLY You can't write against a read only replica.\r\n",
+			"SENTINEL": "*2\r\n$8\r\n10.0.0.2\r\n$4\r\n6380\r\n",
+		})
+		p := NewRedisPool(RedisPoolConf{
+			Server:   "127.0.0.1:6379",
+			Password: "s3cr3t",
+			Database: 2,
+			MaxIdle:  1,
+		})
+		p.dial = f.Dial
+		defer p.Close()
+
+		Convey("Should authenticate and select the database", func() {
+			c, err := p.Get()
+			So(err, ShouldBeNil)
+			So(<-f.dialed, ShouldEqual, "127.0.0.1:6379")
+			So(<-f.commands, ShouldResemble, []string{"AUTH", "s3cr3t"})
+			So(<-f.commands, ShouldResemble, []string{"SELECT", "2"})
+			p.Put(c)
+
+			// The idle connection is reused.
+			c2, err := p.Get()
+			So(err, ShouldBeNil)
+			So(c2, ShouldEqual, c)
+		})
+
+		Convey("Should decode replies", func() {
+			raw, err := redisBytes(p.Do("GET", "key"))
+			So(err, ShouldBeNil)
+			So(string(raw), ShouldEqual, "hello")
+
+			n, err := redisInt(p.Do("EXISTS", "key"))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+
+			values, err := redisStrings(p.Do("MGET", "a", "b"))
+			So(err, ShouldBeNil)
+			So(values, ShouldResemble, []string{"a", ""})
+
+			_, err = p.Do("DEL")
+			So(err, ShouldResemble, RedisError("ERR wrong number of arguments"))
+		})
+
+		Convey("Should pipeline transactions", func() {
+			c, err := p.Get()
+			So(err, ShouldBeNil)
+			c.Send("MULTI")
+			c.Send("SET", "key", "value")
+			reply, err := c.Do("EXEC")
+			So(err, ShouldBeNil)
+			So(reply, ShouldBeNil) // Aborted.
+			So(c.Err(), ShouldBeNil)
+		})
+
+		Convey("Should close connections to replicas", func() {
+			c, err := p.Get()
+			So(err, ShouldBeNil)
+			_, err = c.Do("INCR", "key")
+			So(err, ShouldResemble, RedisError(
+				"READONLY You can't write against a read only replica."))
+			So(c.Err(), ShouldNotBeNil)
+			p.Put(c)
+
+			// The connection is reopened after a failover.
+			c2, err := p.Get()
+			So(err, ShouldBeNil)
+			So(c2, ShouldNotEqual, c)
+		})
+
+		Convey("Should resolve the master from sentinels", func() {
+			p.conf.Sentinels = []string{"10.0.0.1:26379"}
+			p.conf.MasterName = "pushgo"
+			_, err := p.Get()
+			So(err, ShouldBeNil)
+			So(<-f.dialed, ShouldEqual, "10.0.0.1:26379")
+			So(<-f.commands, ShouldResemble,
+				[]string{"SENTINEL", "get-master-addr-by-name", "pushgo"})
+			So(<-f.dialed, ShouldEqual, "10.0.0.2:6380")
+		})
+	})
+}
@@ -0,0 +1,928 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mozilla-services/pushgo/id"
+)
+
+// maxRedisRetries is the number of times a transaction is retried if a
+// watched key changes.
+const maxRedisRetries = 10
+
+// NewRedisStore creates an unconfigured Redis adapter.
+func NewRedisStore() *RedisStore {
+	return &RedisStore{}
+}
+
+// RedisDriverConf specifies Redis driver options.
+type RedisDriverConf struct {
+	// Server is the address of a single Redis node. Ignored if sentinels are
+	// specified.
+	Server string `toml:"server" env:"server"`
+
+	// Sentinels are the addresses of Redis Sentinel nodes. If set, the adapter
+	// connects to the master named MasterName, and follows failovers.
+	Sentinels []string `toml:"sentinels" env:"sentinels"`
+
+	// MasterName is the name of the master monitored by the sentinels.
+	// Defaults to "mymaster".
+	MasterName string `toml:"master_name" env:"master_name"`
+
+	Password string `toml:"password" env:"password"`
+	Database int    `toml:"database" env:"database"`
+
+	// MaxIdle is the maximum number of idle connections. Defaults to 10.
+	MaxIdle int `toml:"max_idle" env:"max_idle"`
+}
+
+// RedisConf specifies Redis adapter options.
+type RedisConf struct {
+	MaxChannels int `toml:"max_channels" env:"max_channels"`
+
+	// KeyPrefix is prepended to all keys, so that several deployments can
+	// share a database. Defaults to "pushgo:".
+	KeyPrefix string          `toml:"key_prefix" env:"key_prefix"`
+	Driver    RedisDriverConf `toml:"redis" env:"redis"`
+	Db        DbConf
+}
+
+// RedisStore is a Redis adapter. Each device has a marker key, a set of
+// registered channel IDs, and a channel record per channel. Channel records
+// expire according to their state; the device keys are kept until the
+// device is dropped. Dead letters are stored as separate keys, and indexed
+// in a sorted set by failure time. Unlike memcached, Redis can persist records across
+// restarts if configured with RDB snapshots or an append-only file.
+type RedisStore struct {
+	KeyPrefix         string
+	PingPrefix        string
+	TombstonePrefix   string
+	DeadLetterPrefix  string
+	TimeoutLive       time.Duration
+	TimeoutReg        time.Duration
+	TimeoutDel        time.Duration
+	TimeoutTombstone  time.Duration
+	TimeoutDeadLetter time.Duration
+	HandleTimeout     time.Duration
+	RejectDecreasing  bool
+	maxChannels       int
+	logger            *SimpleLogger
+	pool              *RedisPool
+	cipher            *EnvelopeCipher
+	codec             *RecordCodec
+}
+
+// ConfigStruct returns a configuration object with defaults. Implements
+// HasConfigStruct.ConfigStruct().
+func (*RedisStore) ConfigStruct() interface{} {
+	return &RedisConf{
+		MaxChannels: 200,
+		KeyPrefix:   "pushgo:",
+		Driver: RedisDriverConf{
+			Server:     "127.0.0.1:6379",
+			MasterName: "mymaster",
+			MaxIdle:    10,
+		},
+		Db: DbConf{
+			TimeoutLive:       3 * 24 * 60 * 60,
+			TimeoutReg:        3 * 60 * 60,
+			TimeoutDel:        24 * 60 * 60,
+			HandleTimeout:     "5s",
+			PingPrefix:        "_pc-",
+			TombstonePrefix:   "_ts-",
+			TimeoutTombstone:  24 * 60 * 60,
+			DeadLetterPrefix:  "_dlq-",
+			TimeoutDeadLetter: 7 * 24 * 60 * 60,
+			Codec:             "json",
+		},
+	}
+}
+
+// Init initializes the Redis adapter with the given configuration.
+// Implements HasConfigStruct.Init().
+func (s *RedisStore) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*RedisConf)
+	s.logger = app.Logger()
+	s.maxChannels = conf.MaxChannels
+
+	s.KeyPrefix = conf.KeyPrefix
+	s.PingPrefix = conf.Db.PingPrefix
+	s.TombstonePrefix = conf.Db.TombstonePrefix
+	s.DeadLetterPrefix = conf.Db.DeadLetterPrefix
+
+	if s.cipher, err = conf.Db.RecordCipher(); err != nil {
+		s.logger.Panic("redis", "Db.EncryptionKey must be a valid AES key",
+			LogFields{"error": err.Error()})
+		return err
+	}
+
+	if s.codec, err = NewRecordCodec(conf.Db.Codec); err != nil {
+		s.logger.Panic("redis", "Db.Codec must be json, gob, or protobuf",
+			LogFields{"error": err.Error(), "codec": conf.Db.Codec})
+		return err
+	}
+
+	if s.HandleTimeout, err = time.ParseDuration(conf.Db.HandleTimeout); err != nil {
+		s.logger.Panic("redis", "Db.HandleTimeout must be a valid duration",
+			LogFields{"error": err.Error()})
+		return err
+	}
+
+	s.TimeoutLive = time.Duration(conf.Db.TimeoutLive) * time.Second
+	s.TimeoutReg = time.Duration(conf.Db.TimeoutReg) * time.Second
+	s.TimeoutDel = time.Duration(conf.Db.TimeoutDel) * time.Second
+	s.TimeoutTombstone = time.Duration(conf.Db.TimeoutTombstone) * time.Second
+	s.TimeoutDeadLetter = time.Duration(conf.Db.TimeoutDeadLetter) * time.Second
+	s.RejectDecreasing = conf.Db.RejectDecreasing
+
+	s.pool = NewRedisPool(RedisPoolConf{
+		Server:     conf.Driver.Server,
+		Sentinels:  conf.Driver.Sentinels,
+		MasterName: conf.Driver.MasterName,
+		Password:   conf.Driver.Password,
+		Database:   conf.Driver.Database,
+		MaxIdle:    conf.Driver.MaxIdle,
+		Timeout:    s.HandleTimeout,
+	})
+
+	return nil
+}
+
+// CanStore indicates whether the specified number of channel registrations
+// are allowed per client. Implements Store.CanStore().
+func (s *RedisStore) CanStore(channels int) bool {
+	return channels <= s.maxChannels
+}
+
+// Close closes the connection pool. Implements Store.Close().
+func (s *RedisStore) Close() error {
+	return s.pool.Close()
+}
+
+// KeyToIDs extracts the hex-encoded device and channel IDs from a user-
+// readable primary key. Implements Store.KeyToIDs().
+func (s *RedisStore) KeyToIDs(key string) (uaid, chid string, err error) {
+	if uaid, chid, err = splitIDs(key); err != nil {
+		if s.logger.ShouldLog(WARNING) {
+			s.logger.Warn("redis", "Invalid key",
+				LogFields{"error": err.Error(), "key": key})
+		}
+		return "", "", ErrInvalidKey
+	}
+	return
+}
+
+// IDsToKey generates a user-readable primary key from a (device ID, channel
+// ID) tuple. Implements Store.IDsToKey().
+func (s *RedisStore) IDsToKey(uaid, chid string) (string, error) {
+	logWarning := s.logger.ShouldLog(WARNING)
+	if len(uaid) == 0 {
+		if logWarning {
+			s.logger.Warn("redis", "Missing device ID",
+				LogFields{"uaid": uaid, "chid": chid})
+		}
+		return "", ErrInvalidKey
+	}
+	if len(chid) == 0 {
+		if logWarning {
+			s.logger.Warn("redis", "Missing channel ID",
+				LogFields{"uaid": uaid, "chid": chid})
+		}
+		return "", ErrInvalidKey
+	}
+	return joinIDs(uaid, chid), nil
+}
+
+// Status queries whether Redis is available for reading and writing.
+// Implements Store.Status().
+func (s *RedisStore) Status() (bool, error) {
+	fakeID, err := id.Generate()
+	if err != nil {
+		return false, err
+	}
+	key, expected := s.KeyPrefix+"status_"+fakeID, []byte("test")
+	if _, err = s.pool.Do("SET", key, string(expected), "EX", "6"); err != nil {
+		if s.logger.ShouldLog(ERROR) {
+			s.logger.Error("redis", "Error storing health check key",
+				LogFields{"error": err.Error(), "key": key})
+		}
+		return false, err
+	}
+	raw, err := redisBytes(s.pool.Do("GET", key))
+	if err != nil {
+		if s.logger.ShouldLog(ERROR) {
+			s.logger.Error("redis", "Error fetching health check key",
+				LogFields{"error": err.Error(), "key": key})
+		}
+		return false, err
+	}
+	if !bytes.Equal(raw, expected) {
+		if s.logger.ShouldLog(ERROR) {
+			s.logger.Error("redis", "Unexpected health check result",
+				LogFields{"expected": string(expected), "actual": string(raw)})
+		}
+		return false, ErrRedisStatus
+	}
+	s.pool.Do("DEL", key)
+	return true, nil
+}
+
+// Exists returns a Boolean indicating whether a device has previously
+// registered with the Simple Push server. Implements Store.Exists().
+func (s *RedisStore) Exists(uaid string) bool {
+	if ok, hasID := hasExistsHook(uaid); hasID {
+		return ok
+	}
+	if !id.Valid(uaid) {
+		return false
+	}
+	n, err := redisInt(s.pool.Do("EXISTS", s.deviceKey(uaid)))
+	if err != nil {
+		if s.logger.ShouldLog(ERROR) {
+			s.logger.Error("redis", "Exists encountered unknown error",
+				LogFields{"uaid": uaid, "error": err.Error()})
+		}
+		return false
+	}
+	return n > 0
+}
+
+// Register creates and stores a channel record for the given device ID and
+// channel ID. If version > 0, the record will be marked as active. Implements
+// Store.Register().
+func (s *RedisStore) Register(uaid, chid string, version int64) error {
+	if len(uaid) == 0 {
+		return ErrNoID
+	}
+	if len(chid) == 0 {
+		return ErrNoChannel
+	}
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	if !id.Valid(chid) {
+		return ErrInvalidChannel
+	}
+	c, err := s.pool.Get()
+	if err != nil {
+		return err
+	}
+	defer s.pool.Put(c)
+	// The tombstone is watched, so that the registration fails with
+	// ErrRecordUpdateFailed if the channel is unregistered concurrently.
+	pk := joinIDs(uaid, chid)
+	if _, err = c.Do("WATCH", s.tombstoneKey(pk)); err != nil {
+		return err
+	}
+	tombstoned, err := s.hasTombstone(c, pk)
+	if err != nil || tombstoned {
+		c.Do("UNWATCH")
+		if tombstoned {
+			return ErrChannelGone
+		}
+		return err
+	}
+	rec := &ChannelRecord{State: StateRegistered}
+	if version != 0 {
+		rec.State = StateLive
+		rec.Version = uint64(version)
+	}
+	return s.execRec(c, uaid, chid, rec, true)
+}
+
+// execRec stores a channel record in a transaction, adding the channel to the
+// device's channel set if register is true. Keys watched by the caller are
+// unwatched. Returns ErrRecordUpdateFailed if a watched key changed.
+func (s *RedisStore) execRec(c *RedisConn, uaid, chid string,
+	rec *ChannelRecord, register bool) error {
+
+	raw, ttl, err := s.encodeRec(rec)
+	if err != nil {
+		c.Do("UNWATCH")
+		return err
+	}
+	c.Send("MULTI")
+	if register {
+		c.Send("SET", s.deviceKey(uaid), "1")
+		c.Send("SADD", s.channelsKey(uaid), chid)
+	}
+	c.Send("SET", setArgs(s.recKey(joinIDs(uaid, chid)), raw, ttl)...)
+	reply, err := c.Do("EXEC")
+	if err != nil {
+		if s.logger.ShouldLog(ERROR) {
+			s.logger.Error("redis", "Could not store channel", LogFields{
+				"uaid":  uaid,
+				"chid":  chid,
+				"error": err.Error(),
+			})
+		}
+		return err
+	}
+	if reply == nil {
+		// A watched key changed before the transaction ran.
+		if s.logger.ShouldLog(WARNING) {
+			s.logger.Warn("redis", "Channel changed during update",
+				LogFields{"uaid": uaid, "chid": chid})
+		}
+		return ErrRecordUpdateFailed
+	}
+	return nil
+}
+
+// Update updates the version for the given device ID and channel ID.
+// Implements Store.Update().
+func (s *RedisStore) Update(uaid, chid string, version int64) error {
+	if len(uaid) == 0 {
+		return ErrNoID
+	}
+	if len(chid) == 0 {
+		return ErrNoChannel
+	}
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	if !id.Valid(chid) {
+		return ErrInvalidChannel
+	}
+	c, err := s.pool.Get()
+	if err != nil {
+		return err
+	}
+	defer s.pool.Put(c)
+	// The record and tombstone are watched, so that the update fails with
+	// ErrRecordUpdateFailed if the channel is unregistered concurrently.
+	pk := joinIDs(uaid, chid)
+	if _, err = c.Do("WATCH", s.recKey(pk), s.tombstoneKey(pk)); err != nil {
+		return err
+	}
+	// Reject updates for recently unregistered channels, even if the record
+	// was dropped, instead of registering them again.
+	tombstoned, err := s.hasTombstone(c, pk)
+	if err != nil || tombstoned {
+		c.Do("UNWATCH")
+		if tombstoned {
+			return ErrChannelGone
+		}
+		return err
+	}
+	cRec, err := s.decodeRec(redisBytes(c.Do("GET", s.recKey(pk))))
+	if err != nil {
+		c.Do("UNWATCH")
+		if s.logger.ShouldLog(ERROR) {
+			s.logger.Error("redis", "Update error", LogFields{
+				"pk":    pk,
+				"error": err.Error(),
+			})
+		}
+		return err
+	}
+	if cRec == nil || cRec.State == StateDeleted {
+		// No record found or the record was deleted.
+		if s.logger.ShouldLog(DEBUG) {
+			s.logger.Debug("redis", "Registering channel", LogFields{
+				"uaid":      uaid,
+				"channelID": chid,
+				"version":   strconv.FormatInt(version, 10),
+			})
+		}
+		rec := &ChannelRecord{State: StateRegistered}
+		if version != 0 {
+			rec.State = StateLive
+			rec.Version = uint64(version)
+		}
+		return s.execRec(c, uaid, chid, rec, true)
+	}
+	if s.RejectDecreasing && cRec.Version > uint64(version) {
+		c.Do("UNWATCH")
+		return ErrStaleVersion
+	}
+	return s.execRec(c, uaid, chid, &ChannelRecord{
+		State:   StateLive,
+		Version: uint64(version),
+	}, false)
+}
+
+// Unregister marks the channel ID associated with the given device ID
+// as inactive. Implements Store.Unregister().
+func (s *RedisStore) Unregister(uaid, chid string) error {
+	if len(uaid) == 0 {
+		return ErrNoID
+	}
+	if len(chid) == 0 {
+		return ErrNoChannel
+	}
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	if !id.Valid(chid) {
+		return ErrInvalidChannel
+	}
+	c, err := s.pool.Get()
+	if err != nil {
+		return err
+	}
+	defer s.pool.Put(c)
+	// The record is watched, so that a concurrent update or registration
+	// fails the transaction instead of overwriting the deleted record.
+	key := joinIDs(uaid, chid)
+	if _, err = c.Do("WATCH", s.recKey(key)); err != nil {
+		return err
+	}
+	registered, err := redisInt(c.Do("SISMEMBER", s.channelsKey(uaid), chid))
+	if err != nil || registered == 0 {
+		c.Do("UNWATCH")
+		if err != nil {
+			return err
+		}
+		if tombstoned, _ := s.hasTombstone(c, key); tombstoned {
+			return ErrChannelGone
+		}
+		return ErrNonexistentChannel
+	}
+	channel, err := s.decodeRec(redisBytes(c.Do("GET", s.recKey(key))))
+	if err != nil {
+		c.Do("UNWATCH")
+		if s.logger.ShouldLog(ERROR) {
+			s.logger.Error("redis", "Could not delete Channel",
+				LogFields{"pk": key, "error": err.Error()})
+		}
+		return ErrRecordUpdateFailed
+	}
+	if channel == nil {
+		channel = new(ChannelRecord)
+	}
+	channel.State = StateDeleted
+	raw, ttl, err := s.encodeRec(channel)
+	if err != nil {
+		c.Do("UNWATCH")
+		return ErrRecordUpdateFailed
+	}
+	c.Send("MULTI")
+	c.Send("SREM", s.channelsKey(uaid), chid)
+	if s.TimeoutTombstone > 0 {
+		c.Send("SET", setArgs(s.tombstoneKey(key),
+			[]byte(strconv.FormatInt(timeNow().UTC().Unix(), 10)),
+			s.TimeoutTombstone)...)
+	}
+	c.Send("SET", setArgs(s.recKey(key), raw, ttl)...)
+	reply, err := c.Do("EXEC")
+	if err != nil || reply == nil {
+		if s.logger.ShouldLog(ERROR) {
+			fields := LogFields{"pk": key}
+			if err != nil {
+				fields["error"] = err.Error()
+			}
+			s.logger.Error("redis", "Could not store deleted Channel", fields)
+		}
+		return ErrRecordUpdateFailed
+	}
+	return nil
+}
+
+// Drop removes a channel ID associated with the given device ID from Redis.
+// Deregistration calls should call s.Unregister() instead. Implements
+// Store.Drop().
+func (s *RedisStore) Drop(uaid, chid string) error {
+	if len(uaid) == 0 {
+		return ErrNoID
+	}
+	if len(chid) == 0 {
+		return ErrNoChannel
+	}
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	if !id.Valid(chid) {
+		return ErrInvalidChannel
+	}
+	c, err := s.pool.Get()
+	if err != nil {
+		return err
+	}
+	defer s.pool.Put(c)
+	c.Send("MULTI")
+	c.Send("SREM", s.channelsKey(uaid), chid)
+	c.Send("DEL", s.recKey(joinIDs(uaid, chid)))
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// FetchAll returns all channel updates and expired channels for a device ID
+// since the specified cutoff time. Implements Store.FetchAll().
+func (s *RedisStore) FetchAll(uaid string, since time.Time) (
+	[]Update, []string, error) {
+
+	if len(uaid) == 0 {
+		return nil, nil, ErrNoID
+	}
+	chids, err := redisStrings(s.pool.Do("SMEMBERS", s.channelsKey(uaid)))
+	if err != nil {
+		if s.logger.ShouldLog(ERROR) {
+			s.logger.Error("redis", "Error fetching channels for UAID",
+				LogFields{"uaid": uaid, "error": err.Error()})
+		}
+		return nil, nil, err
+	}
+	updates := make([]Update, 0, 20)
+	expired := make([]string, 0, 20)
+	if len(chids) == 0 {
+		return updates, expired, nil
+	}
+	sort.Strings(chids)
+
+	keys := make([]string, len(chids))
+	for i, chid := range chids {
+		keys[i] = s.recKey(joinIDs(uaid, chid))
+	}
+	reply, err := s.pool.Do("MGET", keys...)
+	if err != nil {
+		return nil, nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != len(chids) {
+		return nil, nil, ErrRedisProtocol
+	}
+
+	sinceUnix := since.Unix()
+	for index, item := range items {
+		raw, ok := item.([]byte)
+		if !ok {
+			continue
+		}
+		chid := chids[index]
+		channel := new(ChannelRecord)
+		if err = s.codec.Unmarshal(raw, channel); err != nil {
+			if s.logger.ShouldLog(ERROR) {
+				s.logger.Error("redis", "Could not unmarshal rec", LogFields{
+					"uaid":  uaid,
+					"chid":  chid,
+					"error": err.Error(),
+				})
+			}
+			continue
+		}
+		if channel.LastTouched < sinceUnix {
+			continue
+		}
+		switch channel.State {
+		case StateLive:
+			version := channel.Version
+			if version == 0 {
+				version = uint64(timeNow().UTC().Unix())
+			}
+			updates = append(updates, Update{
+				ChannelID: chid,
+				Version:   version,
+			})
+		case StateDeleted:
+			expired = append(expired, chid)
+		case StateRegistered:
+			// Item registered, but not yet active. Ignore it.
+		default:
+			if s.logger.ShouldLog(WARNING) {
+				s.logger.Warn("redis", "Unknown state", LogFields{
+					"uaid": uaid,
+					"chid": chid,
+				})
+			}
+		}
+	}
+	return updates, expired, nil
+}
+
+// DropAll removes all channel records for the given device ID. Implements
+// Store.DropAll().
+func (s *RedisStore) DropAll(uaid string) error {
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	c, err := s.pool.Get()
+	if err != nil {
+		return err
+	}
+	defer s.pool.Put(c)
+	// The channel set is watched, so that the transaction is retried if a
+	// channel is registered concurrently, instead of leaving its record.
+	for i := 0; i < maxRedisRetries; i++ {
+		if _, err = c.Do("WATCH", s.channelsKey(uaid)); err != nil {
+			return err
+		}
+		chids, err := redisStrings(c.Do("SMEMBERS", s.channelsKey(uaid)))
+		if err != nil {
+			c.Do("UNWATCH")
+			return err
+		}
+		keys := make([]string, 0, len(chids)+2)
+		for _, chid := range chids {
+			keys = append(keys, s.recKey(joinIDs(uaid, chid)))
+		}
+		keys = append(keys, s.channelsKey(uaid), s.deviceKey(uaid))
+		c.Send("MULTI")
+		c.Send("DEL", keys...)
+		reply, err := c.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			return nil
+		}
+	}
+	if s.logger.ShouldLog(WARNING) {
+		s.logger.Warn("redis", "Channels changed while dropping device",
+			LogFields{"uaid": uaid})
+	}
+	return ErrRecordUpdateFailed
+}
+
+// FetchPing retrieves proprietary ping information for the given device ID
+// from Redis. Implements Store.FetchPing().
+func (s *RedisStore) FetchPing(uaid string) ([]byte, error) {
+	if len(uaid) == 0 {
+		return nil, ErrNoID
+	}
+	if !id.Valid(uaid) {
+		return nil, ErrInvalidID
+	}
+	raw, err := redisBytes(s.pool.Do("GET", s.KeyPrefix+s.PingPrefix+uaid))
+	if err != nil {
+		return nil, err
+	}
+	return s.cipher.Open(raw)
+}
+
+// PutPing stores the proprietary ping info blob for the given device ID in
+// Redis. Implements Store.PutPing().
+func (s *RedisStore) PutPing(uaid string, pingData []byte) error {
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	sealed, err := s.cipher.Seal(pingData)
+	if err != nil {
+		return err
+	}
+	_, err = s.pool.Do("SET", s.KeyPrefix+s.PingPrefix+uaid, string(sealed))
+	return err
+}
+
+// DropPing removes all proprietary ping info for the given device ID.
+// Implements Store.DropPing().
+func (s *RedisStore) DropPing(uaid string) error {
+	if len(uaid) == 0 {
+		return ErrNoID
+	}
+	if !id.Valid(uaid) {
+		return ErrInvalidID
+	}
+	_, err := s.pool.Do("DEL", s.KeyPrefix+s.PingPrefix+uaid)
+	return err
+}
+
+// HasTombstone indicates whether the channel ID associated with the given
+// device ID was recently unregistered. Implements TombstoneStore.HasTombstone().
+func (s *RedisStore) HasTombstone(uaid, chid string) (bool, error) {
+	if len(uaid) == 0 {
+		return false, ErrNoID
+	}
+	if len(chid) == 0 {
+		return false, ErrNoChannel
+	}
+	if !id.Valid(uaid) {
+		return false, ErrInvalidID
+	}
+	if !id.Valid(chid) {
+		return false, ErrInvalidChannel
+	}
+	return s.hasTombstone(s.pool, joinIDs(uaid, chid))
+}
+
+// PutDeadLetter stores a failed update, and adds it to the dead letter index.
+// Expired updates are removed from the index. Implements
+// DeadLetterStore.PutDeadLetter().
+func (s *RedisStore) PutDeadLetter(letter *DeadLetter) error {
+	raw, err := s.codec.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	c, err := s.pool.Get()
+	if err != nil {
+		return err
+	}
+	defer s.pool.Put(c)
+	c.Send("MULTI")
+	c.Send("SET", setArgs(s.deadLetterKey(letter.ID), raw,
+		s.TimeoutDeadLetter)...)
+	c.Send("ZADD", s.deadLetterKey("index"),
+		strconv.FormatInt(letter.FailedAt, 10), letter.ID)
+	s.sendPruneDeadLetters(c)
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// FetchDeadLetters returns up to limit failed updates, oldest first. Expired
+// updates are removed from the index. Implements
+// DeadLetterStore.FetchDeadLetters().
+func (s *RedisStore) FetchDeadLetters(limit int) ([]*DeadLetter, error) {
+	last := -1
+	if limit > 0 {
+		last = limit - 1
+	}
+	c, err := s.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer s.pool.Put(c)
+	c.Send("MULTI")
+	s.sendPruneDeadLetters(c)
+	c.Send("ZRANGE", s.deadLetterKey("index"), "0", strconv.Itoa(last))
+	reply, err := c.Do("EXEC")
+	if err != nil {
+		return nil, err
+	}
+	results, ok := reply.([]interface{})
+	if !ok || len(results) == 0 {
+		return nil, ErrRedisProtocol
+	}
+	letterIDs, err := redisStrings(results[len(results)-1], nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(letterIDs) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(letterIDs))
+	for i, letterID := range letterIDs {
+		keys[i] = s.deadLetterKey(letterID)
+	}
+	if reply, err = c.Do("MGET", keys...); err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != len(letterIDs) {
+		return nil, ErrRedisProtocol
+	}
+	letters := make([]*DeadLetter, 0, len(items))
+	for _, item := range items {
+		raw, ok := item.([]byte)
+		if !ok {
+			// Dropped concurrently.
+			continue
+		}
+		letter := new(DeadLetter)
+		if err = s.codec.Unmarshal(raw, letter); err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+// FetchDeadLetter returns the failed update with the given ID. Implements
+// DeadLetterStore.FetchDeadLetter().
+func (s *RedisStore) FetchDeadLetter(letterID string) (*DeadLetter, error) {
+	if !id.Valid(letterID) {
+		return nil, ErrNoDeadLetter
+	}
+	raw, err := redisBytes(s.pool.Do("GET", s.deadLetterKey(letterID)))
+	if err != nil {
+		if err == ErrRedisNil {
+			return nil, ErrNoDeadLetter
+		}
+		return nil, err
+	}
+	letter := new(DeadLetter)
+	if err = s.codec.Unmarshal(raw, letter); err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+// DropDeadLetter removes a failed update and its index entry. Implements
+// DeadLetterStore.DropDeadLetter().
+func (s *RedisStore) DropDeadLetter(letterID string) error {
+	if !id.Valid(letterID) {
+		return ErrNoDeadLetter
+	}
+	c, err := s.pool.Get()
+	if err != nil {
+		return err
+	}
+	defer s.pool.Put(c)
+	c.Send("MULTI")
+	c.Send("DEL", s.deadLetterKey(letterID))
+	c.Send("ZREM", s.deadLetterKey("index"), letterID)
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// sendPruneDeadLetters queues a command that removes expired updates from
+// the dead letter index, as part of a transaction.
+func (s *RedisStore) sendPruneDeadLetters(c *RedisConn) {
+	if s.TimeoutDeadLetter <= 0 {
+		return
+	}
+	cutoff := timeNow().UTC().Unix() - int64(s.TimeoutDeadLetter/time.Second)
+	c.Send("ZREMRANGEBYSCORE", s.deadLetterKey("index"), "-inf",
+		"("+strconv.FormatInt(cutoff, 10))
+}
+
+// hasTombstone indicates whether a channel was recently unregistered.
+func (s *RedisStore) hasTombstone(r redisDoer, pk string) (bool, error) {
+	if s.TimeoutTombstone <= 0 {
+		return false, nil
+	}
+	n, err := redisInt(r.Do("EXISTS", s.tombstoneKey(pk)))
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// deviceKey returns the key of the device marker, which is kept after all
+// the device's channels are unregistered.
+func (s *RedisStore) deviceKey(uaid string) string {
+	return s.KeyPrefix + uaid
+}
+
+// channelsKey returns the key of the device's channel ID set.
+func (s *RedisStore) channelsKey(uaid string) string {
+	return s.KeyPrefix + uaid + ":chids"
+}
+
+// recKey returns the key of a channel record.
+func (s *RedisStore) recKey(pk string) string {
+	return s.KeyPrefix + pk
+}
+
+// tombstoneKey returns the key of a channel tombstone.
+func (s *RedisStore) tombstoneKey(pk string) string {
+	return s.KeyPrefix + s.TombstonePrefix + pk
+}
+
+// deadLetterKey returns the key of a dead letter, or of the dead letter
+// index if letterID is "index".
+func (s *RedisStore) deadLetterKey(letterID string) string {
+	return s.KeyPrefix + s.DeadLetterPrefix + letterID
+}
+
+// encodeRec touches and encodes a channel record, returning the record
+// timeout.
+func (s *RedisStore) encodeRec(rec *ChannelRecord) (raw []byte,
+	ttl time.Duration, err error) {
+
+	rec.LastTouched = timeNow().UTC().Unix()
+	if raw, err = s.codec.Marshal(rec); err != nil {
+		if s.logger.ShouldLog(ERROR) {
+			s.logger.Error("redis", "Failure to marshal item",
+				LogFields{"error": err.Error()})
+		}
+		return nil, 0, err
+	}
+	return raw, s.recTTL(rec.State), nil
+}
+
+// setArgs returns the arguments of a SET command that stores value, expiring
+// after ttl. Values without a timeout don't expire.
+func setArgs(key string, value []byte, ttl time.Duration) []string {
+	if seconds := int64(ttl.Seconds()); seconds > 0 {
+		return []string{key, string(value), "EX", strconv.FormatInt(seconds, 10)}
+	}
+	return []string{key, string(value)}
+}
+
+// decodeRec decodes a channel record read with redisBytes. Returns a nil
+// record if the record does not exist.
+func (s *RedisStore) decodeRec(raw []byte, err error) (*ChannelRecord, error) {
+	if err != nil {
+		if err == ErrRedisNil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	rec := new(ChannelRecord)
+	if err = s.codec.Unmarshal(raw, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// recTTL returns the timeout for a channel record in the given state.
+func (s *RedisStore) recTTL(state ChannelState) time.Duration {
+	switch state {
+	case StateDeleted:
+		return s.TimeoutDel
+	case StateRegistered:
+		return s.TimeoutReg
+	}
+	return s.TimeoutLive
+}
+
+func init() {
+	AvailableStores["redis"] = func() HasConfigStruct { return NewRedisStore() }
+}
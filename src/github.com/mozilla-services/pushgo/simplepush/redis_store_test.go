@@ -0,0 +1,218 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func setupRedis(t *testing.T) (testRs *RedisStore, connected bool) {
+	testRs = NewRedisStore()
+	conf := testRs.ConfigStruct().(*RedisConf)
+	conf.KeyPrefix = "pushgo-test:"
+	testApp := &Application{}
+	testRs.Init(testApp, conf)
+	testRs.logger, _ = NewLogger(&TestLogger{DEBUG, t})
+	c, err := net.Dial("tcp", conf.Driver.Server)
+	if err != nil {
+		return testRs, false
+	}
+	c.Close()
+	return testRs, true
+}
+
+func Test_RedisConfigStruct(t *testing.T) {
+	testRs := NewRedisStore()
+	if _, ok := testRs.ConfigStruct().(*RedisConf); !ok {
+		t.Error("RedisStore invalid configuration struct")
+	}
+}
+
+func Test_RedisStatus(t *testing.T) {
+	testRs, connected := setupRedis(t)
+	if !connected {
+		t.Skip("Skipping Status check, no server.")
+	}
+	defer testRs.Close()
+
+	if success, err := testRs.Status(); !success || err != nil {
+		t.Errorf("Status failed: %v", err)
+	}
+}
+
+func Test_RedisRegister(t *testing.T) {
+	testRs, connected := setupRedis(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testRs.Close()
+	defer testRs.DropAll(TESTUAID)
+
+	if err := testRs.Register(TESTUAID, TESTCHID, 0); err != nil {
+		t.Errorf("Register returned error: %v", err)
+	}
+	if !testRs.Exists(TESTUAID) {
+		t.Error("Exists could not locate registered device")
+	}
+	if testRs.Exists(TESTCHID) {
+		t.Error("Exists found unregistered device")
+	}
+	if err := testRs.Register("", TESTCHID, 0); err != ErrNoID {
+		t.Errorf("Register accepted missing device ID: %v", err)
+	}
+	if err := testRs.Register(TESTUAID, "invalid", 0); err != ErrInvalidChannel {
+		t.Errorf("Register accepted invalid channel ID: %v", err)
+	}
+	// Registered channels are not returned until updated.
+	updates, expired, err := testRs.FetchAll(TESTUAID, time.Time{})
+	if err != nil || len(updates) != 0 || len(expired) != 0 {
+		t.Errorf("FetchAll returned registered channel: %v, %v, %v",
+			updates, expired, err)
+	}
+}
+
+func Test_RedisUpdate(t *testing.T) {
+	testRs, connected := setupRedis(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testRs.Close()
+	defer testRs.DropAll(TESTUAID)
+
+	testRs.Register(TESTUAID, TESTCHID, 0)
+	if err := testRs.Update(TESTUAID, TESTCHID, 12345); err != nil {
+		t.Errorf("Update returned error: %v", err)
+	}
+	updates, _, err := testRs.FetchAll(TESTUAID, time.Time{})
+	if err != nil {
+		t.Errorf("FetchAll returned error: %v", err)
+	}
+	if len(updates) != 1 || updates[0].ChannelID != TESTCHID ||
+		updates[0].Version != 12345 {
+		t.Errorf("FetchAll returned wrong updates: %v", updates)
+	}
+
+	testRs.RejectDecreasing = true
+	if err := testRs.Update(TESTUAID, TESTCHID, 123); err != ErrStaleVersion {
+		t.Errorf("Update accepted decreasing version: %v", err)
+	}
+}
+
+func Test_RedisUnregister(t *testing.T) {
+	testRs, connected := setupRedis(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testRs.Close()
+	defer testRs.DropAll(TESTUAID)
+	pk := joinIDs(TESTUAID, TESTCHID)
+	defer testRs.pool.Do("DEL", testRs.tombstoneKey(pk))
+
+	testRs.Register(TESTUAID, TESTCHID, 12345)
+	if err := testRs.Unregister(TESTUAID, TESTCHID); err != nil {
+		t.Errorf("Unregister returned error: %v", err)
+	}
+	if err := testRs.Unregister(TESTUAID, TESTCHID); err != ErrChannelGone {
+		t.Errorf("Unregister failed to reject unregistered channel: %v", err)
+	}
+	if err := testRs.Update(TESTUAID, TESTCHID, 67890); err != ErrChannelGone {
+		t.Errorf("Update failed to reject unregistered channel: %v", err)
+	}
+	if gone, err := testRs.HasTombstone(TESTUAID, TESTCHID); !gone || err != nil {
+		t.Errorf("HasTombstone failed to find tombstone: %v", err)
+	}
+	// The device is kept after its last channel is unregistered.
+	if !testRs.Exists(TESTUAID) {
+		t.Error("Exists could not locate device without channels")
+	}
+}
+
+func Test_RedisDrop(t *testing.T) {
+	testRs, connected := setupRedis(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testRs.Close()
+
+	testRs.Register(TESTUAID, TESTCHID, 12345)
+	if err := testRs.Drop(TESTUAID, TESTCHID); err != nil {
+		t.Errorf("Drop returned error: %v", err)
+	}
+	updates, _, _ := testRs.FetchAll(TESTUAID, time.Time{})
+	if len(updates) != 0 {
+		t.Errorf("FetchAll returned dropped channel: %v", updates)
+	}
+	if err := testRs.DropAll(TESTUAID); err != nil {
+		t.Errorf("DropAll returned error: %v", err)
+	}
+	if testRs.Exists(TESTUAID) {
+		t.Error("Exists found dropped device")
+	}
+}
+
+func Test_RedisPing(t *testing.T) {
+	testRs, connected := setupRedis(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testRs.Close()
+
+	if err := testRs.PutPing(TESTUAID, []byte("ping data")); err != nil {
+		t.Errorf("PutPing returned error: %v", err)
+	}
+	if data, err := testRs.FetchPing(TESTUAID); string(data) != "ping data" {
+		t.Errorf("FetchPing returned wrong data: %q, %v", data, err)
+	}
+	if err := testRs.DropPing(TESTUAID); err != nil {
+		t.Errorf("DropPing returned error: %v", err)
+	}
+	if _, err := testRs.FetchPing(TESTUAID); err != ErrRedisNil {
+		t.Errorf("FetchPing returned dropped ping: %v", err)
+	}
+}
+
+func Test_RedisDeadLetters(t *testing.T) {
+	testRs, connected := setupRedis(t)
+	if !connected {
+		t.Skip("Skipping, no server.")
+	}
+	defer testRs.Close()
+
+	first := &DeadLetter{ID: "d1c7c768b1be4c7093a69b52910d4baa", UAID: TESTUAID,
+		ChannelID: TESTCHID, Version: 1, Data: "hello", Reason: "timeout",
+		FailedAt: timeNow().Unix() - 1, Attempts: 3}
+	second := &DeadLetter{ID: "5e1e5984569c4f00bf4bea47754a6403", UAID: TESTUAID,
+		ChannelID: TESTCHID, Version: 2, Reason: "timeout",
+		FailedAt: timeNow().Unix(), Attempts: 1}
+	defer testRs.DropDeadLetter(first.ID)
+	defer testRs.DropDeadLetter(second.ID)
+	for _, letter := range []*DeadLetter{first, second} {
+		if err := testRs.PutDeadLetter(letter); err != nil {
+			t.Fatalf("PutDeadLetter returned error: %v", err)
+		}
+	}
+	letters, err := testRs.FetchDeadLetters(1)
+	if err != nil || len(letters) != 1 || *letters[0] != *first {
+		t.Errorf("FetchDeadLetters returned wrong letters: %v, %v", letters, err)
+	}
+	if letter, err := testRs.FetchDeadLetter(second.ID); err != nil ||
+		*letter != *second {
+
+		t.Errorf("FetchDeadLetter returned wrong letter: %v, %v", letter, err)
+	}
+	if err = testRs.DropDeadLetter(first.ID); err != nil {
+		t.Errorf("DropDeadLetter returned error: %v", err)
+	}
+	if _, err = testRs.FetchDeadLetter(first.ID); err != ErrNoDeadLetter {
+		t.Errorf("FetchDeadLetter returned dropped letter: %v", err)
+	}
+	if letters, err = testRs.FetchDeadLetters(0); err != nil ||
+		len(letters) != 1 || *letters[0] != *second {
+
+		t.Errorf("FetchDeadLetters returned dropped letter: %v, %v", letters, err)
+	}
+}
@@ -0,0 +1,324 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/bbangert/toml"
+	"github.com/kitcambridge/envconf"
+)
+
+// Reloadable is an optional interface implemented by plugins with settings
+// that can change at runtime.
+type Reloadable interface {
+	// ReloadableSettings returns the names of the settings that can change
+	// at runtime, relative to the plugin's section. Nested settings are
+	// dotted; e.g., "listener.max_connections".
+	ReloadableSettings() []string
+
+	// Reload applies the reloadable settings in config, a value returned by
+	// ConfigStruct. Other settings in config are unchanged.
+	Reload(config interface{}) error
+}
+
+// reloadSection is a configuration section that can be reloaded.
+type reloadSection struct {
+	name       string
+	extensible bool // Whether the section has a type keyword.
+	plugin     func(*Application) interface{}
+}
+
+// reloadSections lists the sections checked for changes, in load order.
+// Changes to the optional [dead_letters], [tenants], and [control] sections,
+// and virtual servers, are not checked; tenant settings are refreshed
+// separately.
+var reloadSections = []reloadSection{
+	{"default", false, func(app *Application) interface{} { return app }},
+	{"logging", true, func(app *Application) interface{} { return app.Logger().Logger }},
+	{"metrics", false, func(app *Application) interface{} { return app.Metrics() }},
+	{"storage", true, func(app *Application) interface{} { return app.Store() }},
+	{"propping", true, func(app *Application) interface{} { return app.PropPinger() }},
+	{"router", true, func(app *Application) interface{} { return app.Router() }},
+	{"discovery", true, func(app *Application) interface{} { return app.Locator() }},
+	{"websocket", false, func(app *Application) interface{} { return app.SocketHandler() }},
+	{"balancer", true, func(app *Application) interface{} { return app.Balancer() }},
+	{"endpoint", false, func(app *Application) interface{} { return app.EndpointHandler() }},
+	{"profile", false, func(app *Application) interface{} { return app.ProfileHandlers() }},
+	{"admin", false, func(app *Application) interface{} { return app.AdminHandlers() }},
+}
+
+// ConfigReloader applies configuration changes without restarting. Each
+// section is compared with the settings in effect; changed settings that the
+// section's plugin can reload are applied, and other changes are logged and
+// ignored until the next restart. A configuration that fails to decode is
+// rejected entirely; if a plugin fails to apply its changes, the remaining
+// sections are not reloaded. Environment variables override the file, as at startup.
+type ConfigReloader struct {
+	app       *Application
+	logger    *SimpleLogger
+	metrics   Statistician
+	env       envconf.Environment
+	logging   int // The minimum log level set on the command line.
+	reloadMux sync.Mutex
+	initial   ConfigFile               // The configuration loaded at startup.
+	current   map[string]*reloadConfig // Settings in effect, by section name.
+}
+
+// NewConfigReloader creates a reloader for an application loaded from
+// configFile.
+func NewConfigReloader(app *Application, configFile ConfigFile,
+	env envconf.Environment, logging int) *ConfigReloader {
+
+	return &ConfigReloader{
+		app:     app,
+		logger:  app.Logger(),
+		metrics: app.Metrics(),
+		env:     env,
+		logging: logging,
+		initial: configFile,
+	}
+}
+
+// ReloadFile re-reads the configuration file, and applies changed settings.
+func (r *ConfigReloader) ReloadFile(filename string) error {
+	var configFile ConfigFile
+	if _, err := toml.DecodeFile(filename, &configFile); err != nil {
+		err = fmt.Errorf("Error decoding config file: %s", err)
+		r.logFailure(err)
+		return err
+	}
+	return r.Reload(configFile)
+}
+
+// Reload applies the changed settings in configFile.
+func (r *ConfigReloader) Reload(configFile ConfigFile) (err error) {
+	r.reloadMux.Lock()
+	defer r.reloadMux.Unlock()
+
+	if r.current == nil {
+		if r.current, err = r.decodeAll(r.initial, nil); err != nil {
+			r.logFailure(err)
+			return err
+		}
+	}
+	updated, err := r.decodeAll(configFile, r.current)
+	if err != nil {
+		r.logFailure(err)
+		return err
+	}
+	for _, section := range reloadSections {
+		plugin, ok := section.plugin(r.app).(HasConfigStruct)
+		if !ok {
+			continue
+		}
+		current, next := r.current[section.name], updated[section.name]
+		if err = r.applySection(section.name, plugin, current, next); err != nil {
+			r.logFailure(err)
+			return err
+		}
+		r.current[section.name] = next
+	}
+	if r.logging > 0 {
+		// The command-line log level overrides the configuration file.
+		r.logger.Logger.SetFilter(LogLevel(r.logging))
+	}
+	if r.logger.ShouldLog(INFO) {
+		r.logger.Info("reload", "Reloaded configuration", nil)
+	}
+	r.metrics.Increment("config.reload.success")
+	return nil
+}
+
+// applySection applies the changes between the current and next settings
+// for a section. Settings that the plugin can't reload are reset to their
+// current values in next.
+func (r *ConfigReloader) applySection(name string, plugin HasConfigStruct,
+	current, next *reloadConfig) error {
+
+	if current == nil || next == nil {
+		return nil
+	}
+	if current.typ != next.typ {
+		r.reject(name, "type")
+		*next = *current
+		return nil
+	}
+	var allowed []string
+	reloadable, ok := plugin.(Reloadable)
+	if ok {
+		allowed = reloadable.ReloadableSettings()
+	}
+	var changed []string
+	for _, setting := range diffSettings("", reflect.ValueOf(current.conf),
+		reflect.ValueOf(next.conf)) {
+
+		if !hasSetting(allowed, setting.name) {
+			r.reject(name, setting.name)
+			setting.next.Set(setting.current)
+			continue
+		}
+		changed = append(changed, setting.name)
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	if err := reloadable.Reload(next.conf); err != nil {
+		return fmt.Errorf("Could not reload section '%s': %s", name, err)
+	}
+	if r.logger.ShouldLog(INFO) {
+		r.logger.Info("reload", "Applied changed settings", LogFields{
+			"section": name, "settings": strings.Join(changed, ",")})
+	}
+	return nil
+}
+
+// reject logs a change to a setting that can't be reloaded.
+func (r *ConfigReloader) reject(section, setting string) {
+	if r.logger.ShouldLog(WARNING) {
+		r.logger.Warn("reload",
+			"Setting cannot be changed without a restart; ignoring change",
+			LogFields{"section": section, "setting": setting})
+	}
+	r.metrics.Increment("config.reload.rejected")
+}
+
+func (r *ConfigReloader) logFailure(err error) {
+	if r.logger.ShouldLog(ERROR) {
+		r.logger.Error("reload", "Could not reload configuration",
+			LogFields{"error": err.Error()})
+	}
+	r.metrics.Increment("config.reload.error")
+}
+
+// reloadConfig is a section's type keyword and decoded settings.
+type reloadConfig struct {
+	typ  string
+	conf interface{} // A value returned by the plugin's ConfigStruct.
+}
+
+// decodeAll decodes the settings of each reloadable section in configFile.
+// Extensible sections with a different type than in current are not
+// decoded, since their settings belong to a plugin that isn't loaded.
+func (r *ConfigReloader) decodeAll(configFile ConfigFile,
+	current map[string]*reloadConfig) (configs map[string]*reloadConfig, err error) {
+
+	configs = make(map[string]*reloadConfig, len(reloadSections))
+	for _, section := range reloadSections {
+		plugin, ok := section.plugin(r.app).(HasConfigStruct)
+		if !ok {
+			continue
+		}
+		config, err := r.decode(section, plugin, configFile, current[section.name])
+		if err != nil {
+			return nil, err
+		}
+		configs[section.name] = config
+	}
+	return configs, nil
+}
+
+// decode decodes a section's settings, and applies environment overrides.
+// Sections omitted from configFile use the plugin's defaults.
+func (r *ConfigReloader) decode(section reloadSection, plugin HasConfigStruct,
+	configFile ConfigFile, current *reloadConfig) (config *reloadConfig, err error) {
+
+	config = new(reloadConfig)
+	conf, ok := configFile[section.name]
+	if !section.extensible {
+		if config.conf = plugin.ConfigStruct(); config.conf == nil {
+			return nil, nil
+		}
+		if ok {
+			if err = toml.PrimitiveDecode(conf, config.conf); err != nil {
+				return nil, fmt.Errorf("Unable to decode config for section '%s': %s",
+					section.name, err)
+			}
+		}
+		if err = r.env.Decode(toEnvName(section.name), EnvSep, config.conf); err != nil {
+			return nil, fmt.Errorf("Invalid environment variable for section '%s': %s",
+				section.name, err)
+		}
+		return config, nil
+	}
+	if !ok {
+		return nil, fmt.Errorf("Missing section '%s'", section.name)
+	}
+	globals := new(ExtensibleGlobals)
+	if err = toml.PrimitiveDecode(conf, globals); err != nil {
+		return nil, err
+	}
+	if err = r.env.Decode(toEnvName(section.name), EnvSep, globals); err != nil {
+		return nil, err
+	}
+	config.typ = globals.Typ
+	if current != nil && current.typ != config.typ {
+		return config, nil
+	}
+	if config.conf, err = LoadConfigStruct(section.name, r.env, conf, plugin); err != nil {
+		return nil, err
+	}
+	if config.conf == nil {
+		return nil, nil
+	}
+	return config, nil
+}
+
+// changedSetting is a setting that differs between two decoded sections.
+type changedSetting struct {
+	name    string
+	current reflect.Value
+	next    reflect.Value
+}
+
+// diffSettings compares two config structs of the same type, and returns
+// the changed settings. Nested structs are compared field by field.
+func diffSettings(prefix string, current, next reflect.Value) (
+	changed []changedSetting) {
+
+	if current.Kind() == reflect.Ptr && !current.IsNil() && !next.IsNil() {
+		current, next = current.Elem(), next.Elem()
+	}
+	if current.Kind() != reflect.Struct {
+		if !reflect.DeepEqual(current.Interface(), next.Interface()) {
+			changed = append(changed, changedSetting{prefix, current, next})
+		}
+		return changed
+	}
+	typ := current.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue // Unexported.
+		}
+		name := settingName(field)
+		if len(prefix) > 0 {
+			name = prefix + "." + name
+		}
+		changed = append(changed, diffSettings(name, current.Field(i),
+			next.Field(i))...)
+	}
+	return changed
+}
+
+// settingName returns the configuration key for a config struct field.
+func settingName(field reflect.StructField) string {
+	if name := field.Tag.Get("toml"); len(name) > 0 {
+		return name
+	}
+	return strings.ToLower(field.Name)
+}
+
+func hasSetting(settings []string, name string) bool {
+	for _, setting := range settings {
+		if setting == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bbangert/toml"
+	"github.com/kitcambridge/envconf"
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var reloadSource = `
+[default]
+current_host = "push.example.com"
+client_min_ping_interval = "20s"
+client_hello_timeout = "30s"
+
+[balancer]
+type = "static"
+threshold = 0.5
+redirects = ["wss://push-1.example.com"]
+`
+
+func decodeReloadSource(t *testing.T, source string) ConfigFile {
+	var configFile ConfigFile
+	if _, err := toml.Decode(source, &configFile); err != nil {
+		t.Fatalf("Error decoding config file: %s", err)
+	}
+	return configFile
+}
+
+func TestConfigReloader(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Configuration reloading", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.hostname = "push.example.com"
+		app.clientMinPing = 20 * time.Second
+		app.clientHelloTimeout = 30 * time.Second
+		balancer := &StaticBalancer{
+			threshold: 0.5,
+			redirects: []string{"wss://push-1.example.com"},
+		}
+		app.SetBalancer(balancer)
+		r := NewConfigReloader(app, decodeReloadSource(t, reloadSource),
+			envconf.New(nil), 0)
+
+		Convey("Should apply reloadable settings", func() {
+			mckStat.EXPECT().Increment("config.reload.success")
+			err := r.Reload(decodeReloadSource(t, `
+[default]
+current_host = "push.example.com"
+client_min_ping_interval = "45s"
+client_hello_timeout = "1m"
+
+[balancer]
+type = "static"
+threshold = 0.8
+redirects = ["wss://push-1.example.com"]
+`))
+			So(err, ShouldBeNil)
+			So(app.clientMinPing, ShouldEqual, 45*time.Second)
+			So(app.clientHelloTimeout, ShouldEqual, time.Minute)
+			So(balancer.threshold, ShouldEqual, 0.8)
+
+			Convey("Should revert reloaded settings", func() {
+				mckStat.EXPECT().Increment("config.reload.success")
+				So(r.Reload(decodeReloadSource(t, reloadSource)), ShouldBeNil)
+				So(app.clientMinPing, ShouldEqual, 20*time.Second)
+				So(balancer.threshold, ShouldEqual, 0.5)
+			})
+		})
+
+		Convey("Should ignore changes to immutable settings", func() {
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("config.reload.rejected").Times(2),
+				mckStat.EXPECT().Increment("config.reload.success"),
+			)
+			err := r.Reload(decodeReloadSource(t, `
+[default]
+current_host = "push-2.example.com"
+client_min_ping_interval = "45s"
+client_hello_timeout = "30s"
+
+[balancer]
+type = "static"
+threshold = 0.5
+redirects = ["wss://push-2.example.com"]
+`))
+			So(err, ShouldBeNil)
+			So(app.Hostname(), ShouldEqual, "push.example.com")
+			So(app.clientMinPing, ShouldEqual, 45*time.Second)
+			So(balancer.redirects, ShouldResemble,
+				[]string{"wss://push-1.example.com"})
+
+			Convey("Should keep rejecting changes until restarted", func() {
+				gomock.InOrder(
+					mckStat.EXPECT().Increment("config.reload.rejected"),
+					mckStat.EXPECT().Increment("config.reload.success"),
+				)
+				err := r.Reload(decodeReloadSource(t, `
+[default]
+current_host = "push-2.example.com"
+
+[balancer]
+type = "static"
+threshold = 0.5
+redirects = ["wss://push-1.example.com"]
+`))
+				So(err, ShouldBeNil)
+				So(app.clientMinPing, ShouldEqual, 20*time.Second)
+			})
+		})
+
+		Convey("Should ignore changes to plugin types", func() {
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("config.reload.rejected"),
+				mckStat.EXPECT().Increment("config.reload.success"),
+			)
+			err := r.Reload(decodeReloadSource(t, `
+[default]
+current_host = "push.example.com"
+
+[balancer]
+type = "etcd"
+servers = ["http://localhost:4001"]
+`))
+			So(err, ShouldBeNil)
+			So(balancer.threshold, ShouldEqual, 0.5)
+		})
+
+		Convey("Should reject invalid configurations", func() {
+			mckStat.EXPECT().Increment("config.reload.error")
+			err := r.Reload(decodeReloadSource(t, `
+[default]
+current_host = "push.example.com"
+client_min_ping_interval = "often"
+
+[balancer]
+type = "static"
+threshold = 0.8
+`))
+			So(err, ShouldNotBeNil)
+			So(app.clientMinPing, ShouldEqual, 20*time.Second)
+			So(balancer.threshold, ShouldEqual, 0.5)
+		})
+
+		Convey("Should require plugin sections", func() {
+			mckStat.EXPECT().Increment("config.reload.error")
+			err := r.Reload(decodeReloadSource(t, `
+[default]
+current_host = "push.example.com"
+client_min_ping_interval = "45s"
+`))
+			So(err, ShouldNotBeNil)
+			So(app.clientMinPing, ShouldEqual, 20*time.Second)
+		})
+	})
+}
@@ -0,0 +1,379 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrNoReplicationKey = errors.New("Replication requires a signing key")
+	ErrInvalidReplica   = errors.New("Unknown replica operation")
+	ErrReplicaResidency = errors.New(
+		"Replication cannot be enabled with data residency")
+)
+
+// maxReplicaBodyLen is the maximum size of a replication request.
+const maxReplicaBodyLen = 8 << 20
+
+// Replica operations.
+const (
+	ReplicaRegister   = "register"
+	ReplicaUnregister = "unregister"
+	ReplicaDropAll    = "drop_all"
+)
+
+type ReplicationConfig struct {
+	Enabled bool
+
+	// Peers lists the replication URLs of the other regions, e.g.,
+	// "https://push-eu.example.com:8090". Each region's URL should balance
+	// across its nodes.
+	Peers []string
+
+	// SigningKey is the base64-encoded key used to sign replication requests.
+	// All regions must use the same key. Required.
+	SigningKey string `toml:"signing_key" env:"signing_key"`
+
+	// MaxSkew is the maximum difference between the signed request time and
+	// the receiving node's clock. Defaults to 30 seconds.
+	MaxSkew string `toml:"max_skew" env:"max_skew"`
+
+	// Interval is the time between sends. Defaults to 1 second.
+	Interval string
+
+	// BatchSize is the maximum number of changes per request. Defaults to
+	// 500.
+	BatchSize int `toml:"batch_size" env:"batch_size"`
+
+	// MaxPending is the maximum number of unsent changes per peer. Once a
+	// peer's backlog is full, the oldest changes are discarded. Defaults to
+	// 100000.
+	MaxPending int `toml:"max_pending" env:"max_pending"`
+
+	// Listener accepts replication requests from other regions.
+	Listener TCPListenerConfig
+}
+
+// Replica is a change to a device's registration state, sent to other
+// regions. Time is the time of the change, in seconds since Epoch.
+type Replica struct {
+	Op        string `json:"op"`
+	DeviceID  string `json:"uaid"`
+	ChannelID string `json:"channelID,omitempty"`
+	Time      int64  `json:"time"`
+}
+
+// replicaBackend is implemented by stores that support replication.
+type replicaBackend interface {
+	// applyReplica applies a change from another region, unless the local
+	// state changed after it. Returns false if the change was discarded.
+	applyReplica(replica *Replica) (applied bool, err error)
+}
+
+// replicaPeer is a region that receives this node's changes.
+type replicaPeer struct {
+	url     string
+	pending []*Replica // Unsent changes, oldest first.
+}
+
+// Replicator asynchronously copies channel registrations, unregistrations,
+// and device resets to other regions, so that devices can fail over to
+// another region without registering their channels again. Pending updates
+// are not replicated. Conflicting changes are resolved by time: a change is
+// only applied if it is newer than the channel's registration or
+// unregistration in the receiving region, so all regions converge on the
+// last write. Requests are retried until accepted, or until the peer's
+// backlog is full. A nil Replicator replicates nothing.
+type Replicator struct {
+	logger     *SimpleLogger
+	metrics    Statistician
+	backend    replicaBackend
+	peers      []*replicaPeer
+	signingKey []byte
+	maxSkew    time.Duration
+	interval   time.Duration
+	batchSize  int
+	maxPending int
+	rclient    *http.Client
+	listener   net.Listener
+	server     Server
+	queue      chan *Replica
+	closeChan  chan bool
+	closeOnce  Once
+	done       chan bool
+}
+
+// NewReplicator creates a replicator for backend from conf, and starts
+// accepting changes from other regions.
+func NewReplicator(app *Application, conf ReplicationConfig,
+	backend replicaBackend) (r *Replicator, err error) {
+
+	if app.Residency() != nil {
+		return nil, ErrReplicaResidency
+	}
+	r = &Replicator{
+		logger:     app.Logger(),
+		metrics:    app.Metrics(),
+		backend:    backend,
+		peers:      make([]*replicaPeer, len(conf.Peers)),
+		batchSize:  conf.BatchSize,
+		maxPending: conf.MaxPending,
+		queue:      make(chan *Replica, conf.MaxPending),
+		closeChan:  make(chan bool),
+		done:       make(chan bool),
+	}
+	for i, url := range conf.Peers {
+		r.peers[i] = &replicaPeer{url: url}
+	}
+	if len(conf.SigningKey) == 0 {
+		return nil, ErrNoReplicationKey
+	}
+	if r.signingKey, err = base64.URLEncoding.DecodeString(conf.SigningKey); err != nil {
+		return nil, err
+	}
+	if err = cryptoProvider.CheckKey(r.signingKey); err != nil {
+		return nil, err
+	}
+	if r.maxSkew, err = time.ParseDuration(conf.MaxSkew); err != nil {
+		return nil, fmt.Errorf("Invalid max_skew: %s", err)
+	}
+	if r.interval, err = time.ParseDuration(conf.Interval); err != nil {
+		return nil, fmt.Errorf("Invalid interval: %s", err)
+	}
+	if r.batchSize < 1 {
+		r.batchSize = 1
+	}
+	r.rclient = &http.Client{Timeout: r.interval + 5*time.Second}
+	if r.listener, err = conf.Listener.Listen(app); err != nil {
+		return nil, err
+	}
+	r.server = NewServeCloser(&http.Server{
+		Handler:  &LogHandler{http.HandlerFunc(r.ReplicateHandler), r.logger},
+		ErrorLog: log.New(&LogWriter{r.logger, "replication", ERROR}, "", 0),
+	})
+	go r.server.Serve(r.listener)
+	return r, nil
+}
+
+// Put queues a change for replication. If the queue is full, the change is
+// discarded.
+func (r *Replicator) Put(op, uaid, chid string) {
+	if r == nil {
+		return
+	}
+	replica := &Replica{
+		Op:        op,
+		DeviceID:  uaid,
+		ChannelID: chid,
+		Time:      timeNow().UTC().Unix(),
+	}
+	select {
+	case r.queue <- replica:
+	default:
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("replication", "Replication queue full; discarding change",
+				LogFields{"op": op, "uaid": uaid, "chid": chid})
+		}
+		r.metrics.Increment("store.replication.dropped")
+	}
+}
+
+// Run sends queued changes to each peer every interval, until the
+// replicator is closed.
+func (r *Replicator) Run() {
+	defer close(r.done)
+	ticker := clock.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.closeChan:
+			r.Flush()
+			return
+		case <-ticker.C():
+		}
+		r.Flush()
+	}
+}
+
+// Flush moves queued changes to each peer's backlog, and sends the backlogs.
+func (r *Replicator) Flush() {
+	for {
+		var replica *Replica
+		select {
+		case replica = <-r.queue:
+		default:
+		}
+		if replica == nil {
+			break
+		}
+		for _, peer := range r.peers {
+			peer.pending = append(peer.pending, replica)
+		}
+	}
+	for _, peer := range r.peers {
+		if excess := len(peer.pending) - r.maxPending; excess > 0 {
+			if r.logger.ShouldLog(WARNING) {
+				r.logger.Warn("replication", "Replication backlog full; discarding changes",
+					LogFields{"peer": peer.url, "discarded": strconv.Itoa(excess)})
+			}
+			r.metrics.IncrementBy("store.replication.dropped", int64(excess))
+			peer.pending = peer.pending[excess:]
+		}
+		r.sendPending(peer)
+	}
+}
+
+// sendPending sends a peer's backlog in batches, stopping at the first
+// failed request. The failed batch is retried on the next flush.
+func (r *Replicator) sendPending(peer *replicaPeer) {
+	for len(peer.pending) > 0 {
+		n := len(peer.pending)
+		if n > r.batchSize {
+			n = r.batchSize
+		}
+		if err := r.send(peer.url, peer.pending[:n]); err != nil {
+			if r.logger.ShouldLog(WARNING) {
+				r.logger.Warn("replication", "Could not replicate changes",
+					LogFields{"peer": peer.url, "error": err.Error(),
+						"pending": strconv.Itoa(len(peer.pending))})
+			}
+			r.metrics.Increment("store.replication.send.error")
+			return
+		}
+		r.metrics.IncrementBy("store.replication.sent", int64(n))
+		peer.pending = peer.pending[n:]
+	}
+	peer.pending = nil
+}
+
+// send posts a batch of changes to a peer.
+func (r *Replicator) send(url string, batch []*Replica) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url+"/replicate", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	sentAt := timeNow().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderRouteTime, strconv.FormatInt(sentAt, 10))
+	req.Header.Set(HeaderRouteSignature, signRoute(r.signingKey, "", sentAt, body))
+	resp, err := r.rclient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ReplicateHandler applies changes from another region. Responds with a 500
+// if any change could not be applied; the sender retries the batch, and
+// changes already applied are discarded as stale.
+func (r *Replicator) ReplicateHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" || req.URL.Path != "/replicate" {
+		http.Error(resp, "Not Found", http.StatusNotFound)
+		return
+	}
+	body, err := r.verify(req)
+	if err != nil {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("replication", "Rejecting replication request",
+				LogFields{"error": err.Error(), "remote": req.RemoteAddr})
+		}
+		r.metrics.Increment("store.replication.unsigned")
+		http.Error(resp, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var batch []*Replica
+	if err = json.Unmarshal(body, &batch); err != nil {
+		http.Error(resp, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	var failed bool
+	for _, replica := range batch {
+		applied, err := r.backend.applyReplica(replica)
+		if err != nil {
+			if r.logger.ShouldLog(ERROR) {
+				r.logger.Error("replication", "Could not apply replicated change",
+					LogFields{"op": replica.Op, "uaid": replica.DeviceID,
+						"chid": replica.ChannelID, "error": err.Error()})
+			}
+			r.metrics.Increment("store.replication.apply.error")
+			failed = true
+			continue
+		}
+		if applied {
+			r.metrics.Increment("store.replication.applied")
+		} else {
+			r.metrics.Increment("store.replication.stale")
+		}
+	}
+	if failed {
+		http.Error(resp, "Could not apply changes", http.StatusInternalServerError)
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+// verify checks the signature of a replication request, and returns its
+// body.
+func (r *Replicator) verify(req *http.Request) (body []byte, err error) {
+	signature := req.Header.Get(HeaderRouteSignature)
+	if len(signature) == 0 {
+		return nil, ErrUnsignedRoute
+	}
+	sentAt, err := strconv.ParseInt(req.Header.Get(HeaderRouteTime), 10, 64)
+	if err != nil {
+		return nil, ErrUnsignedRoute
+	}
+	skew := timeNow().Sub(time.Unix(sentAt, 0))
+	if skew > r.maxSkew || skew < -r.maxSkew {
+		return nil, ErrStaleRoute
+	}
+	if body, err = ioutil.ReadAll(io.LimitReader(req.Body, maxReplicaBodyLen)); err != nil {
+		return nil, err
+	}
+	expected := signRoute(r.signingKey, "", sentAt, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, ErrUnsignedRoute
+	}
+	return body, nil
+}
+
+// Close stops accepting changes from other regions, and makes a final
+// attempt to send unsent changes.
+func (r *Replicator) Close() error {
+	if r == nil {
+		return nil
+	}
+	return r.closeOnce.Do(r.close)
+}
+
+func (r *Replicator) close() error {
+	r.listener.Close()
+	r.server.Close()
+	close(r.closeChan)
+	<-r.done
+	return nil
+}
@@ -0,0 +1,140 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// replicaLog records applied changes in memory.
+type replicaLog struct {
+	applied []Replica
+	err     error
+}
+
+func (l *replicaLog) applyReplica(replica *Replica) (bool, error) {
+	if l.err != nil {
+		return false, l.err
+	}
+	l.applied = append(l.applied, *replica)
+	return true, nil
+}
+
+func TestReplicator(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	uaid := "5e1e5984569c4f00bf4bea47754a6403"
+	chid := "0d6a6d0ca1ba4be1bc8a2cea8e4ddb1a"
+	key := []byte("0123456789abcdef")
+
+	Convey("Replication", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+
+		backend := new(replicaLog)
+		receiver := &Replicator{
+			logger:     app.Logger(),
+			metrics:    mckStat,
+			backend:    backend,
+			signingKey: key,
+			maxSkew:    30 * time.Second,
+		}
+		srv := httptest.NewServer(http.HandlerFunc(receiver.ReplicateHandler))
+		defer srv.Close()
+
+		peer := &replicaPeer{url: srv.URL}
+		sender := &Replicator{
+			logger:     app.Logger(),
+			metrics:    mckStat,
+			peers:      []*replicaPeer{peer},
+			signingKey: key,
+			batchSize:  1,
+			maxPending: 2,
+			rclient:    new(http.Client),
+			queue:      make(chan *Replica, 2),
+		}
+
+		Convey("Should send signed changes to peers", func() {
+			mckStat.EXPECT().Increment("store.replication.applied").Times(2)
+			mckStat.EXPECT().IncrementBy("store.replication.sent", int64(1)).Times(2)
+			sender.Put(ReplicaRegister, uaid, chid)
+			sender.Put(ReplicaUnregister, uaid, chid)
+			sender.Flush()
+			So(backend.applied, ShouldHaveLength, 2)
+			So(backend.applied[0].Op, ShouldEqual, ReplicaRegister)
+			So(backend.applied[0].DeviceID, ShouldEqual, uaid)
+			So(backend.applied[0].ChannelID, ShouldEqual, chid)
+			So(backend.applied[1].Op, ShouldEqual, ReplicaUnregister)
+			So(peer.pending, ShouldBeEmpty)
+		})
+
+		Convey("Should retry changes that weren't applied", func() {
+			backend.err = errors.New("memcache unavailable")
+			mckStat.EXPECT().Increment("store.replication.apply.error")
+			mckStat.EXPECT().Increment("store.replication.send.error")
+			sender.Put(ReplicaRegister, uaid, chid)
+			sender.Flush()
+			So(peer.pending, ShouldHaveLength, 1)
+
+			backend.err = nil
+			mckStat.EXPECT().Increment("store.replication.applied")
+			mckStat.EXPECT().IncrementBy("store.replication.sent", int64(1))
+			sender.Flush()
+			So(backend.applied, ShouldHaveLength, 1)
+			So(peer.pending, ShouldBeEmpty)
+		})
+
+		Convey("Should reject unsigned changes", func() {
+			sender.signingKey = []byte("fedcba9876543210")
+			mckStat.EXPECT().Increment("store.replication.unsigned")
+			mckStat.EXPECT().Increment("store.replication.send.error")
+			sender.Put(ReplicaDropAll, uaid, "")
+			sender.Flush()
+			So(backend.applied, ShouldBeEmpty)
+		})
+
+		Convey("Should discard changes once the backlog is full", func() {
+			peer.url = "http://127.0.0.1:0"
+			mckStat.EXPECT().Increment("store.replication.send.error").Times(2)
+			sender.Put(ReplicaRegister, uaid, chid)
+			sender.Put(ReplicaUnregister, uaid, chid)
+			sender.Flush()
+			So(peer.pending, ShouldHaveLength, 2)
+
+			mckStat.EXPECT().IncrementBy("store.replication.dropped", int64(1))
+			sender.Put(ReplicaDropAll, uaid, "")
+			sender.Flush()
+			So(peer.pending, ShouldHaveLength, 2)
+			So(peer.pending[0].Op, ShouldEqual, ReplicaUnregister)
+			So(peer.pending[1].Op, ShouldEqual, ReplicaDropAll)
+		})
+
+		Convey("Should not replicate resident devices", func() {
+			app.residency = &Residency{app: app, region: "us"}
+			_, err := NewReplicator(app, ReplicationConfig{}, backend)
+			So(err, ShouldEqual, ErrReplicaResidency)
+		})
+
+		Convey("Should require a signing key", func() {
+			_, err := NewReplicator(app, ReplicationConfig{}, backend)
+			So(err, ShouldEqual, ErrNoReplicationKey)
+		})
+	})
+}
@@ -0,0 +1,273 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoResidencyStore = errors.New(
+	"Storage adapter does not support data residency")
+
+type ResidencyConfig struct {
+	// Enabled tags each device with the region of the node it first connects
+	// to, and restricts the device to nodes in that region. Each region's
+	// nodes must use region-local storage; region tags must be visible to all
+	// regions.
+	Enabled bool
+
+	// Region is the region of this node.
+	Region string
+
+	// Regions assigns regions to the WebSocket URLs of their nodes, as
+	// "region=url" entries. Clients that connect to a node in another region
+	// are redirected to their region's URL; if the region has no URL, the
+	// handshake is rejected.
+	Regions []string
+
+	// CacheSize is the maximum number of device region tags cached by this
+	// node, so that handshakes and updates for recently seen devices skip the
+	// shared store. Caching is disabled if 0.
+	CacheSize int `toml:"cache_size" env:"cache_size"`
+
+	// CacheTTL is how long a cached region tag is used before it's fetched
+	// again.
+	CacheTTL string `toml:"cache_ttl" env:"cache_ttl"`
+}
+
+// ResidencyStore is an optional interface implemented by stores that keep
+// the region of each device. Region tags must be shared by all regions, so
+// that each region can reject devices tagged for another.
+type ResidencyStore interface {
+	// FetchRegion returns the device's region, or an empty string if the
+	// device is untagged.
+	FetchRegion(suaid string) (region string, err error)
+
+	// PutRegion tags the device with region.
+	PutRegion(suaid, region string) error
+}
+
+// Residency keeps device state within the region where the device
+// registered. Devices are tagged with this node's region when they first
+// connect; afterward, handshakes and updates for the device are only
+// accepted by nodes in that region, so its state is only stored in that
+// region's store. Devices registered before residency was enabled are
+// untagged, and tagged on their next handshake. Checks fail closed if the
+// region tag can't be fetched. A nil Residency allows all devices.
+type Residency struct {
+	app    *Application
+	store  ResidencyStore // Set by Application.SetStore.
+	region string
+	urls   map[string]string // WebSocket URLs, by region.
+	cache  *regionCache      // May be nil.
+}
+
+// NewResidency creates a data residency policy from conf.
+func NewResidency(app *Application, conf ResidencyConfig) (*Residency, error) {
+	if len(conf.Region) == 0 {
+		return nil, errors.New("Missing region")
+	}
+	r := &Residency{
+		app:    app,
+		region: conf.Region,
+		urls:   make(map[string]string, len(conf.Regions)),
+	}
+	for _, entry := range conf.Regions {
+		i := strings.Index(entry, "=")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("Invalid region entry: %q", entry)
+		}
+		region, url := entry[:i], entry[i+1:]
+		if _, ok := r.urls[region]; ok {
+			return nil, fmt.Errorf("Duplicate region: %q", region)
+		}
+		r.urls[region] = url
+	}
+	if conf.CacheSize > 0 {
+		ttl, err := time.ParseDuration(conf.CacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cache TTL: %s", err)
+		}
+		r.cache = newRegionCache(conf.CacheSize, ttl)
+	}
+	return r, nil
+}
+
+// Region returns this node's region.
+func (r *Residency) Region() string {
+	if r == nil {
+		return ""
+	}
+	return r.region
+}
+
+// URL returns the WebSocket URL of the nodes in region, or an empty string
+// if unknown.
+func (r *Residency) URL(region string) string {
+	if r == nil {
+		return ""
+	}
+	return r.urls[region]
+}
+
+// Admit checks the region of a connecting device, tagging untagged devices
+// with this node's region. Returns ErrWrongRegion, and the device's region,
+// if the device is tagged for another region.
+func (r *Residency) Admit(uaid string) (region string, err error) {
+	if r == nil {
+		return "", nil
+	}
+	if region, err = r.fetch(uaid); err != nil {
+		return "", err
+	}
+	if len(region) == 0 {
+		region = r.region
+		if err = r.store.PutRegion(uaid, region); err != nil {
+			r.logError("Could not tag device region", uaid, err)
+			return "", err
+		}
+		r.cache.Put(uaid, region)
+		r.app.Metrics().Increment("residency.tagged")
+		return region, nil
+	}
+	if region != r.region {
+		r.reject("Rejecting handshake for device in another region",
+			uaid, region)
+		r.app.Metrics().Increment("residency.rejected.client")
+		return region, ErrWrongRegion
+	}
+	return region, nil
+}
+
+// Check returns ErrWrongRegion if the device is tagged for another region.
+// Untagged devices are allowed.
+func (r *Residency) Check(uaid string) error {
+	if r == nil {
+		return nil
+	}
+	region, err := r.fetch(uaid)
+	if err != nil {
+		return err
+	}
+	if len(region) > 0 && region != r.region {
+		r.reject("Rejecting update for device in another region", uaid, region)
+		r.app.Metrics().Increment("residency.rejected.update")
+		return ErrWrongRegion
+	}
+	return nil
+}
+
+// fetch returns the device's region tag, from the cache if possible. Only
+// tagged devices are cached, so that tags set by other nodes are seen
+// immediately.
+func (r *Residency) fetch(uaid string) (region string, err error) {
+	if r.store == nil {
+		return "", ErrNoResidencyStore
+	}
+	if r.cache != nil {
+		if region, ok := r.cache.Get(uaid); ok {
+			r.app.Metrics().Increment("residency.cache.hit")
+			return region, nil
+		}
+		r.app.Metrics().Increment("residency.cache.miss")
+	}
+	if region, err = r.store.FetchRegion(uaid); err != nil {
+		r.logError("Could not fetch device region", uaid, err)
+		return "", err
+	}
+	if len(region) > 0 {
+		r.cache.Put(uaid, region)
+	}
+	return region, nil
+}
+
+func (r *Residency) reject(message, uaid, region string) {
+	logger := r.app.Logger()
+	if logger.ShouldLog(WARNING) {
+		logger.Warn("residency", message, LogFields{"uaid": uaid,
+			"region": region, "localRegion": r.region})
+	}
+}
+
+func (r *Residency) logError(message, uaid string, err error) {
+	logger := r.app.Logger()
+	if logger.ShouldLog(ERROR) {
+		logger.Error("residency", message,
+			LogFields{"uaid": uaid, "error": err.Error()})
+	}
+	r.app.Metrics().Increment("residency.error")
+}
+
+// cachedRegion is a device region tag.
+type cachedRegion struct {
+	uaid      string
+	region    string
+	expiresAt time.Time
+}
+
+// regionCache is a bounded LRU cache of device region tags. Entries expire
+// after the TTL. A nil regionCache caches nothing.
+type regionCache struct {
+	ttl      time.Duration
+	size     int
+	cacheMux sync.Mutex
+	lru      *list.List // Least recently used entries at the back.
+	regions  map[string]*list.Element
+}
+
+func newRegionCache(size int, ttl time.Duration) *regionCache {
+	return &regionCache{
+		ttl:     ttl,
+		size:    size,
+		lru:     list.New(),
+		regions: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached region of a device, if it has not expired.
+func (c *regionCache) Get(uaid string) (region string, ok bool) {
+	c.cacheMux.Lock()
+	defer c.cacheMux.Unlock()
+	elem, ok := c.regions[uaid]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*cachedRegion)
+	if !timeNow().Before(entry.expiresAt) {
+		c.lru.Remove(elem)
+		delete(c.regions, uaid)
+		return "", false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.region, true
+}
+
+// Put caches the region of a device, evicting the least recently used
+// device if the cache is full.
+func (c *regionCache) Put(uaid, region string) {
+	if c == nil {
+		return
+	}
+	c.cacheMux.Lock()
+	defer c.cacheMux.Unlock()
+	expiresAt := timeNow().Add(c.ttl)
+	if elem, ok := c.regions[uaid]; ok {
+		entry := elem.Value.(*cachedRegion)
+		entry.region, entry.expiresAt = region, expiresAt
+		c.lru.MoveToFront(elem)
+		return
+	}
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.regions, oldest.Value.(*cachedRegion).uaid)
+	}
+	c.regions[uaid] = c.lru.PushFront(&cachedRegion{uaid, region, expiresAt})
+}
@@ -0,0 +1,224 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// regionStore keeps device region tags in memory.
+type regionStore struct {
+	NoStore
+	regions map[string]string
+	fetches int
+	err     error
+}
+
+func (s *regionStore) FetchRegion(uaid string) (string, error) {
+	s.fetches++
+	return s.regions[uaid], s.err
+}
+
+func (s *regionStore) PutRegion(uaid, region string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.regions[uaid] = region
+	return nil
+}
+
+func TestResidency(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	uaid := "5e1e5984569c4f00bf4bea47754a6403"
+
+	Convey("Data residency", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		r, err := NewResidency(app, ResidencyConfig{
+			Enabled: true,
+			Region:  "us",
+			Regions: []string{"eu=wss://eu.example.com"},
+		})
+		So(err, ShouldBeNil)
+		app.residency = r
+		store := &regionStore{regions: make(map[string]string)}
+		So(app.SetStore(store), ShouldBeNil)
+
+		Convey("Should tag untagged devices on handshake", func() {
+			mckStat.EXPECT().Increment("residency.tagged")
+			region, err := r.Admit(uaid)
+			So(err, ShouldBeNil)
+			So(region, ShouldEqual, "us")
+			So(store.regions[uaid], ShouldEqual, "us")
+
+			// Tagged devices aren't tagged again.
+			region, err = r.Admit(uaid)
+			So(err, ShouldBeNil)
+			So(region, ShouldEqual, "us")
+		})
+
+		Convey("Should reject devices tagged for another region", func() {
+			store.regions[uaid] = "eu"
+			mckStat.EXPECT().Increment("residency.rejected.client")
+			region, err := r.Admit(uaid)
+			So(err, ShouldEqual, ErrWrongRegion)
+			So(region, ShouldEqual, "eu")
+			So(r.URL(region), ShouldEqual, "wss://eu.example.com")
+
+			mckStat.EXPECT().Increment("residency.rejected.update")
+			So(r.Check(uaid), ShouldEqual, ErrWrongRegion)
+		})
+
+		Convey("Should allow updates for untagged devices", func() {
+			So(r.Check(uaid), ShouldBeNil)
+			So(store.regions, ShouldBeEmpty)
+		})
+
+		Convey("Should fail closed if the store fails", func() {
+			store.err = errors.New("memcache unavailable")
+			mckStat.EXPECT().Increment("residency.error").Times(2)
+			_, err := r.Admit(uaid)
+			So(err, ShouldNotBeNil)
+			So(r.Check(uaid), ShouldNotBeNil)
+		})
+
+		Convey("Should cache region tags", func() {
+			defer saveTimeFuncs()()
+			now := time.Unix(1257894000, 0)
+			timeNow = func() time.Time { return now }
+
+			r, err := NewResidency(app, ResidencyConfig{
+				Enabled:   true,
+				Region:    "us",
+				CacheSize: 1,
+				CacheTTL:  "1m",
+			})
+			So(err, ShouldBeNil)
+			r.store = store
+
+			mckStat.EXPECT().Increment("residency.cache.miss")
+			mckStat.EXPECT().Increment("residency.tagged")
+			_, err = r.Admit(uaid)
+			So(err, ShouldBeNil)
+			So(store.fetches, ShouldEqual, 1)
+
+			mckStat.EXPECT().Increment("residency.cache.hit").Times(2)
+			So(r.Check(uaid), ShouldBeNil)
+			_, err = r.Admit(uaid)
+			So(err, ShouldBeNil)
+			So(store.fetches, ShouldEqual, 1)
+
+			// Untagged devices aren't cached.
+			other := "7e3a3b0a8f5a4b5c9d6e1f2a3b4c5d6e"
+			mckStat.EXPECT().Increment("residency.cache.miss").Times(2)
+			So(r.Check(other), ShouldBeNil)
+			So(r.Check(other), ShouldBeNil)
+			So(store.fetches, ShouldEqual, 3)
+
+			now = now.Add(1 * time.Minute)
+			mckStat.EXPECT().Increment("residency.cache.miss")
+			So(r.Check(uaid), ShouldBeNil)
+			So(store.fetches, ShouldEqual, 4)
+		})
+
+		Convey("Should require a store that supports residency", func() {
+			So(app.SetStore(&NoStore{}), ShouldEqual, ErrNoResidencyStore)
+		})
+
+		Convey("Should reject invalid settings", func() {
+			_, err := NewResidency(app, ResidencyConfig{Enabled: true})
+			So(err, ShouldNotBeNil)
+			_, err = NewResidency(app, ResidencyConfig{Region: "us",
+				Regions: []string{"eu"}})
+			So(err, ShouldNotBeNil)
+			_, err = NewResidency(app, ResidencyConfig{Region: "us",
+				Regions: []string{"eu=wss://a", "eu=wss://b"}})
+			So(err, ShouldNotBeNil)
+			_, err = NewResidency(app, ResidencyConfig{Region: "us",
+				CacheSize: 10, CacheTTL: "soon"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Should allow all devices if disabled", func() {
+			var r *Residency
+			region, err := r.Admit(uaid)
+			So(err, ShouldBeNil)
+			So(region, ShouldBeEmpty)
+			So(r.Check(uaid), ShouldBeNil)
+		})
+	})
+}
+
+func TestWorkerResidency(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckSocket := NewMockSocket(mockCtrl)
+
+	uaid := "5e1e5984569c4f00bf4bea47754a6403"
+
+	Convey("Worker data residency", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.residency, _ = NewResidency(app, ResidencyConfig{
+			Enabled: true,
+			Region:  "us",
+			Regions: []string{"eu=wss://eu.example.com"},
+		})
+		store := &regionStore{regions: map[string]string{uaid: "eu"}}
+		app.SetStore(store)
+		wws := NewWorker(app, mckSocket, "test")
+
+		Convey("Should redirect devices to their region", func() {
+			redirectReply := HelloReply{
+				Type:        "hello",
+				DeviceID:    uaid,
+				Status:      307,
+				RedirectURL: new(string),
+			}
+			*redirectReply.RedirectURL = "wss://eu.example.com"
+			replyBytes, _ := json.Marshal(redirectReply)
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("residency.rejected.client"),
+				mckSocket.EXPECT().WriteText(string(replyBytes)),
+			)
+			err := wws.Hello(&RequestHeader{Type: "hello"},
+				[]byte(`{"uaid":"`+uaid+`","channelIDs":[]}`))
+			So(err, ShouldBeNil)
+			So(wws.stopped(), ShouldBeTrue)
+			So(app.WorkerExists(uaid), ShouldBeFalse)
+		})
+
+		Convey("Should reject devices from regions without a URL", func() {
+			store.regions[uaid] = "ap"
+			mckStat.EXPECT().Increment("residency.rejected.client")
+			err := wws.Hello(&RequestHeader{Type: "hello"},
+				[]byte(`{"uaid":"`+uaid+`","channelIDs":[]}`))
+			So(err, ShouldEqual, ErrWrongRegion)
+			So(app.WorkerExists(uaid), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,251 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type ResumeConfig struct {
+	// Enabled issues a resumption token in each handshake reply. Clients that
+	// reconnect to the same node within the TTL and present the token resume
+	// their previous session: unacknowledged updates are resent without
+	// fetching the device's channels from the store, and rate limits carry
+	// over.
+	Enabled bool
+
+	// TTL is how long the session of a closed connection can be resumed.
+	TTL string
+
+	// Size is the maximum number of resumable sessions. The oldest sessions
+	// are discarded first.
+	Size int
+}
+
+// parkedSession is the state of a closed connection, kept for resumption.
+type parkedSession struct {
+	token    string
+	uaid     string
+	parkedAt time.Time
+	updates  []Update // Sent, but not acknowledged.
+	expired  []string // Sent, but not acknowledged.
+	regTimes []time.Time
+	regNext  int
+	lastPing time.Time
+	missed   bool // Set if updates were routed to the device while parked.
+}
+
+// SessionCache holds the sessions of recently closed connections, so that
+// clients reconnecting after a network blip skip a full store flush. Only
+// clean sessions are resumed without a flush: if an update is routed to the
+// device while its session is parked, the session is marked as missed, and
+// the client's pending updates are fetched from the store as usual. A nil
+// SessionCache resumes no sessions.
+//
+// Missed updates are tracked in memory, not in the store: a session is only
+// marked if an update is routed to this node, or accepted by its endpoint,
+// while the session is parked. An update stored by another node that fails
+// to route to this one goes unnoticed until the client's next full flush.
+type SessionCache struct {
+	ttl         time.Duration
+	size        int
+	sessionsMux sync.Mutex
+	sessions    *list.List               // Oldest sessions at the front.
+	byToken     map[string]*list.Element // By resumption token.
+	byUAID      map[string]*list.Element // By device ID.
+}
+
+// NewSessionCache creates a session cache from conf.
+func NewSessionCache(conf ResumeConfig) (c *SessionCache, err error) {
+	c = &SessionCache{
+		size:     conf.Size,
+		sessions: list.New(),
+		byToken:  make(map[string]*list.Element),
+		byUAID:   make(map[string]*list.Element),
+	}
+	if c.ttl, err = time.ParseDuration(conf.TTL); err != nil {
+		return nil, err
+	}
+	if c.size < 1 {
+		c.size = 1
+	}
+	return c, nil
+}
+
+// Token returns a new resumption token, or an empty string if resumption is
+// disabled.
+func (c *SessionCache) Token() (token string, err error) {
+	if c == nil {
+		return "", nil
+	}
+	return idGenerate()
+}
+
+// Park stores the session of a closed connection, replacing any parked
+// session for the same device.
+func (c *SessionCache) Park(session *parkedSession) {
+	if c == nil {
+		return
+	}
+	session.parkedAt = timeNow()
+	c.sessionsMux.Lock()
+	defer c.sessionsMux.Unlock()
+	c.prune(session.parkedAt)
+	if elem, ok := c.byUAID[session.uaid]; ok {
+		c.remove(elem)
+	}
+	if c.sessions.Len() >= c.size {
+		c.remove(c.sessions.Front())
+	}
+	elem := c.sessions.PushBack(session)
+	c.byToken[session.token] = elem
+	c.byUAID[session.uaid] = elem
+}
+
+// Resume removes and returns the session for token, if it was parked for
+// uaid and has not expired.
+func (c *SessionCache) Resume(token, uaid string) (
+	session *parkedSession, ok bool) {
+
+	if c == nil {
+		return nil, false
+	}
+	c.sessionsMux.Lock()
+	defer c.sessionsMux.Unlock()
+	elem, ok := c.byToken[token]
+	if !ok {
+		return nil, false
+	}
+	// Tokens are single-use.
+	c.remove(elem)
+	session = elem.Value.(*parkedSession)
+	if session.uaid != uaid || c.isExpired(session, timeNow()) {
+		return nil, false
+	}
+	return session, true
+}
+
+// Missed marks the parked session for uaid, if any, as having missed an
+// update.
+func (c *SessionCache) Missed(uaid string) {
+	if c == nil {
+		return
+	}
+	c.sessionsMux.Lock()
+	if elem, ok := c.byUAID[uaid]; ok {
+		elem.Value.(*parkedSession).missed = true
+	}
+	c.sessionsMux.Unlock()
+}
+
+// Len returns the number of parked sessions.
+func (c *SessionCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.sessionsMux.Lock()
+	defer c.sessionsMux.Unlock()
+	return c.sessions.Len()
+}
+
+func (c *SessionCache) isExpired(session *parkedSession, now time.Time) bool {
+	return now.Sub(session.parkedAt) >= c.ttl
+}
+
+// prune discards expired sessions. The caller must hold the sessions lock.
+func (c *SessionCache) prune(now time.Time) {
+	for elem := c.sessions.Front(); elem != nil; elem = c.sessions.Front() {
+		if !c.isExpired(elem.Value.(*parkedSession), now) {
+			break
+		}
+		c.remove(elem)
+	}
+}
+
+// remove discards a session. The caller must hold the sessions lock.
+func (c *SessionCache) remove(elem *list.Element) {
+	session := c.sessions.Remove(elem).(*parkedSession)
+	delete(c.byToken, session.token)
+	if c.byUAID[session.uaid] == elem {
+		delete(c.byUAID, session.uaid)
+	}
+}
+
+// resumeState tracks the updates sent to a client that have not been
+// acknowledged, so that the session can be parked when the connection
+// closes. Updates are sent from routing goroutines, so the state is locked.
+// A nil resumeState tracks nothing.
+type resumeState struct {
+	sync.Mutex
+	token   string
+	updates map[string]Update // By channel ID.
+	expired map[string]bool
+	parked  bool
+}
+
+func newResumeState(token string) *resumeState {
+	return &resumeState{
+		token:   token,
+		updates: make(map[string]Update),
+		expired: make(map[string]bool),
+	}
+}
+
+// sent records updates and expired channels sent to the client. Returns
+// false if the session was already parked; the caller should mark the parked
+// session as missed.
+func (r *resumeState) sent(updates []Update, expired []string) bool {
+	if r == nil {
+		return true
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.parked {
+		return false
+	}
+	for _, update := range updates {
+		r.updates[update.ChannelID] = update
+	}
+	for _, chid := range expired {
+		r.expired[chid] = true
+	}
+	return true
+}
+
+// acked removes acknowledged updates and expired channels. Updates are kept
+// if a newer version was sent after the acknowledged version.
+func (r *resumeState) acked(updates []Update, expired []string) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	for _, update := range updates {
+		if sent, ok := r.updates[update.ChannelID]; ok && update.Version >= sent.Version {
+			delete(r.updates, update.ChannelID)
+		}
+	}
+	for _, chid := range expired {
+		delete(r.expired, chid)
+	}
+	r.Unlock()
+}
+
+// park stops tracking updates, and returns the unacknowledged updates and
+// expired channels as a session.
+func (r *resumeState) park(uaid string) *parkedSession {
+	r.Lock()
+	defer r.Unlock()
+	r.parked = true
+	session := &parkedSession{token: r.token, uaid: uaid}
+	for _, update := range r.updates {
+		session.updates = append(session.updates, update)
+	}
+	for chid := range r.expired {
+		session.expired = append(session.expired, chid)
+	}
+	return session
+}
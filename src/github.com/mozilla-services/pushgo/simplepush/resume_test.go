@@ -0,0 +1,92 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSessionCache(t *testing.T) {
+	Convey("Session resumption", t, func() {
+		defer saveTimeFuncs()()
+		now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+		timeNow = func() time.Time { return now }
+
+		c, err := NewSessionCache(ResumeConfig{TTL: "30s", Size: 2})
+		So(err, ShouldBeNil)
+		uaid := "5e1e5984569c4f00bf4bea47754a6403"
+
+		Convey("Should resume parked sessions once", func() {
+			c.Park(&parkedSession{token: "a", uaid: uaid})
+			_, ok := c.Resume("a", "9e1e5984569c4f00bf4bea47754a6403")
+			So(ok, ShouldBeFalse)
+
+			c.Park(&parkedSession{token: "b", uaid: uaid})
+			session, ok := c.Resume("b", uaid)
+			So(ok, ShouldBeTrue)
+			So(session.token, ShouldEqual, "b")
+			_, ok = c.Resume("b", uaid)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Should not resume expired sessions", func() {
+			c.Park(&parkedSession{token: "a", uaid: uaid})
+			now = now.Add(30 * time.Second)
+			_, ok := c.Resume("a", uaid)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Should replace sessions for the same device", func() {
+			c.Park(&parkedSession{token: "a", uaid: uaid})
+			c.Park(&parkedSession{token: "b", uaid: uaid})
+			So(c.Len(), ShouldEqual, 1)
+			_, ok := c.Resume("a", uaid)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Should discard the oldest sessions when full", func() {
+			c.Park(&parkedSession{token: "a", uaid: "a"})
+			c.Park(&parkedSession{token: "b", uaid: "b"})
+			c.Park(&parkedSession{token: "c", uaid: "c"})
+			So(c.Len(), ShouldEqual, 2)
+			_, ok := c.Resume("a", "a")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Should mark sessions that missed updates", func() {
+			c.Park(&parkedSession{token: "a", uaid: uaid})
+			c.Missed(uaid)
+			session, ok := c.Resume("a", uaid)
+			So(ok, ShouldBeTrue)
+			So(session.missed, ShouldBeTrue)
+		})
+
+		Convey("Should track unacknowledged updates", func() {
+			r := newResumeState("a")
+			So(r.sent([]Update{{"chid1", 1, "", false}, {"chid2", 2, "", false}}, []string{"chid3"}),
+				ShouldBeTrue)
+			r.sent([]Update{{"chid2", 3, "", false}}, nil)
+			r.acked([]Update{{"chid1", 1, "", false}, {"chid2", 2, "", false}}, []string{"chid3"})
+
+			session := r.park(uaid)
+			So(session.updates, ShouldResemble, []Update{{"chid2", 3, "", false}})
+			So(session.expired, ShouldBeEmpty)
+			So(r.sent([]Update{{"chid4", 1, "", false}}, nil), ShouldBeFalse)
+		})
+
+		Convey("Should resume no sessions if disabled", func() {
+			var c *SessionCache
+			token, err := c.Token()
+			So(err, ShouldBeNil)
+			So(token, ShouldEqual, "")
+			c.Park(&parkedSession{token: "a", uaid: uaid})
+			_, ok := c.Resume("a", uaid)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,135 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RetryAfterConfig struct {
+	Enabled bool
+
+	// MinDelay and MaxDelay bound the advertised retry delay.
+	MinDelay string `toml:"min_delay" env:"min_delay"`
+	MaxDelay string `toml:"max_delay" env:"max_delay"`
+
+	// MaxJitter is the maximum random delay added to each estimate, so that
+	// app servers rejected at the same time don't retry at the same time.
+	MaxJitter string `toml:"max_jitter" env:"max_jitter"`
+
+	// MaxTracked is the maximum number of channels tracked to determine
+	// whether app servers honor the Retry-After header.
+	MaxTracked int `toml:"max_tracked" env:"max_tracked"`
+}
+
+// RetryAdvisor adds Retry-After headers to responses for updates rejected
+// while the endpoint sheds load, and tracks whether app servers wait before
+// retrying.
+type RetryAdvisor struct {
+	metrics    Statistician
+	minDelay   time.Duration
+	maxDelay   time.Duration
+	maxJitter  time.Duration
+	maxTracked int
+	jitter     func(max int64) int64
+	retryMux   sync.Mutex
+	retries    map[string]time.Time // Earliest retry times, by channel.
+}
+
+// NewRetryAdvisor creates a Retry-After advisor from conf.
+func NewRetryAdvisor(app *Application, conf RetryAfterConfig) (
+	a *RetryAdvisor, err error) {
+
+	a = &RetryAdvisor{
+		metrics:    app.Metrics(),
+		maxTracked: conf.MaxTracked,
+		jitter:     rand.Int63n,
+		retries:    make(map[string]time.Time),
+	}
+	if a.minDelay, err = time.ParseDuration(conf.MinDelay); err != nil {
+		return nil, err
+	}
+	if a.maxDelay, err = time.ParseDuration(conf.MaxDelay); err != nil {
+		return nil, err
+	}
+	if a.maxJitter, err = time.ParseDuration(conf.MaxJitter); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Delay returns the retry delay for a recovery estimate, clamped and
+// jittered, and rounded up to whole seconds.
+func (a *RetryAdvisor) Delay(estimate time.Duration) time.Duration {
+	delay := estimate
+	if delay < a.minDelay {
+		delay = a.minDelay
+	}
+	if a.maxJitter > 0 {
+		delay += time.Duration(a.jitter(int64(a.maxJitter)))
+	}
+	if delay > a.maxDelay {
+		delay = a.maxDelay
+	}
+	if rem := delay % time.Second; rem > 0 {
+		delay += time.Second - rem
+	}
+	return delay
+}
+
+// Advise sets the Retry-After header on resp, and records the earliest retry
+// time for the channel. Must be called before writing the response status.
+func (a *RetryAdvisor) Advise(resp http.ResponseWriter, uaid, chid string,
+	estimate time.Duration) {
+
+	delay := a.Delay(estimate)
+	resp.Header().Set("Retry-After", strconv.FormatInt(int64(delay/time.Second), 10))
+	a.metrics.Timer("updates.appserver.retry_after", delay)
+
+	now := timeNow()
+	a.retryMux.Lock()
+	defer a.retryMux.Unlock()
+	if len(a.retries) >= a.maxTracked {
+		a.prune(now)
+		if len(a.retries) >= a.maxTracked {
+			return
+		}
+	}
+	a.retries[joinIDs(uaid, chid)] = now.Add(delay)
+}
+
+// Check records whether an update for a previously rejected channel was sent
+// after the advertised delay.
+func (a *RetryAdvisor) Check(uaid, chid string) {
+	key := joinIDs(uaid, chid)
+	a.retryMux.Lock()
+	retryAt, ok := a.retries[key]
+	if ok {
+		delete(a.retries, key)
+	}
+	a.retryMux.Unlock()
+	if !ok {
+		return
+	}
+	if timeNow().Before(retryAt) {
+		a.metrics.Increment("updates.appserver.retry_early")
+	} else {
+		a.metrics.Increment("updates.appserver.retry_honored")
+	}
+}
+
+// prune removes channels that weren't retried within the maximum delay of
+// their earliest retry time. The caller must hold the retry lock.
+func (a *RetryAdvisor) prune(now time.Time) {
+	for key, retryAt := range a.retries {
+		if now.Sub(retryAt) > a.maxDelay {
+			delete(a.retries, key)
+		}
+	}
+}
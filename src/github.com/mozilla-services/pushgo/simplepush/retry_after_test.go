@@ -0,0 +1,83 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRetryAdvisor(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+
+	defer saveTimeFuncs()()
+	var now time.Time
+	timeNow = func() time.Time { return now }
+
+	Convey("Retry-After advisor", t, func() {
+		app := NewApplication()
+		app.SetMetrics(mckStat)
+		a, err := NewRetryAdvisor(app, RetryAfterConfig{
+			Enabled:    true,
+			MinDelay:   "1s",
+			MaxDelay:   "1m",
+			MaxJitter:  "5s",
+			MaxTracked: 1,
+		})
+		So(err, ShouldBeNil)
+		var jitter int64
+		a.jitter = func(max int64) int64 { return jitter }
+		now = time.Unix(1000, 0)
+
+		Convey("Should clamp, jitter, and round up delays", func() {
+			So(a.Delay(0), ShouldEqual, 1*time.Second)
+			So(a.Delay(2*time.Hour), ShouldEqual, 1*time.Minute)
+			jitter = int64(1500 * time.Millisecond)
+			So(a.Delay(2*time.Second), ShouldEqual, 4*time.Second)
+		})
+
+		Convey("Should track whether app servers honor the delay", func() {
+			resp := httptest.NewRecorder()
+			mckStat.EXPECT().Timer("updates.appserver.retry_after", 10*time.Second)
+			a.Advise(resp, "123", "456", 10*time.Second)
+			So(resp.HeaderMap.Get("Retry-After"), ShouldEqual, "10")
+
+			now = now.Add(5 * time.Second)
+			mckStat.EXPECT().Increment("updates.appserver.retry_early")
+			a.Check("123", "456")
+
+			// Untracked channels are ignored.
+			a.Check("123", "456")
+
+			mckStat.EXPECT().Timer("updates.appserver.retry_after", 10*time.Second)
+			a.Advise(httptest.NewRecorder(), "123", "456", 10*time.Second)
+			now = now.Add(10 * time.Second)
+			mckStat.EXPECT().Increment("updates.appserver.retry_honored")
+			a.Check("123", "456")
+		})
+
+		Convey("Should bound the number of tracked channels", func() {
+			mckStat.EXPECT().Timer("updates.appserver.retry_after",
+				gomock.Any()).Times(3)
+			a.Advise(httptest.NewRecorder(), "123", "456", 0)
+			a.Advise(httptest.NewRecorder(), "123", "789", 0)
+			So(a.retries, ShouldHaveLength, 1)
+
+			// Channels not retried within the maximum delay are pruned.
+			now = now.Add(2 * time.Minute)
+			a.Advise(httptest.NewRecorder(), "123", "789", 0)
+			_, ok := a.retries[joinIDs("123", "789")]
+			So(ok, ShouldBeTrue)
+			So(a.retries, ShouldHaveLength, 1)
+		})
+	})
+}
@@ -0,0 +1,166 @@
+// Code generated by protoc-gen-gogo.
+// source: route.proto
+// DO NOT EDIT!
+
+package simplepush
+
+import proto "github.com/gogo/protobuf/proto"
+import math "math"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = math.Inf
+
+type RouteReceipt_Status int32
+
+const (
+	RouteReceipt_DELIVERED      RouteReceipt_Status = 0
+	RouteReceipt_UNKNOWN_DEVICE RouteReceipt_Status = 1
+	RouteReceipt_INVALID        RouteReceipt_Status = 2
+	RouteReceipt_GONE           RouteReceipt_Status = 3
+	RouteReceipt_ERROR          RouteReceipt_Status = 4
+)
+
+var RouteReceipt_Status_name = map[int32]string{
+	0: "DELIVERED",
+	1: "UNKNOWN_DEVICE",
+	2: "INVALID",
+	3: "GONE",
+	4: "ERROR",
+}
+var RouteReceipt_Status_value = map[string]int32{
+	"DELIVERED":      0,
+	"UNKNOWN_DEVICE": 1,
+	"INVALID":        2,
+	"GONE":           3,
+	"ERROR":          4,
+}
+
+func (x RouteReceipt_Status) Enum() *RouteReceipt_Status {
+	p := new(RouteReceipt_Status)
+	*p = x
+	return p
+}
+func (x RouteReceipt_Status) String() string {
+	return proto.EnumName(RouteReceipt_Status_name, int32(x))
+}
+func (x *RouteReceipt_Status) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(RouteReceipt_Status_value, data, "RouteReceipt_Status")
+	if err != nil {
+		return err
+	}
+	*x = RouteReceipt_Status(value)
+	return nil
+}
+
+// RouteFrame is an update routed to the node connected to a device.
+type RouteFrame struct {
+	Uaid             *string `protobuf:"bytes,1,opt,name=uaid" json:"uaid,omitempty"`
+	ChannelId        *string `protobuf:"bytes,2,opt,name=channel_id" json:"channel_id,omitempty"`
+	Version          *int64  `protobuf:"varint,3,opt,name=version" json:"version,omitempty"`
+	Time             *int64  `protobuf:"varint,4,opt,name=time" json:"time,omitempty"`
+	Data             *string `protobuf:"bytes,5,opt,name=data" json:"data,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *RouteFrame) Reset()         { *m = RouteFrame{} }
+func (m *RouteFrame) String() string { return proto.CompactTextString(m) }
+func (*RouteFrame) ProtoMessage()    {}
+
+func (m *RouteFrame) GetUaid() string {
+	if m != nil && m.Uaid != nil {
+		return *m.Uaid
+	}
+	return ""
+}
+
+func (m *RouteFrame) GetChannelId() string {
+	if m != nil && m.ChannelId != nil {
+		return *m.ChannelId
+	}
+	return ""
+}
+
+func (m *RouteFrame) GetVersion() int64 {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return 0
+}
+
+func (m *RouteFrame) GetTime() int64 {
+	if m != nil && m.Time != nil {
+		return *m.Time
+	}
+	return 0
+}
+
+func (m *RouteFrame) GetData() string {
+	if m != nil && m.Data != nil {
+		return *m.Data
+	}
+	return ""
+}
+
+// RouteReceipt is returned by the receiving node.
+type RouteReceipt struct {
+	Status           *RouteReceipt_Status `protobuf:"varint,1,opt,name=status,enum=simplepush.RouteReceipt_Status,def=0" json:"status,omitempty"`
+	Uaid             *string              `protobuf:"bytes,2,opt,name=uaid" json:"uaid,omitempty"`
+	ChannelId        *string              `protobuf:"bytes,3,opt,name=channel_id" json:"channel_id,omitempty"`
+	Version          *int64               `protobuf:"varint,4,opt,name=version" json:"version,omitempty"`
+	Node             *string              `protobuf:"bytes,5,opt,name=node" json:"node,omitempty"`
+	Time             *int64               `protobuf:"varint,6,opt,name=time" json:"time,omitempty"`
+	XXX_unrecognized []byte               `json:"-"`
+}
+
+func (m *RouteReceipt) Reset()         { *m = RouteReceipt{} }
+func (m *RouteReceipt) String() string { return proto.CompactTextString(m) }
+func (*RouteReceipt) ProtoMessage()    {}
+
+const Default_RouteReceipt_Status RouteReceipt_Status = RouteReceipt_DELIVERED
+
+func (m *RouteReceipt) GetStatus() RouteReceipt_Status {
+	if m != nil && m.Status != nil {
+		return *m.Status
+	}
+	return Default_RouteReceipt_Status
+}
+
+func (m *RouteReceipt) GetUaid() string {
+	if m != nil && m.Uaid != nil {
+		return *m.Uaid
+	}
+	return ""
+}
+
+func (m *RouteReceipt) GetChannelId() string {
+	if m != nil && m.ChannelId != nil {
+		return *m.ChannelId
+	}
+	return ""
+}
+
+func (m *RouteReceipt) GetVersion() int64 {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return 0
+}
+
+func (m *RouteReceipt) GetNode() string {
+	if m != nil && m.Node != nil {
+		return *m.Node
+	}
+	return ""
+}
+
+func (m *RouteReceipt) GetTime() int64 {
+	if m != nil && m.Time != nil {
+		return *m.Time
+	}
+	return 0
+}
+
+func init() {
+	proto.RegisterEnum("simplepush.RouteReceipt_Status", RouteReceipt_Status_name, RouteReceipt_Status_value)
+}
@@ -17,11 +17,15 @@
 package simplepush
 
 import (
+	"errors"
 	"time"
 )
 
 var (
 	AvailableRouters = make(AvailableExtensions)
+
+	ErrNoRouteStore = errors.New(
+		"Storage adapter does not support direct routing")
 )
 
 type Router interface {
@@ -47,3 +51,19 @@ type Router interface {
 	// Indicate status of the router, error if there's a problem
 	Status() (bool, error)
 }
+
+// RouteStore is an optional interface implemented by stores that keep the
+// node each device is connected to, so that routers can send updates for the
+// device directly to its node instead of probing all contacts.
+type RouteStore interface {
+	// FetchRoute returns the routing URL of the node that the device is
+	// connected to, or an empty string if unknown.
+	FetchRoute(suaid string) (node string, err error)
+
+	// PutRoute records the node that the device connected to.
+	PutRoute(suaid, node string) error
+
+	// DropRoute removes the device's route if it points to node, so that a
+	// node doesn't remove the route of a device that reconnected elsewhere.
+	DropRoute(suaid, node string) error
+}
@@ -7,7 +7,9 @@ package simplepush
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -21,12 +23,33 @@ import (
 	"time"
 
 	capn "github.com/glycerine/go-capnproto"
+	"github.com/gogo/protobuf/proto"
 	"github.com/gorilla/mux"
 )
 
 var (
 	ErrNoLocator       = errors.New("Discovery service not configured")
 	ErrInvalidRoutable = errors.New("Malformed routable")
+	ErrUnsignedRoute   = errors.New("Missing or invalid routing signature")
+	ErrStaleRoute      = errors.New("Routing timestamp outside allowed skew")
+	ErrRouteFormat     = errors.New("Unknown routing format")
+)
+
+// Routing frame formats. Receiving nodes decode both formats, based on the
+// request content type.
+const (
+	RouteFormatCapnp    = "capnp"
+	RouteFormatProtobuf = "protobuf"
+
+	contentTypeCapnp    = "application/x-capnproto"
+	contentTypeProtobuf = "application/x-protobuf"
+)
+
+// Routing request headers. Signed requests include the time the request was
+// sent, in seconds since Epoch, and the HMAC of the request.
+const (
+	HeaderRouteTime      = "X-Route-Timestamp"
+	HeaderRouteSignature = "X-Route-Signature"
 )
 
 type BroadcastRouterConfig struct {
@@ -56,6 +79,37 @@ type BroadcastRouterConfig struct {
 	Listener TCPListenerConfig
 
 	MaxDataLen int `toml:"max_data_len" env:"max_data_len"`
+
+	// SigningKey is the base64-encoded cluster key used to sign routing
+	// requests. If set, the router signs outgoing requests, and rejects
+	// unsigned or stale incoming requests. All nodes in a cluster must use the
+	// same key. No default value; requests are not signed if unspecified.
+	SigningKey string `toml:"signing_key" env:"signing_key"`
+
+	// MaxSkew is the maximum difference between the signed request time and
+	// the receiving node's clock. Defaults to 30 seconds.
+	MaxSkew string `toml:"max_skew" env:"max_skew"`
+
+	// Format is the encoding used for outgoing routing requests: "capnp" or
+	// "protobuf". Nodes using protobuf also request delivery receipts.
+	// Defaults to "capnp".
+	Format string
+
+	// Peering specifies the node-to-node handshake, used to refuse routing to
+	// incompatible or wrong-cluster peers.
+	Peering PeeringConfig
+
+	// MaxPending is the maximum number of routing requests in flight to each
+	// peer. Once a peer's queue is full, updates for devices connected to it
+	// are rejected with a 503 instead of queued. Defaults to 0, which does not
+	// limit pending requests.
+	MaxPending int `toml:"max_pending" env:"max_pending"`
+
+	// Direct records the node that each device is connected to in the store,
+	// and routes updates for the device to that node before probing the
+	// other contacts. Requires a store that supports direct routing. Defaults
+	// to false.
+	Direct bool
 }
 
 // Router proxies incoming updates to the Simple Push server ("contact") that
@@ -77,6 +131,15 @@ type BroadcastRouter struct {
 	closeWait   sync.WaitGroup
 	closeSignal chan bool
 	maxDataLen  int
+	signingKey  []byte
+	maxSkew     time.Duration
+	format      string
+	brownout    *Brownout
+	peering     *Peering
+	maxPending  int
+	pendingMux  sync.Mutex
+	pending     map[string]int // In-flight routing requests, by contact.
+	routes      RouteStore     // Device routes; nil if direct routing is off.
 	routerMux   *mux.Router
 	closeOnce   Once
 }
@@ -86,6 +149,7 @@ func NewBroadcastRouter() (r *BroadcastRouter) {
 		routerMux:   mux.NewRouter(),
 		closeSignal: make(chan bool),
 		rclient:     new(http.Client),
+		pending:     make(map[string]int),
 	}
 	r.routerMux.HandleFunc("/route/{uaid}", r.RouteHandler)
 	return r
@@ -103,6 +167,12 @@ func (*BroadcastRouter) ConfigStruct() interface{} {
 			KeepAlivePeriod: "3m",
 		},
 		MaxDataLen: 4096,
+		MaxSkew:    "30s",
+		Format:     RouteFormatCapnp,
+		Peering: PeeringConfig{
+			Enabled: false,
+			TTL:     "5m",
+		},
 	}
 }
 
@@ -128,6 +198,32 @@ func (r *BroadcastRouter) Init(app *Application, config interface{}) (err error)
 		return err
 	}
 	r.setClientOptions(conf.BucketSize, ctimeout, rwtimeout)
+	if len(conf.SigningKey) > 0 {
+		signingKey, err := base64.URLEncoding.DecodeString(conf.SigningKey)
+		if err != nil {
+			r.logger.Panic("router", "Could not decode signing key",
+				LogFields{"error": err.Error()})
+			return err
+		}
+		if err = cryptoProvider.CheckKey(signingKey); err != nil {
+			r.logger.Panic("router", "Invalid signing key",
+				LogFields{"error": err.Error(), "crypto": cryptoProvider.Name()})
+			return err
+		}
+		maxSkew, err := time.ParseDuration(conf.MaxSkew)
+		if err != nil {
+			r.logger.Panic("router", "Could not parse max_skew",
+				LogFields{"error": err.Error(), "max_skew": conf.MaxSkew})
+			return err
+		}
+		r.setSigningKey(signingKey, maxSkew)
+	}
+	if conf.Format != RouteFormatCapnp && conf.Format != RouteFormatProtobuf {
+		r.logger.Panic("router", "Unknown routing format",
+			LogFields{"format": conf.Format})
+		return ErrRouteFormat
+	}
+	r.format = conf.Format
 	r.setClientTransport(&http.Transport{
 		Dial:                r.dial,
 		MaxIdleConnsPerHost: conf.IdleConns,
@@ -140,7 +236,24 @@ func (r *BroadcastRouter) Init(app *Application, config interface{}) (err error)
 			LogFields{"error": err.Error()})
 		return err
 	}
+	if conf.Peering.Enabled {
+		if err = r.setPeering(conf.Peering); err != nil {
+			r.logger.Panic("router", "Could not configure peering",
+				LogFields{"error": err.Error(), "ttl": conf.Peering.TTL})
+			return err
+		}
+	}
+	if conf.Direct {
+		routes, ok := app.Store().(RouteStore)
+		if !ok {
+			r.logger.Panic("router", "Could not enable direct routing",
+				LogFields{"error": ErrNoRouteStore.Error()})
+			return ErrNoRouteStore
+		}
+		r.routes = routes
+	}
 	r.maxDataLen = conf.MaxDataLen
+	r.maxPending = conf.MaxPending
 	r.server = NewServeCloser(&http.Server{
 		ConnState: func(c net.Conn, state http.ConnState) {
 			if state == http.StateNew {
@@ -160,6 +273,7 @@ func (r *BroadcastRouter) setApp(app *Application) {
 	r.app = app
 	r.logger = app.Logger()
 	r.metrics = app.Metrics()
+	r.brownout = app.Brownout()
 	if len(r.hostname) == 0 {
 		r.hostname = app.Hostname()
 	}
@@ -167,7 +281,7 @@ func (r *BroadcastRouter) setApp(app *Application) {
 
 // listenWithConfig starts a listener for the routing handler.
 func (r *BroadcastRouter) listenWithConfig(conf ListenerConfig) (err error) {
-	if r.listener, err = conf.Listen(); err != nil {
+	if r.listener, err = conf.Listen(r.app); err != nil {
 		return err
 	}
 	var scheme string
@@ -193,12 +307,41 @@ func (r *BroadcastRouter) setClientOptions(bucketSize int, ctimeout,
 	r.rclient.Timeout = rwtimeout
 }
 
+// setSigningKey sets the key used to sign and verify routing requests, and
+// the maximum allowed clock skew between nodes.
+func (r *BroadcastRouter) setSigningKey(key []byte, maxSkew time.Duration) {
+	r.signingKey = key
+	r.maxSkew = maxSkew
+}
+
 // setClientTransport overrides the HTTP client transport for this router.
 // This is used by the tests to install a synthetic dialer.
 func (r *BroadcastRouter) setClientTransport(transport http.RoundTripper) {
 	r.rclient.Transport = transport
 }
 
+// setPeering enables the peering handshake. Nodes accept both routing
+// formats; peers must accept the format used by this node.
+func (r *BroadcastRouter) setPeering(conf PeeringConfig) (err error) {
+	local := PeerInfo{
+		Node:         r.url,
+		Capabilities: []string{RouteFormatCapnp, RouteFormatProtobuf},
+	}
+	if len(r.signingKey) > 0 {
+		local.Capabilities = append(local.Capabilities, PeerCapSigned)
+	}
+	required := []string{r.format}
+	if r.peering, err = NewPeering(r.app, local, required, conf, r.rclient); err != nil {
+		return err
+	}
+	r.peering.setSigningKey(r.signingKey, r.maxSkew)
+	r.routerMux.HandleFunc("/peer", r.peering.HandshakeHandler).Methods("POST")
+	return nil
+}
+
+// Peering implements PeeringRouter.Peering.
+func (r *BroadcastRouter) Peering() *Peering { return r.peering }
+
 func (r *BroadcastRouter) Hostname() string { return r.hostname }
 
 func (r *BroadcastRouter) Start(errChan chan<- error) {
@@ -227,38 +370,80 @@ func (r *BroadcastRouter) RouteHandler(resp http.ResponseWriter, req *http.Reque
 		return
 	}
 
+	body := io.Reader(req.Body)
+	if len(r.signingKey) > 0 {
+		// Verify the signature before looking up the worker, so that unsigned
+		// requests can't probe for connected devices.
+		signed, err := r.verifyRoute(req, uaid)
+		if err != nil {
+			if logWarning {
+				r.logger.Warn("router", "Rejecting routing request",
+					LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid,
+						"error": err.Error()})
+			}
+			http.Error(resp, "Forbidden", http.StatusForbidden)
+			if err == ErrStaleRoute {
+				r.metrics.Increment("updates.routed.stale")
+			} else {
+				r.metrics.Increment("updates.routed.unsigned")
+			}
+			return
+		}
+		body = bytes.NewReader(signed)
+	}
+
 	worker, found := r.app.GetWorker(uaid)
 	if !found {
-		http.Error(resp, "UID Not Found", http.StatusNotFound)
+		// The device may reconnect with a parked session; it must fetch this
+		// update from the store.
+		r.app.Sessions().Missed(uaid)
+		r.writeReceipt(resp, req, http.StatusNotFound, "UID Not Found",
+			&RouteReceipt{
+				Status: RouteReceipt_UNKNOWN_DEVICE.Enum(),
+				Uaid:   proto.String(uaid),
+			})
 		r.metrics.Increment("updates.routed.unknown")
 		return
 	}
 
 	// We know of this one.
-	var (
-		routable   Routable
-		chid, data string
-	)
-	segment, err := capn.ReadFromStream(req.Body, nil)
+	frame, err := r.decodeFrame(req.Header.Get("Content-Type"), body)
 	if err != nil {
 		if logWarning {
 			r.logger.Warn("router", "Could not read update body",
 				LogFields{"rid": req.Header.Get(HeaderID), "error": err.Error()})
 		}
-		goto invalidBody
+		r.invalidBody(resp, req, uaid)
+		return
 	}
-	routable = ReadRootRoutable(segment)
-	chid = routable.ChannelID()
+	if frame.Uaid != nil && frame.GetUaid() != uaid {
+		// Protobuf frames name the device; reject frames routed to another
+		// device's URL.
+		if logWarning {
+			r.logger.Warn("router", "Mismatched device ID in routing frame",
+				LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid,
+					"frameUAID": frame.GetUaid()})
+		}
+		r.invalidBody(resp, req, uaid)
+		return
+	}
+	chid := frame.GetChannelId()
 	if len(chid) == 0 {
 		if logWarning {
 			r.logger.Warn("router", "Missing channel ID",
 				LogFields{"rid": req.Header.Get(HeaderID), "uaid": uaid})
 		}
-		goto invalidBody
+		r.invalidBody(resp, req, uaid)
+		return
 	}
 	r.metrics.Increment("updates.routed.incoming")
+	receipt := &RouteReceipt{
+		Uaid:      proto.String(uaid),
+		ChannelId: proto.String(chid),
+		Version:   proto.Int64(frame.GetVersion()),
+	}
 	// Never trust external data
-	data = routable.Data()
+	data := frame.GetData()
 	if len(data) > r.maxDataLen {
 		if logWarning {
 			r.logger.Warn("router", "Data segment too long, truncating",
@@ -267,25 +452,194 @@ func (r *BroadcastRouter) RouteHandler(resp http.ResponseWriter, req *http.Reque
 		}
 		data = data[:r.maxDataLen]
 	}
-	// routed data is already in storage.
-	if err = worker.Send(chid, routable.Version(), data); err != nil {
+	// Routed updates are already in storage; the sending node's store write
+	// rejected unregistered channels, so the tombstone isn't fetched again.
+	if err = worker.Send(chid, frame.GetVersion(), data); err != nil {
 		if logWarning {
 			r.logger.Warn("router", "Could not update local user",
 				LogFields{"rid": req.Header.Get(HeaderID), "error": err.Error()})
 		}
-		http.Error(resp, "Server Error", http.StatusInternalServerError)
+		receipt.Status = RouteReceipt_ERROR.Enum()
+		r.writeReceipt(resp, req, http.StatusInternalServerError,
+			"Server Error", receipt)
 		r.metrics.Increment("updates.routed.error")
 		return
 	}
-	resp.Write([]byte("Ok"))
+	receipt.Status = RouteReceipt_DELIVERED.Enum()
+	r.writeReceipt(resp, req, http.StatusOK, "Ok", receipt)
 	r.metrics.Increment("updates.routed.received")
-	return
+}
+
+// invalidBody rejects a routing request with a malformed body.
+func (r *BroadcastRouter) invalidBody(resp http.ResponseWriter,
+	req *http.Request, uaid string) {
 
-invalidBody:
-	http.Error(resp, "Invalid body", http.StatusNotAcceptable)
+	r.writeReceipt(resp, req, http.StatusNotAcceptable, "Invalid body",
+		&RouteReceipt{
+			Status: RouteReceipt_INVALID.Enum(),
+			Uaid:   proto.String(uaid),
+		})
 	r.metrics.Increment("updates.routed.invalid")
 }
 
+// writeReceipt writes the response to a routing request. If the sending node
+// accepts protobuf, the response body is the delivery receipt; otherwise, the
+// body is msg. Receipts are not sent in brownout mode.
+func (r *BroadcastRouter) writeReceipt(resp http.ResponseWriter,
+	req *http.Request, code int, msg string, receipt *RouteReceipt) {
+
+	if r.brownout.Active() ||
+		!strings.Contains(req.Header.Get("Accept"), contentTypeProtobuf) {
+		if code == http.StatusOK {
+			resp.Write([]byte(msg))
+		} else {
+			http.Error(resp, msg, code)
+		}
+		return
+	}
+	receipt.Node = proto.String(r.url)
+	receipt.Time = proto.Int64(timeNow().UnixNano())
+	body, err := proto.Marshal(receipt)
+	if err != nil {
+		http.Error(resp, msg, code)
+		return
+	}
+	resp.Header().Set("Content-Type", contentTypeProtobuf)
+	resp.WriteHeader(code)
+	resp.Write(body)
+}
+
+// readReceipt reads the delivery receipt from a routing response, returning
+// nil if the contact did not send one. The body is fully consumed; otherwise,
+// the HTTP client will not reuse the underlying TCP connection.
+func readReceipt(resp *http.Response) *RouteReceipt {
+	defer io.Copy(ioutil.Discard, resp.Body)
+	if resp.Header.Get("Content-Type") != contentTypeProtobuf {
+		return nil
+	}
+	// Receipts are small; cap the body to avoid buffering large responses.
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return nil
+	}
+	receipt := new(RouteReceipt)
+	if err = proto.Unmarshal(raw, receipt); err != nil {
+		return nil
+	}
+	return receipt
+}
+
+// encodeFrame encodes an outgoing routing request in the configured format.
+func (r *BroadcastRouter) encodeFrame(uaid, chid string, version int64,
+	sentAt time.Time, data string) ([]byte, error) {
+
+	if r.format == RouteFormatProtobuf {
+		return proto.Marshal(&RouteFrame{
+			Uaid:      proto.String(uaid),
+			ChannelId: proto.String(chid),
+			Version:   proto.Int64(version),
+			Time:      proto.Int64(sentAt.UnixNano()),
+			Data:      proto.String(data),
+		})
+	}
+	segment := capn.NewBuffer(nil)
+	routable := NewRootRoutable(segment)
+	routable.SetChannelID(chid)
+	routable.SetVersion(version)
+	routable.SetTime(sentAt.UnixNano())
+	routable.SetData(data)
+	buf := new(bytes.Buffer)
+	if _, err := segment.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeFrame decodes an incoming routing request. Requests without a
+// protobuf content type are decoded as Cap'n Proto segments, for
+// compatibility with older nodes.
+func (r *BroadcastRouter) decodeFrame(contentType string, body io.Reader) (
+	frame *RouteFrame, err error) {
+
+	if contentType == contentTypeProtobuf {
+		var raw []byte
+		if raw, err = ioutil.ReadAll(io.LimitReader(body, r.maxBodyLen())); err != nil {
+			return nil, err
+		}
+		frame = new(RouteFrame)
+		if err = proto.Unmarshal(raw, frame); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+	segment, err := capn.ReadFromStream(body, nil)
+	if err != nil {
+		return nil, err
+	}
+	routable := ReadRootRoutable(segment)
+	return &RouteFrame{
+		ChannelId: proto.String(routable.ChannelID()),
+		Version:   proto.Int64(routable.Version()),
+		Time:      proto.Int64(routable.Time()),
+		Data:      proto.String(routable.Data()),
+	}, nil
+}
+
+// maxBodyLen returns the maximum size of a routing request body. Frames are
+// small; capping the body avoids buffering arbitrarily large requests.
+func (r *BroadcastRouter) maxBodyLen() int64 {
+	return int64(r.maxDataLen) + 4096
+}
+
+// signRoute returns the signature for a routing request to uaid, sent at
+// time sentAt (in seconds since Epoch). The signature is the MAC of the time,
+// device ID, and request body; HMAC-SHA256 with the default crypto provider.
+func signRoute(key []byte, uaid string, sentAt int64, body []byte) string {
+	mac := cryptoProvider.NewMAC(key)
+	io.WriteString(mac, strconv.FormatInt(sentAt, 10))
+	io.WriteString(mac, "\n")
+	io.WriteString(mac, uaid)
+	io.WriteString(mac, "\n")
+	mac.Write(body)
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyRoute checks the signature and timestamp of an incoming routing
+// request, returning the request body if the request is valid.
+func (r *BroadcastRouter) verifyRoute(req *http.Request, uaid string) (
+	body []byte, err error) {
+
+	return verifySigned(req, r.signingKey, r.maxSkew, uaid, r.maxBodyLen())
+}
+
+// verifySigned checks the signature and timestamp of a signed node-to-node
+// request, returning up to maxLen bytes of the request body if the request
+// is valid.
+func verifySigned(req *http.Request, key []byte, maxSkew time.Duration,
+	uaid string, maxLen int64) (body []byte, err error) {
+
+	signature := req.Header.Get(HeaderRouteSignature)
+	if len(signature) == 0 {
+		return nil, ErrUnsignedRoute
+	}
+	sentAt, err := strconv.ParseInt(req.Header.Get(HeaderRouteTime), 10, 64)
+	if err != nil {
+		return nil, ErrUnsignedRoute
+	}
+	skew := timeNow().Sub(time.Unix(sentAt, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return nil, ErrStaleRoute
+	}
+	if body, err = ioutil.ReadAll(io.LimitReader(req.Body, maxLen)); err != nil {
+		return nil, err
+	}
+	expected := signRoute(key, uaid, sentAt, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, ErrUnsignedRoute
+	}
+	return body, nil
+}
+
 func (r *BroadcastRouter) dial(netw, addr string) (c net.Conn, err error) {
 	c, err = net.DialTimeout(netw, addr, r.ctimeout)
 	if err != nil {
@@ -312,12 +666,36 @@ func (r *BroadcastRouter) ServeMux() ServeMux {
 	return (*RouteMux)(r.routerMux)
 }
 
-func (r *BroadcastRouter) Register(uaid string) error {
-	return nil
+// Register records this node as the device's route, if direct routing is
+// enabled.
+func (r *BroadcastRouter) Register(uaid string) (err error) {
+	if r.routes == nil {
+		return nil
+	}
+	if err = r.routes.PutRoute(uaid, r.url); err != nil {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("router", "Could not record device route",
+				LogFields{"uaid": uaid, "error": err.Error()})
+		}
+		r.metrics.Increment("router.direct.error")
+	}
+	return err
 }
 
-func (r *BroadcastRouter) Unregister(uaid string) error {
-	return nil
+// Unregister removes the device's route, unless the device has since
+// connected to another node.
+func (r *BroadcastRouter) Unregister(uaid string) (err error) {
+	if r.routes == nil {
+		return nil
+	}
+	if err = r.routes.DropRoute(uaid, r.url); err != nil {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("router", "Could not remove device route",
+				LogFields{"uaid": uaid, "error": err.Error()})
+		}
+		r.metrics.Increment("router.direct.error")
+	}
+	return err
 }
 
 func (r *BroadcastRouter) Status() (bool, error) {
@@ -363,12 +741,32 @@ func (r *BroadcastRouter) Route(cancelSignal <-chan bool, uaid, chid string,
 		r.metrics.Increment("router.broadcast.error")
 		return false, ErrNoLocator
 	}
-	segment := capn.NewBuffer(nil)
-	routable := NewRootRoutable(segment)
-	routable.SetChannelID(chid)
-	routable.SetVersion(version)
-	routable.SetTime(sentAt.UnixNano())
-	routable.SetData(data)
+	body, err := r.encodeFrame(uaid, chid, version, sentAt, data)
+	if err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("router", "Could not encode routing request",
+				LogFields{"rid": logID, "error": err.Error()})
+		}
+		r.metrics.Increment("router.broadcast.error")
+		return false, err
+	}
+	owner, result, err := r.notifyOwner(cancelSignal, uaid, body, logID)
+	if err != nil {
+		return false, err
+	}
+	if result == routeDelivered {
+		return true, nil
+	}
+	if result == routeBusy {
+		// The update is stored; the device will fetch it when the node's
+		// queue drains or the device reconnects.
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("router", "Routing queue full for device's node",
+				LogFields{"rid": logID, "uaid": uaid, "peer": owner})
+		}
+		r.metrics.Increment("router.broadcast.busy")
+		return false, nil
+	}
 	contacts, err := locator.Contacts(uaid)
 	if err != nil {
 		if r.logger.ShouldLog(CRITICAL) {
@@ -391,7 +789,11 @@ func (r *BroadcastRouter) Route(cancelSignal <-chan bool, uaid, chid string,
 			"data":    data,
 			"time":    strconv.FormatInt(sentAt.UnixNano(), 10)})
 	}
-	delivered, err = r.notifyAll(cancelSignal, contacts, uaid, segment, logID)
+	if len(owner) > 0 {
+		// The device's node didn't accept the update; don't probe it again.
+		contacts = withoutContact(contacts, owner)
+	}
+	result, err = r.notifyAll(cancelSignal, contacts, uaid, body, logID)
 	if err != nil {
 		if r.logger.ShouldLog(WARNING) {
 			r.logger.Warn("router", "Could not post to server",
@@ -400,102 +802,228 @@ func (r *BroadcastRouter) Route(cancelSignal <-chan bool, uaid, chid string,
 		r.metrics.Increment("router.broadcast.error")
 		return false, err
 	}
-	return delivered, nil
+	if result == routeBusy {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("router", "Routing queues full for all contacts",
+				LogFields{"rid": logID, "uaid": uaid, "chid": chid})
+		}
+		r.metrics.Increment("router.broadcast.busy")
+	}
+	return result == routeDelivered, nil
+}
+
+// notifyOwner routes an update to the node that the device is connected to,
+// if direct routing is enabled and the device's route is known. Returns the
+// node, or an empty string if the update wasn't sent.
+func (r *BroadcastRouter) notifyOwner(cancelSignal <-chan bool, uaid string,
+	body []byte, logID string) (owner string, result routeResult, err error) {
+
+	if r.routes == nil {
+		return "", routeMissed, nil
+	}
+	owner, err = r.routes.FetchRoute(uaid)
+	if err != nil {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("router", "Could not fetch device route",
+				LogFields{"rid": logID, "uaid": uaid, "error": err.Error()})
+		}
+		r.metrics.Increment("router.direct.error")
+		return "", routeMissed, nil
+	}
+	if len(owner) == 0 || owner == r.url {
+		// Unknown or stale route. Updates are only routed if the device isn't
+		// connected to this node.
+		r.metrics.Increment("router.direct.unknown")
+		return "", routeMissed, nil
+	}
+	if result, err = r.notifyBucket(cancelSignal, []string{owner}, uaid, body,
+		logID); err != nil {
+		return "", routeMissed, err
+	}
+	switch result {
+	case routeDelivered:
+		r.metrics.Increment("router.direct.hit")
+	case routeMissed:
+		r.metrics.Increment("router.direct.miss")
+	}
+	return owner, result, nil
+}
+
+// withoutContact returns a copy of contacts without the given contact.
+func withoutContact(contacts []string, contact string) []string {
+	filtered := make([]string, 0, len(contacts))
+	for _, c := range contacts {
+		if c != contact {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered
 }
 
 // notifyAll partitions a slice of contacts into buckets, then broadcasts an
 // update to each bucket.
 func (r *BroadcastRouter) notifyAll(cancelSignal <-chan bool, contacts []string,
-	uaid string, segment *capn.Segment, logID string) (delivered bool, err error) {
+	uaid string, body []byte, logID string) (result routeResult, err error) {
 
-	for fromIndex := 0; !delivered && fromIndex < len(contacts); {
+	for fromIndex := 0; result != routeDelivered && fromIndex < len(contacts); {
 		toIndex := fromIndex + r.bucketSize
 		if toIndex > len(contacts) {
 			toIndex = len(contacts)
 		}
-		if delivered, err = r.notifyBucket(cancelSignal, contacts[fromIndex:toIndex],
-			uaid, segment, logID); err != nil {
-			break
+		bucketResult, err := r.notifyBucket(cancelSignal,
+			contacts[fromIndex:toIndex], uaid, body, logID)
+		if err != nil {
+			return routeMissed, err
+		}
+		if bucketResult > result {
+			result = bucketResult
 		}
 		fromIndex += toIndex
 	}
-	return
+	return result, nil
 }
 
 // notifyBucket routes a message to all contacts in a bucket, returning as soon
-// as a contact accepts the update.
+// as a contact accepts the update. Returns routeBusy if no contact accepted
+// the update, and at least one contact's routing queue was full.
 func (r *BroadcastRouter) notifyBucket(cancelSignal <-chan bool,
-	contacts []string, uaid string, segment *capn.Segment, logID string) (
-	delivered bool, err error) {
+	contacts []string, uaid string, body []byte, logID string) (
+	result routeResult, err error) {
 
 	timeout := r.ctimeout + r.rwtimeout + 1*time.Second
-	deliveries := make(chan bool, len(contacts))
+	deliveries := make(chan routeResult, len(contacts))
 	for _, contact := range contacts {
-		url := fmt.Sprintf("%s/route/%s", contact, uaid)
-		go r.notifyContact(deliveries, url, segment, logID)
+		go r.notifyContact(deliveries, contact, uaid, body, logID)
 	}
-	timer := time.After(timeout)
-	for i := 0; !delivered && i < cap(deliveries); i++ {
+	timer := clock.After(timeout)
+	for i := 0; result != routeDelivered && i < cap(deliveries); i++ {
 		select {
 		case <-r.closeSignal:
-			return false, io.EOF
+			return routeMissed, io.EOF
 		case <-cancelSignal:
-		case delivered = <-deliveries:
+		case contactResult := <-deliveries:
+			if contactResult > result {
+				result = contactResult
+			}
 		case <-timer:
 		}
 	}
-	return delivered, nil
+	return result, nil
+}
+
+// acquirePending reserves a routing queue slot for the contact. Returns false
+// if the contact's queue is full.
+func (r *BroadcastRouter) acquirePending(contact string) bool {
+	if r.maxPending <= 0 {
+		return true
+	}
+	r.pendingMux.Lock()
+	defer r.pendingMux.Unlock()
+	if r.pending[contact] >= r.maxPending {
+		return false
+	}
+	r.pending[contact]++
+	return true
+}
+
+// releasePending frees a routing queue slot reserved by acquirePending.
+func (r *BroadcastRouter) releasePending(contact string) {
+	if r.maxPending <= 0 {
+		return
+	}
+	r.pendingMux.Lock()
+	if r.pending[contact]--; r.pending[contact] <= 0 {
+		delete(r.pending, contact)
+	}
+	r.pendingMux.Unlock()
 }
 
 // notifyContact routes a message to a single contact.
-func (r *BroadcastRouter) notifyContact(deliveries chan<- bool, url string,
-	segment *capn.Segment, logID string) {
+func (r *BroadcastRouter) notifyContact(deliveries chan<- routeResult,
+	contact string, uaid string, body []byte, logID string) {
 
-	buf := bytes.Buffer{}
-	segment.WriteTo(&buf)
-	req, err := http.NewRequest("PUT", url, &buf)
+	if !r.peering.Allow(contact) {
+		r.metrics.Increment("router.peer.refused")
+		deliveries <- routeMissed
+		return
+	}
+	if !r.acquirePending(contact) {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("router", "Routing queue full for contact",
+				LogFields{"rid": logID, "peer": contact,
+					"pending": strconv.Itoa(r.maxPending)})
+		}
+		r.metrics.Increment("router.peer.backpressure." +
+			strings.Map(cleanMetricPart, contact))
+		deliveries <- routeBusy
+		return
+	}
+	defer r.releasePending(contact)
+	url := fmt.Sprintf("%s/route/%s", contact, uaid)
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
 	if err != nil {
 		if r.logger.ShouldLog(ERROR) {
 			r.logger.Error("router", "Router request failed",
 				LogFields{"rid": logID, "error": err.Error()})
 		}
-		deliveries <- false
+		deliveries <- routeMissed
 		return
 	}
 	req.Header.Set(HeaderID, logID)
+	if len(r.signingKey) > 0 {
+		sentAt := timeNow().Unix()
+		req.Header.Set(HeaderRouteTime, strconv.FormatInt(sentAt, 10))
+		req.Header.Set(HeaderRouteSignature,
+			signRoute(r.signingKey, uaid, sentAt, body))
+	}
 	if r.logger.ShouldLog(DEBUG) {
 		r.logger.Debug("router", "Sending request",
 			LogFields{"rid": logID, "url": url})
 	}
-	req.Header.Add("Content-Type", "application/json")
+	if r.format == RouteFormatProtobuf {
+		req.Header.Set("Content-Type", contentTypeProtobuf)
+		req.Header.Set("Accept", contentTypeProtobuf)
+	} else {
+		req.Header.Set("Content-Type", contentTypeCapnp)
+	}
 	resp, err := r.rclient.Do(req)
 	if err != nil {
 		if r.logger.ShouldLog(ERROR) {
 			r.logger.Error("router", "Router send failed",
 				LogFields{"rid": logID, "error": err.Error()})
 		}
-		deliveries <- false
+		deliveries <- routeMissed
 		return
 	}
 	defer resp.Body.Close()
-	// Discard the response body. If the body is not fully consumed, the HTTP
-	// client will not reuse the underlying TCP connection.
-	io.Copy(ioutil.Discard, resp.Body)
+	fields := LogFields{"rid": logID, "url": url}
+	if receipt := readReceipt(resp); receipt != nil {
+		fields["status"] = receipt.GetStatus().String()
+		fields["node"] = receipt.GetNode()
+	}
 	if resp.StatusCode != 200 {
 		if r.logger.ShouldLog(DEBUG) {
-			r.logger.Debug("router", "Denied",
-				LogFields{"rid": logID, "url": url})
+			r.logger.Debug("router", "Denied", fields)
 		}
-		deliveries <- false
+		deliveries <- routeMissed
 		return
 	}
 	if r.logger.ShouldLog(INFO) {
-		r.logger.Info("router", "Server accepted",
-			LogFields{"rid": logID, "url": url})
+		r.logger.Info("router", "Server accepted", fields)
 	}
-	deliveries <- true
+	deliveries <- routeDelivered
 }
 
+// routeResult is the outcome of routing an update to a contact, ordered so
+// that a successful delivery takes precedence over a full queue.
+type routeResult int
+
+const (
+	routeMissed routeResult = iota
+	routeBusy
+	routeDelivered
+)
+
 func init() {
 	AvailableRouters["broadcast"] = func() HasConfigStruct {
 		return NewBroadcastRouter()
@@ -5,11 +5,17 @@
 package simplepush
 
 import (
+	"bytes"
 	"errors"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/rafrombrc/gomock/gomock"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -114,10 +120,355 @@ func TestBroadcastRouter(t *testing.T) {
 		So(delivered, ShouldBeTrue)
 	})
 
+	Convey("Should succeed self-routing signed updates", t, func() {
+		router.setSigningKey([]byte("s3cr3t"), 30*time.Second)
+		defer router.setSigningKey(nil, 0)
+
+		mockWorker := NewMockWorker(mockCtrl)
+		app.AddWorker(uaid, mockWorker)
+
+		mckLocator.EXPECT().Contacts(gomock.Any()).Return([]string{router.URL()}, nil)
+		mckStat.EXPECT().Increment("updates.routed.incoming")
+		mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+		mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+			gomock.Any()).AnyTimes()
+		mockWorker.EXPECT().Send(chid, version, "").Return(nil)
+		mckStat.EXPECT().Gauge("update.client.connections", gomock.Any()).AnyTimes()
+		mckStat.EXPECT().Increment("updates.routed.received")
+		mckStat.EXPECT().Increment("router.dial.success").AnyTimes()
+		mckStat.EXPECT().Increment("router.dial.error").AnyTimes()
+
+		delivered, err := router.Route(cancelSignal, uaid, chid, version, sentAt,
+			"", "")
+		So(err, ShouldBeNil)
+		So(delivered, ShouldBeTrue)
+	})
+
+	Convey("Should succeed self-routing protobuf updates", t, func() {
+		router.format = RouteFormatProtobuf
+		defer func() { router.format = RouteFormatCapnp }()
+
+		mockWorker := NewMockWorker(mockCtrl)
+		app.AddWorker(uaid, mockWorker)
+
+		mckLocator.EXPECT().Contacts(gomock.Any()).Return([]string{router.URL()}, nil)
+		mckStat.EXPECT().Increment("updates.routed.incoming")
+		mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+		mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+			gomock.Any()).AnyTimes()
+		mockWorker.EXPECT().Send(chid, version, "hello").Return(nil)
+		mckStat.EXPECT().Gauge("update.client.connections", gomock.Any()).AnyTimes()
+		mckStat.EXPECT().Increment("updates.routed.received")
+		mckStat.EXPECT().Increment("router.dial.success").AnyTimes()
+		mckStat.EXPECT().Increment("router.dial.error").AnyTimes()
+
+		delivered, err := router.Route(cancelSignal, uaid, chid, version, sentAt,
+			"", "hello")
+		So(err, ShouldBeNil)
+		So(delivered, ShouldBeTrue)
+	})
+
+	Convey("Should refuse to route to contacts with full queues", t, func() {
+		thisNode := router.URL()
+		peerMetric := strings.Map(cleanMetricPart, thisNode)
+		router.maxPending = 1
+		router.pending[thisNode] = 1
+		defer func() {
+			router.maxPending = 0
+			delete(router.pending, thisNode)
+		}()
+
+		mckLocator.EXPECT().Contacts(gomock.Any()).Return([]string{thisNode}, nil)
+		mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+		mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+			gomock.Any()).AnyTimes()
+		gomock.InOrder(
+			mckStat.EXPECT().Increment("router.peer.backpressure."+peerMetric),
+			mckStat.EXPECT().Increment("router.broadcast.busy"),
+		)
+
+		delivered, err := router.Route(cancelSignal, uaid, chid, version, sentAt,
+			"", "")
+		So(err, ShouldBeNil)
+		So(delivered, ShouldBeFalse)
+		So(router.pending[thisNode], ShouldEqual, 1)
+	})
+
+	Convey("Should reject protobuf frames for other devices", t, func() {
+		mockWorker := NewMockWorker(mockCtrl)
+		app.AddWorker(uaid, mockWorker)
+		defer app.RemoveWorker(uaid, mockWorker)
+
+		mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+		mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+			gomock.Any()).AnyTimes()
+		mckStat.EXPECT().Increment("updates.routed.invalid")
+
+		body, err := proto.Marshal(&RouteFrame{
+			Uaid:      proto.String("0d6a6d0c-a1ba-4be1-bc8a-2cea8e4ddb1a"),
+			ChannelId: proto.String(chid),
+			Version:   proto.Int64(version),
+		})
+		So(err, ShouldBeNil)
+		req, err := http.NewRequest("PUT", "/route/"+uaid, bytes.NewReader(body))
+		So(err, ShouldBeNil)
+		req.Header.Set("Content-Type", contentTypeProtobuf)
+		resp := httptest.NewRecorder()
+		router.ServeMux().ServeHTTP(resp, req)
+		So(resp.Code, ShouldEqual, http.StatusNotAcceptable)
+	})
+
+	Convey("Should route directly to the device's node", t, func() {
+		routes := &routeStore{routes: make(map[string]string)}
+		router.routes = routes
+		defer func() { router.routes = nil }()
+
+		mockWorker := NewMockWorker(mockCtrl)
+		app.AddWorker(uaid, mockWorker)
+		defer app.RemoveWorker(uaid, mockWorker)
+
+		mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+		mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+			gomock.Any()).AnyTimes()
+		mckStat.EXPECT().Increment("router.dial.success").AnyTimes()
+		mckStat.EXPECT().Increment("router.dial.error").AnyTimes()
+
+		Convey("Should record routes for connected devices", func() {
+			So(router.Register(uaid), ShouldBeNil)
+			So(routes.routes[uaid], ShouldEqual, router.URL())
+
+			// Routes recorded by other nodes are kept.
+			routes.routes[uaid] = "http://node-b:3000"
+			So(router.Unregister(uaid), ShouldBeNil)
+			So(routes.routes[uaid], ShouldEqual, "http://node-b:3000")
+
+			routes.routes[uaid] = router.URL()
+			So(router.Unregister(uaid), ShouldBeNil)
+			So(routes.routes, ShouldBeEmpty)
+		})
+
+		Convey("Should not query the locator if the node accepts", func() {
+			// The pipe dialer connects all nodes to this router.
+			routes.routes[uaid] = "http://node-b:3000"
+			mckStat.EXPECT().Increment("updates.routed.incoming")
+			mockWorker.EXPECT().Send(chid, version, "").Return(nil)
+			mckStat.EXPECT().Increment("updates.routed.received")
+			mckStat.EXPECT().Increment("router.direct.hit")
+
+			delivered, err := router.Route(cancelSignal, uaid, chid, version,
+				sentAt, "", "")
+			So(err, ShouldBeNil)
+			So(delivered, ShouldBeTrue)
+		})
+
+		Convey("Should probe other contacts if the route is stale", func() {
+			routes.routes[uaid] = "http://node-b:3000"
+			app.RemoveWorker(uaid, mockWorker)
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("updates.routed.unknown"),
+				mckStat.EXPECT().Increment("router.direct.miss"),
+				mckLocator.EXPECT().Contacts(uaid).Return(
+					[]string{"http://node-b:3000"}, nil),
+			)
+
+			delivered, err := router.Route(cancelSignal, uaid, chid, version,
+				sentAt, "", "")
+			So(err, ShouldBeNil)
+			So(delivered, ShouldBeFalse)
+		})
+
+		Convey("Should not probe other contacts if the node is busy", func() {
+			owner := "http://node-b:3000"
+			routes.routes[uaid] = owner
+			router.maxPending = 1
+			router.pending[owner] = 1
+			defer func() {
+				router.maxPending = 0
+				delete(router.pending, owner)
+			}()
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("router.peer.backpressure."+
+					strings.Map(cleanMetricPart, owner)),
+				mckStat.EXPECT().Increment("router.broadcast.busy"),
+			)
+
+			// The locator is not queried; the update stays stored until the
+			// node's queue drains.
+			delivered, err := router.Route(cancelSignal, uaid, chid, version,
+				sentAt, "", "")
+			So(err, ShouldBeNil)
+			So(delivered, ShouldBeFalse)
+			So(router.pending[owner], ShouldEqual, 1)
+		})
+
+		Convey("Should probe all contacts if the route is unknown", func() {
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("router.direct.unknown"),
+				mckLocator.EXPECT().Contacts(uaid).Return([]string{}, nil),
+			)
+
+			delivered, err := router.Route(cancelSignal, uaid, chid, version,
+				sentAt, "", "")
+			So(err, ShouldBeNil)
+			So(delivered, ShouldBeFalse)
+		})
+	})
+
 	router.Close()
 	<-errChan
 }
 
+// routeStore keeps device routes in memory.
+type routeStore struct {
+	NoStore
+	routes map[string]string
+}
+
+func (s *routeStore) FetchRoute(uaid string) (string, error) {
+	return s.routes[uaid], nil
+}
+
+func (s *routeStore) PutRoute(uaid, node string) error {
+	s.routes[uaid] = node
+	return nil
+}
+
+func (s *routeStore) DropRoute(uaid, node string) error {
+	if s.routes[uaid] == node {
+		delete(s.routes, uaid)
+	}
+	return nil
+}
+
+func TestRouteFrames(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+	router := NewBroadcastRouter()
+	router.maxDataLen = 4096
+	router.url = "http://push1.example.com:3000"
+
+	uaid := "2130ac71-6f04-47cf-b7dc-2570ba1d2afe"
+	chid := "90662645-a7b5-4dfe-8105-a290553507e4"
+	sentAt := time.Unix(1257894000, 0)
+
+	Convey("Routing frames", t, func() {
+		Convey("Should decode Cap'n Proto frames", func() {
+			router.format = RouteFormatCapnp
+			body, err := router.encodeFrame(uaid, chid, 10, sentAt, "hello")
+			So(err, ShouldBeNil)
+			frame, err := router.decodeFrame(contentTypeCapnp, bytes.NewReader(body))
+			So(err, ShouldBeNil)
+			So(frame.GetChannelId(), ShouldEqual, chid)
+			So(frame.GetVersion(), ShouldEqual, 10)
+			So(frame.GetTime(), ShouldEqual, sentAt.UnixNano())
+			So(frame.GetData(), ShouldEqual, "hello")
+		})
+
+		Convey("Should decode protobuf frames", func() {
+			router.format = RouteFormatProtobuf
+			body, err := router.encodeFrame(uaid, chid, 10, sentAt, "hello")
+			So(err, ShouldBeNil)
+			frame, err := router.decodeFrame(contentTypeProtobuf, bytes.NewReader(body))
+			So(err, ShouldBeNil)
+			So(frame.GetUaid(), ShouldEqual, uaid)
+			So(frame.GetChannelId(), ShouldEqual, chid)
+			So(frame.GetVersion(), ShouldEqual, 10)
+			So(frame.GetData(), ShouldEqual, "hello")
+		})
+
+		Convey("Should return receipts to nodes that accept protobuf", func() {
+			req := &http.Request{Header: http.Header{}}
+			req.Header.Set("Accept", contentTypeProtobuf)
+			resp := httptest.NewRecorder()
+			router.writeReceipt(resp, req, http.StatusGone, "Channel unregistered",
+				&RouteReceipt{
+					Status:    RouteReceipt_GONE.Enum(),
+					Uaid:      proto.String(uaid),
+					ChannelId: proto.String(chid),
+				})
+			So(resp.Code, ShouldEqual, http.StatusGone)
+
+			receipt := readReceipt(&http.Response{
+				Header: resp.HeaderMap,
+				Body:   ioutil.NopCloser(resp.Body),
+			})
+			So(receipt, ShouldNotBeNil)
+			So(receipt.GetStatus(), ShouldEqual, RouteReceipt_GONE)
+			So(receipt.GetChannelId(), ShouldEqual, chid)
+			So(receipt.GetNode(), ShouldEqual, router.url)
+			So(receipt.GetTime(), ShouldEqual, timeNow().UnixNano())
+		})
+
+		Convey("Should return plain responses to older nodes", func() {
+			req := &http.Request{Header: http.Header{}}
+			resp := httptest.NewRecorder()
+			router.writeReceipt(resp, req, http.StatusOK, "Ok",
+				&RouteReceipt{Status: RouteReceipt_DELIVERED.Enum()})
+			So(resp.Body.String(), ShouldEqual, "Ok")
+			So(readReceipt(&http.Response{
+				Header: resp.HeaderMap,
+				Body:   ioutil.NopCloser(resp.Body),
+			}), ShouldBeNil)
+		})
+	})
+}
+
+func TestRouteSignatures(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+	router := NewBroadcastRouter()
+	router.maxDataLen = 4096
+	router.setSigningKey([]byte("s3cr3t"), 30*time.Second)
+
+	uaid := "2130ac71-6f04-47cf-b7dc-2570ba1d2afe"
+	body := []byte("routable")
+	now := timeNow().Unix()
+
+	newRequest := func(sentAt int64, signature string) *http.Request {
+		req := &http.Request{
+			Method: "PUT",
+			Header: http.Header{},
+			Body:   ioutil.NopCloser(bytes.NewReader(body)),
+		}
+		req.Header.Set(HeaderRouteTime, strconv.FormatInt(sentAt, 10))
+		req.Header.Set(HeaderRouteSignature, signature)
+		return req
+	}
+
+	Convey("Routing signatures", t, func() {
+		Convey("Should accept signed requests", func() {
+			req := newRequest(now, signRoute([]byte("s3cr3t"), uaid, now, body))
+			actual, err := router.verifyRoute(req, uaid)
+			So(err, ShouldBeNil)
+			So(actual, ShouldResemble, body)
+		})
+
+		Convey("Should reject unsigned requests", func() {
+			_, err := router.verifyRoute(newRequest(now, ""), uaid)
+			So(err, ShouldEqual, ErrUnsignedRoute)
+		})
+
+		Convey("Should reject requests signed with another key", func() {
+			req := newRequest(now, signRoute([]byte("wrong"), uaid, now, body))
+			_, err := router.verifyRoute(req, uaid)
+			So(err, ShouldEqual, ErrUnsignedRoute)
+		})
+
+		Convey("Should reject signatures for other devices", func() {
+			req := newRequest(now, signRoute([]byte("s3cr3t"), uaid, now, body))
+			_, err := router.verifyRoute(req, "4a2d7b4e-0b5f-4f0e-9c5e-6c2a0e1d3f7b")
+			So(err, ShouldEqual, ErrUnsignedRoute)
+		})
+
+		Convey("Should reject stale requests", func() {
+			sentAt := now - 60
+			req := newRequest(sentAt, signRoute([]byte("s3cr3t"), uaid, sentAt, body))
+			_, err := router.verifyRoute(req, uaid)
+			So(err, ShouldEqual, ErrStaleRoute)
+		})
+	})
+}
+
 func BenchmarkRouter(b *testing.B) {
 	mockCtrl := gomock.NewController(b)
 	defer mockCtrl.Finish()
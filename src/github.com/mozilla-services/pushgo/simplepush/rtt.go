@@ -0,0 +1,249 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sync"
+	"time"
+)
+
+type RTTConfig struct {
+	Enabled bool
+
+	// MinDeadline and MaxDeadline bound the per-connection write deadline.
+	MinDeadline string `toml:"min_write_deadline" env:"min_write_deadline"`
+	MaxDeadline string `toml:"max_write_deadline" env:"max_write_deadline"`
+
+	// Factor is the multiple of the retransmission timeout (smoothed RTT plus
+	// four times the RTT variance) used as the write deadline.
+	Factor float64
+
+	// CoalesceFactor is the multiple of the smoothed RTT that updates are
+	// held before they are sent, so that updates routed in quick succession
+	// share a notification. Coalescing is disabled if zero.
+	CoalesceFactor float64 `toml:"coalesce_factor" env:"coalesce_factor"`
+
+	// MaxCoalesce bounds the coalescing window.
+	MaxCoalesce string `toml:"max_coalesce_window" env:"max_coalesce_window"`
+}
+
+// RTTPolicy holds the write deadline and coalescing window bounds shared by
+// all connections.
+type RTTPolicy struct {
+	metrics        Statistician
+	minDeadline    time.Duration
+	maxDeadline    time.Duration
+	factor         float64
+	coalesceFactor float64
+	maxCoalesce    time.Duration
+}
+
+// NewRTTPolicy creates an RTT policy from conf.
+func NewRTTPolicy(app *Application, conf RTTConfig) (p *RTTPolicy, err error) {
+	p = &RTTPolicy{
+		metrics:        app.Metrics(),
+		factor:         conf.Factor,
+		coalesceFactor: conf.CoalesceFactor,
+	}
+	if p.minDeadline, err = time.ParseDuration(conf.MinDeadline); err != nil {
+		return nil, err
+	}
+	if p.maxDeadline, err = time.ParseDuration(conf.MaxDeadline); err != nil {
+		return nil, err
+	}
+	if p.maxDeadline < p.minDeadline {
+		p.maxDeadline = p.minDeadline
+	}
+	if p.coalesceFactor > 0 {
+		if p.maxCoalesce, err = time.ParseDuration(conf.MaxCoalesce); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Estimator returns a new RTT estimator for a connection. Returns nil if p is
+// nil.
+func (p *RTTPolicy) Estimator() *RTTEstimator {
+	if p == nil {
+		return nil
+	}
+	return &RTTEstimator{policy: p}
+}
+
+// RTTEstimator estimates the round-trip time for a connection from the time
+// between a server packet that expects a response (an update or an idle
+// probe) and the next client packet. Estimates are smoothed as in RFC 6298.
+// A nil RTTEstimator measures nothing.
+type RTTEstimator struct {
+	policy  *RTTPolicy
+	rttMux  sync.Mutex
+	sentAt  time.Time // Zero if no response is pending.
+	srtt    time.Duration
+	rttvar  time.Duration
+	samples int
+}
+
+// Sent records a server packet that expects a response. Only the oldest
+// unanswered packet is timed.
+func (e *RTTEstimator) Sent() {
+	if e == nil {
+		return
+	}
+	e.rttMux.Lock()
+	if e.sentAt.IsZero() {
+		e.sentAt = timeNow()
+	}
+	e.rttMux.Unlock()
+}
+
+// Received records a client packet, completing a pending sample.
+func (e *RTTEstimator) Received() {
+	if e == nil {
+		return
+	}
+	e.rttMux.Lock()
+	if e.sentAt.IsZero() {
+		e.rttMux.Unlock()
+		return
+	}
+	sample := timeNow().Sub(e.sentAt)
+	e.sentAt = time.Time{}
+	e.observe(sample)
+	e.rttMux.Unlock()
+	e.policy.metrics.Timer("client.rtt", sample)
+}
+
+// observe updates the smoothed RTT and variance. The caller must hold the
+// RTT lock.
+func (e *RTTEstimator) observe(sample time.Duration) {
+	if e.samples == 0 {
+		e.srtt = sample
+		e.rttvar = sample / 2
+	} else {
+		delta := e.srtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		e.rttvar = (3*e.rttvar + delta) / 4
+		e.srtt = (7*e.srtt + sample) / 8
+	}
+	e.samples++
+}
+
+// SRTT returns the smoothed round-trip time, or 0 if no samples have been
+// taken.
+func (e *RTTEstimator) SRTT() time.Duration {
+	if e == nil {
+		return 0
+	}
+	e.rttMux.Lock()
+	defer e.rttMux.Unlock()
+	return e.srtt
+}
+
+// WriteDeadline returns the write timeout for the connection: the policy's
+// factor times the retransmission timeout, clamped to the policy bounds. The
+// maximum is used until the first sample is taken.
+func (e *RTTEstimator) WriteDeadline() time.Duration {
+	e.rttMux.Lock()
+	defer e.rttMux.Unlock()
+	p := e.policy
+	if e.samples == 0 {
+		return p.maxDeadline
+	}
+	d := time.Duration(p.factor * float64(e.srtt+4*e.rttvar))
+	if d < p.minDeadline {
+		return p.minDeadline
+	}
+	if d > p.maxDeadline {
+		return p.maxDeadline
+	}
+	return d
+}
+
+// CoalesceWindow returns how long updates are held before they are sent to
+// the connection: the policy's coalescing factor times the smoothed RTT, up
+// to the maximum window. Updates are sent immediately until the first sample
+// is taken, or if e is nil.
+func (e *RTTEstimator) CoalesceWindow() time.Duration {
+	if e == nil {
+		return 0
+	}
+	e.rttMux.Lock()
+	defer e.rttMux.Unlock()
+	p := e.policy
+	if e.samples == 0 {
+		return 0
+	}
+	d := time.Duration(p.coalesceFactor * float64(e.srtt))
+	if d > p.maxCoalesce {
+		return p.maxCoalesce
+	}
+	return d
+}
+
+// Coalescer returns a new coalescing queue for the connection, which sends
+// held updates with send. Returns nil if e is nil, or coalescing is disabled.
+func (e *RTTEstimator) Coalescer(send func([]Update)) *Coalescer {
+	if e == nil || e.policy.coalesceFactor <= 0 {
+		return nil
+	}
+	return &Coalescer{rtt: e, send: send}
+}
+
+// Coalescer holds updates for a connection's coalescing window, so that
+// updates routed in quick succession are sent in one notification. The
+// window starts with the first held update, and adapts to the connection's
+// RTT. Held updates are already stored, so they are flushed again if the
+// client reconnects. A nil Coalescer never holds updates.
+type Coalescer struct {
+	rtt      *RTTEstimator
+	send     func([]Update)
+	batchMux sync.Mutex
+	batch    []Update
+	timer    Timer // Nil if no updates are held.
+}
+
+// Hold holds an update until the end of the coalescing window. Returns false
+// if the update should be sent now.
+func (c *Coalescer) Hold(update Update) bool {
+	if c == nil {
+		return false
+	}
+	window := c.rtt.CoalesceWindow()
+	c.batchMux.Lock()
+	defer c.batchMux.Unlock()
+	if c.timer == nil {
+		if window <= 0 {
+			return false
+		}
+		c.timer = clock.AfterFunc(window, c.flush)
+	} else {
+		c.rtt.policy.metrics.Increment("updates.coalesced")
+	}
+	for i, held := range c.batch {
+		if held.ChannelID == update.ChannelID {
+			// Only the latest version of a channel is sent.
+			if update.Version > held.Version {
+				c.batch[i] = update
+			}
+			return true
+		}
+	}
+	c.batch = append(c.batch, update)
+	return true
+}
+
+// flush sends the held updates at the end of the coalescing window.
+func (c *Coalescer) flush() {
+	c.batchMux.Lock()
+	updates := c.batch
+	c.batch, c.timer = nil, nil
+	c.batchMux.Unlock()
+	if len(updates) > 0 {
+		c.send(updates)
+	}
+}
@@ -0,0 +1,165 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRTTEstimator(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+
+	defer saveTimeFuncs()()
+	var now time.Time
+	timeNow = func() time.Time { return now }
+
+	Convey("RTT estimation", t, func() {
+		now = time.Unix(1257894000, 0).UTC()
+		app := NewApplication()
+		app.SetMetrics(mckStat)
+
+		p, err := NewRTTPolicy(app, RTTConfig{
+			Enabled:        true,
+			MinDeadline:    "1s",
+			MaxDeadline:    "10s",
+			Factor:         2,
+			CoalesceFactor: 0.5,
+			MaxCoalesce:    "100ms",
+		})
+		So(err, ShouldBeNil)
+		e := p.Estimator()
+
+		sample := func(rtt time.Duration) {
+			e.Sent()
+			now = now.Add(rtt)
+			e.Received()
+		}
+
+		Convey("Should use the maximum deadline until sampled", func() {
+			So(e.SRTT(), ShouldEqual, 0)
+			So(e.WriteDeadline(), ShouldEqual, 10*time.Second)
+		})
+
+		Convey("Should time the oldest unanswered packet", func() {
+			mckStat.EXPECT().Timer("client.rtt", 300*time.Millisecond)
+			e.Sent()
+			now = now.Add(100 * time.Millisecond)
+			e.Sent()
+			now = now.Add(200 * time.Millisecond)
+			e.Received()
+			e.Received()
+			So(e.SRTT(), ShouldEqual, 300*time.Millisecond)
+		})
+
+		Convey("Should smooth samples and clamp the deadline", func() {
+			mckStat.EXPECT().Timer("client.rtt", gomock.Any()).Times(3)
+			sample(800 * time.Millisecond)
+			// 2 * (800ms + 4 * 400ms)
+			So(e.WriteDeadline(), ShouldEqual, 4800*time.Millisecond)
+
+			sample(800 * time.Millisecond)
+			sample(800 * time.Millisecond)
+			So(e.SRTT(), ShouldEqual, 800*time.Millisecond)
+			// rttvar decays to 400ms * 9/16 = 225ms.
+			So(e.WriteDeadline(), ShouldEqual, 3400*time.Millisecond)
+		})
+
+		Convey("Should enforce the minimum deadline", func() {
+			mckStat.EXPECT().Timer("client.rtt", 10*time.Millisecond)
+			sample(10 * time.Millisecond)
+			So(e.WriteDeadline(), ShouldEqual, 1*time.Second)
+		})
+
+		Convey("Should adapt the coalescing window", func() {
+			So(e.CoalesceWindow(), ShouldEqual, 0)
+			mckStat.EXPECT().Timer("client.rtt", gomock.Any()).Times(2)
+			sample(80 * time.Millisecond)
+			So(e.CoalesceWindow(), ShouldEqual, 40*time.Millisecond)
+			// The smoothed RTT is 1s; the window is clamped to the maximum.
+			sample(7440 * time.Millisecond)
+			So(e.CoalesceWindow(), ShouldEqual, 100*time.Millisecond)
+		})
+
+		Convey("Should ignore disabled estimation", func() {
+			var p *RTTPolicy
+			e := p.Estimator()
+			So(e, ShouldBeNil)
+			e.Sent()
+			e.Received()
+			So(e.SRTT(), ShouldEqual, 0)
+			So(e.CoalesceWindow(), ShouldEqual, 0)
+			So(e.Coalescer(nil), ShouldBeNil)
+		})
+	})
+}
+
+func TestCoalescer(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStat.EXPECT().Timer("client.rtt", gomock.Any()).AnyTimes()
+
+	defer saveTimeFuncs()()
+
+	Convey("Update coalescing", t, func() {
+		mockClock := newMockClock(time.Unix(1257894000, 0).UTC())
+		useMockClock(mockClock)
+
+		app := NewApplication()
+		app.SetMetrics(mckStat)
+		p, err := NewRTTPolicy(app, RTTConfig{
+			Enabled:        true,
+			MinDeadline:    "1s",
+			MaxDeadline:    "10s",
+			Factor:         2,
+			CoalesceFactor: 0.5,
+			MaxCoalesce:    "100ms",
+		})
+		So(err, ShouldBeNil)
+		e := p.Estimator()
+		var sent [][]Update
+		c := e.Coalescer(func(updates []Update) {
+			sent = append(sent, updates)
+		})
+
+		Convey("Should send updates immediately until sampled", func() {
+			So(c.Hold(Update{ChannelID: "a", Version: 1}), ShouldBeFalse)
+		})
+
+		Convey("Should send updates held within the window together", func() {
+			e.Sent()
+			mockClock.Advance(80 * time.Millisecond)
+			e.Received()
+
+			mckStat.EXPECT().Increment("updates.coalesced").Times(2)
+			So(c.Hold(Update{ChannelID: "a", Version: 1}), ShouldBeTrue)
+			mockClock.Advance(20 * time.Millisecond)
+			So(c.Hold(Update{ChannelID: "b", Version: 1}), ShouldBeTrue)
+			So(c.Hold(Update{ChannelID: "a", Version: 2}), ShouldBeTrue)
+			So(sent, ShouldBeEmpty)
+
+			mockClock.Advance(20 * time.Millisecond)
+			So(sent, ShouldResemble, [][]Update{{
+				{ChannelID: "a", Version: 2},
+				{ChannelID: "b", Version: 1},
+			}})
+		})
+
+		Convey("Should ignore disabled coalescing", func() {
+			p.coalesceFactor = 0
+			So(e.Coalescer(nil), ShouldBeNil)
+			var c *Coalescer
+			So(c.Hold(Update{ChannelID: "a", Version: 1}), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,163 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sync"
+)
+
+// SandboxSend is a proprietary ping recorded by a sandboxed pinger instead
+// of being sent to the provider.
+type SandboxSend struct {
+	Pinger   string `json:"pinger"`
+	UAID     string `json:"uaid"`
+	Version  int64  `json:"version"`
+	Data     string `json:"data,omitempty"`
+	Request  string `json:"request,omitempty"` // The would-be provider request.
+	Recorded int64  `json:"recorded"`          // Seconds since Epoch.
+}
+
+// PingSandbox records would-be pings in a fixed-size buffer, so that staging
+// environments and integration tests can inspect them without contacting
+// providers. Once the buffer is full, the oldest sends are discarded.
+type PingSandbox struct {
+	sendsMux sync.Mutex
+	sends    []SandboxSend
+	size     int
+}
+
+// NewPingSandbox returns a sandbox that keeps the last size sends.
+func NewPingSandbox(size int) *PingSandbox {
+	if size < 1 {
+		size = 1
+	}
+	return &PingSandbox{size: size}
+}
+
+// Record adds a send to the buffer.
+func (s *PingSandbox) Record(send SandboxSend) {
+	send.Recorded = timeNow().Unix()
+	s.sendsMux.Lock()
+	if len(s.sends) >= s.size {
+		s.sends = append(s.sends[:0], s.sends[len(s.sends)-s.size+1:]...)
+	}
+	s.sends = append(s.sends, send)
+	s.sendsMux.Unlock()
+}
+
+// Sends returns the recorded sends, oldest first.
+func (s *PingSandbox) Sends() []SandboxSend {
+	s.sendsMux.Lock()
+	defer s.sendsMux.Unlock()
+	sends := make([]SandboxSend, len(s.sends))
+	copy(sends, s.sends)
+	return sends
+}
+
+// Reset discards all recorded sends.
+func (s *PingSandbox) Reset() {
+	s.sendsMux.Lock()
+	s.sends = nil
+	s.sendsMux.Unlock()
+}
+
+// SandboxPinger is an optional interface implemented by proprietary pingers
+// that can run in sandbox mode. Sandbox returns nil if sandbox mode is
+// disabled.
+type SandboxPinger interface {
+	Sandbox() *PingSandbox
+}
+
+type SandboxPingConfig struct {
+	// CanBypass mimics a provider that can deliver updates without the
+	// WebSocket connection, like GCM.
+	CanBypass bool `toml:"can_bypass_websocket" env:"can_bypass_websocket"`
+
+	// MaxPayload mimics a provider that limits payload sizes. Payloads are
+	// unlimited if set to 0.
+	MaxPayload int `toml:"max_payload" env:"max_payload"`
+
+	// Size is the number of sends kept in the sandbox buffer.
+	Size int
+}
+
+// SandboxPing is a mock pinger that accepts any registration data and
+// records sends in a sandbox buffer. Useful for integration tests.
+type SandboxPing struct {
+	logger     *SimpleLogger
+	store      Store
+	canBypass  bool
+	maxPayload int
+	sandbox    *PingSandbox
+}
+
+func (r *SandboxPing) ConfigStruct() interface{} {
+	return &SandboxPingConfig{
+		CanBypass: false,
+		Size:      100,
+	}
+}
+
+func (r *SandboxPing) Init(app *Application, config interface{}) error {
+	conf := config.(*SandboxPingConfig)
+	r.logger = app.Logger()
+	r.store = app.Store()
+	r.canBypass = conf.CanBypass
+	r.maxPayload = conf.MaxPayload
+	r.sandbox = NewPingSandbox(conf.Size)
+	return nil
+}
+
+func (r *SandboxPing) Name() string {
+	return "sandbox"
+}
+
+func (r *SandboxPing) Sandbox() *PingSandbox {
+	return r.sandbox
+}
+
+func (r *SandboxPing) Register(uaid string, pingData []byte) error {
+	return r.store.PutPing(uaid, pingData)
+}
+
+func (r *SandboxPing) CanBypassWebsocket() bool {
+	return r.canBypass
+}
+
+// MaxPayload implements PayloadLimiter.MaxPayload().
+func (r *SandboxPing) MaxPayload() int {
+	return r.maxPayload
+}
+
+// Send records the ping if the device has registration data.
+func (r *SandboxPing) Send(uaid string, vers int64, data string) (bool, error) {
+	pingData, err := r.store.FetchPing(uaid)
+	if err != nil {
+		return false, err
+	}
+	if len(pingData) == 0 {
+		return false, nil
+	}
+	if r.logger.ShouldLog(INFO) {
+		r.logger.Info("propping", "Recording sandboxed ping",
+			LogFields{"uaid": uaid, "connect": string(pingData)})
+	}
+	r.sandbox.Record(SandboxSend{
+		Pinger:  r.Name(),
+		UAID:    uaid,
+		Version: vers,
+		Data:    data,
+		Request: string(pingData),
+	})
+	return true, nil
+}
+
+func (r *SandboxPing) Status() (bool, error) {
+	return true, nil
+}
+
+func (r *SandboxPing) Close() error {
+	return nil
+}
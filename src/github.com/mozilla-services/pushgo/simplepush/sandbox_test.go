@@ -0,0 +1,92 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPingSandbox(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := &TestMetrics{}
+	mckStat.Init(nil, nil)
+	mckStore := NewMockStore(mockCtrl)
+
+	Convey("Pinger sandbox", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(mckStore)
+		uaid := "deadbeef00000000000000000000"
+		fakeConnect := []byte(`{"regid":"testing"}`)
+
+		Convey("Should keep the most recent sends", func() {
+			sandbox := NewPingSandbox(2)
+			for vers := int64(1); vers <= 3; vers++ {
+				sandbox.Record(SandboxSend{UAID: uaid, Version: vers})
+			}
+			sends := sandbox.Sends()
+			So(sends, ShouldHaveLength, 2)
+			So(sends[0].Version, ShouldEqual, 2)
+			So(sends[1].Version, ShouldEqual, 3)
+			So(sends[1].Recorded, ShouldEqual, 1257894000)
+
+			sandbox.Reset()
+			So(sandbox.Sends(), ShouldBeEmpty)
+		})
+
+		Convey("Should record sends for registered devices", func() {
+			pinger := new(SandboxPing)
+			So(pinger.Init(app, pinger.ConfigStruct()), ShouldBeNil)
+
+			mckStore.EXPECT().FetchPing(uaid).Return(nil, nil)
+			ok, err := pinger.Send(uaid, 1, "")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+
+			mckStore.EXPECT().FetchPing(uaid).Return(fakeConnect, nil)
+			ok, err = pinger.Send(uaid, 2, "data")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(pinger.Sandbox().Sends(), ShouldResemble, []SandboxSend{{
+				Pinger:   "sandbox",
+				UAID:     uaid,
+				Version:  2,
+				Data:     "data",
+				Request:  string(fakeConnect),
+				Recorded: 1257894000,
+			}})
+		})
+
+		Convey("Should record GCM requests instead of sending", func() {
+			testGcm := NewGCMPing()
+			conf := testGcm.ConfigStruct().(*GCMPingConfig)
+			conf.Sandbox = true
+			So(testGcm.Init(app, conf), ShouldBeNil)
+			testGcm.ReplaceClient(nil)
+
+			mckStore.EXPECT().FetchPing(uaid).Return(fakeConnect, nil)
+			ok, err := testGcm.Send(uaid, 1, "data")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(mckStat.Counters["ping.gcm.sandbox"], ShouldEqual, 1)
+			sends := testGcm.Sandbox().Sends()
+			So(sends, ShouldHaveLength, 1)
+			So(sends[0].Request, ShouldContainSubstring, `"registration_ids":["testing"]`)
+		})
+	})
+}
@@ -0,0 +1,156 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sync"
+)
+
+type SequenceConfig struct {
+	Enabled bool
+
+	// MaxUnacked is the maximum number of unacknowledged frames tracked for
+	// each connection. Once exceeded, the oldest frames are counted as lost.
+	MaxUnacked int `toml:"max_unacked" env:"max_unacked"`
+}
+
+// SequencePolicy holds the sequence tracking limits shared by all
+// connections.
+type SequencePolicy struct {
+	metrics    Statistician
+	maxUnacked int
+}
+
+// NewSequencePolicy creates a sequence policy from conf.
+func NewSequencePolicy(app *Application, conf SequenceConfig) *SequencePolicy {
+	p := &SequencePolicy{metrics: app.Metrics(), maxUnacked: conf.MaxUnacked}
+	if p.maxUnacked < 1 {
+		p.maxUnacked = 1
+	}
+	return p
+}
+
+// Tracker returns a new sequence tracker for a connection. Returns nil if p
+// is nil.
+func (p *SequencePolicy) Tracker() *SequenceTracker {
+	if p == nil {
+		return nil
+	}
+	return &SequenceTracker{policy: p}
+}
+
+// SequenceTracker numbers the notification frames sent to a client that
+// opted in during the handshake. Clients echo the number in their ACKs; an
+// acknowledged frame implies that all earlier unacknowledged frames were
+// lost, since clients acknowledge frames in order. Clients can detect lost
+// or duplicated frames from gaps and repeats in the sequence. A nil
+// SequenceTracker numbers nothing.
+type SequenceTracker struct {
+	policy  *SequencePolicy
+	seqMux  sync.Mutex
+	last    uint64      // The last sequence number sent.
+	unacked []sentFrame // Sent, unacknowledged frames, ascending.
+}
+
+// sentFrame is a numbered frame awaiting acknowledgement. Only the channel
+// IDs and versions are kept.
+type sentFrame struct {
+	seq     uint64
+	updates []Update
+	expired []string
+}
+
+// matches indicates whether an ACK acknowledges the frame: at least one
+// acknowledged update must match an update in the frame by channel ID and
+// version, or one acknowledged expired channel must match.
+func (f *sentFrame) matches(updates []Update, expired []string) bool {
+	for _, acked := range updates {
+		for _, update := range f.updates {
+			if acked.ChannelID == update.ChannelID &&
+				acked.Version == update.Version {
+				return true
+			}
+		}
+	}
+	for _, acked := range expired {
+		for _, chid := range f.expired {
+			if acked == chid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Next returns the sequence number for the next frame, which carries updates
+// and expired channel IDs. Returns 0, which is omitted from frames, if t is
+// nil.
+func (t *SequenceTracker) Next(updates []Update, expired []string) uint64 {
+	if t == nil {
+		return 0
+	}
+	frame := sentFrame{updates: make([]Update, len(updates)), expired: expired}
+	for i, update := range updates {
+		frame.updates[i] = Update{ChannelID: update.ChannelID,
+			Version: update.Version}
+	}
+	t.seqMux.Lock()
+	t.last++
+	seq := t.last
+	frame.seq = seq
+	var lost int
+	if len(t.unacked) >= t.policy.maxUnacked {
+		lost = len(t.unacked) - t.policy.maxUnacked + 1
+		t.unacked = t.unacked[lost:]
+	}
+	t.unacked = append(t.unacked, frame)
+	t.seqMux.Unlock()
+	if lost > 0 {
+		t.policy.metrics.IncrementBy("client.sequence.lost", int64(lost))
+	}
+	return seq
+}
+
+// Ack records a client acknowledgement for seq, with the acknowledged
+// updates and expired channel IDs. The frame is only acknowledged if the ACK
+// matches its contents; otherwise, a client echoing a stale or wrong number
+// would mark frames it never received as delivered. Acknowledgements without
+// a sequence number are ignored.
+func (t *SequenceTracker) Ack(seq uint64, updates []Update, expired []string) {
+	if t == nil || seq == 0 {
+		return
+	}
+	t.seqMux.Lock()
+	i := 0
+	for ; i < len(t.unacked) && t.unacked[i].seq < seq; i++ {
+	}
+	found := i < len(t.unacked) && t.unacked[i].seq == seq
+	matched := found && t.unacked[i].matches(updates, expired)
+	if matched {
+		t.unacked = t.unacked[i+1:]
+	}
+	last := t.last
+	t.seqMux.Unlock()
+	switch {
+	case matched:
+		if i > 0 {
+			t.policy.metrics.IncrementBy("client.sequence.lost", int64(i))
+		}
+	case !found && seq <= last:
+		t.policy.metrics.Increment("client.sequence.duplicate")
+	default:
+		t.policy.metrics.Increment("client.sequence.invalid")
+	}
+}
+
+// Unacked returns the number of unacknowledged frames.
+func (t *SequenceTracker) Unacked() int {
+	if t == nil {
+		return 0
+	}
+	t.seqMux.Lock()
+	defer t.seqMux.Unlock()
+	return len(t.unacked)
+}
@@ -0,0 +1,84 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSequenceTracker(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Frame sequence numbers", t, func() {
+		app := NewApplication()
+		app.SetMetrics(mckStat)
+		p := NewSequencePolicy(app, SequenceConfig{Enabled: true, MaxUnacked: 3})
+		tr := p.Tracker()
+		updates := []Update{{ChannelID: "chid1", Version: 1, Data: "hi"}}
+		acked := []Update{{ChannelID: "chid1", Version: 1}}
+
+		Convey("Should number frames from 1", func() {
+			So(tr.Next(updates, nil), ShouldEqual, 1)
+			So(tr.Next(nil, []string{"chid2"}), ShouldEqual, 2)
+			So(tr.Unacked(), ShouldEqual, 2)
+			tr.Ack(1, acked, nil)
+			So(tr.Unacked(), ShouldEqual, 1)
+			tr.Ack(2, nil, []string{"chid2"})
+			So(tr.Unacked(), ShouldEqual, 0)
+		})
+
+		Convey("Should count skipped frames as lost", func() {
+			mckStat.EXPECT().IncrementBy("client.sequence.lost", int64(2))
+			tr.Next(nil, nil)
+			tr.Next(nil, nil)
+			tr.Next(updates, nil)
+			tr.Ack(3, acked, nil)
+			So(tr.Unacked(), ShouldEqual, 0)
+		})
+
+		Convey("Should count duplicate and invalid acknowledgements", func() {
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("client.sequence.duplicate"),
+				mckStat.EXPECT().Increment("client.sequence.invalid"),
+			)
+			tr.Next(updates, nil)
+			tr.Ack(1, acked, nil)
+			tr.Ack(1, acked, nil)
+			tr.Ack(5, acked, nil)
+			// Unnumbered acknowledgements are ignored.
+			tr.Ack(0, acked, nil)
+		})
+
+		Convey("Should not acknowledge frames with different contents", func() {
+			mckStat.EXPECT().Increment("client.sequence.invalid").Times(2)
+			tr.Next(updates, nil)
+			tr.Ack(1, []Update{{ChannelID: "chid1", Version: 2}}, nil)
+			tr.Ack(1, []Update{{ChannelID: "chid2", Version: 1}}, nil)
+			So(tr.Unacked(), ShouldEqual, 1)
+		})
+
+		Convey("Should bound unacknowledged frames", func() {
+			mckStat.EXPECT().IncrementBy("client.sequence.lost", int64(1))
+			for i := 0; i < 4; i++ {
+				tr.Next(updates, nil)
+			}
+			So(tr.Unacked(), ShouldEqual, 3)
+		})
+
+		Convey("Should number nothing if disabled", func() {
+			var p *SequencePolicy
+			tr := p.Tracker()
+			So(tr, ShouldBeNil)
+			So(tr.Next(updates, nil), ShouldEqual, 0)
+			So(func() { tr.Ack(1, acked, nil) }, ShouldNotPanic)
+		})
+	})
+}
@@ -193,6 +193,15 @@ func (t *TestServer) load() (*Application, error) {
 			}
 			return ph, nil
 		},
+		PluginAdmin: func(app *Application) (HasConfigStruct, error) {
+			ah := NewAdminHandlers()
+			ahConf := ah.ConfigStruct().(*AdminHandlersConfig)
+			ahConf.Enabled = false
+			if err := ah.Init(app, ahConf); err != nil {
+				return nil, fmt.Errorf("Error initializing admin handlers: %s", err)
+			}
+			return ah, nil
+		},
 	}
 	return loaders.Load(int(t.LogLevel))
 }
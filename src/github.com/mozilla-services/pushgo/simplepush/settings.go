@@ -0,0 +1,152 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClientSettings is a "settings" frame pushed to connected clients to adjust
+// keep-alive and reconnect timing at runtime. Intervals are in seconds; zero
+// values are omitted, and clients should keep their current values.
+type ClientSettings struct {
+	Type         string `json:"messageType"`
+	PingInterval int64  `json:"pingInterval,omitempty"`
+	Backoff      int64  `json:"backoff,omitempty"`
+}
+
+// IsZero indicates whether the settings frame is empty.
+func (s *ClientSettings) IsZero() bool {
+	return s.PingInterval == 0 && s.Backoff == 0
+}
+
+// SettingsSender is an optional interface implemented by workers that accept
+// pushed client settings.
+type SettingsSender interface {
+	SendSettings(settings *ClientSettings) error
+}
+
+type AdaptivePingConfig struct {
+	Enabled bool
+
+	// MinInterval and MaxInterval bound the advised ping interval.
+	MinInterval string `toml:"min_interval" env:"min_interval"`
+	MaxInterval string `toml:"max_interval" env:"max_interval"`
+
+	// Samples is the number of idle disconnects observed for a network before
+	// advising a ping interval.
+	Samples int
+}
+
+// PingAdvisor learns per-network ping intervals from client disconnects.
+// Networks that consistently drop idle connections (e.g., carrier NATs with
+// short mapping timeouts) are advised to ping more frequently than the time
+// their connections typically survive.
+type PingAdvisor struct {
+	minInterval time.Duration
+	maxInterval time.Duration
+	samples     int
+	networksMux sync.Mutex
+	networks    map[string]*idleSamples
+}
+
+// NewPingAdvisor creates a ping advisor from conf.
+func NewPingAdvisor(conf AdaptivePingConfig) (a *PingAdvisor, err error) {
+	a = &PingAdvisor{
+		samples:  conf.Samples,
+		networks: make(map[string]*idleSamples),
+	}
+	if a.minInterval, err = time.ParseDuration(conf.MinInterval); err != nil {
+		return nil, err
+	}
+	if a.maxInterval, err = time.ParseDuration(conf.MaxInterval); err != nil {
+		return nil, err
+	}
+	if a.samples < 1 {
+		a.samples = 1
+	}
+	return a, nil
+}
+
+// Observe records that a client on network disconnected after being idle
+// for the given period.
+func (a *PingAdvisor) Observe(network string, idle time.Duration) {
+	if len(network) == 0 || idle <= 0 {
+		return
+	}
+	a.networksMux.Lock()
+	s, ok := a.networks[network]
+	if !ok {
+		s = &idleSamples{durations: make(durations, 0, a.samples)}
+		a.networks[network] = s
+	}
+	s.add(idle)
+	a.networksMux.Unlock()
+}
+
+// Advise returns the ping interval for clients on network. ok is false if
+// too few disconnects have been observed.
+func (a *PingAdvisor) Advise(network string) (interval time.Duration, ok bool) {
+	a.networksMux.Lock()
+	s, ok := a.networks[network]
+	if !ok || len(s.durations) < a.samples {
+		a.networksMux.Unlock()
+		return 0, false
+	}
+	sorted := make(durations, len(s.durations))
+	copy(sorted, s.durations)
+	a.networksMux.Unlock()
+
+	// Use the lower quartile of observed idle periods, with a safety margin.
+	sort.Sort(sorted)
+	interval = sorted[len(sorted)/4] * 3 / 4
+	if interval < a.minInterval {
+		interval = a.minInterval
+	} else if interval > a.maxInterval {
+		interval = a.maxInterval
+	}
+	return interval, true
+}
+
+// idleSamples is a fixed-size ring of observed idle periods.
+type idleSamples struct {
+	durations durations
+	next      int
+}
+
+func (s *idleSamples) add(d time.Duration) {
+	if len(s.durations) < cap(s.durations) {
+		s.durations = append(s.durations, d)
+		return
+	}
+	s.durations[s.next] = d
+	s.next = (s.next + 1) % len(s.durations)
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// networkOf groups a remote address by network: /24 for IPv4, /48 for IPv6.
+// Returns an empty string if addr is not an IP address.
+func networkOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
@@ -0,0 +1,111 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNetworkOf(t *testing.T) {
+	tests := []struct {
+		addr    string
+		network string
+	}{
+		{"192.0.2.57:4321", "192.0.2.0/24"},
+		{"198.51.100.1", "198.51.100.0/24"},
+		{"[2001:db8:1234:5678::1]:443", "2001:db8:1234::/48"},
+		{"localhost:8080", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if network := networkOf(test.addr); network != test.network {
+			t.Errorf("Wrong network for %q: got %q; want %q",
+				test.addr, network, test.network)
+		}
+	}
+}
+
+func TestPingAdvisor(t *testing.T) {
+	Convey("Adaptive pings", t, func() {
+		advisor, err := NewPingAdvisor(AdaptivePingConfig{
+			MinInterval: "1m",
+			MaxInterval: "30m",
+			Samples:     4,
+		})
+		So(err, ShouldBeNil)
+		network := "192.0.2.0/24"
+
+		Convey("Should not advise unknown networks", func() {
+			_, ok := advisor.Advise(network)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Should require enough samples", func() {
+			advisor.Observe(network, 10*time.Minute)
+			advisor.Observe(network, 10*time.Minute)
+			_, ok := advisor.Advise(network)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Should advise intervals shorter than idle disconnects", func() {
+			for _, idle := range []time.Duration{8, 4, 20, 12, 16} {
+				advisor.Observe(network, idle*time.Minute)
+			}
+			// The oldest sample is evicted; the lower quartile is 12 minutes.
+			interval, ok := advisor.Advise(network)
+			So(ok, ShouldBeTrue)
+			So(interval, ShouldEqual, 9*time.Minute)
+		})
+
+		Convey("Should clamp advised intervals", func() {
+			for i := 0; i < 4; i++ {
+				advisor.Observe(network, 30*time.Second)
+			}
+			interval, ok := advisor.Advise(network)
+			So(ok, ShouldBeTrue)
+			So(interval, ShouldEqual, 1*time.Minute)
+		})
+	})
+}
+
+func TestPushSettings(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckSocket := NewMockSocket(mockCtrl)
+
+	Convey("Should push settings to connected clients", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+
+		uaid := "5e1e5984569c4f00bf4bea47754a6403"
+		wws := NewWorker(app, mckSocket, "test")
+		wws.SetUAID(uaid)
+		app.AddWorker(uaid, wws)
+
+		settings := &ClientSettings{PingInterval: 300, Backoff: 60}
+		gomock.InOrder(
+			mckSocket.EXPECT().WriteJSON(ClientSettings{"settings", 300, 60}),
+			mckStat.EXPECT().Increment("updates.client.settings"),
+		)
+		So(app.PushSettings(settings), ShouldEqual, 1)
+		So(app.ClientSettings(), ShouldEqual, settings)
+
+		Convey("Should clear empty settings", func() {
+			So(app.PushSettings(new(ClientSettings)), ShouldEqual, 0)
+			So(app.ClientSettings(), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,80 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type ShardConfig struct {
+	Enabled bool
+
+	// Pools assigns primary key prefixes to the node pools that serve
+	// them, as "prefix=url" entries. Endpoints with a matching key are
+	// issued with the pool's URL in place of {{.CurrentHost}}; the longest
+	// matching prefix wins. Other endpoints use the current host.
+	Pools []string
+}
+
+// EndpointShards partitions update endpoints onto dedicated node pools by
+// primary key prefix, so that app servers for large tenants send updates to pools
+// separate from the nodes that serve WebSocket clients. Endpoints issued
+// before a pool is added keep their original host. A nil EndpointShards
+// assigns no endpoints to pools.
+type EndpointShards struct {
+	pools []endpointPool // Longest prefix first.
+}
+
+type endpointPool struct {
+	prefix string
+	url    string
+}
+
+// NewEndpointShards parses the pool assignments in conf.
+func NewEndpointShards(conf ShardConfig) (*EndpointShards, error) {
+	s := &EndpointShards{pools: make([]endpointPool, 0, len(conf.Pools))}
+	seen := make(map[string]bool, len(conf.Pools))
+	for _, entry := range conf.Pools {
+		i := strings.Index(entry, "=")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("Invalid pool entry: %q", entry)
+		}
+		prefix, url := entry[:i], strings.TrimRight(entry[i+1:], "/")
+		if seen[prefix] {
+			return nil, fmt.Errorf("Duplicate pool prefix: %q", prefix)
+		}
+		seen[prefix] = true
+		s.pools = append(s.pools, endpointPool{prefix, url})
+	}
+	sort.Sort(poolsByPrefix(s.pools))
+	return s, nil
+}
+
+// URL returns the URL of the pool assigned to the unencrypted primary key,
+// or false if the key isn't assigned to a pool.
+func (s *EndpointShards) URL(key string) (url string, ok bool) {
+	if s == nil {
+		return "", false
+	}
+	for _, pool := range s.pools {
+		if strings.HasPrefix(key, pool.prefix) {
+			return pool.url, true
+		}
+	}
+	return "", false
+}
+
+type poolsByPrefix []endpointPool
+
+func (p poolsByPrefix) Len() int      { return len(p) }
+func (p poolsByPrefix) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p poolsByPrefix) Less(i, j int) bool {
+	if len(p[i].prefix) == len(p[j].prefix) {
+		return p[i].prefix < p[j].prefix
+	}
+	return len(p[i].prefix) > len(p[j].prefix)
+}
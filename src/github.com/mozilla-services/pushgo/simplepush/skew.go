@@ -0,0 +1,55 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"time"
+)
+
+type ClockConfig struct {
+	// Enabled adds a server "timestamp" to notification frames, and measures
+	// client clock skew from pings that carry the client "time".
+	Enabled bool
+}
+
+// SkewMonitor timestamps notification frames and measures client clock
+// skew, to help interpret client-reported delivery latencies. A nil
+// SkewMonitor does nothing.
+type SkewMonitor struct {
+	metrics Statistician
+}
+
+// NewSkewMonitor creates a skew monitor.
+func NewSkewMonitor(app *Application) *SkewMonitor {
+	return &SkewMonitor{metrics: app.Metrics()}
+}
+
+// Stamp returns the current server time, in milliseconds since Epoch. Returns
+// 0, which is omitted from frames, if m is nil.
+func (m *SkewMonitor) Stamp() int64 {
+	if m == nil {
+		return 0
+	}
+	return timeNow().UnixNano() / int64(time.Millisecond)
+}
+
+// Observe records the skew between the client clock and the server clock,
+// given a client timestamp in milliseconds since Epoch. The server time is
+// adjusted by half the round-trip time, if known. Pings without a client
+// timestamp are ignored.
+func (m *SkewMonitor) Observe(clientTime int64, rtt time.Duration) {
+	if m == nil || clientTime <= 0 {
+		return
+	}
+	sentAt := timeNow().Add(-rtt / 2)
+	skew := time.Unix(0, clientTime*int64(time.Millisecond)).Sub(sentAt)
+	if skew < 0 {
+		m.metrics.Increment("client.clock.behind")
+		skew = -skew
+	} else {
+		m.metrics.Increment("client.clock.ahead")
+	}
+	m.metrics.Timer("client.clock.skew", skew)
+}
@@ -0,0 +1,60 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSkewMonitor(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+
+	defer saveTimeFuncs()()
+	timeNow = func() time.Time { return time.Unix(1257894000, 0) }
+
+	Convey("Client clock skew", t, func() {
+		app := NewApplication()
+		app.SetMetrics(mckStat)
+		m := NewSkewMonitor(app)
+
+		Convey("Should stamp frames with the server time", func() {
+			So(m.Stamp(), ShouldEqual, 1257894000000)
+		})
+
+		Convey("Should measure clients ahead of the server", func() {
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("client.clock.ahead"),
+				mckStat.EXPECT().Timer("client.clock.skew", 3*time.Second),
+			)
+			// The ping was sent 1 second before it was received.
+			m.Observe(1257894002000, 2*time.Second)
+		})
+
+		Convey("Should measure clients behind the server", func() {
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("client.clock.behind"),
+				mckStat.EXPECT().Timer("client.clock.skew", 5*time.Second),
+			)
+			m.Observe(1257893995000, 0)
+		})
+
+		Convey("Should ignore pings without a client time", func() {
+			m.Observe(0, 0)
+		})
+
+		Convey("Should do nothing if disabled", func() {
+			var m *SkewMonitor
+			So(m.Stamp(), ShouldEqual, 0)
+			So(func() { m.Observe(1257894000000, 0) }, ShouldNotPanic)
+		})
+	})
+}
@@ -47,6 +47,17 @@ type Socket interface {
 	Close() error
 }
 
+// CloseGoingAway is the WebSocket close status sent when the server is
+// shutting down (RFC 6455, section 7.4.1).
+const CloseGoingAway = 1001
+
+// StatusCloser is an optional interface implemented by sockets that can
+// start the WebSocket closing handshake with a status code. Unlike Close,
+// the underlying connection stays open until the peer responds.
+type StatusCloser interface {
+	SendClose(status int) error
+}
+
 // WebSocket implements the Socket interface for a *websocket.Conn.
 type WebSocket websocket.Conn
 
@@ -96,6 +107,15 @@ func (ws *WebSocket) WriteText(data string) error {
 	return websocket.Message.Send((*websocket.Conn)(ws), data)
 }
 
+// SendClose implements StatusCloser.SendClose. The WebSocket library always
+// closes with status 1000, so the close frame is written directly.
+func (ws *WebSocket) SendClose(status int) error {
+	conn := (*websocket.Conn)(ws)
+	conn.PayloadType = websocket.CloseFrame
+	_, err := conn.Write([]byte{byte(status >> 8), byte(status)})
+	return err
+}
+
 func (ws *WebSocket) Close() error {
 	return (*websocket.Conn)(ws).Close()
 }
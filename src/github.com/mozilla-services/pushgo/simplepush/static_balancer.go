@@ -14,11 +14,11 @@ type StaticBalancerConf struct {
 }
 
 type StaticBalancer struct {
-	sync.Mutex
+	sync.Mutex   // Protects threshold and currentIndex.
 	redirects    []string
 	threshold    float64
 	workerCount  func() int
-	maxWorkers   int
+	maxWorkers   func() int
 	currentIndex int
 }
 
@@ -32,7 +32,7 @@ func (b *StaticBalancer) Init(app *Application, config interface{}) error {
 	b.threshold = conf.Threshold
 
 	b.workerCount = app.WorkerCount
-	b.maxWorkers = app.SocketHandler().MaxConns()
+	b.maxWorkers = app.SocketHandler().MaxConns
 
 	return nil
 }
@@ -40,9 +40,27 @@ func (b *StaticBalancer) Init(app *Application, config interface{}) error {
 func (*StaticBalancer) Close() error          { return nil }
 func (*StaticBalancer) Status() (bool, error) { return true, nil }
 
+// ReloadableSettings implements Reloadable.ReloadableSettings().
+func (*StaticBalancer) ReloadableSettings() []string {
+	return []string{"threshold"}
+}
+
+// Reload applies a changed redirection threshold. Implements
+// Reloadable.Reload().
+func (b *StaticBalancer) Reload(config interface{}) error {
+	conf := config.(*StaticBalancerConf)
+	b.Lock()
+	b.threshold = conf.Threshold
+	b.Unlock()
+	return nil
+}
+
 func (b *StaticBalancer) shouldRedirect() (currentWorkers int64, ok bool) {
 	currentWorkers = int64(b.workerCount())
-	ok = float64(currentWorkers+1)/float64(b.maxWorkers) >= b.threshold
+	b.Lock()
+	threshold := b.threshold
+	b.Unlock()
+	ok = float64(currentWorkers+1)/float64(b.maxWorkers()) >= threshold
 	return
 }
 
@@ -60,6 +60,7 @@ type Update struct {
 	ChannelID string `json:"channelID"`
 	Version   uint64 `json:"version"`
 	Data      string `json:"data"`
+	Payload   bool   `json:"-"` // Data is held by a PayloadStore.
 }
 
 // DbConf specifies generic database adapter options.
@@ -83,6 +84,126 @@ type DbConf struct {
 	// PingPrefix is the key prefix for proprietary (GCM, etc.) pings. Defaults to
 	// "_pc-".
 	PingPrefix string `toml:"prop_prefix" env:"prop_prefix"`
+
+	// DeadLetterPrefix is the key prefix for failed updates. Defaults to
+	// "_dlq-".
+	DeadLetterPrefix string `toml:"dlq_prefix" env:"dlq_prefix"`
+
+	// TimeoutDeadLetter is the failed update record timeout. Defaults to 7
+	// days; updates that are not replayed within this timeout are discarded.
+	TimeoutDeadLetter int64 `toml:"timeout_dlq" env:"timeout_dlq"`
+
+	// TombstonePrefix is the key prefix for unregistered channel tombstones.
+	// Defaults to "_ts-".
+	TombstonePrefix string `toml:"tomb_prefix" env:"tomb_prefix"`
+
+	// TimeoutTombstone is the unregistered channel tombstone timeout. Defaults
+	// to 1 day; updates for tombstoned channels are rejected as gone. Disabled
+	// if set to 0.
+	TimeoutTombstone int64 `toml:"timeout_tomb" env:"timeout_tomb"`
+
+	// RegisteredPrefix is the key prefix for channel registration times,
+	// which are kept until the channel is unregistered. Channel records are
+	// dropped when their updates are acknowledged, so replicated changes are
+	// ordered by these times instead. Defaults to "_reg-". Only supported by
+	// the memcache_memcachego store.
+	RegisteredPrefix string `toml:"registered_prefix" env:"registered_prefix"`
+
+	// BanPrefix is the key prefix for abusive client bans. Defaults to
+	// "_ban-".
+	BanPrefix string `toml:"ban_prefix" env:"ban_prefix"`
+
+	// APIKeyPrefix is the key prefix for app server API keys. Defaults to
+	// "_key-".
+	APIKeyPrefix string `toml:"apikey_prefix" env:"apikey_prefix"`
+
+	// AffinityPrefix is the key prefix for the node that each device last
+	// connected to. Defaults to "_aff-".
+	AffinityPrefix string `toml:"affinity_prefix" env:"affinity_prefix"`
+
+	// TimeoutAffinity is the connection affinity record timeout. Defaults to
+	// 1 day.
+	TimeoutAffinity int64 `toml:"timeout_affinity" env:"timeout_affinity"`
+
+	// PruneAfter is how long, in seconds, a device can be offline before its
+	// pending updates are pruned. A device is offline from the time it last
+	// fetched its updates. When a device that was offline longer than
+	// PruneAfter reconnects, updates stored more than PruneAfter ago are
+	// discarded, except for its newest update; the channels remain
+	// registered. Should be less than TimeoutLive. Disabled if set to 0. Only
+	// supported by the memcache_memcachego store.
+	PruneAfter int64 `toml:"prune_after" env:"prune_after"`
+
+	// PayloadPrefix is the key prefix for update payloads too large to send
+	// over proprietary transports. Payloads expire after TimeoutLive.
+	// Defaults to "_pl-". Only supported by the memcache_memcachego store.
+	PayloadPrefix string `toml:"payload_prefix" env:"payload_prefix"`
+
+	// TrackConnects records the time of each device's last handshake, for
+	// the admin API. Records expire after TimeoutLive. Only supported by the
+	// memcache_memcachego store.
+	TrackConnects bool `toml:"track_connects" env:"track_connects"`
+
+	// ConnectPrefix is the key prefix for last handshake times. Defaults to
+	// "_lc-".
+	ConnectPrefix string `toml:"connect_prefix" env:"connect_prefix"`
+
+	// FetchedPrefix is the key prefix for the times that devices last fetched
+	// their updates, used by PruneAfter. Records expire after TimeoutLive.
+	// Defaults to "_lf-".
+	FetchedPrefix string `toml:"fetched_prefix" env:"fetched_prefix"`
+
+	// TenantPrefix is the key prefix for device tenant tags, used to keep
+	// virtual servers from using each other's device IDs. Tags do not
+	// expire. Defaults to "_tn-". Only supported by the memcache_memcachego
+	// store.
+	TenantPrefix string `toml:"tenant_prefix" env:"tenant_prefix"`
+
+	// RegionPrefix is the key prefix for device region tags, used for data
+	// residency. Tags do not expire. Defaults to "_rg-". Only supported by the
+	// memcache_memcachego store.
+	RegionPrefix string `toml:"region_prefix" env:"region_prefix"`
+
+	// RoutePrefix is the key prefix for the routing URL of the node that each
+	// device is connected to, used for direct routing. Records expire after
+	// TimeoutLive. Defaults to "_rt-". Only supported by the
+	// memcache_memcachego store.
+	RoutePrefix string `toml:"route_prefix" env:"route_prefix"`
+
+	// EncryptionKey is the base64-encoded AES master key used to encrypt
+	// proprietary ping records at rest. No default value; records are stored
+	// in plaintext if unspecified.
+	EncryptionKey string `toml:"encryption_key" env:"encryption_key"`
+
+	// Codec is the record serialization format: "json", "gob", or
+	// "protobuf". Defaults to "json". Records written with any codec remain
+	// readable after the codec is changed. Only supported by the
+	// memcache_memcachego and redis stores.
+	Codec string `toml:"codec" env:"codec"`
+
+	// OpMetrics records the latency of each store operation, by operation and
+	// backend server, and counts errors by class: timeouts, missing records,
+	// serialization errors, and other backend errors. Only supported by the
+	// memcache_memcachego store.
+	OpMetrics bool `toml:"op_metrics" env:"op_metrics"`
+
+	// RejectDecreasing rejects updates with a lower version than the stored
+	// channel version, instead of replacing it. Rejected updates are not
+	// delivered. Updates with the same version are accepted.
+	RejectDecreasing bool `toml:"reject_decreasing" env:"reject_decreasing"`
+}
+
+// RecordCipher returns the envelope cipher for encrypting records at rest, or
+// nil if encryption is disabled.
+func (conf *DbConf) RecordCipher() (*EnvelopeCipher, error) {
+	if len(conf.EncryptionKey) == 0 {
+		return nil, nil
+	}
+	wrapper, err := NewLocalKeyWrapper(conf.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return NewEnvelopeCipher(wrapper), nil
 }
 
 // Store describes a storage adapter.
@@ -141,6 +262,45 @@ type Store interface {
 	DropPing(suaid string) error
 }
 
+// ExpiringStore is an optional interface implemented by stores that discard
+// updates that are not delivered within the app server's TTL.
+type ExpiringStore interface {
+	// UpdateExpires updates the channel record version, like Update. If the
+	// update is not fetched before expiresAt, it is discarded, and the channel
+	// is treated as registered but not updated.
+	UpdateExpires(suaid, schid string, version int64, expiresAt time.Time) error
+}
+
+// UpdatePeeker is an optional interface implemented by stores whose FetchAll
+// discards expired or pruned updates. Read-only callers, like the admin API,
+// use PeekAll instead, so that looking at a device doesn't change it.
+type UpdatePeeker interface {
+	// PeekAll returns all pending updates and expired channels for a device,
+	// like FetchAll with a zero cutoff time, without modifying any records.
+	PeekAll(suaid string) (updates []Update, expired []string, err error)
+}
+
+// PeekAll returns a device's pending updates and expired channels without
+// modifying the store. Stores that don't implement UpdatePeeker don't modify
+// records in FetchAll.
+func PeekAll(store Store, uaid string) (updates []Update, expired []string,
+	err error) {
+
+	if peeker, ok := store.(UpdatePeeker); ok {
+		return peeker.PeekAll(uaid)
+	}
+	return store.FetchAll(uaid, time.Time{})
+}
+
+// TombstoneStore is an optional interface implemented by stores that keep
+// tombstones for unregistered channels. Tombstones prevent updates that race
+// an unregistration from resurrecting the channel.
+type TombstoneStore interface {
+	// HasTombstone indicates whether the channel was unregistered within the
+	// tombstone timeout.
+	HasTombstone(suaid, schid string) (bool, error)
+}
+
 // keySep is the primary key separator.
 var keySep = "."
 
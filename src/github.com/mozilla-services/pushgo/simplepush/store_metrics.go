@@ -0,0 +1,97 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"time"
+)
+
+// Store error classes, used to name store operation error metrics.
+const (
+	StoreErrTimeout       = "timeout"
+	StoreErrNotFound      = "not_found"
+	StoreErrSerialization = "serialization"
+	StoreErrClient        = "client"
+	StoreErrBackend       = "backend"
+)
+
+// StoreOps records the latency and errors of storage adapter operations, so
+// that slow backends can be distinguished from serialization bugs. For an
+// operation op on backend, StoreOps records the timers "store.backend.op" and
+// "store.backend.shard.<shard>.op", and the counter
+// "store.backend.op.error.<class>". A nil StoreOps records nothing.
+type StoreOps struct {
+	metrics  Statistician
+	prefix   string
+	classify func(error) string
+}
+
+// NewStoreOps returns a recorder for the operations of the named backend.
+// classify returns the error class for a backend error; if nil,
+// ClassifyStoreError is used.
+func NewStoreOps(metrics Statistician, backend string,
+	classify func(error) string) *StoreOps {
+
+	if classify == nil {
+		classify = ClassifyStoreError
+	}
+	return &StoreOps{
+		metrics:  metrics,
+		prefix:   "store." + backend + ".",
+		classify: classify,
+	}
+}
+
+// Done records an operation started at startTime. shard identifies the
+// backend server or partition that handled the operation, and is omitted if
+// empty. err points to the error returned by the operation; it may be nil
+// for operations that do not return errors. Done is meant to be deferred.
+func (o *StoreOps) Done(op, shard string, startTime time.Time, err *error) {
+	if o == nil {
+		return
+	}
+	elapsed := timeNow().Sub(startTime)
+	o.metrics.Timer(o.prefix+op, elapsed)
+	if len(shard) > 0 {
+		o.metrics.Timer(o.prefix+"shard."+shard+"."+op, elapsed)
+	}
+	if err == nil || *err == nil {
+		return
+	}
+	o.metrics.Increment(o.prefix + op + ".error." + o.classify(*err))
+}
+
+// ClassifyStoreError returns the class of a storage adapter error: timeouts,
+// missing records, record encoding errors, invalid IDs from the caller, and
+// other backend errors.
+func ClassifyStoreError(err error) string {
+	switch err {
+	case ErrNoDeadLetter, ErrNoBan, ErrNoAPIKey:
+		return StoreErrNotFound
+	case ErrInvalidID, ErrInvalidChannel, ErrNoID, ErrInvalidBan:
+		return StoreErrClient
+	case ErrInvalidRecord, ErrUnknownCodec, ErrRecordVersion,
+		ErrCodecUnsupported, ErrInvalidEnvelope:
+		return StoreErrSerialization
+	}
+	switch typedErr := err.(type) {
+	case net.Error:
+		if typedErr.Timeout() {
+			return StoreErrTimeout
+		}
+	case *json.SyntaxError, *json.UnmarshalTypeError,
+		*json.UnsupportedTypeError, *json.UnsupportedValueError:
+		return StoreErrSerialization
+	}
+	// encoding/gob and protobuf errors are untyped.
+	if msg := err.Error(); strings.HasPrefix(msg, "gob: ") ||
+		strings.HasPrefix(msg, "proto: ") {
+		return StoreErrSerialization
+	}
+	return StoreErrBackend
+}
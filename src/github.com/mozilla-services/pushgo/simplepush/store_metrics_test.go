@@ -0,0 +1,70 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStoreOps(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Store operation metrics", t, func() {
+		defer saveTimeFuncs()()
+		now := time.Unix(1000, 0)
+		timeNow = func() time.Time { return now }
+
+		ops := NewStoreOps(mckStat, "gomemc", nil)
+		startTime := now.Add(-5 * time.Millisecond)
+
+		Convey("Should time operations by shard", func() {
+			var err error
+			mckStat.EXPECT().Timer("store.gomemc.fetch_all", 5*time.Millisecond)
+			mckStat.EXPECT().Timer("store.gomemc.shard.1.fetch_all",
+				5*time.Millisecond)
+			ops.Done("fetch_all", "1", startTime, &err)
+		})
+
+		Convey("Should count errors by class", func() {
+			err := ErrRecordVersion
+			mckStat.EXPECT().Timer("store.gomemc.update", 5*time.Millisecond)
+			mckStat.EXPECT().Increment("store.gomemc.update.error.serialization")
+			ops.Done("update", "", startTime, &err)
+		})
+
+		Convey("Should classify errors", func() {
+			So(ClassifyStoreError(&netErr{timeout: true}), ShouldEqual,
+				StoreErrTimeout)
+			So(ClassifyStoreError(ErrNoDeadLetter), ShouldEqual, StoreErrNotFound)
+			So(ClassifyStoreError(ErrNoAPIKey), ShouldEqual, StoreErrNotFound)
+			So(ClassifyStoreError(ErrInvalidID), ShouldEqual, StoreErrClient)
+			So(ClassifyStoreError(ErrInvalidChannel), ShouldEqual, StoreErrClient)
+			So(ClassifyStoreError(ErrNoID), ShouldEqual, StoreErrClient)
+			So(ClassifyStoreError(ErrInvalidBan), ShouldEqual, StoreErrClient)
+			So(ClassifyStoreError(json.Unmarshal([]byte("{"), new(Ban))),
+				ShouldEqual, StoreErrSerialization)
+			So(ClassifyStoreError(errors.New("gob: type mismatch")),
+				ShouldEqual, StoreErrSerialization)
+			So(ClassifyStoreError(&netErr{timeout: false}), ShouldEqual,
+				StoreErrBackend)
+			So(ClassifyStoreError(ErrMemcacheStatus), ShouldEqual, StoreErrBackend)
+		})
+
+		Convey("Should record nothing if disabled", func() {
+			var ops *StoreOps
+			err := ErrRecordVersion
+			ops.Done("update", "", startTime, &err)
+		})
+	})
+}
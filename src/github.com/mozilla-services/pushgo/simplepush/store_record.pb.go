@@ -0,0 +1,86 @@
+// Code generated by protoc-gen-gogo.
+// source: store_record.proto
+// DO NOT EDIT!
+
+package simplepush
+
+import proto "github.com/gogo/protobuf/proto"
+import math "math"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = math.Inf
+
+// StoredRecord is a channel record.
+type StoredRecord struct {
+	State            *int32  `protobuf:"varint,1,opt,name=state" json:"state,omitempty"`
+	Version          *uint64 `protobuf:"varint,2,opt,name=version" json:"version,omitempty"`
+	LastTouched      *int64  `protobuf:"varint,3,opt,name=last_touched" json:"last_touched,omitempty"`
+	ExpiresAt        *int64  `protobuf:"varint,4,opt,name=expires_at" json:"expires_at,omitempty"`
+	Created          *int64  `protobuf:"varint,5,opt,name=created" json:"created,omitempty"`
+	Payload          *uint64 `protobuf:"varint,6,opt,name=payload" json:"payload,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *StoredRecord) Reset()         { *m = StoredRecord{} }
+func (m *StoredRecord) String() string { return proto.CompactTextString(m) }
+func (*StoredRecord) ProtoMessage()    {}
+
+func (m *StoredRecord) GetState() int32 {
+	if m != nil && m.State != nil {
+		return *m.State
+	}
+	return 0
+}
+
+func (m *StoredRecord) GetVersion() uint64 {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return 0
+}
+
+func (m *StoredRecord) GetLastTouched() int64 {
+	if m != nil && m.LastTouched != nil {
+		return *m.LastTouched
+	}
+	return 0
+}
+
+func (m *StoredRecord) GetExpiresAt() int64 {
+	if m != nil && m.ExpiresAt != nil {
+		return *m.ExpiresAt
+	}
+	return 0
+}
+
+func (m *StoredRecord) GetCreated() int64 {
+	if m != nil && m.Created != nil {
+		return *m.Created
+	}
+	return 0
+}
+
+func (m *StoredRecord) GetPayload() uint64 {
+	if m != nil && m.Payload != nil {
+		return *m.Payload
+	}
+	return 0
+}
+
+// StoredChannelIDs is the list of channels registered to a device.
+type StoredChannelIDs struct {
+	ChannelIds       []string `protobuf:"bytes,1,rep,name=channel_ids" json:"channel_ids,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *StoredChannelIDs) Reset()         { *m = StoredChannelIDs{} }
+func (m *StoredChannelIDs) String() string { return proto.CompactTextString(m) }
+func (*StoredChannelIDs) ProtoMessage()    {}
+
+func (m *StoredChannelIDs) GetChannelIds() []string {
+	if m != nil {
+		return m.ChannelIds
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// Subprotocol is the WebSocket subprotocol name for the push protocol.
+// Clients may request a specific protocol version with a versioned variant,
+// such as "push-notification.v1".
+const Subprotocol = "push-notification"
+
+// DefaultProtocolVersion is the protocol version used by clients that don't
+// request a version.
+const DefaultProtocolVersion = 1
+
+var ErrUnsupportedProtocol = errors.New("Unsupported WebSocket subprotocol")
+
+type SubprotocolConfig struct {
+	// Strict rejects connections that only offer unknown subprotocols, or
+	// that request a version other than the one in the handshake URL.
+	// Otherwise, these connections are served with the default protocol
+	// version, without a subprotocol. Connections that don't offer a
+	// subprotocol are always accepted.
+	Strict bool
+}
+
+// ProtocolServer serves a client connection for a protocol version.
+type ProtocolServer func(socket Socket, req *http.Request)
+
+// ParseSubprotocol returns the protocol version for a subprotocol name. The
+// unversioned name selects the default version.
+func ParseSubprotocol(name string) (version int, ok bool) {
+	if name == Subprotocol {
+		return DefaultProtocolVersion, true
+	}
+	if !strings.HasPrefix(name, Subprotocol+".v") {
+		return 0, false
+	}
+	version, err := strconv.Atoi(name[len(Subprotocol)+2:])
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// VersionedSubprotocol returns the subprotocol name for a protocol version.
+func VersionedSubprotocol(version int) string {
+	return Subprotocol + ".v" + strconv.Itoa(version)
+}
+
+// HandleVersion registers the server for a protocol version. Clients select
+// a version with a versioned subprotocol, or the /v{version} handshake URL.
+func (h *SocketHandler) HandleVersion(version int, serve ProtocolServer) {
+	h.versions[version] = serve
+}
+
+// negotiate selects the protocol version for a connection, and the
+// subprotocol to return in the handshake response. pathVersion is the
+// version in the handshake URL, or 0 if unspecified. Of the offered
+// subprotocols, the client's first supported choice is selected. Compressed
+// variants are only supported if compression is enabled.
+func (h *SocketHandler) negotiate(conf *websocket.Config, pathVersion int) (
+	version int, err error) {
+
+	if pathVersion > 0 {
+		if _, ok := h.versions[pathVersion]; !ok {
+			h.metrics.Increment("client.socket.subprotocol.rejected")
+			return 0, ErrUnsupportedProtocol
+		}
+	}
+	offered := conf.Protocol
+	conf.Protocol = nil
+	for _, name := range offered {
+		base, deflate := splitCompression(name)
+		if deflate && h.compression == nil {
+			continue
+		}
+		v, ok := ParseSubprotocol(base)
+		if !ok {
+			continue
+		}
+		if pathVersion > 0 && base == Subprotocol {
+			// The handshake URL selects the version.
+			v = pathVersion
+		}
+		if _, ok = h.versions[v]; !ok || pathVersion > 0 && v != pathVersion {
+			continue
+		}
+		conf.Protocol = []string{name}
+		return v, nil
+	}
+	if len(offered) > 0 {
+		if h.subprotocol.Strict {
+			h.metrics.Increment("client.socket.subprotocol.rejected")
+			return 0, ErrUnsupportedProtocol
+		}
+		h.metrics.Increment("client.socket.subprotocol.unsupported")
+	}
+	if pathVersion > 0 {
+		return pathVersion, nil
+	}
+	return DefaultProtocolVersion, nil
+}
+
+// pathVersion returns the protocol version in the handshake URL, or 0 if
+// unspecified.
+func pathVersion(req *http.Request) int {
+	version, _ := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/v"))
+	return version
+}
@@ -0,0 +1,116 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/websocket"
+)
+
+func TestSubprotocol(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Subprotocol negotiation", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		h := NewSocketHandler()
+		h.setApp(app)
+		h.HandleVersion(2, func(Socket, *http.Request) {})
+
+		negotiate := func(pathVersion int, offered ...string) (
+			version int, protocol []string, err error) {
+
+			conf := &websocket.Config{Protocol: offered}
+			version, err = h.negotiate(conf, pathVersion)
+			return version, conf.Protocol, err
+		}
+
+		Convey("Should parse subprotocol names", func() {
+			version, ok := ParseSubprotocol("push-notification")
+			So(ok, ShouldBeTrue)
+			So(version, ShouldEqual, DefaultProtocolVersion)
+			version, ok = ParseSubprotocol("push-notification.v2")
+			So(ok, ShouldBeTrue)
+			So(version, ShouldEqual, 2)
+			_, ok = ParseSubprotocol("push-notification.v0")
+			So(ok, ShouldBeFalse)
+			_, ok = ParseSubprotocol("chat")
+			So(ok, ShouldBeFalse)
+			So(VersionedSubprotocol(3), ShouldEqual, "push-notification.v3")
+		})
+
+		Convey("Should use the default version without a subprotocol", func() {
+			version, protocol, err := negotiate(0)
+			So(err, ShouldBeNil)
+			So(version, ShouldEqual, DefaultProtocolVersion)
+			So(protocol, ShouldBeEmpty)
+		})
+
+		Convey("Should select the client's first supported choice", func() {
+			version, protocol, err := negotiate(0, "chat",
+				"push-notification.v3", "push-notification.v2", "push-notification")
+			So(err, ShouldBeNil)
+			So(version, ShouldEqual, 2)
+			So(protocol, ShouldResemble, []string{"push-notification.v2"})
+		})
+
+		Convey("Should use the version in the handshake URL", func() {
+			version, protocol, err := negotiate(2, "push-notification")
+			So(err, ShouldBeNil)
+			So(version, ShouldEqual, 2)
+			So(protocol, ShouldResemble, []string{"push-notification"})
+
+			mckStat.EXPECT().Increment("client.socket.subprotocol.rejected")
+			_, _, err = negotiate(3)
+			So(err, ShouldEqual, ErrUnsupportedProtocol)
+		})
+
+		Convey("Should only select compressed variants if enabled", func() {
+			mckStat.EXPECT().Increment("client.socket.subprotocol.unsupported")
+			version, protocol, err := negotiate(0, "push-notification.v2+deflate")
+			So(err, ShouldBeNil)
+			So(version, ShouldEqual, DefaultProtocolVersion)
+			So(protocol, ShouldBeEmpty)
+
+			h.compression = &Compression{}
+			version, protocol, err = negotiate(0, "push-notification.v2+deflate",
+				"push-notification.v2")
+			So(err, ShouldBeNil)
+			So(version, ShouldEqual, 2)
+			So(protocol, ShouldResemble, []string{"push-notification.v2+deflate"})
+		})
+
+		Convey("Should accept unknown subprotocols without a reply", func() {
+			mckStat.EXPECT().Increment("client.socket.subprotocol.unsupported")
+			version, protocol, err := negotiate(0, "chat")
+			So(err, ShouldBeNil)
+			So(version, ShouldEqual, DefaultProtocolVersion)
+			So(protocol, ShouldBeEmpty)
+		})
+
+		Convey("Should reject unknown subprotocols in strict mode", func() {
+			h.subprotocol.Strict = true
+			mckStat.EXPECT().Increment("client.socket.subprotocol.rejected").Times(2)
+			_, _, err := negotiate(0, "chat")
+			So(err, ShouldEqual, ErrUnsupportedProtocol)
+
+			// Conflicting handshake URL and subprotocol versions.
+			_, _, err = negotiate(1, "push-notification.v2")
+			So(err, ShouldEqual, ErrUnsupportedProtocol)
+		})
+	})
+}
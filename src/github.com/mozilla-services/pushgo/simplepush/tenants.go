@@ -0,0 +1,288 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// DefaultTenant is the tenant name for clients and app servers that don't
+// match a virtual server.
+const DefaultTenant = "default"
+
+type TenantConfig struct {
+	Enabled bool
+
+	// Dir is the etcd directory containing the tenant settings. Each key is
+	// a tenant name (a virtual server name, or "default"), and each value is
+	// a JSON object with the tenant's settings. Defaults to "push_tenants".
+	Dir string
+
+	// Servers is a list of etcd servers.
+	Servers []string
+
+	// RefreshInterval is the interval for fetching tenant settings from etcd.
+	// Defaults to "30s".
+	RefreshInterval string `toml:"refresh_interval" env:"refresh_interval"`
+}
+
+// TenantSettings are the dynamic settings for a tenant. Omitted settings
+// fall back to the server config.
+type TenantSettings struct {
+	// MaxRegisters and RegisterWindow override client_max_registers and
+	// client_register_window. RegisterWindow is required if the server
+	// doesn't limit registrations. Changes apply to connections that haven't
+	// registered a channel yet.
+	MaxRegisters   *int   `json:"maxRegisters,omitempty"`
+	RegisterWindow string `json:"registerWindow,omitempty"`
+
+	// MaxFlushUpdates overrides the max_updates flush cap. Zero disables the
+	// cap for the tenant.
+	MaxFlushUpdates *int `json:"maxFlushUpdates,omitempty"`
+
+	// Features enables or disables optional features for the tenant, by
+	// name. "purge" overrides allow_purge, and "flush_drop" overrides the
+	// flush cap's drop setting.
+	Features map[string]bool `json:"features,omitempty"`
+
+	registerWindow time.Duration
+}
+
+// parseTenantSettings decodes and validates a tenant settings object.
+func parseTenantSettings(data []byte) (s *TenantSettings, err error) {
+	s = new(TenantSettings)
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if len(s.RegisterWindow) > 0 {
+		if s.registerWindow, err = time.ParseDuration(s.RegisterWindow); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// TenantSource fetches the encoded settings for all tenants, by tenant name.
+type TenantSource interface {
+	Fetch() (map[string][]byte, error)
+}
+
+// etcdTenantSource fetches tenant settings from an etcd directory.
+type etcdTenantSource struct {
+	client *etcd.Client
+	dir    string
+}
+
+func (s *etcdTenantSource) Fetch() (map[string][]byte, error) {
+	response, err := s.client.Get(s.dir, false, false)
+	if err != nil {
+		if IsEtcdKeyNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	values := make(map[string][]byte, len(response.Node.Nodes))
+	for _, node := range response.Node.Nodes {
+		if node.Dir {
+			continue
+		}
+		values[path.Base(node.Key)] = []byte(node.Value)
+	}
+	return values, nil
+}
+
+// Tenants holds per-tenant quotas, rate limits, and feature flags, refreshed
+// periodically from etcd, so that operators can change them without
+// restarting the fleet. A nil Tenants uses the server config for all tenants.
+type Tenants struct {
+	logger          *SimpleLogger
+	metrics         Statistician
+	source          TenantSource
+	refreshInterval time.Duration
+	settingsMux     sync.RWMutex
+	settings        map[string]*TenantSettings
+	closeSignal     chan bool
+	closeWait       sync.WaitGroup
+	closeOnce       Once
+}
+
+func NewTenants() *Tenants {
+	return &Tenants{
+		settings:    make(map[string]*TenantSettings),
+		closeSignal: make(chan bool),
+	}
+}
+
+func (t *Tenants) ConfigStruct() interface{} {
+	return &TenantConfig{
+		Enabled:         false,
+		Dir:             "push_tenants",
+		Servers:         []string{"http://localhost:4001"},
+		RefreshInterval: "30s",
+	}
+}
+
+func (t *Tenants) Init(app *Application, config interface{}) (err error) {
+	conf := config.(*TenantConfig)
+	t.logger = app.Logger()
+	t.metrics = app.Metrics()
+
+	if !conf.Enabled {
+		return nil
+	}
+	if t.refreshInterval, err = time.ParseDuration(conf.RefreshInterval); err != nil {
+		t.logger.Panic("tenants", "Could not parse refreshInterval",
+			LogFields{"error": err.Error(),
+				"refreshInterval": conf.RefreshInterval})
+		return err
+	}
+	t.source = &etcdTenantSource{
+		client: etcd.NewClient(conf.Servers),
+		dir:    conf.Dir,
+	}
+	if err = t.Refresh(); err != nil {
+		t.logger.Panic("tenants", "Could not fetch tenant settings from etcd",
+			LogFields{"error": err.Error()})
+		return err
+	}
+	t.closeWait.Add(1)
+	go t.refreshSettings()
+	app.SetTenants(t)
+	return nil
+}
+
+// Refresh fetches the settings for all tenants. If a tenant's settings are
+// invalid, its previous settings are kept.
+func (t *Tenants) Refresh() error {
+	values, err := t.source.Fetch()
+	if err != nil {
+		if t.logger.ShouldLog(ERROR) {
+			t.logger.Error("tenants", "Failed to fetch tenant settings",
+				LogFields{"error": err.Error()})
+		}
+		t.metrics.Increment("tenants.fetch.error")
+		return err
+	}
+	settings := make(map[string]*TenantSettings, len(values))
+	t.settingsMux.RLock()
+	for tenant, data := range values {
+		s, err := parseTenantSettings(data)
+		if err != nil {
+			if t.logger.ShouldLog(WARNING) {
+				t.logger.Warn("tenants", "Invalid tenant settings",
+					LogFields{"tenant": tenant, "error": err.Error()})
+			}
+			t.metrics.Increment("tenants.invalid")
+			if s = t.settings[tenant]; s == nil {
+				continue
+			}
+		}
+		settings[tenant] = s
+	}
+	t.settingsMux.RUnlock()
+	t.settingsMux.Lock()
+	t.settings = settings
+	t.settingsMux.Unlock()
+	t.metrics.Gauge("tenants.count", int64(len(settings)))
+	if t.logger.ShouldLog(DEBUG) {
+		t.logger.Debug("tenants", "Refreshed tenant settings",
+			LogFields{"tenants": strconv.Itoa(len(settings))})
+	}
+	return nil
+}
+
+// refreshSettings periodically fetches tenant settings from etcd.
+func (t *Tenants) refreshSettings() {
+	defer t.closeWait.Done()
+	ticker := clock.NewTicker(t.refreshInterval)
+	for ok := true; ok; {
+		select {
+		case ok = <-t.closeSignal:
+		case <-ticker.C():
+			t.Refresh()
+		}
+	}
+	ticker.Stop()
+}
+
+// Settings returns the settings for tenant, or nil if the tenant uses the
+// server config.
+func (t *Tenants) Settings(tenant string) *TenantSettings {
+	if t == nil {
+		return nil
+	}
+	t.settingsMux.RLock()
+	s := t.settings[tenant]
+	t.settingsMux.RUnlock()
+	return s
+}
+
+// Feature indicates whether the named feature is enabled for tenant,
+// returning def if the tenant doesn't override it.
+func (t *Tenants) Feature(tenant, name string, def bool) bool {
+	s := t.Settings(tenant)
+	if s == nil {
+		return def
+	}
+	if enabled, ok := s.Features[name]; ok {
+		return enabled
+	}
+	return def
+}
+
+// RegisterLimit returns the maximum number of channel registrations per
+// window for tenant, given the server defaults.
+func (t *Tenants) RegisterLimit(tenant string, limit int,
+	window time.Duration) (int, time.Duration) {
+
+	s := t.Settings(tenant)
+	if s == nil {
+		return limit, window
+	}
+	if s.MaxRegisters != nil {
+		limit = *s.MaxRegisters
+	}
+	if s.registerWindow > 0 {
+		window = s.registerWindow
+	}
+	return limit, window
+}
+
+// FlushLimit returns the maximum number of updates sent in each flush for
+// tenant, and whether excess updates are dropped, given the server defaults.
+func (t *Tenants) FlushLimit(tenant string, limit int, drop bool) (int, bool) {
+	s := t.Settings(tenant)
+	if s == nil {
+		return limit, drop
+	}
+	if s.MaxFlushUpdates != nil {
+		limit = *s.MaxFlushUpdates
+	}
+	return limit, t.Feature(tenant, "flush_drop", drop)
+}
+
+func (t *Tenants) Close() error {
+	return t.closeOnce.Do(t.close)
+}
+
+func (t *Tenants) close() error {
+	close(t.closeSignal)
+	t.closeWait.Wait()
+	return nil
+}
+
+// tenantName returns the tenant name for a virtual server, which may be nil.
+func tenantName(vs *VirtualServer) string {
+	if vs == nil {
+		return DefaultTenant
+	}
+	return vs.Name()
+}
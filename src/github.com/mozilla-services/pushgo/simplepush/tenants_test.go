@@ -0,0 +1,110 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// staticTenantSource returns fixed tenant settings.
+type staticTenantSource struct {
+	values map[string][]byte
+	err    error
+}
+
+func (s *staticTenantSource) Fetch() (map[string][]byte, error) {
+	return s.values, s.err
+}
+
+func TestTenants(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Dynamic tenant settings", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		tenants := NewTenants()
+		So(tenants.Init(app, tenants.ConfigStruct()), ShouldBeNil)
+		source := &staticTenantSource{values: map[string][]byte{
+			DefaultTenant: []byte(`{"features":{"purge":true}}`),
+			"tenant1": []byte(`{"maxRegisters":5,"registerWindow":"1m",` +
+				`"maxFlushUpdates":20,"features":{"flush_drop":true}}`),
+		}}
+		tenants.source = source
+		mckStat.EXPECT().Gauge("tenants.count", int64(2))
+		So(tenants.Refresh(), ShouldBeNil)
+
+		Convey("Should override feature flags", func() {
+			So(tenants.Feature(DefaultTenant, "purge", false), ShouldBeTrue)
+			So(tenants.Feature(DefaultTenant, "unknown", false), ShouldBeFalse)
+			So(tenants.Feature("tenant1", "purge", false), ShouldBeFalse)
+		})
+
+		Convey("Should override registration limits", func() {
+			limit, window := tenants.RegisterLimit("tenant1", 10, time.Second)
+			So(limit, ShouldEqual, 5)
+			So(window, ShouldEqual, time.Minute)
+			limit, window = tenants.RegisterLimit("tenant2", 10, time.Second)
+			So(limit, ShouldEqual, 10)
+			So(window, ShouldEqual, time.Second)
+		})
+
+		Convey("Should override flush caps", func() {
+			limit, drop := tenants.FlushLimit("tenant1", 0, false)
+			So(limit, ShouldEqual, 20)
+			So(drop, ShouldBeTrue)
+			limit, drop = tenants.FlushLimit(DefaultTenant, 10, false)
+			So(limit, ShouldEqual, 10)
+			So(drop, ShouldBeFalse)
+		})
+
+		Convey("Should keep previous settings if invalid", func() {
+			source.values = map[string][]byte{
+				DefaultTenant: []byte(`{"features":{"purge":false}}`),
+				"tenant1":     []byte(`{"registerWindow":"soon"}`),
+				"tenant2":     []byte(`[]`),
+			}
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("tenants.invalid").Times(2),
+				mckStat.EXPECT().Gauge("tenants.count", int64(2)),
+			)
+			So(tenants.Refresh(), ShouldBeNil)
+			So(tenants.Feature(DefaultTenant, "purge", true), ShouldBeFalse)
+			limit, _ := tenants.RegisterLimit("tenant1", 10, time.Second)
+			So(limit, ShouldEqual, 5)
+			So(tenants.Settings("tenant2"), ShouldBeNil)
+		})
+
+		Convey("Should keep all settings if the fetch fails", func() {
+			source.err = errors.New("etcd unavailable")
+			mckStat.EXPECT().Increment("tenants.fetch.error")
+			So(tenants.Refresh(), ShouldNotBeNil)
+			So(tenants.Feature(DefaultTenant, "purge", false), ShouldBeTrue)
+		})
+
+		Convey("Should use the server config if disabled", func() {
+			var tenants *Tenants
+			So(tenants.Feature(DefaultTenant, "purge", true), ShouldBeTrue)
+			limit, window := tenants.RegisterLimit(DefaultTenant, 10, time.Second)
+			So(limit, ShouldEqual, 10)
+			So(window, ShouldEqual, time.Second)
+			limit, drop := tenants.FlushLimit(DefaultTenant, 10, true)
+			So(limit, ShouldEqual, 10)
+			So(drop, ShouldBeTrue)
+		})
+	})
+}
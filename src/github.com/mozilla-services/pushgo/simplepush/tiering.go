@@ -0,0 +1,150 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"strconv"
+)
+
+// PayloadLimiter is an optional interface implemented by proprietary pingers
+// whose transports limit the size of update data, like GCM.
+type PayloadLimiter interface {
+	// MaxPayload returns the size, in bytes, of the largest update payload
+	// that the pinger can send. Payloads are unlimited if zero.
+	MaxPayload() int
+}
+
+// PayloadStore is an optional interface implemented by stores that keep
+// update payloads for devices woken by data-less proprietary pings.
+type PayloadStore interface {
+	// PutPayload stores the update data for a channel version, and flags the
+	// version so that FetchAll returns it with Update.Payload set.
+	PutPayload(suaid, schid string, version int64, data string) error
+
+	// FetchPayloads returns the stored data for each flagged update, in
+	// order. The data is empty for unflagged updates, and for updates whose
+	// data is missing or was stored for a different version.
+	FetchPayloads(suaid string, updates []Update) (data []string, err error)
+}
+
+// MaxPayload returns the payload size limit of pinger, or 0 if the pinger
+// does not limit payload sizes.
+func MaxPayload(pinger PropPinger) int {
+	if limiter, ok := pinger.(PayloadLimiter); ok {
+		return limiter.MaxPayload()
+	}
+	return 0
+}
+
+// PayloadTiering decides how updates are sent over proprietary transports.
+// Payloads within the pinger's limit are sent with the ping. Larger payloads
+// are stored, and the device is sent a data-less wakeup instead; the device
+// fetches the payload when it reconnects. A nil PayloadTiering never tiers.
+type PayloadTiering struct {
+	logger     *SimpleLogger
+	metrics    Statistician
+	store      PayloadStore // May be nil.
+	maxPayload int
+}
+
+// NewPayloadTiering returns the payload tiering policy for the configured
+// pinger, or nil if the pinger does not limit payload sizes.
+func NewPayloadTiering(app *Application) *PayloadTiering {
+	pinger := app.PropPinger()
+	if pinger == nil {
+		return nil
+	}
+	maxPayload := MaxPayload(pinger)
+	if maxPayload <= 0 {
+		return nil
+	}
+	t := &PayloadTiering{
+		logger:     app.Logger(),
+		metrics:    app.Metrics(),
+		maxPayload: maxPayload,
+	}
+	if store, ok := app.Store().(PayloadStore); ok {
+		t.store = store
+	} else if t.logger.ShouldLog(WARNING) {
+		t.logger.Warn("tiering", "Storage adapter does not support payloads; "+
+			"oversized payloads will only be delivered to connected clients",
+			LogFields{"pinger": PingerName(pinger)})
+	}
+	return t
+}
+
+// Wakeup indicates whether data exceeds the pinger's limit, and should be
+// sent as a data-less wakeup. If so, the payload is stored for the device to
+// fetch.
+func (t *PayloadTiering) Wakeup(uaid, chid string, version int64,
+	data string) bool {
+
+	if t == nil || len(data) <= t.maxPayload {
+		return false
+	}
+	t.metrics.Increment("ping.payload.tiered")
+	if t.store == nil {
+		return true
+	}
+	if err := t.store.PutPayload(uaid, chid, version, data); err != nil {
+		if t.logger.ShouldLog(WARNING) {
+			t.logger.Warn("tiering", "Could not store oversized payload",
+				LogFields{"uaid": uaid, "chid": chid,
+					"size": strconv.Itoa(len(data)), "error": err.Error()})
+		}
+		t.metrics.Increment("ping.payload.error")
+	}
+	return true
+}
+
+// Attach fills in the data of flushed updates from stored payloads. Updates
+// that already have data are left unchanged.
+func (t *PayloadTiering) Attach(uaid string, updates []Update) {
+	if t == nil || t.store == nil {
+		return
+	}
+	attached, err := attachPayloads(t.store, uaid, updates)
+	if err != nil {
+		if t.logger.ShouldLog(WARNING) {
+			t.logger.Warn("tiering", "Could not fetch stored payloads",
+				LogFields{"uaid": uaid, "error": err.Error()})
+		}
+		t.metrics.Increment("ping.payload.error")
+		return
+	}
+	if attached > 0 {
+		t.metrics.IncrementBy("ping.payload.fetched", int64(attached))
+	}
+}
+
+// attachPayloads fills in the data of flushed updates flagged with stored
+// payloads, reading the payloads in one batch. Updates that already have data
+// are left unchanged. Returns the number of updates filled in.
+func attachPayloads(store PayloadStore, uaid string,
+	updates []Update) (attached int, err error) {
+
+	var flagged []Update
+	var indices []int
+	for i, update := range updates {
+		if update.Payload && len(update.Data) == 0 {
+			flagged = append(flagged, update)
+			indices = append(indices, i)
+		}
+	}
+	if len(flagged) == 0 {
+		return 0, nil
+	}
+	data, err := store.FetchPayloads(uaid, flagged)
+	if err != nil {
+		return 0, err
+	}
+	for i, index := range indices {
+		if len(data[i]) > 0 {
+			updates[index].Data = data[i]
+			attached++
+		}
+	}
+	return attached, nil
+}
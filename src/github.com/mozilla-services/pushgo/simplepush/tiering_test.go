@@ -0,0 +1,122 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// payloadStore keeps update payloads in memory.
+type payloadStore struct {
+	NoStore
+	payloads map[string]Update
+	fetches  int
+	err      error
+}
+
+func (s *payloadStore) PutPayload(uaid, chid string, version int64,
+	data string) error {
+
+	if s.err != nil {
+		return s.err
+	}
+	s.payloads[joinIDs(uaid, chid)] = Update{chid, uint64(version), data, false}
+	return nil
+}
+
+func (s *payloadStore) FetchPayloads(uaid string, updates []Update) (
+	[]string, error) {
+
+	s.fetches++
+	if s.err != nil {
+		return nil, s.err
+	}
+	data := make([]string, len(updates))
+	for i, update := range updates {
+		stored := s.payloads[joinIDs(uaid, update.ChannelID)]
+		if update.Payload && stored.Version == update.Version {
+			data[i] = stored.Data
+		}
+	}
+	return data, nil
+}
+
+func TestPayloadTiering(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	uaid := "5e1e5984569c4f00bf4bea47754a6403"
+	chid := "0d6a6d0ca1ba4be1bc8a2cea8e4ddb1a"
+
+	Convey("Payload tiering", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		store := &payloadStore{payloads: make(map[string]Update)}
+		app.SetStore(store)
+		app.SetPropPinger(&SandboxPing{maxPayload: 8})
+
+		tiering := NewPayloadTiering(app)
+		So(tiering, ShouldNotBeNil)
+
+		Convey("Should send small payloads with the ping", func() {
+			So(tiering.Wakeup(uaid, chid, 1, "small"), ShouldBeFalse)
+			So(store.payloads, ShouldBeEmpty)
+		})
+
+		Convey("Should store oversized payloads and attach them on flush", func() {
+			mckStat.EXPECT().Increment("ping.payload.tiered")
+			So(tiering.Wakeup(uaid, chid, 2, "oversized"), ShouldBeTrue)
+
+			mckStat.EXPECT().IncrementBy("ping.payload.fetched", int64(1))
+			updates := []Update{{chid, 2, "", true}, {"other", 3, "inline", false}}
+			tiering.Attach(uaid, updates)
+			So(updates[0].Data, ShouldEqual, "oversized")
+			So(updates[1].Data, ShouldEqual, "inline")
+			So(store.fetches, ShouldEqual, 1)
+		})
+
+		Convey("Should only fetch flagged payloads", func() {
+			mckStat.EXPECT().Increment("ping.payload.tiered")
+			tiering.Wakeup(uaid, chid, 2, "oversized")
+			updates := []Update{{chid, 2, "", false}}
+			tiering.Attach(uaid, updates)
+			So(updates[0].Data, ShouldBeEmpty)
+			So(store.fetches, ShouldEqual, 0)
+		})
+
+		Convey("Should not attach payloads for other versions", func() {
+			mckStat.EXPECT().Increment("ping.payload.tiered")
+			tiering.Wakeup(uaid, chid, 2, "oversized")
+			updates := []Update{{chid, 3, "", true}}
+			tiering.Attach(uaid, updates)
+			So(updates[0].Data, ShouldBeEmpty)
+		})
+
+		Convey("Should still wake devices if the payload is not stored", func() {
+			store.err = errors.New("oops")
+			mckStat.EXPECT().Increment("ping.payload.tiered")
+			mckStat.EXPECT().Increment("ping.payload.error")
+			So(tiering.Wakeup(uaid, chid, 2, "oversized"), ShouldBeTrue)
+		})
+
+		Convey("Should not tier unlimited pingers", func() {
+			app.SetPropPinger(&SandboxPing{})
+			So(NewPayloadTiering(app), ShouldBeNil)
+			var disabled *PayloadTiering
+			So(disabled.Wakeup(uaid, chid, 2, "oversized"), ShouldBeFalse)
+		})
+	})
+}
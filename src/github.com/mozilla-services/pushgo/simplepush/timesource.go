@@ -0,0 +1,80 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"time"
+)
+
+// Clock is a source of the current time and timers. Code that waits for
+// timeouts uses the package-level clock, and reads the current time with
+// clock.Now or timeNow, so that tests can control both: timeouts and expiry
+// can be tested without sleeping, and clock jumps can be simulated.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel that receives the current time after d.
+	After(d time.Duration) <-chan time.Time
+
+	// NewTimer returns a timer that sends the current time on its channel
+	// after d.
+	NewTimer(d time.Duration) Timer
+
+	// AfterFunc calls f in its own goroutine after d. The returned timer's
+	// channel is nil.
+	AfterFunc(d time.Duration, f func()) Timer
+
+	// NewTicker returns a ticker that sends the current time on its channel
+	// every d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a single event created by a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is a repeating event created by a Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// stdClock is a Clock backed by the time package.
+type stdClock struct{}
+
+func (stdClock) Now() time.Time { return time.Now() }
+
+func (stdClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (stdClock) NewTimer(d time.Duration) Timer {
+	return stdTimer{time.NewTimer(d)}
+}
+
+func (stdClock) AfterFunc(d time.Duration, f func()) Timer {
+	return stdTimer{time.AfterFunc(d, f)}
+}
+
+func (stdClock) NewTicker(d time.Duration) Ticker {
+	return stdTicker{time.NewTicker(d)}
+}
+
+type stdTimer struct {
+	t *time.Timer
+}
+
+func (t stdTimer) C() <-chan time.Time        { return t.t.C }
+func (t stdTimer) Stop() bool                 { return t.t.Stop() }
+func (t stdTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+type stdTicker struct {
+	t *time.Ticker
+}
+
+func (t stdTicker) C() <-chan time.Time { return t.t.C }
+func (t stdTicker) Stop()               { t.t.Stop() }
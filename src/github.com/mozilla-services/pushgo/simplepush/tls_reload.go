@@ -0,0 +1,317 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrNoFileWatch is returned by newFileWatcher on platforms that cannot
+// watch files for changes.
+var ErrNoFileWatch = errors.New("File watching not supported")
+
+// fileWatcher signals changes to a set of files.
+type fileWatcher interface {
+	Changes() <-chan bool
+	Close() error
+}
+
+// CertReloader serves a TLS certificate, and reloads it when the certificate,
+// key, or OCSP response files change, so that certificates can be renewed
+// without closing existing connections. New connections use the reloaded
+// certificate; established connections are unaffected. If the files cannot be
+// loaded (e.g., because the certificate was updated before its key), the
+// previous certificate is kept, and the files are loaded again on the next
+// change.
+type CertReloader struct {
+	logger      *SimpleLogger
+	metrics     Statistician
+	certFile    string
+	keyFile     string
+	ocspFile    string // Optional DER-encoded OCSP response to staple.
+	interval    time.Duration
+	ocspRefresh time.Duration
+	fetcher     *OCSPFetcher
+	confLock    sync.RWMutex
+	conf        *tls.Config
+	cert        tls.Certificate // The loaded certificate and staple.
+	modTimes    []time.Time     // Of the loaded files.
+	closeChan   chan bool
+	closeOnce   Once
+	done        chan bool
+}
+
+// NewCertReloader loads the certificate and key from certFile and keyFile.
+// If ocspFile is set, its contents are stapled to TLS handshakes as the OCSP
+// response for the certificate; the file should be refreshed by an external
+// tool before the response expires. Otherwise, if ocspRefresh is set, the
+// response is requested from the certificate's OCSP responder every
+// ocspRefresh. If interval is set, the files are reloaded when they change;
+// where file watching is not supported, they are checked every interval. If
+// interval is 0, the certificate is never reloaded.
+func NewCertReloader(app *Application, certFile, keyFile, ocspFile string,
+	interval, ocspRefresh time.Duration) (r *CertReloader, err error) {
+
+	r = &CertReloader{
+		logger:    app.Logger(),
+		metrics:   app.Metrics(),
+		certFile:  certFile,
+		keyFile:   keyFile,
+		ocspFile:  ocspFile,
+		interval:  interval,
+		closeChan: make(chan bool),
+		done:      make(chan bool),
+	}
+	if len(ocspFile) == 0 && ocspRefresh > 0 {
+		r.ocspRefresh = ocspRefresh
+		r.fetcher = NewOCSPFetcher(30 * time.Second)
+	}
+	if err = r.Reload(); err != nil {
+		return nil, err
+	}
+	if r.interval > 0 || r.ocspRefresh > 0 {
+		go r.run()
+	} else {
+		close(r.done)
+	}
+	return r, nil
+}
+
+// Config returns the TLS configuration for new connections.
+func (r *CertReloader) Config() *tls.Config {
+	r.confLock.RLock()
+	conf := r.conf
+	r.confLock.RUnlock()
+	return conf
+}
+
+// Reload loads the certificate, key, and OCSP response, and replaces the TLS
+// configuration used for new connections. If the OCSP response is fetched
+// from the responder and the request fails, the certificate is served without
+// a response until the next refresh.
+func (r *CertReloader) Reload() error {
+	modTimes, err := r.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if len(r.ocspFile) > 0 {
+		if cert.OCSPStaple, err = ioutil.ReadFile(r.ocspFile); err != nil {
+			return err
+		}
+	} else if r.fetcher != nil {
+		r.confLock.RLock()
+		prev := r.cert
+		r.confLock.RUnlock()
+		if sameLeaf(prev, cert) {
+			cert.OCSPStaple = prev.OCSPStaple
+		} else {
+			cert.OCSPStaple = r.fetchStaple(cert)
+		}
+	}
+	r.setCert(cert, modTimes)
+	return nil
+}
+
+// setCert replaces the TLS configuration with one that serves cert.
+func (r *CertReloader) setCert(cert tls.Certificate, modTimes []time.Time) {
+	// Replace the configuration instead of updating it in place, since
+	// tls.Config is not safe for concurrent modification.
+	conf := newTLSServerConfig(cert)
+	r.confLock.Lock()
+	r.conf = conf
+	r.cert = cert
+	if modTimes != nil {
+		r.modTimes = modTimes
+	}
+	r.confLock.Unlock()
+}
+
+// fetchStaple requests an OCSP response for cert, returning nil if the
+// request fails.
+func (r *CertReloader) fetchStaple(cert tls.Certificate) []byte {
+	staple, err := r.fetcher.Fetch(cert)
+	if err != nil {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("tls", "Error fetching OCSP response", LogFields{
+				"error": err.Error(), "cert": r.certFile})
+		}
+		r.metrics.Increment("tls.ocsp.error")
+		return nil
+	}
+	r.metrics.Increment("tls.ocsp.fetched")
+	return staple
+}
+
+// refreshStaple requests a new OCSP response for the loaded certificate. The
+// previous response is kept if the request fails.
+func (r *CertReloader) refreshStaple() {
+	r.confLock.RLock()
+	cert := r.cert
+	r.confLock.RUnlock()
+	staple := r.fetchStaple(cert)
+	if staple == nil {
+		return
+	}
+	r.confLock.RLock()
+	current := r.cert
+	r.confLock.RUnlock()
+	if !sameLeaf(current, cert) {
+		// The certificate was reloaded during the request.
+		return
+	}
+	cert.OCSPStaple = staple
+	r.setCert(cert, nil)
+}
+
+// sameLeaf indicates whether a and b have the same leaf certificate.
+func sameLeaf(a, b tls.Certificate) bool {
+	return len(a.Certificate) > 0 && len(b.Certificate) > 0 &&
+		bytes.Equal(a.Certificate[0], b.Certificate[0])
+}
+
+// files returns the names of the certificate files.
+func (r *CertReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if len(r.ocspFile) > 0 {
+		files = append(files, r.ocspFile)
+	}
+	return files
+}
+
+// stat returns the modification times of the certificate files.
+func (r *CertReloader) stat() (modTimes []time.Time, err error) {
+	files := r.files()
+	modTimes = make([]time.Time, len(files))
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// changed indicates whether any of the certificate files changed since they
+// were loaded.
+func (r *CertReloader) changed() bool {
+	modTimes, err := r.stat()
+	if err != nil {
+		// Retry if a file is missing while it is being replaced.
+		return false
+	}
+	r.confLock.RLock()
+	defer r.confLock.RUnlock()
+	for i, modTime := range modTimes {
+		if !modTime.Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadChanged reloads the certificate files if they changed.
+func (r *CertReloader) reloadChanged() {
+	if !r.changed() {
+		return
+	}
+	if err := r.Reload(); err != nil {
+		if r.logger.ShouldLog(ERROR) {
+			r.logger.Error("tls", "Error reloading certificate", LogFields{
+				"error": err.Error(), "cert": r.certFile})
+		}
+		r.metrics.Increment("tls.reload.error")
+		return
+	}
+	if r.logger.ShouldLog(INFO) {
+		r.logger.Info("tls", "Reloaded certificate", LogFields{
+			"cert": r.certFile})
+	}
+	r.metrics.Increment("tls.reloaded")
+}
+
+func (r *CertReloader) run() {
+	defer close(r.done)
+	var changes <-chan bool
+	var pollChan, refreshChan <-chan time.Time
+	if r.interval > 0 {
+		watcher, err := newFileWatcher(r.files())
+		if err == nil {
+			defer watcher.Close()
+			changes = watcher.Changes()
+		} else {
+			if err != ErrNoFileWatch && r.logger.ShouldLog(WARNING) {
+				r.logger.Warn("tls", "Error watching certificate files; polling",
+					LogFields{"error": err.Error(), "cert": r.certFile})
+			}
+			poll := clock.NewTicker(r.interval)
+			defer poll.Stop()
+			pollChan = poll.C()
+		}
+	}
+	if r.ocspRefresh > 0 {
+		refresh := clock.NewTicker(r.ocspRefresh)
+		defer refresh.Stop()
+		refreshChan = refresh.C()
+	}
+	for {
+		select {
+		case <-r.closeChan:
+			return
+		case <-changes:
+			r.reloadChanged()
+		case <-pollChan:
+			r.reloadChanged()
+		case <-refreshChan:
+			r.refreshStaple()
+		}
+	}
+}
+
+// Close stops watching the certificate files and refreshing the OCSP
+// response.
+func (r *CertReloader) Close() error {
+	return r.closeOnce.Do(r.close)
+}
+
+func (r *CertReloader) close() error {
+	close(r.closeChan)
+	<-r.done
+	return nil
+}
+
+// reloadListener is a TLS listener that uses the latest certificate from a
+// CertReloader for each accepted connection.
+type reloadListener struct {
+	net.Listener
+	certs *CertReloader
+}
+
+// Accept implements net.Listener.Accept.
+func (l *reloadListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(c, l.certs.Config()), nil
+}
+
+// Close stops the certificate reloader and closes the underlying listener.
+// Implements net.Listener.Close.
+func (l *reloadListener) Close() error {
+	l.certs.Close()
+	return l.Listener.Close()
+}
@@ -0,0 +1,108 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushgo-certs")
+	if err != nil {
+		t.Fatalf("Error creating certificate directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Certificate reloading", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+
+		certFile := filepath.Join(dir, "cert.pem")
+		keyFile := filepath.Join(dir, "key.pem")
+		ocspFile := filepath.Join(dir, "ocsp.der")
+		So(ioutil.WriteFile(certFile, certBytes, 0600), ShouldBeNil)
+		So(ioutil.WriteFile(keyFile, keyBytes, 0600), ShouldBeNil)
+		So(ioutil.WriteFile(ocspFile, []byte("staple1"), 0600), ShouldBeNil)
+
+		r, err := NewCertReloader(app, certFile, keyFile, ocspFile, 0, 0)
+		So(err, ShouldBeNil)
+		defer r.Close()
+		conf := r.Config()
+		So(conf.Certificates, ShouldHaveLength, 1)
+		So(string(conf.Certificates[0].OCSPStaple), ShouldEqual, "staple1")
+		So(r.changed(), ShouldBeFalse)
+
+		Convey("Should reload changed files", func() {
+			So(ioutil.WriteFile(ocspFile, []byte("staple2"), 0600), ShouldBeNil)
+			modTime := time.Now().Add(1 * time.Minute)
+			So(os.Chtimes(ocspFile, modTime, modTime), ShouldBeNil)
+			So(r.changed(), ShouldBeTrue)
+
+			So(r.Reload(), ShouldBeNil)
+			So(r.changed(), ShouldBeFalse)
+			newConf := r.Config()
+			So(newConf, ShouldNotEqual, conf)
+			So(string(newConf.Certificates[0].OCSPStaple), ShouldEqual, "staple2")
+			// The previous configuration should not be modified.
+			So(string(conf.Certificates[0].OCSPStaple), ShouldEqual, "staple1")
+		})
+
+		Convey("Should keep the previous certificate if reloading fails", func() {
+			So(ioutil.WriteFile(keyFile, []byte("invalid"), 0600), ShouldBeNil)
+			So(r.Reload(), ShouldNotBeNil)
+			So(r.Config(), ShouldEqual, conf)
+		})
+
+		Convey("Should record reload metrics", func() {
+			modTime := time.Now().Add(1 * time.Minute)
+			So(os.Chtimes(ocspFile, modTime, modTime), ShouldBeNil)
+			mckStat.EXPECT().Increment("tls.reloaded")
+			r.reloadChanged()
+
+			So(ioutil.WriteFile(keyFile, []byte("invalid"), 0600), ShouldBeNil)
+			modTime = modTime.Add(1 * time.Minute)
+			So(os.Chtimes(keyFile, modTime, modTime), ShouldBeNil)
+			mckStat.EXPECT().Increment("tls.reload.error")
+			r.reloadChanged()
+			So(r.changed(), ShouldBeTrue)
+
+			// Unchanged files should not be reloaded.
+			So(ioutil.WriteFile(keyFile, keyBytes, 0600), ShouldBeNil)
+			So(os.Chtimes(keyFile, r.modTimes[1], r.modTimes[1]), ShouldBeNil)
+			r.reloadChanged()
+		})
+
+		Convey("Should require the issuer to fetch OCSP responses", func() {
+			cert, err := tls.X509KeyPair(certBytes, keyBytes)
+			So(err, ShouldBeNil)
+			_, err = NewOCSPFetcher(1 * time.Second).Fetch(cert)
+			So(err, ShouldEqual, ErrNoOCSPIssuer)
+		})
+
+		Convey("Should reject missing certificates", func() {
+			_, err := NewCertReloader(app, filepath.Join(dir, "missing.pem"),
+				keyFile, "", 0, 0)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
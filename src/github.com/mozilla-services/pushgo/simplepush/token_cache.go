@@ -0,0 +1,158 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"unsafe"
+)
+
+type TokenCacheConfig struct {
+	Enabled bool
+
+	// Size is the maximum number of cached tokens.
+	Size int
+}
+
+// TokenInvalidator is an optional interface implemented by update handlers
+// that cache endpoint tokens. The worker invalidates the tokens for a channel
+// when the client unregisters it.
+type TokenInvalidator interface {
+	InvalidateTokens(uaid, chid string)
+}
+
+// tokenHash is the cache key for an endpoint token. Tokens are hashed so that
+// the cache doesn't hold plaintext tokens, and to bound the key size.
+type tokenHash [sha256.Size]byte
+
+// tokenEntryBytes approximates the size of a cache entry: the entry and its
+// list element, the token and channel index entries, and the IDs.
+const tokenEntryBytes = int64(unsafe.Sizeof(cachedToken{})+
+	unsafe.Sizeof(list.Element{})) + 2*mapEntryBytes + 4*idBytes
+
+// cachedToken is a resolved endpoint token.
+type cachedToken struct {
+	hash tokenHash
+	uaid string
+	chid string
+}
+
+// TokenCache is a bounded LRU cache of resolved endpoint tokens, so that hot
+// channels receiving many updates skip decrypting and parsing the token.
+// Only successfully resolved tokens are cached.
+type TokenCache struct {
+	metrics  Statistician
+	size     int
+	cacheMux sync.Mutex
+	lru      *list.List // Least recently used entries at the back.
+	tokens   map[tokenHash]*list.Element
+	channels map[string][]*list.Element // Entries by UAID and channel ID.
+}
+
+// NewTokenCache creates a token cache from conf.
+func NewTokenCache(app *Application, conf TokenCacheConfig) *TokenCache {
+	size := conf.Size
+	if size < 1 {
+		size = 1
+	}
+	c := &TokenCache{
+		metrics:  app.Metrics(),
+		size:     size,
+		lru:      list.New(),
+		tokens:   make(map[tokenHash]*list.Element),
+		channels: make(map[string][]*list.Element),
+	}
+	app.Memory().Register("token_cache", c)
+	return c
+}
+
+func tokenChannelKey(uaid, chid string) string {
+	return uaid + "." + chid
+}
+
+// Get returns the device and channel IDs for token, if cached.
+func (c *TokenCache) Get(token string) (uaid, chid string, ok bool) {
+	hash := tokenHash(sha256.Sum256([]byte(token)))
+	c.cacheMux.Lock()
+	elem, ok := c.tokens[hash]
+	if ok {
+		c.lru.MoveToFront(elem)
+		entry := elem.Value.(*cachedToken)
+		uaid, chid = entry.uaid, entry.chid
+	}
+	c.cacheMux.Unlock()
+	if ok {
+		c.metrics.Increment("endpoint.token_cache.hit")
+	} else {
+		c.metrics.Increment("endpoint.token_cache.miss")
+	}
+	return
+}
+
+// Put caches the device and channel IDs for token, evicting the least
+// recently used token if the cache is full.
+func (c *TokenCache) Put(token, uaid, chid string) {
+	hash := tokenHash(sha256.Sum256([]byte(token)))
+	c.cacheMux.Lock()
+	defer c.cacheMux.Unlock()
+	if elem, ok := c.tokens[hash]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+	if c.lru.Len() >= c.size {
+		c.remove(c.lru.Back())
+	}
+	elem := c.lru.PushFront(&cachedToken{hash, uaid, chid})
+	c.tokens[hash] = elem
+	key := tokenChannelKey(uaid, chid)
+	c.channels[key] = append(c.channels[key], elem)
+}
+
+// Invalidate removes all cached tokens for a channel.
+func (c *TokenCache) Invalidate(uaid, chid string) {
+	c.cacheMux.Lock()
+	defer c.cacheMux.Unlock()
+	key := tokenChannelKey(uaid, chid)
+	for _, elem := range c.channels[key] {
+		c.lru.Remove(elem)
+		delete(c.tokens, elem.Value.(*cachedToken).hash)
+	}
+	delete(c.channels, key)
+}
+
+// Len returns the number of cached tokens.
+func (c *TokenCache) Len() int {
+	c.cacheMux.Lock()
+	defer c.cacheMux.Unlock()
+	return c.lru.Len()
+}
+
+// MemoryUsage returns the approximate bytes held by cached tokens.
+// Implements MemorySizer.
+func (c *TokenCache) MemoryUsage() int64 {
+	return int64(c.Len()) * tokenEntryBytes
+}
+
+// remove evicts a cache entry. The caller must hold the cache lock.
+func (c *TokenCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cachedToken)
+	delete(c.tokens, entry.hash)
+	key := tokenChannelKey(entry.uaid, entry.chid)
+	elems := c.channels[key]
+	for i, e := range elems {
+		if e == elem {
+			elems = append(elems[:i], elems[i+1:]...)
+			break
+		}
+	}
+	if len(elems) == 0 {
+		delete(c.channels, key)
+	} else {
+		c.channels[key] = elems
+	}
+	c.metrics.Increment("endpoint.token_cache.evict")
+}
@@ -0,0 +1,70 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTokenCache(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Endpoint token cache", t, func() {
+		app := NewApplication()
+		app.SetMetrics(mckStat)
+		c := NewTokenCache(app, TokenCacheConfig{Enabled: true, Size: 2})
+
+		Convey("Should return cached tokens", func() {
+			mckStat.EXPECT().Increment("endpoint.token_cache.miss")
+			_, _, ok := c.Get("token1")
+			So(ok, ShouldBeFalse)
+
+			c.Put("token1", "uaid1", "chid1")
+			mckStat.EXPECT().Increment("endpoint.token_cache.hit")
+			uaid, chid, ok := c.Get("token1")
+			So(ok, ShouldBeTrue)
+			So(uaid, ShouldEqual, "uaid1")
+			So(chid, ShouldEqual, "chid1")
+		})
+
+		Convey("Should evict the least recently used token", func() {
+			c.Put("token1", "uaid1", "chid1")
+			c.Put("token2", "uaid1", "chid2")
+			mckStat.EXPECT().Increment("endpoint.token_cache.hit")
+			c.Get("token1")
+
+			mckStat.EXPECT().Increment("endpoint.token_cache.evict")
+			c.Put("token3", "uaid2", "chid3")
+			So(c.Len(), ShouldEqual, 2)
+
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("endpoint.token_cache.miss"),
+				mckStat.EXPECT().Increment("endpoint.token_cache.hit"),
+			)
+			_, _, ok := c.Get("token2")
+			So(ok, ShouldBeFalse)
+			_, _, ok = c.Get("token1")
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Should invalidate tokens for unregistered channels", func() {
+			c.Put("token1", "uaid1", "chid1")
+			c.Put("token2", "uaid1", "chid1")
+			c.Invalidate("uaid1", "chid1")
+			So(c.Len(), ShouldEqual, 0)
+			So(c.channels, ShouldBeEmpty)
+
+			mckStat.EXPECT().Increment("endpoint.token_cache.miss")
+			_, _, ok := c.Get("token1")
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
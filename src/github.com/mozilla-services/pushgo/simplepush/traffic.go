@@ -0,0 +1,216 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TrafficConfig struct {
+	Enabled bool
+
+	// SampleRate is the fraction of client connections recorded, between 0
+	// and 1.
+	SampleRate float64 `toml:"sample_rate" env:"sample_rate"`
+
+	// Path is the file to which recorded sessions are appended, one JSON
+	// object per line.
+	Path string
+
+	// MaxEvents is the maximum number of events recorded per session. Later
+	// events are dropped.
+	MaxEvents int `toml:"max_events" env:"max_events"`
+}
+
+// TrafficEvent is a recorded client command or server update. Events are
+// anonymized: device and channel IDs are replaced with per-session channel
+// indexes, and update data is not recorded.
+type TrafficEvent struct {
+	Offset  int64  `json:"t"`                 // Milliseconds since connect.
+	Type    string `json:"type"`              // Command name, or "update".
+	Channel int    `json:"channel,omitempty"` // 1-based channel index.
+	Count   int    `json:"count,omitempty"`   // Channels in hello; updates in ack.
+}
+
+// TrafficSession records the events for a sampled client connection. A nil
+// TrafficSession records nothing.
+type TrafficSession struct {
+	recorder  *TrafficRecorder
+	start     time.Time
+	eventsMux sync.Mutex
+	events    []TrafficEvent
+	channels  map[string]int // Channel indexes, by channel ID.
+	closeOnce Once
+}
+
+// trafficCommand is the subset of client commands used to anonymize events.
+type trafficCommand struct {
+	ChannelID  string        `json:"channelID"`
+	ChannelIDs []string      `json:"channelIDs"`
+	Updates    []interface{} `json:"updates"`
+}
+
+// Command records a client command. The message is only parsed for channel
+// IDs and counts.
+func (s *TrafficSession) Command(cmd string, message []byte) {
+	if s == nil {
+		return
+	}
+	cmd = strings.ToLower(cmd)
+	event := TrafficEvent{Type: cmd}
+	if cmd != "ping" {
+		command := new(trafficCommand)
+		json.Unmarshal(message, command)
+		switch cmd {
+		case "hello":
+			event.Count = len(command.ChannelIDs)
+		case "ack":
+			event.Count = len(command.Updates)
+		case "register", "unregister":
+			event.Channel = s.channel(command.ChannelID)
+		}
+	}
+	s.record(event)
+}
+
+// Update records an update sent to the client on chid.
+func (s *TrafficSession) Update(chid string) {
+	if s == nil {
+		return
+	}
+	s.record(TrafficEvent{Type: "update", Channel: s.channel(chid)})
+}
+
+// channel returns the index for chid, assigning the next index to new
+// channels.
+func (s *TrafficSession) channel(chid string) int {
+	if len(chid) == 0 {
+		return 0
+	}
+	s.eventsMux.Lock()
+	defer s.eventsMux.Unlock()
+	index, ok := s.channels[chid]
+	if !ok {
+		index = len(s.channels) + 1
+		s.channels[chid] = index
+	}
+	return index
+}
+
+func (s *TrafficSession) record(event TrafficEvent) {
+	event.Offset = int64(timeNow().Sub(s.start) / time.Millisecond)
+	s.eventsMux.Lock()
+	if len(s.events) < s.recorder.maxEvents {
+		s.events = append(s.events, event)
+	}
+	s.eventsMux.Unlock()
+}
+
+// Close writes the session to the recorder.
+func (s *TrafficSession) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.closeOnce.Do(s.close)
+}
+
+func (s *TrafficSession) close() error {
+	s.eventsMux.Lock()
+	events := s.events
+	s.eventsMux.Unlock()
+	return s.recorder.write(&TrafficRecord{
+		Duration: int64(timeNow().Sub(s.start) / time.Millisecond),
+		Events:   events,
+	})
+}
+
+// TrafficRecord is a recorded session, as written by the recorder and read
+// by the replayer.
+type TrafficRecord struct {
+	Duration int64          `json:"duration"` // Milliseconds.
+	Events   []TrafficEvent `json:"events"`
+}
+
+// TrafficRecorder samples client connections, and writes their anonymized
+// command sequences and timings for replay by the load tool.
+type TrafficRecorder struct {
+	logger     *SimpleLogger
+	metrics    Statistician
+	sampleRate float64
+	maxEvents  int
+	sample     func() float64
+	writerMux  sync.Mutex
+	writer     io.Writer
+	encoder    *json.Encoder
+}
+
+// NewTrafficRecorder creates a recorder that appends sessions to the file
+// named in conf.
+func NewTrafficRecorder(app *Application, conf TrafficConfig) (
+	*TrafficRecorder, error) {
+
+	file, err := os.OpenFile(conf.Path,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return newTrafficRecorder(app, conf, file), nil
+}
+
+func newTrafficRecorder(app *Application, conf TrafficConfig,
+	writer io.Writer) *TrafficRecorder {
+
+	return &TrafficRecorder{
+		logger:     app.Logger(),
+		metrics:    app.Metrics(),
+		sampleRate: conf.SampleRate,
+		maxEvents:  conf.MaxEvents,
+		sample:     rand.Float64,
+		writer:     writer,
+		encoder:    json.NewEncoder(writer),
+	}
+}
+
+// Sample returns a session for a new connection, or nil if the connection
+// is not sampled.
+func (r *TrafficRecorder) Sample() *TrafficSession {
+	if r == nil || r.sample() >= r.sampleRate {
+		return nil
+	}
+	return &TrafficSession{
+		recorder: r,
+		start:    timeNow(),
+		channels: make(map[string]int),
+	}
+}
+
+func (r *TrafficRecorder) write(record *TrafficRecord) (err error) {
+	r.writerMux.Lock()
+	err = r.encoder.Encode(record)
+	r.writerMux.Unlock()
+	if err != nil {
+		if r.logger.ShouldLog(WARNING) {
+			r.logger.Warn("traffic", "Could not write traffic record",
+				LogFields{"error": err.Error()})
+		}
+		return err
+	}
+	r.metrics.Increment("client.traffic.recorded")
+	return nil
+}
+
+// Close closes the underlying writer, if it implements io.Closer.
+func (r *TrafficRecorder) Close() error {
+	if c, ok := r.writer.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTrafficRecorder(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+
+	defer saveTimeFuncs()()
+	var now time.Time
+	timeNow = func() time.Time { return now }
+
+	Convey("Traffic recording", t, func() {
+		now = time.Unix(1257894000, 0).UTC()
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+
+		conf := TrafficConfig{
+			Enabled:    true,
+			SampleRate: 0.5,
+			MaxEvents:  4,
+		}
+		buf := new(bytes.Buffer)
+		r := newTrafficRecorder(app, conf, buf)
+
+		Convey("Should only sample a fraction of connections", func() {
+			r.sample = func() float64 { return 0.5 }
+			So(r.Sample(), ShouldBeNil)
+			r.sample = func() float64 { return 0.2 }
+			So(r.Sample(), ShouldNotBeNil)
+		})
+
+		Convey("Should record anonymized commands and timings", func() {
+			r.sample = func() float64 { return 0 }
+			s := r.Sample()
+			So(s, ShouldNotBeNil)
+
+			s.Command("hello", []byte(`{"messageType":"hello","uaid":"abc","channelIDs":["a","b"]}`))
+			now = now.Add(1500 * time.Millisecond)
+			s.Command("register", []byte(`{"messageType":"register","channelID":"c"}`))
+			now = now.Add(2 * time.Second)
+			s.Update("c")
+			s.Command("ack", []byte(`{"messageType":"ack","updates":[{"channelID":"c","version":1}]}`))
+			s.Command("ping", []byte(`{}`))
+			now = now.Add(1 * time.Second)
+
+			mckStat.EXPECT().Increment("client.traffic.recorded")
+			So(s.Close(), ShouldBeNil)
+			So(s.Close(), ShouldBeNil)
+
+			record := new(TrafficRecord)
+			So(json.Unmarshal(buf.Bytes(), record), ShouldBeNil)
+			So(record.Duration, ShouldEqual, 4500)
+			So(record.Events, ShouldResemble, []TrafficEvent{
+				{Offset: 0, Type: "hello", Count: 2},
+				{Offset: 1500, Type: "register", Channel: 1},
+				{Offset: 3500, Type: "update", Channel: 1},
+				{Offset: 3500, Type: "ack", Count: 1},
+			})
+			So(bytes.Contains(buf.Bytes(), []byte("abc")), ShouldBeFalse)
+		})
+
+		Convey("Should ignore unsampled connections", func() {
+			var s *TrafficSession
+			s.Command("hello", []byte(`{}`))
+			s.Update("c")
+			So(s.Close(), ShouldBeNil)
+			So(buf.Len(), ShouldEqual, 0)
+		})
+	})
+}
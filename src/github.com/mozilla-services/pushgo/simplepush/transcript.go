@@ -0,0 +1,213 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrTooManyTranscripts = errors.New("Too many flagged devices")
+
+type TranscriptConfig struct {
+	Enabled bool
+
+	// Size is the number of frames kept for each flagged device. Once the
+	// transcript is full, the oldest frames are discarded.
+	Size int
+
+	// MaxFlagged is the maximum number of devices that can be flagged at
+	// once.
+	MaxFlagged int `toml:"max_flagged" env:"max_flagged"`
+
+	// Scrub lists the message fields whose values are replaced before the
+	// frame is recorded. The defaults cover endpoint tokens, proprietary ping
+	// registrations, and update data.
+	Scrub []string
+}
+
+const (
+	TranscriptIn  = "in"  // Client to server.
+	TranscriptOut = "out" // Server to client.
+)
+
+// scrubbedValue replaces the values of scrubbed fields.
+const scrubbedValue = "[scrubbed]"
+
+// TranscriptFrame is a recorded WebSocket frame.
+type TranscriptFrame struct {
+	Time      int64           `json:"time"`          // Milliseconds since Epoch.
+	Direction string          `json:"dir"`           // "in" or "out".
+	RequestID string          `json:"rid,omitempty"` // The connection's request ID.
+	Data      json.RawMessage `json:"data"`
+}
+
+// Transcript keeps the most recent frames exchanged with a flagged device,
+// across connections. A nil Transcript records nothing.
+type Transcript struct {
+	recorder  *TranscriptRecorder
+	framesMux sync.Mutex
+	frames    []TranscriptFrame
+	next      int // Index of the oldest frame, once the transcript is full.
+}
+
+// Record adds a frame to the transcript, scrubbing secrets. frame is copied.
+func (t *Transcript) Record(requestID, dir string, frame []byte) {
+	if t == nil {
+		return
+	}
+	data := t.recorder.scrub(frame)
+	f := TranscriptFrame{
+		Time:      timeNow().UnixNano() / int64(time.Millisecond),
+		Direction: dir,
+		RequestID: requestID,
+		Data:      data,
+	}
+	t.framesMux.Lock()
+	if len(t.frames) < t.recorder.size {
+		t.frames = append(t.frames, f)
+	} else {
+		t.frames[t.next] = f
+		t.next = (t.next + 1) % len(t.frames)
+	}
+	t.framesMux.Unlock()
+}
+
+// Frames returns the recorded frames, oldest first.
+func (t *Transcript) Frames() []TranscriptFrame {
+	t.framesMux.Lock()
+	defer t.framesMux.Unlock()
+	frames := make([]TranscriptFrame, 0, len(t.frames))
+	frames = append(frames, t.frames[t.next:]...)
+	return append(frames, t.frames[:t.next]...)
+}
+
+// TranscriptRecorder records transcripts for devices flagged through the
+// admin API, to debug misbehaving clients. Recording starts with the next
+// frame exchanged with the device; earlier frames are not kept.
+type TranscriptRecorder struct {
+	metrics        Statistician
+	size           int
+	maxFlagged     int
+	scrubFields    map[string]bool
+	transcriptsMux sync.RWMutex
+	transcripts    map[string]*Transcript // By device ID.
+}
+
+// NewTranscriptRecorder creates a transcript recorder from conf.
+func NewTranscriptRecorder(app *Application,
+	conf TranscriptConfig) *TranscriptRecorder {
+
+	r := &TranscriptRecorder{
+		metrics:     app.Metrics(),
+		size:        conf.Size,
+		maxFlagged:  conf.MaxFlagged,
+		scrubFields: make(map[string]bool, len(conf.Scrub)),
+		transcripts: make(map[string]*Transcript),
+	}
+	if r.size < 1 {
+		r.size = 1
+	}
+	for _, field := range conf.Scrub {
+		r.scrubFields[field] = true
+	}
+	return r
+}
+
+// Flag starts recording frames for uaid. Flagging an already-flagged device
+// keeps its transcript.
+func (r *TranscriptRecorder) Flag(uaid string) error {
+	r.transcriptsMux.Lock()
+	defer r.transcriptsMux.Unlock()
+	if _, ok := r.transcripts[uaid]; ok {
+		return nil
+	}
+	if len(r.transcripts) >= r.maxFlagged {
+		return ErrTooManyTranscripts
+	}
+	r.transcripts[uaid] = &Transcript{recorder: r}
+	r.metrics.Gauge("client.transcript.flagged", int64(len(r.transcripts)))
+	return nil
+}
+
+// Unflag stops recording frames for uaid, and discards its transcript.
+// Returns false if the device was not flagged.
+func (r *TranscriptRecorder) Unflag(uaid string) bool {
+	r.transcriptsMux.Lock()
+	defer r.transcriptsMux.Unlock()
+	if _, ok := r.transcripts[uaid]; !ok {
+		return false
+	}
+	delete(r.transcripts, uaid)
+	r.metrics.Gauge("client.transcript.flagged", int64(len(r.transcripts)))
+	return true
+}
+
+// Flagged returns the flagged device IDs, sorted.
+func (r *TranscriptRecorder) Flagged() []string {
+	r.transcriptsMux.RLock()
+	uaids := make([]string, 0, len(r.transcripts))
+	for uaid := range r.transcripts {
+		uaids = append(uaids, uaid)
+	}
+	r.transcriptsMux.RUnlock()
+	sort.Strings(uaids)
+	return uaids
+}
+
+// Transcript returns the transcript for uaid, or nil if the device is not
+// flagged.
+func (r *TranscriptRecorder) Transcript(uaid string) *Transcript {
+	if r == nil || len(uaid) == 0 {
+		return nil
+	}
+	r.transcriptsMux.RLock()
+	t := r.transcripts[uaid]
+	r.transcriptsMux.RUnlock()
+	return t
+}
+
+// scrub returns a copy of frame with the values of scrubbed fields replaced.
+// Frames that are not valid JSON are recorded as strings.
+func (r *TranscriptRecorder) scrub(frame []byte) json.RawMessage {
+	var v interface{}
+	if err := json.Unmarshal(frame, &v); err != nil {
+		data, _ := json.Marshal(string(frame))
+		return data
+	}
+	data, err := json.Marshal(r.scrubValue(v))
+	if err != nil {
+		data, _ = json.Marshal(string(frame))
+	}
+	return data
+}
+
+func (r *TranscriptRecorder) scrubValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if r.scrubFields[key] {
+				v[key] = scrubbedValue
+				continue
+			}
+			v[key] = r.scrubValue(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = r.scrubValue(value)
+		}
+	}
+	return v
+}
+
+// TranscriptHandler is an optional interface implemented by handlers that
+// record client transcripts. Transcripts returns nil if recording is
+// disabled.
+type TranscriptHandler interface {
+	Transcripts() *TranscriptRecorder
+}
@@ -0,0 +1,80 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTranscripts(t *testing.T) {
+	defer saveTimeFuncs()()
+	timeNow = func() time.Time { return time.Unix(1000, 0) }
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+
+	Convey("Client transcripts", t, func() {
+		app := NewApplication()
+		app.SetMetrics(mckStat)
+		r := NewTranscriptRecorder(app, TranscriptConfig{
+			Enabled:    true,
+			Size:       2,
+			MaxFlagged: 1,
+			Scrub:      []string{"pushEndpoint", "data"},
+		})
+
+		Convey("Should only record flagged devices", func() {
+			So(r.Transcript("uaid1"), ShouldBeNil)
+			mckStat.EXPECT().Gauge("client.transcript.flagged", int64(1))
+			So(r.Flag("uaid1"), ShouldBeNil)
+			So(r.Flag("uaid1"), ShouldBeNil)
+			So(r.Flag("uaid2"), ShouldEqual, ErrTooManyTranscripts)
+			So(r.Flagged(), ShouldResemble, []string{"uaid1"})
+			So(r.Transcript("uaid1"), ShouldNotBeNil)
+
+			mckStat.EXPECT().Gauge("client.transcript.flagged", int64(0))
+			So(r.Unflag("uaid1"), ShouldBeTrue)
+			So(r.Unflag("uaid1"), ShouldBeFalse)
+			So(r.Transcript("uaid1"), ShouldBeNil)
+		})
+
+		Convey("Should keep the most recent frames", func() {
+			mckStat.EXPECT().Gauge("client.transcript.flagged", int64(1))
+			r.Flag("uaid1")
+			transcript := r.Transcript("uaid1")
+			transcript.Record("rid", TranscriptIn, []byte(`{"messageType":"hello"}`))
+			transcript.Record("rid", TranscriptOut, []byte(`{"messageType":"hello","status":200}`))
+			transcript.Record("rid", TranscriptIn, []byte(`{}`))
+			frames := transcript.Frames()
+			So(frames, ShouldHaveLength, 2)
+			So(frames[0].Direction, ShouldEqual, TranscriptOut)
+			So(string(frames[0].Data), ShouldEqual, `{"messageType":"hello","status":200}`)
+			So(frames[1].Direction, ShouldEqual, TranscriptIn)
+			So(frames[1].Time, ShouldEqual, 1000000)
+		})
+
+		Convey("Should scrub secrets", func() {
+			data := r.scrub([]byte(`{"messageType":"register","pushEndpoint":"https://example.com/update/abc",` +
+				`"updates":[{"channelID":"chid1","version":1,"data":"secret"}]}`))
+			So(string(data), ShouldEqual, `{"messageType":"register","pushEndpoint":"[scrubbed]",`+
+				`"updates":[{"channelID":"chid1","data":"[scrubbed]","version":1}]}`)
+			So(string(r.scrub([]byte("not json"))), ShouldEqual, `"not json"`)
+		})
+
+		Convey("Should record nothing if disabled", func() {
+			var r *TranscriptRecorder
+			transcript := r.Transcript("uaid1")
+			So(transcript, ShouldBeNil)
+			So(func() { transcript.Record("rid", TranscriptIn, []byte("{}")) },
+				ShouldNotPanic)
+		})
+	})
+}
@@ -0,0 +1,220 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+type UpdateQueueConfig struct {
+	Enabled bool
+
+	// Size is the maximum number of queued updates. Updates received while
+	// the queue is full are rejected with a 503.
+	Size int
+
+	// Workers is the number of goroutines storing and routing queued
+	// updates.
+	Workers int
+
+	// AsyncReply replies with a 202 as soon as an update is queued, instead
+	// of waiting for it to be stored and routed.
+	AsyncReply bool `toml:"async_reply" env:"async_reply"`
+}
+
+// updateReply captures the response for a queued update.
+type updateReply struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *updateReply) Header() http.Header {
+	if r.header == nil {
+		r.header = make(http.Header)
+	}
+	return r.header
+}
+
+func (r *updateReply) WriteHeader(status int) { r.status = status }
+
+func (r *updateReply) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(p)
+}
+
+// copyTo writes the captured response to resp.
+func (r *updateReply) copyTo(resp http.ResponseWriter) {
+	for name, values := range r.header {
+		resp.Header()[name] = values
+	}
+	resp.WriteHeader(r.status)
+	resp.Write(r.body.Bytes())
+}
+
+// updateJob is an incoming update waiting to be stored and routed.
+type updateJob struct {
+	requestID  string
+	uaid       string
+	chid       string
+	version    int64
+	data       string
+	lowUrgency bool
+	expiresAt  time.Time
+	cn         http.CloseNotifier // Cancels routing; nil for async replies.
+	deadline   *Deadline          // Bounds store writes and routing; may be nil.
+	reply      updateReply
+	sent       bool
+	queuedAt   time.Time
+	done       chan bool
+}
+
+// size returns the approximate bytes held by a queued update.
+func (job *updateJob) size() int64 {
+	return int64(unsafe.Sizeof(*job)) + int64(len(job.requestID)+
+		len(job.uaid)+len(job.chid)+len(job.data))
+}
+
+// UpdateQueue decouples endpoint requests from store writes and routing with
+// a bounded queue and a fixed pool of workers, so that store latency spikes
+// don't tie up connections or grow memory without bound.
+type UpdateQueue struct {
+	metrics   Statistician
+	jobs      chan *updateJob
+	workers   int
+	process   func(*updateJob)
+	wg        sync.WaitGroup
+	closeChan chan bool
+	closeOnce Once
+	closeMux  sync.RWMutex // Held while queueing, so that Close drains every job.
+	statsMux  sync.Mutex
+	avgTime   time.Duration // Moving average of the time to process an update.
+	bytes     int64         // Approximate bytes held by queued updates.
+}
+
+// NewUpdateQueue creates an update queue that processes jobs with process.
+func NewUpdateQueue(app *Application, conf UpdateQueueConfig,
+	process func(*updateJob)) *UpdateQueue {
+
+	workers := conf.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	q := &UpdateQueue{
+		metrics:   app.Metrics(),
+		jobs:      make(chan *updateJob, conf.Size),
+		workers:   workers,
+		process:   process,
+		closeChan: make(chan bool),
+	}
+	app.Memory().Register("update_queue", q)
+	return q
+}
+
+// Start starts the workers.
+func (q *UpdateQueue) Start() {
+	q.wg.Add(q.workers)
+	for i := 0; i < q.workers; i++ {
+		go q.run()
+	}
+}
+
+func (q *UpdateQueue) run() {
+	defer q.wg.Done()
+	for {
+		select {
+		case job := <-q.jobs:
+			q.do(job)
+		case <-q.closeChan:
+			// Finish queued updates before exiting.
+			for {
+				select {
+				case job := <-q.jobs:
+					q.do(job)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *UpdateQueue) do(job *updateJob) {
+	startTime := timeNow()
+	q.metrics.Timer("endpoint.queue.wait", startTime.Sub(job.queuedAt))
+	q.process(job)
+	elapsed := timeNow().Sub(startTime)
+	q.statsMux.Lock()
+	q.avgTime += (elapsed - q.avgTime) / 8
+	q.bytes -= job.size()
+	q.statsMux.Unlock()
+	if job.done != nil {
+		close(job.done)
+	}
+}
+
+// Put queues an update. Returns false if the queue is full or closed. Queued
+// updates are processed even if the queue is closed before they are dequeued.
+func (q *UpdateQueue) Put(job *updateJob) bool {
+	q.closeMux.RLock()
+	defer q.closeMux.RUnlock()
+	select {
+	case <-q.closeChan:
+		return false
+	default:
+	}
+	job.queuedAt = timeNow()
+	size := job.size()
+	q.statsMux.Lock()
+	q.bytes += size
+	q.statsMux.Unlock()
+	select {
+	case q.jobs <- job:
+		q.metrics.Gauge("endpoint.queue.depth", int64(len(q.jobs)))
+		return true
+	default:
+		q.statsMux.Lock()
+		q.bytes -= size
+		q.statsMux.Unlock()
+		q.metrics.Increment("endpoint.queue.full")
+		return false
+	}
+}
+
+// RecoveryEstimate returns the estimated time to drain the queue, based on
+// the average time to process an update.
+func (q *UpdateQueue) RecoveryEstimate() time.Duration {
+	q.statsMux.Lock()
+	avgTime := q.avgTime
+	q.statsMux.Unlock()
+	return avgTime * time.Duration(len(q.jobs)) / time.Duration(q.workers)
+}
+
+// MemoryUsage returns the approximate bytes held by queued updates.
+// Implements MemorySizer.
+func (q *UpdateQueue) MemoryUsage() int64 {
+	q.statsMux.Lock()
+	defer q.statsMux.Unlock()
+	return q.bytes
+}
+
+// Close stops accepting updates, and waits for queued updates to finish.
+func (q *UpdateQueue) Close() error {
+	return q.closeOnce.Do(q.close)
+}
+
+func (q *UpdateQueue) close() error {
+	q.closeMux.Lock()
+	close(q.closeChan)
+	q.closeMux.Unlock()
+	q.wg.Wait()
+	return nil
+}
@@ -0,0 +1,80 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUpdateQueue(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStat.EXPECT().Timer("endpoint.queue.wait", gomock.Any()).AnyTimes()
+	mckStat.EXPECT().Gauge("endpoint.queue.depth", gomock.Any()).AnyTimes()
+
+	Convey("Endpoint update queue", t, func() {
+		app := NewApplication()
+		app.SetMetrics(mckStat)
+
+		var processed []string
+		q := NewUpdateQueue(app, UpdateQueueConfig{
+			Enabled: true,
+			Size:    2,
+			Workers: 1,
+		}, func(job *updateJob) {
+			processed = append(processed, job.chid)
+			job.reply.WriteHeader(200)
+		})
+
+		Convey("Should reject updates if the queue is full", func() {
+			So(q.Put(&updateJob{chid: "chid1"}), ShouldBeTrue)
+			So(q.Put(&updateJob{chid: "chid2"}), ShouldBeTrue)
+			mckStat.EXPECT().Increment("endpoint.queue.full")
+			So(q.Put(&updateJob{chid: "chid3"}), ShouldBeFalse)
+			q.Start()
+			q.Close()
+			So(processed, ShouldResemble, []string{"chid1", "chid2"})
+		})
+
+		Convey("Should process queued updates", func() {
+			q.Start()
+			job := &updateJob{chid: "chid1", done: make(chan bool)}
+			So(q.Put(job), ShouldBeTrue)
+			<-job.done
+			So(job.reply.status, ShouldEqual, 200)
+			q.Close()
+			So(processed, ShouldResemble, []string{"chid1"})
+		})
+
+		Convey("Should drain queued updates on close", func() {
+			job := &updateJob{chid: "chid1", done: make(chan bool)}
+			So(q.Put(job), ShouldBeTrue)
+			q.Start()
+			q.Close()
+			So(processed, ShouldResemble, []string{"chid1"})
+			<-job.done
+			So(job.reply.status, ShouldEqual, 200)
+			So(q.Put(&updateJob{chid: "chid2"}), ShouldBeFalse)
+		})
+	})
+
+	Convey("Captured update replies", t, func() {
+		reply := new(updateReply)
+		reply.Header().Set("Content-Type", "application/json")
+		reply.Write([]byte(`"Update queued"`))
+
+		resp := httptest.NewRecorder()
+		reply.copyTo(resp)
+		So(resp.Code, ShouldEqual, 200)
+		So(resp.HeaderMap.Get("Content-Type"), ShouldEqual, "application/json")
+		So(resp.Body.String(), ShouldEqual, `"Update queued"`)
+	})
+}
@@ -0,0 +1,93 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrInvalidResolution = errors.New("Invalid version resolution")
+
+// versionResolutions maps version resolution names to units.
+var versionResolutions = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+type VersionConfig struct {
+	// Resolution is the unit of versions generated for updates that do not
+	// specify one: "s", "ms", "us", or "ns". Clients compare versions as
+	// integers, so changing the resolution of an existing deployment
+	// increases all subsequent versions.
+	Resolution string
+
+	// Monotonic generates strictly increasing versions, even if several
+	// updates arrive within the same tick or the system clock moves backward.
+	// Versions are only monotonic per server.
+	Monotonic bool
+}
+
+// VersionSource generates versions for updates sent without one. A nil
+// VersionSource returns the current time in seconds.
+type VersionSource struct {
+	unit      time.Duration
+	monotonic bool
+	lastMux   sync.Mutex
+	last      int64
+}
+
+// NewVersionSource creates a version source from conf.
+func NewVersionSource(conf VersionConfig) (*VersionSource, error) {
+	resolution := conf.Resolution
+	if len(resolution) == 0 {
+		resolution = "s"
+	}
+	unit, ok := versionResolutions[resolution]
+	if !ok {
+		return nil, ErrInvalidResolution
+	}
+	return &VersionSource{unit: unit, monotonic: conf.Monotonic}, nil
+}
+
+// Next returns a version for an update.
+func (s *VersionSource) Next() int64 {
+	if s == nil {
+		return timeNow().UTC().Unix()
+	}
+	version := timeNow().UnixNano() / int64(s.unit)
+	if !s.monotonic {
+		return version
+	}
+	s.lastMux.Lock()
+	defer s.lastMux.Unlock()
+	if version <= s.last {
+		version = s.last + 1
+	}
+	s.last = version
+	return version
+}
+
+// ParseVersion parses a decimal update version sent by an app server.
+// Versions are non-negative 64-bit integers; returns ErrVersionOverflow for
+// versions that do not fit, and ErrBadVersion for other invalid versions.
+func ParseVersion(s string) (int64, error) {
+	version, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		if numErr, ok := err.(*strconv.NumError); ok &&
+			numErr.Err == strconv.ErrRange {
+			return 0, ErrVersionOverflow
+		}
+		return 0, ErrBadVersion
+	}
+	if version < 0 {
+		return 0, ErrBadVersion
+	}
+	return version, nil
+}
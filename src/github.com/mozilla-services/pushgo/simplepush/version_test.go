@@ -0,0 +1,78 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVersionSource(t *testing.T) {
+	Convey("Generated update versions", t, func() {
+		defer saveTimeFuncs()()
+		now := time.Unix(1257894000, 123456789).UTC()
+		timeNow = func() time.Time { return now }
+
+		Convey("Should default to seconds", func() {
+			var s *VersionSource
+			So(s.Next(), ShouldEqual, 1257894000)
+			s, err := NewVersionSource(VersionConfig{})
+			So(err, ShouldBeNil)
+			So(s.Next(), ShouldEqual, 1257894000)
+		})
+
+		Convey("Should support sub-second resolutions", func() {
+			s, err := NewVersionSource(VersionConfig{Resolution: "ms"})
+			So(err, ShouldBeNil)
+			So(s.Next(), ShouldEqual, 1257894000123)
+			s, err = NewVersionSource(VersionConfig{Resolution: "ns"})
+			So(err, ShouldBeNil)
+			So(s.Next(), ShouldEqual, 1257894000123456789)
+		})
+
+		Convey("Should reject unknown resolutions", func() {
+			_, err := NewVersionSource(VersionConfig{Resolution: "fortnight"})
+			So(err, ShouldEqual, ErrInvalidResolution)
+		})
+
+		Convey("Should increase monotonically if enabled", func() {
+			s, err := NewVersionSource(VersionConfig{Monotonic: true})
+			So(err, ShouldBeNil)
+			So(s.Next(), ShouldEqual, 1257894000)
+			So(s.Next(), ShouldEqual, 1257894001)
+			// The clock moved backward.
+			now = now.Add(-1 * time.Hour)
+			So(s.Next(), ShouldEqual, 1257894002)
+			now = now.Add(2 * time.Hour)
+			So(s.Next(), ShouldEqual, 1257897600)
+		})
+
+		Convey("Should repeat versions if not monotonic", func() {
+			s, err := NewVersionSource(VersionConfig{})
+			So(err, ShouldBeNil)
+			So(s.Next(), ShouldEqual, s.Next())
+		})
+	})
+}
+
+func TestParseVersion(t *testing.T) {
+	Convey("Should parse 64-bit versions", t, func() {
+		version, err := ParseVersion("9223372036854775807")
+		So(err, ShouldBeNil)
+		So(version, ShouldEqual, int64(9223372036854775807))
+	})
+	Convey("Should reject versions that overflow", t, func() {
+		_, err := ParseVersion("9223372036854775808")
+		So(err, ShouldEqual, ErrVersionOverflow)
+	})
+	Convey("Should reject negative and malformed versions", t, func() {
+		_, err := ParseVersion("-1")
+		So(err, ShouldEqual, ErrBadVersion)
+		_, err = ParseVersion("1.5")
+		So(err, ShouldEqual, ErrBadVersion)
+	})
+}
@@ -0,0 +1,258 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bbangert/toml"
+)
+
+// VirtualServerConfig specifies a logical push service sharing this server's
+// listeners, storage, and cluster membership. Virtual servers are configured
+// in [virtual.<name>] sections.
+type VirtualServerConfig struct {
+	// Host is the domain name that clients and app servers use to reach the
+	// virtual server. Requests are matched by their Host header.
+	Host string
+
+	// TokenKey encrypts the virtual server's endpoint tokens. Endpoints
+	// issued by one virtual server are rejected by the others. Required.
+	TokenKey string `toml:"token_key"`
+
+	// PushEndpoint is the endpoint URL template. Defaults to the server's
+	// push_endpoint_template.
+	PushEndpoint string `toml:"push_endpoint_template"`
+
+	// MetricsPrefix is prepended to the names of the virtual server's
+	// client and update metrics. Defaults to the virtual server name.
+	MetricsPrefix string `toml:"metrics_prefix"`
+}
+
+// TenantStore is an optional interface implemented by stores that record
+// the virtual server of each device, so that a device ID registered through
+// one virtual server can't be used to read or replace another tenant's
+// device.
+type TenantStore interface {
+	// FetchTenant returns the device's tenant name, or an empty string if
+	// the device is untagged.
+	FetchTenant(suaid string) (tenant string, err error)
+
+	// PutTenant tags the device with tenant.
+	PutTenant(suaid, tenant string) error
+}
+
+// VirtualServer is a logical push service with its own endpoint domain,
+// token key, and metrics prefix.
+type VirtualServer struct {
+	app              *Application
+	name             string
+	host             string
+	tokenKey         []byte
+	endpointTemplate *template.Template
+	metrics          Statistician // Prefixed metrics only.
+	clientMetrics    Statistician // Server and prefixed metrics.
+}
+
+// NewVirtualServer creates a virtual server from conf.
+func NewVirtualServer(app *Application, name string,
+	conf VirtualServerConfig) (vs *VirtualServer, err error) {
+
+	if len(conf.Host) == 0 {
+		return nil, fmt.Errorf("Missing host for virtual server '%s'", name)
+	}
+	if len(conf.TokenKey) == 0 {
+		return nil, fmt.Errorf("Missing token key for virtual server '%s'", name)
+	}
+	vs = &VirtualServer{
+		app:              app,
+		name:             name,
+		host:             strings.ToLower(conf.Host),
+		endpointTemplate: app.endpointTemplate,
+	}
+	if vs.tokenKey, err = base64.URLEncoding.DecodeString(conf.TokenKey); err != nil {
+		return nil, err
+	}
+	if err = cryptoProvider.CheckKey(vs.tokenKey); err != nil {
+		return nil, err
+	}
+	if len(conf.PushEndpoint) > 0 {
+		if vs.endpointTemplate, err = template.New("Push").Parse(conf.PushEndpoint); err != nil {
+			return nil, err
+		}
+	}
+	prefix := conf.MetricsPrefix
+	if len(prefix) == 0 {
+		prefix = name
+	}
+	vs.metrics = &prefixedMetrics{app.Metrics(), prefix + "."}
+	vs.clientMetrics = &tenantMetrics{app.Metrics(), vs.metrics}
+	return vs, nil
+}
+
+func (vs *VirtualServer) Name() string          { return vs.name }
+func (vs *VirtualServer) Host() string          { return vs.host }
+func (vs *VirtualServer) TokenKey() []byte      { return vs.tokenKey }
+func (vs *VirtualServer) Metrics() Statistician { return vs.metrics }
+
+// ClientMetrics returns the metrics for the virtual server's clients. Each
+// metric is recorded under its server name and its prefixed name, so that
+// server totals include virtual server traffic.
+func (vs *VirtualServer) ClientMetrics() Statistician { return vs.clientMetrics }
+
+// CreateEndpoint allocates an update endpoint with the given primary key,
+// encrypted with the virtual server's token key.
+func (vs *VirtualServer) CreateEndpoint(key string) (string, error) {
+	token, err := encodeToken(vs.tokenKey, key)
+	if err != nil {
+		return "", err
+	}
+	return vs.app.executeEndpoint(vs.endpointTemplate, key, token)
+}
+
+// checkTenant indicates whether the client's virtual server may use the
+// device ID. Devices registered before virtual servers were configured are
+// untagged, and tagged with the client's tenant. Fails closed if the tag
+// can't be fetched. Devices are not checked if no virtual servers are
+// configured.
+func (w *WorkerWS) checkTenant(uaid string) (ok bool, err error) {
+	store, isTenantStore := w.store.(TenantStore)
+	if !isTenantStore || len(w.app.virtual) == 0 {
+		return true, nil
+	}
+	tenant := tenantName(w.virtual)
+	tagged, err := store.FetchTenant(uaid)
+	if err != nil {
+		return false, err
+	}
+	if len(tagged) == 0 {
+		return true, store.PutTenant(uaid, tenant)
+	}
+	if tagged != tenant {
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker", "Device registered with another tenant",
+				LogFields{"rid": w.logID, "uaid": uaid, "tenant": tenant,
+					"registered": tagged})
+		}
+		w.metrics.Increment("updates.client.hello.tenant_mismatch")
+		return false, nil
+	}
+	return true, nil
+}
+
+// tagTenant tags a new device ID with the client's tenant, if virtual
+// servers are configured.
+func (w *WorkerWS) tagTenant(uaid string) error {
+	store, isTenantStore := w.store.(TenantStore)
+	if !isTenantStore || len(w.app.virtual) == 0 {
+		return nil
+	}
+	return store.PutTenant(uaid, tenantName(w.virtual))
+}
+
+// LoadVirtualServers adds the virtual servers configured in the [virtual]
+// section to app.
+func LoadVirtualServers(app *Application, configFile ConfigFile) error {
+	section, ok := configFile["virtual"]
+	if !ok {
+		return nil
+	}
+	var confs map[string]VirtualServerConfig
+	if err := toml.PrimitiveDecode(section, &confs); err != nil {
+		return err
+	}
+	for name, conf := range confs {
+		vs, err := NewVirtualServer(app, name, conf)
+		if err != nil {
+			return fmt.Errorf("Error configuring virtual server '%s': %s",
+				name, err)
+		}
+		if err = app.AddVirtualServer(vs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// virtualHost returns the lowercased host name of a request Host header,
+// without the port.
+func virtualHost(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	return strings.ToLower(host)
+}
+
+// prefixedMetrics prepends a prefix to metric names.
+type prefixedMetrics struct {
+	Statistician
+	prefix string
+}
+
+func (m *prefixedMetrics) IncrementBy(metric string, count int64) {
+	m.Statistician.IncrementBy(m.prefix+metric, count)
+}
+
+func (m *prefixedMetrics) Increment(metric string) {
+	m.Statistician.Increment(m.prefix + metric)
+}
+
+func (m *prefixedMetrics) Decrement(metric string) {
+	m.Statistician.Decrement(m.prefix + metric)
+}
+
+func (m *prefixedMetrics) Timer(metric string, duration time.Duration) {
+	m.Statistician.Timer(m.prefix+metric, duration)
+}
+
+func (m *prefixedMetrics) Gauge(metric string, value int64) {
+	m.Statistician.Gauge(m.prefix+metric, value)
+}
+
+func (m *prefixedMetrics) GaugeDelta(metric string, delta int64) {
+	m.Statistician.GaugeDelta(m.prefix+metric, delta)
+}
+
+// tenantMetrics records metrics with both the server and tenant recorders.
+type tenantMetrics struct {
+	Statistician
+	tenant Statistician
+}
+
+func (m *tenantMetrics) IncrementBy(metric string, count int64) {
+	m.Statistician.IncrementBy(metric, count)
+	m.tenant.IncrementBy(metric, count)
+}
+
+func (m *tenantMetrics) Increment(metric string) {
+	m.Statistician.Increment(metric)
+	m.tenant.Increment(metric)
+}
+
+func (m *tenantMetrics) Decrement(metric string) {
+	m.Statistician.Decrement(metric)
+	m.tenant.Decrement(metric)
+}
+
+func (m *tenantMetrics) Timer(metric string, duration time.Duration) {
+	m.Statistician.Timer(metric, duration)
+	m.tenant.Timer(metric, duration)
+}
+
+func (m *tenantMetrics) Gauge(metric string, value int64) {
+	m.Statistician.Gauge(metric, value)
+	m.tenant.Gauge(metric, value)
+}
+
+func (m *tenantMetrics) GaugeDelta(metric string, delta int64) {
+	m.Statistician.GaugeDelta(metric, delta)
+	m.tenant.GaugeDelta(metric, delta)
+}
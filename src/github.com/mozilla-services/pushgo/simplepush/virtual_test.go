@@ -0,0 +1,150 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// tenantStore keeps device tenant tags in memory.
+type tenantStore struct {
+	*MockStore
+	tenants map[string]string
+}
+
+func (s *tenantStore) FetchTenant(uaid string) (string, error) {
+	return s.tenants[uaid], nil
+}
+
+func (s *tenantStore) PutTenant(uaid, tenant string) error {
+	s.tenants[uaid] = tenant
+	return nil
+}
+
+func TestVirtualServers(t *testing.T) {
+	useMockFuncs()
+	defer useStdFuncs()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(false).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+
+	Convey("Virtual servers", t, func() {
+		app := NewApplication()
+		app.endpointTemplate = testEndpointTemplate
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(mckStore)
+
+		tenant1, err := NewVirtualServer(app, "tenant1", VirtualServerConfig{
+			Host:         "Push.Tenant1.example.com",
+			TokenKey:     "HVozKz_n-DPopP5W877DpRKQOW_dylVf",
+			PushEndpoint: "https://push.tenant1.example.com/update/{{.Token}}",
+		})
+		So(err, ShouldBeNil)
+		So(app.AddVirtualServer(tenant1), ShouldBeNil)
+
+		tenant2, err := NewVirtualServer(app, "tenant2", VirtualServerConfig{
+			Host:          "push.tenant2.example.com",
+			TokenKey:      "O03rpLsdafhIhJEjEJt-CgVHyqHI650oy0pZZvplKDc=",
+			MetricsPrefix: "t2",
+		})
+		So(err, ShouldBeNil)
+		So(app.AddVirtualServer(tenant2), ShouldBeNil)
+
+		Convey("Should match request hosts", func() {
+			So(app.VirtualServer("push.tenant1.example.com:443"), ShouldEqual, tenant1)
+			So(app.VirtualServer("PUSH.TENANT2.EXAMPLE.COM"), ShouldEqual, tenant2)
+			So(app.VirtualServer("push.example.com"), ShouldBeNil)
+		})
+
+		Convey("Should reject virtual servers with the same host", func() {
+			dupe, err := NewVirtualServer(app, "dupe", VirtualServerConfig{
+				Host:     "push.tenant2.example.com",
+				TokenKey: "HVozKz_n-DPopP5W877DpRKQOW_dylVf",
+			})
+			So(err, ShouldBeNil)
+			So(app.AddVirtualServer(dupe), ShouldNotBeNil)
+		})
+
+		Convey("Should require token keys", func() {
+			_, err := NewVirtualServer(app, "keyless", VirtualServerConfig{
+				Host: "push.keyless.example.com",
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Should keep device IDs within their tenant", func() {
+			store := &tenantStore{mckStore, map[string]string{
+				"123": "tenant1",
+			}}
+			worker := &WorkerWS{app: app, logger: app.Logger(),
+				metrics: mckStat, store: store, virtual: tenant2}
+
+			mckStat.EXPECT().Increment("updates.client.hello.tenant_mismatch")
+			ok, err := worker.checkTenant("123")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+
+			// Untagged devices are claimed by the first tenant to use them.
+			ok, err = worker.checkTenant("456")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(store.tenants["456"], ShouldEqual, "tenant2")
+
+			worker.virtual = nil
+			So(worker.tagTenant("789"), ShouldBeNil)
+			So(store.tenants["789"], ShouldEqual, DefaultTenant)
+		})
+
+		Convey("Should issue endpoints with the virtual server's key", func() {
+			endpoint, err := tenant1.CreateEndpoint("456")
+			So(err, ShouldBeNil)
+			So(endpoint, ShouldEqual,
+				"https://push.tenant1.example.com/update/AAAAAAAAAAAAAAAAAAAAAGMKig==")
+
+			eh := NewEndpointHandler()
+			eh.setApp(app)
+			mckStat.EXPECT().Increment("endpoint.token_cache.miss").Times(2)
+			eh.tokenCache = NewTokenCache(app, TokenCacheConfig{Enabled: true, Size: 10})
+			token := "AAAAAAAAAAAAAAAAAAAAAGMKig=="
+
+			mckStore.EXPECT().KeyToIDs("456").Return("123", "456", nil)
+			uaid, chid, err := eh.resolveToken(tenant1, token)
+			So(err, ShouldBeNil)
+			So(uaid, ShouldEqual, "123")
+			So(chid, ShouldEqual, "456")
+
+			// Cached tokens are only accepted by the issuing virtual server.
+			mckStore.EXPECT().KeyToIDs(token).Return("", "", ErrInvalidKey)
+			_, _, err = eh.resolveToken(nil, token)
+			So(err, ShouldEqual, ErrInvalidKey)
+		})
+
+		Convey("Should prefix metric names", func() {
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("tenant1.client.socket.connect"),
+				mckStat.EXPECT().Timer("t2.client.socket.lifespan", gomock.Any()),
+			)
+			tenant1.Metrics().Increment("client.socket.connect")
+			tenant2.Metrics().Timer("client.socket.lifespan", 0)
+		})
+
+		Convey("Should record client metrics under server and prefixed names", func() {
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("updates.client.hello"),
+				mckStat.EXPECT().Increment("tenant1.updates.client.hello"),
+			)
+			tenant1.ClientMetrics().Increment("updates.client.hello")
+		})
+	})
+}
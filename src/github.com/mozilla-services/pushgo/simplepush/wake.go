@@ -0,0 +1,199 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type WakeConfig struct {
+	Enabled bool
+
+	// Window is how long after a proprietary ping a device must connect for
+	// the ping to count as a wakeup.
+	Window string
+}
+
+// NamedPinger is an optional interface implemented by proprietary pingers
+// that report a short name, used to label wakeup metrics.
+type NamedPinger interface {
+	Name() string
+}
+
+// PingerName returns the metrics label for a pinger: its name if it
+// implements NamedPinger, or "unknown".
+func PingerName(pinger PropPinger) string {
+	if named, ok := pinger.(NamedPinger); ok {
+		return named.Name()
+	}
+	return "unknown"
+}
+
+// WakeTracker measures whether proprietary pings bring devices back: a ping
+// converts if the device connects within the window after the ping was sent.
+// Outcomes are reported per pinger as metrics under "ping.wake.{pinger}".
+type WakeTracker struct {
+	metrics    Statistician
+	window     time.Duration
+	pendingMux sync.Mutex
+	pings      *list.List               // Pending pings, oldest at the front.
+	pending    map[string]*list.Element // Pending pings by UAID.
+	stats      map[string]*WakeStats    // Outcomes by pinger name.
+}
+
+// pendingWake is a sent ping awaiting a device connection.
+type pendingWake struct {
+	uaid   string
+	pinger string
+	sentAt time.Time
+}
+
+// WakeStats summarizes ping outcomes for a pinger.
+type WakeStats struct {
+	Sent    int64 `json:"sent"`
+	Errors  int64 `json:"errors"`
+	Woke    int64 `json:"woke"`
+	Expired int64 `json:"expired"`
+}
+
+// Conversion returns the percentage of resolved pings that woke the device.
+func (s *WakeStats) Conversion() int64 {
+	resolved := s.Woke + s.Expired
+	if resolved == 0 {
+		return 0
+	}
+	return s.Woke * 100 / resolved
+}
+
+// NewWakeTracker creates a wakeup tracker from conf.
+func NewWakeTracker(conf WakeConfig) (t *WakeTracker, err error) {
+	t = &WakeTracker{
+		pings:   list.New(),
+		pending: make(map[string]*list.Element),
+		stats:   make(map[string]*WakeStats),
+	}
+	if t.window, err = time.ParseDuration(conf.Window); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Sent records a proprietary ping sent to a device. Safe to call on a nil
+// WakeTracker.
+func (t *WakeTracker) Sent(pinger, uaid string) {
+	if t == nil {
+		return
+	}
+	now := timeNow()
+	t.pendingMux.Lock()
+	t.expire(now)
+	t.statsFor(pinger).Sent++
+	if elem, ok := t.pending[uaid]; ok {
+		// A newer ping replaces the pending one.
+		t.pings.Remove(elem)
+	}
+	t.pending[uaid] = t.pings.PushBack(&pendingWake{uaid, pinger, now})
+	t.pendingMux.Unlock()
+	t.metrics.Increment("ping.wake." + pinger + ".sent")
+}
+
+// Failed records a ping rejected by the provider. Safe to call on a nil
+// WakeTracker.
+func (t *WakeTracker) Failed(pinger string) {
+	if t == nil {
+		return
+	}
+	t.pendingMux.Lock()
+	t.statsFor(pinger).Errors++
+	t.pendingMux.Unlock()
+	t.metrics.Increment("ping.wake." + pinger + ".error")
+}
+
+// Connected records a device connection. If the device was pinged within the
+// window, the ping is counted as a wakeup. Safe to call on a nil WakeTracker.
+func (t *WakeTracker) Connected(uaid string) {
+	if t == nil {
+		return
+	}
+	now := timeNow()
+	t.pendingMux.Lock()
+	var wake *pendingWake
+	elem, ok := t.pending[uaid]
+	if ok {
+		wake = elem.Value.(*pendingWake)
+		t.remove(elem)
+		if ok = now.Sub(wake.sentAt) < t.window; ok {
+			t.resolve(wake.pinger, true)
+		}
+	}
+	t.expire(now)
+	t.pendingMux.Unlock()
+	if ok {
+		t.metrics.Timer("ping.wake."+wake.pinger+".latency",
+			now.Sub(wake.sentAt))
+	}
+}
+
+// Stats returns the ping outcomes for each pinger.
+func (t *WakeTracker) Stats() map[string]WakeStats {
+	if t == nil {
+		return nil
+	}
+	t.pendingMux.Lock()
+	defer t.pendingMux.Unlock()
+	t.expire(timeNow())
+	stats := make(map[string]WakeStats, len(t.stats))
+	for pinger, s := range t.stats {
+		stats[pinger] = *s
+	}
+	return stats
+}
+
+// expire resolves pings older than the window as failed wakeups. Pings are
+// kept in the order they were sent, so only expired pings are visited. The
+// caller must hold the pending lock.
+func (t *WakeTracker) expire(now time.Time) {
+	for elem := t.pings.Front(); elem != nil; elem = t.pings.Front() {
+		wake := elem.Value.(*pendingWake)
+		if now.Sub(wake.sentAt) < t.window {
+			break
+		}
+		t.remove(elem)
+		t.resolve(wake.pinger, false)
+	}
+}
+
+// remove removes a pending ping. The caller must hold the pending lock.
+func (t *WakeTracker) remove(elem *list.Element) {
+	wake := t.pings.Remove(elem).(*pendingWake)
+	delete(t.pending, wake.uaid)
+}
+
+// resolve records the outcome of a ping, and updates the conversion rate.
+// The caller must hold the pending lock.
+func (t *WakeTracker) resolve(pinger string, woke bool) {
+	s := t.statsFor(pinger)
+	if woke {
+		s.Woke++
+		t.metrics.Increment("ping.wake." + pinger + ".woke")
+	} else {
+		s.Expired++
+		t.metrics.Increment("ping.wake." + pinger + ".expired")
+	}
+	t.metrics.Gauge("ping.wake."+pinger+".conversion", s.Conversion())
+}
+
+// statsFor returns the stats for a pinger. The caller must hold the pending
+// lock.
+func (t *WakeTracker) statsFor(pinger string) *WakeStats {
+	s, ok := t.stats[pinger]
+	if !ok {
+		s = new(WakeStats)
+		t.stats[pinger] = s
+	}
+	return s
+}
@@ -0,0 +1,103 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWakeTracker(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckStat := NewMockStatistician(mockCtrl)
+
+	defer saveTimeFuncs()()
+	var now time.Time
+	timeNow = func() time.Time { return now }
+
+	Convey("Wakeup tracking", t, func() {
+		now = time.Unix(1257894000, 0).UTC()
+		tracker, err := NewWakeTracker(WakeConfig{Enabled: true, Window: "1m"})
+		So(err, ShouldBeNil)
+		tracker.metrics = mckStat
+		uaid := "6a4f5b0e1c2d4e3f8a9b0c1d2e3f4a5b"
+
+		Convey("Should count devices that connect within the window", func() {
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("ping.wake.gcm.sent"),
+				mckStat.EXPECT().Increment("ping.wake.gcm.woke"),
+				mckStat.EXPECT().Gauge("ping.wake.gcm.conversion", int64(100)),
+				mckStat.EXPECT().Timer("ping.wake.gcm.latency", 10*time.Second),
+			)
+			tracker.Sent("gcm", uaid)
+			now = now.Add(10 * time.Second)
+			tracker.Connected(uaid)
+			So(tracker.Stats(), ShouldResemble, map[string]WakeStats{
+				"gcm": {Sent: 1, Woke: 1}})
+
+			// Subsequent connections aren't counted.
+			tracker.Connected(uaid)
+		})
+
+		Convey("Should expire pings without a connection", func() {
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("ping.wake.gcm.sent"),
+				mckStat.EXPECT().Increment("ping.wake.gcm.expired"),
+				mckStat.EXPECT().Gauge("ping.wake.gcm.conversion", int64(0)),
+			)
+			tracker.Sent("gcm", uaid)
+			now = now.Add(time.Minute)
+			tracker.Connected(uaid)
+			So(tracker.Stats(), ShouldResemble, map[string]WakeStats{
+				"gcm": {Sent: 1, Expired: 1}})
+		})
+
+		Convey("Should expire pings in the order they were sent", func() {
+			otherID := "0f9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c"
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("ping.wake.gcm.sent"),
+				mckStat.EXPECT().Increment("ping.wake.apns.sent"),
+				mckStat.EXPECT().Increment("ping.wake.gcm.sent"),
+				mckStat.EXPECT().Increment("ping.wake.apns.expired"),
+				mckStat.EXPECT().Gauge("ping.wake.apns.conversion", int64(0)),
+			)
+			tracker.Sent("gcm", uaid)
+			now = now.Add(10 * time.Second)
+			tracker.Sent("apns", otherID)
+			now = now.Add(40 * time.Second)
+			// A newer ping replaces the pending one.
+			tracker.Sent("gcm", uaid)
+			now = now.Add(20 * time.Second)
+			So(tracker.Stats(), ShouldResemble, map[string]WakeStats{
+				"gcm":  {Sent: 2},
+				"apns": {Sent: 1, Expired: 1}})
+		})
+
+		Convey("Should record provider errors", func() {
+			mckStat.EXPECT().Increment("ping.wake.gcm.error")
+			tracker.Failed("gcm")
+			So(tracker.Stats(), ShouldResemble, map[string]WakeStats{
+				"gcm": {Errors: 1}})
+		})
+
+		Convey("Should compute conversion rates", func() {
+			s := &WakeStats{Sent: 4, Woke: 3, Expired: 1}
+			So(s.Conversion(), ShouldEqual, 75)
+			So(new(WakeStats).Conversion(), ShouldEqual, 0)
+		})
+
+		Convey("Should ignore calls if disabled", func() {
+			var disabled *WakeTracker
+			disabled.Sent("gcm", uaid)
+			disabled.Connected(uaid)
+			So(disabled.Stats(), ShouldBeNil)
+		})
+	})
+}
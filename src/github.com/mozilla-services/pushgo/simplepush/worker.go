@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"runtime"
 	"strconv"
 	"strings"
@@ -57,6 +58,48 @@ type Worker interface {
 	Close() error
 }
 
+// ExpiredSender is an optional interface implemented by workers that can
+// notify clients of channels deactivated by the server.
+type ExpiredSender interface {
+	SendExpired(chids ...string) error
+}
+
+// CommandHandler handles client protocol commands. Each command receives the
+// parsed request header and the compacted JSON message.
+type CommandHandler interface {
+	Hello(header *RequestHeader, message []byte) error
+	Ack(header *RequestHeader, message []byte) error
+	Register(header *RequestHeader, message []byte) error
+	Unregister(header *RequestHeader, message []byte) error
+	Ping(header *RequestHeader, message []byte) error
+	Purge(header *RequestHeader, message []byte) error
+	Channels(header *RequestHeader, message []byte) error
+}
+
+// DispatchCommand calls the handler method for the command named in the
+// request header. Returns ErrUnsupportedType for unknown commands.
+func DispatchCommand(h CommandHandler, header *RequestHeader,
+	message []byte) error {
+
+	switch strings.ToLower(header.Type) {
+	case "purge":
+		return h.Purge(header, message)
+	case "ping":
+		return h.Ping(header, message)
+	case "hello":
+		return h.Hello(header, message)
+	case "ack":
+		return h.Ack(header, message)
+	case "register":
+		return h.Register(header, message)
+	case "unregister":
+		return h.Unregister(header, message)
+	case "channels":
+		return h.Channels(header, message)
+	}
+	return ErrUnsupportedType
+}
+
 type WorkerWS struct {
 	Socket
 	born         time.Time
@@ -67,10 +110,52 @@ type WorkerWS struct {
 	logID        string
 	uaid         string
 	state        WorkerState
+	handshook    bool // Set once the handshake reply is written.
 	lastPing     time.Time
+	lastRecv     time.Time
 	pingInt      time.Duration
+	idleInt      time.Duration
+	maxSilence   time.Duration
+	readTimeout  time.Duration // Maximum time between client frames.
+	writeTimeout time.Duration // Maximum time to write a frame.
 	helloTimeout time.Duration
+	helloFrames  int           // Maximum frames received before the handshake.
+	helloBytes   int           // Maximum bytes received before the handshake.
+	maxChannels  int           // Maximum channel IDs sent in a handshake.
+	shakeFrames  int           // Frames received before the handshake.
+	shakeBytes   int           // Bytes received before the handshake.
+	shakeTimeout time.Duration // Maximum time to complete a handshake.
+	regWindow    time.Duration // Sliding window for the registration limit.
+	regTimes     []time.Time   // Ring of recent registration times.
+	regNext      int           // Index of the oldest registration time.
 	pongInterval time.Duration
+	dupeHello    DupeHelloMode
+	advisor      *PingAdvisor        // Per-network ping heuristics; may be nil.
+	network      string              // The client's network, for the ping advisor.
+	addr         string              // The client's remote address.
+	crashes      *CrashPolicy        // Per-client crash budget; may be nil.
+	abuse        *AbuseScorer        // Client violation scoring; may be nil.
+	admission    *AdmissionControl   // Reconnect waves; may be nil.
+	traffic      *TrafficSession     // Recorded traffic shape; may be nil.
+	rtt          *RTTEstimator       // Round-trip time estimate; may be nil.
+	coalesce     *Coalescer          // Updates held for the RTT window; may be nil.
+	dedupe       *DeliveryFilter     // Duplicate update suppression; may be nil.
+	redelivery   *RedeliveryTracker  // Unacknowledged update retries; may be nil.
+	transcripts  *TranscriptRecorder // Flagged client transcripts; may be nil.
+	protocol     *ProtocolValidator  // Inbound message validation; may be nil.
+	sequencer    *SequencePolicy     // Frame sequence numbers; may be nil.
+	seq          *SequenceTracker    // Set if the client opted in; may be nil.
+	skew         *SkewMonitor        // Timestamps and clock skew; may be nil.
+	affinity     *Affinity           // Reconnection hints; may be nil.
+	tiering      *PayloadTiering     // Stored oversized payloads; may be nil.
+	payloads     *StoredPayloads     // Stored update data; may be nil.
+	localWrites  *LocalWrites        // Delivered updates being stored; may be nil.
+	doze         *DozeQueue          // Client hints and held updates; may be nil.
+	flushCap     *FlushCap           // Updates sent per flush; may be nil.
+	goroutines   *ConnGoroutines     // Spawned goroutines; may be nil.
+	sessions     *SessionCache       // Session resumption; may be nil.
+	resume       *resumeState        // Unacknowledged updates; may be nil.
+	virtual      *VirtualServer      // The client's virtual server; may be nil.
 }
 
 type WorkerState int
@@ -81,59 +166,40 @@ const (
 	WorkerStopped
 )
 
-type RequestHeader struct {
-	Type string `json:"messageType"`
-}
-
-type HelloRequest struct {
-	DeviceID   string            `json:"uaid"`
-	ChannelIDs []json.RawMessage `json:"channelIDs"`
-	PingData   json.RawMessage   `json:"connect"`
-}
-
-type HelloReply struct {
-	Type        string  `json:"messageType"`
-	DeviceID    string  `json:"uaid"`
-	Status      int     `json:"status"`
-	RedirectURL *string `json:"redirect,omitempty"`
-}
-
-type RegisterRequest struct {
-	ChannelID string `json:"channelID"`
-}
+// DupeHelloMode determines how a worker responds to a repeated handshake on
+// the same connection.
+type DupeHelloMode int
 
-type RegisterReply struct {
-	Type      string `json:"messageType"`
-	DeviceID  string `json:"uaid"`
-	Status    int    `json:"status"`
-	ChannelID string `json:"channelID"`
-	Endpoint  string `json:"pushEndpoint"`
-}
+const (
+	// DupeHelloFlush acknowledges the handshake and flushes pending updates.
+	DupeHelloFlush DupeHelloMode = iota
 
-type UnregisterRequest struct {
-	ChannelID string `json:"channelID"`
-}
+	// DupeHelloError rejects the handshake and closes the connection.
+	DupeHelloError
 
-type UnregisterReply struct {
-	Type      string `json:"messageType"`
-	Status    int    `json:"status"`
-	ChannelID string `json:"channelID"`
-}
+	// DupeHelloIgnore acknowledges the handshake without side effects.
+	DupeHelloIgnore
 
-type FlushReply struct {
-	Type    string   `json:"messageType"`
-	Updates []Update `json:"updates,omitempty"`
-	Expired []string `json:"expired,omitempty"`
-}
+	// DupeHelloResync reconciles the client's channels with the store, as for
+	// a new connection, then flushes pending updates. The client is issued a
+	// new device ID if its channels cannot be reconciled.
+	DupeHelloResync
+)
 
-type ACKRequest struct {
-	Updates []Update `json:"updates"`
-	Expired []string `json:"expired"`
+var dupeHelloModes = map[string]DupeHelloMode{
+	"flush":  DupeHelloFlush,
+	"error":  DupeHelloError,
+	"ignore": DupeHelloIgnore,
+	"resync": DupeHelloResync,
 }
 
-type PingReply struct {
-	Type   string `json:"messageType"`
-	Status int    `json:"status"`
+// ParseDupeHelloMode returns the duplicate handshake mode with the given name.
+func ParseDupeHelloMode(name string) (mode DupeHelloMode, err error) {
+	mode, ok := dupeHelloModes[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("Unknown duplicate hello mode: %q", name)
+	}
+	return mode, nil
 }
 
 type SendData struct {
@@ -143,6 +209,8 @@ type SendData struct {
 }
 
 func NewWorker(app *Application, socket Socket, logID string) *WorkerWS {
+	app.clientMux.RLock()
+	defer app.clientMux.RUnlock()
 	return &WorkerWS{
 		Socket:       socket,
 		born:         timeNow(),
@@ -153,8 +221,21 @@ func NewWorker(app *Application, socket Socket, logID string) *WorkerWS {
 		logID:        logID,
 		state:        WorkerInactive,
 		pingInt:      app.clientMinPing,
+		idleInt:      app.clientPingInterval,
+		maxSilence:   app.clientMaxSilence,
+		readTimeout:  app.clientReadTimeout,
+		writeTimeout: app.clientWriteTimeout,
 		helloTimeout: app.clientHelloTimeout,
+		helloFrames:  app.clientHelloFrames,
+		helloBytes:   app.clientHelloBytes,
+		maxChannels:  app.clientMaxChannels,
+		shakeTimeout: app.handshakeTimeout,
+		regWindow:    app.registerWindow,
 		pongInterval: app.clientPongInterval,
+		dupeHello:    app.dupeHello,
+		goroutines:   app.Goroutines().Conn(logID),
+		sessions:     app.Sessions(),
+		localWrites:  app.LocalWrites(),
 	}
 }
 
@@ -171,6 +252,67 @@ func harmlessConnectionError(err error) (harmless bool) {
 	return
 }
 
+// WriteJSON implements Socket.WriteJSON. If RTT estimation is enabled, the
+// write deadline is set from the connection's round-trip time; otherwise, it
+// is set from the write timeout. Clients that exceed the deadline are
+// disconnected.
+func (w *WorkerWS) WriteJSON(v interface{}) (err error) {
+	w.setWriteDeadline()
+	if err = w.Socket.WriteJSON(v); err != nil {
+		w.writeFailed(err)
+		return err
+	}
+	if t := w.transcript(); t != nil {
+		if data, err := json.Marshal(v); err == nil {
+			t.Record(w.logID, TranscriptOut, data)
+		}
+	}
+	return nil
+}
+
+// WriteText implements Socket.WriteText, setting the write deadline like
+// WriteJSON.
+func (w *WorkerWS) WriteText(data string) (err error) {
+	w.setWriteDeadline()
+	if err = w.Socket.WriteText(data); err != nil {
+		w.writeFailed(err)
+		return err
+	}
+	w.transcript().Record(w.logID, TranscriptOut, []byte(data))
+	return nil
+}
+
+// transcript returns the transcript for the client, or nil if the client is
+// not flagged. Clients are looked up on each frame, so that flagging a
+// device takes effect without waiting for it to reconnect.
+func (w *WorkerWS) transcript() *Transcript {
+	return w.transcripts.Transcript(w.UAID())
+}
+
+func (w *WorkerWS) setWriteDeadline() {
+	if w.rtt != nil {
+		w.SetWriteDeadline(timeNow().Add(w.rtt.WriteDeadline()))
+	} else if w.writeTimeout > 0 {
+		w.SetWriteDeadline(timeNow().Add(w.writeTimeout))
+	}
+}
+
+// writeFailed stops the worker if a write exceeded its deadline. The pending
+// read is interrupted, so that the connection is closed without waiting for
+// the read deadline.
+func (w *WorkerWS) writeFailed(err error) {
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() || w.stopped() {
+		return
+	}
+	if w.logger.ShouldLog(INFO) {
+		w.logger.Info("worker", "Client exceeded write deadline. Closing socket",
+			LogFields{"rid": w.logID, "uaid": w.UAID()})
+	}
+	w.metrics.Increment("updates.client.write_timeout")
+	w.stop()
+	w.SetReadDeadline(timeNow())
+}
+
 func (w *WorkerWS) Born() time.Time     { return w.born }
 func (w *WorkerWS) SetUAID(uaid string) { w.uaid = uaid }
 func (w *WorkerWS) UAID() string        { return w.uaid }
@@ -188,15 +330,55 @@ func (w *WorkerWS) ReadDeadline() (t time.Time) {
 		}
 
 	// For clients that have completed the handshake, the deadline is the end of
-	// the next pong interval.
+	// the next pong interval, or the end of the maximum silent period,
+	// whichever comes first.
 	case WorkerActive:
 		if w.pongInterval > 0 {
 			t = timeNow().Add(w.pongInterval)
 		}
+		if w.maxSilence > 0 {
+			if silentAt := w.lastActive().Add(w.maxSilence); t.IsZero() || silentAt.Before(t) {
+				t = silentAt
+			}
+		}
+		if w.readTimeout > 0 {
+			if timeoutAt := w.lastActive().Add(w.readTimeout); t.IsZero() || timeoutAt.Before(t) {
+				t = timeoutAt
+			}
+		}
+		// Wake up to resend unacknowledged updates. Updates routed while the
+		// read is pending are checked at the next deadline.
+		if dueAt := w.redelivery.Deadline(); !dueAt.IsZero() && (t.IsZero() || dueAt.Before(t)) {
+			t = dueAt
+		}
+		// Wake up to send updates held for a dozing client.
+		if dueAt := w.doze.Deadline(); !dueAt.IsZero() && (t.IsZero() || dueAt.Before(t)) {
+			t = dueAt
+		}
 	}
 	return
 }
 
+// lastActive returns the time the client last sent a packet, or the socket
+// creation time if the client has not sent any packets.
+func (w *WorkerWS) lastActive() time.Time {
+	if w.lastRecv.IsZero() {
+		return w.Born()
+	}
+	return w.lastRecv
+}
+
+// isSilent indicates whether the client has exceeded the maximum silent
+// period.
+func (w *WorkerWS) isSilent() bool {
+	return w.maxSilence > 0 && !timeNow().Before(w.lastActive().Add(w.maxSilence))
+}
+
+// readTimedOut indicates whether the client has exceeded the read timeout.
+func (w *WorkerWS) readTimedOut() bool {
+	return w.readTimeout > 0 && !timeNow().Before(w.lastActive().Add(w.readTimeout))
+}
+
 func (w *WorkerWS) sniffer() {
 	// Sniff the websocket for incoming data.
 	// Reading from the websocket is a blocking operation, and we also
@@ -211,6 +393,10 @@ func (w *WorkerWS) sniffer() {
 		raw, err := w.ReadBinary()
 		if err != nil {
 			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if w.stopped() {
+					// Interrupted by a failed write.
+					continue
+				}
 				if w.state == WorkerInactive {
 					if w.logger.ShouldLog(DEBUG) {
 						w.logger.Debug("worker", "Worker Idle connection. Closing socket",
@@ -219,11 +405,43 @@ func (w *WorkerWS) sniffer() {
 					w.stop()
 					continue
 				}
+				if w.isSilent() {
+					if w.logger.ShouldLog(INFO) {
+						w.logger.Info("worker", "Client exceeded maximum silent period. Closing socket",
+							LogFields{"rid": w.logID, "uaid": w.UAID()})
+					}
+					w.metrics.Increment("updates.client.silent")
+					w.stop()
+					continue
+				}
+				if w.readTimedOut() {
+					if w.logger.ShouldLog(INFO) {
+						w.logger.Info("worker", "Client exceeded read timeout. Closing socket",
+							LogFields{"rid": w.logID, "uaid": w.UAID()})
+					}
+					w.metrics.Increment("updates.client.read_timeout")
+					w.stop()
+					continue
+				}
+				if w.redeliver() {
+					continue
+				}
+				if due := w.doze.Due(timeNow()); len(due) > 0 {
+					w.sendHeld(due)
+					continue
+				}
 				if err = w.WriteText("{}"); err == nil {
+					w.rtt.Sent()
 					continue
 				}
 			}
+			wasActive := w.state == WorkerActive
 			w.stop()
+			if w.advisor != nil && wasActive {
+				// The client dropped after being idle; record how long the
+				// connection survived for this network.
+				w.advisor.Observe(w.network, timeNow().Sub(w.lastActive()))
+			}
 			if err != io.EOF {
 				if w.logger.ShouldLog(ERROR) && !harmlessConnectionError(err) {
 					w.logger.Error("worker", "Websocket Error",
@@ -232,6 +450,21 @@ func (w *WorkerWS) sniffer() {
 			}
 			continue
 		}
+		if w.maxSilence > 0 || w.readTimeout > 0 || w.advisor != nil {
+			w.lastRecv = timeNow()
+		}
+		w.rtt.Received()
+		if w.state == WorkerInactive && w.helloFlood(len(raw)) {
+			if logWarning {
+				w.logger.Warn("worker", "Client exceeded pre-handshake limits. Closing socket",
+					LogFields{"rid": w.logID, "addr": w.addr,
+						"frames": strconv.Itoa(w.shakeFrames),
+						"bytes":  strconv.Itoa(w.shakeBytes)})
+			}
+			w.metrics.Increment("updates.client.hello.flood")
+			w.stop()
+			continue
+		}
 		if len(raw) <= 0 {
 			continue
 		}
@@ -253,6 +486,7 @@ func (w *WorkerWS) sniffer() {
 						LogFields{"rid": w.logID, "error": ErrStr(err)})
 				}
 			}
+			w.reportAbuse(ViolationPayload)
 			w.stop()
 			continue
 		} else {
@@ -273,27 +507,31 @@ func (w *WorkerWS) sniffer() {
 					LogFields{"rid": w.logID, "error": ErrStr(err)})
 			}
 			w.handleError(msg, ErrInvalidHeader)
+			w.reportAbuse(ViolationPayload)
 			w.stop()
 			continue
 		}
-		switch strings.ToLower(header.Type) {
-		case "purge": // No-op for backward compatibility.
-		case "ping":
-			err = w.Ping(header, msg)
-		case "hello":
-			err = w.Hello(header, msg)
-		case "ack":
-			err = w.Ack(header, msg)
-		case "register":
-			err = w.Register(header, msg)
-		case "unregister":
-			err = w.Unregister(header, msg)
-		default:
+		w.traffic.Command(header.Type, msg)
+		if header.Type != "hello" {
+			// Handshakes are recorded by Hello, once the device ID is known.
+			w.transcript().Record(w.logID, TranscriptIn, msg)
+		}
+		if err = w.protocol.Validate(header.Type, msg); err != nil {
+			if logWarning {
+				w.logger.Warn("worker", "Invalid protocol message", LogFields{
+					"rid": w.logID, "cmd": header.Type, "error": err.Error()})
+			}
+			w.metrics.Increment("client.protocol.invalid")
+			w.handleError(msg, ErrInvalidParams)
+			w.reportAbuse(ViolationPayload)
+			w.stop()
+			continue
+		}
+		if err = DispatchCommand(w, header, msg); err == ErrUnsupportedType {
 			if logWarning {
 				w.logger.Warn("worker", "Bad command",
 					LogFields{"rid": w.logID, "cmd": header.Type})
 			}
-			err = ErrUnsupportedType
 		}
 		if err != nil {
 			if w.logger.ShouldLog(DEBUG) {
@@ -301,12 +539,26 @@ func (w *WorkerWS) sniffer() {
 					LogFields{"rid": w.logID, "cmd": header.Type, "error": ErrStr(err)})
 			}
 			w.handleError(msg, err)
+			if err == ErrInvalidParams || err == ErrUnsupportedType {
+				w.reportAbuse(ViolationPayload)
+			}
 			w.stop()
 			continue
 		}
 	}
 }
 
+// helloFlood counts a frame of size bytes received before the handshake, and
+// indicates whether the client exceeded the pre-handshake frame or byte
+// limits. Like the hello timeout, this bounds the resources held by clients
+// that never complete the handshake.
+func (w *WorkerWS) helloFlood(size int) bool {
+	w.shakeFrames++
+	w.shakeBytes += size
+	return w.helloFrames > 0 && w.shakeFrames > w.helloFrames ||
+		w.helloBytes > 0 && w.shakeBytes > w.helloBytes
+}
+
 func (w *WorkerWS) stopped() bool {
 	return w.state == WorkerStopped
 }
@@ -315,6 +567,69 @@ func (w *WorkerWS) stop() {
 	w.state = WorkerStopped
 }
 
+// recoverCommand recovers from a panic while handling cmd, and replaces the
+// command error with ErrInvalidParams. Must be called via defer.
+func (w *WorkerWS) recoverCommand(cmd string, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	w.crashed(cmd, r)
+	if err != nil {
+		*err = ErrInvalidParams
+	}
+}
+
+// crashed records a crash report for a panic recovered while handling a
+// client command, and charges it to the client. Must be called from the
+// worker's goroutine.
+func (w *WorkerWS) crashed(cmd string, r interface{}) {
+	w.chargeCrash(w.crashReport(cmd, r))
+}
+
+// crashReport logs and returns a crash report for a panic recovered while
+// handling cmd. The crash isn't charged to the client; this is safe to call
+// from any goroutine.
+func (w *WorkerWS) crashReport(cmd string, r interface{}) *CrashReport {
+	stack := make([]byte, 1<<16)
+	n := runtime.Stack(stack, false)
+	report := &CrashReport{
+		Time:      timeNow().Unix(),
+		RequestID: w.logID,
+		UAID:      w.UAID(),
+		Command:   cmd,
+		Addr:      w.addr,
+		Stack:     string(stack[:n]),
+	}
+	if err, ok := r.(error); ok {
+		report.Error = ErrStr(err)
+	} else {
+		report.Error = fmt.Sprintf("%v", r)
+	}
+	if w.logger.ShouldLog(ERROR) {
+		w.logger.Error("worker", "Unhandled error", report.Fields())
+	}
+	w.metrics.Increment("client.crash")
+	return report
+}
+
+// chargeCrash counts a crash caused by the client against its crash budget
+// and abuse score. Clients that exceed either are disconnected.
+func (w *WorkerWS) chargeCrash(report *CrashReport) {
+	if w.crashes != nil && w.crashes.Record(report) {
+		w.stop()
+	}
+	w.reportAbuse(ViolationCrash)
+}
+
+// reportAbuse records a violation for this client. Clients banned as a
+// result are disconnected.
+func (w *WorkerWS) reportAbuse(v Violation) {
+	if w.abuse != nil && w.abuse.Report(w.UAID(), w.addr, v) {
+		w.stop()
+	}
+}
+
 // standardize the error reporting back to the client.
 func (w *WorkerWS) handleError(message []byte, err error) (ret error) {
 	reply := make(map[string]interface{})
@@ -327,19 +642,7 @@ func (w *WorkerWS) handleError(message []byte, err error) (ret error) {
 
 // General workhorse loop for the websocket handler.
 func (w *WorkerWS) Run() {
-	defer func() {
-		if r := recover(); r != nil {
-			if err, _ := r.(error); err != nil && w.logger.ShouldLog(ERROR) {
-				stack := make([]byte, 1<<16)
-				n := runtime.Stack(stack, false)
-				w.logger.Error("worker", "Unhandled connection error", LogFields{
-					"rid":   w.logID,
-					"error": ErrStr(err),
-					"stack": string(stack[:n])})
-			}
-		}
-		return
-	}()
+	defer w.recoverCommand("", nil)
 
 	w.sniffer()
 
@@ -354,22 +657,28 @@ func (w *WorkerWS) Run() {
 func (w *WorkerWS) Hello(header *RequestHeader, message []byte) (err error) {
 	logWarning := w.logger.ShouldLog(WARNING)
 	// register the UAID
-	defer func() {
-		if r := recover(); r != nil {
-			if err, _ := r.(error); err != nil && w.logger.ShouldLog(ERROR) {
-				stack := make([]byte, 1<<16)
-				n := runtime.Stack(stack, false)
-				w.logger.Error("worker", "Unhandled error", LogFields{"rid": w.logID,
-					"cmd": "hello", "error": ErrStr(err), "stack": string(stack[:n])})
-			}
-			err = ErrInvalidParams
-		}
-	}()
+	defer w.recoverCommand("hello", &err)
 
 	request := new(HelloRequest)
 	if err = json.Unmarshal(message, request); err != nil {
 		return ErrInvalidParams
 	}
+	w.transcripts.Transcript(request.DeviceID).Record(w.logID, TranscriptIn,
+		message)
+	isDupe := len(w.UAID()) > 0
+	if !isDupe && w.admission != nil {
+		if retryAfter := w.admission.Admit(request.DeviceID); retryAfter > 0 {
+			return w.deferHello(header, retryAfter)
+		}
+	}
+	if w.sessions != nil && w.resume == nil {
+		// Track sent updates before the worker is registered for routing.
+		var token string
+		if token, err = w.sessions.Token(); err != nil {
+			return err
+		}
+		w.resume = newResumeState(token)
+	}
 	wroteReply, err := w.registerDevice(header, request)
 	if err != nil {
 		return err
@@ -379,12 +688,31 @@ func (w *WorkerWS) Hello(header *RequestHeader, message []byte) (err error) {
 		return nil
 	}
 	uaid := w.UAID()
+	w.doze.Observe(request.Hints)
+	var session *parkedSession
+	if !isDupe && len(request.Resume) > 0 {
+		session = w.resumeSession(request.Resume, uaid)
+	}
 	if w.logger.ShouldLog(DEBUG) {
 		w.logger.Debug("worker", "sending response",
 			LogFields{"rid": w.logID, "cmd": "hello", "uaid": uaid})
 	}
-	reply := fmt.Sprintf(`{"messageType":%q,"uaid":%q,"status":200}`,
-		header.Type, uaid)
+	params := w.keepAliveParams()
+	if request.Sequence && w.sequencer != nil {
+		if w.seq == nil {
+			w.seq = w.sequencer.Tracker()
+		}
+		params += `,"sequence":true`
+	}
+	if w.resume != nil {
+		params += fmt.Sprintf(`,"resume":%q`, w.resume.token)
+	}
+	if chids, drifted := w.checkDrift(uaid, request.Checksum); drifted {
+		list, _ := json.Marshal(chids)
+		params += `,"channelIDs":` + string(list)
+	}
+	reply := fmt.Sprintf(`{"messageType":%q,"uaid":%q,"status":200%s}`,
+		header.Type, uaid, params)
 	if err = w.WriteText(reply); err != nil {
 		if logWarning {
 			w.logger.Warn("worker", "Error writing client handshake", LogFields{
@@ -393,29 +721,214 @@ func (w *WorkerWS) Hello(header *RequestHeader, message []byte) (err error) {
 		return err
 	}
 	w.metrics.Increment("updates.client.hello")
+	w.app.Wake().Connected(uaid)
 	if w.logger.ShouldLog(INFO) {
 		w.logger.Info("worker", "Client successfully connected",
 			LogFields{"rid": w.logID})
 	}
 	w.state = WorkerActive
+	w.handshook = true
+	if isDupe && w.dupeHello == DupeHelloIgnore {
+		return nil
+	}
+	w.sendInitialSettings()
+	if session != nil && !session.missed {
+		return w.flushSession(session)
+	}
 	// Get the lastAccessed time from wherever
 	return w.Flush(0)
 }
 
+// resumeSession restores the parked session for token, if the client's
+// previous connection to this node closed within the resumption TTL.
+func (w *WorkerWS) resumeSession(token, uaid string) *parkedSession {
+	session, ok := w.sessions.Resume(token, uaid)
+	if !ok {
+		w.metrics.Increment("updates.client.resume.miss")
+		return nil
+	}
+	w.regTimes, w.regNext = session.regTimes, session.regNext
+	w.lastPing = session.lastPing
+	if session.missed {
+		// Updates were routed to the device while it was disconnected.
+		w.metrics.Increment("updates.client.resume.missed")
+	} else {
+		w.metrics.Increment("updates.client.resume")
+	}
+	return session
+}
+
+// flushSession resends the updates that the client had not acknowledged
+// when its previous connection closed, in place of a store flush.
+func (w *WorkerWS) flushSession(session *parkedSession) error {
+	if len(session.updates) == 0 && len(session.expired) == 0 {
+		return nil
+	}
+	w.resume.sent(session.updates, session.expired)
+	w.redelivery.Sent(session.updates, session.expired)
+	w.WriteJSON(FlushReply{"notification", session.updates, session.expired,
+		w.seq.Next(session.updates, session.expired), w.skew.Stamp()})
+	w.rtt.Sent()
+	w.metrics.IncrementBy("updates.sent", int64(len(session.updates)))
+	return nil
+}
+
+// parkSession stores the session of a closed connection for resumption.
+// The worker is always stopped by the time it's closed, so sessions are
+// parked if the client completed the handshake.
+func (w *WorkerWS) parkSession(uaid string) {
+	if w.resume == nil || !w.handshook {
+		return
+	}
+	session := w.resume.park(uaid)
+	session.regTimes, session.regNext = w.regTimes, w.regNext
+	session.lastPing = w.lastPing
+	w.sessions.Park(session)
+}
+
+// deferHello tells a client to reconnect once its admission wave opens, then
+// closes the connection.
+func (w *WorkerWS) deferHello(header *RequestHeader,
+	retryAfter time.Duration) (err error) {
+
+	// Round up, so that the client doesn't retry just before its wave opens.
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	status, message := ErrToStatus(ErrNotAdmitted)
+	reply := fmt.Sprintf(
+		`{"messageType":%q,"status":%d,"error":%q,"retryAfter":%d}`,
+		header.Type, status, message, seconds)
+	w.metrics.Increment("updates.client.hello.deferred")
+	if w.logger.ShouldLog(DEBUG) {
+		w.logger.Debug("worker", "Deferring client handshake",
+			LogFields{"rid": w.logID, "retryAfter": strconv.FormatInt(seconds, 10)})
+	}
+	err = w.WriteText(reply)
+	w.stop()
+	return err
+}
+
+// sendInitialSettings pushes settings to a newly connected client: the
+// settings last pushed by the operator, if any, or the ping interval advised
+// for the client's network.
+func (w *WorkerWS) sendInitialSettings() {
+	settings := w.app.ClientSettings()
+	if settings == nil && w.advisor != nil {
+		interval, ok := w.advisor.Advise(w.network)
+		if !ok || interval == w.idleInt {
+			return
+		}
+		settings = &ClientSettings{PingInterval: int64(interval / time.Second)}
+	}
+	if settings == nil {
+		return
+	}
+	w.SendSettings(settings)
+}
+
+// SendSettings implements SettingsSender.SendSettings.
+func (w *WorkerWS) SendSettings(settings *ClientSettings) (err error) {
+	if w.UAID() == "" {
+		return ErrNoHandshake
+	}
+	reply := *settings
+	reply.Type = "settings"
+	if err = w.WriteJSON(reply); err != nil {
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker", "Error sending client settings",
+				LogFields{"rid": w.logID, "error": err.Error()})
+		}
+		return err
+	}
+	w.metrics.Increment("updates.client.settings")
+	return nil
+}
+
+// SendGoAway implements GoAwaySender.SendGoAway.
+func (w *WorkerWS) SendGoAway(retryAfter time.Duration) (err error) {
+	if w.UAID() == "" {
+		return ErrNoHandshake
+	}
+	reply := GoAway{"goaway", http.StatusServiceUnavailable,
+		int64(retryAfter / time.Second)}
+	if err = w.WriteJSON(reply); err != nil {
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker", "Error sending goaway",
+				LogFields{"rid": w.logID, "error": err.Error()})
+		}
+		return err
+	}
+	// Start the closing handshake with status 1001, so that clients that
+	// ignore the goaway frame still disconnect.
+	sc, ok := w.Socket.(StatusCloser)
+	if !ok {
+		return nil
+	}
+	w.setWriteDeadline()
+	if err = sc.SendClose(CloseGoingAway); err != nil {
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker", "Error sending close frame",
+				LogFields{"rid": w.logID, "error": err.Error()})
+		}
+		return err
+	}
+	return nil
+}
+
+// keepAliveParams returns the advertised ping interval and maximum silent
+// period, in seconds, as additional handshake reply fields.
+func (w *WorkerWS) keepAliveParams() string {
+	var params string
+	if w.idleInt > 0 {
+		params += fmt.Sprintf(`,"pingInterval":%d`, int64(w.idleInt/time.Second))
+	}
+	if w.maxSilence > 0 {
+		params += fmt.Sprintf(`,"maxSilence":%d`, int64(w.maxSilence/time.Second))
+	}
+	return params
+}
+
 // registerDevice adds the worker to the worker map and registers the
 // connecting client with the router.
 func (w *WorkerWS) registerDevice(header *RequestHeader,
 	request *HelloRequest) (wroteReply bool, err error) {
 
-	uaid, allowRedirect, err := w.handshake(request)
+	uaid, allowRedirect, err := w.timedHandshake(request)
 	if err != nil {
 		return false, err
 	}
+	if w.abuse != nil && w.abuse.Banned(BanUAID, uaid) {
+		if w.logger.ShouldLog(NOTICE) {
+			w.logger.Notice("worker", "Rejecting banned device",
+				LogFields{"rid": w.logID, "uaid": uaid})
+		}
+		w.metrics.Increment("updates.client.hello.banned")
+		return false, ErrBanned
+	}
+	if uaid != w.UAID() {
+		region, err := w.app.Residency().Admit(uaid)
+		if err == ErrWrongRegion {
+			if url := w.app.Residency().URL(region); len(url) > 0 {
+				// Send the client to its region's nodes.
+				w.SetUAID(uaid)
+				w.writeRedirect(header, url)
+				return true, nil
+			}
+		}
+		if err != nil {
+			return false, err
+		}
+	}
 	w.SetUAID(uaid)
 	if allowRedirect {
+		origin, redirect := w.affinity.Hint(uaid)
+		if redirect {
+			w.writeRedirect(header, origin)
+			return true, nil
+		}
 		if wroteReply = w.checkRedirect(header); wroteReply {
 			return
 		}
+		w.affinity.Record(uaid, origin)
 	}
 	// register any proprietary connection requirements
 	w.registerPropPing([]byte(request.PingData))
@@ -424,18 +937,84 @@ func (w *WorkerWS) registerDevice(header *RequestHeader,
 		// Avoid re-registration for duplicate handshakes.
 		w.app.Router().Register(uaid)
 	}
+	w.recordConnect(uaid)
 	w.logger.Info("worker", "Client registered", nil)
 	return false, nil
 }
 
-// handshake performs the opening handshake.
-func (w *WorkerWS) handshake(request *HelloRequest) (
+// handshakeResult is the outcome of an opening handshake.
+type handshakeResult struct {
+	deviceID      string
+	allowRedirect bool
+	err           error
+	crash         *CrashReport // Set if the handshake panicked.
+}
+
+// timedHandshake performs the opening handshake, returning
+// ErrHandshakeTimeout if it does not complete within the handshake timeout.
+// This keeps a slow store from blocking the worker indefinitely. Store calls
+// can't be interrupted, so the abandoned handshake finishes its current call
+// in the background, then stops before making any further changes.
+func (w *WorkerWS) timedHandshake(request *HelloRequest) (
+	deviceID string, allowRedirect bool, err error) {
+
+	if w.shakeTimeout <= 0 {
+		return w.handshake(request, nil)
+	}
+	results := make(chan handshakeResult, 1)
+	cancel := make(chan bool)
+	w.goroutines.Go("handshake", func() {
+		defer func() {
+			if r := recover(); r != nil {
+				// Charged by the worker's goroutine, which owns the
+				// worker state.
+				results <- handshakeResult{err: ErrInvalidParams,
+					crash: w.crashReport("hello", r)}
+			}
+		}()
+		deviceID, allowRedirect, err := w.handshake(request, cancel)
+		results <- handshakeResult{deviceID, allowRedirect, err, nil}
+	})
+	timer := clock.NewTimer(w.shakeTimeout)
+	defer timer.Stop()
+	select {
+	case result := <-results:
+		if result.crash != nil {
+			w.chargeCrash(result.crash)
+		}
+		return result.deviceID, result.allowRedirect, result.err
+	case <-timer.C():
+	}
+	close(cancel)
+	if w.logger.ShouldLog(WARNING) {
+		w.logger.Warn("worker", "Timed out completing client handshake",
+			LogFields{"rid": w.logID, "timeout": w.shakeTimeout.String()})
+	}
+	w.metrics.Increment("updates.client.hello.timeout")
+	return "", false, ErrHandshakeTimeout
+}
+
+// handshakeCanceled indicates whether a timed handshake was abandoned. A
+// nil cancel channel is never canceled.
+func handshakeCanceled(cancel <-chan bool) bool {
+	select {
+	case <-cancel:
+		return true
+	default:
+	}
+	return false
+}
+
+// handshake performs the opening handshake. If cancel is closed, handshake
+// returns ErrHandshakeTimeout before dropping channels, disconnecting other
+// clients, or tagging new device IDs.
+func (w *WorkerWS) handshake(request *HelloRequest, cancel <-chan bool) (
 	deviceID string, allowRedirect bool, err error) {
 
 	logWarning := w.logger.ShouldLog(WARNING)
 	currentID := w.UAID()
 
-	if request.ChannelIDs == nil {
+	if !request.ChannelIDs.Sent {
 		// Must include "channelIDs" (even if empty)
 		if logWarning {
 			w.logger.Warn("worker", "Missing ChannelIDs",
@@ -446,13 +1025,13 @@ func (w *WorkerWS) handshake(request *HelloRequest) (
 
 	if len(currentID) > 0 {
 		if len(request.DeviceID) == 0 || currentID == request.DeviceID {
-			// Duplicate handshake with omitted or identical device ID. Allow the
-			// caller to flush pending notifications, but avoid querying the balancer.
+			// Duplicate handshake with omitted or identical device ID. Avoid
+			// querying the balancer.
 			if w.logger.ShouldLog(DEBUG) {
 				w.logger.Debug("worker", "Duplicate client handshake",
 					LogFields{"rid": w.logID})
 			}
-			return currentID, false, nil
+			return w.dupeHandshake(currentID, request, cancel)
 		}
 		// if there's already a Uaid for this device, don't accept a new one
 		if logWarning {
@@ -479,18 +1058,32 @@ func (w *WorkerWS) handshake(request *HelloRequest) (
 		}
 		goto forceReset
 	}
-	if !w.store.CanStore(len(request.ChannelIDs)) {
+	if !w.canStoreChannels(request.ChannelIDs.Count) {
 		// are there a suspicious number of channels?
 		if logWarning {
 			w.logger.Warn("worker",
 				"Too many channel IDs in handshake; resetting UAID", LogFields{
 					"rid":      w.logID,
 					"uaid":     request.DeviceID,
-					"channels": strconv.Itoa(len(request.ChannelIDs))})
+					"channels": strconv.Itoa(request.ChannelIDs.Count)})
+		}
+		if handshakeCanceled(cancel) {
+			return "", false, ErrHandshakeTimeout
 		}
 		w.store.DropAll(request.DeviceID)
 		goto forceReset
 	}
+	if handshakeCanceled(cancel) {
+		return "", false, ErrHandshakeTimeout
+	}
+	if ok, err := w.checkTenant(request.DeviceID); err != nil {
+		return "", false, err
+	} else if !ok {
+		goto forceReset
+	}
+	if handshakeCanceled(cancel) {
+		return "", false, ErrHandshakeTimeout
+	}
 	prevWorker, workerConnected = w.app.GetWorker(request.DeviceID)
 	if workerConnected {
 		if w.logger.ShouldLog(INFO) {
@@ -499,7 +1092,7 @@ func (w *WorkerWS) handshake(request *HelloRequest) (
 		}
 		prevWorker.Close()
 	}
-	if len(request.ChannelIDs) > 0 && !w.store.Exists(request.DeviceID) {
+	if request.ChannelIDs.Count > 0 && !w.store.Exists(request.DeviceID) {
 		if logWarning {
 			w.logger.Warn("worker",
 				"Channel IDs specified in handshake for nonexistent UAID",
@@ -510,12 +1103,92 @@ func (w *WorkerWS) handshake(request *HelloRequest) (
 	return request.DeviceID, true, nil
 
 forceReset:
+	if handshakeCanceled(cancel) {
+		return "", false, ErrHandshakeTimeout
+	}
 	if deviceID, err = idGenerate(); err != nil {
 		return "", false, err
 	}
+	if err = w.tagTenant(deviceID); err != nil {
+		return "", false, err
+	}
 	return deviceID, true, nil
 }
 
+// dupeHandshake handles a repeated handshake for the current device ID,
+// according to the worker's duplicate hello mode. Like handshake, it stops if
+// cancel is closed.
+func (w *WorkerWS) dupeHandshake(currentID string, request *HelloRequest,
+	cancel <-chan bool) (deviceID string, allowRedirect bool, err error) {
+
+	switch w.dupeHello {
+	case DupeHelloError:
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker", "Rejecting duplicate client handshake",
+				LogFields{"rid": w.logID, "uaid": currentID})
+		}
+		return "", false, ErrExistingID
+
+	case DupeHelloResync:
+		if w.reconcileChannels(currentID, request) {
+			return currentID, false, nil
+		}
+		if handshakeCanceled(cancel) {
+			return "", false, ErrHandshakeTimeout
+		}
+		// The client's channels are stale. Deregister the current device ID;
+		// the caller will register the new ID with the router.
+		if removed := w.app.RemoveWorker(currentID, w); removed {
+			w.app.Router().Unregister(currentID)
+		}
+		if deviceID, err = idGenerate(); err != nil {
+			return "", false, err
+		}
+		if err = w.tagTenant(deviceID); err != nil {
+			return "", false, err
+		}
+		return deviceID, false, nil
+	}
+
+	return currentID, false, nil
+}
+
+// canStoreChannels indicates whether a handshake may include the specified
+// number of channel IDs.
+func (w *WorkerWS) canStoreChannels(channels int) bool {
+	if w.maxChannels > 0 && channels > w.maxChannels {
+		w.metrics.Increment("updates.client.hello.max_channels")
+		return false
+	}
+	return w.store.CanStore(channels)
+}
+
+// reconcileChannels indicates whether the channels sent by a resyncing client
+// are consistent with the store.
+func (w *WorkerWS) reconcileChannels(uaid string, request *HelloRequest) bool {
+	logWarning := w.logger.ShouldLog(WARNING)
+	if !w.canStoreChannels(request.ChannelIDs.Count) {
+		if logWarning {
+			w.logger.Warn("worker",
+				"Too many channel IDs in resync; resetting UAID", LogFields{
+					"rid":      w.logID,
+					"uaid":     uaid,
+					"channels": strconv.Itoa(request.ChannelIDs.Count)})
+		}
+		w.store.DropAll(uaid)
+		return false
+	}
+	if request.ChannelIDs.Count > 0 && !w.store.Exists(uaid) {
+		if logWarning {
+			w.logger.Warn("worker",
+				"Channel IDs specified in resync for nonexistent UAID",
+				LogFields{"rid": w.logID, "uaid": uaid})
+		}
+		return false
+	}
+	return true
+}
+
 // checkRedirect determines if a connecting client should be redirected to a
 // different host. wroteReply indicates whether checkRedirect responded to the
 // client; if so, the caller should close the connection.
@@ -539,14 +1212,19 @@ func (w *WorkerWS) checkRedirect(header *RequestHeader) (wroteReply bool) {
 	if !shouldRedirect {
 		return false
 	}
+	w.writeRedirect(header, origin)
+	return true
+}
+
+// writeRedirect redirects a connecting client to the host at origin.
+func (w *WorkerWS) writeRedirect(header *RequestHeader, origin string) {
 	if w.logger.ShouldLog(DEBUG) {
 		w.logger.Debug("worker", "Redirecting client", LogFields{
 			"rid": w.logID, "cmd": header.Type, "origin": origin})
 	}
 	reply := fmt.Sprintf(`{"messageType":%q,"uaid":%q,"status":307,"redirect":%q}`,
-		header.Type, uaid, origin)
+		header.Type, w.UAID(), origin)
 	w.WriteText(reply)
-	return true
 }
 
 // registerPropPing registers the client with the proprietary pinger if one is
@@ -571,17 +1249,7 @@ func (w *WorkerWS) registerPropPing(connect []byte) (err error) {
 // Clear the data that the client stated it received, then re-flush any
 // records (including new data)
 func (w *WorkerWS) Ack(_ *RequestHeader, message []byte) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			if err, _ := r.(error); err != nil && w.logger.ShouldLog(ERROR) {
-				stack := make([]byte, 1<<16)
-				n := runtime.Stack(stack, false)
-				w.logger.Error("worker", "Unhandled error", LogFields{"rid": w.logID,
-					"cmd": "ack", "error": ErrStr(err), "stack": string(stack[:n])})
-			}
-			err = ErrInvalidParams
-		}
-	}()
+	defer w.recoverCommand("ack", &err)
 	uaid := w.UAID()
 	if uaid == "" {
 		return ErrNoHandshake
@@ -594,7 +1262,14 @@ func (w *WorkerWS) Ack(_ *RequestHeader, message []byte) (err error) {
 		return ErrNoParams
 	}
 	w.metrics.Increment("updates.client.ack")
+	w.seq.Ack(request.Seq, request.Updates, request.Expired)
+	w.resume.acked(request.Updates, request.Expired)
+	w.redelivery.Acked(request.Updates, request.Expired)
 	for _, update := range request.Updates {
+		if w.localWrites != nil {
+			// Don't store an acknowledged update after it's dropped.
+			w.localWrites.Acked(uaid, update.ChannelID, int64(update.Version))
+		}
 		if err = w.store.Drop(uaid, update.ChannelID); err != nil {
 			goto logError
 		}
@@ -620,33 +1295,29 @@ logError:
 
 // Register a new ChannelID. Optionally, encrypt the endpoint.
 func (w *WorkerWS) Register(header *RequestHeader, message []byte) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			if err, _ := r.(error); err != nil && w.logger.ShouldLog(ERROR) {
-				stack := make([]byte, 1<<16)
-				n := runtime.Stack(stack, false)
-				w.logger.Error("worker", "Unhandled error", LogFields{"rid": w.logID,
-					"cmd": "register", "error": ErrStr(err), "stack": string(stack[:n])})
-			}
-			err = ErrInvalidParams
-		}
-	}()
+	defer w.recoverCommand("register", &err)
 
 	uaid := w.UAID()
 	if uaid == "" {
 		return ErrNoHandshake
 	}
+	if w.registerFlood(timeNow()) {
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker", "Client sending too many registrations",
+				LogFields{"rid": w.logID, "uaid": uaid,
+					"limit": strconv.Itoa(len(w.regTimes)), "window": w.regWindow.String()})
+		}
+		w.stop()
+		w.metrics.Increment("updates.client.too_many_registers")
+		w.reportAbuse(ViolationRegister)
+		return ErrTooManyRegisters
+	}
 	request := new(RegisterRequest)
 	if err = json.Unmarshal(message, request); err != nil || !id.Valid(request.ChannelID) {
 		return ErrInvalidParams
 	}
-	if err = w.store.Register(uaid, request.ChannelID, 0); err != nil {
-		if w.logger.ShouldLog(WARNING) {
-			w.logger.Warn("worker", "Register failed, error updating backing store",
-				LogFields{"rid": w.logID, "cmd": "register", "error": ErrStr(err)})
-		}
-		return err
-	}
+	// Generate the endpoint before storing the channel, so that a failure
+	// doesn't leave a registered channel without an endpoint.
 	key, err := w.store.IDsToKey(uaid, request.ChannelID)
 	if err != nil {
 		if w.logger.ShouldLog(WARNING) {
@@ -655,7 +1326,16 @@ func (w *WorkerWS) Register(header *RequestHeader, message []byte) (err error) {
 		}
 		return err
 	}
-	endpoint, err := w.app.CreateEndpoint(key)
+	var endpoint string
+	if bridge := w.app.Bridge(); bridge != nil {
+		// Use the upstream endpoint, so that app servers send updates through
+		// the upstream service.
+		endpoint, err = bridge.Register(uaid, request.ChannelID)
+	} else if w.virtual != nil {
+		endpoint, err = w.virtual.CreateEndpoint(key)
+	} else {
+		endpoint, err = w.app.CreateEndpoint(key)
+	}
 	if err != nil {
 		if w.logger.ShouldLog(WARNING) {
 			w.logger.Warn("worker", "Error registering endpoint", LogFields{
@@ -666,6 +1346,13 @@ func (w *WorkerWS) Register(header *RequestHeader, message []byte) (err error) {
 		}
 		return err
 	}
+	if err = w.store.Register(uaid, request.ChannelID, 0); err != nil {
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker", "Register failed, error updating backing store",
+				LogFields{"rid": w.logID, "cmd": "register", "error": ErrStr(err)})
+		}
+		return err
+	}
 	status, _ := ErrToStatus(err)
 	if w.logger.ShouldLog(DEBUG) {
 		w.logger.Debug("worker", "Server returned", LogFields{
@@ -685,25 +1372,49 @@ func (w *WorkerWS) Register(header *RequestHeader, message []byte) (err error) {
 			"channelID":    request.ChannelID,
 			"pushEndpoint": endpoint})
 	}
-	w.WriteJSON(RegisterReply{header.Type, uaid, status, request.ChannelID, endpoint})
+	if err = w.WriteJSON(RegisterReply{header.Type, uaid, status,
+		request.ChannelID, endpoint}); err != nil {
+
+		// The client never received the endpoint; roll back the registration.
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker", "Error sending endpoint; dropping channel",
+				LogFields{"rid": w.logID, "uaid": uaid, "chid": request.ChannelID,
+					"error": ErrStr(err)})
+		}
+		w.store.Drop(uaid, request.ChannelID)
+		return err
+	}
 	w.metrics.Increment("updates.client.register")
 	return nil
 }
 
+// registerFlood records a registration at now, and indicates whether the
+// client has exceeded the maximum number of registrations within the sliding
+// window. The limit is enforced per connection: the worker keeps the times of
+// the most recent registrations, and rejects a registration if the oldest of
+// them falls within the window.
+func (w *WorkerWS) registerFlood(now time.Time) bool {
+	if w.regTimes == nil {
+		var limit int
+		limit, w.regWindow = w.app.Tenants().RegisterLimit(
+			tenantName(w.virtual), w.app.maxRegisters, w.regWindow)
+		if limit <= 0 {
+			return false
+		}
+		w.regTimes = make([]time.Time, limit)
+	}
+	if oldest := w.regTimes[w.regNext]; !oldest.IsZero() && now.Sub(oldest) < w.regWindow {
+		return true
+	}
+	w.regTimes[w.regNext] = now
+	w.regNext = (w.regNext + 1) % len(w.regTimes)
+	return false
+}
+
 // Unregister a ChannelID.
 func (w *WorkerWS) Unregister(header *RequestHeader, message []byte) (err error) {
 	logWarning := w.logger.ShouldLog(WARNING)
-	defer func() {
-		if r := recover(); r != nil {
-			if err, _ := r.(error); err != nil && w.logger.ShouldLog(ERROR) {
-				stack := make([]byte, 1<<16)
-				n := runtime.Stack(stack, false)
-				w.logger.Error("worker", "Unhandled error", LogFields{"rid": w.logID,
-					"cmd": "register", "error": ErrStr(err), "stack": string(stack[:n])})
-			}
-			err = ErrInvalidParams
-		}
-	}()
+	defer w.recoverCommand("unregister", &err)
 	uaid := w.UAID()
 	if uaid == "" {
 		if logWarning {
@@ -723,6 +1434,12 @@ func (w *WorkerWS) Unregister(header *RequestHeader, message []byte) (err error)
 		}
 		return ErrNoParams
 	}
+	if bridge := w.app.Bridge(); bridge != nil {
+		bridge.Unregister(uaid, request.ChannelID)
+	}
+	if ti, ok := w.app.EndpointHandler().(TokenInvalidator); ok {
+		ti.InvalidateTokens(uaid, request.ChannelID)
+	}
 	// Always return success for an UNREG.
 	if err = w.store.Unregister(uaid, request.ChannelID); err != nil {
 		if logWarning {
@@ -773,14 +1490,9 @@ func (w *WorkerWS) Send(chid string, version int64, data string) (err error) {
 			pinger.Send(uaid, version, data)
 		}
 		err = fmt.Errorf("Error sending update: %#v", r)
-		if w.logger.ShouldLog(ERROR) {
-			stack := make([]byte, 1<<16)
-			n := runtime.Stack(stack, false)
-			w.logger.Error("worker", "Panic sending update",
-				LogFields{"error": ErrStr(err),
-					"uaid":  uaid,
-					"stack": string(stack[:n])})
-		}
+		// Send runs on the router's goroutine, and updates come from app
+		// servers, so the crash is reported without charging the client.
+		w.crashReport("notification", r)
 	}()
 	if w.logger.ShouldLog(DEBUG) {
 		w.logger.Debug("worker", "Sending update to client", LogFields{
@@ -790,11 +1502,100 @@ func (w *WorkerWS) Send(chid string, version int64, data string) (err error) {
 			"version": strconv.FormatInt(version, 10),
 		})
 	}
+	if !w.dedupe.Allow(chid, uint64(version)) {
+		// Already delivered by a pending update flush or another route.
+		w.metrics.Increment("updates.deduplicated")
+		return nil
+	}
+	if held := w.doze.Release(); len(held) > 0 {
+		// Held low-priority updates are sent before the next normal update.
+		w.sendHeld(held)
+	}
+	update := Update{chid, uint64(version), data, false}
+	if w.coalesce.Hold(update) {
+		// Sent with the updates routed within the coalescing window.
+		return nil
+	}
 	// hand craft a notification update to the client.
-	// TODO: allow bulk updates.
-	updates := []Update{{chid, uint64(version), data}}
-	w.WriteJSON(FlushReply{"notification", updates, nil})
+	updates := []Update{update}
+	if !w.resume.sent(updates, nil) {
+		// The connection closed after the update was routed here.
+		w.sessions.Missed(uaid)
+	}
+	w.redelivery.Sent(updates, nil)
+	w.WriteJSON(FlushReply{"notification", updates, nil,
+		w.seq.Next(updates, nil), w.skew.Stamp()})
+	w.rtt.Sent()
 	w.metrics.Increment("updates.sent")
+	w.traffic.Update(chid)
+	return nil
+}
+
+// Defer holds a low-priority update if the client is dozing. Returns false if
+// the update was not held, and should be sent. Implements
+// DeferredSender.Defer().
+func (w *WorkerWS) Defer(chid string, version int64, data string) bool {
+	if w.doze == nil || len(w.UAID()) == 0 {
+		return false
+	}
+	deferred, due := w.doze.Defer(Update{chid, uint64(version), data, false})
+	if len(due) > 0 {
+		// Too many held updates; send them now.
+		w.sendHeld(due)
+	}
+	return deferred
+}
+
+// sendHeld sends updates held for a dozing client.
+func (w *WorkerWS) sendHeld(updates []Update) {
+	allowed := updates[:0]
+	for _, update := range updates {
+		if w.dedupe.Allow(update.ChannelID, update.Version) {
+			allowed = append(allowed, update)
+		}
+	}
+	if len(allowed) == 0 {
+		return
+	}
+	w.sendUpdates(allowed)
+}
+
+// sendUpdates sends updates to the client in one notification.
+func (w *WorkerWS) sendUpdates(updates []Update) {
+	if !w.resume.sent(updates, nil) {
+		w.sessions.Missed(w.UAID())
+	}
+	w.redelivery.Sent(updates, nil)
+	if err := w.WriteJSON(FlushReply{"notification", updates, nil,
+		w.seq.Next(updates, nil), w.skew.Stamp()}); err != nil {
+		return
+	}
+	w.rtt.Sent()
+	w.metrics.IncrementBy("updates.sent", int64(len(updates)))
+	for _, update := range updates {
+		w.traffic.Update(update.ChannelID)
+	}
+}
+
+// SendExpired implements ExpiredSender.SendExpired. Clients acknowledge
+// expired channels like pending updates.
+func (w *WorkerWS) SendExpired(chids ...string) (err error) {
+	if w.UAID() == "" {
+		return ErrNoHandshake
+	}
+	if !w.resume.sent(nil, chids) {
+		w.sessions.Missed(w.UAID())
+	}
+	w.redelivery.Sent(nil, chids)
+	w.rtt.Sent()
+	if err = w.WriteJSON(FlushReply{"notification", nil, chids,
+		w.seq.Next(nil, chids), w.skew.Stamp()}); err != nil {
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker", "Error sending expired channels",
+				LogFields{"rid": w.logID, "error": err.Error()})
+		}
+		return err
+	}
 	return nil
 }
 
@@ -831,9 +1632,24 @@ func (w *WorkerWS) Flush(lastAccessed int64) (err error) {
 		}
 		return err
 	}
+	// Cap the flush before filtering duplicates, so that held updates aren't
+	// recorded as delivered.
+	updates = w.flushCap.Apply(uaid, tenantName(w.virtual), updates)
+	if pending := len(updates); pending > 0 {
+		updates = w.dedupe.Updates(updates)
+		if dupes := pending - len(updates); dupes > 0 {
+			w.metrics.IncrementBy("updates.deduplicated", int64(dupes))
+		}
+	}
 	if len(updates) == 0 && len(expired) == 0 {
 		return nil
 	}
+	if w.payloads != nil {
+		// Stored payloads include oversized payloads stored by tiering.
+		w.payloads.Attach(uaid, updates)
+	} else {
+		w.tiering.Attach(uaid, updates)
+	}
 	if w.logger.ShouldLog(DEBUG) {
 		logStrings := make([]string, len(updates))
 		for i, update := range updates {
@@ -844,12 +1660,52 @@ func (w *WorkerWS) Flush(lastAccessed int64) (err error) {
 			"rid":     w.logID,
 			"updates": fmt.Sprintf("[%s]", strings.Join(logStrings, ", "))})
 	}
-	w.WriteJSON(FlushReply{"notification", updates, expired})
+	w.resume.sent(updates, expired)
+	w.redelivery.Sent(updates, expired)
+	w.WriteJSON(FlushReply{"notification", updates, expired,
+		w.seq.Next(updates, expired), w.skew.Stamp()})
+	w.rtt.Sent()
 	w.metrics.IncrementBy("updates.sent", int64(len(updates)))
 	return nil
 }
 
-func (w *WorkerWS) Ping(header *RequestHeader, _ []byte) (err error) {
+// redeliver resends updates that the client has not acknowledged within the
+// re-delivery timeout, and reports updates that exhausted their retries.
+// Returns true if any updates were resent, or if the client was disconnected
+// for exceeding the lost update limit.
+func (w *WorkerWS) redeliver() bool {
+	updates, expired, lost := w.redelivery.Due(timeNow())
+	if lost > 0 {
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker", "Client did not acknowledge updates after retries",
+				LogFields{"rid": w.logID, "uaid": w.UAID(), "count": strconv.Itoa(lost)})
+		}
+		w.metrics.IncrementBy("updates.lost", int64(lost))
+		if w.redelivery.Unresponsive() {
+			if w.logger.ShouldLog(INFO) {
+				w.logger.Info("worker", "Client stopped acknowledging updates. Closing socket",
+					LogFields{"rid": w.logID, "uaid": w.UAID()})
+			}
+			w.metrics.Increment("updates.client.unresponsive")
+			w.stop()
+			return true
+		}
+	}
+	if len(updates) == 0 && len(expired) == 0 {
+		return false
+	}
+	// Resent updates bypass the delivery filter, which would suppress them as
+	// duplicates.
+	if err := w.WriteJSON(FlushReply{"notification", updates, expired,
+		w.seq.Next(updates, expired), w.skew.Stamp()}); err != nil {
+		return false
+	}
+	w.rtt.Sent()
+	w.metrics.IncrementBy("updates.redelivered", int64(len(updates)+len(expired)))
+	return true
+}
+
+func (w *WorkerWS) Ping(header *RequestHeader, message []byte) (err error) {
 	now := timeNow()
 	if w.pingInt > 0 && !w.lastPing.IsZero() && now.Sub(w.lastPing) < w.pingInt {
 		if w.logger.ShouldLog(WARNING) {
@@ -862,9 +1718,21 @@ func (w *WorkerWS) Ping(header *RequestHeader, _ []byte) (err error) {
 		}
 		w.stop()
 		w.metrics.Increment("updates.client.too_many_pings")
+		w.reportAbuse(ViolationPing)
 		return ErrTooManyPings
 	}
 	w.lastPing = now
+	if w.skew != nil || w.doze != nil {
+		request := new(PingRequest)
+		if json.Unmarshal(message, request) == nil {
+			if w.skew != nil {
+				w.skew.Observe(request.Time, w.rtt.SRTT())
+			}
+			if due := w.doze.Observe(request.Hints); len(due) > 0 {
+				w.sendHeld(due)
+			}
+		}
+	}
 	if w.app.pushLongPongs {
 		w.WriteJSON(PingReply{header.Type, 200})
 	} else {
@@ -874,6 +1742,37 @@ func (w *WorkerWS) Ping(header *RequestHeader, _ []byte) (err error) {
 	return nil
 }
 
+// Purge removes all stored data for the client's device, as for an erasure
+// request, but keeps the client connected. Purge is a testing aid; unless
+// allow_purge is set, it's acknowledged with "{}" and ignored, as in earlier
+// versions.
+func (w *WorkerWS) Purge(header *RequestHeader, _ []byte) (err error) {
+	if !w.app.Tenants().Feature(tenantName(w.virtual), "purge", w.app.allowPurge) {
+		return w.WriteText("{}")
+	}
+	uaid := w.UAID()
+	if uaid == "" {
+		return ErrNoHandshake
+	}
+	status := 200
+	_, err = storeDataEraser(w.store).EraseDevice(uaid)
+	if r := w.app.Router(); r != nil {
+		// Erasing removes the device's route; record it again, since the
+		// client is still connected to this node.
+		r.Register(uaid)
+	}
+	if err != nil {
+		if w.logger.ShouldLog(WARNING) {
+			w.logger.Warn("worker", "Purge failed, error updating backing store",
+				LogFields{"rid": w.logID, "uaid": uaid, "error": ErrStr(err)})
+		}
+		status, _ = ErrToStatus(err)
+	} else {
+		w.metrics.Increment("updates.client.purge")
+	}
+	return w.WriteJSON(PurgeReply{header.Type, status})
+}
+
 // Close removes worker from the worker map, deregisters the client from the
 // router, and closes the underlying socket. Invoking Close multiple times for
 // the same worker is a no-op.
@@ -899,8 +1798,12 @@ func (w *WorkerWS) Close() error {
 	// woken when not connected.
 	if removed := w.app.RemoveWorker(uaid, w); removed {
 		w.app.Router().Unregister(uaid)
+		w.parkSession(uaid)
 	}
-	return w.Socket.Close()
+	err := w.Socket.Close()
+	// Goroutines spawned for this connection should have exited.
+	w.goroutines.Close()
+	return err
 }
 
 func isPingBody(raw []byte) bool {
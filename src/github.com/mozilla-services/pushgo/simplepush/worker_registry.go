@@ -0,0 +1,161 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// workerShards is the number of worker map shards. Must be a power of 2.
+// Writers copy an entire shard, so this should keep shards small: with 200k
+// connected clients, each shard holds about 50 workers.
+const workerShards = 4096
+
+// workerEntryBytes approximates the size of a registered worker, excluding
+// its socket and goroutine stacks.
+const workerEntryBytes = int64(unsafe.Sizeof(WorkerWS{}))
+
+// WorkerRegistry maps device IDs to connected workers. The registry is
+// sharded by device ID, and each shard publishes an immutable snapshot of
+// its map. Lookups load the current snapshot without locking; writers copy
+// the shard, modify the copy, and publish it (read-copy-update). This keeps
+// routed deliveries from contending with client registrations.
+type WorkerRegistry struct {
+	shards [workerShards]workerShard
+	count  int32
+}
+
+type workerShard struct {
+	sync.Mutex                // Serializes writers.
+	workers    unsafe.Pointer // *map[string]Worker; read atomically.
+}
+
+// NewWorkerRegistry returns an empty worker registry.
+func NewWorkerRegistry() *WorkerRegistry {
+	r := new(WorkerRegistry)
+	for i := range r.shards {
+		workers := make(map[string]Worker)
+		r.shards[i].workers = unsafe.Pointer(&workers)
+	}
+	return r
+}
+
+// shard returns the shard for uaid, using the FNV-1a hash of the device ID.
+func (r *WorkerRegistry) shard(uaid string) *workerShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(uaid); i++ {
+		h ^= uint32(uaid[i])
+		h *= 16777619
+	}
+	return &r.shards[h&(workerShards-1)]
+}
+
+// load returns the current snapshot of the shard. The returned map must not
+// be modified.
+func (s *workerShard) load() map[string]Worker {
+	return *(*map[string]Worker)(atomic.LoadPointer(&s.workers))
+}
+
+// store publishes a new snapshot of the shard. The caller must hold the
+// shard lock.
+func (s *workerShard) store(workers map[string]Worker) {
+	atomic.StorePointer(&s.workers, unsafe.Pointer(&workers))
+}
+
+// copyWith returns a copy of the shard map with room for delta entries.
+func (s *workerShard) copyWith(delta int) map[string]Worker {
+	prev := s.load()
+	workers := make(map[string]Worker, len(prev)+delta)
+	for uaid, worker := range prev {
+		workers[uaid] = worker
+	}
+	return workers
+}
+
+// Len returns the number of registered workers.
+func (r *WorkerRegistry) Len() int {
+	return int(atomic.LoadInt32(&r.count))
+}
+
+// MemoryUsage returns the approximate bytes held by registered workers.
+// Implements MemorySizer.
+func (r *WorkerRegistry) MemoryUsage() int64 {
+	return int64(r.Len()) * (mapEntryBytes + idBytes + workerEntryBytes)
+}
+
+// Get returns the worker for uaid. Get never blocks.
+func (r *WorkerRegistry) Get(uaid string) (worker Worker, ok bool) {
+	worker, ok = r.shard(uaid).load()[uaid]
+	return
+}
+
+// Add registers worker for uaid, replacing any existing worker. replaced
+// indicates whether a worker was already registered for uaid.
+func (r *WorkerRegistry) Add(uaid string, worker Worker) (replaced bool) {
+	s := r.shard(uaid)
+	s.Lock()
+	if prevWorker, ok := s.load()[uaid]; ok && prevWorker == worker {
+		// Duplicate registration; avoid copying the shard.
+		s.Unlock()
+		return true
+	}
+	workers := s.copyWith(1)
+	_, replaced = workers[uaid]
+	workers[uaid] = worker
+	s.store(workers)
+	s.Unlock()
+	if !replaced {
+		atomic.AddInt32(&r.count, 1)
+	}
+	return
+}
+
+// Remove deregisters uaid if it is registered to worker. removed indicates
+// whether the worker was registered.
+func (r *WorkerRegistry) Remove(uaid string, worker Worker) (removed bool) {
+	s := r.shard(uaid)
+	s.Lock()
+	if prevWorker, ok := s.load()[uaid]; ok && prevWorker == worker {
+		workers := s.copyWith(0)
+		delete(workers, uaid)
+		s.store(workers)
+		removed = true
+	}
+	s.Unlock()
+	if removed {
+		atomic.AddInt32(&r.count, -1)
+	}
+	return
+}
+
+// Workers returns a point-in-time list of registered workers.
+func (r *WorkerRegistry) Workers() []Worker {
+	workers := make([]Worker, 0, r.Len())
+	for i := range r.shards {
+		for _, worker := range r.shards[i].load() {
+			workers = append(workers, worker)
+		}
+	}
+	return workers
+}
+
+// Drain deregisters and returns all workers.
+func (r *WorkerRegistry) Drain() []Worker {
+	var workers []Worker
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.Lock()
+		prev := s.load()
+		s.store(make(map[string]Worker))
+		s.Unlock()
+		for _, worker := range prev {
+			workers = append(workers, worker)
+		}
+		atomic.AddInt32(&r.count, -int32(len(prev)))
+	}
+	return workers
+}
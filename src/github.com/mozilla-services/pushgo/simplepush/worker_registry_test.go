@@ -0,0 +1,171 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWorkerRegistry(t *testing.T) {
+	Convey("Worker registry", t, func() {
+		r := NewWorkerRegistry()
+		uaid := "b6b1cb9ad6624b4bb5a9d0b2a6f1b7d4"
+		worker := &NoWorker{uaid: uaid}
+
+		Convey("Should add and look up workers", func() {
+			So(r.Add(uaid, worker), ShouldBeFalse)
+			So(r.Len(), ShouldEqual, 1)
+			actual, ok := r.Get(uaid)
+			So(ok, ShouldBeTrue)
+			So(actual, ShouldEqual, worker)
+		})
+
+		Convey("Should not count duplicate registrations", func() {
+			r.Add(uaid, worker)
+			So(r.Add(uaid, worker), ShouldBeTrue)
+			So(r.Add(uaid, &NoWorker{uaid: uaid}), ShouldBeTrue)
+			So(r.Len(), ShouldEqual, 1)
+		})
+
+		Convey("Should only remove matching workers", func() {
+			r.Add(uaid, worker)
+			So(r.Remove(uaid, &NoWorker{uaid: uaid}), ShouldBeFalse)
+			So(r.Len(), ShouldEqual, 1)
+			So(r.Remove(uaid, worker), ShouldBeTrue)
+			So(r.Len(), ShouldEqual, 0)
+			_, ok := r.Get(uaid)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Should not modify published snapshots", func() {
+			r.Add(uaid, worker)
+			snapshot := r.shard(uaid).load()
+			r.Remove(uaid, worker)
+			So(snapshot, ShouldContainKey, uaid)
+		})
+
+		Convey("Should drain all workers", func() {
+			for i := 0; i < 100; i++ {
+				r.Add(fmt.Sprintf("%032x", i), &NoWorker{})
+			}
+			So(r.Workers(), ShouldHaveLength, 100)
+			So(r.Drain(), ShouldHaveLength, 100)
+			So(r.Len(), ShouldEqual, 0)
+			So(r.Workers(), ShouldBeEmpty)
+		})
+	})
+}
+
+// mutexWorkerMap is the previous single-lock worker map, kept for
+// comparison benchmarks.
+type mutexWorkerMap struct {
+	sync.RWMutex
+	workers map[string]Worker
+}
+
+func (m *mutexWorkerMap) Get(uaid string) (worker Worker, ok bool) {
+	m.RLock()
+	worker, ok = m.workers[uaid]
+	m.RUnlock()
+	return
+}
+
+func (m *mutexWorkerMap) Add(uaid string, worker Worker) {
+	m.Lock()
+	m.workers[uaid] = worker
+	m.Unlock()
+}
+
+func (m *mutexWorkerMap) Remove(uaid string) {
+	m.Lock()
+	delete(m.workers, uaid)
+	m.Unlock()
+}
+
+const benchWorkers = 200000
+
+func benchIDs() []string {
+	ids := make([]string, benchWorkers)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%032x", i)
+	}
+	return ids
+}
+
+// benchMixed runs a workload of 1 registration per 20 lookups, approximating
+// routed deliveries interleaved with client churn.
+func benchMixed(b *testing.B, get func(string), add func(string), remove func(string)) {
+	ids := benchIDs()
+	for _, uaid := range ids {
+		add(uaid)
+	}
+	var next uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddUint32(&next, 1)
+			uaid := ids[i%benchWorkers]
+			if i%20 == 0 {
+				remove(uaid)
+				add(uaid)
+				continue
+			}
+			get(uaid)
+		}
+	})
+}
+
+func BenchmarkWorkerRegistryMixed(b *testing.B) {
+	r := NewWorkerRegistry()
+	worker := new(NoWorker)
+	benchMixed(b,
+		func(uaid string) { r.Get(uaid) },
+		func(uaid string) { r.Add(uaid, worker) },
+		func(uaid string) { r.Remove(uaid, worker) })
+}
+
+func BenchmarkWorkerMutexMapMixed(b *testing.B) {
+	m := &mutexWorkerMap{workers: make(map[string]Worker)}
+	worker := new(NoWorker)
+	benchMixed(b,
+		func(uaid string) { m.Get(uaid) },
+		func(uaid string) { m.Add(uaid, worker) },
+		func(uaid string) { m.Remove(uaid) })
+}
+
+func BenchmarkWorkerRegistryGet(b *testing.B) {
+	r := NewWorkerRegistry()
+	ids := benchIDs()
+	for _, uaid := range ids {
+		r.Add(uaid, new(NoWorker))
+	}
+	var next uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			r.Get(ids[atomic.AddUint32(&next, 1)%benchWorkers])
+		}
+	})
+}
+
+func BenchmarkWorkerMutexMapGet(b *testing.B) {
+	m := &mutexWorkerMap{workers: make(map[string]Worker)}
+	ids := benchIDs()
+	for _, uaid := range ids {
+		m.Add(uaid, new(NoWorker))
+	}
+	var next uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			m.Get(ids[atomic.AddUint32(&next, 1)%benchWorkers])
+		}
+	})
+}
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"runtime"
 	"testing"
 	"text/template"
 	"time"
@@ -65,6 +66,36 @@ func TestWorkerRegister(t *testing.T) {
 			So(err, ShouldEqual, ErrInvalidParams)
 		})
 
+		Convey("Should disconnect clients that register too often", func() {
+			app.maxRegisters = 2
+			wws.regWindow = time.Minute
+			wws.SetUAID("5b2c9d4e8f1a4b3c9d0e1f2a3b4c5d6e")
+
+			// Invalid registrations count toward the limit.
+			for i := 0; i < 2; i++ {
+				err := wws.Register(nil, []byte(`{"channelID": "123"}`))
+				So(err, ShouldEqual, ErrInvalidParams)
+			}
+			mckStat.EXPECT().Increment("updates.client.too_many_registers")
+			err := wws.Register(nil, []byte(`{"channelID": "123"}`))
+			So(err, ShouldEqual, ErrTooManyRegisters)
+			So(wws.stopped(), ShouldBeTrue)
+		})
+
+		Convey("Should limit registrations within a sliding window", func() {
+			app.maxRegisters = 3
+			wws.regWindow = time.Minute
+			start := time.Unix(1257894000, 0)
+
+			So(wws.registerFlood(start), ShouldBeFalse)
+			So(wws.registerFlood(start.Add(20*time.Second)), ShouldBeFalse)
+			So(wws.registerFlood(start.Add(40*time.Second)), ShouldBeFalse)
+			So(wws.registerFlood(start.Add(50*time.Second)), ShouldBeTrue)
+			// The first registration falls outside the window.
+			So(wws.registerFlood(start.Add(time.Minute)), ShouldBeFalse)
+			So(wws.registerFlood(start.Add(70*time.Second)), ShouldBeTrue)
+		})
+
 		Convey("Should fail if storage is unavailable", func() {
 			uaid := "d0afa324950511e48aed3c15c2c622fe"
 			wws.SetUAID(uaid)
@@ -72,8 +103,11 @@ func TestWorkerRegister(t *testing.T) {
 			chid := "f2265458950511e49cae3c15c2c622fe"
 			storeErr := errors.New("oops")
 
-			mckStore.EXPECT().Register(uaid, chid,
-				int64(0)).Return(storeErr)
+			gomock.InOrder(
+				mckStore.EXPECT().IDsToKey(uaid, chid).Return("123", nil),
+				mckEndHandler.EXPECT().URL().Return("https://example.com"),
+				mckStore.EXPECT().Register(uaid, chid, int64(0)).Return(storeErr),
+			)
 
 			err := wws.Register(&RequestHeader{Type: "register"}, []byte(
 				`{"channelID":"f2265458950511e49cae3c15c2c622fe"}`))
@@ -87,10 +121,8 @@ func TestWorkerRegister(t *testing.T) {
 			chid := "f6022b9012a74e4ba392f13b86b7d8f6"
 			keyErr := errors.New("universe has imploded")
 
-			gomock.InOrder(
-				mckStore.EXPECT().Register(uaid, chid, int64(0)).Return(nil),
-				mckStore.EXPECT().IDsToKey(uaid, chid).Return("", keyErr),
-			)
+			mckStore.EXPECT().IDsToKey(uaid, chid).Return("", keyErr)
+
 			err := wws.Register(&RequestHeader{Type: "register"}, []byte(
 				`{"channelID":"f6022b9012a74e4ba392f13b86b7d8f6"}`))
 			So(err, ShouldEqual, keyErr)
@@ -104,7 +136,6 @@ func TestWorkerRegister(t *testing.T) {
 
 			app.endpointTemplate = invalidTemplate
 			gomock.InOrder(
-				mckStore.EXPECT().Register(uaid, chid, int64(0)).Return(nil),
 				mckStore.EXPECT().IDsToKey(uaid, chid).Return("123", nil),
 				mckEndHandler.EXPECT().URL().Return("https://example.com"),
 			)
@@ -121,9 +152,9 @@ func TestWorkerRegister(t *testing.T) {
 			chid := "930c80b8950611e4be663c15c2c622fe"
 
 			gomock.InOrder(
-				mckStore.EXPECT().Register(uaid, chid, int64(0)).Return(nil),
 				mckStore.EXPECT().IDsToKey(uaid, chid).Return("123", nil),
 				mckEndHandler.EXPECT().URL().Return("https://example.com"),
+				mckStore.EXPECT().Register(uaid, chid, int64(0)).Return(nil),
 				mckSocket.EXPECT().WriteJSON(RegisterReply{
 					Type:      "register",
 					DeviceID:  uaid,
@@ -138,6 +169,26 @@ func TestWorkerRegister(t *testing.T) {
 				`{"channelID":"930c80b8950611e4be663c15c2c622fe"}`))
 			So(err, ShouldBeNil)
 		})
+
+		Convey("Should drop channels if the endpoint cannot be sent", func() {
+			uaid := "3d2e8e2b6e5d4c5c9f0a1b2c3d4e5f60"
+			wws.SetUAID(uaid)
+
+			chid := "c1d2e3f4a5b64c7d8e9f0a1b2c3d4e5f"
+			writeErr := errors.New("connection reset")
+
+			gomock.InOrder(
+				mckStore.EXPECT().IDsToKey(uaid, chid).Return("123", nil),
+				mckEndHandler.EXPECT().URL().Return("https://example.com"),
+				mckStore.EXPECT().Register(uaid, chid, int64(0)).Return(nil),
+				mckSocket.EXPECT().WriteJSON(gomock.Any()).Return(writeErr),
+				mckStore.EXPECT().Drop(uaid, chid),
+			)
+
+			err := wws.Register(&RequestHeader{Type: "register"}, []byte(
+				`{"channelID":"c1d2e3f4a5b64c7d8e9f0a1b2c3d4e5f"}`))
+			So(err, ShouldEqual, writeErr)
+		})
 	})
 }
 
@@ -186,8 +237,8 @@ func TestWorkerFlush(t *testing.T) {
 			wws.SetUAID(uaid)
 
 			updates := []Update{
-				{"263d09f8950b11e4a1f83c15c2c622fe", 2, "I'm a little teapot"},
-				{"bac9d83a950b11e4bd713c15c2c622fe", 4, "Short and stout"},
+				{"263d09f8950b11e4a1f83c15c2c622fe", 2, "I'm a little teapot", false},
+				{"bac9d83a950b11e4bd713c15c2c622fe", 4, "Short and stout", false},
 			}
 			expired := []string{"c778e94a950b11e4ba7f3c15c2c622fe"}
 
@@ -252,6 +303,14 @@ func TestWorkerSend(t *testing.T) {
 		Convey("Should send a proprietary ping if flush panics", func() {
 			uaid := "4dd3327e8a68462389eb6ab771c05867"
 			wws.SetUAID(uaid)
+			wws.addr = "192.0.2.57:4321"
+			crashes, err := NewCrashPolicy(app, CrashPolicyConfig{
+				MaxCrashes: 1,
+				Window:     "1m",
+				BanPeriod:  "5m",
+			})
+			So(err, ShouldBeNil)
+			wws.crashes = crashes
 
 			writeErr := errors.New("universe has imploded")
 			writePanic := func(interface{}) error {
@@ -265,13 +324,19 @@ func TestWorkerSend(t *testing.T) {
 			gomock.InOrder(
 				mckSocket.EXPECT().WriteJSON(FlushReply{
 					Type:    "notification",
-					Updates: []Update{{chid, uint64(version), data}},
+					Updates: []Update{{chid, uint64(version), data, false}},
 				}).Do(writePanic),
 				mckPinger.EXPECT().Send(uaid, version, data),
+				mckStat.EXPECT().Increment("client.crash"),
 			)
 
-			err := wws.Send(chid, version, data)
+			err = wws.Send(chid, version, data)
 			So(err, ShouldNotBeNil)
+
+			// Updates come from app servers, so the crash isn't charged to the
+			// client.
+			So(wws.stopped(), ShouldBeFalse)
+			So(crashes.Banned(wws.addr), ShouldBeFalse)
 		})
 
 		Convey("Should send an update with the given payload", func() {
@@ -284,7 +349,7 @@ func TestWorkerSend(t *testing.T) {
 			gomock.InOrder(
 				mckSocket.EXPECT().WriteJSON(FlushReply{
 					Type:    "notification",
-					Updates: []Update{{chid, uint64(version), data}},
+					Updates: []Update{{chid, uint64(version), data, false}},
 				}),
 				mckStat.EXPECT().Increment("updates.sent"),
 				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
@@ -380,8 +445,8 @@ func TestWorkerACK(t *testing.T) {
 			wws.SetUAID(uaid)
 
 			flushUpdates := []Update{
-				{"263d09f8950b11e4a1f83c15c2c622fe", 2, "I'm a little teapot"},
-				{"bac9d83a950b11e4bd713c15c2c622fe", 4, "Short and stout"},
+				{"263d09f8950b11e4a1f83c15c2c622fe", 2, "I'm a little teapot", false},
+				{"bac9d83a950b11e4bd713c15c2c622fe", 4, "Short and stout", false},
 			}
 			flushExpired := []string{"c778e94a950b11e4ba7f3c15c2c622fe"}
 
@@ -532,6 +597,72 @@ func TestWorkerUnregister(t *testing.T) {
 	})
 }
 
+func TestWorkerPurge(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStore := NewMockStore(mockCtrl)
+	mckSocket := NewMockSocket(mockCtrl)
+
+	Convey("Should purge device state", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+		app.SetStore(mckStore)
+		header := &RequestHeader{Type: "purge"}
+		uaid := "5e3c0ee4e0b54a2fa6d8a5dd4d04ed8a"
+
+		Convey("Should ignore purges unless enabled", func() {
+			wws := NewWorker(app, mckSocket, "test")
+			wws.SetUAID(uaid)
+
+			mckSocket.EXPECT().WriteText("{}")
+			err := wws.Purge(header, nil)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Should reject unidentified clients", func() {
+			app.allowPurge = true
+			wws := NewWorker(app, mckSocket, "test")
+
+			err := wws.Purge(header, nil)
+			So(err, ShouldEqual, ErrNoHandshake)
+		})
+
+		Convey("Should erase the device and confirm", func() {
+			app.allowPurge = true
+			wws := NewWorker(app, mckSocket, "test")
+			wws.SetUAID(uaid)
+
+			gomock.InOrder(
+				mckStore.EXPECT().FetchAll(uaid, time.Time{}),
+				mckStore.EXPECT().DropAll(uaid),
+				mckStore.EXPECT().FetchPing(uaid),
+				mckStat.EXPECT().Increment("updates.client.purge"),
+				mckSocket.EXPECT().WriteJSON(PurgeReply{"purge", 200}),
+			)
+			err := wws.Purge(header, nil)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Should report partial erasures", func() {
+			app.allowPurge = true
+			app.SetStore(&erasingStore{erased: 1, err: errors.New("oops")})
+			wws := NewWorker(app, mckSocket, "test")
+			wws.SetUAID(uaid)
+
+			mckSocket.EXPECT().WriteJSON(PurgeReply{"purge", 500})
+			err := wws.Purge(header, nil)
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
 func TestWorkerHandshakeRedirect(t *testing.T) {
 	useMockFuncs()
 	defer useStdFuncs()
@@ -668,6 +799,83 @@ func TestWorkerHandshakeDupe(t *testing.T) {
 				`{"uaid":"720f6b9a953411e4aadf3c15c2c622fe","channelIDs":[]}`))
 			So(err, ShouldEqual, ErrExistingID)
 		})
+
+		Convey("Should reject duplicate handshakes in error mode", func() {
+			uaid := "1b7ee16e3e0e4d2e9ab4a1d1c3b6a0f2"
+			wws.SetUAID(uaid)
+			wws.dupeHello = DupeHelloError
+
+			err := wws.Hello(&RequestHeader{Type: "hello"}, []byte(
+				`{"uaid":"1b7ee16e3e0e4d2e9ab4a1d1c3b6a0f2","channelIDs":[]}`))
+			So(err, ShouldEqual, ErrExistingID)
+		})
+
+		Convey("Should not flush duplicate handshakes in ignore mode", func() {
+			uaid := "52c4d4b6d6f24aa0a3d1b0fbb2c66c3a"
+			wws.SetUAID(uaid)
+			wws.dupeHello = DupeHelloIgnore
+
+			gomock.InOrder(
+				mckRouter.EXPECT().Register(uaid).Return(nil),
+				mckSocket.EXPECT().WriteText(gomock.Any()).Return(nil),
+				mckStat.EXPECT().Increment("updates.client.hello"),
+			)
+			err := wws.Hello(&RequestHeader{Type: "hello"},
+				[]byte(`{"uaid":"","channelIDs":[]}`))
+
+			So(err, ShouldBeNil)
+			So(wws.stopped(), ShouldBeFalse)
+		})
+
+		Convey("Should reconcile channels in resync mode", func() {
+			uaid := "0f6a4d2a8a8e4c1b9d6f5e3c2b1a0987"
+			wws.SetUAID(uaid)
+			wws.dupeHello = DupeHelloResync
+			app.AddWorker(uaid, wws)
+
+			gomock.InOrder(
+				mckStore.EXPECT().CanStore(1).Return(true),
+				mckStore.EXPECT().Exists(uaid).Return(true),
+				mckSocket.EXPECT().WriteText(gomock.Any()).Return(nil),
+				mckStat.EXPECT().Increment("updates.client.hello"),
+				mckStore.EXPECT().FetchAll(uaid, gomock.Any()).Return(nil, nil, nil),
+				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+			)
+			err := wws.Hello(&RequestHeader{Type: "hello"}, []byte(
+				`{"uaid":"0f6a4d2a8a8e4c1b9d6f5e3c2b1a0987","channelIDs":["1"]}`))
+
+			So(err, ShouldBeNil)
+			So(wws.UAID(), ShouldEqual, uaid)
+			So(app.WorkerExists(uaid), ShouldBeTrue)
+		})
+
+		Convey("Should issue new IDs for stale channels in resync mode", func() {
+			useMockFuncs()
+			defer useStdFuncs()
+
+			uaid := "7d0e1f2a3b4c4d5e8f9a0b1c2d3e4f50"
+			wws.SetUAID(uaid)
+			wws.dupeHello = DupeHelloResync
+			app.AddWorker(uaid, wws)
+
+			gomock.InOrder(
+				mckStore.EXPECT().CanStore(1).Return(true),
+				mckStore.EXPECT().Exists(uaid).Return(false),
+				mckRouter.EXPECT().Unregister(uaid),
+				mckRouter.EXPECT().Register(testID).Return(nil),
+				mckSocket.EXPECT().WriteText(gomock.Any()).Return(nil),
+				mckStat.EXPECT().Increment("updates.client.hello"),
+				mckStore.EXPECT().FetchAll(testID, gomock.Any()).Return(nil, nil, nil),
+				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+			)
+			err := wws.Hello(&RequestHeader{Type: "hello"}, []byte(
+				`{"uaid":"","channelIDs":["1"]}`))
+
+			So(err, ShouldBeNil)
+			So(wws.UAID(), ShouldEqual, testID)
+			So(app.WorkerExists(uaid), ShouldBeFalse)
+			So(app.WorkerExists(testID), ShouldBeTrue)
+		})
 	})
 }
 
@@ -980,6 +1188,179 @@ func TestWorkerRun(t *testing.T) {
 			So(wws.stopped(), ShouldBeTrue)
 		})
 
+		Convey("Should report idle disconnects to the ping advisor", func() {
+			advisor, err := NewPingAdvisor(AdaptivePingConfig{
+				MinInterval: "1m",
+				MaxInterval: "30m",
+				Samples:     1,
+			})
+			So(err, ShouldBeNil)
+			network := "192.0.2.0/24"
+			wws.advisor, wws.network = advisor, network
+			wws.state = WorkerActive
+			wws.SetUAID(testID)
+			wws.lastRecv = timeNow().Add(-10 * time.Minute)
+
+			gomock.InOrder(
+				mckSocket.EXPECT().SetReadDeadline(gomock.Any()),
+				mckSocket.EXPECT().ReadBinary().Return(nil, io.EOF),
+			)
+
+			wws.Run()
+			So(wws.stopped(), ShouldBeTrue)
+			interval, ok := advisor.Advise(network)
+			So(ok, ShouldBeTrue)
+			So(interval, ShouldEqual, 10*time.Minute*3/4)
+		})
+
+		Convey("Should advertise keep-alive parameters after handshake", func() {
+			wws.idleInt = 5 * time.Minute
+			wws.maxSilence = 15 * time.Minute
+
+			gomock.InOrder(
+				mckBalancer.EXPECT().RedirectURL().Return("", false, nil),
+				mckRouter.EXPECT().Register(testID).Return(nil),
+				mckSocket.EXPECT().WriteText(`{"messageType":"hello","uaid":"`+
+					testID+`","status":200,"pingInterval":300,"maxSilence":900}`),
+				mckStat.EXPECT().Increment("updates.client.hello"),
+				mckStore.EXPECT().FetchAll(testID, gomock.Any()),
+				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+			)
+
+			err := wws.Hello(&RequestHeader{Type: "hello"},
+				[]byte(`{"uaid":"","channelIDs":[]}`))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Should resend unacknowledged updates before pongs", func() {
+			p, err := NewRedeliveryPolicy(RedeliveryConfig{
+				Timeout: "0s", MaxRetries: 1, Backoff: 2})
+			So(err, ShouldBeNil)
+			wws.redelivery = p.Tracker()
+			wws.state = WorkerActive
+			wws.SetUAID(testID)
+			updates := []Update{{"chid1", 3, "", false}}
+			wws.redelivery.Sent(updates, nil)
+
+			gomock.InOrder(
+				mckSocket.EXPECT().SetReadDeadline(timeNow()),
+				mckSocket.EXPECT().ReadBinary().Return(nil, &netErr{timeout: true}),
+				mckSocket.EXPECT().WriteJSON(FlushReply{
+					Type:    "notification",
+					Updates: updates,
+				}),
+				mckStat.EXPECT().IncrementBy("updates.redelivered", int64(1)),
+
+				mckSocket.EXPECT().SetReadDeadline(timeNow()),
+				mckSocket.EXPECT().ReadBinary().Return(nil, &netErr{timeout: true}),
+				mckStat.EXPECT().IncrementBy("updates.lost", int64(1)),
+				mckSocket.EXPECT().WriteText("{}"),
+
+				mckSocket.EXPECT().SetReadDeadline(timeNow().Add(wws.pongInterval)),
+				mckSocket.EXPECT().ReadBinary().Return(nil, io.EOF),
+			)
+
+			wws.Run()
+			So(wws.stopped(), ShouldBeTrue)
+		})
+
+		Convey("Should close clients that stop acknowledging updates", func() {
+			p, err := NewRedeliveryPolicy(RedeliveryConfig{
+				Timeout: "0s", MaxRetries: 0, MaxLost: 1})
+			So(err, ShouldBeNil)
+			wws.redelivery = p.Tracker()
+			wws.state = WorkerActive
+			wws.SetUAID(testID)
+			wws.redelivery.Sent([]Update{{"chid1", 3, "", false}}, nil)
+
+			gomock.InOrder(
+				mckSocket.EXPECT().SetReadDeadline(timeNow()),
+				mckSocket.EXPECT().ReadBinary().Return(nil, &netErr{timeout: true}),
+				mckStat.EXPECT().IncrementBy("updates.lost", int64(1)),
+				mckStat.EXPECT().Increment("updates.client.unresponsive"),
+			)
+
+			wws.Run()
+			So(wws.stopped(), ShouldBeTrue)
+		})
+
+		Convey("Should close clients that exceed the maximum silent period", func() {
+			wws.state = WorkerActive
+			wws.maxSilence = 30 * time.Second
+			wws.lastRecv = timeNow().Add(-1 * time.Minute)
+
+			gomock.InOrder(
+				mckSocket.EXPECT().SetReadDeadline(wws.lastRecv.Add(wws.maxSilence)),
+				mckSocket.EXPECT().ReadBinary().Return(nil, &netErr{timeout: true}),
+				mckStat.EXPECT().Increment("updates.client.silent"),
+			)
+
+			wws.Run()
+			So(wws.stopped(), ShouldBeTrue)
+		})
+
+		Convey("Should close clients that exceed the read timeout", func() {
+			wws.state = WorkerActive
+			wws.readTimeout = 30 * time.Second
+			wws.lastRecv = timeNow().Add(-1 * time.Minute)
+
+			gomock.InOrder(
+				mckSocket.EXPECT().SetReadDeadline(wws.lastRecv.Add(wws.readTimeout)),
+				mckSocket.EXPECT().ReadBinary().Return(nil, &netErr{timeout: true}),
+				mckStat.EXPECT().Increment("updates.client.read_timeout"),
+			)
+
+			wws.Run()
+			So(wws.stopped(), ShouldBeTrue)
+		})
+
+		Convey("Should close clients that exceed the write deadline", func() {
+			wws.state = WorkerActive
+			wws.writeTimeout = 5 * time.Second
+
+			gomock.InOrder(
+				mckSocket.EXPECT().SetWriteDeadline(timeNow().Add(wws.writeTimeout)),
+				mckSocket.EXPECT().WriteText("{}").Return(&netErr{timeout: true}),
+				mckStat.EXPECT().Increment("updates.client.write_timeout"),
+				mckSocket.EXPECT().SetReadDeadline(timeNow()),
+			)
+
+			err := wws.WriteText("{}")
+			So(err, ShouldNotBeNil)
+			So(wws.stopped(), ShouldBeTrue)
+		})
+
+		Convey("Should close unidentified clients that send too many frames", func() {
+			app.pushLongPongs = true
+			wws.helloFrames = 1
+			gomock.InOrder(
+				mckSocket.EXPECT().SetReadDeadline(wws.Born().Add(wws.helloTimeout)),
+				mckSocket.EXPECT().ReadBinary().Return([]byte("{}"), nil),
+				mckSocket.EXPECT().WriteJSON(PingReply{Type: "ping", Status: 200}),
+				mckStat.EXPECT().Increment("updates.client.ping"),
+
+				mckSocket.EXPECT().SetReadDeadline(wws.Born().Add(wws.helloTimeout)),
+				mckSocket.EXPECT().ReadBinary().Return([]byte("{}"), nil),
+				mckStat.EXPECT().Increment("updates.client.hello.flood"),
+			)
+
+			wws.Run()
+			So(wws.stopped(), ShouldBeTrue)
+		})
+
+		Convey("Should close unidentified clients that send too many bytes", func() {
+			wws.helloBytes = 16
+			gomock.InOrder(
+				mckSocket.EXPECT().SetReadDeadline(wws.Born().Add(wws.helloTimeout)),
+				mckSocket.EXPECT().ReadBinary().Return(
+					[]byte(`{"messageType":"register"}`), nil),
+				mckStat.EXPECT().Increment("updates.client.hello.flood"),
+			)
+
+			wws.Run()
+			So(wws.stopped(), ShouldBeTrue)
+		})
+
 		Convey("Should ignore empty packets", func() {
 			app.pushLongPongs = true
 			gomock.InOrder(
@@ -1055,11 +1436,11 @@ func TestWorkerRun(t *testing.T) {
 					"messageType": "register",
 					"channelID": "89101cfa01dd4294a00e3a813cb3da97"
 				}`), nil),
-				mckStore.EXPECT().Register(testID,
-					"89101cfa01dd4294a00e3a813cb3da97", int64(0)),
 				mckStore.EXPECT().IDsToKey(testID,
 					"89101cfa01dd4294a00e3a813cb3da97").Return("123", nil),
 				mckEndHandler.EXPECT().URL().Return("https://example.com"),
+				mckStore.EXPECT().Register(testID,
+					"89101cfa01dd4294a00e3a813cb3da97", int64(0)),
 				mckSocket.EXPECT().WriteJSON(RegisterReply{
 					Type:      "register",
 					DeviceID:  testID,
@@ -1150,11 +1531,11 @@ func TestRunCase(t *testing.T) {
 			"messageType": "RegisteR",
 			"channelID": "929c148c588746b29f4ea3dee52fdbd0"
 		}`), nil),
-		mckStore.EXPECT().Register(testID,
-			"929c148c588746b29f4ea3dee52fdbd0", int64(0)),
 		mckStore.EXPECT().IDsToKey(testID,
 			"929c148c588746b29f4ea3dee52fdbd0").Return("1", nil),
 		mckEndHandler.EXPECT().URL().Return("https://example.com"),
+		mckStore.EXPECT().Register(testID,
+			"929c148c588746b29f4ea3dee52fdbd0", int64(0)),
 		mckSocket.EXPECT().WriteJSON(RegisterReply{
 			Type:      "RegisteR",
 			DeviceID:  testID,
@@ -1229,6 +1610,25 @@ func TestWorkerHello(t *testing.T) {
 			So(err, ShouldEqual, ErrInvalidParams)
 		})
 
+		Convey("Should defer clients outside the open admission waves", func() {
+			wws := NewWorker(app, mckSocket, "test")
+			admission, err := NewAdmissionControl(AdmissionConfig{
+				Waves: 4, Interval: "30s"})
+			So(err, ShouldBeNil)
+			wws.admission = admission
+
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("updates.client.hello.deferred"),
+				mckSocket.EXPECT().WriteText(
+					`{"messageType":"hello","status":503,"error":"Server recovering; retry later","retryAfter":60}`),
+			)
+
+			err = wws.Hello(&RequestHeader{Type: "hello"}, []byte(
+				`{"uaid":"6a4f5b0e1c2d4e3f8a9b0c1d2e3f4a5b","channelIDs":[]}`))
+			So(err, ShouldBeNil)
+			So(wws.UAID(), ShouldEqual, "")
+		})
+
 		Convey("Should issue new IDs if an invalid ID given", func() {
 			wws := NewWorker(app, mckSocket, "test")
 
@@ -1274,6 +1674,89 @@ func TestWorkerHello(t *testing.T) {
 			So(app.WorkerExists(testID), ShouldBeTrue)
 		})
 
+		Convey("Should issue new IDs if the handshake exceeds the channel limit", func() {
+			wws := NewWorker(app, mckSocket, "test")
+			wws.maxChannels = 3
+
+			prevID := "ba14b1f190d04e728acfe6ab71362e91"
+			gomock.InOrder(
+				mckStat.EXPECT().Increment("updates.client.hello.max_channels"),
+				mckStore.EXPECT().DropAll(prevID),
+				mckBalancer.EXPECT().RedirectURL().Return("", false, nil),
+				mckRouter.EXPECT().Register(testID).Return(nil),
+				mckSocket.EXPECT().WriteText(gomock.Any()),
+				mckStat.EXPECT().Increment("updates.client.hello"),
+				mckStore.EXPECT().FetchAll(testID, gomock.Any()).Return(nil, nil, nil),
+				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+			)
+			err := wws.Hello(&RequestHeader{Type: "hello"}, []byte(`{
+				"uaid": "ba14b1f190d04e728acfe6ab71362e91",
+				"channelIDs": ["1", "2", "3", "4"]
+			}`))
+
+			So(err, ShouldBeNil)
+			So(app.WorkerExists(testID), ShouldBeTrue)
+		})
+
+		Convey("Should resume parked sessions without a store flush", func() {
+			app.sessions, _ = NewSessionCache(ResumeConfig{TTL: "30s", Size: 10})
+			wws := NewWorker(app, mckSocket, "test")
+
+			prevID := "ba14b1f190d04e728acfe6ab71362e91"
+			app.sessions.Park(&parkedSession{token: "t0k3n", uaid: prevID,
+				updates: []Update{{"chid", 3, "", false}}})
+			gomock.InOrder(
+				mckStore.EXPECT().CanStore(0).Return(true),
+				mckBalancer.EXPECT().RedirectURL().Return("", false, nil),
+				mckRouter.EXPECT().Register(prevID).Return(nil),
+				mckStat.EXPECT().Increment("updates.client.resume"),
+				mckSocket.EXPECT().WriteText(
+					`{"messageType":"hello","uaid":"ba14b1f190d04e728acfe6ab71362e91","status":200,"resume":"d1c7c768b1be4c7093a69b52910d4baa"}`),
+				mckStat.EXPECT().Increment("updates.client.hello"),
+				mckSocket.EXPECT().WriteJSON(gomock.Any()),
+				mckStat.EXPECT().IncrementBy("updates.sent", int64(1)),
+			)
+			err := wws.Hello(&RequestHeader{Type: "hello"}, []byte(
+				`{"uaid":"ba14b1f190d04e728acfe6ab71362e91","channelIDs":[],"resume":"t0k3n"}`))
+			So(err, ShouldBeNil)
+
+			// The resent update is parked again when the client disconnects.
+			gomock.InOrder(
+				mckSocket.EXPECT().SetReadDeadline(gomock.Any()),
+				mckSocket.EXPECT().ReadBinary().Return(nil, io.EOF),
+				mckRouter.EXPECT().Unregister(prevID),
+				mckSocket.EXPECT().Close(),
+			)
+			wws.Run()
+			So(wws.stopped(), ShouldBeTrue)
+			wws.Close()
+			session, ok := app.sessions.Resume(testID, prevID)
+			So(ok, ShouldBeTrue)
+			So(session.updates, ShouldResemble, []Update{{"chid", 3, "", false}})
+		})
+
+		Convey("Should flush from the store if a parked session missed updates", func() {
+			app.sessions, _ = NewSessionCache(ResumeConfig{TTL: "30s", Size: 10})
+			wws := NewWorker(app, mckSocket, "test")
+
+			prevID := "ba14b1f190d04e728acfe6ab71362e91"
+			app.sessions.Park(&parkedSession{token: "t0k3n", uaid: prevID})
+			app.sessions.Missed(prevID)
+			gomock.InOrder(
+				mckStore.EXPECT().CanStore(0).Return(true),
+				mckBalancer.EXPECT().RedirectURL().Return("", false, nil),
+				mckRouter.EXPECT().Register(prevID).Return(nil),
+				mckStat.EXPECT().Increment("updates.client.resume.missed"),
+				mckSocket.EXPECT().WriteText(gomock.Any()),
+				mckStat.EXPECT().Increment("updates.client.hello"),
+				mckStore.EXPECT().FetchAll(prevID, gomock.Any()).Return(nil, nil, nil),
+				mckStat.EXPECT().Timer("client.flush", gomock.Any()),
+			)
+			err := wws.Hello(&RequestHeader{Type: "hello"}, []byte(
+				`{"uaid":"ba14b1f190d04e728acfe6ab71362e91","channelIDs":[],"resume":"t0k3n"}`))
+			So(err, ShouldBeNil)
+		})
+
 		Convey("Should require the `channelIDs` field", func() {
 			var err error
 
@@ -1286,6 +1769,33 @@ func TestWorkerHello(t *testing.T) {
 			So(err, ShouldEqual, ErrNoParams)
 		})
 
+		Convey("Should time out slow handshakes", func() {
+			prevID := "7a2d58cc0b6d4ef19aa1f7b4a1e9b2d0"
+			tracker := NewGoroutineTracker(app, GoroutineConfig{})
+			app.goroutines = tracker
+			wws := NewWorker(app, mckSocket, "test")
+			wws.shakeTimeout = 10 * time.Millisecond
+
+			unblock := make(chan bool)
+			gomock.InOrder(
+				mckStore.EXPECT().CanStore(1).Do(func(int) { <-unblock }).Return(true),
+				mckStat.EXPECT().Increment("updates.client.hello.timeout"),
+			)
+
+			err := wws.Hello(&RequestHeader{Type: "hello"}, []byte(
+				`{"uaid":"7a2d58cc0b6d4ef19aa1f7b4a1e9b2d0","channelIDs":["1"]}`))
+			So(err, ShouldEqual, ErrHandshakeTimeout)
+			So(wws.UAID(), ShouldBeEmpty)
+
+			// The abandoned handshake finishes the blocked store call, then
+			// stops without checking the device ID or registering the worker.
+			close(unblock)
+			for running, _ := tracker.Counts(); running > 0; running, _ = tracker.Counts() {
+				runtime.Gosched()
+			}
+			So(app.WorkerExists(prevID), ShouldBeFalse)
+		})
+
 		Convey("Should issue new IDs for nonexistent registrations", func() {
 			oldID := "2214c771a8474edfb14448577863594d"
 			wws := NewWorker(app, mckSocket, "test")
@@ -1453,8 +1963,8 @@ func TestHandshakeFlush(t *testing.T) {
 		Convey("Should flush updates after handshake", func() {
 			uaid := "b0b8afe6950c11e49aa73c15c2c622fe"
 			updates := []Update{
-				{"263d09f8950b11e4a1f83c15c2c622fe", 2, "I'm a little teapot"},
-				{"bac9d83a950b11e4bd713c15c2c622fe", 4, "Short and stout"},
+				{"263d09f8950b11e4a1f83c15c2c622fe", 2, "I'm a little teapot", false},
+				{"bac9d83a950b11e4bd713c15c2c622fe", 4, "Short and stout", false},
 			}
 			expired := []string{"c778e94a950b11e4ba7f3c15c2c622fe"}
 
@@ -1650,3 +2160,32 @@ func TestHarmlessConnectionError(t *testing.T) {
 		})
 	})
 }
+
+func TestDispatchCommand(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckHandler := NewMockCommandHandler(mockCtrl)
+
+	Convey("Should dispatch client commands", t, func() {
+		message := []byte(`{"messageType":"REGISTER","channelID":"abc"}`)
+		header := &RequestHeader{Type: "REGISTER"}
+		mckHandler.EXPECT().Register(header, message).Return(ErrInvalidParams)
+		So(DispatchCommand(mckHandler, header, message), ShouldEqual,
+			ErrInvalidParams)
+
+		header = &RequestHeader{Type: "ping"}
+		mckHandler.EXPECT().Ping(header, []byte("{}"))
+		So(DispatchCommand(mckHandler, header, []byte("{}")), ShouldBeNil)
+
+		header = &RequestHeader{Type: "purge"}
+		mckHandler.EXPECT().Purge(header, nil)
+		So(DispatchCommand(mckHandler, header, nil), ShouldBeNil)
+
+		header = &RequestHeader{Type: "channels"}
+		mckHandler.EXPECT().Channels(header, nil)
+		So(DispatchCommand(mckHandler, header, nil), ShouldBeNil)
+		So(DispatchCommand(mckHandler, &RequestHeader{Type: "bogus"}, nil),
+			ShouldEqual, ErrUnsupportedType)
+	})
+}
@@ -0,0 +1,371 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+type WriteBehindConfig struct {
+	Enabled bool
+
+	// Interval is the time between flushes.
+	Interval string
+
+	// MaxPending is the number of buffered writes that triggers an early
+	// flush.
+	MaxPending int `toml:"max_pending" env:"max_pending"`
+
+	// Workers is the number of concurrent writes during a flush.
+	Workers int
+
+	// WaitForFlush blocks callers until their writes are flushed, and returns
+	// write errors. Writes are still coalesced, but are not lost if the
+	// server exits before flushing. If false, writes are checked against the
+	// store, so that writes to unregistered channels and stale versions are
+	// rejected, and return without waiting for the flush; errors writing to
+	// the store are only logged.
+	WaitForFlush bool `toml:"wait_for_flush" env:"wait_for_flush"`
+}
+
+// writeBackend is implemented by stores that support write-behind buffering.
+// The methods write directly to the backing store.
+type writeBackend interface {
+	register(uaid, chid string, version int64) error
+	update(uaid, chid string, version int64) error
+	drop(uaid, chid string) error
+
+	// check returns the error that a registration or update would be
+	// rejected with, without writing it.
+	check(op writeOp, uaid, chid string, version int64) error
+
+	// rejectsDecreasing indicates whether updates with versions older than
+	// the stored version are rejected with ErrStaleVersion.
+	rejectsDecreasing() bool
+}
+
+type writeOp int
+
+const (
+	writeRegister writeOp = iota
+	writeUpdate
+	writeDrop
+)
+
+// pendingWrite is a buffered write for a channel. Only the latest write is
+// kept: an update registers the channel if it doesn't exist, and a drop
+// supersedes earlier writes.
+type pendingWrite struct {
+	op      writeOp
+	uaid    string
+	chid    string
+	version int64
+	waiters []chan error
+}
+
+// pendingWriteBytes approximates the size of a buffered write: the write,
+// its map entry and key, and the IDs.
+const pendingWriteBytes = int64(unsafe.Sizeof(pendingWrite{})) +
+	mapEntryBytes + 4*idBytes
+
+// WriteBuffer batches channel registrations, version updates, and drops into
+// periodic flushes, coalescing writes to the same channel. This trades
+// durability for fewer round trips to backing stores where per-key requests
+// dominate cost.
+type WriteBuffer struct {
+	logger      *SimpleLogger
+	metrics     Statistician
+	backend     writeBackend
+	interval    time.Duration
+	maxPending  int
+	workers     int
+	wait        bool
+	pendingMux  sync.Mutex
+	pending     map[string]*pendingWrite // By channel key.
+	flushSignal chan bool
+	closeChan   chan bool
+	closeOnce   Once
+	done        chan bool
+}
+
+// NewWriteBuffer creates a write buffer for backend from conf.
+func NewWriteBuffer(app *Application, conf WriteBehindConfig,
+	backend writeBackend) (b *WriteBuffer, err error) {
+
+	b = &WriteBuffer{
+		logger:      app.Logger(),
+		metrics:     app.Metrics(),
+		backend:     backend,
+		maxPending:  conf.MaxPending,
+		workers:     conf.Workers,
+		wait:        conf.WaitForFlush,
+		pending:     make(map[string]*pendingWrite),
+		flushSignal: make(chan bool, 1),
+		closeChan:   make(chan bool),
+		done:        make(chan bool),
+	}
+	if b.interval, err = time.ParseDuration(conf.Interval); err != nil {
+		return nil, err
+	}
+	if b.workers < 1 {
+		b.workers = 1
+	}
+	app.Memory().Register("write_buffer", b)
+	return b, nil
+}
+
+// Register buffers a channel registration.
+func (b *WriteBuffer) Register(uaid, chid string, version int64) error {
+	return b.put(writeRegister, uaid, chid, version)
+}
+
+// Update buffers a channel version update.
+func (b *WriteBuffer) Update(uaid, chid string, version int64) error {
+	return b.put(writeUpdate, uaid, chid, version)
+}
+
+// Drop buffers a channel removal.
+func (b *WriteBuffer) Drop(uaid, chid string) error {
+	return b.put(writeDrop, uaid, chid, 0)
+}
+
+func (b *WriteBuffer) put(op writeOp, uaid, chid string, version int64) error {
+	select {
+	case <-b.closeChan:
+		// Write through once the buffer is closed.
+		return b.write(&pendingWrite{op: op, uaid: uaid, chid: chid,
+			version: version})
+	default:
+	}
+	var waiter chan error
+	if b.wait {
+		waiter = make(chan error, 1)
+	} else if op != writeDrop {
+		// Callers don't see flush errors, so reject writes that the store
+		// would reject now.
+		if err := b.backend.check(op, uaid, chid, version); err != nil {
+			return err
+		}
+	}
+	key := joinIDs(uaid, chid)
+	b.pendingMux.Lock()
+	write, ok := b.pending[key]
+	if ok && op == writeUpdate && write.op != writeDrop &&
+		version < write.version && b.backend.rejectsDecreasing() {
+
+		// Keep the buffered newer version, as the store would.
+		b.pendingMux.Unlock()
+		b.metrics.Increment("store.write_behind.stale")
+		return ErrStaleVersion
+	}
+	if ok {
+		write.op, write.version = op, version
+	} else {
+		write = &pendingWrite{op: op, uaid: uaid, chid: chid, version: version}
+		b.pending[key] = write
+	}
+	if waiter != nil {
+		write.waiters = append(write.waiters, waiter)
+	}
+	isFull := len(b.pending) >= b.maxPending
+	b.pendingMux.Unlock()
+	if ok {
+		b.metrics.Increment("store.write_behind.coalesced")
+	}
+	if isFull {
+		select {
+		case b.flushSignal <- true:
+		default:
+		}
+	}
+	if waiter == nil {
+		return nil
+	}
+	return <-waiter
+}
+
+// MemoryUsage returns the approximate bytes held by buffered writes.
+// Implements MemorySizer.
+func (b *WriteBuffer) MemoryUsage() int64 {
+	b.pendingMux.Lock()
+	pending := len(b.pending)
+	b.pendingMux.Unlock()
+	return int64(pending) * pendingWriteBytes
+}
+
+// HasDevice indicates whether there are buffered registrations or updates
+// for a device.
+func (b *WriteBuffer) HasDevice(uaid string) bool {
+	prefix := uaid + keySep
+	b.pendingMux.Lock()
+	defer b.pendingMux.Unlock()
+	for key, write := range b.pending {
+		if write.op != writeDrop && strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// FlushDevice writes all buffered writes for a device, so that subsequent
+// reads observe them. Returns an error if a write could not be stored;
+// writes rejected by the store are reported to their callers instead.
+func (b *WriteBuffer) FlushDevice(uaid string) error {
+	writes := b.take(uaid)
+	if len(writes) == 0 {
+		return nil
+	}
+	if err := b.apply(writes); err != nil && !isRejectedWrite(err) {
+		return err
+	}
+	return nil
+}
+
+// Discard removes all buffered writes for a device without writing them.
+func (b *WriteBuffer) Discard(uaid string) {
+	for _, write := range b.take(uaid) {
+		write.done(nil)
+	}
+}
+
+// take removes and returns the buffered writes for a device.
+func (b *WriteBuffer) take(uaid string) (writes []*pendingWrite) {
+	prefix := uaid + keySep
+	b.pendingMux.Lock()
+	defer b.pendingMux.Unlock()
+	for key, write := range b.pending {
+		if strings.HasPrefix(key, prefix) {
+			writes = append(writes, write)
+			delete(b.pending, key)
+		}
+	}
+	return writes
+}
+
+// Flush writes all buffered writes.
+func (b *WriteBuffer) Flush() error {
+	b.pendingMux.Lock()
+	pending := b.pending
+	b.pending = make(map[string]*pendingWrite)
+	b.pendingMux.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	writes := make([]*pendingWrite, 0, len(pending))
+	for _, write := range pending {
+		writes = append(writes, write)
+	}
+	return b.apply(writes)
+}
+
+// apply writes to the backing store with up to b.workers concurrent writes.
+// Returns the first error, preferring errors writing to the store over
+// writes rejected by the store. Failed writes without waiting callers are
+// lost, and counted as dropped.
+func (b *WriteBuffer) apply(writes []*pendingWrite) (err error) {
+	startTime := timeNow()
+	var (
+		wg     sync.WaitGroup
+		errMux sync.Mutex
+	)
+	slots := make(chan bool, b.workers)
+	for _, write := range writes {
+		slots <- true
+		wg.Add(1)
+		go func(write *pendingWrite) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			writeErr := b.write(write)
+			write.done(writeErr)
+			if writeErr == nil {
+				return
+			}
+			if len(write.waiters) == 0 {
+				b.metrics.Increment("store.write_behind.dropped")
+			}
+			errMux.Lock()
+			if err == nil || isRejectedWrite(err) && !isRejectedWrite(writeErr) {
+				err = writeErr
+			}
+			errMux.Unlock()
+		}(write)
+	}
+	wg.Wait()
+	b.metrics.Timer("store.write_behind.flush", timeNow().Sub(startTime))
+	b.metrics.IncrementBy("store.write_behind.writes", int64(len(writes)))
+	return err
+}
+
+func (b *WriteBuffer) write(write *pendingWrite) (err error) {
+	switch write.op {
+	case writeRegister:
+		err = b.backend.register(write.uaid, write.chid, write.version)
+	case writeUpdate:
+		err = b.backend.update(write.uaid, write.chid, write.version)
+	case writeDrop:
+		err = b.backend.drop(write.uaid, write.chid)
+	}
+	if err == nil {
+		return nil
+	}
+	b.metrics.Increment("store.write_behind.error")
+	if b.logger.ShouldLog(WARNING) {
+		b.logger.Warn("write_behind", "Error flushing buffered write", LogFields{
+			"uaid":    write.uaid,
+			"chid":    write.chid,
+			"version": strconv.FormatInt(write.version, 10),
+			"error":   err.Error()})
+	}
+	return err
+}
+
+// isRejectedWrite indicates whether err is a store's rejection of a write,
+// rather than an error writing to the store.
+func isRejectedWrite(err error) bool {
+	return err == ErrChannelGone || err == ErrStaleVersion ||
+		err == ErrNonexistentChannel
+}
+
+// done notifies callers waiting for the write.
+func (write *pendingWrite) done(err error) {
+	for _, waiter := range write.waiters {
+		waiter <- err
+	}
+}
+
+// Run flushes buffered writes every interval, or when the buffer is full,
+// until the buffer is closed.
+func (b *WriteBuffer) Run() {
+	defer close(b.done)
+	ticker := clock.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.closeChan:
+			b.Flush()
+			return
+		case <-ticker.C():
+		case <-b.flushSignal:
+		}
+		b.Flush()
+	}
+}
+
+// Close stops the flush loop, and writes any buffered writes.
+func (b *WriteBuffer) Close() error {
+	return b.closeOnce.Do(b.close)
+}
+
+func (b *WriteBuffer) close() error {
+	close(b.closeChan)
+	<-b.done
+	return nil
+}
@@ -0,0 +1,177 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/rafrombrc/gomock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testWriteBackend implements writeBackend, recording writes.
+type testWriteBackend struct {
+	sync.Mutex
+	writes     []string
+	fail       string // Fail writes to this channel.
+	gone       string // Reject writes to this channel.
+	decreasing bool   // Reject decreasing versions.
+}
+
+func (w *testWriteBackend) record(op, uaid, chid string, version int64) error {
+	if chid == w.fail {
+		return ErrRecordUpdateFailed
+	}
+	w.Lock()
+	w.writes = append(w.writes, fmt.Sprintf("%s %s.%s:%d", op, uaid, chid,
+		version))
+	w.Unlock()
+	return nil
+}
+
+func (w *testWriteBackend) register(uaid, chid string, version int64) error {
+	return w.record("register", uaid, chid, version)
+}
+
+func (w *testWriteBackend) update(uaid, chid string, version int64) error {
+	return w.record("update", uaid, chid, version)
+}
+
+func (w *testWriteBackend) drop(uaid, chid string) error {
+	return w.record("drop", uaid, chid, 0)
+}
+
+func (w *testWriteBackend) check(op writeOp, uaid, chid string,
+	version int64) error {
+
+	if chid == w.gone {
+		return ErrChannelGone
+	}
+	return nil
+}
+
+func (w *testWriteBackend) rejectsDecreasing() bool {
+	return w.decreasing
+}
+
+func (w *testWriteBackend) sorted() []string {
+	w.Lock()
+	defer w.Unlock()
+	sort.Strings(w.writes)
+	return w.writes
+}
+
+func TestWriteBuffer(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mckLogger := NewMockLogger(mockCtrl)
+	mckLogger.EXPECT().ShouldLog(gomock.Any()).Return(true).AnyTimes()
+	mckLogger.EXPECT().Log(gomock.Any(), gomock.Any(), gomock.Any(),
+		gomock.Any()).AnyTimes()
+	mckStat := NewMockStatistician(mockCtrl)
+	mckStat.EXPECT().Timer("store.write_behind.flush", gomock.Any()).AnyTimes()
+	mckStat.EXPECT().IncrementBy("store.write_behind.writes",
+		gomock.Any()).AnyTimes()
+
+	Convey("Write-behind buffer", t, func() {
+		app := NewApplication()
+		app.SetLogger(mckLogger)
+		app.SetMetrics(mckStat)
+
+		backend := new(testWriteBackend)
+		conf := WriteBehindConfig{
+			Enabled:    true,
+			Interval:   "1h",
+			MaxPending: 100,
+			Workers:    2,
+		}
+		b, err := NewWriteBuffer(app, conf, backend)
+		So(err, ShouldBeNil)
+
+		Convey("Should coalesce writes to the same channel", func() {
+			mckStat.EXPECT().Increment("store.write_behind.coalesced").Times(2)
+			So(b.Register("uaid1", "chid1", 0), ShouldBeNil)
+			So(b.Update("uaid1", "chid1", 2), ShouldBeNil)
+			So(b.Update("uaid1", "chid1", 3), ShouldBeNil)
+			So(b.Register("uaid1", "chid2", 0), ShouldBeNil)
+			So(b.HasDevice("uaid1"), ShouldBeTrue)
+			So(backend.sorted(), ShouldBeEmpty)
+
+			So(b.Flush(), ShouldBeNil)
+			So(b.HasDevice("uaid1"), ShouldBeFalse)
+			So(backend.sorted(), ShouldResemble, []string{
+				"register uaid1.chid2:0",
+				"update uaid1.chid1:3",
+			})
+		})
+
+		Convey("Should not replace buffered versions with older versions", func() {
+			backend.decreasing = true
+			mckStat.EXPECT().Increment("store.write_behind.stale")
+			mckStat.EXPECT().Increment("store.write_behind.coalesced")
+			So(b.Update("uaid1", "chid1", 5), ShouldBeNil)
+			So(b.Update("uaid1", "chid1", 3), ShouldEqual, ErrStaleVersion)
+			So(b.Update("uaid1", "chid1", 6), ShouldBeNil)
+			So(b.Flush(), ShouldBeNil)
+			So(backend.sorted(), ShouldResemble, []string{"update uaid1.chid1:6"})
+		})
+
+		Convey("Should reject writes to unregistered channels", func() {
+			backend.gone = "chid1"
+			So(b.Update("uaid1", "chid1", 1), ShouldEqual, ErrChannelGone)
+			So(b.HasDevice("uaid1"), ShouldBeFalse)
+		})
+
+		Convey("Should return errors flushing writes for a device", func() {
+			backend.fail = "chid2"
+			mckStat.EXPECT().Increment("store.write_behind.error")
+			mckStat.EXPECT().Increment("store.write_behind.dropped")
+			So(b.Update("uaid1", "chid1", 1), ShouldBeNil)
+			So(b.Update("uaid1", "chid2", 1), ShouldBeNil)
+			So(b.FlushDevice("uaid1"), ShouldEqual, ErrRecordUpdateFailed)
+			So(backend.sorted(), ShouldResemble, []string{"update uaid1.chid1:1"})
+		})
+
+		Convey("Should flush writes for a device before reads", func() {
+			So(b.Update("uaid1", "chid1", 1), ShouldBeNil)
+			So(b.Update("uaid2", "chid1", 1), ShouldBeNil)
+			So(b.FlushDevice("uaid1"), ShouldBeNil)
+			So(backend.sorted(), ShouldResemble, []string{"update uaid1.chid1:1"})
+			So(b.HasDevice("uaid2"), ShouldBeTrue)
+
+			b.Discard("uaid2")
+			So(b.HasDevice("uaid2"), ShouldBeFalse)
+		})
+
+		Convey("Should flush and write through when closed", func() {
+			go b.Run()
+			So(b.Drop("uaid1", "chid1"), ShouldBeNil)
+			b.Close()
+			So(b.Update("uaid1", "chid2", 1), ShouldBeNil)
+			So(backend.sorted(), ShouldResemble, []string{
+				"drop uaid1.chid1:0",
+				"update uaid1.chid2:1",
+			})
+		})
+
+		Convey("Should return flush errors to waiting callers", func() {
+			conf.WaitForFlush = true
+			conf.Interval = "1ms"
+			b, err := NewWriteBuffer(app, conf, backend)
+			So(err, ShouldBeNil)
+			go b.Run()
+			defer b.Close()
+
+			backend.fail = "chid2"
+			mckStat.EXPECT().Increment("store.write_behind.error")
+			So(b.Update("uaid1", "chid1", 1), ShouldBeNil)
+			So(b.Update("uaid1", "chid2", 1), ShouldEqual, ErrRecordUpdateFailed)
+		})
+	})
+}
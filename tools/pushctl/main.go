@@ -0,0 +1,168 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+ * Push server test utilities
+ *
+ * pushctl endpoint new: construct a valid update endpoint for a device and
+ * channel, without a live registration. The token key and endpoint template
+ * are read from a server config file, or specified with -key and -template.
+ *
+ * pushctl protocol schema: print the JSON Schemas for the client protocol
+ * messages.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bbangert/toml"
+	"github.com/mozilla-services/pushgo/id"
+	"github.com/mozilla-services/pushgo/simplepush"
+)
+
+// keyConfig is the subset of the server config used to encode endpoints.
+type keyConfig struct {
+	TokenKey     string `toml:"token_key"`
+	PushEndpoint string `toml:"push_endpoint_template"`
+}
+
+const usage = `Usage: pushctl <command> [options]
+
+Commands:
+  endpoint new    Generate an update endpoint for a device and channel
+  protocol schema Print the protocol message schemas
+`
+
+func main() {
+	if len(os.Args) < 3 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch cmd := os.Args[1] + " " + os.Args[2]; cmd {
+	case "endpoint new":
+		if err := endpointNew(os.Args[3:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error generating endpoint: %s\n", err)
+			os.Exit(1)
+		}
+	case "protocol schema":
+		if err := protocolSchema(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error generating schemas: %s\n", err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
+
+func endpointNew(args []string) (err error) {
+	flags := flag.NewFlagSet("endpoint new", flag.ExitOnError)
+	configFile := flags.String("config", "", "Server config file")
+	virtual := flags.String("virtual", "", "Virtual server name (requires -config)")
+	tokenKey := flags.String("key", "", "Token key; overrides the config file")
+	pushEndpoint := flags.String("template", "",
+		"Endpoint template; overrides the config file")
+	host := flags.String("host", "http://localhost:8081",
+		"Endpoint handler URL, substituted for {{.CurrentHost}}")
+	uaid := flags.String("uaid", "", "Device ID (generated if omitted)")
+	chid := flags.String("chid", "", "Channel ID (generated if omitted)")
+	flags.Parse(args)
+
+	conf := keyConfig{PushEndpoint: "{{.CurrentHost}}/update/{{.Token}}"}
+	if len(*configFile) > 0 {
+		if conf, err = loadKeyConfig(*configFile, *virtual, conf); err != nil {
+			return err
+		}
+	} else if len(*virtual) > 0 {
+		return fmt.Errorf("-virtual requires -config")
+	}
+	if len(*tokenKey) > 0 {
+		conf.TokenKey = *tokenKey
+	}
+	if len(*pushEndpoint) > 0 {
+		conf.PushEndpoint = *pushEndpoint
+	}
+	if len(*configFile) > 0 && len(conf.TokenKey) == 0 {
+		// The key may be set in the server's environment instead; an
+		// unencrypted endpoint would be rejected by that server.
+		return fmt.Errorf("Missing token_key in %s; use -key to set it",
+			*configFile)
+	}
+	if *uaid, err = checkID("device", *uaid); err != nil {
+		return err
+	}
+	if *chid, err = checkID("channel", *chid); err != nil {
+		return err
+	}
+	endpoint, err := simplepush.GenerateEndpoint(conf.TokenKey,
+		conf.PushEndpoint, *host, *uaid, *chid)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# uaid: %s, chid: %s\n%s\n", *uaid, *chid, endpoint)
+	return nil
+}
+
+func protocolSchema() error {
+	data, err := json.MarshalIndent(simplepush.ProtocolSchemas(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", data)
+	return nil
+}
+
+// loadKeyConfig reads the token key and endpoint template from the [default]
+// section of a config file, or from [virtual.<name>] if virtual is set. A
+// missing endpoint template in a virtual server section falls back to
+// [default]; the token key doesn't, as the server requires one for each
+// virtual server.
+func loadKeyConfig(filename, virtual string, conf keyConfig) (
+	keyConfig, error) {
+
+	var file struct {
+		Default keyConfig
+		Virtual map[string]keyConfig
+	}
+	if _, err := toml.DecodeFile(filename, &file); err != nil {
+		return conf, err
+	}
+	merge(&conf, file.Default)
+	if len(virtual) > 0 {
+		vconf, ok := file.Virtual[virtual]
+		if !ok {
+			return conf, fmt.Errorf("Unknown virtual server: %s", virtual)
+		}
+		conf.TokenKey = vconf.TokenKey
+		merge(&conf, vconf)
+	}
+	return conf, nil
+}
+
+func merge(dest *keyConfig, src keyConfig) {
+	if len(src.TokenKey) > 0 {
+		dest.TokenKey = src.TokenKey
+	}
+	if len(src.PushEndpoint) > 0 {
+		dest.PushEndpoint = src.PushEndpoint
+	}
+}
+
+// checkID validates an ID, or generates one if empty.
+func checkID(kind, s string) (string, error) {
+	if len(s) == 0 {
+		return id.Generate()
+	}
+	if !id.Valid(s) {
+		return "", fmt.Errorf("Invalid %s ID: %s", kind, s)
+	}
+	return s, nil
+}
+
+// vim: set tabstab=4 softtabstop=4 shiftwidth=4 noexpandtab
@@ -0,0 +1,204 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/*
+ * Replay recorded traffic shapes against a push server
+ *
+ * Reads the sessions written by the WebSocket traffic recorder
+ * ([websocket.traffic]), and replays each as a new client, preserving the
+ * recorded command mix and timings. Updates are replayed by notifying the
+ * session's channel endpoints; the client acknowledges them as they arrive,
+ * so recorded acks are not sent separately.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/pushgo/client"
+	"github.com/mozilla-services/pushgo/id"
+	"github.com/mozilla-services/pushgo/simplepush"
+)
+
+var (
+	origin      string
+	path        string
+	speed       float64
+	concurrency int
+	failures    int32
+)
+
+// replayer replays a recorded session on a single connection.
+type replayer struct {
+	conn      *client.Conn
+	channels  map[int]string // Channel IDs, by recorded index.
+	endpoints map[int]string // Endpoints, by recorded index.
+	version   int64
+}
+
+// channel returns the channel ID for a recorded channel index, generating
+// a new ID for unseen indexes.
+func (r *replayer) channel(index int) (string, error) {
+	if chid, ok := r.channels[index]; ok {
+		return chid, nil
+	}
+	chid, err := id.Generate()
+	if err != nil {
+		return "", err
+	}
+	r.channels[index] = chid
+	return chid, nil
+}
+
+// acceptAll acknowledges updates until the connection is closed.
+func (r *replayer) acceptAll() {
+	for {
+		updates, err := r.conn.ReadBatch()
+		if err != nil {
+			return
+		}
+		r.conn.AcceptBatch(updates)
+	}
+}
+
+func (r *replayer) do(event simplepush.TrafficEvent) (err error) {
+	switch event.Type {
+	case "hello":
+		chids := make([]string, event.Count)
+		for i := range chids {
+			if chids[i], err = r.channel(i + 1); err != nil {
+				return err
+			}
+		}
+		deviceID, err := id.Generate()
+		if err != nil {
+			return err
+		}
+		_, err = r.conn.WriteHelo(deviceID, chids...)
+		return err
+
+	case "register":
+		chid, err := r.channel(event.Channel)
+		if err != nil {
+			return err
+		}
+		endpoint, err := r.conn.Register(chid)
+		if err != nil {
+			return err
+		}
+		r.endpoints[event.Channel] = endpoint
+
+	case "unregister":
+		chid, err := r.channel(event.Channel)
+		if err != nil {
+			return err
+		}
+		delete(r.endpoints, event.Channel)
+		return r.conn.Unregister(chid)
+
+	case "ping":
+		_, err = r.conn.WriteRequest(client.NewPing(false))
+		return err
+
+	case "update":
+		endpoint, ok := r.endpoints[event.Channel]
+		if !ok {
+			// The channel was registered in an earlier session.
+			return nil
+		}
+		r.version++
+		return client.Notify(endpoint, r.version)
+	}
+	return nil
+}
+
+func replay(record *simplepush.TrafficRecord) error {
+	conn, err := client.DialOrigin(origin)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := &replayer{
+		conn:      conn,
+		channels:  make(map[int]string),
+		endpoints: make(map[int]string),
+		version:   time.Now().Unix(),
+	}
+	go r.acceptAll()
+	start := time.Now()
+	for _, event := range record.Events {
+		time.Sleep(start.Add(scale(event.Offset)).Sub(time.Now()))
+		if err = r.do(event); err != nil {
+			return fmt.Errorf("%s: %s", event.Type, err)
+		}
+	}
+	time.Sleep(start.Add(scale(record.Duration)).Sub(time.Now()))
+	return nil
+}
+
+// scale converts a recorded offset to a replay delay, adjusted for speed.
+func scale(offset int64) time.Duration {
+	return time.Duration(float64(offset) * float64(time.Millisecond) / speed)
+}
+
+func main() {
+	flag.StringVar(&origin, "origin", "ws://localhost:8080", "WebSocket origin")
+	flag.StringVar(&path, "file", "traffic.jsonl", "Recorded traffic file")
+	flag.Float64Var(&speed, "speed", 1, "Replay speed multiplier")
+	flag.IntVar(&concurrency, "c", 100, "Maximum concurrent sessions")
+	flag.Parse()
+	if speed <= 0 || concurrency < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("replay Error: %s\n", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	var (
+		wg       sync.WaitGroup
+		sessions int
+	)
+	slots := make(chan bool, concurrency)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := new(simplepush.TrafficRecord)
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			fmt.Printf("replay Error: session %d: %s\n", sessions+1, err)
+			continue
+		}
+		sessions++
+		slots <- true
+		wg.Add(1)
+		go func(n int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if err := replay(record); err != nil {
+				atomic.AddInt32(&failures, 1)
+				fmt.Printf("replay Error: session %d: %s\n", n, err)
+			}
+		}(sessions)
+	}
+	wg.Wait()
+	if err := scanner.Err(); err != nil {
+		fmt.Printf("replay Error: %s\n", err)
+	}
+	fmt.Printf("# Replayed %d sessions, %d failed\n", sessions, failures)
+	if failures > 0 {
+		os.Exit(1)
+	}
+}